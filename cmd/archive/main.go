@@ -7,11 +7,23 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/adammck/blobby/pkg/audit"
 	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/blobby/debughttp"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/codec"
 	"github.com/adammck/blobby/pkg/compactor"
+	"github.com/adammck/blobby/pkg/etcd"
+	"github.com/adammck/blobby/pkg/notify"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/workload"
 	"github.com/jonboulle/clockwork"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -37,24 +49,260 @@ func main() {
 		log.Fatalf("Required: S3_BUCKET")
 	}
 
-	b := blobby.New(mongoURL, bucket, clockwork.NewRealClock())
+	var opts []blobby.Option
+	if name := os.Getenv("ARCHIVE_NAME"); name != "" {
+		opts = append(opts, blobby.WithName(name))
+	}
+	if s := os.Getenv("S3_KEY_SCHEME"); s != "" {
+		scheme, err := sstable.ParseKeyScheme(s)
+		if err != nil {
+			log.Fatalf("Invalid S3_KEY_SCHEME: %v", err)
+		}
+		opts = append(opts, blobby.WithKeyScheme(scheme))
+	}
+	if s := os.Getenv("S3_EXTRA_BUCKETS"); s != "" {
+		opts = append(opts, blobby.WithBuckets(strings.Split(s, ",")...))
+	}
 
-	err := b.Ping(ctx)
-	if err != nil {
-		log.Fatalf("blobby.Ping: %v", err)
+	if id := os.Getenv("ARCHIVE_CODEC"); id != "" {
+		c, err := (&codec.Registry{}).Lookup(id)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_CODEC: %v", err)
+		}
+		opts = append(opts, blobby.WithCodec(c))
+	}
+	if s := os.Getenv("ARCHIVE_FILTER"); s != "" {
+		f, err := sstable.ParseFilterType(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_FILTER: %v", err)
+		}
+		opts = append(opts, blobby.WithFilter(f))
+	}
+	if s := os.Getenv("ARCHIVE_INLINE_FILTERS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_INLINE_FILTERS: %v", err)
+		}
+		opts = append(opts, blobby.WithInlineFilters(n))
+	}
+	if dir := os.Getenv("ARCHIVE_BLOB_CACHE"); dir != "" {
+		var size int64
+		if s := os.Getenv("ARCHIVE_BLOB_CACHE_SIZE"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid ARCHIVE_BLOB_CACHE_SIZE: %v", err)
+			}
+			size = n
+		}
+		mode := blobstore.BlobCacheTrust
+		if os.Getenv("ARCHIVE_BLOB_CACHE_VALIDATE") != "" {
+			mode = blobstore.BlobCacheValidate
+		}
+		opts = append(opts, blobby.WithBlobCache(dir, size, mode))
+	}
+	if s := os.Getenv("ARCHIVE_MAX_GET_FETCHES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_MAX_GET_FETCHES: %v", err)
+		}
+		opts = append(opts, blobby.WithMaxGetFetches(n))
+	}
+	if sep := os.Getenv("ARCHIVE_FLUSH_PARTITION_SEP"); sep != "" {
+		opts = append(opts, blobby.WithFlushPartitioner(blobby.PartitionByPrefix(sep)))
+	}
+	if os.Getenv("ARCHIVE_MANIFEST") != "" {
+		opts = append(opts, blobby.WithManifest())
+	}
+	if s := os.Getenv("ARCHIVE_DEGRADED_READS"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_DEGRADED_READS: %v", err)
+		}
+		opts = append(opts, blobby.WithDegradedReads(d))
+	}
+	if s := os.Getenv("ARCHIVE_WARMUP_INDEXES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_WARMUP_INDEXES: %v", err)
+		}
+		opts = append(opts, blobby.WithWarmup(blobby.WarmupOptions{Indexes: n}))
+	}
+	if ep := os.Getenv("ARCHIVE_ETCD_ENDPOINT"); ep != "" {
+		name := os.Getenv("ARCHIVE_NAME")
+		if name == "" {
+			name = blobby.DefaultName
+		}
+		opts = append(opts, blobby.WithCoordinator(etcd.New(ep, fmt.Sprintf("/blobby/%s/", name))))
 	}
+	if os.Getenv("ARCHIVE_AUDIT") != "" {
+		opts = append(opts, blobby.WithAudit())
+	}
+	if os.Getenv("ARCHIVE_STRICT") != "" {
+		opts = append(opts, blobby.WithStrictOrdering())
+	}
+	if os.Getenv("ARCHIVE_RECOVER_FLUSHES") != "" {
+		opts = append(opts, blobby.WithFlushRecovery())
+	}
+	if s := os.Getenv("ARCHIVE_SLOW_THRESHOLD"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_SLOW_THRESHOLD: %v", err)
+		}
+		opts = append(opts, blobby.WithSlowLog(slog.Default(), blobby.SlowThresholds{Put: d, Get: d, Flush: d, Compact: d}))
+	}
+	if s := os.Getenv("ARCHIVE_ACCESS_SAMPLE"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_ACCESS_SAMPLE: %v", err)
+		}
+		opts = append(opts, blobby.WithAccessStats(rate))
+	}
+	if s := os.Getenv("ARCHIVE_VERIFY_READS"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_VERIFY_READS: %v", err)
+		}
+		opts = append(opts, blobby.WithVerifyReads(slog.Default(), rate))
+	}
+	if caller := os.Getenv("ARCHIVE_CALLER"); caller != "" {
+		ctx = blobby.WithCaller(ctx, caller)
+	}
+	publishers := publisherOptions(ctx)
+	opts = append(opts, publishers...)
+
+	b := blobby.New(mongoURL, bucket, clockwork.NewRealClock(), opts...)
 
+	// these are the only commands which don't require an initialized archive
+	// with an up-to-date schema.
 	switch cmd {
 	case "init":
 		cmdInit(ctx, b)
+		return
+	case "migrate":
+		cmdMigrate(ctx, b)
+		return
+	case "recover-metadata":
+		cmdRecoverMetadata(ctx, b)
+		return
+	case "rebuild-metadata":
+		cmdRebuildMetadata(ctx, b)
+		return
+	}
+
+	err := b.Open(ctx)
+	if err != nil {
+		log.Fatalf("blobby.Open: %v", err)
+	}
+
+	if addr := os.Getenv("ARCHIVE_DEBUG_ADDR"); addr != "" {
+		go func() {
+			err := http.ListenAndServe(addr, debughttp.Handler(b))
+			log.Fatalf("ListenAndServe: %v", err)
+		}()
+	}
+
+	// write the sampled reads of long-running commands every minute, and the
+	// rest before exiting.
+	if os.Getenv("ARCHIVE_ACCESS_SAMPLE") != "" {
+		go func() {
+			err := b.RunAccessStats(ctx, time.Minute)
+			log.Printf("RunAccessStats: %s", err)
+		}()
+		defer func() {
+			err := b.FlushAccessStats(ctx)
+			if err != nil {
+				log.Printf("FlushAccessStats: %s", err)
+			}
+		}()
+	}
+
+	// publish events from this command, and wait for the stragglers before
+	// exiting. commands which exit via log.Fatalf might drop some.
+	if len(publishers) > 0 {
+		pctx, cancel := context.WithCancel(ctx)
+		ch := b.Events(pctx)
+		done := make(chan struct{})
+		go func() {
+			b.PublishEvents(ctx, ch, func(err error) { log.Printf("PublishEvents: %s", err) })
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	switch cmd {
 	case "put":
 		cmdPut(ctx, b, os.Stdin)
 	case "get":
-		cmdGet(ctx, b, os.Args[2])
+		cmdGet(ctx, b)
 	case "flush":
 		cmdFlush(ctx, b)
 	case "compact":
 		cmdCompact(ctx, b, bucket)
+	case "checkpoint":
+		cmdCheckpoint(ctx, b, os.Args[2])
+	case "checkpoints":
+		cmdCheckpoints(ctx, b)
+	case "rollback":
+		cmdRollback(ctx, b, os.Args[2])
+	case "clone":
+		cmdClone(ctx, b, os.Args[2])
+	case "destroy":
+		cmdDestroy(ctx, b, os.Args[2])
+	case "import":
+		cmdImport(ctx, b)
+	case "export":
+		cmdExport(ctx, b)
+	case "sync":
+		cmdSync(ctx, b)
+	case "export-rocksdb":
+		cmdExportRocksDB(ctx, b)
+	case "import-rocksdb":
+		cmdImportRocksDB(ctx, b)
+	case "reconcile":
+		cmdReconcile(ctx, b)
+	case "purge":
+		cmdPurge(ctx, b)
+	case "recover-compactions":
+		cmdRecoverCompactions(ctx, b)
+	case "build-indexes":
+		cmdBuildIndexes(ctx, b)
+	case "count":
+		cmdCount(ctx, b)
+	case "autoflush":
+		cmdAutoflush(ctx, b)
+	case "audit":
+		cmdAudit(ctx, b)
+	case "compactions":
+		cmdCompactions(ctx, b)
+	case "windows":
+		cmdWindows(ctx, b)
+	case "sstables":
+		cmdSSTables(ctx, b)
+	case "cold":
+		cmdCold(ctx, b)
+	case "memtables":
+		cmdMemtables(ctx, b)
+	case "publish-manifest":
+		cmdPublishManifest(ctx, b)
+	case "namespaces":
+		cmdNamespaces(b)
+	case "set-namespace":
+		cmdSetNamespace(ctx, b)
+	case "maintenance":
+		cmdMaintenance(ctx, b)
+	case "config":
+		cmdConfig(ctx, b)
+	case "pause":
+		cmdPause(ctx, b, true)
+	case "resume":
+		cmdPause(ctx, b, false)
+	case "bench":
+		cmdBench(ctx, b)
+	case "loadgen":
+		cmdLoadgen(ctx, b)
 	default:
 		log.Fatalf("Unknown command: %s", cmd)
 	}
@@ -68,6 +316,11 @@ type compactFlags struct {
 	maxSize  int64
 	minTime  string
 	maxTime  string
+	maxMem   int
+	verify   bool
+	progress bool
+	maxDur   time.Duration
+	dryRun   bool
 }
 
 func cmdCompact(ctx context.Context, b *blobby.Blobby, bucket string) {
@@ -81,12 +334,23 @@ func cmdCompact(ctx context.Context, b *blobby.Blobby, bucket string) {
 	flags.Int64Var(&cf.maxSize, "max-size", 0, "Maximum total input size in bytes")
 	flags.StringVar(&cf.minTime, "min-time", "", "Only include records newer than this (RFC3339)")
 	flags.StringVar(&cf.maxTime, "max-time", "", "Only include records older than this (RFC3339)")
+	flags.IntVar(&cf.maxMem, "max-memory", 0, "Approximate memory in bytes to buffer inputs (0 for default)")
+	flags.BoolVar(&cf.verify, "verify", false, "Re-read each output and check it against the inputs before committing (slow)")
+	flags.BoolVar(&cf.progress, "progress", false, "Print progress to stderr")
+	flags.DurationVar(&cf.maxDur, "max-duration", 0, "Stop starting compactions, and abandon any unfinished one, after this long")
+	flags.BoolVar(&cf.dryRun, "dry-run", false, "Print the compactions which would run, and their estimated cost, without running them")
 
 	flags.Parse(os.Args[2:])
 
 	opts := compactor.CompactionOptions{
-		MinFiles: cf.minFiles,
-		MaxFiles: cf.maxFiles,
+		MinFiles:    cf.minFiles,
+		MaxFiles:    cf.maxFiles,
+		MaxMemory:   cf.maxMem,
+		Verify:      cf.verify,
+		MaxDuration: cf.maxDur,
+	}
+	if cf.progress {
+		opts.Progress = printProgress
 	}
 
 	switch cf.order {
@@ -125,6 +389,23 @@ func cmdCompact(ctx context.Context, b *blobby.Blobby, bucket string) {
 		opts.MaxTime = t
 	}
 
+	if cf.dryRun {
+		plans, err := b.PlanCompactions(ctx, opts)
+		if err != nil {
+			log.Fatalf("PlanCompactions: %v", err)
+		}
+
+		for i, p := range plans {
+			e := p.Estimate
+			fmt.Printf("Compaction %d: %s\n", i+1, p.Reason)
+			fmt.Printf("  GETs: %d (%d bytes)\n", e.Requests["GetObject"], e.BytesReceived)
+			fmt.Printf("  PUTs: %d (%d bytes)\n", e.Requests["PutObject"], e.BytesSent)
+			fmt.Printf("  DELETEs: %d\n", e.Requests["DeleteObject"])
+			fmt.Printf("  Estimated cost: $%.6f\n", p.Dollars)
+		}
+		return
+	}
+
 	stats, err := b.Compact(ctx, opts)
 	if err != nil {
 		log.Fatalf("Compact: %v", err)
@@ -140,13 +421,31 @@ func cmdCompact(ctx context.Context, b *blobby.Blobby, bucket string) {
 		fmt.Printf("  Input files: %d\n", len(s.Inputs))
 		fmt.Printf("  Output files: %d\n", len(s.Outputs))
 		for j, m := range s.Outputs {
-			fmt.Printf("  Output %d: s3://%s/%s (%d records, %d bytes)\n", j+1, bucket, m.Filename(), m.Count, m.Size)
+			bkt := bucket
+			if m.Bucket != "" {
+				bkt = m.Bucket
+			}
+			fmt.Printf("  Output %d: s3://%s/%s (%d records, %d bytes)\n", j+1, bkt, m.Filename(), m.Count, m.Size)
 		}
 	}
 }
 
 func cmdInit(ctx context.Context, b *blobby.Blobby) {
-	err := b.Init(ctx)
+	err := b.Ping(ctx)
+	if err != nil {
+		log.Fatalf("blobby.Ping: %v", err)
+	}
+
+	ok, err := b.Initialized(ctx)
+	if err != nil {
+		log.Fatalf("blobby.Initialized: %s", err)
+	}
+	if ok {
+		fmt.Println("Already initialized")
+		return
+	}
+
+	err = b.Init(ctx)
 	if err != nil {
 		log.Fatalf("blobby.Init: %s", err)
 	}
@@ -190,10 +489,32 @@ func cmdPut(ctx context.Context, b *blobby.Blobby, r io.Reader) {
 	fmt.Printf("Wrote %d documents to: %s\n", n, dest)
 }
 
-func cmdGet(ctx context.Context, b *blobby.Blobby, key string) {
-	bb, stats, err := b.Get(ctx, key)
+func cmdGet(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	source := flags.String("source", "all", "Where to read from: all, memtable, or sstables")
+	flags.Parse(os.Args[2:])
+
+	if flags.NArg() != 1 {
+		log.Fatalf("Usage: get [-source all|memtable|sstables] <key>")
+	}
+
+	opts := blobby.GetOptions{}
+	switch *source {
+	case "all":
+	case "memtable":
+		opts.Source = blobby.SourceMemtable
+	case "sstables":
+		opts.Source = blobby.SourceSSTables
+	default:
+		log.Fatalf("unknown source: %q", *source)
+	}
+
+	bb, _, stats, err := b.GetWithOptions(ctx, flags.Arg(0), opts)
 	if err != nil {
-		log.Fatalf("Get: %s", err)
+		log.Fatalf("GetWithOptions: %s", err)
+	}
+	if bb == nil {
+		log.Fatalf("Not found in %s: %s", *source, flags.Arg(0))
 	}
 
 	o := map[string]interface{}{}
@@ -209,15 +530,1023 @@ func cmdGet(ctx context.Context, b *blobby.Blobby, key string) {
 
 	fmt.Fprintf(os.Stderr, "Scanned %d records in %d blobs\n", stats.RecordsScanned, stats.BlobsFetched)
 	fmt.Fprintf(os.Stderr, "Found 1 record in: %s\n", stats.Source)
+	if stats.Degraded {
+		fmt.Fprintf(os.Stderr, "Warning: Mongo is unavailable, so this might be stale as of: %s\n", stats.ManifestTime)
+	}
 	fmt.Printf("%s\n", out)
 }
 
 func cmdFlush(ctx context.Context, b *blobby.Blobby) {
-	stats, err := b.Flush(ctx)
+	flags := flag.NewFlagSet("flush", flag.ExitOnError)
+	opts := blobby.FlushOptions{}
+
+	flags.BoolVar(&opts.Force, "force", false, "Flush regardless of min-records and max-age")
+	flags.IntVar(&opts.MinRecords, "min-records", 0, "Only flush if the memtable contains at least this many records")
+	flags.DurationVar(&opts.MaxAge, "max-age", 0, "Only flush if the oldest record in the memtable is older than this")
+	flags.DurationVar(&opts.MaxDuration, "max-duration", 0, "Stop after this long, and leave the rest of the memtable for the next flush")
+	flags.IntVar(&opts.BatchSize, "batch-size", blobby.DefaultFlushBatchSize, "Read this many records from the memtable at once")
+	progress := flags.Bool("progress", false, "Print progress to stderr")
+
+	flags.Parse(os.Args[2:])
+
+	if *progress {
+		opts.Progress = printProgress
+	}
+
+	stats, err := b.Flush(ctx, opts)
 	if err != nil {
 		log.Fatalf("Flush: %s", err)
 	}
 
-	fmt.Printf("Flushed %d documents to: %s\n", stats.Meta.Count, stats.BlobURL)
+	if stats.Skipped {
+		fmt.Println("Nothing to flush")
+		return
+	}
+
+	if len(stats.Outputs) == 0 {
+		fmt.Println("Every record had expired; nothing written")
+	}
+	for _, m := range stats.Outputs {
+		fmt.Printf("Flushed %d documents to: %s\n", m.Count, m.Filename())
+	}
+	if stats.Partial {
+		fmt.Printf("Ran out of time; %d documents left in: %s\n", stats.Remaining, stats.FlushedMemtableURL)
+	}
 	fmt.Printf("Active memtable is now: %s\n", stats.ActiveMemtable)
 }
+
+// printProgress prints the progress of a flush or compaction to stderr.
+func printProgress(p blobby.Progress) {
+	msg := fmt.Sprintf("%s: %d", p.Phase, p.Records)
+	if p.TotalRecords > 0 {
+		msg += fmt.Sprintf("/%d", p.TotalRecords)
+	}
+	msg += fmt.Sprintf(" records, %d bytes uploaded, %s elapsed", p.BytesUploaded, p.Elapsed.Round(time.Millisecond))
+	if p.ETA > 0 {
+		msg += fmt.Sprintf(", ~%s left", p.ETA.Round(time.Second))
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+func cmdAutoflush(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("autoflush", flag.ExitOnError)
+	p := blobby.AgeFlushPolicy{}
+
+	flags.DurationVar(&p.MaxAge, "max-age", 5*time.Minute, "Flush when the oldest record in the memtable is older than this")
+	flags.DurationVar(&p.Interval, "interval", 0, "How often to check the memtable (default max-age/10)")
+	leader := flags.Bool("leader", false, "Only flush while this process is the leader, so several can run at once")
+
+	flags.Parse(os.Args[2:])
+
+	lag, err := b.MemtableLag(ctx)
+	if err != nil {
+		log.Fatalf("MemtableLag: %s", err)
+	}
+
+	fmt.Printf("Memtable lag is: %s\n", lag)
+	fmt.Printf("Flushing when lag exceeds: %s\n", p.MaxAge)
+
+	if *leader {
+		err = b.RunAsLeader(ctx, blobby.LeaderOptions{Name: "autoflush"}, func(ctx context.Context) error {
+			fmt.Printf("Became leader: %s\n", b.Owner())
+			defer fmt.Printf("Stopped leading: %s\n", b.Owner())
+			return b.RunAgeFlushPolicy(ctx, p)
+		})
+	} else {
+		err = b.RunAgeFlushPolicy(ctx, p)
+	}
+	if err != nil {
+		log.Fatalf("RunAgeFlushPolicy: %s", err)
+	}
+}
+
+func cmdCheckpoint(ctx context.Context, b *blobby.Blobby, name string) {
+	cp, err := b.Checkpoint(ctx, name)
+	if err != nil {
+		log.Fatalf("Checkpoint: %s", err)
+	}
+
+	fmt.Printf("Checkpoint %s contains %d sstables\n", cp.Name, len(cp.Metas))
+}
+
+func cmdCheckpoints(ctx context.Context, b *blobby.Blobby) {
+	cps, err := b.ListCheckpoints(ctx)
+	if err != nil {
+		log.Fatalf("ListCheckpoints: %s", err)
+	}
+
+	for _, cp := range cps {
+		fmt.Printf("%s\t%s\t%d sstables\n", cp.Name, cp.Created.Format(time.RFC3339), len(cp.Metas))
+	}
+}
+
+func cmdRollback(ctx context.Context, b *blobby.Blobby, name string) {
+	undo, err := b.RollbackTo(ctx, name)
+	if err != nil {
+		log.Fatalf("RollbackTo: %s", err)
+	}
+
+	fmt.Printf("Rolled back to checkpoint: %s\n", name)
+	fmt.Printf("To undo, roll back to: %s\n", undo.Name)
+}
+
+func cmdClone(ctx context.Context, b *blobby.Blobby, target string) {
+	_, err := b.Clone(ctx, target)
+	if err != nil {
+		log.Fatalf("Clone: %s", err)
+	}
+
+	fmt.Printf("Cloned %s to: %s\n", b.Name(), target)
+}
+
+func cmdDestroy(ctx context.Context, b *blobby.Blobby, confirm string) {
+	flags := flag.NewFlagSet("destroy", flag.ExitOnError)
+	opts := blobby.DestroyOptions{}
+
+	flags.BoolVar(&opts.DeleteOrphans, "delete-orphans", false, "Also delete unreferenced sstables (only if the bucket isn't shared)")
+
+	flags.Parse(os.Args[3:])
+
+	stats, err := b.Destroy(ctx, confirm, opts)
+	if err != nil {
+		log.Fatalf("Destroy: %s", err)
+	}
+
+	fmt.Printf("Destroyed %s, and deleted %d blobs (%d orphans, %d shared blobs kept)\n", b.Name(), stats.BlobsDeleted, stats.OrphansDeleted, stats.BlobsKept)
+}
+
+func cmdMigrate(ctx context.Context, b *blobby.Blobby) {
+	ms, err := b.Migrate(ctx)
+	for _, m := range ms {
+		fmt.Printf("Migrated to version %d: %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		log.Fatalf("Migrate: %s", err)
+	}
+
+	if len(ms) == 0 {
+		fmt.Println("Already up to date")
+	}
+}
+
+func cmdReconcile(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	opts := blobby.ReconcileOptions{}
+
+	flags.BoolVar(&opts.DeleteOrphans, "delete-orphans", false, "Delete unreferenced sstables (only if the bucket isn't shared)")
+	flags.DurationVar(&opts.MinOrphanAge, "min-orphan-age", time.Hour, "Ignore unreferenced sstables newer than this")
+
+	flags.Parse(os.Args[2:])
+
+	stats, err := b.Reconcile(ctx, opts)
+	if err != nil {
+		log.Fatalf("Reconcile: %s", err)
+	}
+
+	fmt.Printf("Listed %d sstables, %d referenced by metadata\n", stats.BlobsListed, stats.BlobsReferenced)
+	for _, key := range stats.Orphans {
+		fmt.Printf("  Orphan: %s\n", key)
+	}
+	for _, key := range stats.Missing {
+		fmt.Printf("  Missing: %s\n", key)
+	}
+	if opts.DeleteOrphans {
+		fmt.Printf("Deleted %d orphans\n", stats.OrphansDeleted)
+	}
+}
+
+func cmdImport(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	opts := blobby.ImportOptions{}
+
+	flags.StringVar(&opts.Bucket, "bucket", "", "Bucket to import the objects from (default: the archive's)")
+	flags.StringVar(&opts.Prefix, "prefix", "", "Only import objects whose keys start with this")
+	flags.BoolVar(&opts.TrimPrefix, "trim-prefix", false, "Remove the prefix from the keys")
+	flags.StringVar(&opts.StartAfter, "start-after", "", "Resume after this object key")
+	flags.Int64Var(&opts.SSTableSize, "sstable-size", blobby.DefaultImportSSTableSize, "Bytes of values to write to each sstable")
+	flags.IntVar(&opts.Concurrency, "concurrency", blobby.ImportConcurrency, "Number of objects to fetch at once")
+	flags.BoolVar(&opts.SkipInvalid, "skip-invalid", false, "Skip objects which aren't valid JSON")
+	format := flags.String("format", "s3", "Where to import from: s3, or jsonl or csv from files or stdin")
+
+	// only for jsonl and csv.
+	sopts := blobby.StreamImportOptions{}
+	flags.StringVar(&sopts.KeyField, "key", blobby.DefaultKeyField, "Field containing the key of each row")
+	flags.BoolVar(&sopts.Direct, "direct", false, "Write straight to sstables, rather than via the memtable")
+	flags.IntVar(&sopts.BatchSize, "batch-size", blobby.DefaultStreamBatchSize, "Rows to write per batch (without -direct)")
+	dedup := flags.String("dedup", "", "What to do with repeated keys: first to keep the first, reject to reject the rest (default: last wins)")
+	rejects := flags.String("rejects", "", "File to write rejected rows to (default: fail on the first)")
+
+	flags.Parse(os.Args[2:])
+
+	if *format != "s3" {
+		sopts.Format = *format
+		sopts.SSTableSize = opts.SSTableSize
+		sopts.Dedup = blobby.DedupMode(*dedup)
+		cmdImportStream(ctx, b, sopts, *rejects, flags.Args())
+		return
+	}
+
+	stats, err := b.Import(ctx, opts)
+	if stats != nil && stats.LastKey != "" {
+		fmt.Printf("Imported through: %s\n", stats.LastKey)
+	}
+	if err != nil {
+		log.Fatalf("Import: %s", err)
+	}
+
+	fmt.Printf("Listed %d objects, imported %d (%d bytes) to %d sstables, skipped %d\n",
+		stats.Listed, stats.Imported, stats.Bytes, len(stats.Outputs), stats.Skipped)
+}
+
+func cmdImportStream(ctx context.Context, b *blobby.Blobby, opts blobby.StreamImportOptions, rejects string, paths []string) {
+	switch opts.Dedup {
+	case blobby.DedupNone, blobby.DedupFirst, blobby.DedupReject:
+	default:
+		log.Fatalf("invalid -dedup: %q", opts.Dedup)
+	}
+
+	if rejects != "" {
+		f, err := os.Create(rejects)
+		if err != nil {
+			log.Fatalf("Create: %s", err)
+		}
+		defer f.Close()
+		opts.Rejects = f
+	}
+
+	opts.Progress = func(stats *blobby.StreamImportStats) {
+		fmt.Fprintf(os.Stderr, "Read %d rows, imported %d (%d bytes)\n", stats.Rows, stats.Imported, stats.Bytes)
+	}
+
+	var r io.Reader = os.Stdin
+	if len(paths) > 0 {
+		var readers []io.Reader
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Fatalf("Open: %s", err)
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+		r = io.MultiReader(readers...)
+	}
+
+	// each csv file would have its own header.
+	if opts.Format == blobby.FormatCSV && len(paths) > 1 {
+		log.Fatalf("only one csv file can be imported at once")
+	}
+
+	stats, err := b.ImportStream(ctx, r, opts)
+	if err != nil {
+		log.Fatalf("ImportStream: %s", err)
+	}
+
+	fmt.Printf("Read %d rows, imported %d (%d bytes) in %d batches, skipped %d duplicates, rejected %d\n",
+		stats.Rows, stats.Imported, stats.Bytes, stats.Batches, stats.Duplicates, stats.Rejected)
+}
+
+func cmdExport(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	opts := blobby.ExportOptions{}
+
+	to := flags.String("to", "jsonl", "Where to export to: jsonl, s3, or archive")
+	out := flags.String("out", "", "Path to write to, for jsonl (default: stdout)")
+	bucket := flags.String("bucket", "", "Bucket to write objects to, for s3 (default: the archive's)")
+	prefix := flags.String("prefix", "", "Prefix of the object keys, for s3")
+	concurrency := flags.Int("concurrency", blobby.ExportConcurrency, "Number of objects to write at once, for s3")
+	archive := flags.String("archive", "", "Name of the archive to write to, for archive")
+	flags.StringVar(&opts.Start, "start", "", "First key to export")
+	flags.StringVar(&opts.End, "end", "", "Export keys before this (default: unbounded)")
+
+	flags.Parse(os.Args[2:])
+
+	var target blobby.ExportTarget
+	switch *to {
+	case "jsonl":
+		w := os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Fatalf("Create: %s", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		target = blobby.JSONLTarget(w)
+
+	case "s3":
+		if *prefix == "" && *bucket == "" {
+			log.Fatalf("-prefix is required when exporting to the archive's bucket")
+		}
+		target = b.S3Target(*bucket, *prefix, *concurrency)
+
+	case "archive":
+		if *archive == "" {
+			log.Fatalf("-archive is required")
+		}
+		dst := b.Sibling(*archive)
+		err := dst.Open(ctx)
+		if err != nil {
+			log.Fatalf("Open(%s): %s", *archive, err)
+		}
+		target = blobby.ArchiveTarget(dst)
+
+	default:
+		log.Fatalf("invalid -to: %q", *to)
+	}
+
+	stats, err := b.ExportLatest(ctx, target, opts)
+	if err != nil {
+		log.Fatalf("ExportLatest: %s", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d keys (%d bytes) as of %s\n", stats.Keys, stats.Bytes, stats.At.Format(time.RFC3339))
+}
+
+func cmdSync(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	opts := blobby.SyncOptions{}
+
+	mongoURL := flags.String("mongo", os.Getenv("MONGO_URL"), "Mongo URL of the target archive")
+	bucket := flags.String("bucket", os.Getenv("S3_BUCKET"), "Bucket of the target archive")
+	archive := flags.String("archive", blobby.DefaultName, "Name of the target archive, which must be initialized")
+	flags.StringVar(&opts.Name, "name", "", "Name of the sync (default: the target's name)")
+	flags.DurationVar(&opts.Overlap, "overlap", blobby.DefaultSyncOverlap, "How far back each pass rereads")
+	interval := flags.Duration("interval", 0, "Keep running, this often (default is to run once)")
+	reset := flags.Bool("reset", false, "Forget the cursor, and start over with a full copy")
+
+	flags.Parse(os.Args[2:])
+
+	dst := blobby.New(*mongoURL, *bucket, clockwork.NewRealClock(), blobby.WithName(*archive))
+	err := dst.Open(ctx)
+	if err != nil {
+		log.Fatalf("Open(%s): %s", *archive, err)
+	}
+
+	if *reset {
+		name := opts.Name
+		if name == "" {
+			name = dst.Name()
+		}
+		err = b.ResetSync(ctx, name)
+		if err != nil {
+			log.Fatalf("ResetSync: %s", err)
+		}
+	}
+
+	report := func(stats *blobby.SyncStats, err error) {
+		if err != nil {
+			fmt.Printf("Sync failed, lag %s: %s\n", stats.Lag, err)
+			return
+		}
+		if stats.Initial {
+			fmt.Printf("Copied %d keys (%d bytes), lag %s\n", stats.Export.Keys, stats.Export.Bytes, stats.Lag)
+			return
+		}
+		fmt.Printf("Copied %d changes in %d batches, lag %s\n", stats.Records, stats.Batches, stats.Lag)
+	}
+
+	if *interval > 0 {
+		err := b.RunSync(ctx, dst, *interval, opts, report)
+		if err != nil {
+			log.Fatalf("RunSync: %s", err)
+		}
+		return
+	}
+
+	stats, err := b.Sync(ctx, dst, opts)
+	if err != nil {
+		log.Fatalf("Sync: %s", err)
+	}
+	report(stats, nil)
+}
+
+func cmdExportRocksDB(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("export-rocksdb", flag.ExitOnError)
+	opts := blobby.ExportRocksDBOptions{}
+
+	out := flags.String("out", "", "Path to write the SST file to")
+	flags.StringVar(&opts.Start, "start", "", "First key to export")
+	flags.StringVar(&opts.End, "end", "", "Export keys before this (default: unbounded)")
+
+	flags.Parse(os.Args[2:])
+	if *out == "" {
+		log.Fatalf("-out is required")
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Create: %s", err)
+	}
+
+	stats, err := b.ExportRocksDB(ctx, f, opts)
+	if err != nil {
+		f.Close()
+		log.Fatalf("ExportRocksDB: %s", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		log.Fatalf("Close: %s", err)
+	}
+
+	fmt.Printf("Exported %d keys (%d bytes) to %s\n", stats.Keys, stats.Bytes, *out)
+}
+
+func cmdImportRocksDB(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("import-rocksdb", flag.ExitOnError)
+	opts := blobby.ImportRocksDBOptions{}
+
+	in := flags.String("in", "", "Path of the SST file to import")
+	flags.Int64Var(&opts.SSTableSize, "sstable-size", blobby.DefaultImportSSTableSize, "Bytes of values to write to each sstable")
+	flags.BoolVar(&opts.SkipInvalid, "skip-invalid", false, "Skip values which aren't valid JSON")
+
+	flags.Parse(os.Args[2:])
+	if *in == "" {
+		log.Fatalf("-in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Stat: %s", err)
+	}
+
+	stats, err := b.ImportRocksDB(ctx, f, fi.Size(), opts)
+	if err != nil {
+		log.Fatalf("ImportRocksDB: %s", err)
+	}
+
+	fmt.Printf("Read %d entries, imported %d (%d bytes) to %d sstables, skipped %d\n",
+		stats.Listed, stats.Imported, stats.Bytes, len(stats.Outputs), stats.Skipped)
+}
+
+func cmdRecoverCompactions(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("recover-compactions", flag.ExitOnError)
+	grace := flags.Duration("grace", compactor.ClaimTimeout, "Only recover compactions prepared longer ago than this")
+	flags.Parse(os.Args[2:])
+
+	stats, err := b.RecoverCompactions(ctx, *grace)
+	if err != nil {
+		log.Fatalf("RecoverCompactions: %s", err)
+	}
+
+	fmt.Printf("Rolled forward %d compactions, and rolled back %d\n", len(stats.RolledForward), len(stats.RolledBack))
+}
+
+func cmdPurge(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	grace := flags.Duration("grace", blobby.DefaultPurgeGrace, "Only purge sstables superseded longer ago than this")
+	flags.Parse(os.Args[2:])
+
+	stats, err := b.Purge(ctx, *grace)
+	if err != nil {
+		log.Fatalf("Purge: %s", err)
+	}
+
+	fmt.Printf("Purged %d sstables, and deleted %d blobs\n", len(stats.Purged), stats.BlobsDeleted)
+}
+
+func cmdBuildIndexes(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("build-indexes", flag.ExitOnError)
+	opts := blobby.IndexOptions{}
+
+	flags.IntVar(&opts.MaxSSTables, "max", 0, "Maximum number of indexes to build per run (0 for unlimited)")
+	interval := flags.Duration("interval", 0, "Keep running, this often (default is to run once)")
+
+	flags.Parse(os.Args[2:])
+
+	report := func(stats *blobby.IndexStats) {
+		fmt.Printf("Built %d of %d missing indexes (%d discarded)\n", stats.Built, stats.Missing, stats.Discarded)
+	}
+
+	if *interval > 0 {
+		err := b.RunBuildIndexes(ctx, *interval, opts, report)
+		if err != nil {
+			log.Fatalf("RunBuildIndexes: %s", err)
+		}
+		return
+	}
+
+	stats, err := b.BuildIndexes(ctx, opts)
+	if err != nil {
+		log.Fatalf("BuildIndexes: %s", err)
+	}
+
+	report(stats)
+}
+
+func cmdCount(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("count", flag.ExitOnError)
+	opts := blobby.ScanOptions{}
+
+	flags.StringVar(&opts.Start, "start", "", "Only count keys at or after this one")
+	flags.StringVar(&opts.End, "end", "", "Only count keys before this one (default is unbounded)")
+	exact := flags.Bool("exact", false, "Count exactly, by scanning every sstable (default is to estimate from the metadata)")
+
+	flags.Parse(os.Args[2:])
+
+	n, err := b.Count(ctx, opts, *exact)
+	if err != nil {
+		log.Fatalf("Count: %s", err)
+	}
+
+	fmt.Println(n)
+}
+
+func cmdAudit(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	f := blobby.AuditFilter{}
+	var op, since string
+
+	flags.StringVar(&op, "op", "", "Only show this operation (put, flush, compact, purge, checkpoint, rollback)")
+	flags.StringVar(&f.Caller, "caller", "", "Only show operations by this caller")
+	flags.StringVar(&f.Key, "key", "", "Only show operations which wrote this key")
+	flags.StringVar(&since, "since", "", "Only show operations after this time (RFC3339)")
+	flags.IntVar(&f.Limit, "limit", 100, "Maximum number of entries to show (0 for unlimited)")
+
+	flags.Parse(os.Args[2:])
+
+	f.Op = audit.Op(op)
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			log.Fatalf("Invalid since: %v", err)
+		}
+		f.Since = t
+	}
+
+	entries, err := b.AuditLog(ctx, f)
+	if err != nil {
+		log.Fatalf("AuditLog: %s", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			log.Fatalf("Encode: %s", err)
+		}
+	}
+}
+
+func cmdWindows(ctx context.Context, b *blobby.Blobby) {
+	ws, err := b.Windows(ctx)
+	if err != nil {
+		log.Fatalf("Windows: %s", err)
+	}
+
+	for _, w := range ws {
+		fmt.Printf("%s: %d sstables, keys [%s, %s], newest record %s\n", w.Start.Format(time.DateOnly), w.Count, w.MinKey, w.MaxKey, w.MaxTime.Format(time.RFC3339))
+	}
+}
+
+func cmdSSTables(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("sstables", flag.ExitOnError)
+	opts := blobby.ListOptions{SkipFilters: true}
+	var order string
+
+	flags.StringVar(&order, "order", "min-key", "Order to list sstables in: min-key, created, or size")
+	flags.BoolVar(&opts.Desc, "desc", false, "List in descending order")
+	flags.StringVar(&opts.After, "after", "", "Token printed by the previous page")
+	flags.IntVar(&opts.Limit, "limit", 100, "Maximum number of sstables to show")
+
+	flags.Parse(os.Args[2:])
+
+	switch order {
+	case "min-key":
+		opts.Order = blobby.ByMinKey
+	case "created":
+		opts.Order = blobby.ByCreated
+	case "size":
+		opts.Order = blobby.BySize
+	default:
+		log.Fatalf("Invalid order: %s", order)
+	}
+
+	metas, next, err := b.ListSSTables(ctx, opts)
+	if err != nil {
+		log.Fatalf("ListSSTables: %s", err)
+	}
+
+	for _, m := range metas {
+		fmt.Printf("%s: keys [%s, %s], %d records, %d bytes, created %s\n", m.Filename(), m.MinKey, m.MaxKey, m.Count, m.Size, m.Created.Format(time.RFC3339))
+	}
+
+	if next != "" {
+		fmt.Printf("Next page: -after %s\n", next)
+	}
+}
+
+func cmdCold(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("cold", flag.ExitOnError)
+	days := flags.Int("days", 30, "List sstables which haven't been read for this many days")
+	flags.Parse(os.Args[2:])
+
+	cold, err := b.ColdSSTables(ctx, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		log.Fatalf("ColdSSTables: %s", err)
+	}
+
+	var bytes int64
+	for _, a := range cold {
+		last := "never"
+		if !a.LastRead.IsZero() {
+			last = a.LastRead.Format(time.RFC3339)
+		}
+		fmt.Printf("%s: keys [%s, %s], %d bytes, last read %s (~%.0f reads), idle %s\n",
+			a.Meta.Filename(), a.Meta.MinKey, a.Meta.MaxKey, a.Meta.Size, last, a.Reads, a.Idle.Round(time.Hour))
+		bytes += int64(a.Meta.Size)
+	}
+
+	fmt.Printf("%d sstables (%d bytes) not read in %d days\n", len(cold), bytes, *days)
+}
+
+func cmdMemtables(ctx context.Context, b *blobby.Blobby) {
+	ms, err := b.MemtableStats(ctx)
+	if err != nil {
+		log.Fatalf("MemtableStats: %s", err)
+	}
+
+	fmt.Printf("Active: %s\n", ms.Active)
+	fmt.Printf("Waiting to flush: %d %v\n", len(ms.Inactive), ms.Inactive)
+	fmt.Printf("Unflushed: %d records, %d bytes\n", ms.Records, ms.Bytes)
+	if !ms.Oldest.IsZero() {
+		fmt.Printf("Oldest: %s (%s ago)\n", ms.Oldest.Format(time.RFC3339), ms.Lag.Round(time.Second))
+	}
+}
+
+func cmdCompactions(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("compactions", flag.ExitOnError)
+	f := blobby.HistoryFilter{}
+	var since string
+	var lineage bool
+
+	flags.StringVar(&f.Filename, "file", "", "Only show compactions which read or wrote this sstable")
+	flags.BoolVar(&lineage, "lineage", false, "Show every compaction which contributed to -file instead")
+	flags.StringVar(&since, "since", "", "Only show compactions started after this time (RFC3339)")
+	flags.IntVar(&f.Limit, "limit", 100, "Maximum number of compactions to show (0 for unlimited)")
+
+	flags.Parse(os.Args[2:])
+
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			log.Fatalf("Invalid since: %v", err)
+		}
+		f.Since = t
+	}
+
+	var rs []*blobby.CompactionRecord
+	var err error
+	if lineage {
+		if f.Filename == "" {
+			log.Fatalf("-lineage requires -file")
+		}
+		rs, err = b.Lineage(ctx, f.Filename)
+		if err != nil {
+			log.Fatalf("Lineage: %s", err)
+		}
+	} else {
+		rs, err = b.CompactionHistory(ctx, f)
+		if err != nil {
+			log.Fatalf("CompactionHistory: %s", err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range rs {
+		err = enc.Encode(r)
+		if err != nil {
+			log.Fatalf("Encode: %s", err)
+		}
+	}
+}
+
+func cmdNamespaces(b *blobby.Blobby) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, ns := range b.Namespaces() {
+		err := enc.Encode(ns)
+		if err != nil {
+			log.Fatalf("Encode: %s", err)
+		}
+	}
+}
+
+func cmdSetNamespace(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("set-namespace", flag.ExitOnError)
+	cfg := &blobby.NamespaceConfig{}
+	var del bool
+
+	flags.StringVar(&cfg.Prefix, "prefix", "", "Key prefix of the namespace (required)")
+	flags.StringVar(&cfg.Codec, "codec", "", "Codec to encode new values with")
+	flags.DurationVar(&cfg.Retention, "retention", 0, "How long to keep superseded versions")
+	flags.IntVar(&cfg.MaxVersions, "max-versions", 0, "Number of versions of each key to keep")
+	flags.DurationVar(&cfg.TTL, "ttl", 0, "How long new records stay in the memtable before expiring")
+	flags.BoolVar(&del, "delete", false, "Remove the namespace config instead")
+
+	flags.Parse(os.Args[2:])
+
+	if cfg.Prefix == "" {
+		log.Fatalf("Required: --prefix")
+	}
+
+	if del {
+		err := b.DeleteNamespace(ctx, cfg.Prefix)
+		if err != nil {
+			log.Fatalf("DeleteNamespace: %s", err)
+		}
+		return
+	}
+
+	err := b.SetNamespace(ctx, cfg)
+	if err != nil {
+		log.Fatalf("SetNamespace: %s", err)
+	}
+}
+
+// windowsFlag collects the values of a repeated -window flag.
+type windowsFlag []blobby.MaintenanceWindow
+
+func (f *windowsFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *windowsFlag) Set(s string) error {
+	w, err := blobby.ParseMaintenanceWindow(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, w)
+	return nil
+}
+
+func cmdMaintenance(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	var windows windowsFlag
+	var task string
+	var clear bool
+
+	flags.StringVar(&task, "task", "", "Task to set the windows of (compaction, gc)")
+	flags.Var(&windows, "window", `When the task may run, e.g. "mon-fri 01:00-05:00 Europe/London" (repeatable)`)
+	flags.BoolVar(&clear, "clear", false, "Allow the task to run at any time")
+
+	flags.Parse(os.Args[2:])
+
+	if task != "" {
+		if len(windows) == 0 && !clear {
+			log.Fatalf("Required: --window or --clear")
+		}
+
+		err := b.SetMaintenanceWindows(ctx, task, windows)
+		if err != nil {
+			log.Fatalf("SetMaintenanceWindows: %s", err)
+		}
+	}
+
+	ms, err := b.MaintenanceSchedule(ctx)
+	if err != nil {
+		log.Fatalf("MaintenanceSchedule: %s", err)
+	}
+
+	for _, t := range []string{blobby.TaskCompaction, blobby.TaskGC} {
+		if len(ms[t]) == 0 {
+			fmt.Printf("%s: any time\n", t)
+			continue
+		}
+		for _, w := range ms[t] {
+			fmt.Printf("%s: %s\n", t, w)
+		}
+	}
+}
+
+// quotaRatesFlag collects the values of a repeated -quota-rate flag, like
+// "a/=10:5", which is ten puts and five gets per second.
+type quotaRatesFlag []blobby.QuotaRate
+
+func (f *quotaRatesFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *quotaRatesFlag) Set(s string) error {
+	prefix, rates, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected prefix=puts:gets, got: %q", s)
+	}
+
+	puts, gets, ok := strings.Cut(rates, ":")
+	if !ok {
+		return fmt.Errorf("expected prefix=puts:gets, got: %q", s)
+	}
+
+	r := blobby.QuotaRate{Prefix: prefix}
+	var err error
+	r.PutsPerSecond, err = strconv.ParseFloat(puts, 64)
+	if err != nil {
+		return err
+	}
+	r.GetsPerSecond, err = strconv.ParseFloat(gets, 64)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, r)
+	return nil
+}
+
+func cmdConfig(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	cfg := *b.RuntimeConfig()
+	var rates quotaRatesFlag
+
+	flags.IntVar(&cfg.CompactionMinFiles, "compaction-min-files", cfg.CompactionMinFiles, "Default minimum number of files to compact")
+	flags.IntVar(&cfg.CompactionMaxFiles, "compaction-max-files", cfg.CompactionMaxFiles, "Default maximum number of files to compact")
+	flags.IntVar(&cfg.CompactionMinInputSize, "compaction-min-size", cfg.CompactionMinInputSize, "Default minimum total input size of compactions, in bytes")
+	flags.IntVar(&cfg.CompactionMaxInputSize, "compaction-max-size", cfg.CompactionMaxInputSize, "Default maximum total input size of compactions, in bytes")
+	flags.IntVar(&cfg.IndexCacheSize, "index-cache", cfg.IndexCacheSize, "Number of sstable indexes to keep in memory")
+	flags.Int64Var(&cfg.BlobCacheBytes, "blob-cache-size", cfg.BlobCacheBytes, "Size of the blob cache, in bytes")
+	flags.IntVar(&cfg.MaxGetFetches, "max-get-fetches", cfg.MaxGetFetches, "Most sstables which each get will fetch")
+	flags.Var(&rates, "quota-rate", `Rates of the quota with a prefix, e.g. "a/=10:5" for 10 puts and 5 gets per second (repeatable)`)
+	clear := flags.Bool("clear", false, "Revert everything to the options each process was started with")
+
+	flags.Parse(os.Args[2:])
+
+	if len(rates) > 0 {
+		cfg.QuotaRates = rates
+	}
+	if *clear {
+		cfg = blobby.RuntimeConfig{}
+	}
+
+	if flags.NFlag() > 0 {
+		err := b.SetRuntimeConfig(ctx, &cfg)
+		if err != nil {
+			log.Fatalf("SetRuntimeConfig: %s", err)
+		}
+	}
+
+	fmt.Printf("compaction-min-files: %d\n", cfg.CompactionMinFiles)
+	fmt.Printf("compaction-max-files: %d\n", cfg.CompactionMaxFiles)
+	fmt.Printf("compaction-min-size: %d\n", cfg.CompactionMinInputSize)
+	fmt.Printf("compaction-max-size: %d\n", cfg.CompactionMaxInputSize)
+	fmt.Printf("index-cache: %d\n", cfg.IndexCacheSize)
+	fmt.Printf("blob-cache-size: %d\n", cfg.BlobCacheBytes)
+	fmt.Printf("max-get-fetches: %d\n", cfg.MaxGetFetches)
+	for _, r := range cfg.QuotaRates {
+		fmt.Printf("quota-rate: %s=%g:%g\n", r.Prefix, r.PutsPerSecond, r.GetsPerSecond)
+	}
+}
+
+func cmdPause(ctx context.Context, b *blobby.Blobby, pause bool) {
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	task := flags.String("task", "", "Task to pause or resume (flush, compaction, gc)")
+
+	flags.Parse(os.Args[2:])
+
+	if *task == "" {
+		log.Fatalf("Required: --task")
+	}
+
+	if pause {
+		err := b.Pause(ctx, *task)
+		if err != nil {
+			log.Fatalf("Pause: %s", err)
+		}
+	} else {
+		err := b.Resume(ctx, *task)
+		if err != nil {
+			log.Fatalf("Resume: %s", err)
+		}
+	}
+
+	paused, err := b.Paused(ctx)
+	if err != nil {
+		log.Fatalf("Paused: %s", err)
+	}
+
+	if len(paused) == 0 {
+		fmt.Println("Nothing is paused")
+		return
+	}
+
+	fmt.Printf("Paused: %s\n", strings.Join(paused, ", "))
+}
+
+func cmdPublishManifest(ctx context.Context, b *blobby.Blobby) {
+	m, err := b.PublishManifest(ctx)
+	if err != nil {
+		log.Fatalf("PublishManifest: %s", err)
+	}
+
+	fmt.Printf("Published manifest of %d sstables\n", m.Count)
+}
+
+func cmdRecoverMetadata(ctx context.Context, b *blobby.Blobby) {
+	m, n, err := b.RecoverMetadataFromBlobstore(ctx)
+	if err != nil {
+		log.Fatalf("RecoverMetadataFromBlobstore: %s", err)
+	}
+
+	fmt.Printf("Recovered %d of %d sstables from manifest published at: %s\n", n, m.Count, m.Created)
+}
+
+func cmdRebuildMetadata(ctx context.Context, b *blobby.Blobby) {
+	stats, err := b.RebuildMetadata(ctx)
+	if err != nil {
+		log.Fatalf("RebuildMetadata: %s", err)
+	}
+
+	fmt.Printf("Listed %d sstables, and added %d to the metadata\n", stats.BlobsListed, stats.Inserted)
+}
+
+func cmdBench(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	name := flags.String("workload", "write-heavy", "Preset workload (write-heavy, read-heavy, zipfian)")
+	ops := flags.Int("ops", 10000, "Number of operations to perform")
+	keys := flags.Int("keys", 0, "Number of distinct keys (default from workload)")
+	size := flags.Int("value-size", 0, "Size of each value in bytes (default from workload)")
+	seed := flags.Int64("seed", 1, "Random seed")
+
+	flags.Parse(os.Args[2:])
+
+	cfg, ok := workload.Presets[*name]
+	if !ok {
+		log.Fatalf("Invalid workload: %s", *name)
+	}
+	if *keys > 0 {
+		cfg.Keys = *keys
+	}
+	if *size > 0 {
+		cfg.ValueSize = *size
+	}
+	cfg.Seed = *seed
+
+	res, err := workload.Run(ctx, b, cfg, *ops)
+	if err != nil {
+		log.Fatalf("Run: %s", err)
+	}
+
+	fmt.Println(res)
+}
+
+func cmdLoadgen(ctx context.Context, b *blobby.Blobby) {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	cfg := workload.SoakConfig{}
+
+	flags.IntVar(&cfg.QPS, "qps", 100, "Maximum puts and gets per second (0 for unlimited)")
+	flags.DurationVar(&cfg.Duration, "duration", 0, "How long to run for (0 for forever)")
+	flags.IntVar(&cfg.ReadPercent, "read-percent", 50, "Percentage of operations which are gets")
+	flags.IntVar(&cfg.Keys, "keys", 10000, "Number of distinct keys")
+	flags.BoolVar(&cfg.Zipf, "zipf", false, "Choose keys from a zipfian rather than uniform distribution")
+	flags.IntVar(&cfg.ValueSize, "min-value-size", 64, "Minimum size of each value in bytes")
+	flags.IntVar(&cfg.MaxValueSize, "max-value-size", 1024, "Maximum size of each value in bytes")
+	flags.DurationVar(&cfg.FlushInterval, "flush-interval", time.Minute, "How often to flush (0 to never)")
+	flags.DurationVar(&cfg.CompactInterval, "compact-interval", 10*time.Minute, "How often to compact (0 to never)")
+	flags.DurationVar(&cfg.ReportInterval, "report-interval", 10*time.Second, "How often to print stats")
+	flags.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "Random seed")
+
+	flags.Parse(os.Args[2:])
+
+	cfg.OnReport = func(r *workload.Result) {
+		fmt.Printf("%s\n\n", r)
+	}
+
+	res, err := workload.Soak(ctx, b, cfg)
+	fmt.Printf("Total:\n%s\n", res)
+	if err != nil {
+		log.Fatalf("Soak: %s", err)
+	}
+}
+
+// publisherOptions returns the options to publish events to the webhook and SNS
+// topic given by the environment, if any.
+func publisherOptions(ctx context.Context) []blobby.Option {
+	var types []blobby.EventType
+	if s := os.Getenv("ARCHIVE_NOTIFY_EVENTS"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			types = append(types, blobby.EventType(t))
+		}
+	}
+
+	var opts []blobby.Option
+	if u := os.Getenv("ARCHIVE_WEBHOOK_URL"); u != "" {
+		w := notify.NewWebhook(u)
+		w.Secret = os.Getenv("ARCHIVE_WEBHOOK_SECRET")
+		opts = append(opts, blobby.WithPublisher(w, types...))
+	}
+	if arn := os.Getenv("ARCHIVE_SNS_TOPIC"); arn != "" {
+		s, err := notify.NewSNS(ctx, arn)
+		if err != nil {
+			log.Fatalf("notify.NewSNS: %v", err)
+		}
+		opts = append(opts, blobby.WithPublisher(s, types...))
+	}
+
+	return opts
+}
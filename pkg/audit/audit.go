@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionName    = "audit"
+	connectionTimeout = 3 * time.Second
+)
+
+// Op is the name of a mutating operation.
+type Op string
+
+const (
+	OpPut        Op = "put"
+	OpFlush      Op = "flush"
+	OpCompact    Op = "compact"
+	OpPurge      Op = "purge"
+	OpCheckpoint Op = "checkpoint"
+	OpRollback   Op = "rollback"
+	OpImport     Op = "import"
+)
+
+// Entry is a single record in the audit log.
+type Entry struct {
+	Time   time.Time `bson:"time"`
+	Op     Op        `bson:"op"`
+	Caller string    `bson:"caller,omitempty"`
+
+	// The keys which were written, if any.
+	Keys []string `bson:"keys,omitempty"`
+
+	// The filenames of the sstables which were created or removed, if any.
+	Created []string `bson:"created,omitempty"`
+	Removed []string `bson:"removed,omitempty"`
+
+	// The name of the checkpoint which was created or restored, if any.
+	Checkpoint string `bson:"checkpoint,omitempty"`
+
+	// The error returned by the operation, if it failed. Failed operations are
+	// logged too, since they might have had partial effects.
+	Error string `bson:"error,omitempty"`
+}
+
+// Log is an append-only audit trail of mutating operations, stored in Mongo.
+type Log struct {
+	mongo    *mongo.Database
+	mongoURL string
+	dbName   string
+}
+
+func New(mongoURL, dbName string) *Log {
+	return &Log{
+		mongoURL: mongoURL,
+		dbName:   dbName,
+	}
+}
+
+// SetClient makes the log use the given client, rather than connecting its own,
+// so that it can share a connection pool with others.
+func (l *Log) SetClient(client *mongo.Client) {
+	l.mongo = client.Database(l.dbName)
+}
+
+func (l *Log) getMongo(ctx context.Context) (*mongo.Database, error) {
+	if l.mongo != nil {
+		return l.mongo, nil
+	}
+
+	opt := options.Client().ApplyURI(l.mongoURL).SetTimeout(connectionTimeout)
+	client, err := mongo.Connect(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+
+	l.mongo = client.Database(l.dbName)
+	return l.mongo, nil
+}
+
+// Init creates the indexes needed to query the log. It's idempotent.
+func (l *Log) Init(ctx context.Context) error {
+	db, err := l.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "keys", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "caller", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("CreateIndexes: %w", err)
+	}
+
+	return nil
+}
+
+// Record appends an entry to the log.
+func (l *Log) Record(ctx context.Context, e *Entry) error {
+	db, err := l.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(collectionName).InsertOne(ctx, e)
+	if err != nil {
+		return fmt.Errorf("InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// Filter selects entries from the log. Zero fields match everything.
+type Filter struct {
+	Op     Op
+	Caller string
+	Key    string
+	Since  time.Time
+	Until  time.Time
+
+	// Limit specifies the maximum number of entries to return. Zero means no
+	// limit.
+	Limit int
+}
+
+// Query returns the entries matching the given filter, newest first.
+func (l *Log) Query(ctx context.Context, f Filter) ([]*Entry, error) {
+	db, err := l.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	q := bson.M{}
+	if f.Op != "" {
+		q["op"] = f.Op
+	}
+	if f.Caller != "" {
+		q["caller"] = f.Caller
+	}
+	if f.Key != "" {
+		q["keys"] = f.Key
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := bson.M{}
+		if !f.Since.IsZero() {
+			t["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			t["$lt"] = f.Until
+		}
+		q["time"] = t
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	if f.Limit > 0 {
+		opts.SetLimit(int64(f.Limit))
+	}
+
+	cur, err := db.Collection(collectionName).Find(ctx, q, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var entries []*Entry
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return entries, nil
+}
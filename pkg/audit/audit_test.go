@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+
+	l := New(env.MongoURL(), "blobby")
+	require.NoError(t, l.Init(ctx))
+
+	t0 := time.Now().UTC().Truncate(time.Millisecond)
+	entries := []*Entry{
+		{Time: t0, Op: OpPut, Caller: "alice", Keys: []string{"a"}},
+		{Time: t0.Add(1 * time.Second), Op: OpPut, Caller: "bob", Keys: []string{"b"}},
+		{Time: t0.Add(2 * time.Second), Op: OpFlush, Caller: "alice", Created: []string{"1.sstable"}},
+	}
+	for _, e := range entries {
+		require.NoError(t, l.Record(ctx, e))
+	}
+
+	res, err := l.Query(ctx, Filter{})
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, OpFlush, res[0].Op) // newest first
+
+	res, err = l.Query(ctx, Filter{Caller: "alice"})
+	require.NoError(t, err)
+	assert.Len(t, res, 2)
+
+	res, err = l.Query(ctx, Filter{Key: "b"})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "bob", res[0].Caller)
+
+	res, err = l.Query(ctx, Filter{Op: OpPut, Since: t0.Add(1 * time.Second)})
+	require.NoError(t, err)
+	assert.Len(t, res, 1)
+
+	res, err = l.Query(ctx, Filter{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, res, 1)
+}
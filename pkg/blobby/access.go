@@ -0,0 +1,176 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+type Access = metadata.Access
+
+// WithAccessStats records how recently, and roughly how often, each sstable is
+// read by Get, MultiGet, Versions, and Scan, so that AccessReport can tell which
+// are cold. Only the given fraction of reads (between 0 and 1) are recorded, to
+// keep the overhead down. They're buffered in memory until FlushAccessStats is
+// called, so run RunAccessStats too.
+func WithAccessStats(rate float64) Option {
+	return func(b *Blobby) {
+		b.access.rate = min(rate, 1)
+	}
+}
+
+// accessTracker buffers the sampled reads of sstables.
+type accessTracker struct {
+	rate float64
+
+	mu      sync.Mutex
+	pending map[string]Access
+}
+
+// recordAccess records a read of the given sstable, if it's sampled.
+func (b *Blobby) recordAccess(m *sstable.Meta) {
+	t := &b.access
+	if t.rate <= 0 || rand.Float64() >= t.rate {
+		return
+	}
+
+	now := b.clock.Now()
+	fn := m.Filename()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = map[string]Access{}
+	}
+
+	a := t.pending[fn]
+	if now.After(a.LastRead) {
+		a.LastRead = now
+	}
+	a.Reads += 1 / t.rate
+	t.pending[fn] = a
+}
+
+// FlushAccessStats writes the reads recorded since the last flush to the
+// metadata store. If that fails, they're kept for the next flush.
+func (b *Blobby) FlushAccessStats(ctx context.Context) error {
+	t := &b.access
+
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	err := b.md.RecordAccess(ctx, pending)
+	if err == nil {
+		return nil
+	}
+
+	// put them back, merged with any which were recorded in the meantime.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = map[string]Access{}
+	}
+	for fn, a := range pending {
+		cur := t.pending[fn]
+		if a.LastRead.After(cur.LastRead) {
+			cur.LastRead = a.LastRead
+		}
+		cur.Reads += a.Reads
+		t.pending[fn] = cur
+	}
+
+	return fmt.Errorf("metadata.RecordAccess: %w", err)
+}
+
+// RunAccessStats calls FlushAccessStats every interval until the context is
+// cancelled or a flush fails.
+func (b *Blobby) RunAccessStats(ctx context.Context, interval time.Duration) error {
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+
+		err := b.FlushAccessStats(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SSTableAccess is how recently and often a live sstable has been read.
+type SSTableAccess struct {
+	Meta *sstable.Meta
+
+	// The last recorded read, or zero if none were, and the estimated number
+	// of reads. See WithAccessStats.
+	LastRead time.Time
+	Reads    float64
+
+	// How long it's been since the sstable was last read, or if it never was,
+	// since it was created. Sstables written by compaction start afresh, since
+	// reads of their inputs aren't carried over.
+	Idle time.Duration
+}
+
+// AccessReport returns the recorded accesses of every live sstable, coldest
+// (i.e. idle for longest) first. Only reads made by processes with
+// WithAccessStats, and flushed since, are included.
+func (b *Blobby) AccessReport(ctx context.Context) ([]*SSTableAccess, error) {
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	accesses, err := b.md.GetAccess(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetAccess: %w", err)
+	}
+
+	now := b.clock.Now()
+	out := make([]*SSTableAccess, len(metas))
+	for i, m := range metas {
+		a := accesses[m.Filename()]
+		since := a.LastRead
+		if since.IsZero() {
+			since = m.Created
+		}
+
+		out[i] = &SSTableAccess{Meta: m, LastRead: a.LastRead, Reads: a.Reads, Idle: now.Sub(since)}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Idle > out[j].Idle
+	})
+
+	return out, nil
+}
+
+// ColdSSTables returns the live sstables which haven't been read for at least
+// the given duration, coldest first. See AccessReport.
+func (b *Blobby) ColdSSTables(ctx context.Context, idle time.Duration) ([]*SSTableAccess, error) {
+	report, err := b.AccessReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	n := sort.Search(len(report), func(i int) bool {
+		return report[i].Idle < idle
+	})
+
+	return report[:n], nil
+}
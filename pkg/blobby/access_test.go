@@ -0,0 +1,66 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAccess(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	m := &sstable.Meta{Created: c.Now()}
+
+	// disabled by default.
+	b := New("", "", c)
+	b.recordAccess(m)
+	assert.Nil(t, b.access.pending)
+
+	b = New("", "", c, WithAccessStats(1))
+	b.recordAccess(m)
+	c.Advance(time.Minute)
+	b.recordAccess(m)
+
+	a := b.access.pending[m.Filename()]
+	assert.Equal(t, c.Now(), a.LastRead)
+	assert.Equal(t, 2.0, a.Reads)
+}
+
+func TestAccessReport(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	WithAccessStats(1)(b)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := b.Put(ctx, k, []byte(`{}`))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{Force: true})
+		require.NoError(t, err)
+		c.Advance(time.Hour)
+	}
+
+	c.Advance(48 * time.Hour)
+	_, _, err := b.Get(ctx, "b")
+	require.NoError(t, err)
+	require.NoError(t, b.FlushAccessStats(ctx))
+
+	c.Advance(24 * time.Hour)
+	report, err := b.AccessReport(ctx)
+	require.NoError(t, err)
+	require.Len(t, report, 2)
+
+	// a was never read, so it's been idle since it was created.
+	assert.Equal(t, "a", report[0].Meta.MinKey)
+	assert.True(t, report[0].LastRead.IsZero())
+	assert.Equal(t, "b", report[1].Meta.MinKey)
+	assert.Equal(t, 1.0, report[1].Reads)
+	assert.Equal(t, 24*time.Hour, report[1].Idle)
+
+	cold, err := b.ColdSSTables(ctx, 2*24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, cold, 1)
+	assert.Equal(t, "a", cold[0].Meta.MinKey)
+}
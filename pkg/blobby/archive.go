@@ -4,36 +4,342 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/adammck/blobby/pkg/audit"
 	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/codec"
 	"github.com/adammck/blobby/pkg/compactor"
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/memtable"
 	"github.com/adammck/blobby/pkg/metadata"
 	"github.com/adammck/blobby/pkg/sstable"
 	"github.com/adammck/blobby/pkg/types"
 	"github.com/jonboulle/clockwork"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/sync/errgroup"
 )
 
+// DefaultName is the name of the archive when WithName isn't given. It's used
+// as the name of the Mongo database containing the memtables and metadata.
+const DefaultName = "blobby"
+
 type Blobby struct {
-	mt    *memtable.Memtable
+	mongoURL string
+	bucket   string
+	name     string
+	bsOpts   []blobstore.Option
+
+	// see WithMongoClient and WithS3Client. nil if the archive connects its
+	// own clients.
+	mongoClient *mongo.Client
+	s3Client    blobstore.S3API
+
+	mt    Memtable
 	bs    *blobstore.Blobstore
-	md    *metadata.Store
+	md    Metadata
 	clock clockwork.Clock
 	comp  *compactor.Compactor
+
+	// new values are encoded with codec, if it's set. codecs contains every
+	// codec which might be needed to decode existing values.
+	codec  codec.Codec
+	codecs codec.Registry
+
+	// per-namespace overrides, loaded from the metadata by Open.
+	namespaces atomic.Pointer[metadata.Namespaces]
+
+	// checked by Put before the validators.
+	keyPolicy KeyPolicy
+
+	// checked by Put, in the order they were given.
+	validators []namespaceValidator
+
+	// wrapped around Put and Get, outermost first.
+	interceptors []Interceptor
+
+	// checked by Put and Get, before anything else. nil allows everything.
+	authorizer Authorizer
+
+	// checked by Put and Get, after the validators. quotaState is created
+	// lazily for each quota and caller, and guarded by quotaMu.
+	quotas     []Quota
+	quotaMu    sync.Mutex
+	quotaState map[quotaKey]*quotaState
+
+	// operations slower than the thresholds are logged, if slowLog is set.
+	slowLog        *slog.Logger
+	slowThresholds SlowThresholds
+
+	// injected into the backends, if set. only for tests.
+	faults *faultinject.Injector
+
+	// publish the manifest after every change to the live set.
+	publishManifest bool
+
+	// nil unless WithAudit was given.
+	auditEnabled bool
+	audit        *audit.Log
+
+	// held for the duration of a flush, so concurrent calls to Flush in this
+	// process fail fast rather than racing to rotate the memtable. concurrent
+	// flushes in other processes are caught by memtable.Rotate.
+	flushMu sync.Mutex
+
+	// set while WatchMetadata is running.
+	watcher atomic.Pointer[metadata.Watcher]
+
+	// the maximum number of sstables fetched by each get. zero means no limit.
+	maxGetFetches int
+
+	// if set, flushes write one sstable per partition rather than one in total.
+	flushPartitioner func(key string) string
+
+	// subscribers to Events.
+	events eventBus
+
+	// sent notifications of events by RunPublishers.
+	publishers []publisher
+
+	// holds leases on behalf of this instance, as owner. defaults to md.
+	coord Coordinator
+	owner string
+
+	// the elections which RunAsLeader is leading.
+	leaders leaders
+
+	// see WithDegradedReads.
+	degraded degraded
+
+	// see WithWarmup. warmupStats is set by Open, if it warmed up.
+	warmupOpts  *WarmupOptions
+	warmupStats atomic.Pointer[WarmupStats]
+
+	// used to estimate the cost of S3 requests. see WithPricing.
+	pricing Pricing
+
+	// the paused tasks, as of the last time they were checked. see Pause.
+	paused atomic.Pointer[[]string]
+
+	// the runtime config which was last applied. see SetRuntimeConfig.
+	config atomic.Pointer[RuntimeConfig]
+
+	// see WithAccessStats.
+	access accessTracker
+
+	// see WithVerifyReads.
+	verify verifier
+
+	// see WithStrictOrdering.
+	strict bool
+
+	// see WithFlushRecovery.
+	recoverFlushes bool
+
+	// the cursor of each sync run by this process. see Sync.
+	syncMu   sync.Mutex
+	syncedTo map[string]time.Time
+}
+
+type Option func(*Blobby)
+
+// WithName sets the name of the archive. Several archives with different names
+// can share a Mongo cluster and a bucket.
+func WithName(name string) Option {
+	return func(b *Blobby) {
+		b.name = name
+	}
+}
+
+// WithKeyScheme sets the scheme used to choose where in the bucket new sstables
+// are written. The default is sstable.FlatKeys.
+func WithKeyScheme(scheme sstable.KeyScheme) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithKeyScheme(scheme))
+	}
+}
+
+// WithFlushMemory limits the memory used to sort each flush, spilling to
+// temporary files in dir beyond that. See blobstore.WithFlushMemory.
+func WithFlushMemory(limit int, dir string) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithFlushMemory(limit, dir))
+	}
+}
+
+// WithIndexCache sets the number of sstable indexes to keep in memory. See
+// blobstore.WithIndexCache.
+func WithIndexCache(n int) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithIndexCache(n))
+	}
+}
+
+// WithFilter sets the type of filter which is built for new sstables. See
+// blobstore.WithFilter.
+func WithFilter(t sstable.FilterType) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithFilter(t))
+	}
+}
+
+// WithInlineFilters stores the bloom filters of new sstables in the metadata, if
+// they're no larger than the given number of bytes, so gets can skip sstables
+// without any blobstore requests. See blobstore.WithInlineFilters.
+func WithInlineFilters(maxBytes int) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithInlineFilters(maxBytes))
+	}
+}
+
+// WithBlobCache keeps sstables and indexes on local disk after they're first
+// read. See blobstore.WithBlobCache.
+func WithBlobCache(dir string, maxBytes int64, mode blobstore.BlobCacheMode) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithBlobCache(dir, maxBytes, mode))
+	}
+}
+
+// WithMaxGetFetches limits the number of sstables which each Get will fetch
+// from the blobstore. Gets which would need more than that fail with a
+// TooManyOverlaps error, which usually means that compaction has fallen behind.
+// Sstables ruled out by their filters don't count. Zero means no limit.
+func WithMaxGetFetches(n int) Option {
+	return func(b *Blobby) {
+		b.maxGetFetches = n
+	}
+}
+
+// WithFlushPartitioner makes each flush write a separate sstable for each
+// partition of the keys in the memtable, per the given func, rather than one
+// sstable spanning all of them. Partitions should be contiguous ranges of keys,
+// like those returned by PartitionByPrefix, so the sstables don't overlap. This
+// reduces read amplification for workloads like multi-tenant archives, where
+// each flush would otherwise overlap every tenant, at the cost of more (and
+// smaller) sstables.
+func WithFlushPartitioner(fn func(key string) string) Option {
+	return func(b *Blobby) {
+		b.flushPartitioner = fn
+	}
+}
+
+// PartitionByPrefix returns a partition func for WithFlushPartitioner which
+// puts keys in the same partition if they're the same up to and including the
+// first sep, e.g. "tenant/" for "tenant/123". Keys which don't contain sep are
+// all in the same partition, so each run of them shares an sstable.
+func PartitionByPrefix(sep string) func(key string) string {
+	return func(key string) string {
+		prefix, _, ok := strings.Cut(key, sep)
+		if !ok {
+			return ""
+		}
+		return prefix + sep
+	}
 }
 
-func New(mongoURL, bucket string, clock clockwork.Clock) *Blobby {
-	bs := blobstore.New(bucket, clock)
-	md := metadata.New(mongoURL)
+// WithFaults injects faults into the backends. It's only meant for tests.
+func WithFaults(fi *faultinject.Injector) Option {
+	return func(b *Blobby) {
+		b.faults = fi
+		b.bsOpts = append(b.bsOpts, blobstore.WithFaults(fi))
+	}
+}
+
+// WithBuckets spreads new sstables across the given buckets as well as the
+// primary one, by consistent hashing. See blobstore.WithBuckets.
+func WithBuckets(buckets ...string) Option {
+	return func(b *Blobby) {
+		b.bsOpts = append(b.bsOpts, blobstore.WithBuckets(buckets...))
+	}
+}
+
+// WithMongoClient makes the archive use the given Mongo client for its memtable,
+// metadata, and audit log, rather than connecting its own, so that the host
+// application can manage the connection pool, credentials, and monitoring, or
+// share them between archives. The URL given to New is still used to tell
+// whether two archives are the same, so should point at the same cluster.
+func WithMongoClient(client *mongo.Client) Option {
+	return func(b *Blobby) {
+		b.mongoClient = client
+	}
+}
+
+// WithS3Client makes the archive use the given S3 client, rather than creating
+// one from the environment. See blobstore.Blobstore.SetClient.
+func WithS3Client(client blobstore.S3API) Option {
+	return func(b *Blobby) {
+		b.s3Client = client
+	}
+}
+
+func New(mongoURL, bucket string, clock clockwork.Clock, opts ...Option) *Blobby {
+	b := &Blobby{
+		mongoURL: mongoURL,
+		bucket:   bucket,
+		name:     DefaultName,
+		clock:    clock,
+
+		keyPolicy:  DefaultKeyPolicy,
+		quotaState: map[quotaKey]*quotaState{},
+		owner:      fmt.Sprintf("blobby-%016x", rand.Uint64()),
+		pricing:    DefaultPricing,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
 
-	return &Blobby{
-		mt:    memtable.New(mongoURL, clock),
-		bs:    bs,
-		md:    md,
-		clock: clock,
-		comp:  compactor.New(bs, md, clock),
+	b.bs = blobstore.New(bucket, clock, b.bsOpts...)
+	if b.s3Client != nil {
+		b.bs.SetClient(b.s3Client)
 	}
+
+	if b.md == nil {
+		md := metadata.New(mongoURL, b.name)
+		if b.mongoClient != nil {
+			md.SetClient(b.mongoClient)
+		}
+		if b.faults != nil {
+			md.SetFaults(b.faults)
+		}
+		b.md = md
+	}
+
+	if b.mt == nil {
+		mt := memtable.New(mongoURL, b.name, clock)
+		if b.mongoClient != nil {
+			mt.SetClient(b.mongoClient)
+		}
+		if b.faults != nil {
+			mt.SetFaults(b.faults)
+		}
+		b.mt = mongoMemtable{mt}
+	}
+
+	if b.coord == nil {
+		b.coord = b.md
+	}
+	b.comp = compactor.New(b.bs, b.md, clock)
+	b.comp.SetLeaseFunc(b.onLease)
+
+	if b.auditEnabled {
+		b.audit = audit.New(mongoURL, b.name)
+		if b.mongoClient != nil {
+			b.audit.SetClient(b.mongoClient)
+		}
+	}
+
+	return b
+}
+
+// Name returns the name of this archive.
+func (b *Blobby) Name() string {
+	return b.name
 }
 
 func (b *Blobby) Ping(ctx context.Context) error {
@@ -50,6 +356,8 @@ func (b *Blobby) Ping(ctx context.Context) error {
 	return nil
 }
 
+// Init creates everything needed by a new archive. It's idempotent, so it can
+// be called on an existing archive, or again to finish an interrupted Init.
 func (b *Blobby) Init(ctx context.Context) error {
 	err := b.mt.Init(ctx)
 	if err != nil {
@@ -61,143 +369,1244 @@ func (b *Blobby) Init(ctx context.Context) error {
 		return fmt.Errorf("metadata.Init: %s", err)
 	}
 
+	if b.audit != nil {
+		err = b.audit.Init(ctx)
+		if err != nil {
+			return fmt.Errorf("audit.Init: %s", err)
+		}
+	}
+
 	return nil
 }
 
-func (b *Blobby) Put(ctx context.Context, key string, value []byte) (string, error) {
-	return b.mt.Put(ctx, key, value)
-}
+// ErrNotInitialized is returned by Open when the archive doesn't exist, or
+// hasn't been fully initialized.
+var ErrNotInitialized = errors.New("archive not initialized")
 
-type GetStats struct {
-	Source         string
-	BlobsFetched   int
-	RecordsScanned int
-}
+// Open checks that the backends are reachable and that the archive has been
+// initialized, without changing anything. With WithWarmup, it also warms the
+// caches before returning.
+func (b *Blobby) Open(ctx context.Context) error {
+	err := b.Ping(ctx)
+	if err != nil {
+		return err
+	}
 
-// TODO: return the Record, or maybe the timestamp too, not just the value.
-func (b *Blobby) Get(ctx context.Context, key string) (value []byte, stats *GetStats, err error) {
-	stats = &GetStats{}
+	ok, err := b.Initialized(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotInitialized, b.name)
+	}
 
-	rec, src, err := b.mt.Get(ctx, key)
-	if err != nil && !errors.Is(err, &memtable.NotFound{}) {
-		return nil, stats, fmt.Errorf("memtable.Get: %w", err)
+	err = b.md.CheckSchema(ctx)
+	if err != nil {
+		return fmt.Errorf("metadata.CheckSchema: %w", err)
 	}
-	if rec != nil {
-		// TODO: Update Memtable.Get to return stats too.
-		stats.Source = src
-		return rec.Document, stats, nil
+
+	err = b.md.CheckFeatures(ctx)
+	if err != nil {
+		return fmt.Errorf("metadata.CheckFeatures: %w", err)
 	}
 
-	metas, err := b.md.GetContaining(ctx, key)
+	blocks, err := b.md.HasFeature(ctx, FeatureBlocks)
 	if err != nil {
-		return nil, stats, fmt.Errorf("metadata.GetContaining: %w", err)
+		return fmt.Errorf("metadata.HasFeature: %w", err)
+	}
+	if blocks {
+		b.bs.SetFormat(sstable.FormatBlocks)
 	}
 
-	// note: this assumes that metas is already sorted.
-	for _, meta := range metas {
-		rec, bstats, err := b.bs.Find(ctx, meta.Filename(), key)
+	err = b.RefreshNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Paused(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.RefreshRuntimeConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.recoverOnOpen(ctx)
+	if err != nil {
+		return fmt.Errorf("RecoverFlushes: %w", err)
+	}
+
+	if b.warmupOpts != nil {
+		stats, err := b.Warmup(ctx, *b.warmupOpts)
 		if err != nil {
-			return nil, stats, fmt.Errorf("blobstore.Get: %w", err)
+			return fmt.Errorf("Warmup: %w", err)
 		}
+		b.warmupStats.Store(stats)
+	}
 
-		// accumulate stats as we go
-		stats.BlobsFetched++
-		stats.RecordsScanned += bstats.RecordsScanned
+	return nil
+}
 
-		if rec != nil {
-			// return as soon as we find the first record, but that's wrong!
-			// before returning, we need to look at the record timestamp, and
-			// check whether any of the remaining metas have a minTime newer
-			// than that. this is only possible after a weird compaction.
-			// TODO: fix this!
-			stats.Source = bstats.Source
-			return rec.Document, stats, nil
-		}
+type Feature = metadata.Feature
+
+// FeatureBlocks writes new sstables in sstable.FormatBlocks, which is smaller
+// and faster to search, once the archive is next opened. Every process must be
+// upgraded to a version which can read it first.
+const FeatureBlocks = metadata.FeatureBlocks
+
+// EnableFeature enables an optional format feature for this archive. Once this
+// is done, processes running versions of this package which don't support the
+// feature will refuse to Open the archive.
+func (b *Blobby) EnableFeature(ctx context.Context, f Feature) error {
+	return b.md.EnableFeature(ctx, f)
+}
+
+type Migration = metadata.Migration
+
+// Migrate upgrades the metadata of an existing archive to the version used by
+// this package, and returns the migrations which were run. Other processes
+// using older versions might fail (or worse) once this is done.
+func (b *Blobby) Migrate(ctx context.Context) ([]Migration, error) {
+	ms, err := b.md.Migrate(ctx)
+	if err != nil {
+		return ms, fmt.Errorf("metadata.Migrate: %w", err)
 	}
 
-	// key not found
-	return nil, stats, nil
+	return ms, nil
 }
 
-type FlushStats struct {
+// Initialized returns true if Init has been completed for this archive.
+func (b *Blobby) Initialized(ctx context.Context) (bool, error) {
+	ok, err := b.mt.Initialized(ctx)
+	if err != nil {
+		return false, fmt.Errorf("memtable.Initialized: %w", err)
+	}
+	if !ok {
+		return false, nil
+	}
 
-	// The URL of the memtable which was flushed.
-	FlushedMemtable string
+	ok, err = b.md.Initialized(ctx)
+	if err != nil {
+		return false, fmt.Errorf("metadata.Initialized: %w", err)
+	}
 
-	// The URL of the memtable that is now active, after the flush.
-	// TODO: Rename this to reflect that it's just the name now.
-	ActiveMemtable string
+	return ok, nil
+}
 
-	// The URL of the flushed sstable.
-	// TODO: Rename this to reflect that it's just the blob key (filename) now.
-	BlobURL string
+func (b *Blobby) Put(ctx context.Context, key string, value []byte) (string, error) {
+	return b.PutTagged(ctx, key, value, nil)
+}
 
-	// Metadata about the flushed sstable.
-	Meta *sstable.Meta
+// PutTagged is like Put, but also stores the given tags with the record. They
+// are returned by GetTagged.
+func (b *Blobby) PutTagged(ctx context.Context, key string, value []byte, tags map[string]string) (string, error) {
+	return b.PutWithOptions(ctx, key, value, PutOptions{Tags: tags})
 }
 
-func (b *Blobby) Flush(ctx context.Context) (*FlushStats, error) {
-	stats := &FlushStats{}
+type PutOptions struct {
+	// Tags are stored with the record, and returned by GetTagged.
+	Tags map[string]string
+
+	// IdempotencyKey identifies this write, so that if it's retried (e.g. after
+	// a timeout) with the same key and idempotency key, no duplicate version is
+	// created. Retries are recognized while the original write is in the
+	// memtable, and duplicates which slip through are removed when flushing.
+	IdempotencyKey string
+}
+
+func (b *Blobby) PutWithOptions(ctx context.Context, key string, value []byte, opts PutOptions) (string, error) {
+	start := b.clock.Now()
+	c := &Call{Method: MethodPut, Key: key, Value: value, Tags: opts.Tags, IdempotencyKey: opts.IdempotencyKey}
+	err := b.intercept(ctx, c, b.put)
+	b.logSlow(ctx, "put", b.slowThresholds.Put, start, err,
+		slog.String("key", key),
+		slog.Int("bytes", len(value)),
+		slog.String("dest", c.Dest))
+	return c.Dest, err
+}
+
+func (b *Blobby) put(ctx context.Context, c *Call) error {
+	err := b.authorize(ctx, MethodPut, c.Key)
+	if err != nil {
+		return err
+	}
 
-	// TODO: check whether old sstable is still flushing
-	hPrev, hNext, err := b.mt.Rotate(ctx)
+	rec, err := b.prepare(c)
 	if err != nil {
-		return stats, fmt.Errorf("memtable.Swap: %s", err)
+		return err
 	}
 
-	stats.ActiveMemtable = hNext.Name()
+	err = b.admit(ctx, MethodPut, c.Key, len(c.Value))
+	if err != nil {
+		return err
+	}
 
-	ch := make(chan *types.Record)
-	g, ctx2 := errgroup.WithContext(ctx)
+	c.Dest, err = b.mt.PutRecord(ctx, rec)
+	if err != nil {
+		b.refundPut(ctx, c.Key, len(c.Value))
+	}
 
-	g.Go(func() error {
-		err := hPrev.Flush(ctx2, ch)
+	return b.audited(ctx, &audit.Entry{Op: audit.OpPut, Keys: []string{c.Key}}, err)
+}
+
+// prepare checks the key and value of the given call, and returns the record
+// which should be written to the memtable, with the value encoded.
+func (b *Blobby) prepare(c *Call) (*types.Record, error) {
+	err := b.keyPolicy.Check(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.validate(c.Key, c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	value, id, err := b.encode(c.Key, c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &types.Record{
+		Key:      c.Key,
+		Document: value,
+		Codec:    id,
+		Tags:     c.Tags,
+
+		IdempotencyKey: c.IdempotencyKey,
+	}
+
+	if ns := b.namespace(c.Key); ns != nil && ns.TTL > 0 {
+		rec.Expires = b.clock.Now().Add(ns.TTL)
+	}
+
+	return rec, nil
+}
+
+type GetStats struct {
+	Source         string
+	BlobsFetched   int
+	RecordsScanned int
+
+	// The number of sstables which were skipped without being fetched, because
+	// their filter ruled out the key.
+	BlobsFiltered int
+
+	// Degraded is true if the memtable or metadata store couldn't be reached,
+	// so the value was read from the manifest published at ManifestTime (see
+	// WithDegradedReads). It might be stale: anything written since then is
+	// missing.
+	Degraded     bool
+	ManifestTime time.Time
+}
+
+// TODO: return the Record, or maybe the timestamp too, not just the value.
+func (b *Blobby) Get(ctx context.Context, key string) (value []byte, stats *GetStats, err error) {
+	value, _, stats, err = b.GetTagged(ctx, key)
+	return value, stats, err
+}
+
+// GetInto is like Get, but copies the value into buf, reusing it if it's large
+// enough, and returns it. This allows high-QPS callers to recycle one buffer for
+// every get, rather than keeping each value alive. It returns nil if the key
+// doesn't exist.
+func (b *Blobby) GetInto(ctx context.Context, key string, buf []byte) ([]byte, *GetStats, error) {
+	value, stats, err := b.Get(ctx, key)
+	if err != nil || value == nil {
+		return nil, stats, err
+	}
+
+	return append(buf[:0], value...), stats, nil
+}
+
+// GetTagged is like Get, but also returns the tags which were stored with the
+// record by PutTagged.
+func (b *Blobby) GetTagged(ctx context.Context, key string) (value []byte, tags map[string]string, stats *GetStats, err error) {
+	return b.GetWithOptions(ctx, key, GetOptions{})
+}
+
+// GetSource is where Get may read from.
+type GetSource int
+
+const (
+	// SourceAll reads the memtables, then the sstables. This is the default.
+	SourceAll GetSource = iota
+
+	// SourceMemtable only reads the memtables, so only returns values which
+	// were written recently enough that they haven't been flushed yet.
+	SourceMemtable
+
+	// SourceSSTables skips the memtables, and only reads the sstables. This
+	// returns the newest value which has been flushed, so reads aren't
+	// affected by writes until they're flushed, and it's cheaper for callers
+	// which know that the key hasn't been written recently.
+	SourceSSTables
+)
+
+type GetOptions struct {
+	// Source restricts where the value is read from. Degraded reads (see
+	// WithDegradedReads) only apply to SourceAll and SourceSSTables, since the
+	// manifest doesn't include the memtable.
+	Source GetSource
+}
+
+// GetWithOptions is like GetTagged, with options.
+func (b *Blobby) GetWithOptions(ctx context.Context, key string, opts GetOptions) (value []byte, tags map[string]string, stats *GetStats, err error) {
+	start := b.clock.Now()
+	c := &Call{Method: MethodGet, Key: key, Stats: &GetStats{}}
+	defer func() {
+		b.logSlow(ctx, "get", b.slowThresholds.Get, start, err, getAttrs(key, c.Stats)...)
+	}()
+
+	err = b.intercept(ctx, c, func(ctx context.Context, c *Call) error {
+		err := b.authorize(ctx, MethodGet, c.Key)
 		if err != nil {
-			return fmt.Errorf("memtable.Flush: %w", err)
+			return err
 		}
-		return nil
-	})
-
-	var dest string
-	var meta *sstable.Meta
 
-	g.Go(func() error {
-		var err error
-		dest, _, meta, err = b.bs.Flush(ctx2, ch)
+		err = b.admit(ctx, MethodGet, c.Key, 0)
 		if err != nil {
-			return fmt.Errorf("blobstore.Flush: %w", err)
+			return err
 		}
-		return nil
+
+		rec, stats, err := b.get(ctx, c.Key, opts.Source)
+		c.Stats = stats
+		if err == nil && opts.Source == SourceAll {
+			b.maybeVerify(ctx, c.Key, start, rec, stats)
+		}
+		if rec != nil {
+			c.Value = rec.Document
+			c.Tags = rec.Tags
+		}
+		return err
 	})
+	return c.Value, c.Tags, c.Stats, err
+}
 
-	err = g.Wait()
-	if err != nil {
-		return stats, err
-	}
+// get returns the newest record with the given key from the given source, with
+// its document decoded, or nil if there isn't one.
+func (b *Blobby) get(ctx context.Context, key string, source GetSource) (*types.Record, *GetStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	stats := &GetStats{}
 
-	// wait until the sstable is actually readable to update the stats.
+	pctx, cancel := b.primaryContext(ctx)
+	defer cancel()
+
+	if source != SourceSSTables {
+		rec, src, err := b.mt.Get(pctx, key)
+		if err != nil && !errors.Is(err, &memtable.NotFound{}) {
+			err = fmt.Errorf("memtable.Get: %w", err)
+			if source == SourceMemtable {
+				return nil, stats, err
+			}
+			return b.getDegraded(ctx, key, stats, err)
+		}
+		if rec != nil {
+			// TODO: Update Memtable.Get to return stats too.
+			stats.Source = src
 
-	err = b.md.Insert(ctx, meta)
+			// an sstable can hold a newer version than the memtables: imports
+			// are written straight to sstables with their own timestamps, and
+			// a memtable which is being flushed, or was abandoned by a flush
+			// which failed, can be older than a later flush. so the memtable
+			// only wins if nothing newer is there.
+			if source == SourceAll {
+				rec, err = b.newerInSSTables(pctx, key, rec, stats)
+				if err != nil {
+					return nil, stats, err
+				}
+			}
+
+			rec.Document, err = b.decode(rec)
+			if err != nil {
+				return nil, stats, err
+			}
+			return rec, stats, nil
+		}
+		if source == SourceMemtable {
+			return nil, stats, nil
+		}
+	}
+
+	metas, err := b.getContaining(pctx, key)
 	if err != nil {
-		// TODO: maybe delete the sstable(s) here, since they're orphaned.
-		return stats, fmt.Errorf("metadata.Insert: %w", err)
+		return b.getDegraded(ctx, key, stats, err)
 	}
 
-	stats.FlushedMemtable = hPrev.Name()
-	stats.BlobURL = dest
-	stats.Meta = meta
+	rec, err := findNewest(ctx, b.bs, metas, key, b.fetchLimit(), stats, b.recordAccess)
+	if err != nil || rec == nil {
+		return nil, stats, err
+	}
 
-	err = b.mt.Drop(ctx, hPrev.Name())
+	if b.strict {
+		rec, err = b.breakTies(ctx, key, metas, rec, stats)
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+
+	rec.Document, err = b.decode(rec)
 	if err != nil {
-		return stats, fmt.Errorf("memtable.Drop: %w", err)
+		return nil, stats, err
 	}
 
-	return stats, nil
+	return rec, stats, nil
 }
 
-type CompactionStats = compactor.CompactionStats
-type CompactionOptions = compactor.CompactionOptions
+// findNewest returns the newest record with the given key from the given
+// sstables, which must be sorted such that the one containing the newest record
+// is first (see metadata.GetContaining), or nil if there isn't one. The document
+// is not decoded. Stats are accumulated into the given struct. If limit is
+// non-zero, and more than that many sstables would have to be fetched before
+// the key is found, a TooManyOverlaps error is returned instead. If onFetch
+// isn't nil, it's called with each sstable which is fetched.
+//
+// Finding the key in one sstable doesn't mean it's the newest version, since
+// imports and some compactions leave sstables whose ranges of timestamps
+// overlap, so it keeps reading until the rest are all older than the version
+// found. Versions with the same timestamp are ordered by sequence number, like
+// in compaction. If the limit is reached after the key is found, the newest
+// version so far is returned.
+func findNewest(ctx context.Context, bs *blobstore.Blobstore, metas []*sstable.Meta, key string, limit int, stats *GetStats, onFetch func(*sstable.Meta)) (*types.Record, error) {
+	var newest *types.Record
+	var newestIn *sstable.Meta
+
+	for _, meta := range metas {
+
+		// sorted by MaxTime, so the rest can only contain older versions.
+		if newest != nil && meta.MaxTime.Before(newest.Timestamp) {
+			break
+		}
+
+		if limit > 0 && stats.BlobsFetched >= limit {
+			if newest != nil {
+				break
+			}
+			return nil, &TooManyOverlaps{Key: key, Limit: limit, Candidates: metas}
+		}
+
+		rec, bstats, err := bs.Find(ctx, meta, key)
+		if err != nil {
+			return nil, fmt.Errorf("blobstore.Get: %w", err)
+		}
+
+		// accumulate stats as we go
+		if bstats.Filtered {
+			stats.BlobsFiltered++
+			continue
+		}
+		stats.BlobsFetched++
+		stats.RecordsScanned += bstats.RecordsScanned
+		if onFetch != nil {
+			onFetch(meta)
+		}
+
+		if rec == nil {
+			continue
+		}
+
+		if newest == nil || rec.Timestamp.After(newest.Timestamp) ||
+			(rec.Timestamp.Equal(newest.Timestamp) && meta.LargestSeq > newestIn.LargestSeq) {
+			newest, newestIn = rec, meta
+			stats.Source = bstats.Source
+		}
+	}
+
+	// nil if the key wasn't found.
+	return newest, nil
+}
+
+// ErrTooManyOverlaps matches any TooManyOverlaps error, via errors.Is.
+var ErrTooManyOverlaps = &TooManyOverlaps{}
+
+// TooManyOverlaps is returned by Get when the key might be in more sstables than
+// the limit set by WithMaxGetFetches, and it wasn't found in the first ones.
+type TooManyOverlaps struct {
+	Key   string
+	Limit int
+
+	// Candidates are all of the sstables which might contain the key, newest
+	// first, including those already fetched.
+	Candidates []*sstable.Meta
+}
+
+func (e *TooManyOverlaps) Error() string {
+	return fmt.Sprintf("too many overlapping sstables for key %q: %d candidates, limit is %d", e.Key, len(e.Candidates), e.Limit)
+}
+
+func (e *TooManyOverlaps) Is(err error) bool {
+	_, ok := err.(*TooManyOverlaps)
+	return ok
+}
+
+// getContaining returns the metadata of the sstables which might contain the
+// given key, from the watcher if one is running, or the metadata store if not.
+func (b *Blobby) getContaining(ctx context.Context, key string) ([]*sstable.Meta, error) {
+	if w := b.watcher.Load(); w != nil {
+		select {
+		case <-w.Ready():
+			return w.GetContaining(key), nil
+		default:
+		}
+	}
+
+	metas, err := b.md.GetContaining(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetContaining: %w", err)
+	}
+
+	return metas, nil
+}
+
+type MetadataEvent = metadata.Event
+
+// WatchMetadata watches the metadata store for sstables being added or removed
+// by any process sharing this archive, and calls onEvent (if not nil) for each
+// change, until the context is cancelled or watching fails. While it's running,
+// Get reads the list of sstables from memory rather than querying Mongo, which
+// is much faster but might lag behind other processes very slightly.
+func (b *Blobby) WatchMetadata(ctx context.Context, onEvent func(MetadataEvent)) error {
+	st, ok := b.md.(*metadata.Store)
+	if !ok {
+		return fmt.Errorf("can't watch metadata store: %T", b.md)
+	}
+
+	w := st.NewWatcher(onEvent)
+	if !b.watcher.CompareAndSwap(nil, w) {
+		return fmt.Errorf("already watching metadata")
+	}
+	defer b.watcher.Store(nil)
+
+	err := w.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("watcher.Run: %w", err)
+	}
+
+	return nil
+}
+
+type Progress = blobstore.Progress
+type ProgressFunc = blobstore.ProgressFunc
+
+type FlushOptions struct {
+	// Force flushes the active memtable regardless of MinRecords and MaxAge.
+	// Empty memtables are never flushed, even when this is set.
+	Force bool
+
+	// MinRecords specifies the minimum number of records which the active
+	// memtable must contain before it's flushed.
+	MinRecords int
+
+	// MaxAge specifies how old the oldest record in the active memtable must be
+	// before it's flushed. If both this and MinRecords are set, the memtable is
+	// flushed when either of them is exceeded.
+	MaxAge time.Duration
+
+	// Progress, if set, is called with the progress of the flush as it runs.
+	// See blobstore.ProgressFunc.
+	Progress ProgressFunc
+
+	// MaxDuration, if set, bounds how long the flush spends writing records.
+	// Once it's exceeded, the flush stops at the next key, and commits the
+	// sstable(s) written so far, rather than abandoning them. The rest of the
+	// records stay in the memtable, and are flushed first by the next Flush,
+	// regardless of the other options. See FlushStats.Partial.
+	MaxDuration time.Duration
+
+	// BatchSize is the maximum number of records read from the memtable at
+	// once, or zero for DefaultFlushBatchSize. Each batch is read with its own
+	// query, and handed to the sstable writer before the next is read, so only
+	// one is held in memory. A batch which fails to read is retried, without
+	// starting the flush over.
+	BatchSize int
+
+	// ResumeOnly only finishes a partial or failed flush, if there is one,
+	// rather than flushing the active memtable. See RecoverFlushes.
+	ResumeOnly bool
+}
+
+type FlushStats struct {
+
+	// Skipped is true if the active memtable was not flushed, because it was
+	// empty or didn't meet the thresholds in FlushOptions. None of the other
+	// fields are set when this is true.
+	Skipped bool
+
+	// The name of the memtable which was flushed, and its URL, for display.
+	// See memtable.Handle.URL.
+	FlushedMemtable    string
+	FlushedMemtableURL string
+
+	// The name of the memtable that is now active, after the flush.
+	ActiveMemtable string
+
+	// The URL of the flushed sstable.
+	// TODO: Rename this to reflect that it's just the blob key (filename) now.
+	BlobURL string
+
+	// Metadata about the flushed sstable. This is nil if every record in the
+	// memtable had expired, so no sstable was written. If the flush was
+	// partitioned (see WithFlushPartitioner), it's the first of Outputs.
+	Meta *sstable.Meta
+
+	// Metadata about every sstable written by the flush, in key order. There's
+	// only one unless the flush was partitioned.
+	Outputs []*sstable.Meta
+
+	// Resumed is true if the flush finished a memtable which was left behind
+	// by a partial or failed flush, rather than the active memtable.
+	Resumed bool
+
+	// The number of batches read from the memtable and written, and the number
+	// of times that reading one failed and was retried. See BatchSize.
+	Batches     int
+	ReadRetries int
+
+	// Partial is true if the flush exceeded FlushOptions.MaxDuration, so only
+	// some of the records in FlushedMemtable were written. Remaining is the
+	// number which are left in it, to be flushed by the next Flush.
+	Partial   bool
+	Remaining int
+}
+
+// DefaultFlushBatchSize is the number of records read from the memtable at once
+// by Flush, unless FlushOptions.BatchSize is given.
+const DefaultFlushBatchSize = 1000
+
+// flushReadRetries is the number of times that reading a batch of records from
+// the memtable is retried by Flush, before it fails.
+const flushReadRetries = 3
+
+// ErrFlushInProgress is returned by Flush when another flush is already running,
+// either in this process or (if it rotated the same memtable) in another.
+var ErrFlushInProgress = errors.New("flush already in progress")
+
+func (b *Blobby) Flush(ctx context.Context, opts FlushOptions) (*FlushStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassFlush)
+	err := b.checkTask(ctx, TaskFlush)
+	if err != nil {
+		return &FlushStats{}, err
+	}
+
+	start := b.clock.Now()
+	stats, err := b.flush(ctx, opts)
+	b.logSlow(ctx, "flush", b.slowThresholds.Flush, start, err, flushAttrs(stats)...)
+
+	// skipped and rejected flushes didn't change anything, so aren't audited.
+	if stats.Skipped || errors.Is(err, ErrFlushInProgress) {
+		return stats, err
+	}
+
+	b.emit(ctx, Event{Type: EventFlush, Created: stats.Outputs, Error: err})
+
+	e := &audit.Entry{Op: audit.OpFlush, Created: filenames(stats.Outputs)}
+
+	err = b.audited(ctx, e, err)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, b.autoPublish(ctx)
+}
+
+func (b *Blobby) flush(ctx context.Context, opts FlushOptions) (*FlushStats, error) {
+	stats := &FlushStats{}
+
+	if !b.flushMu.TryLock() {
+		return stats, ErrFlushInProgress
+	}
+	defer b.flushMu.Unlock()
+
+	// finish any partial or failed flush before starting another, so that
+	// newer versions of a key never end up in an older sstable, and memtables
+	// left behind by a crash don't mask newer versions which were flushed.
+	hPrev, err := b.mt.Resume(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("memtable.Resume: %w", err)
+	}
+
+	// if this flush fails, the next one can resume it straight away.
+	done := false
+	defer func() {
+		if hPrev != nil && !done {
+			_ = b.mt.Release(context.WithoutCancel(ctx), hPrev.Name())
+		}
+	}()
+
+	if hPrev != nil {
+		hActive, err := b.mt.Active(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("memtable.Active: %w", err)
+		}
+		stats.ActiveMemtable = hActive.Name()
+		stats.Resumed = true
+
+	} else if opts.ResumeOnly {
+		stats.Skipped = true
+		return stats, nil
+
+	} else {
+		ok, err := b.shouldFlush(ctx, opts)
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			stats.Skipped = true
+			return stats, nil
+		}
+
+		var hNext MemtableHandle
+		hPrev, hNext, err = b.mt.Rotate(ctx)
+		if err != nil {
+			if errors.Is(err, &memtable.RotateConflict{}) {
+				return stats, fmt.Errorf("%w: %w", ErrFlushInProgress, err)
+			}
+			return stats, fmt.Errorf("memtable.Rotate: %w", err)
+		}
+		stats.ActiveMemtable = hNext.Name()
+	}
+
+	if opts.Progress != nil {
+		n, err := hPrev.Count(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("handle.Count: %w", err)
+		}
+		ctx = blobstore.WithProgress(ctx, b.clock, n, opts.Progress)
+	}
+
+	// the records are always read in order, in batches. flushes which might
+	// stop part-way rely on that, so the ones which were written can be
+	// deleted from the memtable by key, and so do partitioned flushes, so they
+	// can be cut into sstables as they arrive. both of those write sstables as
+	// the records arrive, rather than buffering them.
+	var deadline time.Time
+	if opts.MaxDuration > 0 {
+		deadline = b.clock.Now().Add(opts.MaxDuration)
+	}
+	sorted := b.flushPartitioner != nil || !deadline.IsZero()
+
+	sopts := memtable.StreamOptions{
+		BatchSize: opts.BatchSize,
+		Retries:   flushReadRetries,
+	}
+	if sopts.BatchSize == 0 {
+		sopts.BatchSize = DefaultFlushBatchSize
+	}
+
+	read := func(ctx context.Context, ch chan *types.Record, now time.Time) error {
+		st, err := hPrev.FlushBatches(ctx, ch, now, sopts)
+		stats.Batches = st.Batches
+		stats.ReadRetries = st.Retries
+		return err
+	}
+
+	ch := make(chan *types.Record)
+	g, ctx2 := errgroup.WithContext(ctx)
+
+	// the first key which wasn't flushed, if the deadline was exceeded.
+	var cutKey string
+
+	g.Go(func() error {
+		now := b.clock.Now()
+
+		if deadline.IsZero() {
+			err := read(ctx2, ch, now)
+			if err != nil {
+				return fmt.Errorf("memtable.Flush: %w", err)
+			}
+			return nil
+		}
+
+		src := make(chan *types.Record)
+		rctx, cancel := context.WithCancel(ctx2)
+		defer cancel()
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- read(rctx, src, now)
+		}()
+
+		cutKey = cutAtDeadline(b.clock, deadline, src, ch)
+		cancel()
+
+		// if the flush was cut short, the reader was cancelled, but every
+		// record which was forwarded had been read successfully.
+		err := <-errc
+		if err != nil && cutKey == "" {
+			return fmt.Errorf("memtable.Flush: %w", err)
+		}
+		return nil
+	})
+
+	var metas []*sstable.Meta
+
+	g.Go(func() error {
+		if b.flushPartitioner != nil {
+			var err error
+			metas, err = b.bs.FlushPartitioned(ctx2, ch, b.flushPartitioner)
+			if err != nil {
+				return fmt.Errorf("blobstore.FlushPartitioned: %w", err)
+			}
+			return nil
+		}
+
+		// sorted flushes are written as they arrive, as a single partition.
+		if sorted {
+			var err error
+			metas, err = b.bs.FlushPartitioned(ctx2, ch, func(string) string { return "" })
+			if err != nil {
+				return fmt.Errorf("blobstore.FlushPartitioned: %w", err)
+			}
+			return nil
+		}
+
+		_, _, meta, err := b.bs.Flush(ctx2, ch)
+		if err != nil {
+			return fmt.Errorf("blobstore.Flush: %w", err)
+		}
+		metas = []*sstable.Meta{meta}
+		return nil
+	})
+
+	err = g.Wait()
+	if errors.Is(err, blobstore.NoRecords) {
+
+		// every record in the memtable had expired, so there's nothing to
+		// write. it can just be dropped.
+		stats.FlushedMemtable = hPrev.Name()
+		stats.FlushedMemtableURL = hPrev.URL()
+		err = b.mt.Drop(ctx, hPrev.Name())
+		if err != nil {
+			return stats, fmt.Errorf("memtable.Drop: %w", err)
+		}
+		done = true
+		blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseDone)
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	// wait until the sstable is actually readable to update the stats.
+
+	count := 0
+	for _, meta := range metas {
+		count += meta.Count
+	}
+
+	blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseCommit)
+
+	err = b.register(ctx, metas, count)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.FlushedMemtable = hPrev.Name()
+	stats.FlushedMemtableURL = hPrev.URL()
+	stats.BlobURL = metas[0].Filename()
+	stats.Meta = metas[0]
+	stats.Outputs = metas
+
+	if cutKey != "" {
+		err = b.keepRemainder(ctx, hPrev, cutKey, stats)
+		if err != nil {
+			return stats, err
+		}
+
+		done = true
+		blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseDone)
+		return stats, nil
+	}
+
+	err = b.mt.Drop(ctx, hPrev.Name())
+	if err != nil {
+		return stats, fmt.Errorf("memtable.Drop: %w", err)
+	}
+
+	done = true
+	blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseDone)
+	return stats, nil
+}
+
+// shouldFlush returns true if the active memtable is non-empty and meets the
+// thresholds in the given options.
+func (b *Blobby) shouldFlush(ctx context.Context, opts FlushOptions) (bool, error) {
+	h, err := b.mt.Active(ctx)
+	if err != nil {
+		return false, fmt.Errorf("memtable.Active: %w", err)
+	}
+
+	n, err := h.Count(ctx)
+	if err != nil {
+		return false, fmt.Errorf("handle.Count: %w", err)
+	}
+
+	if n == 0 {
+		return false, nil
+	}
+
+	if opts.Force || (opts.MinRecords == 0 && opts.MaxAge == 0) {
+		return true, nil
+	}
+
+	if opts.MinRecords > 0 && n >= opts.MinRecords {
+		return true, nil
+	}
+
+	if opts.MaxAge > 0 {
+		oldest, err := h.Oldest(ctx)
+		if err != nil {
+			return false, fmt.Errorf("handle.Oldest: %w", err)
+		}
+
+		if b.clock.Since(oldest) >= opts.MaxAge {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// register assigns sequence numbers to the records of the given new sstables,
+// which total count, and adds the sstables to the live set.
+func (b *Blobby) register(ctx context.Context, metas []*sstable.Meta, count int) error {
+	seq, err := b.md.NextSeq(ctx, int64(count))
+	if err != nil {
+		return fmt.Errorf("metadata.NextSeq: %w", err)
+	}
+
+	for _, meta := range metas {
+		meta.SmallestSeq = seq
+		meta.LargestSeq = seq + int64(meta.Count) - 1
+		seq += int64(meta.Count)
+
+		err = b.md.Insert(ctx, meta)
+		if err != nil {
+			// TODO: maybe delete the sstable(s) here, since they're orphaned.
+			return fmt.Errorf("metadata.Insert: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type Checkpoint = metadata.Checkpoint
+
+// Checkpoint flushes every memtable (see flushAll), then records the resulting
+// set of sstables under the given name, so the archive can later be restored to
+// this point by RollbackTo. Writes which arrive during the flush may or may not
+// be included. Names must be unique.
+func (b *Blobby) Checkpoint(ctx context.Context, name string) (*Checkpoint, error) {
+	err := b.flushAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := b.md.CreateCheckpoint(ctx, name, b.clock.Now())
+	if err != nil {
+		err = fmt.Errorf("metadata.CreateCheckpoint: %w", err)
+	}
+
+	err = b.audited(ctx, &audit.Entry{Op: audit.OpCheckpoint, Checkpoint: name}, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// ListCheckpoints returns every checkpoint, oldest first, with the sstables in
+// each. Rolling back is the only way to read the archive as of one of them;
+// there's no read at a checkpoint.
+func (b *Blobby) ListCheckpoints(ctx context.Context) ([]*Checkpoint, error) {
+	cps, err := b.md.ListCheckpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.ListCheckpoints: %w", err)
+	}
+
+	return cps, nil
+}
+
+// flushAll flushes the memtables left behind by earlier flushes, and then the
+// active one, so that every write which finished before it was called is in an
+// sstable. A forced Flush isn't enough, since it finishes a leftover memtable
+// instead of the active one, if there is one. It returns ErrFlushInProgress
+// if another process is still flushing a memtable, since its records might not
+// be in an sstable yet.
+func (b *Blobby) flushAll(ctx context.Context) error {
+	for {
+		_, err := b.RecoverFlushes(ctx)
+		if err != nil {
+			return fmt.Errorf("RecoverFlushes: %w", err)
+		}
+
+		// anything still in the queue is claimed by another process.
+		q, err := b.mt.FlushQueue(ctx)
+		if err != nil {
+			return fmt.Errorf("memtable.FlushQueue: %w", err)
+		}
+		if len(q) > 0 {
+			return fmt.Errorf("%w: memtable %s is being flushed by another process", ErrFlushInProgress, q[0].Name())
+		}
+
+		stats, err := b.Flush(ctx, FlushOptions{Force: true})
+		if err != nil {
+			return fmt.Errorf("Flush: %w", err)
+		}
+
+		// another flush was abandoned since the queue was checked, so this
+		// finished that instead of rotating the active memtable.
+		if !stats.Resumed {
+			return nil
+		}
+	}
+}
+
+// RollbackTo restores the archive to the state it was in when the given
+// checkpoint was created. Before doing so, it creates a new checkpoint of the
+// current state (which is returned), so the rollback itself can be undone by
+// rolling back to that. No sstables are deleted.
+func (b *Blobby) RollbackTo(ctx context.Context, name string) (*Checkpoint, error) {
+	cp, err := b.md.GetCheckpoint(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetCheckpoint: %w", err)
+	}
+
+	// flush the memtable as part of this, so the rolled-back data isn't masked
+	// by records which were written since the checkpoint.
+	undo, err := b.Checkpoint(ctx, fmt.Sprintf("pre-rollback-%d", b.clock.Now().UnixMilli()))
+	if err != nil {
+		return nil, fmt.Errorf("Checkpoint: %w", err)
+	}
+
+	err = b.md.Restore(ctx, cp, b.clock.Now())
+	if err != nil {
+		err = fmt.Errorf("metadata.Restore: %w", err)
+	}
+
+	err = b.audited(ctx, &audit.Entry{Op: audit.OpRollback, Checkpoint: name}, err)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.autoPublish(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return undo, nil
+}
+
+// Sibling returns a handle on the archive with the given name, in the same Mongo
+// database and bucket as this one, with the same blobstore options and clients.
+// It must be opened (or initialized) before use.
+func (b *Blobby) Sibling(name string) *Blobby {
+	return New(b.mongoURL, b.bucket, b.clock, WithName(name), WithMongoClient(b.mongoClient), WithS3Client(b.s3Client), func(dst *Blobby) {
+		dst.bsOpts = b.bsOpts
+	})
+}
+
+// clonePrefix is prepended to the names of the checkpoints created by Clone, so
+// the sstables they pin can be recognized as shared with another archive.
+const clonePrefix = "clone-"
+
+// Clone creates a new archive with the given name, containing everything in
+// this one. The sstables are shared rather than copied, so this is cheap, but
+// it flushes the memtable of this archive first. The clone has its own
+// memtable, and writes to either archive are not visible in the other.
+//
+// The shared sstables are pinned by a checkpoint in each archive, so neither
+// will delete them when compacting.
+//
+// Both archives write new sstables to the same bucket, so they might choose the
+// same name if they flush in the same millisecond. The blobstore never
+// overwrites an sstable, so one of them is given the next name instead.
+func (b *Blobby) Clone(ctx context.Context, target string) (*Blobby, error) {
+	if target == b.name {
+		return nil, fmt.Errorf("can't clone archive into itself: %s", target)
+	}
+
+	cp, err := b.Checkpoint(ctx, clonePrefix+"to-"+target)
+	if err != nil {
+		return nil, fmt.Errorf("Checkpoint: %w", err)
+	}
+
+	dst := b.Sibling(target)
+	err = dst.Init(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Init(%s): %w", target, err)
+	}
+
+	for _, m := range cp.Metas {
+		err = dst.md.Insert(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("metadata.Insert(%s): %w", m.Filename(), err)
+		}
+	}
+
+	_, err = dst.md.CreateCheckpoint(ctx, clonePrefix+"from-"+b.name, b.clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("metadata.CreateCheckpoint(%s): %w", target, err)
+	}
+
+	return dst, nil
+}
+
+type PurgeStats = compactor.PurgeStats
+
+// DefaultPurgeGrace is a reasonable grace period to pass to Purge. It should be
+// much longer than the slowest read.
+const DefaultPurgeGrace = 1 * time.Hour
+
+// Purge permanently deletes sstables which were superseded by compaction (or
+// rollback) more than grace ago. Until then, they're retained so that reads
+// which already decided to fetch them don't fail.
+func (b *Blobby) Purge(ctx context.Context, grace time.Duration) (*PurgeStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGC)
+	err := b.checkTask(ctx, TaskGC)
+	if err != nil {
+		return &PurgeStats{}, err
+	}
+
+	stats, err := b.comp.Purge(ctx, grace)
+	if err == nil && len(stats.Purged) == 0 {
+		return stats, nil
+	}
+
+	b.emit(ctx, Event{Type: EventPurge, Removed: stats.Purged, Error: err})
+
+	err = b.audited(ctx, &audit.Entry{Op: audit.OpPurge, Removed: filenames(stats.Purged)}, err)
+	if err != nil {
+		return stats, err
+	}
+
+	err = b.md.DeleteAccess(ctx, filenames(stats.Purged))
+	if err != nil {
+		return stats, fmt.Errorf("metadata.DeleteAccess: %w", err)
+	}
+
+	// the compactions which superseded the purged sstables left the summaries
+	// of their windows wider than necessary, so this is a good time to narrow
+	// them.
+	err = b.md.RebuildWindows(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.RebuildWindows: %w", err)
+	}
+
+	return stats, nil
+}
+
+type CompactionStats = compactor.CompactionStats
+type CompactionOptions = compactor.CompactionOptions
+type RecoverStats = compactor.RecoverStats
+
+// ErrCompactionConflict is the Error of a CompactionStats when some of its
+// inputs were already being compacted, in this process or another. Nothing was
+// changed, so it's safe to ignore.
+var ErrCompactionConflict = metadata.ErrClaimed
+
+// ErrCompactionTimedOut is the Error of a CompactionStats when the compaction
+// exceeded CompactionOptions.MaxDuration, and was abandoned. Nothing was
+// changed.
+var ErrCompactionTimedOut = compactor.ErrTimedOut
 
 func (b *Blobby) Compact(ctx context.Context, opts CompactionOptions) ([]*CompactionStats, error) {
-	return b.comp.Run(ctx, opts)
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassCompaction)
+	err := b.checkTask(ctx, TaskCompaction)
+	if err != nil {
+		return nil, err
+	}
+
+	start := b.clock.Now()
+	stats, err := b.comp.Run(ctx, b.compactionOptions(opts))
+	b.logSlow(ctx, "compact", b.slowThresholds.Compact, start, err, compactAttrs(stats)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// each compaction is recorded separately, since they can fail separately.
+	changed := false
+	for _, s := range stats {
+		if errors.Is(s.Error, ErrCompactionConflict) {
+			continue
+		}
+
+		e := Event{Type: EventCompaction, Created: s.Outputs, Error: s.Error}
+		if s.Error == nil {
+			e.Removed = s.Inputs
+		}
+		b.emit(ctx, e)
+
+		err = b.audited(ctx, &audit.Entry{
+			Op:      audit.OpCompact,
+			Created: filenames(s.Outputs),
+			Removed: filenames(s.Inputs),
+		}, s.Error)
+		if err != nil && s.Error == nil {
+			return stats, err
+		}
+
+		err = b.recordCompaction(ctx, s)
+		if err != nil {
+			return stats, err
+		}
+
+		// failed compactions might have changed the live set too, if they
+		// failed part-way through updating the metadata.
+		if len(s.Outputs) > 0 {
+			changed = true
+		}
+	}
+
+	if changed {
+		return stats, b.autoPublish(ctx)
+	}
+
+	return stats, nil
+}
+
+// RecoverCompactions finishes or undoes compactions which were prepared more
+// than grace ago but never committed, e.g. because the process crashed while
+// committing them. See compactor.Recover.
+func (b *Blobby) RecoverCompactions(ctx context.Context, grace time.Duration) (*RecoverStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassCompaction)
+	stats, err := b.comp.Recover(ctx, grace)
+
+	for _, p := range stats.RolledForward {
+		b.emit(ctx, Event{Type: EventCompaction, Created: p.Outputs, Removed: p.Inputs})
+
+		aerr := b.audited(ctx, &audit.Entry{
+			Op:      audit.OpCompact,
+			Created: filenames(p.Outputs),
+			Removed: filenames(p.Inputs),
+		}, nil)
+		if aerr != nil {
+			return stats, errors.Join(err, aerr)
+		}
+
+		// the compaction's own stats were lost along with the process which
+		// ran it, so only what was in the pending record is known.
+		herr := b.recordCompaction(ctx, &CompactionStats{
+			Inputs:   p.Inputs,
+			Outputs:  p.Outputs,
+			Reason:   "recovered",
+			Started:  p.Created,
+			Finished: b.clock.Now(),
+		})
+		if herr != nil {
+			return stats, errors.Join(err, herr)
+		}
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	if len(stats.RolledForward) > 0 {
+		return stats, b.autoPublish(ctx)
+	}
+
+	return stats, nil
 }
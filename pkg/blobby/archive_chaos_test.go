@@ -208,7 +208,7 @@ func (o flushOp) String() string {
 }
 
 func (o flushOp) run(t *testing.T, ctx context.Context, b *Blobby, state *testState) error {
-	stats, err := b.Flush(ctx)
+	stats, err := b.Flush(ctx, FlushOptions{})
 	if err != nil {
 		// special case. it's fine if there's nothing to flush.
 		if errors.Is(err, blobstore.NoRecords) {
@@ -218,6 +218,10 @@ func (o flushOp) run(t *testing.T, ctx context.Context, b *Blobby, state *testSt
 
 		return fmt.Errorf("flush: %v", err)
 	}
+	if stats.Skipped {
+		t.Logf("Flush: skipped.")
+		return nil
+	}
 	t.Logf("Flush: %d records -> %s, now active: %s",
 		stats.Meta.Count, stats.BlobURL, stats.ActiveMemtable)
 	return nil
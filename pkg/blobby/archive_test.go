@@ -3,13 +3,18 @@ package blobby
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/codec"
 	"github.com/adammck/blobby/pkg/compactor"
 	"github.com/adammck/blobby/pkg/sstable"
 	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/adammck/blobby/pkg/types"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/require"
 )
@@ -29,6 +34,15 @@ func setup(t *testing.T, clock clockwork.Clock) (context.Context, *testdeps.Env,
 	return ctx, env, b
 }
 
+// clearChecksums zeroes the checksums of the given metas, after checking that
+// they're set, since they can't be predicted.
+func clearChecksums(t *testing.T, metas ...*sstable.Meta) {
+	for _, m := range metas {
+		require.NotZero(t, m.Checksum, m.Filename())
+		m.Checksum = 0
+	}
+}
+
 func TestBasicWriteRead(t *testing.T) {
 
 	// Fix the clock to the current time, but simplify things by rounding to the
@@ -80,21 +94,33 @@ func TestBasicWriteRead(t *testing.T) {
 
 	// flush memtable to the blobstore
 	t2 := tb.now()
-	fstats, err := b.Flush(ctx)
+	fstats, err := b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
+	clearChecksums(t, fstats.Outputs...)
+	meta := &sstable.Meta{
+		MinKey:       "001",
+		MaxKey:       "010",
+		MinTime:      t1.t.Add(15 * time.Millisecond),
+		MaxTime:      t1.t.Add(15 * time.Millisecond * 10),
+		Count:        10,
+		Keys:         10,
+		Size:         497, // idk lol
+		MinValueSize: 9,
+		MaxValueSize: 9,
+		ValueBytes:   90,
+		RawSize:      490,
+		Created:      t2.t,
+		SmallestSeq:  1,
+		LargestSeq:   10,
+		Index:        t2.sstable + ".index",
+	}
 	require.Equal(t, &FlushStats{
-		FlushedMemtable: t1.memtable,
-		ActiveMemtable:  t2.memtable,
-		BlobURL:         t2.sstable,
-		Meta: &sstable.Meta{
-			MinKey:  "001",
-			MaxKey:  "010",
-			MinTime: t1.t.Add(15 * time.Millisecond),
-			MaxTime: t1.t.Add(15 * time.Millisecond * 10),
-			Count:   10,
-			Size:    497, // idk lol
-			Created: t2.t,
-		},
+		FlushedMemtable:    t1.memtable,
+		FlushedMemtableURL: t1.memtableURL,
+		ActiveMemtable:     t2.memtable,
+		BlobURL:            t2.sstable,
+		Meta:               meta,
+		Outputs:            []*sstable.Meta{meta},
 	}, fstats)
 
 	// fetch the same key, and see that it's now read from the blobstore.
@@ -135,21 +161,33 @@ func TestBasicWriteRead(t *testing.T) {
 	// flush again. note that the keys in this sstable are totally disjoint from
 	// the first.
 	t3 := tb.now()
-	fstats, err = b.Flush(ctx)
+	fstats, err = b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
+	clearChecksums(t, fstats.Outputs...)
+	meta = &sstable.Meta{
+		MinKey:       "011",
+		MaxKey:       "020",
+		MinTime:      t2.t.Add(15 * time.Millisecond),
+		MaxTime:      t2.t.Add(15 * time.Millisecond * 10),
+		Count:        10,
+		Keys:         10,
+		Size:         497,
+		MinValueSize: 9,
+		MaxValueSize: 9,
+		ValueBytes:   90,
+		RawSize:      490,
+		Created:      t3.t,
+		SmallestSeq:  11,
+		LargestSeq:   20,
+		Index:        t3.sstable + ".index",
+	}
 	require.Equal(t, &FlushStats{
-		FlushedMemtable: t2.memtable,
-		ActiveMemtable:  t3.memtable,
-		BlobURL:         t3.sstable,
-		Meta: &sstable.Meta{
-			MinKey:  "011",
-			MaxKey:  "020",
-			MinTime: t2.t.Add(15 * time.Millisecond),
-			MaxTime: t2.t.Add(15 * time.Millisecond * 10),
-			Count:   10,
-			Size:    497,
-			Created: t3.t,
-		},
+		FlushedMemtable:    t2.memtable,
+		FlushedMemtableURL: t2.memtableURL,
+		ActiveMemtable:     t3.memtable,
+		BlobURL:            t3.sstable,
+		Meta:               meta,
+		Outputs:            []*sstable.Meta{meta},
 	}, fstats)
 
 	// fetch two keys, to show that they're in the different sstables, but that
@@ -197,21 +235,33 @@ func TestBasicWriteRead(t *testing.T) {
 	// flush again. the two keys we just wrote will end up in the new sstable.
 	c.Advance(1 * time.Hour)
 	t4 := tb.now()
-	fstats, err = b.Flush(ctx)
+	fstats, err = b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
+	clearChecksums(t, fstats.Outputs...)
+	meta = &sstable.Meta{
+		MinKey:       "003",
+		MaxKey:       "013",
+		MinTime:      t3.t.Add(15 * time.Millisecond),
+		MaxTime:      t3.t.Add(15 * time.Millisecond * 2),
+		Count:        2,
+		Keys:         2,
+		Size:         93,
+		MinValueSize: 3,
+		MaxValueSize: 3,
+		ValueBytes:   6,
+		RawSize:      86,
+		Created:      t4.t,
+		SmallestSeq:  21,
+		LargestSeq:   22,
+		Index:        t4.sstable + ".index",
+	}
 	require.Equal(t, &FlushStats{
-		FlushedMemtable: t3.memtable,
-		ActiveMemtable:  t4.memtable,
-		BlobURL:         t4.sstable,
-		Meta: &sstable.Meta{
-			MinKey:  "003",
-			MaxKey:  "013",
-			MinTime: t3.t.Add(15 * time.Millisecond),
-			MaxTime: t3.t.Add(15 * time.Millisecond * 2),
-			Count:   2,
-			Size:    93,
-			Created: t4.t,
-		},
+		FlushedMemtable:    t3.memtable,
+		FlushedMemtableURL: t3.memtableURL,
+		ActiveMemtable:     t4.memtable,
+		BlobURL:            t4.sstable,
+		Meta:               meta,
+		Outputs:            []*sstable.Meta{meta},
 	}, fstats)
 
 	// now we have three sstables with the key ranges:
@@ -242,19 +292,15 @@ func TestBasicWriteRead(t *testing.T) {
 	}, gstats)
 
 	// finally, fetch a key which we know was flushed into the middle sstable,
-	// but is within the key range of the latest sstable. we need to fetch both
-	// sstables, and scan through the first to check that the key isn't present
-	// before moving onto the second one.
-	//
-	// later, we'll optimize this with bloom filters, so we can often skip the
-	// first fetch. not implemented yet. we'll also index them, so we can fetch
-	// a subset of keys, but that's also not implemented.
+	// but is within the key range of the latest sstable. the latest sstable's
+	// bloom filter rules the key out, so only the middle one is fetched.
 	val, gstats = tb.get("012")
 	require.Equal(t, val, docs["012"])
 	require.Equal(t, &GetStats{
 		Source:         t3.sstable,
-		BlobsFetched:   2, // <--
-		RecordsScanned: 4, // (003, 013), (011, 012)
+		BlobsFetched:   1, // <--
+		BlobsFiltered:  1, // <--
+		RecordsScanned: 2, // (011, 012)
 	}, gstats)
 
 	// -------------------------------------- part three: simple compaction ----
@@ -266,15 +312,26 @@ func TestBasicWriteRead(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, cstats, 1)
 	require.NoError(t, cstats[0].Error)
+	clearChecksums(t, cstats[0].Outputs...)
 	require.Equal(t, []*sstable.Meta{
 		{
-			MinKey:  "001",
-			MaxKey:  "020",
-			MinTime: t1.t.Add(15 * time.Millisecond),
-			MaxTime: t3.t.Add(15 * time.Millisecond * 2),
-			Count:   22,
-			Size:    1073,
-			Created: t5.t,
+			MinKey:       "001",
+			MaxKey:       "020",
+			MinTime:      t1.t.Add(15 * time.Millisecond),
+			MaxTime:      t3.t.Add(15 * time.Millisecond * 2),
+			Count:        22,
+			Keys:         20,
+			Size:         1073,
+			MinValueSize: 3,
+			MaxValueSize: 9,
+			ValueBytes:   186,
+			RawSize:      1066,
+			Created:      t5.t,
+			Level:        1,
+			Generation:   1,
+			SmallestSeq:  1,
+			LargestSeq:   22,
+			Index:        t5.sstable + ".index",
 		},
 	}, cstats[0].Outputs)
 
@@ -304,9 +361,22 @@ func TestBasicWriteRead(t *testing.T) {
 		RecordsScanned: 14,
 	}, gstats)
 
+	// the old sstables are still around, in case some reader is still fetching
+	// them, until they're purged after the grace period.
+	for _, ts := range []instant{t2, t3, t4} {
+		_, err = b.bs.Get(ctx, ts.sstable)
+		require.NoError(t, err)
+	}
+
+	c.Advance(DefaultPurgeGrace)
+	pstats, err := b.Purge(ctx, DefaultPurgeGrace)
+	require.NoError(t, err)
+	require.Len(t, pstats.Purged, 3)
+	require.Equal(t, 3, pstats.BlobsDeleted)
+
 	// check that the old sstables were deleted.
 	for _, ts := range []instant{t2, t3, t4} {
-		_, _, err = b.bs.Find(ctx, ts.sstable, "001")
+		_, err = b.bs.Get(ctx, ts.sstable)
 		require.Error(t, err)
 	}
 
@@ -321,7 +391,7 @@ func TestBasicWriteRead(t *testing.T) {
 	// flush to create second sstable
 	c.Advance(1 * time.Hour)
 	t6 := tb.now()
-	fstats, err = b.Flush(ctx)
+	fstats, err = b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 2, fstats.Meta.Count)
 
@@ -334,7 +404,7 @@ func TestBasicWriteRead(t *testing.T) {
 	// flush to create third sstable
 	c.Advance(1 * time.Hour)
 	t7 := tb.now()
-	fstats, err = b.Flush(ctx)
+	fstats, err = b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 2, fstats.Meta.Count)
 
@@ -347,7 +417,7 @@ func TestBasicWriteRead(t *testing.T) {
 	// flush to create fourth sstable
 	c.Advance(1 * time.Hour)
 	t8 := tb.now()
-	fstats, err = b.Flush(ctx)
+	fstats, err = b.Flush(ctx, FlushOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 2, fstats.Meta.Count)
 
@@ -375,14 +445,25 @@ func TestBasicWriteRead(t *testing.T) {
 
 	// verify output metadata
 	require.Len(t, cstats[0].Outputs, 1)
+	clearChecksums(t, cstats[0].Outputs...)
 	require.Equal(t, &sstable.Meta{
-		MinKey:  "201",
-		MaxKey:  "302",
-		MinTime: t6.t.Add(15 * time.Millisecond * 1),
-		MaxTime: t7.t.Add(15 * time.Millisecond * 2),
-		Count:   4,
-		Size:    175,
-		Created: t9.t,
+		MinKey:       "201",
+		MaxKey:       "302",
+		MinTime:      t6.t.Add(15 * time.Millisecond * 1),
+		MaxTime:      t7.t.Add(15 * time.Millisecond * 2),
+		Count:        4,
+		Keys:         4,
+		Size:         175,
+		MinValueSize: 2,
+		MaxValueSize: 2,
+		ValueBytes:   8,
+		RawSize:      168,
+		Created:      t9.t,
+		Level:        1,
+		Generation:   1,
+		SmallestSeq:  25,
+		LargestSeq:   28,
+		Index:        t9.sstable + ".index",
 	}, cstats[0].Outputs[0])
 
 	// verify we can read from the newly compacted file
@@ -395,14 +476,17 @@ func TestBasicWriteRead(t *testing.T) {
 	}, gstats)
 
 	// verify the old uncompacted sstables still exist
-	_, _, err = b.bs.Find(ctx, t5.sstable, "001")
+	_, err = b.bs.Get(ctx, t5.sstable)
 	require.NoError(t, err)
-	_, _, err = b.bs.Find(ctx, t6.sstable, "101")
+	_, err = b.bs.Get(ctx, t6.sstable)
 	require.NoError(t, err)
 
-	// verify the compacted sstables were deleted
+	// verify the compacted sstables were deleted, once purged
+	c.Advance(DefaultPurgeGrace)
+	_, err = b.Purge(ctx, DefaultPurgeGrace)
+	require.NoError(t, err)
 	for _, ins := range []instant{t7, t8} {
-		_, _, err = b.bs.Find(ctx, ins.sstable, "001")
+		_, err = b.bs.Get(ctx, ins.sstable)
 		require.Error(t, err)
 	}
 
@@ -432,9 +516,10 @@ func (ta *testBlobby) get(key string) ([]byte, *GetStats) {
 }
 
 type instant struct {
-	t        time.Time
-	memtable string
-	sstable  string
+	t           time.Time
+	memtable    string
+	memtableURL string
+	sstable     string
 }
 
 // now returns the current (fake) time, in a handy struct which also contains
@@ -442,10 +527,357 @@ type instant struct {
 // this is just to avoid baking the filename patterns into the tests.
 func (ta *testBlobby) now() instant {
 	t := ta.c.Now()
+	mt := fmt.Sprintf("mt_%d", t.UTC().UnixNano())
+
+	u, err := url.Parse(ta.b.mongoURL)
+	require.NoError(ta.t, err)
 
 	return instant{
-		t:        t,
-		memtable: fmt.Sprintf("mt_%d", t.UTC().UnixNano()),
-		sstable:  fmt.Sprintf("%d.sstable", t.UnixMilli()),
+		t:           t,
+		memtable:    mt,
+		memtableURL: fmt.Sprintf("mongodb://%s/%s/%s", u.Host, ta.b.name, mt),
+		sstable:     fmt.Sprintf("%d.sstable", t.UnixMilli()),
 	}
 }
+
+func TestFlushInProgress(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	// pretend that another flush is running in this process.
+	b.flushMu.Lock()
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.ErrorIs(t, err, ErrFlushInProgress)
+	b.flushMu.Unlock()
+
+	// once it's finished, flushing works again.
+	_, err = b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+}
+
+func TestClone(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	tb.put("b", []byte("b1"))
+
+	c.Advance(1 * time.Second)
+	b2, err := b.Clone(ctx, "staging")
+	require.NoError(t, err)
+	require.Equal(t, "staging", b2.Name())
+	tb2 := &testBlobby{ctx: ctx, c: c, t: t, b: b2}
+
+	// the clone can read everything written before it was created.
+	val, _ := tb2.get("a")
+	require.Equal(t, []byte("a1"), val)
+
+	// but writes to either archive aren't visible in the other.
+	c.Advance(1 * time.Second)
+	tb.put("a", []byte("a2"))
+	tb2.put("b", []byte("b2"))
+
+	val, _ = tb.get("b")
+	require.Equal(t, []byte("b1"), val)
+	val, _ = tb2.get("a")
+	require.Equal(t, []byte("a1"), val)
+
+	// compacting the clone doesn't delete the shared sstable.
+	c.Advance(1 * time.Second)
+	_, err = b2.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	cstats, err := b2.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	require.Len(t, cstats, 1)
+	require.NoError(t, cstats[0].Error)
+
+	val, _ = tb.get("a")
+	require.Equal(t, []byte("a2"), val)
+	c.Advance(1 * time.Second)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	val, _ = tb.get("b")
+	require.Equal(t, []byte("b1"), val)
+}
+
+func TestCloneFlushSameTime(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	b2, err := b.Clone(ctx, "staging")
+	require.NoError(t, err)
+	tb2 := &testBlobby{ctx: ctx, c: c, t: t, b: b2}
+
+	// the clock doesn't move, so both archives choose the same name.
+	tb.put("k", []byte("source"))
+	tb2.put("k", []byte("clone"))
+	s1, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	s2, err := b2.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, s1.BlobURL, s2.BlobURL)
+
+	val, _ := tb.get("k")
+	require.Equal(t, []byte("source"), val)
+	val, _ = tb2.get("k")
+	require.Equal(t, []byte("clone"), val)
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	b := New(env.MongoURL(), env.S3Bucket, clockwork.NewFakeClock())
+
+	err := b.Open(ctx)
+	require.ErrorIs(t, err, ErrNotInitialized)
+
+	err = b.Init(ctx)
+	require.NoError(t, err)
+	err = b.Open(ctx)
+	require.NoError(t, err)
+
+	// init is idempotent.
+	err = b.Init(ctx)
+	require.NoError(t, err)
+	ok, err := b.Initialized(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestFeatureBlocks(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	// written before the feature was enabled.
+	_, err := b.Put(ctx, "a", []byte("old"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, b.EnableFeature(ctx, FeatureBlocks))
+	require.NoError(t, b.Open(ctx))
+
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "b", []byte("new"))
+	require.NoError(t, err)
+	fstats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	require.Equal(t, sstable.FormatBlocks, fstats.Meta.Format)
+
+	// both formats can be read, and compacted together.
+	for _, stage := range []string{"flushed", "compacted"} {
+		v, _, err := b.Get(ctx, "a")
+		require.NoError(t, err, stage)
+		require.Equal(t, []byte("old"), v, stage)
+
+		v, _, err = b.Get(ctx, "b")
+		require.NoError(t, err, stage)
+		require.Equal(t, []byte("new"), v, stage)
+
+		c.Advance(time.Second)
+		_, err = b.Compact(ctx, CompactionOptions{})
+		require.NoError(t, err)
+	}
+}
+
+func TestGetContainingOrderAfterCompaction(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	// write four overlapping sstables, each containing a newer version of k.
+	for i := 1; i <= 4; i++ {
+		c.Advance(15 * time.Millisecond)
+		tb.put("a", []byte("a"))
+		tb.put("k", []byte(fmt.Sprintf("v%d", i)))
+		tb.put("z", []byte("z"))
+		c.Advance(1 * time.Second)
+		_, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+
+	// compact the oldest two, so the output is created after (but contains
+	// records older than) the two newest sstables.
+	c.Advance(1 * time.Second)
+	_, err := b.Compact(ctx, CompactionOptions{Order: compactor.OldestFirst, MaxFiles: 2})
+	require.NoError(t, err)
+
+	metas, err := b.md.GetContaining(ctx, "k")
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+	for i := 1; i < len(metas); i++ {
+		require.False(t, metas[i].MaxTime.After(metas[i-1].MaxTime),
+			"metas[%d] is newer than metas[%d]", i, i-1)
+	}
+
+	// the newest version still wins.
+	val, _ := tb.get("k")
+	require.Equal(t, []byte("v4"), val)
+}
+
+func TestFindNewest(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	bs := blobstore.New(env.S3Bucket, c)
+
+	t0 := c.Now()
+	rec := func(key, value string, sec int) *types.Record {
+		return &types.Record{Key: key, Timestamp: t0.Add(time.Duration(sec) * time.Second), Document: []byte(value)}
+	}
+
+	write := func(seq int64, recs ...*types.Record) *sstable.Meta {
+		ch := make(chan *types.Record)
+		go func() {
+			defer close(ch)
+			for _, r := range recs {
+				ch <- r
+			}
+		}()
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		require.NoError(t, err)
+		meta.SmallestSeq, meta.LargestSeq = seq, seq
+		c.Advance(time.Second)
+		return meta
+	}
+
+	// an import, whose records are older than its newest one.
+	imported := write(1, rec("a", "imported", 1), rec("k", "imported", 5), rec("z", "imported", 9))
+	flushed := write(2, rec("k", "flushed", 7))
+	tied := write(3, rec("k", "tied", 7))
+	older := write(4, rec("k", "older", 3))
+
+	// in the order of metadata.GetContaining.
+	metas := []*sstable.Meta{imported, tied, flushed, older}
+
+	stats := &GetStats{}
+	got, err := findNewest(ctx, bs, metas, "k", 0, stats, nil)
+	require.NoError(t, err)
+	require.Equal(t, "tied", string(got.Document))
+	require.Equal(t, tied.Filename(), stats.Source)
+
+	// older doesn't need to be read, since its MaxTime is before the winner.
+	require.Equal(t, 3, stats.BlobsFetched)
+
+	// the newest version so far is returned when the limit is reached.
+	stats = &GetStats{}
+	got, err = findNewest(ctx, bs, metas, "k", 1, stats, nil)
+	require.NoError(t, err)
+	require.Equal(t, "imported", string(got.Document))
+}
+
+func TestGetWithOptionsSource(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("k", []byte("v1"))
+	c.Advance(1 * time.Second)
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	c.Advance(1 * time.Second)
+	tb.put("k", []byte("v2"))
+	tb.put("m", []byte("m1"))
+
+	get := func(key string, source GetSource) []byte {
+		val, _, _, err := b.GetWithOptions(ctx, key, GetOptions{Source: source})
+		require.NoError(t, err)
+		return val
+	}
+
+	require.Equal(t, []byte("v2"), get("k", SourceAll))
+	require.Equal(t, []byte("v2"), get("k", SourceMemtable))
+	require.Equal(t, []byte("v1"), get("k", SourceSSTables))
+
+	// m hasn't been flushed yet.
+	require.Equal(t, []byte("m1"), get("m", SourceMemtable))
+	require.Nil(t, get("m", SourceSSTables))
+
+	c.Advance(1 * time.Second)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	// nothing left in the memtables once they're flushed.
+	require.Nil(t, get("k", SourceMemtable))
+	require.Equal(t, []byte("v2"), get("k", SourceSSTables))
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+
+	b := New(env.MongoURL(), env.S3Bucket, c, WithAudit())
+	require.NoError(t, b.Init(ctx))
+
+	actx := WithCaller(ctx, "alice")
+	_, err := b.Put(actx, "k1", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	stats, err := b.Flush(actx, FlushOptions{})
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	// nothing to flush, so nothing is recorded.
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	entries, err := b.AuditLog(ctx, AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, audit.OpFlush, entries[0].Op)
+	require.Equal(t, []string{stats.Meta.Filename()}, entries[0].Created)
+	require.Equal(t, audit.OpPut, entries[1].Op)
+	require.Equal(t, "alice", entries[1].Caller)
+	require.Equal(t, []string{"k1"}, entries[1].Keys)
+
+	entries, err = b.AuditLog(ctx, AuditFilter{Key: "k1"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// disabled by default.
+	_, err = New(env.MongoURL(), env.S3Bucket, c).AuditLog(ctx, AuditFilter{})
+	require.ErrorIs(t, err, ErrAuditDisabled)
+}
+
+func TestCodecChange(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, b := setup(t, c)
+
+	_, err := b.Put(ctx, "plain", []byte("v1"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	// switch to a different codec. the old values are still readable, from
+	// both the memtable and the sstables.
+	b2 := New(env.MongoURL(), env.S3Bucket, c, WithCodec(codec.Zstd))
+	_, err = b2.Put(ctx, "zstd", []byte("v2"))
+	require.NoError(t, err)
+
+	for _, bb := range []*Blobby{b, b2} {
+		v, _, err := bb.Get(ctx, "zstd")
+		require.NoError(t, err)
+		require.Equal(t, []byte("v2"), v)
+	}
+
+	v, _, err := b2.Get(ctx, "plain")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), v)
+
+	_, err = b2.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	v, _, err = b.Get(ctx, "zstd")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+}
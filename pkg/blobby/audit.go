@@ -0,0 +1,84 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+type AuditEntry = audit.Entry
+type AuditFilter = audit.Filter
+
+// ErrAuditDisabled is returned by AuditLog when the archive wasn't created with
+// WithAudit.
+var ErrAuditDisabled = errors.New("audit log not enabled")
+
+// WithAudit enables the audit log, which records every mutating operation in
+// the archive's Mongo database. When it's enabled, an operation which succeeds
+// but can't be recorded returns an error, since it's better to fail loudly than
+// to silently lose the trail.
+func WithAudit() Option {
+	return func(b *Blobby) {
+		b.auditEnabled = true
+	}
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context which attributes the operations performed with
+// it to the given caller in the audit log.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerFrom(ctx context.Context) string {
+	s, _ := ctx.Value(callerKey{}).(string)
+	return s
+}
+
+// AuditLog returns the entries in the audit log matching the given filter,
+// newest first.
+func (b *Blobby) AuditLog(ctx context.Context, f AuditFilter) ([]*AuditEntry, error) {
+	if b.audit == nil {
+		return nil, ErrAuditDisabled
+	}
+
+	return b.audit.Query(ctx, f)
+}
+
+// audited records the given entry in the audit log (if it's enabled), along
+// with the error returned by the operation, and returns that error. If the
+// operation succeeded but the entry couldn't be recorded, that error is
+// returned instead.
+func (b *Blobby) audited(ctx context.Context, e *audit.Entry, err error) error {
+	if b.audit == nil {
+		return err
+	}
+
+	e.Time = b.clock.Now()
+	e.Caller = callerFrom(ctx)
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	aerr := b.audit.Record(ctx, e)
+	if err != nil {
+		return err
+	}
+	if aerr != nil {
+		return fmt.Errorf("audit.Record: %w", aerr)
+	}
+
+	return nil
+}
+
+func filenames(metas []*sstable.Meta) []string {
+	var fns []string
+	for _, m := range metas {
+		fns = append(fns, m.Filename())
+	}
+	return fns
+}
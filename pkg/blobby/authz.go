@@ -0,0 +1,134 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Authorizer decides whether the caller (see WithCaller) may perform the given
+// operation on the given key. It's consulted by Put and Get after the
+// interceptors, so it sees the key which will actually be read or written. It
+// should return an Unauthorized error to deny the call.
+//
+// Reads of many keys (Scan, ForEach, Count, ExportLatest) are authorized with
+// MethodScan and the start of their range before anything is read, and then
+// with each key which they would return. Keys which are denied are skipped
+// rather than failing the call, so a caller can scan a range which extends
+// beyond what it may read. Sample and ChangesSince have no range, so they only
+// skip keys. GetVersionsBetween is authorized like Get.
+//
+// This is meant to enforce tenant isolation at the archive boundary, so servers
+// exposing the archive only need to establish who the caller is.
+type Authorizer interface {
+	Authorize(ctx context.Context, caller string, m Method, key string) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface.
+type AuthorizerFunc func(ctx context.Context, caller string, m Method, key string) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, caller string, m Method, key string) error {
+	return f(ctx, caller, m, key)
+}
+
+// Unauthorized is returned when an Authorizer denies a call.
+type Unauthorized struct {
+	Caller string
+	Method Method
+	Key    string
+}
+
+func (e *Unauthorized) Error() string {
+	return fmt.Sprintf("unauthorized: caller=%q method=%s key=%q", e.Caller, e.Method, e.Key)
+}
+
+func (e *Unauthorized) Is(err error) bool {
+	_, ok := err.(*Unauthorized)
+	return ok
+}
+
+// WithAuthorizer sets the authorizer which every read and write must pass. The
+// default is to allow everything.
+func WithAuthorizer(a Authorizer) Option {
+	return func(b *Blobby) {
+		b.authorizer = a
+	}
+}
+
+// PrefixRule allows a caller to perform some methods on keys with a prefix. An
+// empty Caller matches every caller, and empty Methods matches every method.
+type PrefixRule struct {
+	Caller  string
+	Methods []Method
+	Prefix  string
+}
+
+// PrefixAuthorizer allows calls which match any of its rules, and denies the
+// rest.
+type PrefixAuthorizer []PrefixRule
+
+func (pa PrefixAuthorizer) Authorize(ctx context.Context, caller string, m Method, key string) error {
+	for _, r := range pa {
+		if r.Caller != "" && r.Caller != caller {
+			continue
+		}
+
+		if !strings.HasPrefix(key, r.Prefix) {
+			continue
+		}
+
+		if len(r.Methods) == 0 {
+			return nil
+		}
+
+		for _, rm := range r.Methods {
+			if rm == m {
+				return nil
+			}
+		}
+	}
+
+	return &Unauthorized{caller, m, key}
+}
+
+// authorize returns an error if the authorizer denies the given call.
+func (b *Blobby) authorize(ctx context.Context, m Method, key string) error {
+	if b.authorizer == nil {
+		return nil
+	}
+
+	return b.authorizer.Authorize(ctx, callerFrom(ctx), m, key)
+}
+
+// authorizeScan returns an error if the caller may not scan the range [start,
+// end), or doing so would exceed a quota. Only the start is authorized, since
+// the keys are checked as they're read; see readable.
+func (b *Blobby) authorizeScan(ctx context.Context, start, end string) error {
+	err := b.authorize(ctx, MethodScan, start)
+	if err != nil {
+		return err
+	}
+
+	return b.admitScan(ctx, start, end)
+}
+
+// readable wraps fn, which is called with each record read by a scan, to skip
+// the records which the caller may not read.
+func (b *Blobby) readable(ctx context.Context, fn func(*Record) error) func(*Record) error {
+	if b.authorizer == nil {
+		return fn
+	}
+
+	return func(rec *Record) error {
+		err := b.authorize(ctx, MethodScan, rec.Key)
+		if errors.Is(err, &Unauthorized{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(rec)
+	}
+}
@@ -0,0 +1,46 @@
+package blobby
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	pa := PrefixAuthorizer{
+		{Caller: "alice", Prefix: "alice/"},
+		{Caller: "bob", Prefix: "bob/"},
+		{Methods: []Method{MethodGet}, Prefix: "public/"},
+	}
+
+	assert.NoError(t, pa.Authorize(ctx, "alice", MethodPut, "alice/k"))
+	assert.NoError(t, pa.Authorize(ctx, "alice", MethodGet, "alice/k"))
+	assert.ErrorIs(t, pa.Authorize(ctx, "alice", MethodGet, "bob/k"), &Unauthorized{})
+	assert.NoError(t, pa.Authorize(ctx, "bob", MethodGet, "public/k"))
+	assert.ErrorIs(t, pa.Authorize(ctx, "bob", MethodPut, "public/k"), &Unauthorized{})
+	assert.ErrorIs(t, pa.Authorize(ctx, "", MethodGet, "alice/k"), &Unauthorized{})
+}
+
+func TestWithAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	var seen []string
+	b := New("", "", clockwork.NewFakeClock(),
+		WithAuthorizer(AuthorizerFunc(func(ctx context.Context, caller string, m Method, key string) error {
+			seen = append(seen, caller+" "+string(m)+" "+key)
+			return &Unauthorized{caller, m, key}
+		})))
+
+	// denied before anything touches the backends, which don't exist here.
+	_, err := b.Put(WithCaller(ctx, "alice"), "k", []byte("v"))
+	require.ErrorIs(t, err, &Unauthorized{})
+	_, _, err = b.Get(WithCaller(ctx, "bob"), "k")
+	require.ErrorIs(t, err, &Unauthorized{})
+	_, err = b.PutBatch(ctx, []*Record{{Key: "k2"}})
+	require.ErrorIs(t, err, &Unauthorized{})
+
+	assert.Equal(t, []string{"alice put k", "bob get k", " put k2"}, seen)
+}
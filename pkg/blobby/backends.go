@@ -0,0 +1,195 @@
+package blobby
+
+import (
+	"context"
+	"time"
+
+	"github.com/adammck/blobby/pkg/compactor"
+	"github.com/adammck/blobby/pkg/memtable"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// Memtable is the part of the memtable which the archive uses. By default, it's
+// a memtable.Memtable in Mongo; see WithMemtable. Implementations must return
+// the same errors (memtable.NotFound, memtable.RotateConflict, etc) as that
+// does, since the archive checks for them.
+type Memtable interface {
+	Ping(ctx context.Context) error
+	Init(ctx context.Context) error
+	Initialized(ctx context.Context) (bool, error)
+	Destroy(ctx context.Context) error
+
+	PutRecord(ctx context.Context, rec *types.Record) (string, error)
+	PutBatch(ctx context.Context, recs []*types.Record) (string, error)
+
+	Get(ctx context.Context, key string) (*types.Record, string, error)
+	GetAll(ctx context.Context, key string, from, to time.Time) ([]*types.Record, error)
+	Since(ctx context.Context, from time.Time) ([]*types.Record, error)
+	Sample(ctx context.Context, n int) ([]*types.Record, error)
+	Count(ctx context.Context) (int, error)
+	CountRange(ctx context.Context, start, end string) (int, error)
+	Names(ctx context.Context) ([]string, error)
+	RangeIter(ctx context.Context, names []string, start, end string) (MemtableIter, error)
+	Oldest(ctx context.Context) (time.Time, error)
+	Stats(ctx context.Context) ([]*memtable.Stats, error)
+
+	Active(ctx context.Context) (MemtableHandle, error)
+	Rotate(ctx context.Context) (MemtableHandle, MemtableHandle, error)
+	FlushQueue(ctx context.Context) ([]MemtableHandle, error)
+	Resume(ctx context.Context) (MemtableHandle, error)
+	Release(ctx context.Context, name string) error
+	MarkPartial(ctx context.Context, name string) error
+	Drop(ctx context.Context, name string) error
+}
+
+// MemtableHandle is a single memtable, active or flushing. See memtable.Handle.
+type MemtableHandle interface {
+	Name() string
+	URL() string
+	Count(ctx context.Context) (int, error)
+	Oldest(ctx context.Context) (time.Time, error)
+	FlushBatches(ctx context.Context, ch chan *types.Record, now time.Time, opts memtable.StreamOptions) (*memtable.StreamStats, error)
+	DeleteBelow(ctx context.Context, key string) (int, error)
+}
+
+// MemtableIter reads a range of records from several memtables. See
+// memtable.RangeIter.
+type MemtableIter interface {
+	Next(ctx context.Context) (*types.Record, error)
+	Close(ctx context.Context)
+}
+
+// Metadata is the part of the metadata store which the archive uses. By
+// default, it's a metadata.Store in Mongo, which is also the default
+// Coordinator; see WithMetadata.
+type Metadata interface {
+	compactor.Metadata
+	Coordinator
+
+	Init(ctx context.Context) error
+	Initialized(ctx context.Context) (bool, error)
+	CheckSchema(ctx context.Context) error
+	Migrate(ctx context.Context) ([]metadata.Migration, error)
+	CheckFeatures(ctx context.Context) error
+	HasFeature(ctx context.Context, f metadata.Feature) (bool, error)
+	EnableFeature(ctx context.Context, f metadata.Feature) error
+	Destroy(ctx context.Context) error
+	DropDatabase(ctx context.Context) error
+
+	Insert(ctx context.Context, meta *sstable.Meta) error
+	SetIndex(ctx context.Context, meta *sstable.Meta) error
+	NextSeq(ctx context.Context, n int64) (int64, error)
+	GetContaining(ctx context.Context, key string) ([]*sstable.Meta, error)
+	GetOverlapping(ctx context.Context, start, end string) ([]*sstable.Meta, error)
+	GetAllMetas(ctx context.Context) ([]*sstable.Meta, error)
+	ListMetas(ctx context.Context, opts metadata.ListOptions) ([]*sstable.Meta, string, error)
+	CountLive(ctx context.Context) (int, error)
+	GetWindows(ctx context.Context) ([]*metadata.Window, error)
+	RebuildWindows(ctx context.Context) error
+
+	CreateCheckpoint(ctx context.Context, name string, created time.Time) (*metadata.Checkpoint, error)
+	GetCheckpoint(ctx context.Context, name string) (*metadata.Checkpoint, error)
+	ListCheckpoints(ctx context.Context) ([]*metadata.Checkpoint, error)
+	Restore(ctx context.Context, cp *metadata.Checkpoint, at time.Time) error
+
+	PutNamespace(ctx context.Context, cfg *metadata.NamespaceConfig) error
+	DeleteNamespace(ctx context.Context, prefix string) error
+
+	GetRuntimeConfig(ctx context.Context) (*metadata.RuntimeConfig, error)
+	SetRuntimeConfig(ctx context.Context, cfg *metadata.RuntimeConfig) error
+	WatchRuntimeConfig(ctx context.Context, onChange func(*metadata.RuntimeConfig)) error
+
+	Paused(ctx context.Context) ([]string, error)
+	SetPaused(ctx context.Context, task string, paused bool) error
+	GetMaintenanceSchedule(ctx context.Context) (metadata.MaintenanceSchedule, error)
+	SetMaintenanceWindows(ctx context.Context, task string, windows []metadata.MaintenanceWindow) error
+
+	RecordCompaction(ctx context.Context, r *metadata.CompactionRecord) error
+	GetCompactionHistory(ctx context.Context, f metadata.HistoryFilter) ([]*metadata.CompactionRecord, error)
+
+	AddUsage(ctx context.Context, id string, n, max int64) (bool, error)
+	GetUsage(ctx context.Context, id string) (int64, error)
+	RecordAccess(ctx context.Context, accesses map[string]metadata.Access) error
+	GetAccess(ctx context.Context) (map[string]metadata.Access, error)
+	DeleteAccess(ctx context.Context, filenames []string) error
+
+	SyncCursor(ctx context.Context, name string) (time.Time, bool, error)
+	SetSyncCursor(ctx context.Context, name string, t time.Time) error
+	DeleteSyncCursor(ctx context.Context, name string) error
+}
+
+var _ Metadata = (*metadata.Store)(nil)
+var _ Memtable = (*mongoMemtable)(nil)
+
+// WithMemtable makes the archive keep new records in the given memtable, rather
+// than one in Mongo. It's mostly useful for tests; see the blobbytest package.
+// WithMongoClient and WithFaults don't apply to it.
+func WithMemtable(mt Memtable) Option {
+	return func(b *Blobby) {
+		b.mt = mt
+	}
+}
+
+// WithMetadata makes the archive keep track of its sstables in the given
+// metadata store, rather than one in Mongo. Like WithMemtable, it's mostly for
+// tests. Unless WithCoordinator is also given, it's the Coordinator too.
+func WithMetadata(md Metadata) Option {
+	return func(b *Blobby) {
+		b.md = md
+	}
+}
+
+// mongoMemtable adapts a memtable.Memtable to the Memtable interface, which
+// returns handles and iterators as interfaces rather than concrete types.
+type mongoMemtable struct {
+	*memtable.Memtable
+}
+
+func (m mongoMemtable) RangeIter(ctx context.Context, names []string, start, end string) (MemtableIter, error) {
+	it, err := m.Memtable.RangeIter(ctx, names, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (m mongoMemtable) Active(ctx context.Context) (MemtableHandle, error) {
+	h, err := m.Memtable.Active(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (m mongoMemtable) Rotate(ctx context.Context) (MemtableHandle, MemtableHandle, error) {
+	hPrev, hNext, err := m.Memtable.Rotate(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hPrev, hNext, nil
+}
+
+func (m mongoMemtable) FlushQueue(ctx context.Context) ([]MemtableHandle, error) {
+	hs, err := m.Memtable.FlushQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MemtableHandle, len(hs))
+	for i, h := range hs {
+		out[i] = h
+	}
+	return out, nil
+}
+
+// Resume returns a nil interface, rather than a nil *memtable.Handle, when there
+// is nothing to resume.
+func (m mongoMemtable) Resume(ctx context.Context) (MemtableHandle, error) {
+	h, err := m.Memtable.Resume(ctx)
+	if err != nil || h == nil {
+		return nil, err
+	}
+	return h, nil
+}
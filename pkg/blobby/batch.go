@@ -0,0 +1,83 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// PutBatch writes the given records in one round trip to the memtable. Unlike
+// Put, the timestamps of the records are kept (or set to the current time, if
+// they're zero), so they can come from the client. Records with the same key
+// and timestamp as an existing record are assumed to be replays, and skipped,
+// unless their values differ, in which case a memtable.TimestampConflict error
+// is returned (see memtable.PutBatch). Timestamps don't need to increase; older
+// records are written as older versions.
+//
+// Each record is passed through the interceptors, checks, and codec as if it
+// were written by Put, but Call.Dest is not set. If any record is rejected,
+// nothing is written. The Key, Document, Timestamp, Tags, and IdempotencyKey
+// fields are used; the others are ignored.
+func (b *Blobby) PutBatch(ctx context.Context, recs []*Record) (string, error) {
+	batch := make([]*types.Record, 0, len(recs))
+	keys := make([]string, 0, len(recs))
+
+	// the quotas of records which were admitted are refunded if the batch
+	// isn't written.
+	var admitted []*Call
+	refund := func() {
+		for _, c := range admitted {
+			b.refundPut(ctx, c.Key, len(c.Value))
+		}
+	}
+
+	for _, in := range recs {
+		c := &Call{
+			Method:         MethodPut,
+			Key:            in.Key,
+			Value:          in.Document,
+			Tags:           in.Tags,
+			IdempotencyKey: in.IdempotencyKey,
+		}
+
+		err := b.intercept(ctx, c, func(ctx context.Context, c *Call) error {
+			err := b.authorize(ctx, MethodPut, c.Key)
+			if err != nil {
+				return err
+			}
+
+			rec, err := b.prepare(c)
+			if err != nil {
+				return err
+			}
+
+			err = b.admit(ctx, MethodPut, c.Key, len(c.Value))
+			if err != nil {
+				return err
+			}
+			admitted = append(admitted, c)
+
+			// the TTL counts from the client's timestamp, if there is one.
+			if !rec.Expires.IsZero() && !in.Timestamp.IsZero() {
+				rec.Expires = in.Timestamp.Add(b.namespace(c.Key).TTL)
+			}
+
+			rec.Timestamp = in.Timestamp
+			batch = append(batch, rec)
+			keys = append(keys, rec.Key)
+			return nil
+		})
+		if err != nil {
+			refund()
+			return "", fmt.Errorf("%s: %w", in.Key, err)
+		}
+	}
+
+	dest, err := b.mt.PutBatch(ctx, batch)
+	if err != nil {
+		refund()
+	}
+	return dest, b.audited(ctx, &audit.Entry{Op: audit.OpPut, Keys: keys}, err)
+}
@@ -0,0 +1,152 @@
+package blobby
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// ChangesSince calls fn with every record with a timestamp at or after the
+// given time, from both the sstables and the memtables, in timestamp order. The
+// documents are decoded. If fn returns an error, iteration stops, and that error
+// is returned.
+//
+// This is meant for consumers which missed live events to catch up, so records
+// may be repeated if they were being flushed during the call, and records which
+// are written during the call may or may not be included. To resume, call this
+// again with the timestamp of the last record seen; it will be seen again.
+//
+// Only sstables whose time range includes records after the given time are
+// read, and each of them is read in full when the feed reaches its MinTime, so
+// memory use is proportional to the overlap between sstables.
+//
+// Records with keys which the caller may not read are skipped. It's counted
+// against every quota, since it reads the whole archive.
+func (b *Blobby) ChangesSince(ctx context.Context, since time.Time, fn func(*Record) error) error {
+	err := b.admitScan(ctx, "", "")
+	if err != nil {
+		return err
+	}
+
+	fn = b.readable(ctx, fn)
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassScan)
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	metas = slices.DeleteFunc(metas, func(m *sstable.Meta) bool {
+		return m.MaxTime.Before(since)
+	})
+	slices.SortFunc(metas, func(a, b *sstable.Meta) int {
+		return a.MinTime.Compare(b.MinTime)
+	})
+
+	h := &tsHeap{}
+
+	recs, err := b.mt.Since(ctx, since)
+	if err != nil {
+		return fmt.Errorf("memtable.Since: %w", err)
+	}
+	for _, rec := range recs {
+		heap.Push(h, rec)
+	}
+
+	var prev *Record
+	for h.Len() > 0 || len(metas) > 0 {
+
+		// load every sstable which might contain a record older than the
+		// oldest one in the heap.
+		for len(metas) > 0 && (h.Len() == 0 || !metas[0].MinTime.After((*h)[0].Timestamp)) {
+			err = b.loadSince(ctx, metas[0], since, h)
+			if err != nil {
+				return err
+			}
+			metas = metas[1:]
+		}
+
+		if h.Len() == 0 {
+			break
+		}
+
+		rec := heap.Pop(h).(*Record)
+
+		// skip records which were read from both a memtable and an sstable.
+		if prev != nil && prev.Key == rec.Key && prev.Timestamp.Equal(rec.Timestamp) {
+			continue
+		}
+		prev = rec
+
+		rec.Document, err = b.decode(rec)
+		if err != nil {
+			return err
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadSince pushes every record in the given sstable with a timestamp at or
+// after the given time onto the heap.
+func (b *Blobby) loadSince(ctx context.Context, m *sstable.Meta, since time.Time, h *tsHeap) error {
+	r, err := b.bs.OpenSSTable(ctx, m)
+	if err != nil {
+		return fmt.Errorf("blobstore.OpenSSTable(%s): %w", m.Filename(), err)
+	}
+	defer r.Close()
+
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			return fmt.Errorf("Next(%s): %w", m.Filename(), err)
+		}
+		if rec == nil {
+			return nil
+		}
+
+		if !rec.Timestamp.Before(since) {
+			heap.Push(h, rec)
+		}
+	}
+}
+
+// tsHeap is a min-heap of records by timestamp, then key.
+type tsHeap []*Record
+
+func (h tsHeap) Len() int {
+	return len(h)
+}
+
+func (h tsHeap) Less(i, j int) bool {
+	if c := h[i].Timestamp.Compare(h[j].Timestamp); c != 0 {
+		return c < 0
+	}
+
+	return h[i].Key < h[j].Key
+}
+
+func (h tsHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *tsHeap) Push(x any) {
+	*h = append(*h, x.(*Record))
+}
+
+func (h *tsHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,50 @@
+package blobby
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesSince(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second)
+	c := clockwork.NewFakeClockAt(t0)
+	ctx, _, b := setup(t, c)
+
+	// write keys in reverse order, so key order and time order differ, across
+	// several sstables and the memtable.
+	for i := 0; i < 6; i++ {
+		_, err := b.Put(ctx, fmt.Sprintf("k%d", 5-i), []byte{byte('0' + i)})
+		require.NoError(t, err)
+		if i%2 == 1 {
+			_, err = b.Flush(ctx, FlushOptions{})
+			require.NoError(t, err)
+		}
+		c.Advance(time.Second)
+	}
+	_, err := b.Put(ctx, "memtable", []byte("6"))
+	require.NoError(t, err)
+
+	var got []string
+	err = b.ChangesSince(ctx, t0.Add(2*time.Second), func(rec *Record) error {
+		got = append(got, string(rec.Document))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3", "4", "5", "6"}, got)
+
+	// stops early.
+	errStop := errors.New("stop")
+	n := 0
+	err = b.ChangesSince(ctx, time.Time{}, func(rec *Record) error {
+		n++
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,62 @@
+package blobby
+
+import (
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/codec"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// WithCodec sets the codec which new values are encoded with. Values written
+// with other codecs (including the builtins) remain readable, as long as the
+// codec is registered with WithKnownCodec.
+func WithCodec(c codec.Codec) Option {
+	return func(b *Blobby) {
+		b.codec = c
+		b.codecs.Register(c)
+	}
+}
+
+// WithKnownCodec registers a codec which is needed to decode existing values,
+// but isn't used for new ones. The builtin codecs are always known.
+func WithKnownCodec(c codec.Codec) Option {
+	return func(b *Blobby) {
+		b.codecs.Register(c)
+	}
+}
+
+// encode returns the given value encoded with the codec of the namespace which
+// the key belongs to, or the archive's codec if it doesn't specify one, and the
+// ID of that codec. If neither is set, the value is returned as-is with no ID.
+func (b *Blobby) encode(key string, value []byte) ([]byte, string, error) {
+	c := b.codec
+	if ns := b.namespace(key); ns != nil && ns.Codec != "" {
+		var err error
+		c, err = b.codecs.Lookup(ns.Codec)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if c == nil {
+		return value, "", nil
+	}
+
+	enc, err := c.Encode(value)
+	if err != nil {
+		return nil, "", fmt.Errorf("codec.Encode(%s): %w", c.ID(), err)
+	}
+
+	return enc, c.ID(), nil
+}
+
+// decode returns the document of the given record, decoded with the codec that
+// it was encoded with.
+func (b *Blobby) decode(rec *types.Record) ([]byte, error) {
+	value, err := b.codecs.Decode(rec.Codec, rec.Document)
+	if err != nil {
+		return nil, fmt.Errorf("codec.Decode(%s): %w", rec.Codec, err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,140 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestConcurrent runs puts, gets, flushes, and compactions concurrently, from
+// several goroutines in each of several instances sharing the same backends,
+// then checks that every write ended up in exactly one live sstable.
+func TestConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewRealClock()
+
+	const (
+		instances = 3
+		writers   = 4
+		writes    = 100
+	)
+
+	bs := make([]*Blobby, instances)
+	for i := range bs {
+		bs[i] = New(env.MongoURL(), env.S3Bucket, c)
+		require.NoError(t, bs[i].Init(ctx))
+	}
+
+	ctx2, cancel := context.WithCancel(ctx)
+	var bg sync.WaitGroup
+	bgErrs := make(chan error, 2*instances)
+
+	// flush and compact constantly in the background, from every instance.
+	for _, b := range bs {
+		bg.Add(2)
+		go func() {
+			defer bg.Done()
+			for ctx2.Err() == nil {
+				_, err := b.Flush(ctx2, FlushOptions{})
+				if err != nil && !errors.Is(err, ErrFlushInProgress) && ctx2.Err() == nil {
+					bgErrs <- fmt.Errorf("Flush: %w", err)
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		go func() {
+			defer bg.Done()
+			for ctx2.Err() == nil {
+				stats, err := b.Compact(ctx2, CompactionOptions{MinFiles: 2})
+				if err != nil && ctx2.Err() == nil {
+					bgErrs <- fmt.Errorf("Compact: %w", err)
+					return
+				}
+				for _, s := range stats {
+					if s.Error != nil && !errors.Is(s.Error, ErrCompactionConflict) && ctx2.Err() == nil {
+						bgErrs <- fmt.Errorf("Compact: %w", s.Error)
+						return
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+	}
+
+	// every write is to a unique key, so it's easy to spot lost or duplicated
+	// records. each is read back immediately, wherever it ended up.
+	g, gctx := errgroup.WithContext(ctx)
+	for i, b := range bs {
+		for w := range writers {
+			g.Go(func() error {
+				for n := range writes {
+					key := fmt.Sprintf("key-%d-%d-%03d", i, w, n)
+					_, err := b.Put(gctx, key, []byte(key))
+					if err != nil {
+						return fmt.Errorf("Put(%s): %w", key, err)
+					}
+
+					v, stats, err := b.Get(gctx, key)
+					if err != nil {
+						return fmt.Errorf("Get(%s): %w", key, err)
+					}
+					if string(v) != key {
+						return fmt.Errorf("Get(%s): got %q from %s", key, v, stats.Source)
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	require.NoError(t, g.Wait())
+	cancel()
+	bg.Wait()
+	close(bgErrs)
+	for err := range bgErrs {
+		require.NoError(t, err)
+	}
+
+	// flush whatever is left, then count the records in the live set.
+	b := bs[0]
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for _, m := range metas {
+		r, err := b.bs.OpenSSTable(ctx, m)
+		require.NoError(t, err)
+		defer r.Close()
+		for {
+			rec, err := r.Next()
+			require.NoError(t, err)
+			if rec == nil {
+				break
+			}
+			counts[rec.Key]++
+		}
+	}
+
+	assert.Len(t, counts, instances*writers*writes, "lost records")
+	for k, n := range counts {
+		assert.Equal(t, 1, n, "duplicated record: %s", k)
+	}
+}
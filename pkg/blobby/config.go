@@ -0,0 +1,123 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/metadata"
+	"golang.org/x/time/rate"
+)
+
+type RuntimeConfig = metadata.RuntimeConfig
+type QuotaRate = metadata.QuotaRate
+
+// SetRuntimeConfig replaces the runtime config, which overrides some of the
+// options which each process was started with, e.g. to shrink the caches or
+// tighten a quota during an incident, without restarting anything. It's stored
+// in the metadata, and applied immediately by this process, but other processes
+// only apply it while they're running WatchRuntimeConfig (or when they call
+// RefreshRuntimeConfig, or Open).
+func (b *Blobby) SetRuntimeConfig(ctx context.Context, cfg *RuntimeConfig) error {
+	err := b.md.SetRuntimeConfig(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("metadata.SetRuntimeConfig: %w", err)
+	}
+
+	b.applyConfig(cfg)
+	return nil
+}
+
+// RuntimeConfig returns the runtime config which this process last applied.
+func (b *Blobby) RuntimeConfig() *RuntimeConfig {
+	cfg := b.config.Load()
+	if cfg == nil {
+		return &RuntimeConfig{}
+	}
+
+	return cfg
+}
+
+// RefreshRuntimeConfig reloads the runtime config from the metadata, and
+// applies it.
+func (b *Blobby) RefreshRuntimeConfig(ctx context.Context) error {
+	cfg, err := b.md.GetRuntimeConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("metadata.GetRuntimeConfig: %w", err)
+	}
+
+	b.applyConfig(cfg)
+	return nil
+}
+
+// WatchRuntimeConfig watches the metadata store for changes to the runtime
+// config made by any process, and applies each of them, until the context is
+// cancelled or watching fails. Long-running processes should run this, so that
+// SetRuntimeConfig applies to them too.
+func (b *Blobby) WatchRuntimeConfig(ctx context.Context) error {
+	err := b.md.WatchRuntimeConfig(ctx, b.applyConfig)
+	if err != nil {
+		return fmt.Errorf("metadata.WatchRuntimeConfig: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Blobby) applyConfig(cfg *RuntimeConfig) {
+	b.config.Store(cfg)
+	b.bs.SetIndexCacheSize(cfg.IndexCacheSize)
+	b.bs.SetBlobCacheSize(cfg.BlobCacheBytes)
+
+	// replace the limiters of every caller, which forgets how much of their
+	// burst they've used.
+	b.quotaMu.Lock()
+	for k, st := range b.quotaState {
+		st.puts, st.gets = b.limiters(k.quota)
+	}
+	b.quotaMu.Unlock()
+}
+
+// limiters returns new rate limiters for the puts and gets of the given quota,
+// with the rates from the runtime config, if it has any.
+func (b *Blobby) limiters(i int) (puts, gets *rate.Limiter) {
+	q := b.quotas[i]
+	for _, r := range b.RuntimeConfig().QuotaRates {
+		if r.Prefix == q.Prefix {
+			q.PutsPerSecond = r.PutsPerSecond
+			q.GetsPerSecond = r.GetsPerSecond
+			break
+		}
+	}
+
+	return newLimiter(q.PutsPerSecond, q.Burst), newLimiter(q.GetsPerSecond, q.Burst)
+}
+
+// fetchLimit returns the most sstables which each Get will fetch. See
+// WithMaxGetFetches.
+func (b *Blobby) fetchLimit() int {
+	if n := b.RuntimeConfig().MaxGetFetches; n > 0 {
+		return n
+	}
+
+	return b.maxGetFetches
+}
+
+// compactionOptions returns the given options, with the zero thresholds filled
+// in from the runtime config.
+func (b *Blobby) compactionOptions(opts CompactionOptions) CompactionOptions {
+	cfg := b.RuntimeConfig()
+
+	if opts.MinFiles == 0 {
+		opts.MinFiles = cfg.CompactionMinFiles
+	}
+	if opts.MaxFiles == 0 {
+		opts.MaxFiles = cfg.CompactionMaxFiles
+	}
+	if opts.MinInputSize == 0 {
+		opts.MinInputSize = cfg.CompactionMinInputSize
+	}
+	if opts.MaxInputSize == 0 {
+		opts.MaxInputSize = cfg.CompactionMaxInputSize
+	}
+
+	return opts
+}
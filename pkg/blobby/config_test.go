@@ -0,0 +1,67 @@
+package blobby
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClock()
+	b := New("", "", c,
+		WithMaxGetFetches(5),
+		WithQuota(Quota{Prefix: "a/", PutsPerSecond: 1}))
+
+	// one put per second, from the quota.
+	require.NoError(t, b.admit(ctx, MethodPut, "a/1", 0))
+	require.ErrorIs(t, b.admit(ctx, MethodPut, "a/2", 0), &QuotaExceeded{})
+
+	b.applyConfig(&RuntimeConfig{
+		CompactionMinFiles: 4,
+		MaxGetFetches:      10,
+		QuotaRates:         []QuotaRate{{Prefix: "a/", PutsPerSecond: 3}},
+	})
+
+	// existing callers get the new rate immediately.
+	for _, k := range []string{"a/2", "a/3", "a/4"} {
+		require.NoError(t, b.admit(ctx, MethodPut, k, 0))
+	}
+	require.ErrorIs(t, b.admit(ctx, MethodPut, "a/5", 0), &QuotaExceeded{})
+
+	assert.Equal(t, 10, b.fetchLimit())
+	assert.Equal(t, CompactionOptions{MinFiles: 4, MaxFiles: 8}, b.compactionOptions(CompactionOptions{MaxFiles: 8}))
+	assert.Equal(t, CompactionOptions{MinFiles: 2}, b.compactionOptions(CompactionOptions{MinFiles: 2}))
+
+	// an empty config reverts to the options given to New.
+	b.applyConfig(&RuntimeConfig{})
+	assert.Equal(t, 5, b.fetchLimit())
+	assert.Equal(t, CompactionOptions{}, b.compactionOptions(CompactionOptions{}))
+	c.Advance(time.Second)
+	require.NoError(t, b.admit(ctx, MethodPut, "a/5", 0))
+	require.ErrorIs(t, b.admit(ctx, MethodPut, "a/6", 0), &QuotaExceeded{})
+}
+
+func TestWatchRuntimeConfig(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	ctx, _, b := setup(t, c)
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.WatchRuntimeConfig(wctx)
+
+	// as if set by another process. it's set repeatedly, since the watcher
+	// might not have started yet.
+	cfg := &RuntimeConfig{IndexCacheSize: 10, QuotaRates: []QuotaRate{{Prefix: "x/", GetsPerSecond: 5}}}
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NoError(c, b.md.SetRuntimeConfig(ctx, cfg))
+		assert.Equal(c, cfg, b.RuntimeConfig())
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, b.SetRuntimeConfig(ctx, &RuntimeConfig{}))
+	assert.Equal(t, &RuntimeConfig{}, b.RuntimeConfig())
+}
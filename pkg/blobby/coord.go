@@ -0,0 +1,57 @@
+package blobby
+
+import (
+	"context"
+	"time"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+// ErrLeaseHeld is returned when a lease is held by another process.
+var ErrLeaseHeld = metadata.ErrLeaseHeld
+
+// ErrManifestConflict is returned by PublishManifest when another process
+// published a manifest at the same time.
+var ErrManifestConflict = metadata.ErrManifestConflict
+
+// Coordinator arbitrates between the processes sharing an archive, via named
+// leases which at most one of them holds at once, and a version number which
+// keeps the published manifest from going backwards. By default, it's the
+// metadata store in Mongo; see the etcd package for an alternative.
+type Coordinator interface {
+	// AcquireLease takes the named lease for owner for ttl, or extends it if
+	// owner already holds it. If anyone else does, it returns ErrLeaseHeld.
+	AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) error
+
+	// ReleaseLease gives up the named lease, if owner holds it.
+	ReleaseLease(ctx context.Context, name, owner string) error
+
+	// LeaseHolder returns the owner of the named lease, or an empty string if
+	// no one holds it.
+	LeaseHolder(ctx context.Context, name string) (string, error)
+
+	// ManifestVersion returns the Created time of the newest manifest which
+	// was published, or the zero time if none was.
+	ManifestVersion(ctx context.Context) (time.Time, error)
+
+	// SwapManifestVersion sets the manifest version to next, if it's currently
+	// prev. Otherwise it returns ErrManifestConflict.
+	SwapManifestVersion(ctx context.Context, prev, next time.Time) error
+}
+
+var _ Coordinator = (*metadata.Store)(nil)
+
+// WithCoordinator coordinates with other processes via the given Coordinator,
+// rather than the metadata store. Every process sharing the archive must use
+// the same one.
+func WithCoordinator(c Coordinator) Option {
+	return func(b *Blobby) {
+		b.coord = c
+	}
+}
+
+// Owner returns the name which identifies this instance as the holder of
+// leases.
+func (b *Blobby) Owner() string {
+	return b.owner
+}
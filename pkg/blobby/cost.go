@@ -0,0 +1,194 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/compactor"
+)
+
+type OpClass = blobstore.OpClass
+
+const (
+	ClassGet        = blobstore.ClassGet
+	ClassScan       = blobstore.ClassScan
+	ClassFlush      = blobstore.ClassFlush
+	ClassCompaction = blobstore.ClassCompaction
+	ClassGC         = blobstore.ClassGC
+	ClassOther      = blobstore.ClassOther
+)
+
+// Pricing is what S3 charges, in dollars, which Stats uses to estimate what
+// each class of operation costs.
+type Pricing struct {
+	// Per thousand PUT, COPY, POST, and LIST requests.
+	WritesPer1000 float64
+
+	// Per thousand GET requests, and every other kind except DELETE, which is
+	// free.
+	ReadsPer1000 float64
+
+	// Per GB received from S3. This is zero within the same region, but not
+	// across regions or out to the internet.
+	TransferPerGB float64
+}
+
+// DefaultPricing is S3 Standard in us-east-1, read from the same region, when
+// WithPricing isn't given.
+var DefaultPricing = Pricing{
+	WritesPer1000: 0.005,
+	ReadsPer1000:  0.0004,
+}
+
+// WithPricing sets the prices used to estimate the cost of S3 requests. See
+// Stats.Costs.
+func WithPricing(p Pricing) Option {
+	return func(b *Blobby) {
+		b.pricing = p
+	}
+}
+
+// writeOps are the S3 operations charged at the write rate. DELETEs are free,
+// and everything else is charged at the read rate.
+var writeOps = map[string]bool{
+	"PutObject":               true,
+	"CopyObject":              true,
+	"ListObjectsV2":           true,
+	"ListObjects":             true,
+	"CreateMultipartUpload":   true,
+	"UploadPart":              true,
+	"CompleteMultipartUpload": true,
+	"CreateBucket":            true,
+}
+
+// Cost returns the estimated cost in dollars of the given requests.
+func (p Pricing) Cost(rs blobstore.RequestStats) float64 {
+	var writes, reads int64
+	for op, n := range rs.Requests {
+		switch {
+		case writeOps[op]:
+			writes += n
+		case op == "DeleteObject" || op == "DeleteObjects":
+		default:
+			reads += n
+		}
+	}
+
+	return float64(writes)/1000*p.WritesPer1000 +
+		float64(reads)/1000*p.ReadsPer1000 +
+		float64(rs.BytesReceived)/(1<<30)*p.TransferPerGB
+}
+
+// OpCost is the S3 requests made by one class of operation in this process,
+// and their estimated cost.
+type OpCost struct {
+	Class OpClass
+	blobstore.RequestStats
+
+	// Estimated from the Pricing given to WithPricing.
+	Dollars float64
+}
+
+// costs returns the cost of each class of operation, ordered by class.
+func (b *Blobby) costs() []*OpCost {
+	var out []*OpCost
+	for class, rs := range b.bs.RequestStats() {
+		out = append(out, &OpCost{Class: class, RequestStats: rs, Dollars: b.pricing.Cost(rs)})
+	}
+
+	slices.SortFunc(out, func(a, b *OpCost) int {
+		return strings.Compare(string(a.Class), string(b.Class))
+	})
+
+	return out
+}
+
+// WriteMetrics writes the costs (see Stats.Costs) and the MemtableStats in the
+// Prometheus text format. If the memtable stats can't be fetched, nothing is
+// written, and an error is returned, so that scrapes fail and the alerts on
+// flush lag don't go quiet when Mongo is down.
+func (b *Blobby) WriteMetrics(ctx context.Context, w io.Writer) error {
+	ms, err := b.MemtableStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	writeCostMetrics(w, b.name, b.costs())
+	writeMemtableMetrics(w, b.name, ms)
+	return nil
+}
+
+func writeCostMetrics(w io.Writer, archive string, costs []*OpCost) {
+	labels := func(class OpClass, kv ...string) string {
+		s := fmt.Sprintf("archive=%q,class=%q", archive, class)
+		for i := 0; i+1 < len(kv); i += 2 {
+			s += fmt.Sprintf(",%s=%q", kv[i], kv[i+1])
+		}
+		return "{" + s + "}"
+	}
+
+	fmt.Fprintln(w, "# HELP blobby_s3_requests_total S3 requests made, by operation class and S3 operation.")
+	fmt.Fprintln(w, "# TYPE blobby_s3_requests_total counter")
+	for _, c := range costs {
+		ops := make([]string, 0, len(c.Requests))
+		for op := range c.Requests {
+			ops = append(ops, op)
+		}
+		slices.Sort(ops)
+
+		for _, op := range ops {
+			fmt.Fprintf(w, "blobby_s3_requests_total%s %d\n", labels(c.Class, "operation", op), c.Requests[op])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP blobby_s3_bytes_total Bytes transferred to and from S3, by operation class.")
+	fmt.Fprintln(w, "# TYPE blobby_s3_bytes_total counter")
+	for _, c := range costs {
+		fmt.Fprintf(w, "blobby_s3_bytes_total%s %d\n", labels(c.Class, "direction", "sent"), c.BytesSent)
+		fmt.Fprintf(w, "blobby_s3_bytes_total%s %d\n", labels(c.Class, "direction", "received"), c.BytesReceived)
+	}
+
+	fmt.Fprintln(w, "# HELP blobby_s3_cost_dollars_total Estimated cost of S3 requests, by operation class.")
+	fmt.Fprintln(w, "# TYPE blobby_s3_cost_dollars_total counter")
+	for _, c := range costs {
+		fmt.Fprintf(w, "blobby_s3_cost_dollars_total%s %g\n", labels(c.Class), c.Dollars)
+	}
+}
+
+type Compaction = compactor.Compaction
+
+// PlannedCompaction is a compaction which Compact would run, and what it's
+// expected to cost.
+type PlannedCompaction struct {
+	*Compaction
+
+	// The S3 requests which it's expected to make, including those to purge
+	// its inputs afterwards. See compactor.Compaction.Estimate.
+	Estimate blobstore.RequestStats
+
+	// Estimated from the Pricing given to WithPricing.
+	Dollars float64
+}
+
+// PlanCompactions returns the compactions which Compact would run with the
+// given options right now, and estimates of what they'd cost, without running
+// them or changing anything, so that expensive ones can be scheduled for when
+// they're cheaper, or less disruptive.
+func (b *Blobby) PlanCompactions(ctx context.Context, opts CompactionOptions) ([]*PlannedCompaction, error) {
+	ccs, err := b.comp.Plan(ctx, b.compactionOptions(opts))
+	if err != nil {
+		return nil, fmt.Errorf("compactor.Plan: %w", err)
+	}
+
+	out := make([]*PlannedCompaction, len(ccs))
+	for i, cc := range ccs {
+		e := cc.Estimate()
+		out[i] = &PlannedCompaction{Compaction: cc, Estimate: e, Dollars: b.pricing.Cost(e)}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package blobby
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPricingCost(t *testing.T) {
+	p := Pricing{WritesPer1000: 5, ReadsPer1000: 0.4, TransferPerGB: 0.09}
+	rs := blobstore.RequestStats{
+		Requests: map[string]int64{
+			"PutObject":     1000,
+			"ListObjectsV2": 1000,
+			"GetObject":     2000,
+			"HeadObject":    500,
+			"DeleteObject":  9999,
+		},
+		BytesSent:     1 << 40,
+		BytesReceived: 10 << 30,
+	}
+
+	// deletes and uploads are free.
+	assert.InDelta(t, 10+1+0.9, p.Cost(rs), 1e-9)
+	assert.Equal(t, 0.0, p.Cost(blobstore.RequestStats{}))
+}
+
+func TestWriteCostMetrics(t *testing.T) {
+	var sb strings.Builder
+	writeCostMetrics(&sb, "test", []*OpCost{
+		{
+			Class:        ClassCompaction,
+			RequestStats: blobstore.RequestStats{Requests: map[string]int64{"PutObject": 2, "GetObject": 3}, BytesSent: 10, BytesReceived: 20},
+			Dollars:      0.25,
+		},
+	})
+
+	out := sb.String()
+	assert.Contains(t, out, "# TYPE blobby_s3_requests_total counter\n")
+	assert.Contains(t, out, `blobby_s3_requests_total{archive="test",class="compaction",operation="GetObject"} 3`+"\n")
+	assert.Contains(t, out, `blobby_s3_requests_total{archive="test",class="compaction",operation="PutObject"} 2`+"\n")
+	assert.Contains(t, out, `blobby_s3_bytes_total{archive="test",class="compaction",direction="sent"} 10`+"\n")
+	assert.Contains(t, out, `blobby_s3_bytes_total{archive="test",class="compaction",direction="received"} 20`+"\n")
+	assert.Contains(t, out, `blobby_s3_cost_dollars_total{archive="test",class="compaction"} 0.25`+"\n")
+}
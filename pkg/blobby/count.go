@@ -0,0 +1,105 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// Count returns the number of distinct keys in the range given by opts.Start and
+// opts.End.
+//
+// If exact is true, the keys are counted by a Scan with KeysOnly set, which
+// fetches every overlapping sstable but doesn't decode the values. Otherwise,
+// it's estimated from the metadata without reading any records: the number of
+// distinct keys in each sstable (see sstable.Meta.Keys), plus the number of
+// records in the memtables. Sstables which are only partly in the range are
+// prorated by the entries of their index which overlap it. Keys which are in
+// more than one sstable (or in the memtable too) are counted more than once, so
+// the estimate is too high by roughly the number of keys which have been
+// overwritten since they were last compacted.
+//
+// Only exact counts skip the keys which the caller may not read, since the
+// estimate doesn't look at them. Both check the start of the range.
+func (b *Blobby) Count(ctx context.Context, opts ScanOptions, exact bool) (int, error) {
+	err := b.authorizeScan(ctx, opts.Start, opts.End)
+	if err != nil {
+		return 0, err
+	}
+
+	if exact {
+		opts.KeysOnly = true
+		n := 0
+		err := b.scan(ctx, opts, b.readable(ctx, func(*Record) error {
+			n++
+			return nil
+		}))
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	n, err := b.mt.CountRange(ctx, opts.Start, opts.End)
+	if err != nil {
+		return 0, fmt.Errorf("memtable.CountRange: %w", err)
+	}
+
+	metas, err := b.md.GetOverlapping(ctx, opts.Start, opts.End)
+	if err != nil {
+		return 0, fmt.Errorf("metadata.GetOverlapping: %w", err)
+	}
+
+	for _, m := range metas {
+		c, err := b.estimateKeys(ctx, m, opts.Start, opts.End)
+		if err != nil {
+			return 0, err
+		}
+		n += c
+	}
+
+	return n, nil
+}
+
+// estimateKeys returns the approximate number of distinct keys in [start, end)
+// in the given sstable.
+func (b *Blobby) estimateKeys(ctx context.Context, m *sstable.Meta, start, end string) (int, error) {
+	keys := m.Keys
+	if keys == 0 {
+		keys = m.Count
+	}
+
+	if m.MinKey >= start && (end == "" || m.MaxKey < end) {
+		return keys, nil
+	}
+
+	// partly in the range, so use the index to work out how much of it. without
+	// one (or counts in it), assume half.
+	ix, err := b.bs.Index(ctx, m)
+	if err != nil {
+		return 0, fmt.Errorf("blobstore.Index(%s): %w", m.Filename(), err)
+	}
+	if ix == nil || m.Count == 0 {
+		return keys / 2, nil
+	}
+
+	// count every entry which overlaps the range, so this errs high, like the
+	// rest of the estimate.
+	in := 0
+	for i, e := range ix.Entries {
+		if e.Count == 0 {
+			return keys / 2, nil
+		}
+
+		last := m.MaxKey
+		if i+1 < len(ix.Entries) {
+			last = ix.Entries[i+1].Key
+		}
+		if last >= start && (end == "" || e.Key < end) {
+			in += e.Count
+		}
+	}
+
+	return keys * in / m.Count, nil
+}
@@ -0,0 +1,51 @@
+package blobby
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCount(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	// 20 keys in an sstable, then new versions of 5 of them in another, and 3
+	// new keys in the memtable.
+	for i := range 20 {
+		tb.put(fmt.Sprintf("k%02d", i), []byte("v1"))
+		c.Advance(1 * time.Millisecond)
+	}
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	for i := range 5 {
+		tb.put(fmt.Sprintf("k%02d", i), []byte("v2"))
+		c.Advance(1 * time.Millisecond)
+	}
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	for i := 20; i < 23; i++ {
+		tb.put(fmt.Sprintf("k%02d", i), []byte("v1"))
+		c.Advance(1 * time.Millisecond)
+	}
+
+	n, err := b.Count(ctx, ScanOptions{}, true)
+	require.NoError(t, err)
+	assert.Equal(t, 23, n)
+
+	n, err = b.Count(ctx, ScanOptions{Start: "k03", End: "k10"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+
+	// the estimate counts the overwritten keys twice.
+	n, err = b.Count(ctx, ScanOptions{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 28, n)
+}
@@ -0,0 +1,59 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+)
+
+// cutAtDeadline forwards records from src to dst, which must be sorted by key,
+// until the deadline passes. Then it stops at the next key, so every version of
+// the last key is forwarded, and returns the first key which wasn't, or empty
+// if every record was. dst is closed either way. src is not drained, so the
+// sender must be cancelled if a key is returned.
+func cutAtDeadline(clock clockwork.Clock, deadline time.Time, src, dst chan *types.Record) string {
+	defer close(dst)
+
+	var last string
+	n := 0
+
+	for rec := range src {
+		if n > 0 && rec.Key != last && !clock.Now().Before(deadline) {
+			return rec.Key
+		}
+
+		dst <- rec
+		last = rec.Key
+		n++
+	}
+
+	return ""
+}
+
+// keepRemainder deletes the records which were flushed from the given memtable,
+// which are those before cutKey, and marks it so that the next flush resumes
+// it. It's marked first, so if the delete fails, the next flush writes some of
+// the same records again, rather than the memtable being forgotten.
+func (b *Blobby) keepRemainder(ctx context.Context, h MemtableHandle, cutKey string, stats *FlushStats) error {
+	err := b.mt.MarkPartial(ctx, h.Name())
+	if err != nil {
+		return fmt.Errorf("memtable.MarkPartial: %w", err)
+	}
+
+	_, err = h.DeleteBelow(ctx, cutKey)
+	if err != nil {
+		return fmt.Errorf("handle.DeleteBelow: %w", err)
+	}
+
+	n, err := h.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("handle.Count: %w", err)
+	}
+
+	stats.Partial = true
+	stats.Remaining = n
+	return nil
+}
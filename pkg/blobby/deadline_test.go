@@ -0,0 +1,137 @@
+package blobby
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCutAtDeadline(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	deadline := c.Now().Add(time.Second)
+
+	src := make(chan *types.Record)
+	dst := make(chan *types.Record)
+	go func() {
+		defer close(src)
+		for _, k := range []string{"a", "b", "b", "b", "c"} {
+			src <- &types.Record{Key: k}
+
+			// the deadline passes in the middle of b, which is finished.
+			if k == "a" {
+				c.Advance(time.Second)
+			}
+		}
+	}()
+
+	var got []string
+	done := make(chan string)
+	go func() {
+		done <- cutAtDeadline(c, deadline, src, dst)
+	}()
+	for rec := range dst {
+		got = append(got, rec.Key)
+	}
+
+	assert.Equal(t, "b", <-done)
+	assert.Equal(t, []string{"a"}, got)
+}
+
+func TestCutAtDeadlineNotReached(t *testing.T) {
+	c := clockwork.NewFakeClock()
+
+	src := make(chan *types.Record, 3)
+	dst := make(chan *types.Record, 3)
+	for _, k := range []string{"a", "b", "c"} {
+		src <- &types.Record{Key: k}
+	}
+	close(src)
+
+	assert.Equal(t, "", cutAtDeadline(c, c.Now().Add(time.Second), src, dst))
+	assert.Len(t, dst, 3)
+}
+
+func TestFlushMaxDuration(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for i := 0; i < 1500; i++ {
+		_, err := b.Put(ctx, fmt.Sprintf("k%04d", i), []byte("x"))
+		require.NoError(t, err)
+	}
+
+	// time runs out after the first thousand records are written.
+	stats, err := b.Flush(ctx, FlushOptions{
+		MaxDuration: time.Minute,
+		Progress: func(p Progress) {
+			if p.Records >= 1000 {
+				c.Advance(time.Hour)
+			}
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, stats.Partial)
+	require.Len(t, stats.Outputs, 1)
+	assert.Less(t, stats.Outputs[0].Count, 1500)
+	assert.Equal(t, 1500, stats.Outputs[0].Count+stats.Remaining)
+
+	// everything is still readable, from one place or the other.
+	for _, k := range []string{"k0000", "k1499"} {
+		rec, _, err := b.Get(ctx, k)
+		require.NoError(t, err, k)
+		assert.Equal(t, []byte("x"), rec, k)
+	}
+
+	// the rest is flushed next, even though the active memtable is empty.
+	partial, remaining := stats.FlushedMemtable, stats.Remaining
+	stats, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	assert.False(t, stats.Partial)
+	assert.Equal(t, partial, stats.FlushedMemtable)
+	require.Len(t, stats.Outputs, 1)
+	assert.Equal(t, remaining, stats.Outputs[0].Count)
+
+	stats, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	assert.True(t, stats.Skipped)
+}
+
+func TestCompactMaxDuration(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := b.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+
+	// time runs out just before the output is uploaded. the fake clock fires
+	// timers in their own goroutine, so give it a moment to cancel.
+	stats, err := b.Compact(ctx, CompactionOptions{
+		MaxDuration: time.Minute,
+		Progress: func(p Progress) {
+			if p.Phase == "upload" {
+				c.Advance(time.Hour)
+				time.Sleep(50 * time.Millisecond)
+			}
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.True(t, stats[0].TimedOut)
+	assert.ErrorIs(t, stats[0].Error, ErrCompactionTimedOut)
+
+	// nothing changed, so it can be run again without a limit.
+	stats, err = b.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.NoError(t, stats[0].Error)
+	assert.Len(t, stats[0].Inputs, 2)
+}
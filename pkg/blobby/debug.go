@@ -0,0 +1,57 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+)
+
+// DebugStats is a snapshot of the state of the archive, for debugging.
+type DebugStats struct {
+	Name string
+
+	// The active memtable, and the number of records in it.
+	Memtable        string
+	MemtableRecords int
+
+	// The number of rotated memtables waiting to be flushed.
+	FlushQueue int
+
+	// The number of sstables in the live set. Every one of them is a candidate
+	// for compaction, so this is the best proxy for the compaction backlog.
+	LiveSSTables int
+
+	Stats *Stats
+}
+
+// DebugStats returns a snapshot of the state of the archive, including the
+// counters returned by Stats.
+func (b *Blobby) DebugStats(ctx context.Context) (*DebugStats, error) {
+	ds := &DebugStats{
+		Name:  b.name,
+		Stats: b.Stats(),
+	}
+
+	h, err := b.mt.Active(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("memtable.Active: %w", err)
+	}
+	ds.Memtable = h.Name()
+
+	ds.MemtableRecords, err = h.Count(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Count(%s): %w", h.Name(), err)
+	}
+
+	q, err := b.mt.FlushQueue(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("memtable.FlushQueue: %w", err)
+	}
+	ds.FlushQueue = len(q)
+
+	ds.LiveSSTables, err = b.md.CountLive(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.CountLive: %w", err)
+	}
+
+	return ds, nil
+}
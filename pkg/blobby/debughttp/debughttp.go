@@ -0,0 +1,136 @@
+// Package debughttp serves the debugging endpoints of an archive over HTTP. It's
+// separate from the blobby package because it imports expvar and net/http/pprof,
+// which register their handlers on http.DefaultServeMux, and programs which
+// embed an archive shouldn't get those just by importing it.
+package debughttp
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+)
+
+// timeout bounds how long the endpoints wait for the backends.
+const timeout = 5 * time.Second
+
+// Handler returns a handler which serves expvar at /debug/vars, pprof at
+// /debug/pprof/, the DebugStats of the given archive as JSON at /debug/stats,
+// the compaction history at /debug/compactions, and the cost of S3 requests
+// (see Stats.Costs) and the MemtableStats in the Prometheus text format at
+// /metrics. The compaction history accepts a "file" param to select the
+// compactions which read or wrote an sstable, "lineage" to return its Lineage
+// instead, and "limit" (default 100). It should only be served on a private
+// listener, since pprof can be expensive and the stats reveal callers and key
+// prefixes.
+//
+// The DebugStats are also published to expvar, under "blobby.<name>".
+func Handler(b *blobby.Blobby) http.Handler {
+	publishExpvar(b)
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := b.WriteMetrics(ctx, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	mux.HandleFunc("/debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		ds, err := b.DebugStats(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ds)
+	})
+
+	mux.HandleFunc("/debug/compactions", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		q := r.URL.Query()
+		f := blobby.HistoryFilter{Filename: q.Get("file"), Limit: 100}
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+				return
+			}
+			f.Limit = n
+		}
+
+		var rs []*blobby.CompactionRecord
+		var err error
+		if q.Has("lineage") {
+			if f.Filename == "" {
+				http.Error(w, "lineage requires file", http.StatusBadRequest)
+				return
+			}
+			rs, err = b.Lineage(ctx, f.Filename)
+		} else {
+			rs, err = b.CompactionHistory(ctx, f)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rs)
+	})
+
+	return mux
+}
+
+// expvarMu serializes publishExpvar, since expvar.Publish panics if the name is
+// already taken.
+var expvarMu sync.Mutex
+
+// publishExpvar publishes the DebugStats of the given archive to expvar, unless
+// an archive with the same name already did. Errors are published in their
+// place, since expvar has no other way to report them.
+func publishExpvar(b *blobby.Blobby) {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	name := "blobby." + b.Name()
+	if expvar.Get(name) != nil {
+		return
+	}
+
+	expvar.Publish(name, expvar.Func(func() any {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		ds, err := b.DebugStats(ctx)
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+
+		return ds
+	}))
+}
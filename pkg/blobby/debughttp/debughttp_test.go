@@ -0,0 +1,63 @@
+package debughttp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	b := blobby.New(env.MongoURL(), env.S3Bucket, clockwork.NewFakeClock())
+	require.NoError(t, b.Init(ctx))
+
+	_, err := b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(Handler(b))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/debug/stats")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var ds blobby.DebugStats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&ds))
+	assert.Equal(t, b.Name(), ds.Name)
+	assert.Equal(t, 1, ds.MemtableRecords)
+	assert.Equal(t, 0, ds.LiveSSTables)
+
+	res2, err := http.Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	defer res2.Body.Close()
+
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(res2.Body).Decode(&vars))
+	assert.Contains(t, vars, "blobby."+b.Name())
+	assert.Contains(t, vars, "memstats")
+
+	res3, err := http.Get(srv.URL + "/debug/pprof/")
+	require.NoError(t, err)
+	res3.Body.Close()
+	assert.Equal(t, http.StatusOK, res3.StatusCode)
+
+	res4, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer res4.Body.Close()
+	require.Equal(t, http.StatusOK, res4.StatusCode)
+
+	body, err := io.ReadAll(res4.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "blobby_s3_requests_total")
+}
@@ -0,0 +1,140 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// DefaultDegradedTimeout is how long Get waits for the memtable and metadata
+// store before falling back to the manifest, when WithDegradedReads is given
+// zero.
+const DefaultDegradedTimeout = time.Second
+
+// DegradedManifestRefresh is how long the manifest used by degraded reads is
+// cached, before it's fetched from the blobstore again.
+const DegradedManifestRefresh = time.Minute
+
+// WithDegradedReads serves Get from the manifest published to the blobstore
+// (see PublishManifest) when the memtable or metadata store fails, or doesn't
+// respond within the timeout, rather than failing. Such reads are flagged by
+// GetStats.Degraded, since they can't see anything in the memtable, or flushed
+// since the manifest was published. Use WithManifest to keep it fresh.
+//
+// The timeout should be well above the normal latency of Mongo, since slow
+// queries fall back too. Zero means DefaultDegradedTimeout.
+func WithDegradedReads(timeout time.Duration) Option {
+	return func(b *Blobby) {
+		if timeout <= 0 {
+			timeout = DefaultDegradedTimeout
+		}
+		b.degraded.enabled = true
+		b.degraded.timeout = timeout
+	}
+}
+
+// degraded is the state of degraded reads.
+type degraded struct {
+	enabled bool
+	timeout time.Duration
+
+	// the manifest, and when it was fetched. guarded by mu, which is held
+	// while fetching, so an outage doesn't cause a stampede of fetches.
+	mu       sync.Mutex
+	manifest *metadata.Manifest
+	fetched  time.Time
+
+	gets atomic.Int64
+}
+
+// primaryContext returns the context for get to read the memtable and metadata
+// store with, which times out early if degraded reads are enabled, so there's
+// time left to fall back.
+func (b *Blobby) primaryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if !b.degraded.enabled {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, b.degraded.timeout)
+}
+
+// getDegraded is the fallback for get when the memtable or metadata store
+// failed with the given error. If degraded reads are enabled, it reads the key
+// from the manifest instead. Otherwise, or if that fails too, it returns the
+// error.
+func (b *Blobby) getDegraded(ctx context.Context, key string, stats *GetStats, cause error) (*types.Record, *GetStats, error) {
+	// nothing's down; the caller gave up.
+	if !b.degraded.enabled || ctx.Err() != nil {
+		return nil, stats, cause
+	}
+
+	m, err := b.degradedManifest(ctx)
+	if err != nil {
+		return nil, stats, errors.Join(cause, fmt.Errorf("degradedManifest: %w", err))
+	}
+
+	b.degraded.gets.Add(1)
+	stats.Degraded = true
+	stats.ManifestTime = m.Created
+
+	rec, err := findNewest(ctx, b.bs, m.GetContaining(key), key, b.fetchLimit(), stats, b.recordAccess)
+	if err != nil || rec == nil {
+		return nil, stats, err
+	}
+
+	rec.Document, err = b.decode(rec)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	return rec, stats, nil
+}
+
+// degradedManifest returns the cached manifest, fetching it first if it's
+// missing or older than DegradedManifestRefresh. If fetching fails, the cached
+// one is returned, if there is one.
+func (b *Blobby) degradedManifest(ctx context.Context) (*metadata.Manifest, error) {
+	d := &b.degraded
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.manifest != nil && b.clock.Since(d.fetched) < DegradedManifestRefresh {
+		return d.manifest, nil
+	}
+
+	m, err := loadManifest(ctx, b.bs, b.name)
+	if err != nil {
+		if d.manifest != nil {
+			return d.manifest, nil
+		}
+		return nil, err
+	}
+
+	d.manifest = m
+	d.fetched = b.clock.Now()
+	return m, nil
+}
+
+// loadManifest fetches and decodes the manifest of the named archive from the
+// blobstore.
+func loadManifest(ctx context.Context, bs *blobstore.Blobstore, name string) (*metadata.Manifest, error) {
+	body, err := bs.OpenBlob(ctx, metadata.ManifestKey(name))
+	if err != nil {
+		return nil, fmt.Errorf("blobstore.OpenBlob: %w", err)
+	}
+	defer body.Close()
+
+	m, err := metadata.ReadManifest(body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ReadManifest: %w", err)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,55 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDegradedReads(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, b := setup(t, c)
+
+	_, err := b.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	m, err := b.PublishManifest(ctx)
+	require.NoError(t, err)
+
+	// written after the manifest, so invisible to degraded reads.
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "k", []byte("v2"))
+	require.NoError(t, err)
+
+	// nothing listens on this port, so every call to Mongo fails.
+	down := "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100&connectTimeoutMS=100"
+
+	// without degraded reads, gets fail.
+	b2 := New(down, env.S3Bucket, c)
+	_, _, err = b2.Get(ctx, "k")
+	require.Error(t, err)
+
+	b3 := New(down, env.S3Bucket, c, WithDegradedReads(50*time.Millisecond))
+	v, stats, err := b3.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), v)
+	assert.True(t, stats.Degraded)
+	assert.True(t, m.Created.Equal(stats.ManifestTime))
+
+	v, stats, err = b3.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+	assert.True(t, stats.Degraded)
+	assert.Equal(t, int64(2), b3.Stats().DegradedGets)
+
+	// when Mongo is up, reads aren't degraded.
+	b4 := New(env.MongoURL(), env.S3Bucket, c, WithDegradedReads(0))
+	v, stats, err = b4.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+	assert.False(t, stats.Degraded)
+}
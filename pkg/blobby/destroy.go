@@ -0,0 +1,180 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// ErrDestroyNotConfirmed is returned by Destroy when the confirmation doesn't
+// match the name of the archive.
+var ErrDestroyNotConfirmed = errors.New("destroy not confirmed")
+
+// ErrDestroyShared is returned by Destroy when asked to delete orphans from the
+// bucket of an archive which shares sstables with a clone, since the sstables
+// written by the clone would look like orphans.
+var ErrDestroyShared = errors.New("archive shares sstables with a clone")
+
+type DestroyOptions struct {
+	// DeleteOrphans also deletes every sstable (and index) in the primary
+	// bucket which isn't referenced by the metadata, like those left behind by
+	// flushes and compactions which failed part way through. Only set this if
+	// the bucket is not shared by any other archive, since their sstables will
+	// look like orphans. It's refused if this archive has been cloned, or is a
+	// clone, since they always share a bucket.
+	DeleteOrphans bool
+}
+
+type DestroyStats struct {
+	// The number of blobs which were deleted, including orphans.
+	BlobsDeleted int
+
+	// The number of blobs which were not deleted, because they're shared with
+	// another archive via Clone.
+	BlobsKept int
+
+	// The number of unreferenced blobs which were deleted. Only non-zero when
+	// the DeleteOrphans option is set.
+	OrphansDeleted int
+}
+
+// Destroy permanently deletes everything in this archive: the memtables, the
+// metadata, the audit log, the manifest, and every sstable which it references,
+// including those which are only referenced by checkpoints or by compactions
+// which were never committed. To avoid accidents, confirm must be the name of
+// the archive.
+//
+// Sstables shared with clones are left alone, since the other archive still
+// needs them, so destroying every archive in a family of clones leaves the
+// shared sstables behind as orphans, which Reconcile can delete if nothing else
+// shares the bucket.
+func (b *Blobby) Destroy(ctx context.Context, confirm string, opts DestroyOptions) (*DestroyStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGC)
+	stats := &DestroyStats{}
+
+	if confirm != b.name {
+		return stats, fmt.Errorf("%w: expected %q, got %q", ErrDestroyNotConfirmed, b.name, confirm)
+	}
+
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	// include sstables which are waiting to be purged.
+	deleted, err := b.md.GetDeleted(ctx, time.Time{})
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetDeleted: %w", err)
+	}
+	metas = append(metas, deleted...)
+
+	// and the outputs of compactions which were never committed.
+	pending, err := b.md.GetPendingCompactions(ctx, time.Time{})
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetPendingCompactions: %w", err)
+	}
+	for _, p := range pending {
+		metas = append(metas, p.Outputs...)
+	}
+
+	cps, err := b.md.ListCheckpoints(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.ListCheckpoints: %w", err)
+	}
+
+	// collect the blobs to delete, and those to keep. a blob might be
+	// referenced many times.
+	del := map[string]*sstable.Meta{}
+	keep := map[string]struct{}{}
+	for _, m := range metas {
+		del[m.Filename()] = m
+	}
+	for _, cp := range cps {
+		for _, m := range cp.Metas {
+			if strings.HasPrefix(cp.Name, clonePrefix) {
+				keep[m.Filename()] = struct{}{}
+			} else {
+				del[m.Filename()] = m
+			}
+		}
+	}
+
+	if opts.DeleteOrphans && len(keep) > 0 {
+		return stats, ErrDestroyShared
+	}
+
+	for fn, m := range del {
+		if _, ok := keep[fn]; ok {
+			continue
+		}
+
+		err = b.bs.DeleteSSTable(ctx, m)
+		if err != nil {
+			return stats, fmt.Errorf("blobstore.Delete(%s): %w", fn, err)
+		}
+
+		stats.BlobsDeleted++
+	}
+
+	stats.BlobsKept = len(keep)
+
+	if opts.DeleteOrphans {
+		n, err := b.deleteOrphans(ctx)
+		if err != nil {
+			return stats, err
+		}
+		stats.OrphansDeleted = n
+		stats.BlobsDeleted += n
+	}
+
+	err = b.bs.Delete(ctx, metadata.ManifestKey(b.name))
+	if err != nil {
+		return stats, fmt.Errorf("blobstore.Delete(manifest): %w", err)
+	}
+
+	// drop the metadata last, so we can try again if deleting blobs fails.
+
+	err = b.mt.Destroy(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("memtable.Destroy: %w", err)
+	}
+
+	err = b.md.DropDatabase(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.DropDatabase: %w", err)
+	}
+
+	return stats, nil
+}
+
+// deleteOrphans deletes every sstable and index in the primary bucket, a page
+// at a time, and returns the number which were deleted. It's called by Destroy
+// after deleting those which are referenced, so these are the rest.
+func (b *Blobby) deleteOrphans(ctx context.Context) (int, error) {
+	var n int
+	err := b.bs.ListPages(ctx, "", "", "", func(page []blobstore.BlobInfo) error {
+		for _, bi := range page {
+			if !strings.HasSuffix(bi.Key, ".sstable") && !strings.HasSuffix(bi.Key, ".sstable.index") {
+				continue
+			}
+
+			err := b.bs.Delete(ctx, bi.Key)
+			if err != nil {
+				return fmt.Errorf("blobstore.Delete(%s): %w", bi.Key, err)
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("blobstore.ListPages: %w", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestroy(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	c.Advance(1 * time.Second)
+	fstats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	// left behind by a flush which crashed before updating the metadata.
+	require.NoError(t, b.bs.PutBlob(ctx, "123.sstable", []byte("orphan")))
+
+	_, err = b.Destroy(ctx, "wrong", DestroyOptions{})
+	require.ErrorIs(t, err, ErrDestroyNotConfirmed)
+
+	dstats, err := b.Destroy(ctx, b.Name(), DestroyOptions{DeleteOrphans: true})
+	require.NoError(t, err)
+	require.Equal(t, &DestroyStats{BlobsDeleted: 2, OrphansDeleted: 1}, dstats)
+
+	_, err = b.bs.Get(ctx, fstats.BlobURL)
+	require.Error(t, err)
+	blobs, err := b.bs.List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, blobs)
+
+	// the archive can be recreated from scratch.
+	err = b.Init(ctx)
+	require.NoError(t, err)
+	val, _ := tb.get("a")
+	require.Nil(t, val)
+}
+
+func TestDestroyClone(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	c.Advance(1 * time.Second)
+	b2, err := b.Clone(ctx, "staging")
+	require.NoError(t, err)
+
+	// the sstables of the clone would look like orphans.
+	_, err = b.Destroy(ctx, b.Name(), DestroyOptions{DeleteOrphans: true})
+	require.ErrorIs(t, err, ErrDestroyShared)
+
+	// but the shared sstables can be left behind.
+	dstats, err := b.Destroy(ctx, b.Name(), DestroyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &DestroyStats{BlobsKept: 1}, dstats)
+
+	v, _, err := b2.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a1"), v)
+}
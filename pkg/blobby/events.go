@@ -0,0 +1,140 @@
+package blobby
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// eventBuffer is the number of events which can be waiting for each subscriber
+// before more are dropped.
+const eventBuffer = 64
+
+// EventType is the kind of thing which happened to the archive.
+type EventType string
+
+const (
+	// EventFlush is emitted when a flush commits its sstables, or drops a
+	// memtable whose records had all expired.
+	EventFlush EventType = "flush"
+
+	// EventCompaction is emitted when a compaction finishes, whether or not it
+	// succeeded, and when RecoverCompactions rolls one forward.
+	EventCompaction EventType = "compaction"
+
+	// EventPurge is emitted when Purge garbage-collects superseded sstables.
+	EventPurge EventType = "purge"
+
+	// EventImport is emitted when Import finishes, with the sstables which it
+	// added to the live set, even if it failed partway.
+	EventImport EventType = "import"
+
+	// EventLeaseAcquired and EventLeaseReleased are emitted when a compaction
+	// in this process claims its inputs, and when it gives them up.
+	EventLeaseAcquired EventType = "lease_acquired"
+	EventLeaseReleased EventType = "lease_released"
+
+	// EventLeaderAcquired and EventLeaderLost are emitted when this process
+	// becomes the leader of an election (see RunAsLeader), and when it stops
+	// being the leader, with the Error which caused that if it wasn't asked
+	// to. EventLeaderError is emitted when it can't reach the Coordinator to
+	// campaign.
+	EventLeaderAcquired EventType = "leader_acquired"
+	EventLeaderLost     EventType = "leader_lost"
+	EventLeaderError    EventType = "leader_error"
+)
+
+// Event describes something which happened to the archive in this process.
+// Changes made by other processes aren't included; see WatchMetadata for those.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// The caller which performed the operation (see WithCaller), if known.
+	Caller string
+
+	// The sstables which were added to the live set, and those which were
+	// removed from it (or, for purges, deleted). Both are empty for lease
+	// events, which set Leased to the sstables which were claimed instead.
+	Created []*sstable.Meta
+	Removed []*sstable.Meta
+	Leased  []*sstable.Meta
+
+	// The compactor which holds (or held) the lease, or for leader events,
+	// this instance (see Blobby.Owner).
+	Owner string
+
+	// The name of the election, for leader events.
+	Election string
+
+	// The error returned by the operation, if it failed.
+	Error error
+}
+
+// eventBus fans events out to subscribers, without ever blocking the archive:
+// if a subscriber falls behind, the events it would have received are dropped.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+
+	dropped atomic.Int64
+}
+
+// Events returns a channel which receives every event emitted by this archive
+// until the context is cancelled, when it's closed. Each call subscribes
+// separately. Events are buffered, but dropped if the subscriber falls too far
+// behind (see Stats.EventsDropped), so receivers should be quick.
+func (b *Blobby) Events(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBuffer)
+
+	b.events.mu.Lock()
+	if b.events.subs == nil {
+		b.events.subs = map[chan Event]struct{}{}
+	}
+	b.events.subs[ch] = struct{}{}
+	b.events.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		b.events.mu.Lock()
+		delete(b.events.subs, ch)
+		close(ch)
+		b.events.mu.Unlock()
+	})
+
+	return ch
+}
+
+// emit sends the given event to every subscriber, stamped with the time and
+// the caller from the context.
+func (b *Blobby) emit(ctx context.Context, e Event) {
+	b.events.mu.Lock()
+	defer b.events.mu.Unlock()
+
+	if len(b.events.subs) == 0 {
+		return
+	}
+
+	e.Time = b.clock.Now()
+	e.Caller = callerFrom(ctx)
+
+	for ch := range b.events.subs {
+		select {
+		case ch <- e:
+		default:
+			b.events.dropped.Add(1)
+		}
+	}
+}
+
+// onLease is the compactor's LeaseFunc.
+func (b *Blobby) onLease(inputs []*sstable.Meta, owner string, held bool) {
+	t := EventLeaseReleased
+	if held {
+		t = EventLeaseAcquired
+	}
+
+	b.emit(context.Background(), Event{Type: t, Leased: inputs, Owner: owner})
+}
@@ -0,0 +1,82 @@
+package blobby
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	b := New("mongodb://unused", "unused", c)
+
+	// nobody's listening, so this goes nowhere.
+	b.emit(context.Background(), Event{Type: EventPurge})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch1 := b.Events(ctx)
+	ch2 := b.Events(context.Background())
+
+	b.emit(WithCaller(context.Background(), "adam"), Event{Type: EventFlush})
+
+	for _, ch := range []<-chan Event{ch1, ch2} {
+		e := <-ch
+		assert.Equal(t, EventFlush, e.Type)
+		assert.Equal(t, "adam", e.Caller)
+		assert.Equal(t, c.Now(), e.Time)
+	}
+
+	// cancelled subscriptions are closed, and stop receiving.
+	cancel()
+	require.Eventually(t, func() bool {
+		_, ok := <-ch1
+		return !ok
+	}, time.Second, time.Millisecond)
+
+	// slow subscribers miss events, rather than blocking the archive.
+	for i := 0; i < eventBuffer+3; i++ {
+		b.emit(context.Background(), Event{Type: EventCompaction})
+	}
+	assert.Len(t, ch2, eventBuffer)
+	assert.Equal(t, int64(3), b.Stats().EventsDropped)
+}
+
+func TestEvents(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	ch := b.Events(ctx)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := b.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+
+	stats, err := b.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+
+	var types []EventType
+	for len(ch) > 0 {
+		e := <-ch
+		types = append(types, e.Type)
+
+		switch e.Type {
+		case EventFlush:
+			assert.Len(t, e.Created, 1)
+		case EventLeaseAcquired, EventLeaseReleased:
+			assert.Equal(t, stats[0].Inputs, e.Leased)
+			assert.NotEmpty(t, e.Owner)
+		case EventCompaction:
+			assert.Equal(t, stats[0].Outputs, e.Created)
+			assert.Equal(t, stats[0].Inputs, e.Removed)
+		}
+	}
+
+	assert.Equal(t, []EventType{EventFlush, EventFlush, EventLeaseAcquired, EventLeaseReleased, EventCompaction}, types)
+}
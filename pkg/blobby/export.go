@@ -0,0 +1,265 @@
+package blobby
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/errgroup"
+)
+
+// ExportConcurrency is the number of objects which S3Target writes at once,
+// when no concurrency is given.
+const ExportConcurrency = 32
+
+// ExportTarget receives the newest version of every key exported by
+// ExportLatest, in key order. Implement it to export to other formats, like
+// Parquet.
+type ExportTarget interface {
+	// Write is called with each record. The Document is decoded.
+	Write(ctx context.Context, rec *Record) error
+
+	// Close is called once every record has been written, unless the export
+	// failed, in which case it's not called, and the context passed to Write
+	// is canceled.
+	Close(ctx context.Context) error
+}
+
+type ExportOptions struct {
+	// Start and End are the half-open range of keys [Start, End) to export. If
+	// End is empty, the range is unbounded.
+	Start string
+	End   string
+
+	// At is the time to export the archive as of. See ScanOptions.At.
+	At time.Time
+}
+
+type ExportStats struct {
+	// The number of keys exported, and the total size of their values.
+	Keys  int
+	Bytes int64
+
+	// The time which the archive was exported as of.
+	At time.Time
+}
+
+// ExportLatest writes the newest version of every key in the given range to the
+// target, as of a single point in time, so that systems which can't merge the
+// versions themselves (like batch jobs) can read a consistent snapshot. Like
+// Scan, keys which the caller may not read are skipped.
+func (b *Blobby) ExportLatest(ctx context.Context, target ExportTarget, opts ExportOptions) (*ExportStats, error) {
+	if at, ok := target.(*archiveTarget); ok && at.dst.name == b.name && at.dst.mongoURL == b.mongoURL {
+		return nil, fmt.Errorf("can't export archive into itself: %s", b.name)
+	}
+
+	err := b.authorizeScan(ctx, opts.Start, opts.End)
+	if err != nil {
+		return nil, err
+	}
+
+	// so targets which write in the background stop if the export fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sopts := b.pin(ScanOptions{Start: opts.Start, End: opts.End, At: opts.At})
+	stats := &ExportStats{At: sopts.At}
+
+	err = b.scan(ctx, sopts, b.readable(ctx, func(rec *Record) error {
+		err := target.Write(ctx, rec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rec.Key, err)
+		}
+
+		stats.Keys++
+		stats.Bytes += int64(len(rec.Document))
+		return nil
+	}))
+	if err != nil {
+		return stats, err
+	}
+
+	err = target.Close(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("Close: %w", err)
+	}
+
+	return stats, nil
+}
+
+// toJSON returns the given value as JSON. Values which are already JSON are
+// returned as they are, and BSON documents (like those written by `blobby put`)
+// are converted to relaxed extended JSON.
+func toJSON(value []byte) ([]byte, error) {
+	if json.Valid(value) {
+		return value, nil
+	}
+
+	raw := bson.Raw(value)
+	if raw.Validate() != nil {
+		return nil, fmt.Errorf("value is neither JSON nor BSON")
+	}
+
+	return bson.MarshalExtJSON(raw, false, false)
+}
+
+type s3Target struct {
+	b           *Blobby
+	bucket      string
+	prefix      string
+	concurrency int
+
+	// started by the first Write, with its context.
+	g    *errgroup.Group
+	gctx context.Context
+}
+
+// S3Target returns a target which writes each record as a JSON object, named
+// by its key and the given prefix, to the given bucket. It's the opposite of
+// Import. If bucket is empty, the archive's own is used, in which case prefix
+// must not overlap with its sstables. Up to concurrency objects are written at
+// once, or ExportConcurrency if it's zero.
+//
+// Objects are only written, never deleted, so an export into the prefix of an
+// older one only overwrites the keys which still exist.
+func (b *Blobby) S3Target(bucket, prefix string, concurrency int) ExportTarget {
+	if concurrency <= 0 {
+		concurrency = ExportConcurrency
+	}
+
+	return &s3Target{b: b, bucket: bucket, prefix: prefix, concurrency: concurrency}
+}
+
+func (t *s3Target) Write(ctx context.Context, rec *Record) error {
+	if t.g == nil {
+		t.g, t.gctx = errgroup.WithContext(ctx)
+		t.g.SetLimit(t.concurrency)
+	}
+
+	body, err := toJSON(rec.Document)
+	if err != nil {
+		return err
+	}
+
+	// stop early if a previous write failed.
+	if t.gctx.Err() != nil {
+		return t.g.Wait()
+	}
+
+	key := t.prefix + rec.Key
+	t.g.Go(func() error {
+		err := t.b.bs.PutBlobIn(t.gctx, t.bucket, key, body)
+		if err != nil {
+			return fmt.Errorf("blobstore.PutBlobIn(%s): %w", key, err)
+		}
+		return nil
+	})
+
+	return nil
+}
+
+func (t *s3Target) Close(ctx context.Context) error {
+	if t.g == nil {
+		return nil
+	}
+
+	return t.g.Wait()
+}
+
+type jsonlTarget struct {
+	w *bufio.Writer
+}
+
+// JSONLTarget returns a target which writes each record to w as a line of
+// JSON, like {"key": "...", "ts": "...", "value": {...}}.
+func JSONLTarget(w io.Writer) ExportTarget {
+	return &jsonlTarget{w: bufio.NewWriter(w)}
+}
+
+type jsonlLine struct {
+	Key       string            `json:"key"`
+	Timestamp time.Time         `json:"ts"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Value     json.RawMessage   `json:"value"`
+}
+
+func (t *jsonlTarget) Write(ctx context.Context, rec *Record) error {
+	value, err := toJSON(rec.Document)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&jsonlLine{Key: rec.Key, Timestamp: rec.Timestamp, Tags: rec.Tags, Value: value})
+	if err != nil {
+		return err
+	}
+
+	_, err = t.w.Write(append(b, '\n'))
+	return err
+}
+
+func (t *jsonlTarget) Close(ctx context.Context) error {
+	return t.w.Flush()
+}
+
+type archiveTarget struct {
+	dst   *Blobby
+	batch []*types.Record
+	size  int64
+}
+
+// ArchiveTarget returns a target which writes the records straight to new
+// sstables in the given archive, which must be open, like Import. Their
+// timestamps and tags are kept, and their values are checked and encoded as if
+// they were Put into it.
+func ArchiveTarget(dst *Blobby) ExportTarget {
+	return &archiveTarget{dst: dst}
+}
+
+func (t *archiveTarget) Write(ctx context.Context, rec *Record) error {
+	r, err := t.dst.prepare(&Call{Method: MethodPut, Key: rec.Key, Value: rec.Document, Tags: rec.Tags})
+	if err != nil {
+		return err
+	}
+
+	// the TTL of the namespace only applies to the memtable.
+	r.Timestamp = rec.Timestamp
+	r.Expires = time.Time{}
+
+	t.batch = append(t.batch, r)
+	t.size += int64(len(r.Document))
+
+	if t.size >= DefaultImportSSTableSize {
+		return t.flush(ctx)
+	}
+
+	return nil
+}
+
+func (t *archiveTarget) flush(ctx context.Context) error {
+	if len(t.batch) == 0 {
+		return nil
+	}
+
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassFlush)
+	metas, err := t.dst.importBatch(ctx, t.batch)
+	t.dst.emit(ctx, Event{Type: EventImport, Created: metas, Error: err})
+	err = t.dst.audited(ctx, &audit.Entry{Op: audit.OpImport, Created: filenames(metas)}, err)
+	if err != nil {
+		return err
+	}
+
+	t.batch, t.size = nil, 0
+	return nil
+}
+
+func (t *archiveTarget) Close(ctx context.Context) error {
+	return t.flush(ctx)
+}
@@ -0,0 +1,86 @@
+package blobby
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestToJSON(t *testing.T) {
+	j, err := toJSON([]byte(`{"a": 1}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, string(j))
+
+	bb, err := bson.Marshal(bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: "x"}})
+	require.NoError(t, err)
+	j, err = toJSON(bb)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a": 1, "b": "x"}`, string(j))
+
+	_, err = toJSON([]byte("nope"))
+	assert.Error(t, err)
+}
+
+func TestJSONLTarget(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	target := JSONLTarget(&buf)
+	require.NoError(t, target.Write(ctx, &Record{Key: "a", Timestamp: ts, Document: []byte(`{"v":1}`)}))
+	require.NoError(t, target.Write(ctx, &Record{Key: "b", Timestamp: ts, Document: []byte(`{"v":2}`), Tags: map[string]string{"x": "y"}}))
+	require.NoError(t, target.Close(ctx))
+
+	assert.Equal(t, `{"key":"a","ts":"2025-01-10T00:00:00Z","value":{"v":1}}
+{"key":"b","ts":"2025-01-10T00:00:00Z","tags":{"x":"y"},"value":{"v":2}}
+`, buf.String())
+}
+
+func TestExportLatest(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for _, v := range []string{"1", "2"} {
+		_, err := b.Put(ctx, "a", []byte(`{"v":`+v+`}`))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{Force: true})
+		require.NoError(t, err)
+		c.Advance(time.Minute)
+	}
+	_, err := b.Put(ctx, "b", []byte(`{"v":3}`))
+	require.NoError(t, err)
+
+	// only the newest version of each key, from the memtable and sstables.
+	var buf bytes.Buffer
+	stats, err := b.ExportLatest(ctx, JSONLTarget(&buf), ExportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Keys)
+	assert.Contains(t, buf.String(), `"key":"a"`)
+	assert.Contains(t, buf.String(), `"value":{"v":2}`)
+	assert.NotContains(t, buf.String(), `"value":{"v":1}`)
+
+	_, err = b.ExportLatest(ctx, b.S3Target("", "export/", 0), ExportOptions{})
+	require.NoError(t, err)
+	body, err := b.bs.GetBlob(ctx, "export/b")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"v":3}`, string(body))
+
+	_, err = b.ExportLatest(ctx, ArchiveTarget(b), ExportOptions{})
+	assert.ErrorContains(t, err, "into itself")
+
+	dst := b.Sibling("dst")
+	require.NoError(t, dst.Init(ctx))
+	require.NoError(t, dst.Open(ctx))
+	_, err = b.ExportLatest(ctx, ArchiveTarget(dst), ExportOptions{})
+	require.NoError(t, err)
+
+	v, _, err := dst.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"v":2}`, string(v))
+}
@@ -0,0 +1,351 @@
+package blobby_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/blobbytest"
+	"github.com/adammck/blobby/pkg/memtable"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests only use the public API, so they run against the fakes in the
+// blobbytest package, without any containers.
+
+func TestFlushOptions(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c)
+
+	// empty memtables are never flushed, even when forced.
+	fstats, err := b.Flush(ctx, blobby.FlushOptions{Force: true})
+	require.NoError(t, err)
+	require.True(t, fstats.Skipped)
+
+	for i := 1; i <= 3; i++ {
+		c.Advance(15 * time.Millisecond)
+		_, err = b.Put(ctx, fmt.Sprintf("%03d", i), []byte("v"))
+		require.NoError(t, err)
+	}
+
+	// below both thresholds.
+	opts := blobby.FlushOptions{MinRecords: 5, MaxAge: 1 * time.Minute}
+	fstats, err = b.Flush(ctx, opts)
+	require.NoError(t, err)
+	require.True(t, fstats.Skipped)
+
+	// the oldest record is now old enough.
+	c.Advance(1 * time.Minute)
+	fstats, err = b.Flush(ctx, opts)
+	require.NoError(t, err)
+	require.False(t, fstats.Skipped)
+	require.Equal(t, 3, fstats.Meta.Count)
+
+	// below the record threshold, but forced.
+	c.Advance(15 * time.Millisecond)
+	_, err = b.Put(ctx, "004", []byte("v"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	fstats, err = b.Flush(ctx, blobby.FlushOptions{MinRecords: 5, Force: true})
+	require.NoError(t, err)
+	require.False(t, fstats.Skipped)
+	require.Equal(t, 1, fstats.Meta.Count)
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c)
+
+	get := func() []byte {
+		val, _, err := b.Get(ctx, "k")
+		require.NoError(t, err)
+		return val
+	}
+
+	_, err := b.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	_, err = b.Checkpoint(ctx, "one")
+	require.NoError(t, err)
+
+	// the second version is still in the memtable.
+	c.Advance(1 * time.Second)
+	_, err = b.Put(ctx, "k", []byte("v2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), get())
+
+	// roll back. the second version is flushed and masked.
+	c.Advance(1 * time.Second)
+	undo, err := b.RollbackTo(ctx, "one")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), get())
+
+	// and undo the rollback.
+	c.Advance(1 * time.Second)
+	undo2, err := b.RollbackTo(ctx, undo.Name)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), get())
+
+	// every rollback left a checkpoint to undo it.
+	cps, err := b.ListCheckpoints(ctx)
+	require.NoError(t, err)
+	var names []string
+	for _, cp := range cps {
+		names = append(names, cp.Name)
+	}
+	require.Equal(t, []string{"one", undo.Name, undo2.Name}, names)
+	require.Len(t, cps[0].Metas, 1)
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c)
+
+	tags := map[string]string{"content-type": "text/plain", "origin": "test"}
+	_, err := b.PutTagged(ctx, "k1", []byte("v1"), tags)
+	require.NoError(t, err)
+
+	check := func() {
+		v, got, _, err := b.GetTagged(ctx, "k1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("v1"), v)
+		require.Equal(t, tags, got)
+	}
+
+	// from the memtable, then from an sstable, then from a compacted sstable.
+	check()
+	for i := 0; i < 2; i++ {
+		c.Advance(time.Second)
+		_, err = b.Put(ctx, fmt.Sprintf("other%d", i), []byte("x"))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, blobby.FlushOptions{})
+		require.NoError(t, err)
+		check()
+	}
+
+	stats, err := b.Compact(ctx, blobby.CompactionOptions{MinFiles: 2})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.NoError(t, stats[0].Error)
+	check()
+}
+
+// sliceTarget is an ExportTarget which keeps the keys written to it.
+type sliceTarget struct {
+	keys []string
+}
+
+func (st *sliceTarget) Write(ctx context.Context, rec *blobby.Record) error {
+	st.keys = append(st.keys, rec.Key)
+	return nil
+}
+
+func (st *sliceTarget) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestReadAuthorization(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c, blobby.WithAuthorizer(blobby.PrefixAuthorizer{
+		{Caller: "admin"},
+		{Caller: "alice", Prefix: "alice/"},
+	}))
+
+	// one version of each key in an sstable, and one in the memtable.
+	admin := blobby.WithCaller(ctx, "admin")
+	for _, k := range []string{"alice/1", "bob/1"} {
+		c.Advance(time.Second)
+		_, err := b.Put(admin, k, []byte("v"))
+		require.NoError(t, err)
+	}
+	_, err := b.Flush(admin, blobby.FlushOptions{})
+	require.NoError(t, err)
+	for _, k := range []string{"alice/2", "bob/2"} {
+		c.Advance(time.Second)
+		_, err := b.Put(admin, k, []byte("v"))
+		require.NoError(t, err)
+	}
+
+	alice := blobby.WithCaller(ctx, "alice")
+	all := blobby.ScanOptions{}
+	mine := blobby.ScanOptions{Start: "alice/"}
+	want := []string{"alice/1", "alice/2"}
+
+	t.Run("Scan", func(t *testing.T) {
+		err := b.Scan(alice, all, func(*blobby.Record) error { return nil })
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+
+		// the range extends beyond alice's keys, so the rest are skipped.
+		var got []string
+		err = b.Scan(alice, mine, func(rec *blobby.Record) error {
+			got = append(got, rec.Key)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("ForEach", func(t *testing.T) {
+		err := b.ForEach(alice, all, func(string, []byte, time.Time) error { return nil })
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+
+		var mu sync.Mutex
+		var got []string
+		err = b.ForEach(alice, mine, func(key string, _ []byte, _ time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, key)
+			return nil
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, want, got)
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		_, err := b.Count(alice, all, true)
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+		_, err = b.Count(alice, all, false)
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+
+		n, err := b.Count(alice, mine, true)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+	})
+
+	t.Run("ExportLatest", func(t *testing.T) {
+		_, err := b.ExportLatest(alice, &sliceTarget{}, blobby.ExportOptions{})
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+
+		st := &sliceTarget{}
+		_, err = b.ExportLatest(alice, st, blobby.ExportOptions{Start: "alice/"})
+		require.NoError(t, err)
+		require.Equal(t, want, st.keys)
+	})
+
+	t.Run("GetVersionsBetween", func(t *testing.T) {
+		_, err := b.GetVersionsBetween(alice, "bob/1", time.Time{}, time.Time{})
+		require.ErrorIs(t, err, &blobby.Unauthorized{})
+
+		recs, err := b.GetVersionsBetween(alice, "alice/1", time.Time{}, time.Time{})
+		require.NoError(t, err)
+		require.Len(t, recs, 1)
+	})
+
+	t.Run("ChangesSince", func(t *testing.T) {
+		var got []string
+		err := b.ChangesSince(alice, time.Time{}, func(rec *blobby.Record) error {
+			got = append(got, rec.Key)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	})
+
+	t.Run("Sample", func(t *testing.T) {
+		recs, err := b.Sample(alice, 100, blobby.SampleOptions{Rand: rand.New(rand.NewSource(1))})
+		require.NoError(t, err)
+		require.NotEmpty(t, recs)
+		for _, rec := range recs {
+			require.Contains(t, want, rec.Key)
+		}
+	})
+}
+
+func TestReadQuota(t *testing.T) {
+	ctx := blobby.WithCaller(context.Background(), "alice")
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c, blobby.WithQuota(blobby.Quota{Prefix: "a/", GetsPerSecond: 1}))
+
+	noop := func(*blobby.Record) error { return nil }
+	require.NoError(t, b.Scan(ctx, blobby.ScanOptions{Start: "a/"}, noop))
+	require.ErrorIs(t, b.Scan(ctx, blobby.ScanOptions{Start: "a/"}, noop), &blobby.QuotaExceeded{})
+	_, err := b.GetVersionsBetween(ctx, "a/1", time.Time{}, time.Time{})
+	require.ErrorIs(t, err, &blobby.QuotaExceeded{})
+	_, err = b.Sample(ctx, 1, blobby.SampleOptions{})
+	require.ErrorIs(t, err, &blobby.QuotaExceeded{})
+	require.ErrorIs(t, b.ChangesSince(ctx, time.Time{}, noop), &blobby.QuotaExceeded{})
+
+	// ranges which don't overlap the quota aren't limited.
+	require.NoError(t, b.Scan(ctx, blobby.ScanOptions{Start: "b/"}, noop))
+}
+
+func TestCheckpointAfterAbandonedFlush(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	mt := blobbytest.NewMemtable(c)
+	b := blobbytest.NewFakeArchive(t, c, blobby.WithMemtable(mt))
+
+	// leave a record in a flushing memtable, as if another process rotated it
+	// then crashed, and another in the active one.
+	_, err := b.Put(ctx, "a", []byte("v"))
+	require.NoError(t, err)
+	_, _, err = mt.Rotate(ctx)
+	require.NoError(t, err)
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "b", []byte("v"))
+	require.NoError(t, err)
+
+	// the other process might still be flushing, so its records might not be
+	// in an sstable yet.
+	_, err = b.Checkpoint(ctx, "held")
+	require.ErrorIs(t, err, blobby.ErrFlushInProgress)
+
+	// once its claim times out, both memtables are flushed.
+	c.Advance(memtable.ClaimTimeout + time.Second)
+	cp, err := b.Checkpoint(ctx, "one")
+	require.NoError(t, err)
+
+	n := 0
+	for _, m := range cp.Metas {
+		n += m.Count
+	}
+	require.Equal(t, 2, n)
+
+	q, err := mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	require.Empty(t, q)
+}
+
+func TestExpiredInMemtable(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	b := blobbytest.NewFakeArchive(t, c)
+	require.NoError(t, b.SetNamespace(ctx, &blobby.NamespaceConfig{Prefix: "tmp/", TTL: time.Minute}))
+
+	_, err := b.Put(ctx, "tmp/k", []byte("v"))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	scan := func() []string {
+		var keys []string
+		err := b.Scan(ctx, blobby.ScanOptions{}, func(rec *blobby.Record) error {
+			keys = append(keys, rec.Key)
+			return nil
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	v, _, err := b.Get(ctx, "tmp/k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+	require.Equal(t, []string{"k", "tmp/k"}, scan())
+
+	// the record is still in the memtable, since it hasn't been flushed or
+	// deleted by Mongo yet, but it's gone as far as reads are concerned.
+	c.Advance(2 * time.Minute)
+	v, _, err = b.Get(ctx, "tmp/k")
+	require.NoError(t, err)
+	require.Nil(t, v)
+	require.Equal(t, []string{"k"}, scan())
+}
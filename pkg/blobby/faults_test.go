@@ -0,0 +1,301 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/faultinject"
+	"github.com/adammck/blobby/pkg/memtable"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupFaults(t *testing.T, c clockwork.Clock) (context.Context, *Blobby, *faultinject.Injector) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	fi := faultinject.New(c)
+	b := New(env.MongoURL(), env.S3Bucket, c, WithFaults(fi))
+	require.NoError(t, b.Init(ctx))
+	return ctx, b, fi
+}
+
+func TestFlushFailures(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	for i, op := range []faultinject.Op{
+		faultinject.MemtableRotate,
+		faultinject.MemtableSwap,
+		faultinject.BlobstorePut,
+		faultinject.MetadataInsert,
+		faultinject.MemtableDrop,
+	} {
+		key := string(op)
+		_, err := b.Put(ctx, key, []byte("v"))
+		require.NoError(t, err)
+		c.Advance(time.Second)
+
+		fi.Add(faultinject.Fault{Op: op, Times: 1})
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.ErrorIs(t, err, faultinject.ErrInjected, op)
+		c.Advance(time.Second)
+
+		// wherever the flush failed, every write so far is still readable,
+		// from the memtable or the sstable.
+		for _, prev := range []faultinject.Op{
+			faultinject.MemtableRotate,
+			faultinject.MemtableSwap,
+			faultinject.BlobstorePut,
+			faultinject.MetadataInsert,
+			faultinject.MemtableDrop,
+		}[:i+1] {
+			v, _, err := b.Get(ctx, string(prev))
+			require.NoError(t, err, "after %s: %s", op, prev)
+			assert.Equal(t, []byte("v"), v, "after %s: %s", op, prev)
+		}
+	}
+}
+
+func TestFlushRecovery(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	for _, op := range []faultinject.Op{
+		faultinject.BlobstorePut,
+		faultinject.MetadataInsert,
+		faultinject.MemtableDrop,
+	} {
+		key := string(op)
+		_, err := b.Put(ctx, key, []byte("v1"))
+		require.NoError(t, err)
+		c.Advance(time.Second)
+
+		// fail after the memtable was rotated out.
+		fi.Add(faultinject.Fault{Op: op, Times: 1})
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.ErrorIs(t, err, faultinject.ErrInjected, op)
+		c.Advance(time.Second)
+
+		// a newer version is written to the new active memtable, which masks
+		// the one left behind.
+		_, err = b.Put(ctx, key, []byte("v2"))
+		require.NoError(t, err)
+		c.Advance(time.Second)
+
+		// the next flush finishes the one which failed, rather than flushing
+		// the active memtable.
+		stats, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err, op)
+		assert.True(t, stats.Resumed, op)
+		c.Advance(time.Second)
+
+		v, _, err := b.Get(ctx, key)
+		require.NoError(t, err, op)
+		assert.Equal(t, []byte("v2"), v, op)
+
+		recs, err := b.GetMulti(ctx, []string{key})
+		require.NoError(t, err, op)
+		require.Contains(t, recs, key, op)
+		assert.Equal(t, []byte("v2"), recs[key].Document, op)
+
+		// and the one after that flushes the active memtable.
+		stats, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err, op)
+		assert.False(t, stats.Resumed, op)
+		c.Advance(time.Second)
+
+		v, _, err = b.Get(ctx, key)
+		require.NoError(t, err, op)
+		assert.Equal(t, []byte("v2"), v, op)
+
+		ms, err := b.MemtableStats(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, ms.Inactive, op)
+	}
+}
+
+func TestFlushRecoveryAfterCrash(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, _ := setupFaults(t, c)
+
+	_, err := b.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	// a process rotates the memtable out, and crashes before flushing it.
+	_, _, err = b.mt.Rotate(ctx)
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	// meanwhile, a newer version is written and flushed by another process,
+	// which leaves the crashed flush alone since it might still be running.
+	_, err = b.Put(ctx, "k", []byte("v2"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+	stats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	assert.False(t, stats.Resumed)
+	c.Advance(time.Second)
+
+	// the memtable left behind doesn't mask the newer version.
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+
+	recs, err := b.GetMulti(ctx, []string{"k"})
+	require.NoError(t, err)
+	require.Contains(t, recs, "k")
+	assert.Equal(t, []byte("v2"), recs["k"].Document)
+
+	// nothing to recover until the claim times out.
+	out, err := b.RecoverFlushes(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// after which it's recovered when the archive is opened.
+	c.Advance(memtable.ClaimTimeout)
+	b2 := New(b.mongoURL, b.bucket, c, WithFlushRecovery())
+	require.NoError(t, b2.Open(ctx))
+
+	ms, err := b2.MemtableStats(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ms.Inactive)
+	assert.Equal(t, 0, ms.Records)
+
+	v, _, err = b2.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+}
+
+func TestFlushReadRetries(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	for i := 0; i < 5; i++ {
+		_, err := b.Put(ctx, fmt.Sprintf("k%d", i), []byte("v"))
+		require.NoError(t, err)
+		c.Advance(time.Second)
+	}
+
+	// a batch which fails to read is retried, without starting over.
+	fi.Add(faultinject.Fault{Op: faultinject.MemtableRead, After: 1, Times: 1})
+	stats, err := b.Flush(ctx, FlushOptions{BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Batches)
+	assert.Equal(t, 1, stats.ReadRetries)
+	assert.Equal(t, 5, stats.Meta.Count)
+	assert.Equal(t, 4, fi.Calls(faultinject.MemtableRead))
+	c.Advance(time.Second)
+
+	// but not forever.
+	_, err = b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+	fi.Reset()
+	fi.Add(faultinject.Fault{Op: faultinject.MemtableRead})
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.ErrorIs(t, err, faultinject.ErrInjected)
+	assert.Equal(t, flushReadRetries+1, fi.Calls(faultinject.MemtableRead))
+	c.Advance(time.Second)
+
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
+
+func TestFlushVerifyFailure(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	_, err := b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	// the sstable is corrupted when it's read back, so it's never inserted, and
+	// the memtable is kept.
+	fi.Add(faultinject.Fault{Op: faultinject.BlobstoreGet, Corrupt: true, Times: 1})
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.ErrorIs(t, err, blobstore.ErrVerifyFailed)
+
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+
+	v, stats, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+	assert.Equal(t, 0, stats.BlobsFetched)
+}
+
+func TestCorruptRead(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	_, err := b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	fi.Add(faultinject.Fault{Op: faultinject.BlobstoreGet, Corrupt: true, Times: 1})
+	v, _, err := b.Get(ctx, "k")
+	assert.True(t, err != nil || string(v) != "v", "corruption went unnoticed")
+
+	v, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+
+	// one to verify the flush, then one per get.
+	assert.Equal(t, 3, fi.Calls(faultinject.BlobstoreGet))
+}
+
+func TestRecoverCompactions(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, b, fi := setupFaults(t, c)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := b.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Second)
+	}
+
+	// the compactor "crashes" while committing, so the live set is unchanged.
+	fi.Add(faultinject.Fault{Op: faultinject.MetadataCommit, Times: 1})
+	stats, err := b.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.ErrorIs(t, stats[0].Error, faultinject.ErrInjected)
+
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metas, 2)
+
+	// too recent to recover yet.
+	rs, err := b.RecoverCompactions(ctx, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, rs.RolledForward)
+
+	// the inputs are still live, so it's rolled forward.
+	c.Advance(time.Hour)
+	rs, err = b.RecoverCompactions(ctx, time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, rs.RolledForward, 1)
+	assert.Empty(t, rs.RolledBack)
+
+	metas, err = b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.Equal(t, "a", metas[0].MinKey)
+	assert.Equal(t, "b", metas[0].MaxKey)
+
+	for _, k := range []string{"a", "b"} {
+		v, _, err := b.Get(ctx, k)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(k), v)
+	}
+}
@@ -0,0 +1,66 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AgeFlushPolicy flushes the active memtable whenever its oldest record is
+// older than MaxAge. This bounds the window during which records exist only in
+// the memtable, at the cost of producing small sstables when writes are slow.
+type AgeFlushPolicy struct {
+	// MaxAge specifies how old the oldest record in the active memtable can get
+	// before it's flushed. Required.
+	MaxAge time.Duration
+
+	// Interval specifies how often to check the age of the active memtable. The
+	// default is a tenth of MaxAge.
+	Interval time.Duration
+}
+
+// RunAgeFlushPolicy checks the active memtable periodically and flushes it per
+// the given policy, until the context is cancelled or a flush fails. Flushes
+// which are skipped because another one is in progress are not failures.
+func (b *Blobby) RunAgeFlushPolicy(ctx context.Context, p AgeFlushPolicy) error {
+	if p.MaxAge <= 0 {
+		return fmt.Errorf("invalid MaxAge: %v", p.MaxAge)
+	}
+
+	interval := p.Interval
+	if interval == 0 {
+		interval = p.MaxAge / 10
+	}
+
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+
+		_, err := b.Flush(ctx, FlushOptions{MaxAge: p.MaxAge})
+		if err != nil && !errors.Is(err, ErrFlushInProgress) && !errors.Is(err, ErrPaused) {
+			return fmt.Errorf("Flush: %w", err)
+		}
+	}
+}
+
+// MemtableLag returns the age of the oldest record which hasn't yet been
+// flushed to the blobstore, or zero if the memtables are all empty.
+func (b *Blobby) MemtableLag(ctx context.Context) (time.Duration, error) {
+	oldest, err := b.mt.Oldest(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("memtable.Oldest: %w", err)
+	}
+
+	if oldest.IsZero() {
+		return 0, nil
+	}
+
+	return b.clock.Since(oldest), nil
+}
@@ -0,0 +1,51 @@
+package blobby
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgeFlushPolicy(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	// no records, so no lag.
+	lag, err := b.MemtableLag(ctx)
+	require.NoError(t, err)
+	require.Zero(t, lag)
+
+	_, err = b.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	c.Advance(30 * time.Second)
+	lag, err = b.MemtableLag(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, lag)
+
+	ctx2, cancel := context.WithCancel(ctx)
+	errs := make(chan error)
+	go func() {
+		errs <- b.RunAgeFlushPolicy(ctx2, AgeFlushPolicy{
+			MaxAge:   1 * time.Minute,
+			Interval: 10 * time.Second,
+		})
+	}()
+
+	// tick until the record is old enough to be flushed.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.BlockUntilContext(ctx, 1))
+		c.Advance(10 * time.Second)
+	}
+
+	require.Eventually(t, func() bool {
+		lag, err := b.MemtableLag(ctx)
+		return err == nil && lag == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+}
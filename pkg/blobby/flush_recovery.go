@@ -0,0 +1,93 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// WithFlushRecovery makes Open call RecoverFlushes before returning, so that a
+// process which crashed part-way through a flush finishes it when it restarts,
+// rather than leaving it for the next Flush.
+func WithFlushRecovery() Option {
+	return func(b *Blobby) {
+		b.recoverFlushes = true
+	}
+}
+
+// RecoverFlushes finishes every flush which was left behind, because it failed,
+// stopped part-way (see FlushOptions.MaxDuration), or was running in a process
+// which crashed, oldest first, without flushing the active memtable. Until then,
+// the memtables they were flushing are still read by Get, so might mask newer
+// versions which have since been flushed. Flush finishes one of them before it
+// does anything else, but this finishes all of them.
+//
+// Flushes which might still be running in another process are left alone, until
+// they've been running for memtable.ClaimTimeout. It returns the stats of each
+// flush which was finished.
+func (b *Blobby) RecoverFlushes(ctx context.Context) ([]*FlushStats, error) {
+	var out []*FlushStats
+	for {
+		stats, err := b.Flush(ctx, FlushOptions{ResumeOnly: true})
+		if err != nil {
+			return out, err
+		}
+		if stats.Skipped {
+			return out, nil
+		}
+
+		out = append(out, stats)
+	}
+}
+
+// recoverOnOpen calls RecoverFlushes, if WithFlushRecovery was given. It's not a
+// failure if flushes are paused, or another one is running.
+func (b *Blobby) recoverOnOpen(ctx context.Context) error {
+	if !b.recoverFlushes {
+		return nil
+	}
+
+	_, err := b.RecoverFlushes(ctx)
+	if errors.Is(err, ErrPaused) || errors.Is(err, ErrFlushInProgress) {
+		return nil
+	}
+
+	return err
+}
+
+// newerInSSTables is called by get with rec, which was found in a memtable. It
+// returns the newest version of the key from the sstables which might contain
+// one newer than rec, or rec if there isn't one. Versions with the same
+// timestamp as rec don't win, since the memtable will be flushed after them.
+// Stats are accumulated into the given struct.
+func (b *Blobby) newerInSSTables(ctx context.Context, key string, rec *types.Record, stats *GetStats) (*types.Record, error) {
+	metas, err := b.getContaining(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("getContaining: %w", err)
+	}
+
+	var newer []*sstable.Meta
+	for _, m := range metas {
+		if m.MaxTime.After(rec.Timestamp) {
+			newer = append(newer, m)
+		}
+	}
+	if len(newer) == 0 {
+		return rec, nil
+	}
+
+	src := stats.Source
+	r, err := findNewest(ctx, b.bs, newer, key, b.fetchLimit(), stats, b.recordAccess)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || !r.Timestamp.After(rec.Timestamp) {
+		stats.Source = src
+		return rec, nil
+	}
+
+	return r, nil
+}
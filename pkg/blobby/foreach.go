@@ -0,0 +1,102 @@
+package blobby
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"golang.org/x/sync/errgroup"
+)
+
+// ForEach is like Scan, but splits the range into opts.Concurrency partitions,
+// and scans them in parallel. fn is called with the key, value, and timestamp of
+// the newest version of every key, so it must be safe to call concurrently. Keys
+// are in order within each partition, but not across them. If fn returns an
+// error, every partition stops, and the first error is returned. Like Scan,
+// every key is read as of the same time.
+//
+// This is meant for heavy per-record work, like transformations or aggregations,
+// which would otherwise be bottlenecked on a single callback. The partitions are
+// split at the boundaries of the sstables, so an archive which is one huge
+// sstable can't be split at all.
+func (b *Blobby) ForEach(ctx context.Context, opts ScanOptions, fn func(key string, value []byte, ts time.Time) error) error {
+	err := b.authorizeScan(ctx, opts.Start, opts.End)
+	if err != nil {
+		return err
+	}
+
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassScan)
+	n := opts.Concurrency
+	if n <= 0 {
+		n = DefaultScanConcurrency
+	}
+
+	opts = b.pin(opts)
+	names, metas, err := b.scanInputs(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	send := b.readable(ctx, func(rec *Record) error {
+		return fn(rec.Key, rec.Document, rec.Timestamp)
+	})
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, p := range partitions(metas, opts.Start, opts.End, n) {
+		g.Go(func() error {
+
+			// each partition fetches one sstable at a time, since the
+			// partitions are already running in parallel.
+			return b.merge(ctx, names, overlapping(metas, p.Start, p.End), ScanOptions{
+				Start:       p.Start,
+				End:         p.End,
+				Concurrency: 1,
+				KeysOnly:    opts.KeysOnly,
+				At:          opts.At,
+			}, send)
+		})
+	}
+
+	return g.Wait()
+}
+
+// partitions splits [start, end) into at most n contiguous ranges, at the
+// MinKeys of the given sstables, so that each has roughly the same number of
+// sstables starting in it.
+func partitions(metas []*sstable.Meta, start, end string, n int) []ScanOptions {
+	var splits []string
+	for _, m := range metas {
+		if m.MinKey > start && (end == "" || m.MinKey < end) {
+			splits = append(splits, m.MinKey)
+		}
+	}
+	slices.Sort(splits)
+	splits = slices.Compact(splits)
+
+	var parts []ScanOptions
+	lo := start
+	for i := 1; i < n; i++ {
+		k := len(splits) * i / n
+		if k >= len(splits) || splits[k] <= lo {
+			continue
+		}
+		parts = append(parts, ScanOptions{Start: lo, End: splits[k]})
+		lo = splits[k]
+	}
+
+	return append(parts, ScanOptions{Start: lo, End: end})
+}
+
+// overlapping returns the sstables whose key range overlaps [start, end), in the
+// same order.
+func overlapping(metas []*sstable.Meta, start, end string) []*sstable.Meta {
+	var out []*sstable.Meta
+	for _, m := range metas {
+		if m.MaxKey >= start && (end == "" || m.MinKey < end) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package blobby
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitions(t *testing.T) {
+	metas := []*sstable.Meta{
+		{MinKey: "a", MaxKey: "f"},
+		{MinKey: "c", MaxKey: "d"},
+		{MinKey: "e", MaxKey: "k"},
+		{MinKey: "g", MaxKey: "z"},
+		{MinKey: "g", MaxKey: "h"},
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		n          int
+		want       []ScanOptions
+	}{
+		{"", "", 1, []ScanOptions{{}}},
+		{"", "", 2, []ScanOptions{{End: "e"}, {Start: "e"}}},
+		{"", "", 4, []ScanOptions{{End: "c"}, {Start: "c", End: "e"}, {Start: "e", End: "g"}, {Start: "g"}}},
+		{"", "", 10, []ScanOptions{{End: "a"}, {Start: "a", End: "c"}, {Start: "c", End: "e"}, {Start: "e", End: "g"}, {Start: "g"}}},
+		{"d", "g", 4, []ScanOptions{{Start: "d", End: "e"}, {Start: "e", End: "g"}}},
+		{"x", "", 4, []ScanOptions{{Start: "x"}}},
+	} {
+		t.Run(fmt.Sprintf("%s-%s-%d", tc.start, tc.end, tc.n), func(t *testing.T) {
+			assert.Equal(t, tc.want, partitions(metas, tc.start, tc.end, tc.n))
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	for i, keys := range [][]string{{"a", "c", "e"}, {"b", "c", "f"}, {"c", "d"}} {
+		for _, k := range keys {
+			tb.put(k, []byte(fmt.Sprintf("%s%d", k, i)))
+			c.Advance(1 * time.Second)
+		}
+		_, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+	tb.put("e", []byte("e3"))
+
+	for _, n := range []int{1, 2, 3} {
+		var mu sync.Mutex
+		var got []string
+		err := b.ForEach(ctx, ScanOptions{Concurrency: n}, func(key string, value []byte, ts time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, string(value))
+			return nil
+		})
+		require.NoError(t, err)
+
+		sort.Strings(got)
+		assert.Equal(t, []string{"a0", "b1", "c2", "d2", "e3", "f1"}, got)
+	}
+}
@@ -0,0 +1,91 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+type CompactionRecord = metadata.CompactionRecord
+type HistoryFilter = metadata.HistoryFilter
+
+// CompactionHistory returns the records of the compactions matching the given
+// filter, newest first. Every compaction which gets as far as claiming its
+// inputs is recorded, including those which fail.
+func (b *Blobby) CompactionHistory(ctx context.Context, f HistoryFilter) ([]*CompactionRecord, error) {
+	return b.md.GetCompactionHistory(ctx, f)
+}
+
+// Lineage returns the records of every compaction which contributed to the
+// sstable with the given filename: the one which wrote it, then the ones which
+// wrote its inputs, and so on, breadth first. Inputs which weren't written by a
+// compaction came from flushes. It's empty if the sstable itself came from a
+// flush.
+func (b *Blobby) Lineage(ctx context.Context, filename string) ([]*CompactionRecord, error) {
+	var out []*CompactionRecord
+	seen := map[string]bool{filename: true}
+	queue := []string{filename}
+
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+
+		rs, err := b.md.GetCompactionHistory(ctx, HistoryFilter{Output: fn})
+		if err != nil {
+			return nil, fmt.Errorf("metadata.GetCompactionHistory(%s): %w", fn, err)
+		}
+
+		for _, r := range rs {
+			out = append(out, r)
+			for _, in := range r.Inputs {
+				if !seen[in] {
+					seen[in] = true
+					queue = append(queue, in)
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// recordCompaction adds the given compaction to the history, along with the
+// caller (if any) from the context. If the compaction succeeded but couldn't be
+// recorded, an error is returned.
+func (b *Blobby) recordCompaction(ctx context.Context, s *CompactionStats) error {
+	r := &metadata.CompactionRecord{
+		Started:  s.Started,
+		Finished: s.Finished,
+		Operator: callerFrom(ctx),
+		Reason:   s.Reason,
+		Inputs:   filenames(s.Inputs),
+		Outputs:  filenames(s.Outputs),
+		Dropped:  s.Dropped,
+	}
+
+	r.InputBytes, r.InputRecords = totals(s.Inputs)
+	r.OutputBytes, r.OutputRecords = totals(s.Outputs)
+
+	if s.Error != nil {
+		r.Error = s.Error.Error()
+	}
+
+	err := b.md.RecordCompaction(ctx, r)
+	if err != nil && s.Error == nil {
+		return fmt.Errorf("metadata.RecordCompaction: %w", err)
+	}
+
+	return nil
+}
+
+// totals returns the total size and record count of the given sstables.
+func totals(metas []*sstable.Meta) (int, int) {
+	var size, count int
+	for _, m := range metas {
+		size += m.Size
+		count += m.Count
+	}
+	return size, count
+}
@@ -0,0 +1,59 @@
+package blobby
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineage(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	ctx = WithCaller(ctx, "adam")
+
+	flush := func(key string) {
+		_, err := b.Put(ctx, key, []byte(key))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Second)
+	}
+
+	compact := func() *CompactionStats {
+		stats, err := b.Compact(ctx, CompactionOptions{})
+		require.NoError(t, err)
+		require.Len(t, stats, 1)
+		require.NoError(t, stats[0].Error)
+		c.Advance(time.Second)
+		return stats[0]
+	}
+
+	flush("a")
+	flush("b")
+	s1 := compact()
+	flush("c")
+	s2 := compact()
+
+	out := s2.Outputs[0].Filename()
+	rs, err := b.Lineage(ctx, out)
+	require.NoError(t, err)
+	require.Len(t, rs, 2)
+
+	assert.Equal(t, []string{out}, rs[0].Outputs)
+	assert.Equal(t, filenames(s2.Inputs), rs[0].Inputs)
+	assert.Equal(t, "adam", rs[0].Operator)
+	assert.Equal(t, fmt.Sprintf("oldest-first: 2 files, %d bytes", s2.Inputs[0].Size+s2.Inputs[1].Size), rs[0].Reason)
+	assert.Equal(t, 3, rs[0].OutputRecords)
+
+	assert.Equal(t, filenames(s1.Outputs), rs[1].Outputs)
+	assert.Equal(t, filenames(s1.Inputs), rs[1].Inputs)
+
+	// the sstables written by flushes have no lineage.
+	rs, err = b.Lineage(ctx, s1.Inputs[0].Filename())
+	require.NoError(t, err)
+	assert.Empty(t, rs)
+}
@@ -0,0 +1,245 @@
+package blobby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultImportSSTableSize is the size of the values which Import writes to
+// each sstable, when ImportOptions.SSTableSize isn't given.
+const DefaultImportSSTableSize = 64 << 20
+
+// ImportConcurrency is the number of objects which Import fetches at once, when
+// ImportOptions.Concurrency isn't given.
+const ImportConcurrency = 32
+
+type ImportOptions struct {
+	// Bucket is where the objects are. The default is the archive's primary
+	// bucket, in which case Prefix must not include the archive's sstables.
+	Bucket string
+
+	// Prefix limits the import to the objects whose keys start with it.
+	Prefix string
+
+	// TrimPrefix removes Prefix from the key of each object, to get the key
+	// which its value is stored under. By default, they're the same.
+	TrimPrefix bool
+
+	// StartAfter skips the objects whose keys sort at or before it, to resume
+	// an import which was interrupted. See ImportStats.LastKey.
+	StartAfter string
+
+	// SSTableSize is roughly the total size of the values written to each
+	// sstable. The default is DefaultImportSSTableSize.
+	SSTableSize int64
+
+	// Concurrency is the number of objects fetched at once. The default is
+	// ImportConcurrency.
+	Concurrency int
+
+	// SkipInvalid skips objects which don't contain valid JSON, rather than
+	// failing. They're counted in ImportStats.Skipped.
+	SkipInvalid bool
+}
+
+type ImportStats struct {
+	// The number of objects listed.
+	Listed int
+
+	// The number of records written, and the total size of their values.
+	Imported int
+	Bytes    int64
+
+	// The number of objects which were skipped, because they're "directories"
+	// or (with SkipInvalid) aren't valid JSON.
+	Skipped int
+
+	// The sstables which were added to the live set.
+	Outputs []*sstable.Meta
+
+	// The key of the last object whose record was added to the live set. Pass
+	// it as ImportOptions.StartAfter to resume from after it.
+	LastKey string
+}
+
+// Import bulk-loads an existing store of one JSON object per key in S3 into the
+// archive, by listing the objects and writing their values straight to new
+// sstables, without replaying them through Put. Each record is timestamped
+// with the LastModified of its object, so writes made since then by Put win.
+// Keys and values are checked and encoded like Put would, but quotas don't
+// apply.
+//
+// S3 lists objects in key order, so each sstable covers a separate range of
+// keys, and is added to the live set as soon as it's written. If the import is
+// interrupted, those sstables are kept, and it can be resumed with StartAfter.
+// Importing the same objects twice is harmless, but wasteful until they're
+// compacted.
+func (b *Blobby) Import(ctx context.Context, opts ImportOptions) (*ImportStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassFlush)
+	stats := &ImportStats{}
+
+	if opts.SSTableSize <= 0 {
+		opts.SSTableSize = DefaultImportSSTableSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = ImportConcurrency
+	}
+
+	var batch []*types.Record
+	var size int64
+	var lastKey string
+
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		metas, err := b.importBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		stats.Outputs = append(stats.Outputs, metas...)
+		stats.Imported += len(batch)
+		stats.Bytes += size
+		stats.LastKey = lastKey
+		batch, size = nil, 0
+		return nil
+	}
+
+	err := b.bs.ListPages(ctx, opts.Bucket, opts.Prefix, opts.StartAfter, func(page []blobstore.BlobInfo) error {
+		stats.Listed += len(page)
+
+		recs, err := b.fetchObjects(ctx, opts, page)
+		if err != nil {
+			return err
+		}
+
+		for i, rec := range recs {
+			if rec == nil {
+				stats.Skipped++
+				continue
+			}
+
+			batch = append(batch, rec)
+			size += int64(len(rec.Document))
+			lastKey = page[i].Key
+
+			if size >= opts.SSTableSize {
+				err = commit()
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = commit()
+	}
+
+	if len(stats.Outputs) == 0 && err == nil {
+		return stats, nil
+	}
+
+	b.emit(ctx, Event{Type: EventImport, Created: stats.Outputs, Error: err})
+	return stats, b.audited(ctx, &audit.Entry{Op: audit.OpImport, Created: filenames(stats.Outputs)}, err)
+}
+
+// fetchObjects returns a record for each of the given objects, in the same
+// order, or nil for those which should be skipped.
+func (b *Blobby) fetchObjects(ctx context.Context, opts ImportOptions, objs []blobstore.BlobInfo) ([]*types.Record, error) {
+	recs := make([]*types.Record, len(objs))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.Concurrency)
+
+	for i, obj := range objs {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+
+		key := obj.Key
+		if opts.TrimPrefix {
+			key = strings.TrimPrefix(key, opts.Prefix)
+		}
+
+		g.Go(func() error {
+			err := b.authorize(gctx, MethodPut, key)
+			if err != nil {
+				return err
+			}
+
+			body, err := b.bs.GetBlobIn(gctx, opts.Bucket, obj.Key)
+			if err != nil {
+				return fmt.Errorf("blobstore.GetBlobIn(%s): %w", obj.Key, err)
+			}
+
+			if !json.Valid(body) {
+				if opts.SkipInvalid {
+					return nil
+				}
+				return fmt.Errorf("invalid JSON: %s", obj.Key)
+			}
+
+			rec, err := b.prepare(&Call{Method: MethodPut, Key: key, Value: body})
+			if err != nil {
+				return fmt.Errorf("%s: %w", obj.Key, err)
+			}
+
+			// the TTL of the namespace only applies to the memtable.
+			rec.Timestamp = obj.LastModified
+			rec.Expires = time.Time{}
+
+			recs[i] = rec
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+// importBatch writes the given records, which must be sorted by key, to new
+// sstables, and adds them to the live set.
+func (b *Blobby) importBatch(ctx context.Context, recs []*types.Record) ([]*sstable.Meta, error) {
+	ch := make(chan *types.Record)
+	go func() {
+		defer close(ch)
+		for _, rec := range recs {
+			ch <- rec
+		}
+	}()
+
+	// FlushPartitioned drains the channel even if it fails.
+	metas, err := b.bs.FlushPartitioned(ctx, ch, func(string) string { return "" })
+	if err != nil {
+		return nil, fmt.Errorf("blobstore.FlushPartitioned: %w", err)
+	}
+
+	count := 0
+	for _, m := range metas {
+		count += m.Count
+	}
+
+	err = b.register(ctx, metas, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
@@ -0,0 +1,105 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, b.bs.PutBlob(ctx, "legacy/"+k, []byte(`{"k":"`+k+`"}`)))
+	}
+	require.NoError(t, b.bs.PutBlob(ctx, "legacy/dir/", nil))
+	require.NoError(t, b.bs.PutBlob(ctx, "legacy/e", []byte("not json")))
+
+	_, err := b.Import(ctx, ImportOptions{Prefix: "legacy/", TrimPrefix: true})
+	require.ErrorContains(t, err, "invalid JSON: legacy/e")
+
+	// nothing was imported, since everything fit in one sstable.
+	v, _, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	// one tiny sstable per object.
+	stats, err := b.Import(ctx, ImportOptions{Prefix: "legacy/", TrimPrefix: true, SkipInvalid: true, SSTableSize: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 6, stats.Listed)
+	assert.Equal(t, 4, stats.Imported)
+	assert.Equal(t, 2, stats.Skipped)
+	assert.Len(t, stats.Outputs, 4)
+	assert.Equal(t, "legacy/d", stats.LastKey)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		v, _, err := b.Get(ctx, k)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"k":"`+k+`"}`, string(v))
+	}
+
+	// newer writes win over imported records, which are as old as the objects.
+	c.Advance(time.Hour)
+	_, err = b.Put(ctx, "a", []byte(`{"k":"new"}`))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	v, _, err = b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"new"}`, string(v))
+
+	// resuming from the last key finds nothing new.
+	stats, err = b.Import(ctx, ImportOptions{Prefix: "legacy/", StartAfter: "legacy/e"})
+	require.NoError(t, err)
+	assert.Zero(t, stats.Listed)
+	assert.Empty(t, stats.Outputs)
+}
+
+func TestImportOverMemtable(t *testing.T) {
+	// the clock starts an hour before the objects are written, so the first
+	// put is older than them.
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Add(-time.Hour).Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	_, err := b.Put(ctx, "a", []byte(`{"k":"old"}`))
+	require.NoError(t, err)
+
+	for _, k := range []string{"a", "b"} {
+		require.NoError(t, b.bs.PutBlob(ctx, "legacy/"+k, []byte(`{"k":"imported"}`)))
+	}
+
+	// and the second is newer.
+	c.Advance(2 * time.Hour)
+	_, err = b.Put(ctx, "b", []byte(`{"k":"new"}`))
+	require.NoError(t, err)
+
+	// without flushing first, so the puts are still in the memtable.
+	_, err = b.Import(ctx, ImportOptions{Prefix: "legacy/", TrimPrefix: true})
+	require.NoError(t, err)
+
+	// the imported record is newer than the unflushed put, so it wins.
+	v, stats, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"imported"}`, string(v))
+	assert.Equal(t, 1, stats.BlobsFetched)
+
+	// but not over the newer one.
+	v, _, err = b.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"new"}`, string(v))
+
+	// and nothing changes when the memtable is flushed.
+	_, err = b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	for k, want := range map[string]string{"a": "imported", "b": "new"} {
+		v, _, err := b.Get(ctx, k)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"k":"`+want+`"}`, string(v))
+	}
+}
@@ -0,0 +1,101 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type IndexOptions struct {
+	// MaxSSTables is the maximum number of indexes to build in one run, so a
+	// large backlog can be worked through gradually. Zero is no limit.
+	MaxSSTables int
+}
+
+type IndexStats struct {
+	// The number of live sstables which had no index.
+	Missing int
+
+	// The number of indexes which were built and attached.
+	Built int
+
+	// The number of indexes which were built, but discarded because their
+	// sstable was compacted away in the meantime.
+	Discarded int
+}
+
+// BuildIndexes builds indexes for live sstables which don't have one, because
+// they were written before indexes existed, so that reads of them can benefit
+// too. Each sstable is read in full, but not rewritten; the index is written
+// alongside it, and attached via the metadata.
+func (b *Blobby) BuildIndexes(ctx context.Context, opts IndexOptions) (*IndexStats, error) {
+	stats := &IndexStats{}
+
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	for _, m := range metas {
+		if m.Index != "" {
+			continue
+		}
+		stats.Missing++
+
+		if opts.MaxSSTables > 0 && stats.Built+stats.Discarded >= opts.MaxSSTables {
+			continue
+		}
+
+		err = b.bs.BuildIndex(ctx, m)
+		if err != nil {
+			return stats, fmt.Errorf("blobstore.BuildIndex(%s): %w", m.Filename(), err)
+		}
+
+		err = b.md.SetIndex(ctx, m)
+		if err != nil {
+			// if the sstable was compacted while the index was being built,
+			// nothing will ever delete the index, so do it now.
+			live, lerr := b.md.IsLive(ctx, m)
+			if lerr != nil || live {
+				return stats, fmt.Errorf("metadata.SetIndex(%s): %w", m.Filename(), err)
+			}
+
+			err = b.bs.DeleteIndex(ctx, m)
+			if err != nil {
+				return stats, fmt.Errorf("blobstore.DeleteIndex(%s): %w", m.Filename(), err)
+			}
+
+			stats.Discarded++
+			continue
+		}
+
+		stats.Built++
+	}
+
+	return stats, nil
+}
+
+// RunBuildIndexes calls BuildIndexes periodically until the context is
+// cancelled or it fails, passing the stats from each run to onResult. Once every
+// sstable has an index, each run only reads the metadata.
+func (b *Blobby) RunBuildIndexes(ctx context.Context, interval time.Duration, opts IndexOptions, onResult func(*IndexStats)) error {
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+
+		stats, err := b.BuildIndexes(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("BuildIndexes: %w", err)
+		}
+
+		if onResult != nil {
+			onResult(stats)
+		}
+	}
+}
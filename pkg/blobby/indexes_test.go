@@ -0,0 +1,53 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildIndexes(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("1"))
+	c.Advance(1 * time.Second)
+	tb.put("c", []byte("3"))
+	c.Advance(1 * time.Second)
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	// make the sstable look like it was written before indexes existed.
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	require.NoError(t, b.bs.DeleteIndex(ctx, metas[0]))
+	metas[0].Index = ""
+	require.NoError(t, b.md.SetIndex(ctx, metas[0]))
+
+	_, stats, err := b.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.BlobsFetched)
+
+	istats, err := b.BuildIndexes(ctx, IndexOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &IndexStats{Missing: 1, Built: 1}, istats)
+
+	// now the missing key is ruled out without fetching the sstable.
+	_, stats, err = b.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.BlobsFetched)
+	require.Equal(t, 1, stats.BlobsFiltered)
+
+	val, _, err := b.Get(ctx, "c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), val)
+
+	// and there's nothing left to do.
+	istats, err = b.BuildIndexes(ctx, IndexOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &IndexStats{}, istats)
+}
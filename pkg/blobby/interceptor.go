@@ -0,0 +1,70 @@
+package blobby
+
+import (
+	"context"
+)
+
+type Method string
+
+const (
+	MethodPut Method = "put"
+	MethodGet Method = "get"
+
+	// MethodScan is a read of many keys, like Scan or Sample. It's only seen by
+	// authorizers and quotas, not interceptors.
+	MethodScan Method = "scan"
+)
+
+// Call describes a single call to Put or Get, as seen by interceptors. The
+// fields can be modified by interceptors on the way in (to rewrite the key or
+// transform the value being written) and on the way out (to transform the value
+// which was read).
+type Call struct {
+	Method Method
+	Key    string
+
+	// The value being written by Put, or the value read by Get. The latter is
+	// only set after the call returns, and is nil if the key wasn't found.
+	Value []byte
+
+	// The tags being written by Put, or read by Get. Like Value, the latter are
+	// only set after the call returns.
+	Tags map[string]string
+
+	// The idempotency key of the write. Only set for Put.
+	IdempotencyKey string
+
+	// The name of the memtable written to by Put. Only set after it returns.
+	Dest string
+
+	// Stats about the call to Get. Only set after it returns.
+	Stats *GetStats
+}
+
+// Handler performs a call, or passes it to the next interceptor.
+type Handler func(ctx context.Context, c *Call) error
+
+// Interceptor wraps calls to Put and Get. It should call next to continue the
+// call (possibly after modifying it), or return an error to abort it. The error
+// returned by next can be inspected, replaced, or returned as-is.
+type Interceptor func(ctx context.Context, c *Call, next Handler) error
+
+// WithInterceptor adds an interceptor around every call to Put and Get. When
+// this is given more than once, the first interceptor is the outermost.
+func WithInterceptor(i Interceptor) Option {
+	return func(b *Blobby) {
+		b.interceptors = append(b.interceptors, i)
+	}
+}
+
+// intercept calls h with the given call, wrapped in the interceptors.
+func (b *Blobby) intercept(ctx context.Context, c *Call, h Handler) error {
+	for i := len(b.interceptors) - 1; i >= 0; i-- {
+		ic, next := b.interceptors[i], h
+		h = func(ctx context.Context, c *Call) error {
+			return ic(ctx, c, next)
+		}
+	}
+
+	return h(ctx, c)
+}
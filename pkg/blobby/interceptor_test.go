@@ -0,0 +1,61 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntercept(t *testing.T) {
+	var log []string
+	trace := func(name string) Interceptor {
+		return func(ctx context.Context, c *Call, next Handler) error {
+			log = append(log, name+">")
+			err := next(ctx, c)
+			log = append(log, "<"+name)
+			return err
+		}
+	}
+
+	prefix := func(ctx context.Context, c *Call, next Handler) error {
+		c.Key = "tenant/" + c.Key
+		return next(ctx, c)
+	}
+
+	b := &Blobby{}
+	for _, opt := range []Option{WithInterceptor(trace("a")), WithInterceptor(trace("b")), WithInterceptor(prefix)} {
+		opt(b)
+	}
+
+	var seen string
+	err := b.intercept(context.Background(), &Call{Method: MethodGet, Key: "k"}, func(ctx context.Context, c *Call) error {
+		seen = c.Key
+		c.Value = []byte("v")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a>", "b>", "<b", "<a"}, log)
+	assert.Equal(t, "tenant/k", seen)
+}
+
+func TestInterceptAbort(t *testing.T) {
+	errDenied := errors.New("denied")
+	b := &Blobby{}
+	WithInterceptor(func(ctx context.Context, c *Call, next Handler) error {
+		if c.Method == MethodPut {
+			return errDenied
+		}
+		return next(ctx, c)
+	})(b)
+
+	called := false
+	err := b.intercept(context.Background(), &Call{Method: MethodPut, Key: "k"}, func(ctx context.Context, c *Call) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, errDenied)
+	assert.False(t, called)
+}
@@ -0,0 +1,82 @@
+package blobby
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// KeyPolicy restricts the keys which can be written by Put.
+type KeyPolicy struct {
+	// MaxLength is the maximum length of a key in bytes. Zero means no limit.
+	MaxLength int
+
+	// AllowEmpty permits the empty string as a key.
+	AllowEmpty bool
+
+	// ValidRune returns true if the given rune may appear in keys. If it's nil,
+	// any rune is allowed. Keys must always be valid UTF-8.
+	ValidRune func(r rune) bool
+
+	// ReservedPrefixes are key prefixes which may not be written, e.g. because
+	// they're used internally by the application.
+	ReservedPrefixes []string
+}
+
+// DefaultKeyPolicy is used when WithKeyPolicy isn't given.
+var DefaultKeyPolicy = KeyPolicy{
+	MaxLength: 1024,
+}
+
+// InvalidKey is returned by Put when the key is rejected by the KeyPolicy.
+type InvalidKey struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKey) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+func (e *InvalidKey) Is(err error) bool {
+	_, ok := err.(*InvalidKey)
+	return ok
+}
+
+// WithKeyPolicy sets the policy which keys must satisfy to be written.
+func WithKeyPolicy(p KeyPolicy) Option {
+	return func(b *Blobby) {
+		b.keyPolicy = p
+	}
+}
+
+// Check returns an InvalidKey error if the given key violates the policy.
+func (p KeyPolicy) Check(key string) error {
+	if key == "" && !p.AllowEmpty {
+		return &InvalidKey{key, "empty"}
+	}
+
+	if p.MaxLength > 0 && len(key) > p.MaxLength {
+		return &InvalidKey{key, fmt.Sprintf("longer than %d bytes", p.MaxLength)}
+	}
+
+	if !utf8.ValidString(key) {
+		return &InvalidKey{key, "not valid UTF-8"}
+	}
+
+	if p.ValidRune != nil {
+		for _, r := range key {
+			if !p.ValidRune(r) {
+				return &InvalidKey{key, fmt.Sprintf("invalid character: %q", r)}
+			}
+		}
+	}
+
+	for _, prefix := range p.ReservedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return &InvalidKey{key, fmt.Sprintf("reserved prefix: %s", prefix)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package blobby
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	p := KeyPolicy{
+		MaxLength:        8,
+		ValidRune:        func(r rune) bool { return unicode.IsLetter(r) || r == '/' },
+		ReservedPrefixes: []string{"sys/"},
+	}
+
+	for key, ok := range map[string]bool{
+		"abc":       true,
+		"日本":        true,
+		"":          false,
+		"abc1":      false,
+		"sys/x":     false,
+		"abcdefghi": false,
+		"a\xffb":    false,
+		"users/abc": false, // too long
+		"user/abc":  true,
+	} {
+		err := p.Check(key)
+		if ok {
+			assert.NoError(t, err, key)
+		} else {
+			assert.ErrorIs(t, err, &InvalidKey{}, key)
+		}
+	}
+
+	assert.NoError(t, KeyPolicy{AllowEmpty: true}.Check(""))
+	assert.Error(t, DefaultKeyPolicy.Check(strings.Repeat("x", 1025)))
+}
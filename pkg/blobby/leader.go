@@ -0,0 +1,202 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// DefaultElection is the name of the election when LeaderOptions.Name
+	// isn't given.
+	DefaultElection = "daemons"
+
+	// DefaultLeaderTTL is how long the leader holds its lease between
+	// renewals, when LeaderOptions.TTL isn't given. If the leader crashes,
+	// another process takes over within about this long.
+	DefaultLeaderTTL = 30 * time.Second
+)
+
+// LeaderOptions configures RunAsLeader.
+type LeaderOptions struct {
+	// Name identifies the election. Processes running different daemons can
+	// hold elections with different names, to spread them out. The default is
+	// DefaultElection.
+	Name string
+
+	// TTL is how long the lease lasts without being renewed. The default is
+	// DefaultLeaderTTL.
+	TTL time.Duration
+
+	// RenewInterval is how often the leader renews the lease, and how often
+	// the others try to take it. The default is a third of TTL.
+	RenewInterval time.Duration
+}
+
+// leaders tracks the elections which this process is leading, for Stats.
+type leaders struct {
+	mu      sync.Mutex
+	leading map[string]bool
+
+	acquired atomic.Int64
+	lost     atomic.Int64
+}
+
+func (l *leaders) set(name string, leading bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.leading == nil {
+		l.leading = map[string]bool{}
+	}
+
+	if leading {
+		l.leading[name] = true
+		l.acquired.Add(1)
+	} else {
+		delete(l.leading, name)
+		l.lost.Add(1)
+	}
+}
+
+func (l *leaders) names() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []string
+	for name := range l.leading {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// RunAsLeader runs fn only while this process is the leader of the named
+// election, so that when several processes embed the archive, only one of them
+// runs the background daemons (e.g. RunAgeFlushPolicy). Leadership is a lease
+// from the Coordinator (see WithCoordinator), which the leader renews every
+// RenewInterval while the others wait to take it.
+//
+// If the leader crashes, its lease expires and another process takes over. If
+// it can't renew its lease for as long as the TTL, or someone else took it, the
+// context passed to fn is cancelled, and this waits for fn to return before
+// campaigning again, so fn never runs twice at once in this process. It should
+// still tolerate another process running it briefly at the same time, since
+// clocks and networks are imperfect.
+//
+// It returns when the context is cancelled, giving up leadership if it held it,
+// or when fn returns an error other than because it lost leadership, after
+// giving up leadership so another process takes over.
+func (b *Blobby) RunAsLeader(ctx context.Context, opts LeaderOptions, fn func(context.Context) error) error {
+	if opts.Name == "" {
+		opts.Name = DefaultElection
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultLeaderTTL
+	}
+	if opts.RenewInterval <= 0 {
+		opts.RenewInterval = opts.TTL / 3
+	}
+
+	t := b.clock.NewTicker(opts.RenewInterval)
+	defer t.Stop()
+
+	for {
+		err := b.coord.AcquireLease(ctx, opts.Name, b.owner, opts.TTL)
+		if err == nil {
+			stop, err := b.lead(ctx, opts, t, fn)
+			if stop {
+				return err
+			}
+		} else if !errors.Is(err, ErrLeaseHeld) && ctx.Err() == nil {
+			// can't reach the coordinator, so can't be leader. keep trying.
+			b.emit(ctx, Event{Type: EventLeaderError, Election: opts.Name, Owner: b.owner, Error: err})
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+	}
+}
+
+// lead runs fn while renewing the lease, which was just acquired, until fn
+// returns or the lease is lost. It returns true if RunAsLeader should return
+// the given error, or false if it should campaign again.
+func (b *Blobby) lead(ctx context.Context, opts LeaderOptions, t clockwork.Ticker, fn func(context.Context) error) (bool, error) {
+	b.leaders.set(opts.Name, true)
+	b.emit(ctx, Event{Type: EventLeaderAcquired, Election: opts.Name, Owner: b.owner})
+
+	fctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(fctx)
+	}()
+
+	// when the lease runs out, if it isn't renewed.
+	expires := b.clock.Now().Add(opts.TTL)
+
+	// why we stopped leading, unless fn returned by itself.
+	var lost error
+	var ferr error
+	returned := false
+
+	for !returned && lost == nil {
+		select {
+		case ferr = <-done:
+			returned = true
+			continue
+		case <-ctx.Done():
+			lost = ctx.Err()
+			continue
+		case <-t.Chan():
+		}
+
+		now := b.clock.Now()
+		err := b.coord.AcquireLease(ctx, opts.Name, b.owner, opts.TTL)
+		switch {
+		case err == nil:
+			expires = now.Add(opts.TTL)
+		case errors.Is(err, ErrLeaseHeld):
+			lost = err
+		case !now.Before(expires):
+			lost = fmt.Errorf("couldn't renew lease: %w", err)
+		}
+	}
+
+	if !returned {
+		cancel()
+		<-done
+	}
+
+	// if the process is still running, let someone else take over now,
+	// rather than after the lease expires.
+	rerr := b.coord.ReleaseLease(context.WithoutCancel(ctx), opts.Name, b.owner)
+
+	b.leaders.set(opts.Name, false)
+	e := Event{Type: EventLeaderLost, Election: opts.Name, Owner: b.owner}
+	if lost != nil && ctx.Err() == nil {
+		e.Error = lost
+	}
+	b.emit(ctx, e)
+
+	switch {
+	case ctx.Err() != nil:
+		return true, ctx.Err()
+	case returned && ferr != nil:
+		return true, errors.Join(fmt.Errorf("fn: %w", ferr), rerr)
+	case returned:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
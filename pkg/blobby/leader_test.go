@@ -0,0 +1,214 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCoordinator is an in-memory Coordinator. Leases never expire by
+// themselves; the test hands them over with steal instead.
+type fakeCoordinator struct {
+	mu       sync.Mutex
+	holders  map[string]string
+	broken   map[string]bool
+	manifest time.Time
+}
+
+func newFakeCoordinator() *fakeCoordinator {
+	return &fakeCoordinator{holders: map[string]string{}, broken: map[string]bool{}}
+}
+
+func (f *fakeCoordinator) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.broken[owner] {
+		return errors.New("unreachable")
+	}
+	if h := f.holders[name]; h != "" && h != owner {
+		return ErrLeaseHeld
+	}
+
+	f.holders[name] = owner
+	return nil
+}
+
+func (f *fakeCoordinator) ReleaseLease(ctx context.Context, name, owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.holders[name] == owner {
+		delete(f.holders, name)
+	}
+	return nil
+}
+
+func (f *fakeCoordinator) LeaseHolder(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.holders[name], nil
+}
+
+func (f *fakeCoordinator) ManifestVersion(ctx context.Context) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.manifest, nil
+}
+
+func (f *fakeCoordinator) SwapManifestVersion(ctx context.Context, prev, next time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.manifest.Equal(prev) {
+		return ErrManifestConflict
+	}
+	f.manifest = next
+	return nil
+}
+
+// setBroken makes the coordinator unreachable by the given owner, or not.
+func (f *fakeCoordinator) setBroken(owner string, broken bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broken[owner] = broken
+}
+
+// steal gives the named lease to owner, as if the holder's lease expired and
+// someone else took it.
+func (f *fakeCoordinator) steal(name, owner string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.holders[name] = owner
+}
+
+// daemon is a fn for RunAsLeader which runs until it's cancelled, and counts
+// how many copies of it are running.
+type daemon struct {
+	mu      sync.Mutex
+	running int
+	starts  int
+}
+
+func (d *daemon) run(ctx context.Context) error {
+	d.mu.Lock()
+	d.running++
+	d.starts++
+	d.mu.Unlock()
+
+	<-ctx.Done()
+
+	d.mu.Lock()
+	d.running--
+	d.mu.Unlock()
+	return ctx.Err()
+}
+
+func (d *daemon) state() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running, d.starts
+}
+
+// advanceUntil advances the clock by d until cond is true, giving the
+// goroutines waiting on it a moment to react each time.
+func advanceUntil(t *testing.T, c *clockwork.FakeClock, d time.Duration, cond func() bool) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		if cond() {
+			return true
+		}
+		c.Advance(d)
+		return false
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestRunAsLeader(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	coord := newFakeCoordinator()
+	b1 := New("mongodb://unused", "unused", c, WithCoordinator(coord))
+	b2 := New("mongodb://unused", "unused", c, WithCoordinator(coord))
+	opts := LeaderOptions{TTL: 3 * time.Second, RenewInterval: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := b1.Events(ctx)
+
+	var d1, d2 daemon
+	errs := make(chan error, 2)
+	go func() { errs <- b1.RunAsLeader(ctx, opts, d1.run) }()
+	require.Eventually(t, func() bool { r, _ := d1.state(); return r == 1 }, time.Second, time.Millisecond)
+
+	go func() { errs <- b2.RunAsLeader(ctx, opts, d2.run) }()
+
+	// only the leader runs the daemon.
+	c.Advance(time.Second)
+	c.Advance(time.Second)
+	r2, _ := d2.state()
+	assert.Equal(t, 0, r2)
+	assert.Equal(t, []string{DefaultElection}, b1.Stats().Leading)
+	assert.Empty(t, b2.Stats().Leading)
+
+	e := <-events
+	assert.Equal(t, EventLeaderAcquired, e.Type)
+	assert.Equal(t, b1.Owner(), e.Owner)
+	assert.Equal(t, DefaultElection, e.Election)
+
+	// the leader can't reach the coordinator. it keeps leading until its
+	// lease would have expired, then steps down.
+	coord.setBroken(b1.Owner(), true)
+	advanceUntil(t, c, time.Second, func() bool { r, _ := d1.state(); return r == 0 })
+
+	e = <-events
+	assert.Equal(t, EventLeaderLost, e.Type)
+	assert.ErrorContains(t, e.Error, "couldn't renew lease")
+
+	// the other takes over.
+	advanceUntil(t, c, time.Second, func() bool { r, _ := d2.state(); return r == 1 })
+	r1, s1 := d1.state()
+	assert.Equal(t, 0, r1)
+	assert.Equal(t, 1, s1)
+
+	// and loses it when someone else takes the lease.
+	coord.setBroken(b1.Owner(), false)
+	coord.steal(DefaultElection, b1.Owner())
+	advanceUntil(t, c, time.Second, func() bool { r, _ := d2.state(); return r == 0 })
+	advanceUntil(t, c, time.Second, func() bool { r, _ := d1.state(); return r == 1 })
+
+	s := b2.Stats()
+	assert.Equal(t, int64(1), s.LeaderAcquired)
+	assert.Equal(t, int64(1), s.LeaderLost)
+	assert.Empty(t, s.Leading)
+
+	// cancelling gives up the lease.
+	cancel()
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, <-errs, context.Canceled)
+	}
+	holder, err := coord.LeaseHolder(context.Background(), DefaultElection)
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+}
+
+func TestRunAsLeaderFnFails(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	coord := newFakeCoordinator()
+	b := New("mongodb://unused", "unused", c, WithCoordinator(coord))
+
+	boom := errors.New("boom")
+	err := b.RunAsLeader(context.Background(), LeaderOptions{Name: "flush"}, func(ctx context.Context) error {
+		return boom
+	})
+	require.ErrorIs(t, err, boom)
+
+	// so someone else can take over right away.
+	holder, err := coord.LeaseHolder(context.Background(), "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+	assert.Empty(t, b.Stats().Leading)
+}
@@ -0,0 +1,30 @@
+package blobby
+
+import (
+	"context"
+
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+type ListOptions = metadata.ListOptions
+type ListOrder = metadata.ListOrder
+
+const (
+	ByMinKey  = metadata.ByMinKey
+	ByCreated = metadata.ByCreated
+	BySize    = metadata.BySize
+)
+
+// ListSSTables returns one page of the metadata of the live sstables matching
+// the given options, and a token to pass as opts.After to fetch the next, which
+// is empty after the last page. See metadata.ListOptions.
+func (b *Blobby) ListSSTables(ctx context.Context, opts ListOptions) ([]*sstable.Meta, string, error) {
+	return b.md.ListMetas(ctx, opts)
+}
+
+// EachSSTable calls fn with the metadata of each live sstable matching the given
+// options, without loading them all into memory at once. See metadata.EachMeta.
+func (b *Blobby) EachSSTable(ctx context.Context, opts ListOptions, fn func(*sstable.Meta) error) error {
+	return b.md.EachMeta(ctx, opts, fn)
+}
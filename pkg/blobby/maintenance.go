@@ -0,0 +1,76 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+type MaintenanceWindow = metadata.MaintenanceWindow
+type MaintenanceSchedule = metadata.MaintenanceSchedule
+
+var ParseMaintenanceWindow = metadata.ParseMaintenanceWindow
+
+// The background tasks which can be confined to maintenance windows, by
+// SetMaintenanceWindows, or paused.
+const (
+	// Compact.
+	TaskCompaction = metadata.TaskCompaction
+
+	// Purge, and Reconcile when it deletes orphans.
+	TaskGC = metadata.TaskGC
+)
+
+// ErrOutsideMaintenanceWindow is returned by tasks which were called outside of
+// their maintenance windows, without doing anything.
+var ErrOutsideMaintenanceWindow = errors.New("outside maintenance window")
+
+// SetMaintenanceWindows confines the given task to the given windows, e.g. to
+// run compactions only at night, when reads are few and requests are cheap. If
+// there are no windows, the task can run at any time, which is the default.
+// It's stored in the metadata, so applies to every process using the archive
+// as soon as it's set.
+//
+// Windows are checked when the task starts, so one which starts just before its
+// window closes runs to completion. Use CompactionOptions.MaxDuration to bound
+// how long compactions run past it.
+func (b *Blobby) SetMaintenanceWindows(ctx context.Context, task string, windows []MaintenanceWindow) error {
+	err := b.md.SetMaintenanceWindows(ctx, task, windows)
+	if err != nil {
+		return fmt.Errorf("metadata.SetMaintenanceWindows: %w", err)
+	}
+
+	return nil
+}
+
+// MaintenanceSchedule returns the maintenance windows of every task which has
+// any.
+func (b *Blobby) MaintenanceSchedule(ctx context.Context) (MaintenanceSchedule, error) {
+	ms, err := b.md.GetMaintenanceSchedule(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetMaintenanceSchedule: %w", err)
+	}
+
+	return ms, nil
+}
+
+// checkMaintenance returns ErrOutsideMaintenanceWindow if the given task isn't
+// allowed to run now. The schedule is read every time, since tasks are rare and
+// slow, so changes apply immediately.
+func (b *Blobby) checkMaintenance(ctx context.Context, task string) error {
+	ms, err := b.MaintenanceSchedule(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := b.clock.Now()
+	if ms.Allows(task, now) {
+		return nil
+	}
+
+	next := ms.NextAllowed(task, now)
+	return fmt.Errorf("%w: %s can't run until %s", ErrOutsideMaintenanceWindow, task, next.Format(time.RFC3339))
+}
@@ -0,0 +1,61 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	// a wednesday, at midnight.
+	c := clockwork.NewFakeClockAt(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx, _, b := setup(t, c)
+
+	for _, k := range []string{"a", "b"} {
+		_, err := b.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Second)
+	}
+
+	w, err := ParseMaintenanceWindow("01:00-05:00")
+	require.NoError(t, err)
+	require.NoError(t, b.SetMaintenanceWindows(ctx, TaskCompaction, []MaintenanceWindow{w}))
+	require.NoError(t, b.SetMaintenanceWindows(ctx, TaskGC, []MaintenanceWindow{w}))
+
+	_, err = b.Compact(ctx, CompactionOptions{MinFiles: 2})
+	require.ErrorIs(t, err, ErrOutsideMaintenanceWindow)
+	assert.ErrorContains(t, err, "2025-01-01T01:00:00Z")
+
+	_, err = b.Purge(ctx, 0)
+	require.ErrorIs(t, err, ErrOutsideMaintenanceWindow)
+
+	// reconciling without deleting anything is always allowed.
+	_, err = b.Reconcile(ctx, ReconcileOptions{})
+	require.NoError(t, err)
+	_, err = b.Reconcile(ctx, ReconcileOptions{DeleteOrphans: true})
+	require.ErrorIs(t, err, ErrOutsideMaintenanceWindow)
+
+	c.Advance(time.Hour)
+	stats, err := b.Compact(ctx, CompactionOptions{MinFiles: 2})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.NoError(t, stats[0].Error)
+
+	_, err = b.Purge(ctx, 0)
+	require.NoError(t, err)
+
+	// clearing the windows allows it at any time.
+	c.Advance(12 * time.Hour)
+	require.NoError(t, b.SetMaintenanceWindows(ctx, TaskCompaction, nil))
+	_, err = b.Compact(ctx, CompactionOptions{MinFiles: 2})
+	require.NoError(t, err)
+
+	ms, err := b.MaintenanceSchedule(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceSchedule{TaskGC: {w}}, ms)
+}
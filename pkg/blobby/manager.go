@@ -0,0 +1,169 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/jonboulle/clockwork"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Manager hands out named archives which share one Mongo client and one S3
+// client, so a process serving many of them (e.g. one per tenant) has a single
+// connection pool to each backend, rather than one per archive. Each archive
+// still has its own Mongo database (named after it), and its own options, so
+// can write to a different bucket or key scheme.
+//
+// Handles are created on first use, and cached, so every call for the same name
+// returns the same one. The clients are connected then too, unless they were
+// given to UseClients. It's safe for concurrent use.
+type Manager struct {
+	mongoURL string
+	bucket   string
+	clock    clockwork.Clock
+	opts     []Option
+
+	mu       sync.Mutex
+	mongo    *mongo.Client
+	s3       blobstore.S3API
+	archives map[string]*Blobby
+
+	// true if the mongo client was connected by the manager, rather than
+	// given to UseClients, so Close should disconnect it.
+	ownMongo bool
+}
+
+// NewManager returns a manager of archives in the given Mongo and bucket. The
+// options are applied to every archive it hands out. Nothing is connected until
+// the first archive is.
+func NewManager(mongoURL, bucket string, clock clockwork.Clock, opts ...Option) *Manager {
+	return &Manager{
+		mongoURL: mongoURL,
+		bucket:   bucket,
+		clock:    clock,
+		opts:     opts,
+		archives: map[string]*Blobby{},
+	}
+}
+
+// Archive returns a handle on the archive with the given name, which must be
+// initialized or opened before use, like one returned by New. The given options
+// are applied after those of the manager, the first time the name is asked for;
+// after that, they're ignored, and the cached handle is returned.
+func (m *Manager) Archive(ctx context.Context, name string, opts ...Option) (*Blobby, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if b, ok := m.archives[name]; ok {
+		return b, nil
+	}
+
+	err := m.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	all := append([]Option{WithMongoClient(m.mongo), WithS3Client(m.s3)}, m.opts...)
+	all = append(all, opts...)
+	all = append(all, WithName(name))
+	b := New(m.mongoURL, m.bucket, m.clock, all...)
+
+	m.archives[name] = b
+	return b, nil
+}
+
+// UseClients makes the manager share the given clients between its archives,
+// rather than connecting its own, so that the host application can manage them.
+// Either can be nil, to connect that one as usual. It must be called before the
+// first call to Archive. Clients given this way aren't disconnected by Close.
+func (m *Manager) UseClients(mc *mongo.Client, sc blobstore.S3API) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mc != nil {
+		m.mongo = mc
+	}
+	if sc != nil {
+		m.s3 = sc
+	}
+}
+
+// Names returns the names of the archives handed out so far, sorted.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.archives))
+	for name := range m.archives {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// Forget removes the handle on the archive with the given name from the cache,
+// so the next call to Archive creates a new one. The archive itself is not
+// changed, and the old handle keeps working until the manager is closed.
+func (m *Manager) Forget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.archives, name)
+}
+
+// Close disconnects the shared Mongo client, unless it was given to UseClients,
+// after which none of the archives handed out can be used.
+func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mongo != nil && m.ownMongo {
+		err := m.mongo.Disconnect(ctx)
+		if err != nil {
+			return fmt.Errorf("mongo.Disconnect: %w", err)
+		}
+	}
+
+	m.mongo = nil
+	m.ownMongo = false
+	m.s3 = nil
+	m.archives = map[string]*Blobby{}
+	return nil
+}
+
+// connect creates the shared clients, if they don't exist yet. The caller must
+// hold the lock.
+func (m *Manager) connect(ctx context.Context) error {
+	if m.mongo == nil {
+		opt := options.Client().ApplyURI(m.mongoURL).SetTimeout(10 * time.Second)
+		client, err := mongo.Connect(ctx, opt)
+		if err != nil {
+			return fmt.Errorf("mongo.Connect: %w", err)
+		}
+
+		err = client.Ping(ctx, nil)
+		if err != nil {
+			_ = client.Disconnect(ctx)
+			return fmt.Errorf("mongo.Ping: %w", err)
+		}
+
+		m.mongo = client
+		m.ownMongo = true
+	}
+
+	if m.s3 == nil {
+		client, err := blobstore.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("blobstore.NewClient: %w", err)
+		}
+
+		m.s3 = client
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package blobby
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+
+	m := NewManager(env.MongoURL(), env.S3Bucket, c, WithStrictOrdering())
+	t.Cleanup(func() { m.Close(ctx) })
+
+	a, err := m.Archive(ctx, "tenant_a")
+	require.NoError(t, err)
+	b, err := m.Archive(ctx, "tenant_b", WithVerifyReads(slog.Default(), 0.5))
+	require.NoError(t, err)
+
+	// the same handle is returned every time.
+	a2, err := m.Archive(ctx, "tenant_a")
+	require.NoError(t, err)
+	assert.Same(t, a, a2)
+	assert.Equal(t, []string{"tenant_a", "tenant_b"}, m.Names())
+
+	// with the manager's options, and its own.
+	assert.Equal(t, "tenant_a", a.Name())
+	assert.True(t, a.strict)
+	assert.True(t, b.strict)
+	assert.Zero(t, a.verify.rate)
+	assert.Equal(t, 0.5, b.verify.rate)
+
+	// which share the clients.
+	assert.NotNil(t, a.mongoClient)
+	assert.Same(t, a.mongoClient, b.mongoClient)
+	assert.Same(t, a.s3Client, b.s3Client)
+	assert.Same(t, a.mongoClient, a.Sibling("other").mongoClient)
+
+	// but not their data.
+	for _, arc := range []*Blobby{a, b} {
+		require.NoError(t, arc.Init(ctx))
+	}
+	_, err = a.Put(ctx, "k", []byte("a"))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "k", []byte("b"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	_, err = a.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	c.Advance(time.Second)
+
+	v, _, err := a.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+	v, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), v)
+
+	// requests are still counted per archive.
+	assert.NotEmpty(t, a.bs.RequestStats())
+	assert.Empty(t, b.bs.RequestStats())
+
+	// a forgotten name gets a new handle.
+	m.Forget("tenant_b")
+	b2, err := m.Archive(ctx, "tenant_b")
+	require.NoError(t, err)
+	assert.NotSame(t, b, b2)
+}
+
+func TestManagerUseClients(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+
+	mc, err := mongo.Connect(ctx, options.Client().ApplyURI(env.MongoURL()))
+	require.NoError(t, err)
+	t.Cleanup(func() { mc.Disconnect(ctx) })
+
+	m := NewManager(env.MongoURL(), env.S3Bucket, c)
+	m.UseClients(mc, nil)
+
+	a, err := m.Archive(ctx, "tenant_a")
+	require.NoError(t, err)
+	assert.Same(t, mc, a.mongoClient)
+	assert.NotNil(t, a.s3Client)
+
+	require.NoError(t, a.Init(ctx))
+	_, err = a.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	// the client belongs to the caller, so it still works after Close.
+	require.NoError(t, m.Close(ctx))
+	require.NoError(t, mc.Ping(ctx, nil))
+
+	// archives can be given clients directly, too.
+	b := New(env.MongoURL(), env.S3Bucket, c, WithName("tenant_a"), WithMongoClient(mc))
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
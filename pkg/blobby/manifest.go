@@ -0,0 +1,217 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+type Manifest = metadata.Manifest
+
+const (
+	// the lease held while publishing the manifest, so that only one process
+	// publishes it at once, and how long a crashed publisher can hold it.
+	manifestLease    = "manifest"
+	manifestLeaseTTL = 5 * time.Minute
+
+	// how often to retry taking the lease while another process holds it.
+	manifestLeaseRetry = 100 * time.Millisecond
+)
+
+// WithManifest publishes the manifest (see PublishManifest) after every flush,
+// compaction, and rollback, so the copy in the blobstore is never far behind.
+// If publishing fails, the operation returns an error, but its effects are not
+// undone. Use RunManifestPublisher to catch up after such failures.
+func WithManifest() Option {
+	return func(b *Blobby) {
+		b.publishManifest = true
+	}
+}
+
+// PublishManifest writes a snapshot of the live set to the blobstore, so that
+// replicas (see Replica) can find the sstables without access to Mongo, and so
+// that the metadata can be recovered by RecoverMetadataFromBlobstore if Mongo
+// is lost.
+//
+// Superseded sstables are retained until they're purged, so a manifest remains
+// readable for at least the purge grace period after it's replaced. The live set
+// is streamed from the metadata store, so the Metas of the returned manifest are
+// empty; see its Count instead.
+//
+// Publishers in several processes take turns, via a lease from the Coordinator,
+// so an older snapshot never replaces a newer one. The Created time of each
+// manifest is after that of the last, even if the clock of this process is
+// behind the one which published it.
+func (b *Blobby) PublishManifest(ctx context.Context) (*Manifest, error) {
+	err := b.acquireManifestLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer b.coord.ReleaseLease(context.WithoutCancel(ctx), manifestLease, b.owner)
+
+	prev, err := b.coord.ManifestVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ManifestVersion: %w", err)
+	}
+
+	// truncated to the precision of extended JSON and Mongo, so the version
+	// reads back the same as it was written.
+	m := &Manifest{
+		Archive: b.name,
+		Created: b.clock.Now().Truncate(time.Millisecond),
+	}
+	if !m.Created.After(prev) {
+		m.Created = prev.Add(time.Millisecond)
+	}
+
+	// the manifest is written to a temp file one sstable at a time, rather
+	// than built in memory, since the live set might be huge.
+	f, err := os.CreateTemp("", "manifest-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	mw, err := metadata.NewManifestWriter(f, m.Archive, m.Created)
+	if err != nil {
+		return nil, fmt.Errorf("NewManifestWriter: %w", err)
+	}
+
+	err = b.md.EachMeta(ctx, metadata.ListOptions{}, mw.Add)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.EachMeta: %w", err)
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("ManifestWriter.Close: %w", err)
+	}
+	m.Count = mw.Count()
+
+	// if our lease expired while writing, and someone else published since,
+	// don't replace theirs.
+	err = b.coord.SwapManifestVersion(ctx, prev, m.Created)
+	if err != nil {
+		return nil, fmt.Errorf("SwapManifestVersion: %w", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("Seek: %w", err)
+	}
+
+	err = b.bs.PutBlobFrom(ctx, metadata.ManifestKey(b.name), f)
+	if err != nil {
+		return nil, fmt.Errorf("blobstore.PutBlobFrom: %w", err)
+	}
+
+	return m, nil
+}
+
+// acquireManifestLease waits until this process holds the manifest lease, or
+// the context is cancelled.
+func (b *Blobby) acquireManifestLease(ctx context.Context) error {
+	for {
+		err := b.coord.AcquireLease(ctx, manifestLease, b.owner, manifestLeaseTTL)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrLeaseHeld) {
+			return fmt.Errorf("AcquireLease: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("AcquireLease: %w", ctx.Err())
+		case <-b.clock.After(manifestLeaseRetry):
+		}
+	}
+}
+
+// autoPublish publishes the manifest, if WithManifest was given.
+func (b *Blobby) autoPublish(ctx context.Context) error {
+	if !b.publishManifest {
+		return nil
+	}
+
+	_, err := b.PublishManifest(ctx)
+	if err != nil {
+		return fmt.Errorf("PublishManifest: %w", err)
+	}
+
+	return nil
+}
+
+// RunManifestPublisher publishes the manifest every interval until the context
+// is cancelled. Errors are passed to onError (if it's non-nil) rather than
+// stopping the loop, since the next attempt might succeed.
+func (b *Blobby) RunManifestPublisher(ctx context.Context, interval time.Duration, onError func(error)) error {
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.Chan():
+			_, err := b.PublishManifest(ctx)
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// RecoverMetadataFromBlobstore repopulates the metadata store from the manifest
+// in the blobstore, e.g. after the Mongo cluster was lost. The metadata store is
+// initialized if necessary, and sstables which are already in the live set are
+// skipped, so this is safe to run again if it's interrupted. It returns the
+// manifest (without its Metas, which are streamed rather than kept in memory)
+// and the number of sstables which were inserted.
+//
+// Anything flushed after the manifest was published is not recovered. To find
+// those sstables, run Reconcile afterwards; they'll show up as orphans.
+func (b *Blobby) RecoverMetadataFromBlobstore(ctx context.Context) (*Manifest, int, error) {
+	r, err := b.bs.OpenBlob(ctx, metadata.ManifestKey(b.name))
+	if err != nil {
+		return nil, 0, fmt.Errorf("blobstore.OpenBlob: %w", err)
+	}
+	defer r.Close()
+
+	err = b.Init(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Init: %w", err)
+	}
+
+	// the sstables are inserted as they're read, so the manifest needn't fit
+	// in memory. its Metas are left empty.
+	n := 0
+	m, err := metadata.ReadManifest(r, func(meta *sstable.Meta) error {
+		ok, err := b.md.IsLive(ctx, meta)
+		if err != nil {
+			return fmt.Errorf("metadata.IsLive(%s): %w", meta.Filename(), err)
+		}
+		if ok {
+			return nil
+		}
+
+		err = b.md.Insert(ctx, meta)
+		if err != nil {
+			return fmt.Errorf("metadata.Insert(%s): %w", meta.Filename(), err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, n, fmt.Errorf("ReadManifest: %w", err)
+	}
+
+	return m, n, nil
+}
@@ -0,0 +1,87 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+type MemtableStats struct {
+	// The number of records in every memtable, active or waiting to be flushed,
+	// and their total size in Mongo. Records in memtables which are being
+	// flushed might also be in an sstable already.
+	Records int
+	Bytes   int64
+
+	// The timestamp of the oldest record in any memtable, or zero if they're all
+	// empty, and how long ago that was. This is how far behind the flushes are,
+	// so it should stay below the flush interval.
+	Oldest time.Time
+	Lag    time.Duration
+
+	// The name of the memtable which is receiving writes, and of those which
+	// have been rotated out and are waiting to be flushed, oldest first.
+	Active   string
+	Inactive []string
+}
+
+// MemtableStats returns the size and age of the data which hasn't been flushed
+// to the blobstore yet, so that alerts can fire when flushes stall. They're also
+// served as gauges by the /metrics endpoint of debughttp.Handler.
+func (b *Blobby) MemtableStats(ctx context.Context) (*MemtableStats, error) {
+	mts, err := b.mt.Stats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("memtable.Stats: %w", err)
+	}
+
+	ms := &MemtableStats{}
+	for _, st := range mts {
+		ms.Records += st.Records
+		ms.Bytes += st.Bytes
+
+		if !st.Oldest.IsZero() && (ms.Oldest.IsZero() || st.Oldest.Before(ms.Oldest)) {
+			ms.Oldest = st.Oldest
+		}
+
+		if st.Active {
+			ms.Active = st.Name
+		} else {
+			ms.Inactive = append(ms.Inactive, st.Name)
+		}
+	}
+
+	if !ms.Oldest.IsZero() {
+		ms.Lag = b.clock.Since(ms.Oldest)
+	}
+
+	return ms, nil
+}
+
+func writeMemtableMetrics(w io.Writer, archive string, ms *MemtableStats) {
+	labels := fmt.Sprintf("{archive=%q}", archive)
+
+	fmt.Fprintln(w, "# HELP blobby_memtable_records Records in the memtables which haven't been flushed.")
+	fmt.Fprintln(w, "# TYPE blobby_memtable_records gauge")
+	fmt.Fprintf(w, "blobby_memtable_records%s %d\n", labels, ms.Records)
+
+	fmt.Fprintln(w, "# HELP blobby_memtable_bytes Size of the records in the memtables which haven't been flushed.")
+	fmt.Fprintln(w, "# TYPE blobby_memtable_bytes gauge")
+	fmt.Fprintf(w, "blobby_memtable_bytes%s %d\n", labels, ms.Bytes)
+
+	fmt.Fprintln(w, "# HELP blobby_memtable_inactive Memtables which have been rotated out and are waiting to be flushed.")
+	fmt.Fprintln(w, "# TYPE blobby_memtable_inactive gauge")
+	fmt.Fprintf(w, "blobby_memtable_inactive%s %d\n", labels, len(ms.Inactive))
+
+	// only when there's something to flush, so the absence can't be mistaken
+	// for a record from 1970.
+	if !ms.Oldest.IsZero() {
+		fmt.Fprintln(w, "# HELP blobby_memtable_oldest_timestamp_seconds Timestamp of the oldest record which hasn't been flushed.")
+		fmt.Fprintln(w, "# TYPE blobby_memtable_oldest_timestamp_seconds gauge")
+		fmt.Fprintf(w, "blobby_memtable_oldest_timestamp_seconds%s %g\n", labels, float64(ms.Oldest.UnixMilli())/1000)
+	}
+
+	fmt.Fprintln(w, "# HELP blobby_memtable_flush_lag_seconds Age of the oldest record which hasn't been flushed, or zero.")
+	fmt.Fprintln(w, "# TYPE blobby_memtable_flush_lag_seconds gauge")
+	fmt.Fprintf(w, "blobby_memtable_flush_lag_seconds%s %g\n", labels, ms.Lag.Seconds())
+}
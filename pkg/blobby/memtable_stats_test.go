@@ -0,0 +1,76 @@
+package blobby
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemtableStats(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	ms, err := b.MemtableStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ms.Records)
+	assert.Zero(t, ms.Oldest)
+	assert.Zero(t, ms.Lag)
+	assert.NotEmpty(t, ms.Active)
+	assert.Empty(t, ms.Inactive)
+
+	t1 := c.Now()
+	_, err = b.Put(ctx, "a", []byte("aaaa"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "b", []byte("bbbb"))
+	require.NoError(t, err)
+	c.Advance(time.Minute)
+
+	ms, err = b.MemtableStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, ms.Records)
+	assert.Positive(t, ms.Bytes)
+	assert.True(t, t1.Equal(ms.Oldest))
+	assert.Equal(t, time.Minute+time.Second, ms.Lag)
+
+	active := ms.Active
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	ms, err = b.MemtableStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ms.Records)
+	assert.Zero(t, ms.Lag)
+	assert.NotEqual(t, active, ms.Active)
+	assert.Empty(t, ms.Inactive)
+}
+
+func TestWriteMemtableMetrics(t *testing.T) {
+	var sb strings.Builder
+	writeMemtableMetrics(&sb, "test", &MemtableStats{
+		Records:  3,
+		Bytes:    100,
+		Oldest:   time.UnixMilli(1736476581500),
+		Lag:      90 * time.Second,
+		Active:   "mt_2",
+		Inactive: []string{"mt_1"},
+	})
+
+	out := sb.String()
+	assert.Contains(t, out, "# TYPE blobby_memtable_records gauge\n")
+	assert.Contains(t, out, `blobby_memtable_records{archive="test"} 3`+"\n")
+	assert.Contains(t, out, `blobby_memtable_bytes{archive="test"} 100`+"\n")
+	assert.Contains(t, out, `blobby_memtable_inactive{archive="test"} 1`+"\n")
+	assert.Contains(t, out, `blobby_memtable_oldest_timestamp_seconds{archive="test"} 1.7364765815e+09`+"\n")
+	assert.Contains(t, out, `blobby_memtable_flush_lag_seconds{archive="test"} 90`+"\n")
+
+	// the oldest timestamp is omitted when there's nothing to flush.
+	sb.Reset()
+	writeMemtableMetrics(&sb, "test", &MemtableStats{Active: "mt_2"})
+	assert.NotContains(t, sb.String(), "blobby_memtable_oldest_timestamp_seconds")
+	assert.Contains(t, sb.String(), `blobby_memtable_flush_lag_seconds{archive="test"} 0`+"\n")
+}
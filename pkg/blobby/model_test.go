@@ -0,0 +1,137 @@
+package blobby
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	modelSeed = flag.Int64("modelseed", 0, "seed for TestModel; zero picks one")
+	modelOps  = flag.Int("modelops", 500, "number of operations for TestModel")
+	modelKeys = flag.Int("modelkeys", 20, "number of distinct keys for TestModel")
+)
+
+// model is a trivial reference implementation of the archive: every version of
+// every key, in the order they were written. Anything the archive returns which
+// disagrees with it is a bug in the archive.
+type model struct {
+	versions map[string][]modelVersion
+}
+
+type modelVersion struct {
+	ts    time.Time
+	value []byte
+}
+
+func (m *model) put(key string, ts time.Time, value []byte) {
+	m.versions[key] = append(m.versions[key], modelVersion{ts: ts, value: value})
+}
+
+// get returns the newest value of the given key, or nil.
+func (m *model) get(key string) []byte {
+	vs := m.versions[key]
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[len(vs)-1].value
+}
+
+// TestModel applies a random sequence of operations to an archive, comparing
+// every read against the model. Failures are reproducible by passing the seed
+// which is logged to -modelseed.
+func TestModel(t *testing.T) {
+	seed := *modelSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed: %d", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	runModel(t, ctx, b, c, r, *modelOps, *modelKeys)
+}
+
+// runModel performs n random operations on the given archive, which must be
+// empty, and checks the results against a model. Every write is given a unique
+// timestamp by advancing the clock, so the expected order is never ambiguous.
+// Occasionally the clock jumps ahead further, so records spread across more
+// than one time range.
+func runModel(t *testing.T, ctx context.Context, b *Blobby, c *clockwork.FakeClock, r *rand.Rand, n, keys int) {
+	m := &model{versions: map[string][]modelVersion{}}
+	var log []string
+
+	// on failure, dump the ops leading up to it, which is usually enough to
+	// see what went wrong without rerunning.
+	defer func() {
+		if t.Failed() {
+			t.Logf("ops:\n%s", strings.Join(log, "\n"))
+		}
+	}()
+
+	for i := range n {
+		key := fmt.Sprintf("key-%03d", r.Intn(keys))
+		p := r.Intn(100)
+
+		switch {
+		case p < 40:
+			val := fmt.Appendf(nil, "%s-v%d", key, i)
+			_, err := b.Put(ctx, key, val)
+			require.NoError(t, err, "op %d: put %s", i, key)
+			m.put(key, c.Now(), val)
+			log = append(log, fmt.Sprintf("%d: put %s=%s", i, key, val))
+
+		case p < 80:
+			actual, stats, err := b.Get(ctx, key)
+			require.NoError(t, err, "op %d: get %s", i, key)
+			require.Equal(t, string(m.get(key)), string(actual),
+				"op %d: get %s from %s", i, key, stats.Source)
+			log = append(log, fmt.Sprintf("%d: get %s", i, key))
+
+		case p < 88:
+			recs, err := b.GetVersionsBetween(ctx, key, time.Time{}, time.Time{})
+			require.NoError(t, err, "op %d: versions %s", i, key)
+			expected := m.versions[key]
+			require.Len(t, recs, len(expected), "op %d: versions %s", i, key)
+			for j, rec := range recs {
+				v := expected[len(expected)-1-j]
+				require.True(t, v.ts.Equal(rec.Timestamp), "op %d: versions %s[%d]", i, key, j)
+				require.Equal(t, string(v.value), string(rec.Document), "op %d: versions %s[%d]", i, key, j)
+			}
+			log = append(log, fmt.Sprintf("%d: versions %s", i, key))
+
+		case p < 95:
+			_, err := b.Flush(ctx, FlushOptions{})
+			require.NoError(t, err, "op %d: flush", i)
+			log = append(log, fmt.Sprintf("%d: flush", i))
+
+		case p < 98:
+			_, err := b.Compact(ctx, CompactionOptions{})
+			require.NoError(t, err, "op %d: compact", i)
+			log = append(log, fmt.Sprintf("%d: compact", i))
+
+		default:
+			d := time.Duration(r.Intn(3600)) * time.Second
+			c.Advance(d)
+			log = append(log, fmt.Sprintf("%d: skip %s", i, d))
+		}
+
+		// BSON only stores milliseconds, so that's the smallest step which
+		// keeps timestamps (and sstable names) unique.
+		c.Advance(time.Millisecond)
+	}
+
+	for key := range m.versions {
+		actual, _, err := b.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, string(m.get(key)), string(actual), "final get %s", key)
+	}
+}
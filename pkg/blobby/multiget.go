@@ -0,0 +1,190 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"golang.org/x/sync/errgroup"
+)
+
+// GetMulti returns the newest version of each of the given keys, with its
+// document decoded, by key. Keys which don't exist are missing from the map.
+//
+// Every key is read as of the same moment, from the same snapshot of the
+// metadata, so a write or flush which lands during the call can't make some
+// keys look newer than others: versions written after the call started are
+// ignored, in favor of the version before. Up to DefaultScanConcurrency keys
+// are fetched from the blobstore at once.
+func (b *Blobby) GetMulti(ctx context.Context, keys []string) (map[string]*Record, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	keys = uniqueKeys(keys)
+
+	err := b.admitGets(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.getAsOf(ctx, keys, b.clock.Now())
+}
+
+// uniqueKeys returns a sorted copy of the given keys, without duplicates.
+func uniqueKeys(keys []string) []string {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// admitGets checks that the caller is allowed to get each of the given keys,
+// and has the quota to.
+func (b *Blobby) admitGets(ctx context.Context, keys []string) error {
+	for _, k := range keys {
+		err := b.authorize(ctx, MethodGet, k)
+		if err != nil {
+			return err
+		}
+
+		err = b.admit(ctx, MethodGet, k, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getAsOf returns the newest version of each of the given keys, which must be
+// sorted and unique, which wasn't written after the given time. See GetMulti.
+func (b *Blobby) getAsOf(ctx context.Context, keys []string, at time.Time) (map[string]*Record, error) {
+	out := map[string]*Record{}
+	if len(keys) == 0 {
+		return out, nil
+	}
+
+	opts := ScanOptions{At: at}
+
+	// like Scan, the memtables are read before the metadata, so records which
+	// are flushed during the call are seen at least once.
+	for _, k := range keys {
+		recs, err := b.mt.GetAll(ctx, k, time.Time{}, at.Add(time.Nanosecond))
+		if err != nil {
+			return nil, fmt.Errorf("memtable.GetAll: %w", err)
+		}
+
+		if rec := newestOf(recs); rec != nil {
+			out[k] = rec
+		}
+	}
+
+	// one query for every key, rather than one each, so they're all read from
+	// the same snapshot of the live set. the sstables are checked even for the
+	// keys found in the memtables, since they can hold newer versions, like in
+	// get, but most are skipped by their MaxTime.
+	metas, err := b.md.GetOverlapping(ctx, keys[0], keys[len(keys)-1]+"\x00")
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetOverlapping: %w", err)
+	}
+
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(DefaultScanConcurrency)
+
+	for _, k := range keys {
+		newest := out[k]
+		g.Go(func() error {
+			rec, err := b.findAsOf(gctx, metas, k, &opts, newest)
+			if err != nil || rec == nil {
+				return err
+			}
+
+			mu.Lock()
+			out[k] = rec
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	err = g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range out {
+		var err error
+		rec.Document, err = b.decode(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// findAsOf returns the newest record with the given key which wasn't written
+// after opts.At, from whichever of the given sstables contain it, if it's newer
+// than the given record from the memtables (which may be nil), or nil if there
+// isn't one. Like findNewest, versions with the same timestamp are ordered by
+// sequence number, and the memtables win ties. The sstables must be in the
+// order of GetContaining. The document is not decoded.
+func (b *Blobby) findAsOf(ctx context.Context, metas []*sstable.Meta, key string, opts *ScanOptions, memtable *Record) (*Record, error) {
+	var newest *Record
+	var newestIn *sstable.Meta
+
+	for _, m := range metas {
+
+		// sorted by MaxTime, so the rest can only contain older versions.
+		if newest != nil && m.MaxTime.Before(newest.Timestamp) {
+			break
+		}
+		if memtable != nil && !m.MaxTime.After(memtable.Timestamp) {
+			break
+		}
+
+		if key < m.MinKey || key > m.MaxKey || m.MinTime.After(opts.At) {
+			continue
+		}
+
+		recs, bstats, err := b.bs.FindAll(ctx, m, key)
+		if err != nil {
+			return nil, fmt.Errorf("blobstore.FindAll(%s): %w", m.Filename(), err)
+		}
+		if !bstats.Filtered {
+			b.recordAccess(m)
+		}
+
+		// newest first, so only the first which isn't too new matters.
+		for _, rec := range recs {
+			if opts.after(rec) {
+				continue
+			}
+
+			if newest == nil || rec.Timestamp.After(newest.Timestamp) ||
+				(rec.Timestamp.Equal(newest.Timestamp) && m.LargestSeq > newestIn.LargestSeq) {
+				newest, newestIn = rec, m
+			}
+			break
+		}
+	}
+
+	if newest == nil || (memtable != nil && !newest.Timestamp.After(memtable.Timestamp)) {
+		return nil, nil
+	}
+
+	return newest, nil
+}
+
+// newestOf returns the record with the newest timestamp, or nil if there are
+// none.
+func newestOf(recs []*Record) *Record {
+	var out *Record
+	for _, rec := range recs {
+		if out == nil || rec.Timestamp.After(out.Timestamp) {
+			out = rec
+		}
+	}
+	return out
+}
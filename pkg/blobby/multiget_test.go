@@ -0,0 +1,57 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMulti(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	tb.put("b", []byte("b1"))
+	c.Advance(time.Second)
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	tb.put("b", []byte("b2"))
+	tb.put("c", []byte("c2"))
+	c.Advance(time.Second)
+
+	docs := func(m map[string]*Record) map[string]string {
+		out := map[string]string{}
+		for k, rec := range m {
+			out[k] = string(rec.Document)
+		}
+		return out
+	}
+
+	got, err := b.GetMulti(ctx, []string{"c", "a", "b", "a", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "a1", "b": "b2", "c": "c2"}, docs(got))
+
+	// versions from the future (as far as this call is concerned) are ignored,
+	// whether they're in the memtable or were flushed to an sstable.
+	future := c.Now().Add(time.Hour)
+	_, err = b.PutBatch(ctx, []*Record{
+		{Key: "a", Timestamp: future, Document: []byte("a3")},
+		{Key: "c", Timestamp: future, Document: []byte("c3")},
+	})
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	got, err = b.GetMulti(ctx, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "a1", "b": "b2", "c": "c2"}, docs(got))
+
+	got, err = b.GetMulti(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
@@ -0,0 +1,74 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+type NamespaceConfig = metadata.NamespaceConfig
+
+// SetNamespace creates or replaces the config of the namespace with the given
+// prefix. It's stored in the metadata, so applies to every process using the
+// archive, but other processes only see it after they call RefreshNamespaces
+// (or Open). Compactions always use the latest config.
+func (b *Blobby) SetNamespace(ctx context.Context, cfg *NamespaceConfig) error {
+	if cfg.Codec != "" {
+		_, err := b.codecs.Lookup(cfg.Codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.md.PutNamespace(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("metadata.PutNamespace: %w", err)
+	}
+
+	return b.RefreshNamespaces(ctx)
+}
+
+// DeleteNamespace removes the config of the namespace with the given prefix, so
+// its keys revert to the archive defaults.
+func (b *Blobby) DeleteNamespace(ctx context.Context, prefix string) error {
+	err := b.md.DeleteNamespace(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("metadata.DeleteNamespace: %w", err)
+	}
+
+	return b.RefreshNamespaces(ctx)
+}
+
+// Namespaces returns the config of every namespace, sorted by prefix, as of the
+// last refresh.
+func (b *Blobby) Namespaces() []*NamespaceConfig {
+	ns := b.namespaces.Load()
+	if ns == nil {
+		return nil
+	}
+
+	return *ns
+}
+
+// RefreshNamespaces reloads the namespace configs from the metadata.
+func (b *Blobby) RefreshNamespaces(ctx context.Context) error {
+	ns, err := b.md.GetNamespaces(ctx)
+	if err != nil {
+		return fmt.Errorf("metadata.GetNamespaces: %w", err)
+	}
+
+	b.namespaces.Store(&ns)
+	return nil
+}
+
+// namespace returns the config of the namespace which the given key belongs to,
+// or nil if there isn't one.
+func (b *Blobby) namespace(key string) *NamespaceConfig {
+	ns := b.namespaces.Load()
+	if ns == nil {
+		return nil
+	}
+
+	return ns.For(key)
+}
@@ -0,0 +1,112 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaces(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second)
+	c := clockwork.NewFakeClockAt(t0)
+	ctx, _, b := setup(t, c)
+
+	err := b.SetNamespace(ctx, &NamespaceConfig{Prefix: "z/", Codec: "nope"})
+	require.Error(t, err)
+
+	require.NoError(t, b.SetNamespace(ctx, &NamespaceConfig{Prefix: "z/", Codec: "gzip"}))
+	require.NoError(t, b.SetNamespace(ctx, &NamespaceConfig{Prefix: "short/", MaxVersions: 2}))
+	require.NoError(t, b.SetNamespace(ctx, &NamespaceConfig{Prefix: "old/", Retention: 150 * time.Minute}))
+	assert.Len(t, b.Namespaces(), 3)
+
+	// values are encoded with the codec of their namespace.
+	_, err = b.Put(ctx, "z/k", []byte("zzz"))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "a", []byte("aaa"))
+	require.NoError(t, err)
+	rec, _, err := b.get(ctx, "z/k", SourceAll)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", rec.Codec)
+	assert.Equal(t, []byte("zzz"), rec.Document)
+	rec, _, err = b.get(ctx, "a", SourceAll)
+	require.NoError(t, err)
+	assert.Equal(t, "", rec.Codec)
+
+	// four versions of some keys, an hour apart, in separate sstables.
+	for i := 0; i < 4; i++ {
+		for _, k := range []string{"short/k", "old/k", "other"} {
+			_, err := b.Put(ctx, k, []byte{byte('a' + i)})
+			require.NoError(t, err)
+		}
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Hour)
+	}
+
+	stats, err := b.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.NoError(t, stats[0].Error)
+	assert.Equal(t, 2+2, stats[0].Dropped)
+
+	versions := func(key string) string {
+		recs, err := b.GetVersionsBetween(ctx, key, time.Time{}, time.Time{})
+		require.NoError(t, err)
+		s := ""
+		for _, r := range recs {
+			s += string(r.Document)
+		}
+		return s
+	}
+
+	assert.Equal(t, "dc", versions("short/k"))
+	assert.Equal(t, "dc", versions("old/k")) // c is 2h old, and b is 3h old.
+	assert.Equal(t, "dcba", versions("other"))
+}
+
+func TestNamespaceTTL(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second)
+	c := clockwork.NewFakeClockAt(t0)
+	ctx, _, b := setup(t, c)
+
+	require.NoError(t, b.SetNamespace(ctx, &NamespaceConfig{Prefix: "cache/", TTL: 10 * time.Minute}))
+
+	_, err := b.Put(ctx, "cache/old", []byte("a"))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "other", []byte("b"))
+	require.NoError(t, err)
+	c.Advance(11 * time.Minute)
+	_, err = b.Put(ctx, "cache/new", []byte("c"))
+	require.NoError(t, err)
+
+	// the expired record is skipped, but the unexpired one is kept.
+	stats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, stats.Meta)
+	assert.Equal(t, 2, stats.Meta.Count)
+
+	val, _, err := b.Get(ctx, "cache/old")
+	require.NoError(t, err)
+	assert.Nil(t, val)
+	val, _, err = b.Get(ctx, "cache/new")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("c"), val)
+
+	// when every record has expired, the memtable is dropped without writing
+	// an sstable.
+	_, err = b.Put(ctx, "cache/gone", []byte("d"))
+	require.NoError(t, err)
+	c.Advance(11 * time.Minute)
+	stats, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	assert.False(t, stats.Skipped)
+	assert.Nil(t, stats.Meta)
+	assert.NotEmpty(t, stats.FlushedMemtable)
+
+	val, _, err = b.Get(ctx, "cache/gone")
+	require.NoError(t, err)
+	assert.Nil(t, val)
+}
@@ -0,0 +1,170 @@
+package blobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// publishTimeout is how long each attempt to publish a notification can take.
+const publishTimeout = 10 * time.Second
+
+// Publisher sends notifications about events to some external system, so that
+// it can learn about new sstables as they land. See the notify package for
+// implementations which post to a webhook or an SNS topic.
+type Publisher interface {
+	// Publish sends the given notification, which is JSON-encoded.
+	Publish(ctx context.Context, body []byte) error
+}
+
+type publisher struct {
+	p     Publisher
+	types []EventType
+}
+
+// WithPublisher sends a notification of every event of the given types (or of
+// every type, if none are given) to the given publisher, while RunPublishers is
+// running. It can be given more than once.
+func WithPublisher(p Publisher, types ...EventType) Option {
+	return func(b *Blobby) {
+		b.publishers = append(b.publishers, publisher{p: p, types: types})
+	}
+}
+
+// Notification is the JSON-friendly form of an Event, which is sent to each
+// Publisher.
+type Notification struct {
+	Archive string    `json:"archive"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Caller  string    `json:"caller,omitempty"`
+
+	Created []NotifiedSSTable `json:"created,omitempty"`
+	Removed []NotifiedSSTable `json:"removed,omitempty"`
+	Leased  []NotifiedSSTable `json:"leased,omitempty"`
+
+	Owner    string `json:"owner,omitempty"`
+	Election string `json:"election,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NotifiedSSTable describes an sstable in a Notification.
+type NotifiedSSTable struct {
+	URL      string    `json:"url"`
+	Filename string    `json:"filename"`
+	MinKey   string    `json:"min_key"`
+	MaxKey   string    `json:"max_key"`
+	MinTime  time.Time `json:"min_time"`
+	MaxTime  time.Time `json:"max_time"`
+	Count    int       `json:"count"`
+	Size     int       `json:"size"`
+}
+
+// notification returns the notification of the given event.
+func (b *Blobby) notification(e *Event) *Notification {
+	n := &Notification{
+		Archive:  b.name,
+		Type:     e.Type,
+		Time:     e.Time,
+		Caller:   e.Caller,
+		Created:  b.notifiedSSTables(e.Created),
+		Removed:  b.notifiedSSTables(e.Removed),
+		Leased:   b.notifiedSSTables(e.Leased),
+		Owner:    e.Owner,
+		Election: e.Election,
+	}
+
+	if e.Error != nil {
+		n.Error = e.Error.Error()
+	}
+
+	return n
+}
+
+func (b *Blobby) notifiedSSTables(metas []*sstable.Meta) []NotifiedSSTable {
+	var out []NotifiedSSTable
+	for _, m := range metas {
+		bkt := m.Bucket
+		if bkt == "" {
+			bkt = b.bucket
+		}
+
+		out = append(out, NotifiedSSTable{
+			URL:      fmt.Sprintf("s3://%s/%s", bkt, m.Filename()),
+			Filename: m.Filename(),
+			MinKey:   m.MinKey,
+			MaxKey:   m.MaxKey,
+			MinTime:  m.MinTime,
+			MaxTime:  m.MaxTime,
+			Count:    m.Count,
+			Size:     m.Size,
+		})
+	}
+	return out
+}
+
+// RunPublishers sends a notification of each event emitted by this archive to
+// the publishers given by WithPublisher, until the context is cancelled. Events
+// emitted before it subscribes are missed; use PublishEvents to subscribe first.
+func (b *Blobby) RunPublishers(ctx context.Context, onError func(error)) error {
+	return b.PublishEvents(ctx, b.Events(ctx), onError)
+}
+
+// PublishEvents sends a notification of each event received from the given
+// channel, which should come from Events, to the publishers given by
+// WithPublisher, until it's closed. Events already waiting when that happens
+// are still published, so a short-lived process can cancel the subscription
+// and wait for this to return before exiting, without losing any.
+//
+// Each notification is sent at most once. Errors are passed to onError (if it's
+// non-nil) rather than stopping the loop. Like any subscriber to Events, events
+// are dropped if publishing falls too far behind.
+func (b *Blobby) PublishEvents(ctx context.Context, events <-chan Event, onError func(error)) error {
+	// publish with a context which outlives ctx, so the events which were
+	// waiting when it was cancelled can still be sent.
+	pctx := context.WithoutCancel(ctx)
+
+	for e := range events {
+		err := b.publish(pctx, &e)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	return nil
+}
+
+// publish sends a notification of the given event to every publisher which
+// wants it, and returns the errors from any which failed.
+func (b *Blobby) publish(ctx context.Context, e *Event) error {
+	var body []byte
+	var errs []error
+
+	for i, p := range b.publishers {
+		if len(p.types) > 0 && !slices.Contains(p.types, e.Type) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			body, err = json.Marshal(b.notification(e))
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		err := p.p.Publish(pctx, body)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("publisher %d: %s event: %w", i, e.Type, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package blobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	bodies [][]byte
+	err    error
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, body []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bodies = append(p.bodies, body)
+	return p.err
+}
+
+func TestPublishEvents(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Date(2025, 1, 10, 3, 0, 0, 0, time.UTC))
+	all := &fakePublisher{}
+	flushes := &fakePublisher{}
+	broken := &fakePublisher{err: errors.New("nope")}
+
+	b := New("mongodb://unused", "bucket-a", c,
+		WithName("test"),
+		WithPublisher(all),
+		WithPublisher(flushes, EventFlush),
+		WithPublisher(broken, EventPurge))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := b.Events(ctx)
+
+	m := &sstable.Meta{MinKey: "a", MaxKey: "b", Count: 2, Size: 100, Created: c.Now()}
+	m2 := &sstable.Meta{MinKey: "c", MaxKey: "c", Count: 1, Size: 50, Created: c.Now(), Bucket: "bucket-b"}
+	b.emit(WithCaller(ctx, "adam"), Event{Type: EventFlush, Created: []*sstable.Meta{m, m2}})
+	b.emit(ctx, Event{Type: EventPurge, Removed: []*sstable.Meta{m}})
+
+	// the events are already waiting, so are still published after the
+	// subscription is cancelled.
+	cancel()
+
+	var errs []error
+	err := b.PublishEvents(ctx, ch, func(err error) { errs = append(errs, err) })
+	require.NoError(t, err)
+
+	require.Len(t, all.bodies, 2)
+	require.Len(t, flushes.bodies, 1)
+	require.Len(t, broken.bodies, 1)
+	require.Len(t, errs, 1)
+	assert.ErrorContains(t, errs[0], "purge event: nope")
+
+	n := &Notification{}
+	require.NoError(t, json.Unmarshal(flushes.bodies[0], n))
+	assert.Equal(t, &Notification{
+		Archive: "test",
+		Type:    EventFlush,
+		Time:    c.Now(),
+		Caller:  "adam",
+		Created: []NotifiedSSTable{
+			{
+				URL:      "s3://bucket-a/" + m.Filename(),
+				Filename: m.Filename(),
+				MinKey:   "a",
+				MaxKey:   "b",
+				Count:    2,
+				Size:     100,
+			},
+			{
+				URL:      "s3://bucket-b/" + m2.Filename(),
+				Filename: m2.Filename(),
+				MinKey:   "c",
+				MaxKey:   "c",
+				Count:    1,
+				Size:     50,
+			},
+		},
+	}, n)
+}
@@ -0,0 +1,62 @@
+package blobby
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxGetFetches(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+	b.maxGetFetches = 2
+
+	// three overlapping sstables, with k only in the oldest.
+	for _, keys := range [][]string{{"a", "k", "z"}, {"a", "z"}, {"a", "z"}} {
+		for _, k := range keys {
+			tb.put(k, []byte(k))
+			c.Advance(1 * time.Second)
+		}
+		_, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+
+	// drop the indexes, so the filters can't rule anything out.
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+	for _, m := range metas {
+		require.NoError(t, b.bs.DeleteIndex(ctx, m))
+		m.Index = ""
+		require.NoError(t, b.md.SetIndex(ctx, m))
+	}
+
+	// the newest sstable is within the limit.
+	val, stats, err := b.Get(ctx, "z")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("z"), val)
+	assert.Equal(t, 1, stats.BlobsFetched)
+
+	// but k would need all three.
+	_, stats, err = b.Get(ctx, "k")
+	require.ErrorIs(t, err, ErrTooManyOverlaps)
+	assert.Equal(t, 2, stats.BlobsFetched)
+
+	var tmo *TooManyOverlaps
+	require.True(t, errors.As(err, &tmo))
+	assert.Equal(t, "k", tmo.Key)
+	assert.Equal(t, 2, tmo.Limit)
+	assert.Len(t, tmo.Candidates, 3)
+
+	// compaction fixes it.
+	_, err = b.Compact(ctx, CompactionOptions{})
+	require.NoError(t, err)
+	val, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("k"), val)
+}
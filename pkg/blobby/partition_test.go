@@ -0,0 +1,55 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionByPrefix(t *testing.T) {
+	p := PartitionByPrefix("/")
+	assert.Equal(t, "acme/", p("acme/123"))
+	assert.Equal(t, "acme/", p("acme/x/y"))
+	assert.Equal(t, "", p("plain"))
+	assert.Equal(t, "/", p("/leading"))
+}
+
+func TestFlushPartitioned(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+	b.flushPartitioner = PartitionByPrefix("/")
+
+	for _, k := range []string{"b/1", "a/2", "a/1", "c/1", "b/2"} {
+		tb.put(k, []byte(k))
+		c.Advance(1 * time.Second)
+	}
+
+	stats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	require.Len(t, stats.Outputs, 3)
+	assert.Equal(t, stats.Outputs[0], stats.Meta)
+
+	var ranges [][2]string
+	for _, m := range stats.Outputs {
+		ranges = append(ranges, [2]string{m.MinKey, m.MaxKey})
+	}
+	assert.Equal(t, [][2]string{{"a/1", "a/2"}, {"b/1", "b/2"}, {"c/1", "c/1"}}, ranges)
+
+	// the sequence numbers are contiguous across the outputs.
+	assert.Equal(t, stats.Outputs[0].LargestSeq+1, stats.Outputs[1].SmallestSeq)
+	assert.Equal(t, stats.Outputs[1].LargestSeq+1, stats.Outputs[2].SmallestSeq)
+
+	// each key is only in the sstable of its partition, so gets fetch one.
+	metas, err := b.md.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metas, 3)
+
+	val, gs, err := b.Get(ctx, "b/2")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b/2"), val)
+	assert.Equal(t, 1, gs.BlobsFetched)
+}
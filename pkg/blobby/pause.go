@@ -0,0 +1,73 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+// TaskFlush is Flush, which can be paused but not confined to maintenance
+// windows.
+const TaskFlush = metadata.TaskFlush
+
+// ErrPaused is returned by tasks which were called while paused, without doing
+// anything. See Pause.
+var ErrPaused = errors.New("paused")
+
+// Pause stops the given task (TaskFlush, TaskCompaction, or TaskGC) from
+// starting until Resume is called, e.g. to quiesce the archive during an
+// incident. It's stored in the metadata, so applies to every process using the
+// archive, and survives restarts. Tasks which are already running aren't
+// interrupted.
+//
+// While flushes are paused, writes accumulate in the memtables, so don't leave
+// them paused for long.
+func (b *Blobby) Pause(ctx context.Context, task string) error {
+	err := b.md.SetPaused(ctx, task, true)
+	if err != nil {
+		return fmt.Errorf("metadata.SetPaused: %w", err)
+	}
+
+	_, err = b.Paused(ctx)
+	return err
+}
+
+// Resume undoes Pause.
+func (b *Blobby) Resume(ctx context.Context, task string) error {
+	err := b.md.SetPaused(ctx, task, false)
+	if err != nil {
+		return fmt.Errorf("metadata.SetPaused: %w", err)
+	}
+
+	_, err = b.Paused(ctx)
+	return err
+}
+
+// Paused returns the tasks which are paused, sorted by name.
+func (b *Blobby) Paused(ctx context.Context) ([]string, error) {
+	tasks, err := b.md.Paused(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.Paused: %w", err)
+	}
+
+	b.paused.Store(&tasks)
+	return tasks, nil
+}
+
+// checkTask returns ErrPaused if the given task is paused, or
+// ErrOutsideMaintenanceWindow if it isn't allowed to run now.
+func (b *Blobby) checkTask(ctx context.Context, task string) error {
+	paused, err := b.Paused(ctx)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(paused, task) {
+		return fmt.Errorf("%w: %s", ErrPaused, task)
+	}
+
+	return b.checkMaintenance(ctx, task)
+}
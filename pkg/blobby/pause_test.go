@@ -0,0 +1,50 @@
+package blobby
+
+import (
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPause(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	ctx, _, b := setup(t, c)
+
+	_, err := b.Put(ctx, "a", []byte("a"))
+	require.NoError(t, err)
+
+	require.NoError(t, b.Pause(ctx, TaskFlush))
+	require.NoError(t, b.Pause(ctx, TaskCompaction))
+	require.NoError(t, b.Pause(ctx, TaskGC))
+	require.NoError(t, b.Pause(ctx, TaskGC), "pausing twice is fine")
+	assert.Equal(t, []string{TaskCompaction, TaskFlush, TaskGC}, b.Stats().Paused)
+
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.ErrorIs(t, err, ErrPaused)
+	_, err = b.Compact(ctx, CompactionOptions{})
+	require.ErrorIs(t, err, ErrPaused)
+	_, err = b.Purge(ctx, 0)
+	require.ErrorIs(t, err, ErrPaused)
+	_, err = b.Reconcile(ctx, ReconcileOptions{DeleteOrphans: true})
+	require.ErrorIs(t, err, ErrPaused)
+
+	// reads and writes carry on.
+	_, err = b.Put(ctx, "b", []byte("b"))
+	require.NoError(t, err)
+	_, _, err = b.Get(ctx, "a")
+	require.NoError(t, err)
+
+	require.NoError(t, b.Resume(ctx, TaskFlush))
+	stats, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	assert.False(t, stats.Skipped)
+
+	paused, err := b.Paused(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TaskCompaction, TaskGC}, paused)
+
+	err = b.Pause(ctx, "tiering")
+	assert.Error(t, err)
+}
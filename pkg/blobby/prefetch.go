@@ -0,0 +1,121 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"golang.org/x/sync/errgroup"
+)
+
+// PrefetchConcurrency is the number of sstables which Prefetch and PrefetchRange
+// fetch at once.
+const PrefetchConcurrency = 8
+
+type PrefetchStats struct {
+	// The number of sstables which might contain the keys.
+	SSTables int
+
+	// The number of those which were skipped, because their filter ruled out
+	// every key.
+	Filtered int
+
+	// The number of sstables which are now in the blob cache. This is always
+	// zero without WithBlobCache, since only indexes can be prefetched.
+	Cached int
+}
+
+// Prefetch warms the caches for the given keys, by loading the indexes of the
+// sstables which might contain them, and the sstables themselves if there's a
+// blob cache (see WithBlobCache). The values aren't returned, and the memtable
+// isn't touched. It's meant for callers which know which keys they'll read
+// ahead of time, and want those reads to be fast; run it in its own goroutine to
+// warm the caches in the background.
+func (b *Blobby) Prefetch(ctx context.Context, keys []string) (*PrefetchStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	// sstables which might contain more than one of the keys are only fetched
+	// once, if any of the keys pass the filter.
+	var order []*sstable.Meta
+	byFile := map[string][]string{}
+
+	for _, key := range keys {
+		metas, err := b.getContaining(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range metas {
+			fn := m.Filename()
+			if _, ok := byFile[fn]; !ok {
+				order = append(order, m)
+			}
+			byFile[fn] = append(byFile[fn], key)
+		}
+	}
+
+	return b.prefetch(ctx, order, byFile)
+}
+
+// PrefetchRange is like Prefetch, but warms the caches for every sstable which
+// overlaps the half-open key range [start, end). If end is empty, the range is
+// unbounded.
+func (b *Blobby) PrefetchRange(ctx context.Context, start, end string) (*PrefetchStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	metas, err := b.md.GetOverlapping(ctx, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetOverlapping: %w", err)
+	}
+
+	return b.prefetch(ctx, metas, nil)
+}
+
+// prefetch fetches the given sstables. If keys is non-nil, sstables are skipped
+// unless the filter allows at least one of their keys.
+func (b *Blobby) prefetch(ctx context.Context, metas []*sstable.Meta, keys map[string][]string) (*PrefetchStats, error) {
+	stats := &PrefetchStats{SSTables: len(metas)}
+	var mu sync.Mutex
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(PrefetchConcurrency)
+
+	for _, m := range metas {
+		g.Go(func() error {
+			ks := []string{""}
+			if keys != nil {
+				ks = keys[m.Filename()]
+			}
+
+			// stop at the first key which the filter doesn't rule out.
+			var ps *blobstore.PrefetchStats
+			for _, key := range ks {
+				var err error
+				ps, err = b.bs.Prefetch(ctx, m, key)
+				if err != nil {
+					return fmt.Errorf("blobstore.Prefetch(%s): %w", m.Filename(), err)
+				}
+				if !ps.Filtered {
+					break
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if ps.Filtered {
+				stats.Filtered++
+			}
+			if ps.Cached {
+				stats.Cached++
+			}
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
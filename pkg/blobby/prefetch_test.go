@@ -0,0 +1,43 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, _ := setup(t, c)
+	b := New(env.MongoURL(), env.S3Bucket, c, WithBlobCache(t.TempDir(), 0, blobstore.BlobCacheTrust))
+	require.NoError(t, b.Open(ctx))
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	// two sstables, a-c and m-z.
+	for _, keys := range [][]string{{"a", "c"}, {"m", "z"}} {
+		for _, k := range keys {
+			tb.put(k, []byte(k))
+			c.Advance(1 * time.Second)
+		}
+		_, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+
+	stats, err := b.Prefetch(ctx, []string{"a", "b", "q"})
+	require.NoError(t, err)
+	assert.Equal(t, &PrefetchStats{SSTables: 2, Filtered: 1, Cached: 1}, stats)
+
+	// the get of a is served from the cache.
+	val, _, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), val)
+	assert.Equal(t, int64(1), b.Stats().BlobCache.Hits)
+
+	stats, err = b.PrefetchRange(ctx, "d", "")
+	require.NoError(t, err)
+	assert.Equal(t, &PrefetchStats{SSTables: 1, Cached: 1}, stats)
+}
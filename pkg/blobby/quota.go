@@ -0,0 +1,357 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"golang.org/x/time/rate"
+)
+
+// Quota limits the calls which each caller (see WithCaller) can make to keys
+// starting with Prefix. Callers are limited separately, so calls without a
+// caller share one quota. Zero fields are unlimited.
+type Quota struct {
+	Prefix string
+
+	// The number of Puts or Gets which each caller can make per second, on
+	// average. These are tracked per process. Reads of many keys, like Scan,
+	// count as one Get against every quota whose prefix overlaps their range.
+	PutsPerSecond float64
+	GetsPerSecond float64
+
+	// Burst is the number of calls which can be made at once, above the rate.
+	// The default is one second's worth, or one, whichever is more.
+	Burst int
+
+	// MaxBytes is the total size of the values which each caller can write.
+	// It's tracked in the metadata, so is shared by every process using the
+	// archive. It never goes down, since values are never deleted.
+	MaxBytes int64
+}
+
+// QuotaExceeded is returned by reads and writes which would exceed a quota.
+type QuotaExceeded struct {
+	Caller string
+	Prefix string
+	Limit  string
+}
+
+func (e *QuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded: caller=%q prefix=%q limit=%s", e.Caller, e.Prefix, e.Limit)
+}
+
+func (e *QuotaExceeded) Is(err error) bool {
+	_, ok := err.(*QuotaExceeded)
+	return ok
+}
+
+// WithQuota adds a quota. When a key matches more than one, every one of them
+// must allow the call. Its rates can be changed later by the runtime config.
+// See RuntimeConfig.QuotaRates.
+func WithQuota(q Quota) Option {
+	return func(b *Blobby) {
+		b.quotas = append(b.quotas, q)
+	}
+}
+
+// Usage counts the calls made by one caller against one quota, by this process.
+type Usage struct {
+	Caller string
+	Prefix string
+
+	Puts         int64
+	Gets         int64
+	BytesWritten int64
+	Rejected     int64
+}
+
+type quotaKey struct {
+	quota  int
+	caller string
+}
+
+type quotaState struct {
+	puts  *rate.Limiter
+	gets  *rate.Limiter
+	usage Usage
+}
+
+func newLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	if burst <= 0 {
+		burst = max(1, int(perSecond))
+	}
+
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// state returns the state of the given quota for the given caller, creating it
+// if necessary. The caller must hold quotaMu.
+func (b *Blobby) state(i int, caller string) *quotaState {
+	k := quotaKey{i, caller}
+	st, ok := b.quotaState[k]
+	if !ok {
+		st = &quotaState{usage: Usage{Caller: caller, Prefix: b.quotas[i].Prefix}}
+		st.puts, st.gets = b.limiters(i)
+		b.quotaState[k] = st
+	}
+
+	return st
+}
+
+// admit checks the given call against every quota which applies to it, and
+// returns a QuotaExceeded error if any of them would be exceeded. Otherwise the
+// call is counted against them. The size is the number of bytes being written.
+func (b *Blobby) admit(ctx context.Context, m Method, key string, size int) error {
+	return b.admitMatching(ctx, m, size, func(prefix string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// admitScan is like admit, for a read of the keys in [start, end). It's checked
+// against every quota whose prefix overlaps the range.
+func (b *Blobby) admitScan(ctx context.Context, start, end string) error {
+	return b.admitMatching(ctx, MethodScan, 0, func(prefix string) bool {
+		return prefixOverlaps(prefix, start, end)
+	})
+}
+
+// admitMatching is like admit, for the quotas whose prefix matches.
+func (b *Blobby) admitMatching(ctx context.Context, m Method, size int, match func(prefix string) bool) error {
+	if len(b.quotas) == 0 {
+		return nil
+	}
+
+	caller := callerFrom(ctx)
+	now := b.clock.Now()
+
+	// take a token from each quota in turn. they're reserved rather than just
+	// taken, so they can be given back if a later quota rejects the call, and
+	// the call doesn't count against the quotas which allowed it.
+	b.quotaMu.Lock()
+	var states []*quotaState
+	var tokens []*rate.Reservation
+	var reject *QuotaExceeded
+	for i, q := range b.quotas {
+		if !match(q.Prefix) {
+			continue
+		}
+
+		st := b.state(i, caller)
+		l := st.gets
+		if m == MethodPut {
+			l = st.puts
+		}
+
+		r := l.ReserveN(now, 1)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			st.usage.Rejected++
+			reject = &QuotaExceeded{caller, q.Prefix, limitName(m) + " per second"}
+			break
+		}
+
+		states = append(states, st)
+		tokens = append(tokens, r)
+	}
+	b.quotaMu.Unlock()
+
+	if reject != nil {
+		cancelAt(tokens, now)
+		return reject
+	}
+
+	// reserve the bytes for each quota in turn, and give them back if a later
+	// one is exceeded.
+	var reserved []int
+	if m == MethodPut {
+		for i, q := range b.quotas {
+			if q.MaxBytes == 0 || !match(q.Prefix) {
+				continue
+			}
+
+			ok, err := b.md.AddUsage(ctx, usageID(caller, q.Prefix), int64(size), q.MaxBytes)
+			if err == nil && !ok {
+				err = &QuotaExceeded{caller, q.Prefix, "bytes"}
+			}
+			if err != nil {
+				b.quotaMu.Lock()
+				b.state(i, caller).usage.Rejected++
+				b.quotaMu.Unlock()
+				b.refund(ctx, caller, reserved, size)
+				cancelAt(tokens, now)
+				return err
+			}
+
+			reserved = append(reserved, i)
+		}
+	}
+
+	b.quotaMu.Lock()
+	for _, st := range states {
+		if m == MethodPut {
+			st.usage.Puts++
+			st.usage.BytesWritten += int64(size)
+		} else {
+			st.usage.Gets++
+		}
+	}
+	b.quotaMu.Unlock()
+
+	return nil
+}
+
+// cancelAt gives back the tokens of the given reservations, as of the given
+// time.
+func cancelAt(rs []*rate.Reservation, now time.Time) {
+	for _, r := range rs {
+		r.CancelAt(now)
+	}
+}
+
+// limitName returns the name of the rate limit which applies to the given
+// method, for errors.
+func limitName(m Method) string {
+	if m == MethodPut {
+		return "puts"
+	}
+
+	return "gets"
+}
+
+// prefixOverlaps returns true if any key with the given prefix is in [start,
+// end). An empty end is unbounded.
+func prefixOverlaps(prefix, start, end string) bool {
+	if end != "" && prefix >= end {
+		return false
+	}
+
+	// every key with the prefix is below its successor, so the range overlaps
+	// if start is too. that's the case if start, truncated to the length of
+	// the prefix, is no greater than it.
+	return start[:min(len(start), len(prefix))] <= prefix
+}
+
+// refund gives back the bytes reserved for the given quotas. It's best effort,
+// since it's only called when something else has already failed.
+func (b *Blobby) refund(ctx context.Context, caller string, quotas []int, size int) {
+	for _, i := range quotas {
+		_, _ = b.md.AddUsage(ctx, usageID(caller, b.quotas[i].Prefix), -int64(size), 0)
+	}
+}
+
+// refundPut gives back the bytes reserved by admit for a put of the given key,
+// after the write failed.
+func (b *Blobby) refundPut(ctx context.Context, key string, size int) {
+	var quotas []int
+	for i, q := range b.quotas {
+		if q.MaxBytes != 0 && strings.HasPrefix(key, q.Prefix) {
+			quotas = append(quotas, i)
+		}
+	}
+
+	b.refund(ctx, callerFrom(ctx), quotas, size)
+}
+
+// usageID returns the ID of the usage counter for the given caller and prefix.
+func usageID(caller, prefix string) string {
+	return fmt.Sprintf("%s|%s", caller, prefix)
+}
+
+// QuotaUsage returns the number of bytes which the given caller has written to
+// keys starting with the given prefix, per the MaxBytes quota for that prefix.
+func (b *Blobby) QuotaUsage(ctx context.Context, caller, prefix string) (int64, error) {
+	n, err := b.md.GetUsage(ctx, usageID(caller, prefix))
+	if err != nil {
+		return 0, fmt.Errorf("metadata.GetUsage: %w", err)
+	}
+
+	return n, nil
+}
+
+type Stats struct {
+	// Usage of each quota by each caller, sorted by prefix then caller.
+	Usage []Usage
+
+	// Counters about the cache configured by WithBlobCache.
+	BlobCache blobstore.BlobCacheStats
+
+	// The number of events which weren't delivered to a subscriber of Events,
+	// because it had fallen behind.
+	EventsDropped int64
+
+	// The number of times this process became the leader of an election (see
+	// RunAsLeader) and stopped being it, and the elections it leads now.
+	LeaderAcquired int64
+	LeaderLost     int64
+	Leading        []string
+
+	// The number of gets served from the manifest, because the memtable or
+	// metadata store couldn't be reached. See WithDegradedReads.
+	DegradedGets int64
+
+	// What Open loaded into the caches, or nil if it didn't. See WithWarmup.
+	Warmup *WarmupStats
+
+	// The S3 requests made by each class of operation, and what they cost,
+	// ordered by class. See WithPricing.
+	Costs []*OpCost
+
+	// The paused tasks, as of the last time this process checked. See Pause.
+	Paused []string
+
+	// How far behind each sync run by this process is, by name. See Sync.
+	Syncs []SyncLag
+
+	// The number of gets which were verified, and the number of those which
+	// returned the wrong version. See WithVerifyReads.
+	VerifiedGets   int64
+	ReadMismatches int64
+}
+
+// Stats returns counters about the calls made by this process.
+func (b *Blobby) Stats() *Stats {
+	s := &Stats{
+		BlobCache:     b.bs.BlobCacheStats(),
+		EventsDropped: b.events.dropped.Load(),
+
+		LeaderAcquired: b.leaders.acquired.Load(),
+		LeaderLost:     b.leaders.lost.Load(),
+		Leading:        b.leaders.names(),
+
+		DegradedGets: b.degraded.gets.Load(),
+
+		Warmup: b.warmupStats.Load(),
+		Costs:  b.costs(),
+		Syncs:  b.syncLags(),
+
+		VerifiedGets:   b.verify.verified.Load(),
+		ReadMismatches: b.verify.mismatches.Load(),
+	}
+
+	if p := b.paused.Load(); p != nil {
+		s.Paused = *p
+	}
+
+	b.quotaMu.Lock()
+	for _, st := range b.quotaState {
+		s.Usage = append(s.Usage, st.usage)
+	}
+	b.quotaMu.Unlock()
+
+	sort.Slice(s.Usage, func(i, j int) bool {
+		if s.Usage[i].Prefix != s.Usage[j].Prefix {
+			return s.Usage[i].Prefix < s.Usage[j].Prefix
+		}
+		return s.Usage[i].Caller < s.Usage[j].Caller
+	})
+
+	return s
+}
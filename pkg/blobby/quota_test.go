@@ -0,0 +1,144 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaRate(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClock()
+	b := New("", "", c,
+		WithQuota(Quota{Prefix: "a/", PutsPerSecond: 2}),
+		WithQuota(Quota{GetsPerSecond: 1, Burst: 2}))
+
+	alice := WithCaller(ctx, "alice")
+	bob := WithCaller(ctx, "bob")
+
+	// the burst defaults to one second's worth.
+	require.NoError(t, b.admit(alice, MethodPut, "a/1", 10))
+	require.NoError(t, b.admit(alice, MethodPut, "a/2", 10))
+	err := b.admit(alice, MethodPut, "a/3", 10)
+	require.ErrorIs(t, err, &QuotaExceeded{})
+	var qe *QuotaExceeded
+	require.True(t, errors.As(err, &qe))
+	assert.Equal(t, "alice", qe.Caller)
+	assert.Equal(t, "a/", qe.Prefix)
+
+	// other callers and other prefixes are unaffected.
+	require.NoError(t, b.admit(bob, MethodPut, "a/1", 10))
+	require.NoError(t, b.admit(alice, MethodPut, "b/1", 10))
+
+	// tokens come back over time.
+	c.Advance(500 * time.Millisecond)
+	require.NoError(t, b.admit(alice, MethodPut, "a/3", 10))
+
+	// the catch-all quota only limits gets.
+	require.NoError(t, b.admit(alice, MethodGet, "x", 0))
+	require.NoError(t, b.admit(alice, MethodGet, "x", 0))
+	require.ErrorIs(t, b.admit(alice, MethodGet, "x", 0), &QuotaExceeded{})
+
+	assert.Equal(t, []Usage{
+		{Caller: "alice", Prefix: "", Puts: 4, Gets: 2, BytesWritten: 40, Rejected: 1},
+		{Caller: "bob", Prefix: "", Puts: 1, BytesWritten: 10},
+		{Caller: "alice", Prefix: "a/", Puts: 3, BytesWritten: 30, Rejected: 1},
+		{Caller: "bob", Prefix: "a/", Puts: 1, BytesWritten: 10},
+	}, b.Stats().Usage)
+}
+
+func TestQuotaOverlapping(t *testing.T) {
+	ctx := WithCaller(context.Background(), "alice")
+	b := New("", "", clockwork.NewFakeClock(),
+		WithQuota(Quota{Prefix: "a/", PutsPerSecond: 3}),
+		WithQuota(Quota{Prefix: "a/b/", PutsPerSecond: 1}))
+
+	// the inner quota is exhausted, so it rejects the next puts.
+	require.NoError(t, b.admit(ctx, MethodPut, "a/b/1", 0))
+	for range 5 {
+		require.ErrorIs(t, b.admit(ctx, MethodPut, "a/b/2", 0), &QuotaExceeded{})
+	}
+
+	// but the outer quota got its tokens back each time, so it still has the
+	// rest of them.
+	require.NoError(t, b.admit(ctx, MethodPut, "a/1", 0))
+	require.NoError(t, b.admit(ctx, MethodPut, "a/2", 0))
+	require.ErrorIs(t, b.admit(ctx, MethodPut, "a/3", 0), &QuotaExceeded{})
+
+	assert.Equal(t, []Usage{
+		{Caller: "alice", Prefix: "a/", Puts: 3, Rejected: 1},
+		{Caller: "alice", Prefix: "a/b/", Puts: 1, Rejected: 5},
+	}, b.Stats().Usage)
+}
+
+func TestQuotaScan(t *testing.T) {
+	ctx := WithCaller(context.Background(), "alice")
+	b := New("", "", clockwork.NewFakeClock(),
+		WithQuota(Quota{Prefix: "a/", GetsPerSecond: 1}),
+		WithQuota(Quota{Prefix: "b/", GetsPerSecond: 1}))
+
+	// only the quota which overlaps the range is counted.
+	require.NoError(t, b.admitScan(ctx, "a/", "a0"))
+	require.ErrorIs(t, b.admitScan(ctx, "a/x", ""), &QuotaExceeded{})
+	require.NoError(t, b.admitScan(ctx, "b/", "b/z"))
+
+	// an unbounded scan overlaps both.
+	require.ErrorIs(t, b.admitScan(ctx, "", ""), &QuotaExceeded{})
+}
+
+func TestPrefixOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, start, end string
+		want               bool
+	}{
+		{"a/", "", "", true},
+		{"a/", "a/", "a0", true},
+		{"a/", "a/m", "", true},
+		{"a/", "a", "a/", false},
+		{"a/", "a0", "", false},
+		{"a/", "b", "", false},
+		{"a/", "", "a/", false},
+		{"a/", "", "a/0", true},
+		{"", "x", "y", true},
+	} {
+		got := prefixOverlaps(tc.prefix, tc.start, tc.end)
+		assert.Equal(t, tc.want, got, "prefix=%q start=%q end=%q", tc.prefix, tc.start, tc.end)
+	}
+}
+
+func TestQuotaBytes(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClock()
+	b := New(env.MongoURL(), env.S3Bucket, c, WithQuota(Quota{Prefix: "a/", MaxBytes: 10}))
+	require.NoError(t, b.Init(ctx))
+
+	alice := WithCaller(ctx, "alice")
+
+	_, err := b.Put(alice, "a/1", []byte("123456"))
+	require.NoError(t, err)
+	_, err = b.Put(alice, "a/2", []byte("123456"))
+	require.ErrorIs(t, err, &QuotaExceeded{})
+	_, err = b.Put(alice, "a/2", []byte("1234"))
+	require.NoError(t, err)
+
+	// a batch is all or nothing, including the quota.
+	_, err = b.PutBatch(WithCaller(ctx, "bob"), []*Record{
+		{Key: "a/1", Document: []byte("12345")},
+		{Key: "a/2", Document: []byte("123456")},
+	})
+	require.ErrorIs(t, err, &QuotaExceeded{})
+
+	n, err := b.QuotaUsage(ctx, "alice", "a/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	n, err = b.QuotaUsage(ctx, "bob", "a/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
@@ -0,0 +1,82 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type RebuildStats struct {
+	// The number of sstable blobs found in the bucket.
+	BlobsListed int
+
+	// The number of sstables which were added to the live set.
+	Inserted int
+}
+
+// RebuildMetadata repopulates the live set from the sstables in the blobstore,
+// by reading the Meta from each of their footers (or scanning older ones which
+// don't have footers). Sstables which are already in the live set are skipped,
+// so this can be run after RecoverMetadataFromBlobstore to add anything flushed
+// since the last manifest, or on its own if there's no manifest at all.
+//
+// This can't tell which sstables were superseded by compaction but not yet
+// purged, so they're added back to the live set. That's harmless for reads,
+// since they contain the same records as the sstables which replaced them, but
+// it's best to Purge before running this. Like Reconcile with DeleteOrphans,
+// this is only safe if the bucket contains no other archives. Only the primary
+// bucket is scanned, so sstables placed in other buckets by WithBuckets must be
+// recovered from a manifest.
+func (b *Blobby) RebuildMetadata(ctx context.Context) (*RebuildStats, error) {
+	stats := &RebuildStats{}
+
+	blobs, err := b.bs.List(ctx, "")
+	if err != nil {
+		return stats, fmt.Errorf("blobstore.List: %w", err)
+	}
+
+	err = b.Init(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("Init: %w", err)
+	}
+
+	// the footer doesn't know about the index, which is written alongside.
+	indexes := map[string]bool{}
+	for _, bi := range blobs {
+		if strings.HasSuffix(bi.Key, ".sstable.index") {
+			indexes[bi.Key] = true
+		}
+	}
+
+	for _, bi := range blobs {
+		if !strings.HasSuffix(bi.Key, ".sstable") {
+			continue
+		}
+		stats.BlobsListed++
+
+		m, err := b.bs.ReadMeta(ctx, bi.Key)
+		if err != nil {
+			return stats, fmt.Errorf("blobstore.ReadMeta(%s): %w", bi.Key, err)
+		}
+
+		if indexes[m.IndexFilename()] {
+			m.Index = m.IndexFilename()
+		}
+
+		ok, err := b.md.IsLive(ctx, m)
+		if err != nil {
+			return stats, fmt.Errorf("metadata.IsLive(%s): %w", bi.Key, err)
+		}
+		if ok {
+			continue
+		}
+
+		err = b.md.Insert(ctx, m)
+		if err != nil {
+			return stats, fmt.Errorf("metadata.Insert(%s): %w", bi.Key, err)
+		}
+		stats.Inserted++
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,208 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+)
+
+// defaultMinOrphanAge is the default for ReconcileOptions.MinOrphanAge.
+const defaultMinOrphanAge = 1 * time.Hour
+
+type ReconcileOptions struct {
+	// DeleteOrphans deletes sstable blobs which aren't referenced by the live
+	// set or any checkpoint. Only set this if the bucket is not shared by any
+	// other archive, since their sstables will look like orphans.
+	DeleteOrphans bool
+
+	// MinOrphanAge specifies how old an unreferenced blob must be before it's
+	// considered an orphan. Flushes and compactions upload blobs before adding
+	// them to the metadata, so newer blobs might just be in flight. The default
+	// is one hour.
+	MinOrphanAge time.Duration
+}
+
+type ReconcileStats struct {
+	// The number of sstable blobs found in the bucket.
+	BlobsListed int
+
+	// The number of distinct sstables referenced by the metadata.
+	BlobsReferenced int
+
+	// The keys of blobs which are in the bucket but not referenced by the
+	// metadata. These are wasting space.
+	Orphans []string
+
+	// The keys of blobs which are referenced by the metadata but missing from
+	// the bucket. Reads which need these will fail.
+	Missing []string
+
+	// The number of orphans which were deleted. Only non-zero when the
+	// DeleteOrphans option is set.
+	OrphansDeleted int
+}
+
+// Reconcile compares the sstables in the bucket with those referenced by the
+// metadata (including checkpoints), and reports any drift between them. Orphans
+// are deleted if requested, but missing blobs are only reported. Only the primary
+// bucket is reconciled; sstables placed in other buckets are ignored. Deleting
+// orphans is confined to the maintenance windows of TaskGC, and paused with it.
+func (b *Blobby) Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGC)
+	stats := &ReconcileStats{}
+
+	if opts.DeleteOrphans {
+		err := b.checkTask(ctx, TaskGC)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	minAge := opts.MinOrphanAge
+	if minAge == 0 {
+		minAge = defaultMinOrphanAge
+	}
+
+	// read the metadata before listing, so any sstable flushed in between is
+	// young enough to be excluded from the orphans.
+	refs, err := b.referencedBlobs(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	blobs, err := b.bs.List(ctx, "")
+	if err != nil {
+		return stats, fmt.Errorf("blobstore.List: %w", err)
+	}
+
+	stats.BlobsReferenced = len(refs)
+	stats.BlobsListed, stats.Orphans, stats.Missing = diffInventory(blobs, refs, b.clock.Now().Add(-minAge))
+
+	if opts.DeleteOrphans {
+		for _, key := range stats.Orphans {
+			err = b.bs.Delete(ctx, key)
+			if err != nil {
+				return stats, fmt.Errorf("blobstore.Delete(%s): %w", key, err)
+			}
+			stats.OrphansDeleted++
+		}
+	}
+
+	return stats, nil
+}
+
+// RunReconcile calls Reconcile periodically until the context is cancelled or
+// reconciliation fails, passing the stats from each run to onResult. Runs which
+// would delete orphans outside of the maintenance windows are skipped.
+func (b *Blobby) RunReconcile(ctx context.Context, interval time.Duration, opts ReconcileOptions, onResult func(*ReconcileStats)) error {
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+
+		stats, err := b.Reconcile(ctx, opts)
+		if errors.Is(err, ErrOutsideMaintenanceWindow) || errors.Is(err, ErrPaused) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Reconcile: %w", err)
+		}
+
+		if onResult != nil {
+			onResult(stats)
+		}
+	}
+}
+
+// referencedBlobs returns the set of blob keys in the primary bucket referenced
+// by the live set, by soft-deleted sstables, by pending compactions, or by any
+// checkpoint.
+func (b *Blobby) referencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	// sstables waiting to be purged aren't orphans yet.
+	deleted, err := b.md.GetDeleted(ctx, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetDeleted: %w", err)
+	}
+	metas = append(metas, deleted...)
+
+	// nor are the outputs of compactions which haven't been committed yet,
+	// since RecoverCompactions may roll them forward.
+	pending, err := b.md.GetPendingCompactions(ctx, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetPendingCompactions: %w", err)
+	}
+	for _, p := range pending {
+		metas = append(metas, p.Outputs...)
+	}
+
+	cps, err := b.md.ListCheckpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.ListCheckpoints: %w", err)
+	}
+
+	// only the primary bucket is listed, so ignore sstables which were placed
+	// in other buckets. (see WithBuckets.)
+	refs := map[string]struct{}{}
+	for _, m := range metas {
+		if m.Bucket == "" {
+			refs[m.Filename()] = struct{}{}
+		}
+	}
+	for _, cp := range cps {
+		for _, m := range cp.Metas {
+			if m.Bucket == "" {
+				refs[m.Filename()] = struct{}{}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// diffInventory compares the sstables in the bucket with those referenced by
+// the metadata, and returns the number of sstables listed, the orphans (which
+// were last modified before the cutoff) and the missing blobs, sorted.
+func diffInventory(blobs []blobstore.BlobInfo, refs map[string]struct{}, cutoff time.Time) (int, []string, []string) {
+	var n int
+	var orphans, missing []string
+
+	listed := map[string]struct{}{}
+	for _, bi := range blobs {
+		if !strings.HasSuffix(bi.Key, ".sstable") {
+			continue
+		}
+
+		n++
+		listed[bi.Key] = struct{}{}
+
+		if _, ok := refs[bi.Key]; !ok && bi.LastModified.Before(cutoff) {
+			orphans = append(orphans, bi.Key)
+		}
+	}
+
+	for key := range refs {
+		if _, ok := listed[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	sort.Strings(orphans)
+	sort.Strings(missing)
+
+	return n, orphans, missing
+}
@@ -0,0 +1,47 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffInventory(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	blobs := []blobstore.BlobInfo{
+		{Key: "1.sstable", LastModified: old},
+		{Key: "2.sstable", LastModified: old}, // orphan
+		{Key: "3.sstable", LastModified: now}, // in flight
+		{Key: "README", LastModified: old},    // not an sstable
+	}
+
+	refs := map[string]struct{}{
+		"1.sstable": {},
+		"4.sstable": {}, // missing
+	}
+
+	n, orphans, missing := diffInventory(blobs, refs, now.Add(-1*time.Hour))
+	require.Equal(t, 3, n)
+	require.Equal(t, []string{"2.sstable"}, orphans)
+	require.Equal(t, []string{"4.sstable"}, missing)
+}
+
+func TestReconcile(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("k", []byte("v"))
+	c.Advance(1 * time.Second)
+	_, err := b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	stats, err := b.Reconcile(ctx, ReconcileOptions{})
+	require.NoError(t, err)
+	require.Equal(t, &ReconcileStats{BlobsListed: 1, BlobsReferenced: 1}, stats)
+}
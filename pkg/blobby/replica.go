@@ -0,0 +1,127 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/codec"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/jonboulle/clockwork"
+)
+
+// Replica is a read-only view of an archive which needs only the blobstore. It
+// learns about sstables from the manifest written by PublishManifest, rather
+// than from the metadata store, so it can't see anything in the memtable, and
+// lags behind the archive by however long it's been since the manifest was
+// published and refreshed.
+type Replica struct {
+	name   string
+	bs     *blobstore.Blobstore
+	clock  clockwork.Clock
+	codecs codec.Registry
+
+	// see WithMaxGetFetches.
+	maxGetFetches int
+
+	manifest atomic.Pointer[metadata.Manifest]
+}
+
+// NewReplica returns a replica of the archive in the given bucket. Only the
+// options which affect reads (WithName, WithMaxGetFetches, and the codec
+// options) are relevant.
+func NewReplica(bucket string, clock clockwork.Clock, opts ...Option) *Replica {
+	b := &Blobby{name: DefaultName}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return &Replica{
+		name:   b.name,
+		bs:     blobstore.New(bucket, clock, b.bsOpts...),
+		clock:  clock,
+		codecs: b.codecs,
+
+		maxGetFetches: b.maxGetFetches,
+	}
+}
+
+// Refresh fetches the latest manifest. It returns true if it was newer than the
+// one which the replica already had.
+func (r *Replica) Refresh(ctx context.Context) (bool, error) {
+	m, err := loadManifest(ctx, r.bs, r.name)
+	if err != nil {
+		return false, err
+	}
+
+	if prev := r.manifest.Load(); prev != nil && !m.Created.After(prev.Created) {
+		return false, nil
+	}
+
+	r.manifest.Store(m)
+	return true, nil
+}
+
+// Run refreshes the manifest every interval until the context is cancelled. It
+// returns an error if the first refresh fails, but only logs later ones via
+// onError (if it's non-nil), since the last good manifest is still usable.
+func (r *Replica) Run(ctx context.Context, interval time.Duration, onError func(error)) error {
+	_, err := r.Refresh(ctx)
+	if err != nil {
+		return err
+	}
+
+	t := r.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.Chan():
+			_, err := r.Refresh(ctx)
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// ErrNoManifest is returned by Replica.Get before the first successful Refresh.
+var ErrNoManifest = errors.New("no manifest loaded")
+
+// Get is like Blobby.Get, but only reads the sstables in the manifest.
+func (r *Replica) Get(ctx context.Context, key string) ([]byte, *GetStats, error) {
+	stats := &GetStats{}
+
+	m := r.manifest.Load()
+	if m == nil {
+		return nil, stats, ErrNoManifest
+	}
+
+	rec, err := findNewest(ctx, r.bs, m.GetContaining(key), key, r.maxGetFetches, stats, nil)
+	if err != nil || rec == nil {
+		return nil, stats, err
+	}
+
+	value, err := r.codecs.Decode(rec.Codec, rec.Document)
+	if err != nil {
+		return nil, stats, fmt.Errorf("codec.Decode(%s): %w", rec.Codec, err)
+	}
+
+	return value, stats, nil
+}
+
+// ManifestTime returns the time at which the current manifest was published,
+// or zero if none has been loaded yet.
+func (r *Replica) ManifestTime() time.Time {
+	m := r.manifest.Load()
+	if m == nil {
+		return time.Time{}
+	}
+
+	return m.Created
+}
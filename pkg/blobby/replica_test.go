@@ -0,0 +1,139 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/codec"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplica(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, _ := setup(t, c)
+	b := New(env.MongoURL(), env.S3Bucket, c, WithCodec(codec.Gzip))
+
+	r := NewReplica(env.S3Bucket, c)
+	_, _, err := r.Get(ctx, "k")
+	require.ErrorIs(t, err, ErrNoManifest)
+
+	_, err = b.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+	_, err = b.PublishManifest(ctx)
+	require.NoError(t, err)
+
+	ok, err := r.Refresh(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	v, _, err := r.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), v)
+
+	// writes aren't visible until they're flushed and published.
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "k", []byte("v2"))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	ok, err = r.Refresh(ctx)
+	require.NoError(t, err)
+	require.False(t, ok)
+	v, _, err = r.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), v)
+
+	_, err = b.PublishManifest(ctx)
+	require.NoError(t, err)
+	_, err = r.Refresh(ctx)
+	require.NoError(t, err)
+	v, _, err = r.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+}
+
+func TestRecoverMetadataFromBlobstore(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, _ := setup(t, c)
+	b := New(env.MongoURL(), env.S3Bucket, c, WithManifest())
+
+	for i, v := range []string{"v1", "v2"} {
+		_, err := b.Put(ctx, "k", []byte(v))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Duration(i+1) * time.Second)
+	}
+
+	// lose the metadata.
+	require.NoError(t, b.md.Destroy(ctx))
+
+	m, n, err := b.RecoverMetadataFromBlobstore(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.Count)
+	require.Equal(t, 2, n)
+
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+
+	// again is a no-op.
+	_, n, err = b.RecoverMetadataFromBlobstore(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestRebuildMetadata(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for i, v := range []string{"v1", "v2"} {
+		_, err := b.Put(ctx, "k", []byte(v))
+		require.NoError(t, err)
+		_, err = b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+		c.Advance(time.Duration(i+1) * time.Second)
+	}
+
+	// lose the metadata, without a manifest to recover from.
+	require.NoError(t, b.md.Destroy(ctx))
+
+	stats, err := b.RebuildMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.BlobsListed)
+	require.Equal(t, 2, stats.Inserted)
+
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+
+	stats, err = b.RebuildMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Inserted)
+}
+
+func TestPublishManifestMonotonic(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, _ := setup(t, c)
+	b := New(env.MongoURL(), env.S3Bucket, c)
+
+	// the clock doesn't move, e.g. because another publisher's is ahead.
+	m1, err := b.PublishManifest(ctx)
+	require.NoError(t, err)
+	m2, err := b.PublishManifest(ctx)
+	require.NoError(t, err)
+	require.True(t, m2.Created.After(m1.Created))
+
+	// the lease was released, so anyone can publish.
+	holder, err := b.coord.LeaseHolder(ctx, manifestLease)
+	require.NoError(t, err)
+	require.Equal(t, "", holder)
+
+	// an older version is never swapped in.
+	err = b.coord.SwapManifestVersion(ctx, m1.Created, m1.Created.Add(time.Hour))
+	require.ErrorIs(t, err, ErrManifestConflict)
+}
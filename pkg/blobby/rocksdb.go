@@ -0,0 +1,193 @@
+package blobby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/rocksdb"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+type ExportRocksDBOptions struct {
+	// Start and End are the half-open range of keys [Start, End) to export. If
+	// End is empty, the range is unbounded.
+	Start string
+	End   string
+
+	// At is the time to export the archive as of. See ScanOptions.At.
+	At time.Time
+}
+
+type ExportRocksDBStats struct {
+	// The number of keys written, and the total size of their values.
+	Keys  int
+	Bytes int64
+}
+
+// ExportRocksDB writes the newest value of every key in the given range to w, as
+// a RocksDB SST file, which can be loaded into a RocksDB instance with
+// IngestExternalFile (or `ldb ingest_extern_sst`). Values are the documents,
+// decoded; timestamps and tags aren't exported.
+func (b *Blobby) ExportRocksDB(ctx context.Context, w io.Writer, opts ExportRocksDBOptions) (*ExportRocksDBStats, error) {
+	stats := &ExportRocksDBStats{}
+	sw := rocksdb.NewWriter(w)
+
+	err := b.Scan(ctx, ScanOptions{Start: opts.Start, End: opts.End, At: opts.At}, func(rec *Record) error {
+		err := sw.Add([]byte(rec.Key), rec.Document)
+		if err != nil {
+			return err
+		}
+
+		stats.Keys++
+		stats.Bytes += int64(len(rec.Document))
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("Scan: %w", err)
+	}
+
+	err = sw.Close()
+	if err != nil {
+		return stats, fmt.Errorf("rocksdb.Writer.Close: %w", err)
+	}
+
+	return stats, nil
+}
+
+type ImportRocksDBOptions struct {
+	// Timestamp is the time which the records are written at, since RocksDB
+	// doesn't keep one. The default is now, so the imported values shadow any
+	// which were written before the import started, whether or not they've
+	// been flushed yet, and are shadowed by any written after.
+	Timestamp time.Time
+
+	// SSTableSize is roughly the total size of the values written to each
+	// sstable. The default is DefaultImportSSTableSize.
+	SSTableSize int64
+
+	// SkipInvalid skips values which aren't valid JSON, or which Put would
+	// otherwise reject, rather than failing. They're counted in
+	// ImportStats.Skipped.
+	SkipInvalid bool
+}
+
+// ImportRocksDB bulk-loads the RocksDB SST file in r, which is size bytes long,
+// into the archive, like Import. Only the newest entry of each key is imported,
+// and keys whose newest entry is a deletion are skipped. Tables containing merge
+// operands or range deletions can't be imported, since they can't be resolved
+// without the merge operator, or the other tables which the range deletions
+// apply to. ImportStats.Listed is the number of entries read.
+func (b *Blobby) ImportRocksDB(ctx context.Context, r io.ReaderAt, size int64, opts ImportRocksDBOptions) (*ImportStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassFlush)
+	stats := &ImportStats{}
+
+	if opts.SSTableSize <= 0 {
+		opts.SSTableSize = DefaultImportSSTableSize
+	}
+	if opts.Timestamp.IsZero() {
+		opts.Timestamp = b.clock.Now()
+	}
+
+	tr, err := rocksdb.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("rocksdb.NewReader: %w", err)
+	}
+
+	if n := tr.RangeDeletions(); n > 0 {
+		return nil, fmt.Errorf("unsupported range deletions: %d", n)
+	}
+
+	var batch []*types.Record
+	var batchSize int64
+	var prev []byte
+	seen := false
+
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		metas, err := b.importBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+
+		stats.Outputs = append(stats.Outputs, metas...)
+		stats.Imported += len(batch)
+		stats.Bytes += batchSize
+		stats.LastKey = batch[len(batch)-1].Key
+		batch, batchSize = nil, 0
+		return nil
+	}
+
+	err = tr.Each(func(ik rocksdb.InternalKey, value []byte) error {
+		stats.Listed++
+
+		// the newest entry of each key comes first, so skip the rest.
+		if seen && string(ik.UserKey) == string(prev) {
+			return nil
+		}
+		prev = append(prev[:0], ik.UserKey...)
+		seen = true
+
+		switch ik.Type {
+		case rocksdb.TypeValue:
+		case rocksdb.TypeDeletion, rocksdb.TypeSingleDeletion:
+			stats.Skipped++
+			return nil
+		default:
+			return fmt.Errorf("unsupported entry type %d: %q", ik.Type, ik.UserKey)
+		}
+
+		key := string(ik.UserKey)
+		err := b.authorize(ctx, MethodPut, key)
+		if err != nil {
+			return err
+		}
+
+		if !json.Valid(value) {
+			if opts.SkipInvalid {
+				stats.Skipped++
+				return nil
+			}
+			return fmt.Errorf("invalid JSON: %q", key)
+		}
+
+		rec, err := b.prepare(&Call{Method: MethodPut, Key: key, Value: value})
+		if err != nil {
+			if opts.SkipInvalid {
+				stats.Skipped++
+				return nil
+			}
+			return fmt.Errorf("%q: %w", key, err)
+		}
+
+		// the TTL of the namespace only applies to the memtable.
+		rec.Timestamp = opts.Timestamp
+		rec.Expires = time.Time{}
+
+		batch = append(batch, rec)
+		batchSize += int64(len(rec.Document))
+
+		if batchSize >= opts.SSTableSize {
+			return commit()
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = commit()
+	}
+
+	if len(stats.Outputs) == 0 && err == nil {
+		return stats, nil
+	}
+
+	b.emit(ctx, Event{Type: EventImport, Created: stats.Outputs, Error: err})
+	return stats, b.audited(ctx, &audit.Entry{Op: audit.OpImport, Created: filenames(stats.Outputs)}, err)
+}
@@ -0,0 +1,102 @@
+package blobby
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/rocksdb"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRocksDBRoundTrip(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	for _, k := range []string{"a", "b", "c"} {
+		_, err := b.Put(ctx, k, []byte(`{"k":"`+k+`"}`))
+		require.NoError(t, err)
+	}
+	_, err := b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	es, err := b.ExportRocksDB(ctx, &buf, ExportRocksDBOptions{End: "c"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, es.Keys)
+
+	// the values are exported as they were written, not encoded.
+	r, err := rocksdb.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	var keys []string
+	require.NoError(t, r.Each(func(ik rocksdb.InternalKey, v []byte) error {
+		keys = append(keys, string(ik.UserKey))
+		assert.JSONEq(t, `{"k":"`+string(ik.UserKey)+`"}`, string(v))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// overwrite one, then import the export, which is newer.
+	c.Advance(time.Minute)
+	_, err = b.Put(ctx, "a", []byte(`{"k":"new"}`))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	c.Advance(time.Minute)
+	is, err := b.ImportRocksDB(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), ImportRocksDBOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, is.Imported)
+	assert.Len(t, is.Outputs, 1)
+
+	v, _, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"a"}`, string(v))
+}
+
+func TestImportRocksDBWithoutFlush(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	_, err := b.Put(ctx, "a", []byte(`{"k":"a"}`))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = b.ExportRocksDB(ctx, &buf, ExportRocksDBOptions{})
+	require.NoError(t, err)
+
+	// overwrite it, but leave the new version in the memtable.
+	c.Advance(time.Minute)
+	_, err = b.Put(ctx, "a", []byte(`{"k":"new"}`))
+	require.NoError(t, err)
+
+	// the import is newer, so it shadows the unflushed version.
+	c.Advance(time.Minute)
+	_, err = b.ImportRocksDB(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), ImportRocksDBOptions{})
+	require.NoError(t, err)
+
+	v, _, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"a"}`, string(v))
+
+	// and is shadowed by writes after it, before they're flushed too.
+	c.Advance(time.Minute)
+	_, err = b.Put(ctx, "a", []byte(`{"k":"newer"}`))
+	require.NoError(t, err)
+
+	v, _, err = b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"newer"}`, string(v))
+
+	// an older timestamp doesn't shadow anything.
+	_, err = b.ImportRocksDB(ctx, bytes.NewReader(buf.Bytes()), int64(buf.Len()), ImportRocksDBOptions{Timestamp: c.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+
+	v, _, err = b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"k":"newer"}`, string(v))
+}
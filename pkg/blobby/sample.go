@@ -0,0 +1,122 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+)
+
+type SampleOptions struct {
+	// Rand is the source of randomness. If it's nil, a new one is seeded from
+	// the clock. Sampling from the memtables always uses Mongo's $sample, so
+	// results aren't reproducible even with a fixed seed.
+	Rand *rand.Rand
+}
+
+// Sample returns approximately n records chosen at random from the whole
+// archive, with their documents decoded, in random order. Each sstable and the
+// memtables contribute in proportion to the number of records in them, so the
+// sample is roughly uniform over every stored version, including those which
+// have been superseded by a newer version but not yet compacted away. It's
+// meant for spot checks, not statistics.
+//
+// Only the parts of each sstable containing the chosen records are read, if its
+// index says how many records are in each part; otherwise the whole sstable is.
+//
+// Records with keys which the caller may not read are dropped, so fewer than n
+// might be returned. It's counted against every quota.
+func (b *Blobby) Sample(ctx context.Context, n int, opts SampleOptions) ([]*Record, error) {
+	err := b.admitScan(ctx, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassScan)
+	rnd := opts.Rand
+	if rnd == nil {
+		rnd = rand.New(rand.NewSource(b.clock.Now().UnixNano()))
+	}
+
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	memCount, err := b.mt.Count(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("memtable.Count: %w", err)
+	}
+
+	// weights[0] is the memtables, then one per sstable.
+	weights := []int{memCount}
+	total := memCount
+	for _, m := range metas {
+		weights = append(weights, m.Count)
+		total += m.Count
+	}
+	if total == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	// draw n times, choosing a source in proportion to its weight.
+	draws := make([]int, len(weights))
+	for range n {
+		x := rnd.Intn(total)
+		for i, w := range weights {
+			if x < w {
+				draws[i]++
+				break
+			}
+			x -= w
+		}
+	}
+
+	var recs []*Record
+	if draws[0] > 0 {
+		got, err := b.mt.Sample(ctx, draws[0])
+		if err != nil {
+			return nil, fmt.Errorf("memtable.Sample: %w", err)
+		}
+		recs = append(recs, got...)
+	}
+
+	for i, m := range metas {
+		if draws[i+1] == 0 {
+			continue
+		}
+
+		got, err := b.bs.Sample(ctx, m, draws[i+1], rnd)
+		if err != nil {
+			return nil, fmt.Errorf("blobstore.Sample(%s): %w", m.Filename(), err)
+		}
+		recs = append(recs, got...)
+	}
+
+	var out []*Record
+	keep := b.readable(ctx, func(rec *Record) error {
+		out = append(out, rec)
+		return nil
+	})
+	for _, rec := range recs {
+		err = keep(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	recs = out
+
+	for _, rec := range recs {
+		rec.Document, err = b.decode(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rnd.Shuffle(len(recs), func(i, j int) {
+		recs[i], recs[j] = recs[j], recs[i]
+	})
+
+	return recs, nil
+}
@@ -0,0 +1,42 @@
+package blobby
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSample(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	// most of the records in sstables, the rest in the memtable.
+	for i := range 100 {
+		tb.put(fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("v%03d", i)))
+		c.Advance(1 * time.Millisecond)
+		if i == 79 {
+			_, err := b.Flush(ctx, FlushOptions{})
+			require.NoError(t, err)
+		}
+	}
+
+	recs, err := b.Sample(ctx, 20, SampleOptions{Rand: rand.New(rand.NewSource(1))})
+	require.NoError(t, err)
+	require.NotEmpty(t, recs)
+	assert.LessOrEqual(t, len(recs), 20)
+
+	for _, rec := range recs {
+		assert.Equal(t, "v"+rec.Key[1:], string(rec.Document))
+	}
+
+	// asking for nothing returns nothing.
+	recs, err = b.Sample(ctx, 0, SampleOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, recs)
+}
@@ -0,0 +1,489 @@
+package blobby
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/memtable"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// DefaultScanConcurrency is the number of sstables which Scan fetches at once,
+// when ScanOptions.Concurrency isn't given.
+const DefaultScanConcurrency = 4
+
+type ScanOptions struct {
+	// Start and End are the half-open range of keys [Start, End) to scan. If End
+	// is empty, the range is unbounded.
+	Start string
+	End   string
+
+	// Concurrency is the maximum number of sstables which are fetched and
+	// decoded at once. Zero means DefaultScanConcurrency.
+	Concurrency int
+
+	// KeysOnly skips decoding the records, so they only have a Key. This is much
+	// cheaper for callers which don't need the values, like counting.
+	KeysOnly bool
+
+	// At is the time to read the archive as of. Versions written after it are
+	// ignored, so the newest version before it is returned instead. Zero means
+	// when the scan starts, so that writes and flushes which land during the
+	// scan can't make some keys look newer than others. Versions which have
+	// since been dropped by compaction (see Namespace) can't be returned, so
+	// keys whose only versions before At were dropped are skipped.
+	At time.Time
+}
+
+// pin returns the given options with At set to now, if it's zero.
+func (b *Blobby) pin(opts ScanOptions) ScanOptions {
+	if opts.At.IsZero() {
+		opts.At = b.clock.Now()
+	}
+	return opts
+}
+
+// after returns true if the given record was written after the time the scan
+// is reading as of, so should be ignored.
+func (opts *ScanOptions) after(rec *Record) bool {
+	return !opts.At.IsZero() && rec.Timestamp.After(opts.At)
+}
+
+// Scan calls fn with the newest version of every key in the given range, from
+// both the memtables and the sstables, in key order. The documents are decoded.
+// If fn returns an error, the scan stops, and that error is returned. Every key
+// is read as of the same time (see ScanOptions.At), so the results are
+// consistent with each other.
+//
+// The sstables are opened in order of their MinKey as the scan reaches them, up
+// to opts.Concurrency ahead, and each is read and decoded in the background, a
+// batch at a time, and merged with the others. The memtables are read in
+// batches too, so memory use is proportional to the number of sstables which
+// overlap each key, not to the size of the range.
+//
+// Keys which the caller may not read are skipped; see Authorizer.
+func (b *Blobby) Scan(ctx context.Context, opts ScanOptions, fn func(*Record) error) error {
+	err := b.authorizeScan(ctx, opts.Start, opts.End)
+	if err != nil {
+		return err
+	}
+
+	return b.scan(ctx, opts, b.readable(ctx, fn))
+}
+
+// scan is Scan, without the authorizer or quotas.
+func (b *Blobby) scan(ctx context.Context, opts ScanOptions, fn func(*Record) error) error {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassScan)
+	opts = b.pin(opts)
+	names, metas, err := b.scanInputs(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return b.merge(ctx, names, metas, opts, fn)
+}
+
+// scanInputs returns the names of the memtables, and the sstables which overlap
+// the range, ordered by MinKey.
+func (b *Blobby) scanInputs(ctx context.Context, opts ScanOptions) ([]string, []*sstable.Meta, error) {
+
+	// the memtables are listed before the metadata is read, so records which
+	// are flushed during the scan are seen at least once: either they're still
+	// in a memtable when it's read, or it was dropped, and merge finds the
+	// sstable they were flushed to.
+	names, err := b.mt.Names(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("memtable.Names: %w", err)
+	}
+
+	metas, err := b.md.GetOverlapping(ctx, opts.Start, opts.End)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metadata.GetOverlapping: %w", err)
+	}
+
+	slices.SortFunc(metas, func(a, b *sstable.Meta) int {
+		return strings.Compare(a.MinKey, b.MinKey)
+	})
+
+	return names, metas, nil
+}
+
+// scanCursor is the next record from one of the inputs to merge.
+type scanCursor struct {
+	rec  *Record
+	next func(context.Context) (*Record, error)
+
+	// breaks ties between versions with the same key and timestamp, like Get:
+	// the memtables win, then the sstables with the highest sequence number.
+	prio int64
+}
+
+// merge calls fn with the newest version of each key in the range of opts from
+// the given memtables and sstables, which must be ordered by MinKey, in key
+// order.
+func (b *Blobby) merge(ctx context.Context, names []string, metas []*sstable.Meta, opts ScanOptions, fn func(*Record) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	h := &cursorHeap{}
+	push := func(c *scanCursor) error {
+		rec, err := c.next(ctx)
+		if err != nil || rec == nil {
+			return err
+		}
+		c.rec = rec
+		heap.Push(h, c)
+		return nil
+	}
+
+	it, err := b.mt.RangeIter(ctx, names, opts.Start, opts.End)
+	if err != nil {
+		return fmt.Errorf("memtable.RangeIter: %w", err)
+	}
+	defer it.Close(ctx)
+
+	known := map[string]bool{}
+	for _, m := range metas {
+		known[m.Filename()] = true
+	}
+
+	err = push(&scanCursor{prio: math.MaxInt64, next: func(ctx context.Context) (*Record, error) {
+		for {
+			rec, err := it.Next(ctx)
+
+			// the rest of its records are in sstables which weren't in the
+			// live set when the scan started, so read those instead.
+			var d *memtable.Dropped
+			if errors.As(err, &d) {
+				err = b.adoptFlushed(ctx, d.Key, opts, known, push)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("memtable: %w", err)
+			}
+			if rec == nil {
+				return nil, nil
+			}
+
+			if opts.KeysOnly {
+				return &Record{Key: rec.Key, Timestamp: rec.Timestamp}, nil
+			}
+
+			rec.Document, err = b.decode(rec)
+			if err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	}})
+	if err != nil {
+		return err
+	}
+
+	f := b.fetchRanges(ctx, metas, opts)
+
+	var prev *Record
+	for {
+
+		// open every sstable which might contain a version of the smallest key
+		// in the heap.
+		for len(metas) > 0 && (h.Len() == 0 || metas[0].MinKey <= (*h)[0].rec.Key) {
+			st, err := f.next(ctx)
+			if err != nil {
+				return err
+			}
+			err = push(&scanCursor{next: st.next, prio: metas[0].LargestSeq})
+			if err != nil {
+				return err
+			}
+			metas = metas[1:]
+		}
+
+		if h.Len() == 0 {
+			return nil
+		}
+
+		c := heap.Pop(h).(*scanCursor)
+		rec := c.rec
+		err := push(c)
+		if err != nil {
+			return err
+		}
+
+		if opts.after(rec) {
+			continue
+		}
+
+		// the newest version of each key comes first, so skip the rest.
+		if prev != nil && rec.Key == prev.Key {
+			continue
+		}
+		prev = rec
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// adoptFlushed is called by merge when a memtable was dropped before it was read
+// to the end, with the last key which was read from it. Its records were flushed
+// first, so they're in sstables which weren't in the live set when the scan
+// started (or in the outputs of compactions of them). This reads those, from
+// the given key onwards, and adds them to known.
+func (b *Blobby) adoptFlushed(ctx context.Context, key string, opts ScanOptions, known map[string]bool, push func(*scanCursor) error) error {
+	metas, err := b.md.GetOverlapping(ctx, key, opts.End)
+	if err != nil {
+		return fmt.Errorf("metadata.GetOverlapping: %w", err)
+	}
+
+	for _, m := range metas {
+		if known[m.Filename()] {
+			continue
+		}
+		known[m.Filename()] = true
+
+		st := b.openRange(ctx, m, key, opts)
+		err = push(&scanCursor{next: st.next, prio: m.LargestSeq})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanBatchSize is the number of records which are read and decoded from each
+// sstable at once, in the background.
+const scanBatchSize = 256
+
+type scanResult struct {
+	recs []*Record
+	err  error
+}
+
+// rangeStream is the records in a range of an sstable, which are read in the
+// background, a batch at a time, so that at most two batches are in memory.
+type rangeStream struct {
+	ch  chan scanResult
+	buf []*Record
+}
+
+// openRange starts reading the records from the given sstable with keys in the
+// range of opts, starting at from. Cancel the context to stop early.
+func (b *Blobby) openRange(ctx context.Context, m *sstable.Meta, from string, opts ScanOptions) *rangeStream {
+	st := &rangeStream{ch: make(chan scanResult, 1)}
+
+	go func() {
+		defer close(st.ch)
+		err := b.readRange(ctx, m, from, opts, func(recs []*Record) bool {
+			select {
+			case st.ch <- scanResult{recs: recs}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err != nil {
+			select {
+			case st.ch <- scanResult{err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return st
+}
+
+// next returns the next record, or nil if there are no more.
+func (st *rangeStream) next(ctx context.Context) (*Record, error) {
+	for len(st.buf) == 0 {
+		select {
+		case res, ok := <-st.ch:
+			if !ok {
+				return nil, nil
+			}
+			if res.err != nil {
+				return nil, res.err
+			}
+			st.buf = res.recs
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	rec := st.buf[0]
+	st.buf = st.buf[1:]
+	return rec, nil
+}
+
+// rangeFetcher opens each of a list of sstables in the background, at most n
+// ahead of the scan, and returns them in the same order.
+type rangeFetcher struct {
+	streams []chan *rangeStream
+
+	// a slot is released when the stream is taken by the scan, so sstables
+	// can't be opened arbitrarily far ahead of it.
+	sem chan struct{}
+}
+
+// fetchRanges starts reading the records in the range from each of the given
+// sstables. Cancel the context to stop early.
+func (b *Blobby) fetchRanges(ctx context.Context, metas []*sstable.Meta, opts ScanOptions) *rangeFetcher {
+	n := opts.Concurrency
+	if n <= 0 {
+		n = DefaultScanConcurrency
+	}
+
+	f := &rangeFetcher{
+		streams: make([]chan *rangeStream, len(metas)),
+		sem:     make(chan struct{}, n),
+	}
+	for i := range metas {
+		f.streams[i] = make(chan *rangeStream, 1)
+	}
+
+	go func() {
+		for i, m := range metas {
+			select {
+			case f.sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			f.streams[i] <- b.openRange(ctx, m, opts.Start, opts)
+		}
+	}()
+
+	return f
+}
+
+// next waits for the next sstable to be opened.
+func (f *rangeFetcher) next(ctx context.Context) (*rangeStream, error) {
+	var st *rangeStream
+	select {
+	case st = <-f.streams[0]:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	<-f.sem
+	f.streams = f.streams[1:]
+	return st, nil
+}
+
+// readRange calls send with batches of the records from the given sstable with
+// keys in the range of opts, starting at from, ordered by key then newest first,
+// with their documents decoded (unless opts.KeysOnly). It stops early if send
+// returns false.
+func (b *Blobby) readRange(ctx context.Context, m *sstable.Meta, from string, opts ScanOptions, send func([]*Record) bool) error {
+	end := opts.End
+
+	r, err := b.bs.OpenSSTableFrom(ctx, m, from)
+	if err != nil {
+		return fmt.Errorf("blobstore.OpenSSTableFrom(%s): %w", m.Filename(), err)
+	}
+	defer r.Close()
+	b.recordAccess(m)
+
+	recs := make([]*Record, 0, scanBatchSize)
+	for {
+		raw, err := r.NextRaw()
+		if err != nil {
+			return fmt.Errorf("NextRaw(%s): %w", m.Filename(), err)
+		}
+
+		var k []byte
+		if raw != nil {
+			var ok bool
+			k, ok = types.RawKey(raw)
+			if !ok {
+				return fmt.Errorf("record without key in %s", m.Filename())
+			}
+			if string(k) < from {
+				continue
+			}
+		}
+
+		if raw == nil || (end != "" && string(k) >= end) {
+			if len(recs) > 0 {
+				send(recs)
+			}
+			return nil
+		}
+
+		if opts.KeysOnly {
+			// the timestamp is needed to skip versions newer than opts.At,
+			// and to order the versions of each key.
+			ts, _ := types.RawTimestamp(raw)
+			recs = append(recs, &Record{Key: string(k), Timestamp: ts})
+		} else {
+			rec := &Record{}
+			err = types.Unmarshal(raw, rec)
+			if err != nil {
+				return fmt.Errorf("Unmarshal(%s): %w", m.Filename(), err)
+			}
+
+			rec.Document, err = b.decode(rec)
+			if err != nil {
+				return err
+			}
+
+			recs = append(recs, rec)
+		}
+
+		if len(recs) == scanBatchSize {
+			if !send(recs) {
+				return nil
+			}
+			recs = make([]*Record, 0, scanBatchSize)
+		}
+	}
+}
+
+// cursorHeap is a min-heap of the inputs to merge, by the key of their next
+// record, then newest first. This is the order of records within sstables.
+type cursorHeap []*scanCursor
+
+func (h cursorHeap) Len() int {
+	return len(h)
+}
+
+func (h cursorHeap) Less(i, j int) bool {
+	a, b := h[i].rec, h[j].rec
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return h[i].prio > h[j].prio
+}
+
+func (h cursorHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *cursorHeap) Push(x any) {
+	*h = append(*h, x.(*scanCursor))
+}
+
+func (h *cursorHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,96 @@
+package blobby
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+	t0 := c.Now()
+
+	// three overlapping sstables, and some newer versions in the memtable.
+	for i, keys := range [][]string{{"a", "c", "e"}, {"b", "c", "f"}, {"c", "d"}} {
+		for _, k := range keys {
+			tb.put(k, []byte(fmt.Sprintf("%s%d", k, i)))
+			c.Advance(1 * time.Second)
+		}
+		_, err := b.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+	tb.put("e", []byte("e3"))
+	tb.put("g", []byte("g3"))
+
+	scan := func(opts ScanOptions) []string {
+		var out []string
+		err := b.Scan(ctx, opts, func(rec *Record) error {
+			out = append(out, string(rec.Document))
+			return nil
+		})
+		require.NoError(t, err)
+		return out
+	}
+
+	for _, n := range []int{0, 1, 3} {
+		assert.Equal(t, []string{"a0", "b1", "c2", "d2", "e3", "f1", "g3"}, scan(ScanOptions{Concurrency: n}))
+		assert.Equal(t, []string{"c2", "d2", "e3"}, scan(ScanOptions{Start: "c", End: "f", Concurrency: n}))
+	}
+
+	// versions written after At are ignored, in favor of older ones, whether
+	// they're in the memtable or an sstable.
+	at := t0.Add(5 * time.Second)
+	assert.Equal(t, []string{"a0", "b1", "c1", "e0", "f1"}, scan(ScanOptions{At: at}))
+
+	n, err := b.Count(ctx, ScanOptions{At: at}, true)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// errors from the callback stop the scan.
+	stop := errors.New("stop")
+	n = 0
+	err = b.Scan(ctx, ScanOptions{Concurrency: 1}, func(rec *Record) error {
+		n++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, n)
+}
+
+func TestScanDuringFlush(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	// more records than the memtable returns in one batch, so the rest of them
+	// are read after the flush.
+	var recs []*Record
+	var want []string
+	for i := 0; i < 2500; i++ {
+		k := fmt.Sprintf("k%04d", i)
+		recs = append(recs, &Record{Key: k, Document: []byte(k)})
+		want = append(want, k)
+	}
+	_, err := b.PutBatch(ctx, recs)
+	require.NoError(t, err)
+
+	// the memtable is flushed and dropped after the first record is read, so
+	// the rest of them must be read from the sstable which it was flushed to.
+	var got []string
+	err = b.Scan(ctx, ScanOptions{}, func(rec *Record) error {
+		if len(got) == 0 {
+			_, err := b.Flush(ctx, FlushOptions{})
+			require.NoError(t, err)
+		}
+		got = append(got, string(rec.Document))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
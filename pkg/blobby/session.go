@@ -0,0 +1,221 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSessionCacheSize is the number of keys which a Session caches, when
+// SessionOptions.CacheSize isn't given.
+const DefaultSessionCacheSize = 128
+
+type SessionOptions struct {
+	// Token is the token returned by Session.Token at the end of an earlier
+	// session, e.g. by the previous request from the same client. If given,
+	// this session reads every write made by that one, even if they were on
+	// different servers with slightly different clocks.
+	Token string
+
+	// CacheSize is the maximum number of keys which are cached. Zero means
+	// DefaultSessionCacheSize; negative disables the cache.
+	CacheSize int
+}
+
+// Session bundles several reads and writes, e.g. in a single web request, so
+// they behave coherently:
+//
+//   - Every read is as of the same time (see At), like GetMulti, so keys read
+//     separately are still consistent with each other.
+//   - Every read sees the writes made earlier in the same session, even though
+//     they're newer than the read time.
+//   - Every key read is cached, so reading it again is free and returns the
+//     same thing.
+//
+// Sessions are cheap, and meant to be short-lived: anything written by other
+// clients after the session started is invisible to it. A Session is safe to
+// use from several goroutines.
+type Session struct {
+	b  *Blobby
+	at time.Time
+
+	mu sync.Mutex
+
+	// the records written in this session, by key.
+	writes map[string]*Record
+
+	// the newest time that any write in this session might have, to be
+	// returned as the token.
+	written time.Time
+
+	// the records read in this session, by key. nil means that the key
+	// doesn't exist.
+	cache     map[string]*Record
+	cacheSize int
+}
+
+// Session starts a session, which reads the archive as of now, or as of the
+// time in opts.Token, if that's later. It returns an error if the token is
+// invalid.
+func (b *Blobby) Session(opts SessionOptions) (*Session, error) {
+	s := &Session{
+		b:         b,
+		at:        b.clock.Now(),
+		writes:    map[string]*Record{},
+		cache:     map[string]*Record{},
+		cacheSize: opts.CacheSize,
+	}
+
+	if s.cacheSize == 0 {
+		s.cacheSize = DefaultSessionCacheSize
+	}
+
+	if opts.Token != "" {
+		t, err := parseToken(opts.Token)
+		if err != nil {
+			return nil, err
+		}
+		if t.After(s.at) {
+			s.at = t
+		}
+	}
+
+	return s, nil
+}
+
+// At returns the time which the session reads the archive as of.
+func (s *Session) At() time.Time {
+	return s.at
+}
+
+// Token returns an opaque token, to be passed to the next session by the same
+// client (see SessionOptions.Token) so that it reads every write made by this
+// one, and everything else this one read.
+func (s *Session) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.at
+	if s.written.After(t) {
+		t = s.written
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+func parseToken(token string) (time.Time, error) {
+	n, err := strconv.ParseInt(token, 36, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid session token: %q", token)
+	}
+
+	return time.Unix(0, n), nil
+}
+
+// Put is like Blobby.Put, but the write is visible to every later read in this
+// session.
+func (s *Session) Put(ctx context.Context, key string, value []byte) (string, error) {
+	return s.PutWithOptions(ctx, key, value, PutOptions{})
+}
+
+// PutWithOptions is like Blobby.PutWithOptions, but the write is visible to
+// every later read in this session.
+func (s *Session) PutWithOptions(ctx context.Context, key string, value []byte, opts PutOptions) (string, error) {
+	dest, err := s.b.PutWithOptions(ctx, key, value, opts)
+	if err != nil {
+		return dest, err
+	}
+
+	// the record was timestamped by the memtable at some point during the
+	// call, so now is an upper bound.
+	now := s.b.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes[key] = &Record{Key: key, Timestamp: now, Document: value, Tags: opts.Tags}
+	if now.After(s.written) {
+		s.written = now
+	}
+
+	return dest, nil
+}
+
+// Get returns the value of the given key as of the start of the session, or
+// as written earlier in the session, or nil if it doesn't exist.
+func (s *Session) Get(ctx context.Context, key string) ([]byte, error) {
+	recs, err := s.GetMulti(ctx, []string{key})
+	if err != nil {
+		return nil, err
+	}
+
+	if rec := recs[key]; rec != nil {
+		return rec.Document, nil
+	}
+
+	return nil, nil
+}
+
+// GetMulti is like Blobby.GetMulti, but reads as of the start of the session,
+// and sees the writes made earlier in the session. Keys which were already read
+// in this session are returned from the cache.
+func (s *Session) GetMulti(ctx context.Context, keys []string) (map[string]*Record, error) {
+	keys = uniqueKeys(keys)
+
+	// cached keys are still checked, since each call might be from a
+	// different caller.
+	err := s.b.admitGets(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]*Record{}
+	var missing []string
+
+	s.mu.Lock()
+	for _, k := range keys {
+		if rec, ok := s.writes[k]; ok {
+			out[k] = rec
+		} else if rec, ok := s.cache[k]; ok {
+			if rec != nil {
+				out[k] = rec
+			}
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	found, err := s.b.getAsOf(ctx, missing, s.at)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range missing {
+		rec := found[k]
+		if rec != nil {
+			out[k] = rec
+		}
+
+		// a write which landed while reading wins.
+		if w, ok := s.writes[k]; ok {
+			out[k] = w
+			continue
+		}
+
+		if len(s.cache) < s.cacheSize {
+			s.cache[k] = rec
+		}
+	}
+
+	return out, nil
+}
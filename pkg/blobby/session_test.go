@@ -0,0 +1,91 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionToken(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	b := New("mongodb://unused", "unused", c)
+
+	s, err := b.Session(SessionOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, c.Now(), s.At())
+
+	// tokens from the past don't move the read time backwards.
+	tok := s.Token()
+	c.Advance(time.Minute)
+	s, err = b.Session(SessionOptions{Token: tok})
+	require.NoError(t, err)
+	assert.Equal(t, c.Now(), s.At())
+
+	// but tokens from the future (e.g. from a server with a fast clock) move
+	// it forwards.
+	c2 := clockwork.NewFakeClockAt(c.Now().Add(-time.Hour))
+	s2, err := New("mongodb://unused", "unused", c2).Session(SessionOptions{Token: s.Token()})
+	require.NoError(t, err)
+	assert.True(t, s2.At().Equal(c.Now()))
+
+	_, err = b.Session(SessionOptions{Token: "!!!"})
+	assert.ErrorContains(t, err, "invalid session token")
+}
+
+func TestSession(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b}
+
+	tb.put("a", []byte("a1"))
+	tb.put("b", []byte("b1"))
+	c.Advance(time.Second)
+
+	s, err := b.Session(SessionOptions{})
+	require.NoError(t, err)
+
+	v, err := s.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), v)
+
+	// writes outside the session, after it started, aren't seen by it. not even
+	// for keys which haven't been read yet.
+	c.Advance(time.Second)
+	tb.put("a", []byte("a2"))
+	tb.put("b", []byte("b2"))
+
+	v, err = s.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), v)
+
+	v, err = s.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b1"), v)
+
+	// but writes inside it are.
+	c.Advance(time.Second)
+	_, err = s.Put(ctx, "b", []byte("b3"))
+	require.NoError(t, err)
+	_, err = s.Put(ctx, "c", []byte("c3"))
+	require.NoError(t, err)
+
+	recs, err := s.GetMulti(ctx, []string{"a", "b", "c", "d"})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	assert.Equal(t, []byte("a1"), recs["a"].Document)
+	assert.Equal(t, []byte("b3"), recs["b"].Document)
+	assert.Equal(t, []byte("c3"), recs["c"].Document)
+
+	// the next session, with the token, sees everything.
+	s, err = b.Session(SessionOptions{Token: s.Token()})
+	require.NoError(t, err)
+
+	recs, err = s.GetMulti(ctx, []string{"a", "b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a2"), recs["a"].Document)
+	assert.Equal(t, []byte("b3"), recs["b"].Document)
+	assert.Equal(t, []byte("c3"), recs["c"].Document)
+}
@@ -0,0 +1,121 @@
+package blobby
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SlowThresholds specifies how long each kind of operation can take before it's
+// logged as slow. Zero disables logging for that kind.
+type SlowThresholds struct {
+	Put     time.Duration
+	Get     time.Duration
+	Flush   time.Duration
+	Compact time.Duration
+}
+
+// WithSlowLog logs operations which take longer than the given thresholds to
+// the given logger, at warning level, with their stats.
+func WithSlowLog(l *slog.Logger, t SlowThresholds) Option {
+	return func(b *Blobby) {
+		b.slowLog = l
+		b.slowThresholds = t
+	}
+}
+
+// logSlow logs the given operation, which started at the given time, if it took
+// longer than the threshold.
+func (b *Blobby) logSlow(ctx context.Context, op string, threshold time.Duration, start time.Time, err error, attrs ...slog.Attr) {
+	if b.slowLog == nil || threshold == 0 {
+		return
+	}
+
+	d := b.clock.Since(start)
+	if d < threshold {
+		return
+	}
+
+	attrs = append([]slog.Attr{
+		slog.String("op", op),
+		slog.Duration("duration", d),
+		slog.Duration("threshold", threshold),
+		slog.String("archive", b.name),
+	}, attrs...)
+
+	if caller := callerFrom(ctx); caller != "" {
+		attrs = append(attrs, slog.String("caller", caller))
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	b.slowLog.LogAttrs(ctx, slog.LevelWarn, "slow operation", attrs...)
+}
+
+func getAttrs(key string, stats *GetStats) []slog.Attr {
+	attrs := []slog.Attr{slog.String("key", key)}
+	if stats != nil {
+		attrs = append(attrs,
+			slog.String("source", stats.Source),
+			slog.Int("blobs_fetched", stats.BlobsFetched),
+			slog.Int("blobs_filtered", stats.BlobsFiltered),
+			slog.Int("records_scanned", stats.RecordsScanned))
+	}
+
+	return attrs
+}
+
+func flushAttrs(stats *FlushStats) []slog.Attr {
+	if stats == nil {
+		return nil
+	}
+
+	attrs := []slog.Attr{
+		slog.Bool("skipped", stats.Skipped),
+		slog.String("memtable", stats.FlushedMemtable),
+		slog.String("sstable", stats.BlobURL),
+	}
+	if len(stats.Outputs) > 0 {
+		var records, bytes int
+		for _, m := range stats.Outputs {
+			records += m.Count
+			bytes += m.Size
+		}
+		attrs = append(attrs,
+			slog.Int("outputs", len(stats.Outputs)),
+			slog.Int("records", records),
+			slog.Int("bytes", bytes))
+	}
+
+	return attrs
+}
+
+func compactAttrs(stats []*CompactionStats) []slog.Attr {
+	var inputs, outputs, inBytes, outBytes, dropped, failed int
+	for _, s := range stats {
+		inputs += len(s.Inputs)
+		outputs += len(s.Outputs)
+		dropped += s.Dropped
+		for _, m := range s.Inputs {
+			inBytes += m.Size
+		}
+		for _, m := range s.Outputs {
+			outBytes += m.Size
+		}
+		if s.Error != nil {
+			failed++
+		}
+	}
+
+	return []slog.Attr{
+		slog.Int("compactions", len(stats)),
+		slog.Int("failed", failed),
+		slog.Int("inputs", inputs),
+		slog.Int("input_bytes", inBytes),
+		slog.Int("outputs", outputs),
+		slog.Int("output_bytes", outBytes),
+		slog.Int("dropped", dropped),
+	}
+}
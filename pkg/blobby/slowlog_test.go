@@ -0,0 +1,53 @@
+package blobby
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowLog(t *testing.T) {
+	ctx := WithCaller(context.Background(), "alice")
+	c := clockwork.NewFakeClock()
+	buf := &bytes.Buffer{}
+	errNope := errors.New("nope")
+
+	// an interceptor which takes as long as the value says, and then fails,
+	// so the backends are never touched.
+	b := New("", "", c,
+		WithSlowLog(slog.New(slog.NewJSONHandler(buf, nil)), SlowThresholds{Put: time.Second}),
+		WithInterceptor(func(ctx context.Context, call *Call, next Handler) error {
+			d, _ := time.ParseDuration(string(call.Value))
+			c.Advance(d)
+			return errNope
+		}))
+
+	_, err := b.Put(ctx, "fast", []byte("999ms"))
+	require.ErrorIs(t, err, errNope)
+	assert.Empty(t, buf.String())
+
+	_, err = b.Put(ctx, "slow", []byte("2s"))
+	require.ErrorIs(t, err, errNope)
+
+	// gets have no threshold, so are never logged.
+	_, _, err = b.Get(ctx, "slow")
+	require.ErrorIs(t, err, errNope)
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "slow operation", entry["msg"])
+	assert.Equal(t, "put", entry["op"])
+	assert.Equal(t, "slow", entry["key"])
+	assert.Equal(t, "alice", entry["caller"])
+	assert.Equal(t, "nope", entry["error"])
+	assert.Equal(t, float64(2*time.Second), entry["duration"])
+}
@@ -0,0 +1,450 @@
+package blobby
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/adammck/blobby/pkg/audit"
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The formats which ImportStream can read.
+const (
+	// FormatJSONL is one JSON object per line. Blank lines are ignored.
+	FormatJSONL = "jsonl"
+
+	// FormatCSV is comma-separated values, with a header row naming the fields.
+	// Every field is a string.
+	FormatCSV = "csv"
+)
+
+// DefaultStreamBatchSize is the number of records which ImportStream writes in
+// each call to PutBatch, when StreamImportOptions.BatchSize isn't given.
+const DefaultStreamBatchSize = 1000
+
+// DefaultKeyField is the field which ImportStream takes each record's key from,
+// when StreamImportOptions.KeyField isn't given. It's the same as `blobby put`.
+const DefaultKeyField = "_id"
+
+// DedupMode is what ImportStream does with rows whose key was already seen.
+type DedupMode string
+
+const (
+	// DedupNone writes every row, so the last one with each key wins, like a
+	// sequence of Puts. This is the default.
+	DedupNone DedupMode = ""
+
+	// DedupFirst skips rows whose key was already seen, so the first one wins.
+	DedupFirst DedupMode = "first"
+
+	// DedupReject rejects rows whose key was already seen.
+	DedupReject DedupMode = "reject"
+)
+
+// ErrDuplicateKey is the reason for rejecting a row with DedupReject.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+type StreamImportOptions struct {
+	// Format is the format of the input, FormatJSONL or FormatCSV.
+	Format string
+
+	// KeyField is the field of each row which contains its key. The default is
+	// DefaultKeyField.
+	KeyField string
+
+	// Direct writes the records straight to new sstables, like Import, rather
+	// than via PutBatch and the memtable. This is much faster for large loads,
+	// but quotas and interceptors don't apply. Like any write, the records
+	// shadow older versions of their keys, even those which haven't been
+	// flushed yet.
+	Direct bool
+
+	// BatchSize is the number of records written in each call to PutBatch. The
+	// default is DefaultStreamBatchSize. It doesn't apply to Direct imports.
+	BatchSize int
+
+	// SSTableSize is roughly the total size of the values written to each
+	// sstable by Direct imports. The default is DefaultImportSSTableSize.
+	SSTableSize int64
+
+	// Dedup is what to do with rows whose key was already seen. Keys are
+	// remembered for the whole import, unless it's DedupNone.
+	Dedup DedupMode
+
+	// Rejects receives a JSON line for each row which couldn't be imported,
+	// because it couldn't be parsed or was refused (e.g. by a Validator), with
+	// its line number, the error, and the row. If it's nil, the first rejected
+	// row fails the import.
+	Rejects io.Writer
+
+	// Progress is called after each batch is written.
+	Progress func(*StreamImportStats)
+}
+
+type StreamImportStats struct {
+	// The number of rows read, not including blank lines or the CSV header.
+	Rows int
+
+	// The number of records written, and the total size of their values.
+	Imported int
+	Bytes    int64
+
+	// The number of rows skipped by DedupFirst, and the number rejected.
+	Duplicates int
+	Rejected   int
+
+	// The number of batches written.
+	Batches int
+
+	// The sstables which were added to the live set, by Direct imports.
+	Outputs []*sstable.Meta
+}
+
+// Rejection is the JSON line written to StreamImportOptions.Rejects for each
+// rejected row.
+type Rejection struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+
+	// The line (for JSONL) or the fields (for CSV) which were rejected.
+	Row any `json:"row"`
+}
+
+// streamRow is a row read from the input, or the error parsing it.
+type streamRow struct {
+	line int
+	raw  any
+	doc  bson.D
+	err  error
+}
+
+// ImportStream reads rows from r in the given format, and writes each of them
+// as a record, batched. The values are stored as BSON documents, so they can
+// be read back with `blobby get`, and checked by RequireFields.
+//
+// Unless opts.Direct is set, each batch is written by PutBatch, so it's as if
+// the rows were Put in order, and rejected rows are found before the batch is
+// written. Otherwise each batch is written to new sstables, like Import, which
+// are timestamped as of when the batch was written.
+func (b *Blobby) ImportStream(ctx context.Context, r io.Reader, opts StreamImportOptions) (*StreamImportStats, error) {
+	if opts.KeyField == "" {
+		opts.KeyField = DefaultKeyField
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultStreamBatchSize
+	}
+	if opts.SSTableSize <= 0 {
+		opts.SSTableSize = DefaultImportSSTableSize
+	}
+
+	var next func() (*streamRow, error)
+	switch opts.Format {
+	case FormatJSONL:
+		next = jsonlRows(r)
+	case FormatCSV:
+		next = csvRows(r)
+	default:
+		return nil, fmt.Errorf("unknown format: %q", opts.Format)
+	}
+
+	si := &streamImport{b: b, opts: opts, stats: &StreamImportStats{}}
+	if opts.Dedup != DedupNone {
+		si.seen = map[string]struct{}{}
+	}
+
+	err := si.run(ctx, next)
+	stats := si.stats
+
+	if !opts.Direct || (len(stats.Outputs) == 0 && err == nil) {
+		return stats, err
+	}
+
+	b.emit(ctx, Event{Type: EventImport, Created: stats.Outputs, Error: err})
+	return stats, b.audited(ctx, &audit.Entry{Op: audit.OpImport, Created: filenames(stats.Outputs)}, err)
+}
+
+type streamImport struct {
+	b     *Blobby
+	opts  StreamImportOptions
+	stats *StreamImportStats
+	seen  map[string]struct{}
+
+	batch []*types.Record
+	size  int64
+
+	// the index of each key in the batch, so later rows can replace earlier
+	// ones, since they'd have the same timestamp.
+	index map[string]int
+}
+
+func (si *streamImport) run(ctx context.Context, next func() (*streamRow, error)) error {
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		si.stats.Rows++
+		rec, key, err := si.record(ctx, row)
+		if err != nil {
+			err = si.reject(row, key, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if rec == nil {
+			si.stats.Duplicates++
+			continue
+		}
+
+		si.add(rec)
+		if si.full() {
+			err = si.commit(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return si.commit(ctx)
+}
+
+// record returns the record for the given row, or nil if it should be skipped
+// as a duplicate. The key is returned if it was found, even on error.
+func (si *streamImport) record(ctx context.Context, row *streamRow) (*types.Record, string, error) {
+	if row.err != nil {
+		return nil, "", row.err
+	}
+
+	key, err := docKey(row.doc, si.opts.KeyField)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if si.seen != nil {
+		if _, ok := si.seen[key]; ok {
+			if si.opts.Dedup == DedupReject {
+				return nil, key, ErrDuplicateKey
+			}
+			return nil, key, nil
+		}
+	}
+
+	value, err := bson.Marshal(row.doc)
+	if err != nil {
+		return nil, key, fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	err = si.b.authorize(ctx, MethodPut, key)
+	if err != nil {
+		return nil, key, err
+	}
+
+	// PutBatch does this again, but would reject the whole batch.
+	rec, err := si.b.prepare(&Call{Method: MethodPut, Key: key, Value: value})
+	if err != nil {
+		return nil, key, err
+	}
+
+	if si.seen != nil {
+		si.seen[key] = struct{}{}
+	}
+
+	if !si.opts.Direct {
+		// PutBatch wants the value as written, not encoded.
+		rec.Document = value
+		rec.Codec = ""
+	}
+
+	return rec, key, nil
+}
+
+func (si *streamImport) add(rec *types.Record) {
+	if si.index == nil {
+		si.index = map[string]int{}
+	}
+
+	if i, ok := si.index[rec.Key]; ok {
+		si.size -= int64(len(si.batch[i].Document))
+		si.batch[i] = rec
+	} else {
+		si.index[rec.Key] = len(si.batch)
+		si.batch = append(si.batch, rec)
+	}
+
+	si.size += int64(len(rec.Document))
+}
+
+func (si *streamImport) full() bool {
+	if si.opts.Direct {
+		return si.size >= si.opts.SSTableSize
+	}
+	return len(si.batch) >= si.opts.BatchSize
+}
+
+func (si *streamImport) commit(ctx context.Context) error {
+	if len(si.batch) == 0 {
+		return nil
+	}
+
+	if si.opts.Direct {
+		ctx := blobstore.WithOpClass(ctx, blobstore.ClassFlush)
+		sort.Slice(si.batch, func(i, j int) bool { return si.batch[i].Key < si.batch[j].Key })
+
+		// the TTL of the namespace only applies to the memtable.
+		now := si.b.clock.Now()
+		for _, rec := range si.batch {
+			rec.Timestamp = now
+			rec.Expires = time.Time{}
+		}
+
+		metas, err := si.b.importBatch(ctx, si.batch)
+		if err != nil {
+			return err
+		}
+		si.stats.Outputs = append(si.stats.Outputs, metas...)
+
+	} else {
+		_, err := si.b.PutBatch(ctx, si.batch)
+		if err != nil {
+			return fmt.Errorf("PutBatch: %w", err)
+		}
+	}
+
+	si.stats.Imported += len(si.batch)
+	si.stats.Bytes += si.size
+	si.stats.Batches++
+	si.batch, si.size, si.index = nil, 0, nil
+
+	if si.opts.Progress != nil {
+		si.opts.Progress(si.stats)
+	}
+
+	return nil
+}
+
+// reject records that the given row was rejected, or returns an error if there's
+// nowhere to record it.
+func (si *streamImport) reject(row *streamRow, key string, err error) error {
+	if si.opts.Rejects == nil {
+		return fmt.Errorf("line %d: %w", row.line, err)
+	}
+
+	si.stats.Rejected++
+	b, jerr := json.Marshal(&Rejection{Line: row.line, Key: key, Error: err.Error(), Row: row.raw})
+	if jerr != nil {
+		return jerr
+	}
+
+	_, werr := si.opts.Rejects.Write(append(b, '\n'))
+	return werr
+}
+
+// docKey returns the value of the given field of doc, as a string.
+func docKey(doc bson.D, field string) (string, error) {
+	for _, e := range doc {
+		if e.Key != field {
+			continue
+		}
+
+		switch v := e.Value.(type) {
+		case string:
+			return v, nil
+		case primitive.ObjectID:
+			return v.Hex(), nil
+		case nil:
+			return "", fmt.Errorf("null key field: %s", field)
+		default:
+			return fmt.Sprintf("%v", v), nil
+		}
+	}
+
+	return "", fmt.Errorf("missing key field: %s", field)
+}
+
+func jsonlRows(r io.Reader) func() (*streamRow, error) {
+	br := bufio.NewReader(r)
+	line := 0
+
+	return func() (*streamRow, error) {
+		for {
+			b, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if len(b) == 0 && err == io.EOF {
+				return nil, io.EOF
+			}
+			line++
+
+			b = bytes.TrimSpace(b)
+			if len(b) == 0 {
+				continue
+			}
+
+			row := &streamRow{line: line, raw: string(b)}
+			row.err = bson.UnmarshalExtJSON(b, false, &row.doc)
+			return row, nil
+		}
+	}
+}
+
+func csvRows(r io.Reader) func() (*streamRow, error) {
+	cr := csv.NewReader(r)
+	var header []string
+
+	return func() (*streamRow, error) {
+		if header == nil {
+			h, err := cr.Read()
+			if err != nil {
+				if err == io.EOF {
+					return nil, io.EOF
+				}
+				return nil, fmt.Errorf("csv header: %w", err)
+			}
+			header = h
+		}
+
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+
+		// rows with the wrong number of fields are returned anyway, but other
+		// parse errors can't be skipped past reliably.
+		var pe *csv.ParseError
+		if errors.As(err, &pe) && errors.Is(pe.Err, csv.ErrFieldCount) {
+			return &streamRow{line: pe.Line, raw: fields, err: err}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := &streamRow{line: line, raw: fields}
+
+		row.doc = make(bson.D, len(header))
+		for i, name := range header {
+			row.doc[i] = bson.E{Key: name, Value: fields[i]}
+		}
+
+		return row, nil
+	}
+}
@@ -0,0 +1,137 @@
+package blobby
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func readRows(t *testing.T, next func() (*streamRow, error)) []*streamRow {
+	var rows []*streamRow
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return rows
+		}
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+}
+
+func TestStreamRowsJSONL(t *testing.T) {
+	rows := readRows(t, jsonlRows(strings.NewReader("{\"_id\": 1, \"name\": \"bulbasaur\"}\n\n{\"_id\": \"x\"}\nnope\n{\"name\": \"ivysaur\"}")))
+	require.Len(t, rows, 4)
+
+	assert.Equal(t, 1, rows[0].line)
+	k, err := docKey(rows[0].doc, "_id")
+	require.NoError(t, err)
+	assert.Equal(t, "1", k)
+
+	assert.Equal(t, 3, rows[1].line)
+	k, err = docKey(rows[1].doc, "_id")
+	require.NoError(t, err)
+	assert.Equal(t, "x", k)
+
+	assert.Equal(t, 4, rows[2].line)
+	assert.Error(t, rows[2].err)
+
+	// the last line has no newline.
+	assert.Equal(t, 5, rows[3].line)
+	_, err = docKey(rows[3].doc, "_id")
+	assert.ErrorContains(t, err, "missing key field: _id")
+}
+
+func TestStreamRowsCSV(t *testing.T) {
+	rows := readRows(t, csvRows(strings.NewReader("id,name\n1,bulbasaur\n2\n3,\"venusaur\"\n")))
+	require.Len(t, rows, 3)
+
+	assert.Equal(t, 2, rows[0].line)
+	assert.Equal(t, bson.D{{Key: "id", Value: "1"}, {Key: "name", Value: "bulbasaur"}}, rows[0].doc)
+
+	assert.Equal(t, 3, rows[1].line)
+	assert.Error(t, rows[1].err)
+	assert.Equal(t, []string{"2"}, rows[1].raw)
+
+	assert.Equal(t, 4, rows[2].line)
+	assert.Equal(t, bson.D{{Key: "id", Value: "3"}, {Key: "name", Value: "venusaur"}}, rows[2].doc)
+}
+
+func TestImportStream(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	in := `{"_id": "a", "v": 1}
+{"_id": "b", "v": 1}
+{"_id": "a", "v": 2}
+{"v": 3}
+{"_id": "c", "v": 1}
+`
+
+	// without somewhere to put them, rejected rows fail the import.
+	_, err := b.ImportStream(ctx, strings.NewReader(in), StreamImportOptions{Format: FormatJSONL})
+	require.ErrorContains(t, err, "line 4: missing key field: _id")
+
+	var rejects bytes.Buffer
+	var progress int
+	stats, err := b.ImportStream(ctx, strings.NewReader(in), StreamImportOptions{
+		Format:    FormatJSONL,
+		Dedup:     DedupFirst,
+		BatchSize: 2,
+		Rejects:   &rejects,
+		Progress:  func(*StreamImportStats) { progress++ },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Rows)
+	assert.Equal(t, 3, stats.Imported)
+	assert.Equal(t, 1, stats.Duplicates)
+	assert.Equal(t, 1, stats.Rejected)
+	assert.Equal(t, 2, stats.Batches)
+	assert.Equal(t, 2, progress)
+
+	var rej Rejection
+	require.NoError(t, json.Unmarshal(rejects.Bytes(), &rej))
+	assert.Equal(t, 4, rej.Line)
+	assert.Equal(t, `{"v": 3}`, rej.Row)
+
+	get := func(key string) bson.M {
+		v, _, err := b.Get(ctx, key)
+		require.NoError(t, err)
+		m := bson.M{}
+		require.NoError(t, bson.Unmarshal(v, &m))
+		return m
+	}
+	assert.EqualValues(t, 1, get("a")["v"])
+
+	// direct imports go straight to sstables. the last row with each key wins,
+	// over the version of b which is still in the memtable too.
+	c.Advance(time.Minute)
+	stats, err = b.ImportStream(ctx, strings.NewReader("k,v\nb,x\nb,y\n"), StreamImportOptions{
+		Format:   FormatCSV,
+		KeyField: "k",
+		Direct:   true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Imported)
+	assert.Len(t, stats.Outputs, 1)
+	assert.Equal(t, "y", get("b")["v"])
+
+	_, src, err := b.mt.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.NotEmpty(t, src)
+
+	// and later writes win over them, before they're flushed.
+	c.Advance(time.Minute)
+	doc, err := bson.Marshal(bson.M{"v": "z"})
+	require.NoError(t, err)
+	_, err = b.PutBatch(ctx, []*Record{{Key: "b", Document: doc}})
+	require.NoError(t, err)
+	assert.Equal(t, "z", get("b")["v"])
+}
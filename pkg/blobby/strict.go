@@ -0,0 +1,146 @@
+package blobby
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// WithStrictOrdering makes Get look for other versions of the key with the same
+// timestamp as the one it found in the sstables, which is possible when records
+// are imported, or written with explicit timestamps, since timestamps only have
+// millisecond precision. Without it, the winner is whichever sstable happens to
+// be read first.
+//
+// Ties are broken by sequence number: the version from the sstable which was
+// flushed or imported last wins, like in compaction. If that can't be told,
+// because the sstables' sequence numbers overlap (after compaction) or they
+// predate sequence numbers, Get fails with an AmbiguousVersion error rather
+// than picking one. Versions with identical values aren't ambiguous.
+//
+// Versions in the memtables win ties with the sstables, since they'll be
+// flushed after every sstable which exists now, so they aren't checked. Strict gets read every
+// sstable which might contain a version as new as the one found, so they're
+// slower, and the extra reads aren't limited by WithMaxGetFetches.
+func WithStrictOrdering() Option {
+	return func(b *Blobby) {
+		b.strict = true
+	}
+}
+
+// ErrAmbiguousVersion matches any AmbiguousVersion error, via errors.Is.
+var ErrAmbiguousVersion = &AmbiguousVersion{}
+
+// AmbiguousVersion is returned by Get with WithStrictOrdering when the newest
+// versions of a key have the same timestamp and different values, and their
+// sequence numbers don't say which was written last.
+type AmbiguousVersion struct {
+	Key       string
+	Timestamp time.Time
+
+	// The sstables containing the tied versions.
+	Sources []string
+}
+
+func (e *AmbiguousVersion) Error() string {
+	return fmt.Sprintf("ambiguous version of key %q at %s: tied in %s", e.Key, e.Timestamp.Format(time.RFC3339Nano), strings.Join(e.Sources, ", "))
+}
+
+func (e *AmbiguousVersion) Is(err error) bool {
+	_, ok := err.(*AmbiguousVersion)
+	return ok
+}
+
+// candidate is a version of a key, and the sstable it was read from.
+type candidate struct {
+	rec  *types.Record
+	meta *sstable.Meta
+}
+
+// breakTies is called by get with WithStrictOrdering, with rec, which was found
+// by findNewest in the given sstables. It reads the rest of the sstables which
+// might contain a version at least as new, and returns the newest version, with
+// ties broken by sequence number. Stats are accumulated into the given struct.
+func (b *Blobby) breakTies(ctx context.Context, key string, metas []*sstable.Meta, rec *types.Record, stats *GetStats) (*types.Record, error) {
+	var found *sstable.Meta
+	for _, m := range metas {
+		if m.Filename() == stats.Source {
+			found = m
+			break
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("sstable not found: %s", stats.Source)
+	}
+
+	cands := []candidate{{rec, found}}
+	for _, m := range metas {
+		if m == found || m.MaxTime.Before(cands[0].rec.Timestamp) {
+			continue
+		}
+
+		r, bstats, err := b.bs.Find(ctx, m, key)
+		if err != nil {
+			return nil, fmt.Errorf("blobstore.Find: %w", err)
+		}
+		if bstats.Filtered {
+			stats.BlobsFiltered++
+			continue
+		}
+		stats.BlobsFetched++
+		stats.RecordsScanned += bstats.RecordsScanned
+		b.recordAccess(m)
+
+		if r == nil {
+			continue
+		}
+
+		// newer than the version found, which findNewest can miss after some
+		// compactions. that's not a tie.
+		if r.Timestamp.After(cands[0].rec.Timestamp) {
+			cands = []candidate{{r, m}}
+		} else if r.Timestamp.Equal(cands[0].rec.Timestamp) {
+			cands = append(cands, candidate{r, m})
+		}
+	}
+
+	winner := cands[0]
+	for _, c := range cands[1:] {
+		if c.meta.LargestSeq > winner.meta.LargestSeq {
+			winner = c
+		}
+	}
+
+	var tied []string
+	for _, c := range cands {
+		if c == winner || sameVersion(c.rec, winner.rec) {
+			continue
+		}
+		if winner.meta.SmallestSeq == 0 || c.meta.LargestSeq == 0 || c.meta.LargestSeq >= winner.meta.SmallestSeq {
+			tied = append(tied, c.meta.Filename())
+		}
+	}
+
+	if len(tied) > 0 {
+		return nil, &AmbiguousVersion{
+			Key:       key,
+			Timestamp: winner.rec.Timestamp,
+			Sources:   append([]string{winner.meta.Filename()}, tied...),
+		}
+	}
+
+	stats.Source = winner.meta.Filename()
+	return winner.rec, nil
+}
+
+// sameVersion returns true if the given records, which have the same key and
+// timestamp, are copies of the same write.
+func sameVersion(a, b *types.Record) bool {
+	return a.Codec == b.Codec && bytes.Equal(a.Document, b.Document) && maps.Equal(a.Tags, b.Tags)
+}
@@ -0,0 +1,74 @@
+package blobby
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSSTable writes the given record to a new sstable with the given sequence
+// numbers, bypassing register, so the tests can control them.
+func writeSSTable(t *testing.T, ctx context.Context, b *Blobby, rec *types.Record, seq int64) string {
+	ch := make(chan *types.Record, 1)
+	ch <- rec
+	close(ch)
+
+	_, _, meta, err := b.bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	meta.SmallestSeq = seq
+	meta.LargestSeq = seq
+	require.NoError(t, b.md.Insert(ctx, meta))
+	return meta.Filename()
+}
+
+func TestStrictOrdering(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+	WithStrictOrdering()(b)
+
+	ts := c.Now()
+	writeSSTable(t, ctx, b, &types.Record{Key: "k", Timestamp: ts, Document: []byte("v2")}, 2)
+	c.Advance(time.Second)
+	writeSSTable(t, ctx, b, &types.Record{Key: "k", Timestamp: ts, Document: []byte("v1")}, 1)
+	c.Advance(time.Second)
+
+	// the sstable with the greater sequence number wins, even though the other
+	// was created later.
+	v, _, err := b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+
+	// identical copies aren't ambiguous.
+	writeSSTable(t, ctx, b, &types.Record{Key: "k", Timestamp: ts, Document: []byte("v2")}, 0)
+	c.Advance(time.Second)
+	v, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+
+	// but a different version without a sequence number is.
+	fn := writeSSTable(t, ctx, b, &types.Record{Key: "k", Timestamp: ts, Document: []byte("v3")}, 0)
+	c.Advance(time.Second)
+	_, _, err = b.Get(ctx, "k")
+	var av *AmbiguousVersion
+	require.ErrorAs(t, err, &av)
+	assert.Contains(t, av.Sources, fn)
+
+	// without strict ordering, one of them is returned.
+	b2 := New(b.mongoURL, b.bucket, c)
+	v, _, err = b2.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.NotNil(t, v)
+
+	// a newer version in the memtable always wins.
+	_, err = b.Put(ctx, "k", []byte("v4"))
+	require.NoError(t, err)
+	v, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v4"), v)
+}
@@ -0,0 +1,273 @@
+package blobby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultSyncOverlap is how far before its cursor each pass of Sync starts
+// reading, when SyncOptions.Overlap isn't given. See SyncOptions.Overlap.
+const DefaultSyncOverlap = 10 * time.Second
+
+// DefaultSyncBatchSize is the number of records which Sync writes to the target
+// in each call to PutBatch, when SyncOptions.BatchSize isn't given.
+const DefaultSyncBatchSize = 1000
+
+type SyncOptions struct {
+	// Name identifies the sync, so that its cursor can be stored in the source
+	// archive's metadata. The default is the name of the target archive, which
+	// is enough unless there are several targets with the same name.
+	Name string
+
+	// Overlap is how far before its cursor each pass starts reading. Records
+	// are timestamped when they're written, but become visible when they're
+	// committed to the memtable, a little later, so a pass could miss records
+	// written just before it without this. They're repeated instead. The
+	// default is DefaultSyncOverlap.
+	Overlap time.Duration
+
+	// BatchSize is the number of records written to the target at once. The
+	// default is DefaultSyncBatchSize.
+	BatchSize int
+}
+
+func (opts *SyncOptions) defaults(dst *Blobby) {
+	if opts.Name == "" {
+		opts.Name = dst.Name()
+	}
+	if opts.Overlap <= 0 {
+		opts.Overlap = DefaultSyncOverlap
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultSyncBatchSize
+	}
+}
+
+type SyncStats struct {
+	// True if this pass copied the whole archive, because the sync hadn't
+	// started yet. The Export stats are set if so.
+	Initial bool
+	Export  *ExportStats
+
+	// The number of changes written to the target, including those repeated
+	// from the previous pass, and the number of batches they were written in.
+	Records int
+	Batches int
+
+	// The cursor after this pass: every record written to the source before
+	// it has been written to the target.
+	Cursor time.Time
+
+	// How far behind the source the target was at the end of this pass.
+	Lag time.Duration
+}
+
+// Sync makes one pass of copying the changes made to this archive to dst, which
+// must be open, so it can be migrated to another bucket or cluster without
+// downtime. Run it periodically (see RunSync) until the target has caught up,
+// then switch writers over to it.
+//
+// The first pass copies the newest version of every key with ExportLatest, and
+// later ones copy every change since the previous pass with ChangesSince, in
+// the order they were made, via PutBatch, keeping their timestamps and tags.
+// The cursor is stored in this archive's metadata, so a sync can be resumed
+// by any process.
+//
+// Changes are copied at least once: a pass which fails or overlaps with the
+// previous one writes some of them again. Those which are still in the target's
+// memtable are recognized by their idempotency key and dropped, and the rest are
+// harmless extra versions until they're compacted.
+//
+// Records which are added with timestamps before the cursor, like those from
+// Import, aren't seen by the sync, so must be added to the target too.
+func (b *Blobby) Sync(ctx context.Context, dst *Blobby, opts SyncOptions) (*SyncStats, error) {
+	opts.defaults(dst)
+	stats := &SyncStats{}
+
+	if dst.name == b.name && dst.mongoURL == b.mongoURL {
+		return stats, fmt.Errorf("can't sync archive into itself: %s", b.name)
+	}
+
+	start := b.clock.Now()
+	cursor, ok, err := b.md.SyncCursor(ctx, opts.Name)
+	if err != nil {
+		return stats, fmt.Errorf("metadata.SyncCursor: %w", err)
+	}
+
+	if !ok {
+		stats.Initial = true
+		stats.Export, err = b.ExportLatest(ctx, ArchiveTarget(dst), ExportOptions{At: start})
+		if err != nil {
+			return stats, fmt.Errorf("ExportLatest: %w", err)
+		}
+
+		// the export skipped anything written after it started.
+		err = b.advanceSync(ctx, opts.Name, start)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Cursor = start
+		stats.Lag = b.clock.Since(start)
+		return stats, nil
+	}
+
+	var batch []*Record
+	commit := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		_, err := dst.PutBatch(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("PutBatch: %w", err)
+		}
+
+		stats.Records += len(batch)
+		stats.Batches++
+
+		// everything before the last record has been copied, but there might
+		// be more with the same timestamp.
+		err = b.advanceSync(ctx, opts.Name, batch[len(batch)-1].Timestamp)
+		batch = nil
+		return err
+	}
+
+	err = b.ChangesSince(ctx, cursor.Add(-opts.Overlap), func(rec *Record) error {
+		// changes made since this pass started can wait until the next one,
+		// so the cursor can't get ahead of the memtable.
+		if !rec.Timestamp.Before(start) {
+			return errStopSync
+		}
+
+		if rec.IdempotencyKey == "" {
+			rec.IdempotencyKey = fmt.Sprintf("sync-%d", rec.Timestamp.UnixNano())
+		}
+
+		batch = append(batch, rec)
+		if len(batch) >= opts.BatchSize {
+			return commit()
+		}
+
+		return nil
+	})
+	if errors.Is(err, errStopSync) {
+		err = nil
+	}
+	if err == nil {
+		err = commit()
+	}
+	if err != nil {
+		stats.Lag = b.syncLag(opts.Name)
+		return stats, err
+	}
+
+	err = b.advanceSync(ctx, opts.Name, start)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Cursor = start
+	stats.Lag = b.syncLag(opts.Name)
+	return stats, nil
+}
+
+var errStopSync = errors.New("stop sync")
+
+// advanceSync moves the cursor of the given sync forwards to t, and records it
+// for Stats.
+func (b *Blobby) advanceSync(ctx context.Context, name string, t time.Time) error {
+	err := b.md.SetSyncCursor(ctx, name, t)
+	if err != nil {
+		return fmt.Errorf("metadata.SetSyncCursor: %w", err)
+	}
+
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	if b.syncedTo == nil {
+		b.syncedTo = map[string]time.Time{}
+	}
+	if t.After(b.syncedTo[name]) {
+		b.syncedTo[name] = t
+	}
+
+	return nil
+}
+
+// syncLag returns how long it's been since the cursor of the given sync, as of
+// the last time this process advanced it.
+func (b *Blobby) syncLag(name string) time.Duration {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	t, ok := b.syncedTo[name]
+	if !ok {
+		return 0
+	}
+
+	return b.clock.Since(t)
+}
+
+// SyncLag is the lag of a sync run by this process.
+type SyncLag struct {
+	Name string
+	Lag  time.Duration
+}
+
+// syncLags returns the lag of every sync run by this process, by name.
+func (b *Blobby) syncLags() []SyncLag {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	var out []SyncLag
+	for name, t := range b.syncedTo {
+		out = append(out, SyncLag{Name: name, Lag: b.clock.Since(t)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ResetSync forgets the cursor of the given sync, so the next pass copies the
+// whole archive again.
+func (b *Blobby) ResetSync(ctx context.Context, name string) error {
+	err := b.md.DeleteSyncCursor(ctx, name)
+	if err != nil {
+		return fmt.Errorf("metadata.DeleteSyncCursor: %w", err)
+	}
+
+	b.syncMu.Lock()
+	delete(b.syncedTo, name)
+	b.syncMu.Unlock()
+
+	return nil
+}
+
+// RunSync calls Sync every interval until the context is cancelled, passing the
+// result of each pass to onResult. Unlike the other Run methods, it keeps going
+// if a pass fails, since the next one will retry the same changes; the lag in
+// Stats shows whether it's keeping up.
+func (b *Blobby) RunSync(ctx context.Context, dst *Blobby, interval time.Duration, opts SyncOptions, onResult func(*SyncStats, error)) error {
+	t := b.clock.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		stats, err := b.Sync(ctx, dst, opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if onResult != nil {
+			onResult(stats, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.Chan():
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	_, err := b.Put(ctx, "a", []byte(`{"v":1}`))
+	require.NoError(t, err)
+	_, err = b.Flush(ctx, FlushOptions{Force: true})
+	require.NoError(t, err)
+
+	dst := b.Sibling("dst")
+	require.NoError(t, dst.Init(ctx))
+	require.NoError(t, dst.Open(ctx))
+
+	_, err = b.Sync(ctx, b, SyncOptions{})
+	assert.ErrorContains(t, err, "into itself")
+
+	// the first pass copies everything.
+	c.Advance(time.Minute)
+	stats, err := b.Sync(ctx, dst, SyncOptions{})
+	require.NoError(t, err)
+	assert.True(t, stats.Initial)
+	assert.Equal(t, 1, stats.Export.Keys)
+
+	v, _, err := dst.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"v":1}`, string(v))
+
+	// later ones copy the changes since.
+	c.Advance(time.Minute)
+	_, err = b.Put(ctx, "a", []byte(`{"v":2}`))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "b", []byte(`{"v":1}`))
+	require.NoError(t, err)
+
+	c.Advance(time.Minute)
+	stats, err = b.Sync(ctx, dst, SyncOptions{})
+	require.NoError(t, err)
+	assert.False(t, stats.Initial)
+	assert.Equal(t, 2, stats.Records)
+
+	v, _, err = dst.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"v":2}`, string(v))
+
+	// repeating changes is harmless.
+	stats, err = b.Sync(ctx, dst, SyncOptions{Overlap: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Records)
+
+	v, _, err = dst.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"v":1}`, string(v))
+
+	require.Len(t, b.Stats().Syncs, 1)
+	assert.Equal(t, "dst", b.Stats().Syncs[0].Name)
+	assert.Zero(t, b.Stats().Syncs[0].Lag)
+}
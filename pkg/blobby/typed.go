@@ -0,0 +1,110 @@
+package blobby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Format is the encoding used by Typed to marshal documents.
+type Format int
+
+const (
+	BSON Format = iota
+	JSON
+)
+
+// Typed wraps an archive to read and write documents of type T, rather than raw
+// bytes. Documents are marshaled with the bson or json struct tags of T.
+type Typed[T any] struct {
+	b        *Blobby
+	format   Format
+	validate func(*T) error
+}
+
+type TypedOption[T any] func(*Typed[T])
+
+// WithFormat sets the encoding of documents. The default is BSON. Changing this
+// for an existing archive makes the documents already in it unreadable.
+func WithFormat[T any](f Format) TypedOption[T] {
+	return func(t *Typed[T]) {
+		t.format = f
+	}
+}
+
+// WithValidator sets a function which is called with every document before it's
+// written by PutDoc. If it returns an error, the document isn't written.
+func WithValidator[T any](fn func(*T) error) TypedOption[T] {
+	return func(t *Typed[T]) {
+		t.validate = fn
+	}
+}
+
+func NewTyped[T any](b *Blobby, opts ...TypedOption[T]) *Typed[T] {
+	t := &Typed[T]{b: b}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// PutDoc validates and marshals the given document, and writes it to the given
+// key. It returns the name of the memtable it was written to, like Put.
+func (t *Typed[T]) PutDoc(ctx context.Context, key string, doc *T) (string, error) {
+	if t.validate != nil {
+		err := t.validate(doc)
+		if err != nil {
+			return "", fmt.Errorf("validate(%s): %w", key, err)
+		}
+	}
+
+	value, err := t.marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("marshal(%s): %w", key, err)
+	}
+
+	return t.b.Put(ctx, key, value)
+}
+
+// GetDoc reads and unmarshals the document at the given key. It returns nil if
+// the key wasn't found, like Get.
+func (t *Typed[T]) GetDoc(ctx context.Context, key string) (*T, *GetStats, error) {
+	value, stats, err := t.b.Get(ctx, key)
+	if err != nil || value == nil {
+		return nil, stats, err
+	}
+
+	doc := new(T)
+	err = t.unmarshal(value, doc)
+	if err != nil {
+		return nil, stats, fmt.Errorf("unmarshal(%s): %w", key, err)
+	}
+
+	return doc, stats, nil
+}
+
+func (t *Typed[T]) marshal(doc *T) ([]byte, error) {
+	switch t.format {
+	case BSON:
+		return bson.Marshal(doc)
+	case JSON:
+		return json.Marshal(doc)
+	default:
+		return nil, fmt.Errorf("invalid format: %d", t.format)
+	}
+}
+
+func (t *Typed[T]) unmarshal(value []byte, doc *T) error {
+	switch t.format {
+	case BSON:
+		return bson.Unmarshal(value, doc)
+	case JSON:
+		return json.Unmarshal(value, doc)
+	default:
+		return fmt.Errorf("invalid format: %d", t.format)
+	}
+}
@@ -0,0 +1,48 @@
+package blobby
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+type testDoc struct {
+	Name  string `bson:"name" json:"name"`
+	Count int    `bson:"count" json:"count"`
+}
+
+func TestTyped(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	errNoName := errors.New("name is required")
+	validate := func(d *testDoc) error {
+		if d.Name == "" {
+			return errNoName
+		}
+		return nil
+	}
+
+	for _, f := range []Format{BSON, JSON} {
+		tb := NewTyped(b, WithFormat[testDoc](f), WithValidator(validate))
+
+		key := fmt.Sprintf("doc%d", f)
+		_, err := tb.PutDoc(ctx, key, &testDoc{Name: "x", Count: 3})
+		require.NoError(t, err)
+
+		doc, _, err := tb.GetDoc(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, &testDoc{Name: "x", Count: 3}, doc)
+
+		_, err = tb.PutDoc(ctx, "invalid", &testDoc{})
+		require.ErrorIs(t, err, errNoName)
+
+		doc, _, err = tb.GetDoc(ctx, "invalid")
+		require.NoError(t, err)
+		require.Nil(t, doc)
+	}
+}
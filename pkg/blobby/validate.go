@@ -0,0 +1,85 @@
+package blobby
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Validator checks a value before it's written by Put. It should return an
+// error describing the problem if the value is invalid.
+type Validator func(key string, value []byte) error
+
+// ValidationError is returned by Put when a value is rejected by a validator.
+type ValidationError struct {
+	Namespace string
+	Key       string
+	Err       error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid value for key %q in namespace %q: %v", e.Key, e.Namespace, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ValidationError) Is(err error) bool {
+	_, ok := err.(*ValidationError)
+	return ok
+}
+
+type namespaceValidator struct {
+	namespace string
+	fn        Validator
+}
+
+// WithValidation adds a validator for values written to keys in the given
+// namespace, which is a key prefix. The empty namespace contains every key.
+// Values must pass every validator whose namespace contains their key.
+func WithValidation(namespace string, fn Validator) Option {
+	return func(b *Blobby) {
+		b.validators = append(b.validators, namespaceValidator{namespace, fn})
+	}
+}
+
+// validate runs the validators which apply to the given key.
+func (b *Blobby) validate(key string, value []byte) error {
+	for _, v := range b.validators {
+		if !strings.HasPrefix(key, v.namespace) {
+			continue
+		}
+
+		err := v.fn(key, value)
+		if err != nil {
+			return &ValidationError{Namespace: v.namespace, Key: key, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// RequireFields returns a validator which checks that values are BSON documents
+// containing all of the given top-level fields. It's a stand-in for a real
+// schema; use a custom Validator to enforce anything more elaborate, such as a
+// JSON Schema.
+func RequireFields(fields ...string) Validator {
+	return func(key string, value []byte) error {
+		raw := bson.Raw(value)
+		err := raw.Validate()
+		if err != nil {
+			return fmt.Errorf("not a BSON document: %w", err)
+		}
+
+		for _, f := range fields {
+			_, err := raw.LookupErr(f)
+			if err != nil {
+				return fmt.Errorf("missing field: %s", f)
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package blobby
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestValidate(t *testing.T) {
+	errTooBig := errors.New("too big")
+	b := &Blobby{}
+	for _, opt := range []Option{
+		WithValidation("users/", RequireFields("name", "email")),
+		WithValidation("", func(key string, value []byte) error {
+			if len(value) > 100 {
+				return errTooBig
+			}
+			return nil
+		}),
+	} {
+		opt(b)
+	}
+
+	good, err := bson.Marshal(bson.M{"name": "a", "email": "b"})
+	require.NoError(t, err)
+	bad, err := bson.Marshal(bson.M{"name": "a"})
+	require.NoError(t, err)
+
+	assert.NoError(t, b.validate("users/1", good))
+	assert.NoError(t, b.validate("other/1", bad))
+
+	err = b.validate("users/1", bad)
+	require.ErrorIs(t, err, &ValidationError{})
+	var ve *ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "users/", ve.Namespace)
+
+	assert.Error(t, b.validate("users/1", []byte("not bson")))
+	assert.ErrorIs(t, b.validate("other/1", make([]byte, 101)), errTooBig)
+}
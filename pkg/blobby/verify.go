@@ -0,0 +1,170 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// WithVerifyReads resolves the given fraction (between 0 and 1) of Gets a second
+// time, the slow way, and logs any discrepancy to the given logger at error
+// level. This is meant to catch bugs in the way Get masks older versions (e.g.
+// the order of memtables and sstables, or sstables missing from the index) in
+// production, before they're noticed by users.
+//
+// The slow way reads every version of the key from every memtable, and from
+// every sstable whose key range includes it, according to the full list of
+// sstables rather than the index, and picks the newest by timestamp. It's slow
+// and expensive, so keep the rate low. Verified gets take longer, since they're
+// checked before returning. Only Gets from SourceAll which weren't degraded are
+// verified.
+func WithVerifyReads(l *slog.Logger, rate float64) Option {
+	return func(b *Blobby) {
+		b.verify.log = l
+		b.verify.rate = min(rate, 1)
+	}
+}
+
+// verifier is the state of WithVerifyReads.
+type verifier struct {
+	log  *slog.Logger
+	rate float64
+
+	verified   atomic.Int64
+	mismatches atomic.Int64
+}
+
+// readMismatch is a discrepancy found by verifyGet.
+type readMismatch struct {
+	Key string
+
+	// The timestamp and source of the version returned by Get, and of the
+	// newest version. A zero timestamp means that no version was found.
+	Got        time.Time
+	GotSource  string
+	Want       time.Time
+	WantSource string
+}
+
+// maybeVerify samples the given get, which started at the given time and
+// returned rec (which might be nil) with the given stats, and if it's sampled,
+// checks it against resolve. Nothing is returned, since the get succeeded.
+func (b *Blobby) maybeVerify(ctx context.Context, key string, start time.Time, rec *types.Record, stats *GetStats) {
+	v := &b.verify
+	if v.rate <= 0 || stats == nil || stats.Degraded || rand.Float64() >= v.rate {
+		return
+	}
+
+	mm, err := b.verifyGet(ctx, key, start, rec, stats)
+	if err != nil {
+		if v.log != nil {
+			v.log.LogAttrs(ctx, slog.LevelWarn, "couldn't verify get",
+				slog.String("archive", b.name),
+				slog.String("key", key),
+				slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	v.verified.Add(1)
+	if mm == nil {
+		return
+	}
+
+	v.mismatches.Add(1)
+	if v.log != nil {
+		v.log.LogAttrs(ctx, slog.LevelError, "get returned wrong version",
+			slog.String("archive", b.name),
+			slog.String("key", key),
+			slog.Time("got", mm.Got),
+			slog.String("got_source", mm.GotSource),
+			slog.Time("want", mm.Want),
+			slog.String("want_source", mm.WantSource))
+	}
+}
+
+// verifyGet returns a readMismatch if rec, which was returned by a get of the
+// given key which started at the given time, isn't the newest version according
+// to resolve, or nil if it is. If the newest version was written after the get
+// started, it's not a mismatch, since the get might not have seen it. The start
+// is truncated to milliseconds, like the timestamps in the memtable.
+func (b *Blobby) verifyGet(ctx context.Context, key string, start time.Time, rec *types.Record, stats *GetStats) (*readMismatch, error) {
+	want, wantSource, err := b.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var got time.Time
+	if rec != nil {
+		got = rec.Timestamp
+	}
+
+	var wantTime time.Time
+	if want != nil {
+		wantTime = want.Timestamp
+		if !wantTime.Before(start.Truncate(time.Millisecond)) {
+			return nil, nil
+		}
+	}
+
+	if got.Equal(wantTime) {
+		return nil, nil
+	}
+
+	return &readMismatch{
+		Key:        key,
+		Got:        got,
+		GotSource:  stats.Source,
+		Want:       wantTime,
+		WantSource: wantSource,
+	}, nil
+}
+
+// resolve returns the newest version of the given key, and where it was found,
+// by reading every version from the memtables and from every sstable whose key
+// range includes it. It's independent of the order of the memtables and of
+// metadata.GetContaining, so it can be used to check them. The document is not
+// decoded.
+func (b *Blobby) resolve(ctx context.Context, key string) (*types.Record, string, error) {
+	recs, err := b.mt.GetAll(ctx, key, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, "", fmt.Errorf("memtable.GetAll: %w", err)
+	}
+
+	var newest *types.Record
+	source := ""
+	for _, rec := range recs {
+		if newest == nil || rec.Timestamp.After(newest.Timestamp) {
+			newest, source = rec, "memtable"
+		}
+	}
+
+	metas, err := b.md.GetAllMetas(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("metadata.GetAllMetas: %w", err)
+	}
+
+	for _, m := range metas {
+		if key < m.MinKey || key > m.MaxKey {
+			continue
+		}
+
+		found, _, err := b.bs.FindAll(ctx, m, key)
+		if err != nil {
+			return nil, "", fmt.Errorf("blobstore.FindAll(%s): %w", m.Filename(), err)
+		}
+
+		for _, rec := range found {
+			if newest == nil || rec.Timestamp.After(newest.Timestamp) {
+				newest, source = rec, m.Filename()
+			}
+		}
+	}
+
+	return newest, source, nil
+}
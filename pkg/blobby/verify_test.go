@@ -0,0 +1,62 @@
+package blobby
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReads(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, _, b := setup(t, c)
+
+	var buf bytes.Buffer
+	WithVerifyReads(slog.New(slog.NewTextHandler(&buf, nil)), 1)(b)
+
+	_, err := b.Put(ctx, "a", []byte("a1"))
+	require.NoError(t, err)
+	c.Advance(time.Second)
+	_, err = b.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	c.Advance(time.Second)
+	_, err = b.Put(ctx, "a", []byte("a2"))
+	require.NoError(t, err)
+	_, err = b.Put(ctx, "k", []byte("k1"))
+	require.NoError(t, err)
+
+	// write a newer version of k straight to an sstable, which the memtable
+	// masks, since it's checked first.
+	c.Advance(time.Second)
+	target := ArchiveTarget(b)
+	require.NoError(t, target.Write(ctx, &Record{Key: "k", Timestamp: c.Now(), Document: []byte("k2")}))
+	require.NoError(t, target.Close(ctx))
+	c.Advance(time.Second)
+
+	v, _, err := b.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a2"), v)
+
+	_, _, err = b.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), b.Stats().VerifiedGets)
+	assert.Equal(t, int64(0), b.Stats().ReadMismatches)
+
+	v, _, err = b.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("k1"), v)
+	assert.Equal(t, int64(3), b.Stats().VerifiedGets)
+	assert.Equal(t, int64(1), b.Stats().ReadMismatches)
+	assert.Contains(t, buf.String(), "get returned wrong version")
+	assert.Contains(t, buf.String(), "key=k")
+
+	// only gets from all sources are verified.
+	_, _, _, err = b.GetWithOptions(ctx, "k", GetOptions{Source: SourceSSTables})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), b.Stats().VerifiedGets)
+}
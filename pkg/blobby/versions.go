@@ -0,0 +1,101 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+type Record = types.Record
+
+// GetVersionsBetween returns every version of the given key with a timestamp
+// in [from, to), from both the memtables and the sstables, newest first. A zero
+// from or to is unbounded. The documents are decoded.
+//
+// Sstables whose time range doesn't overlap the window aren't fetched, so this
+// is cheap for narrow windows, but might be very slow for wide ones.
+//
+// It's authorized and counted against quotas like Get.
+func (b *Blobby) GetVersionsBetween(ctx context.Context, key string, from, to time.Time) ([]*Record, error) {
+	err := b.authorize(ctx, MethodGet, key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.admit(ctx, MethodGet, key, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	recs, err := b.mt.GetAll(ctx, key, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("memtable.GetAll: %w", err)
+	}
+
+	metas, err := b.getContaining(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range metas {
+		if !overlaps(m, from, to) {
+			continue
+		}
+
+		found, bstats, err := b.bs.FindAll(ctx, m, key)
+		if err != nil {
+			return nil, fmt.Errorf("blobstore.FindAll(%s): %w", m.Filename(), err)
+		}
+		if !bstats.Filtered {
+			b.recordAccess(m)
+		}
+
+		for _, rec := range found {
+			if inRange(rec.Timestamp, from, to) {
+				recs = append(recs, rec)
+			}
+		}
+	}
+
+	// newest first. the same record might have been read from both a memtable
+	// and an sstable, if a flush was in progress, so drop duplicates.
+	slices.SortStableFunc(recs, func(a, b *Record) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	recs = slices.CompactFunc(recs, func(a, b *Record) bool {
+		return a.Timestamp.Equal(b.Timestamp)
+	})
+
+	for _, rec := range recs {
+		rec.Document, err = b.decode(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return recs, nil
+}
+
+// overlaps returns true if the time range of the given sstable overlaps with
+// [from, to). A zero from or to is unbounded.
+func overlaps(m *sstable.Meta, from, to time.Time) bool {
+	if !from.IsZero() && m.MaxTime.Before(from) {
+		return false
+	}
+
+	if !to.IsZero() && !m.MinTime.Before(to) {
+		return false
+	}
+
+	return true
+}
+
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
@@ -0,0 +1,53 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlaps(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &sstable.Meta{MinTime: t0, MaxTime: t0.Add(time.Hour)}
+	var zero time.Time
+
+	assert.True(t, overlaps(m, zero, zero))
+	assert.True(t, overlaps(m, t0.Add(-time.Hour), t0.Add(time.Minute)))
+	assert.True(t, overlaps(m, t0.Add(time.Hour), zero))     // from is inclusive
+	assert.False(t, overlaps(m, zero, t0))                   // to is exclusive
+	assert.False(t, overlaps(m, t0.Add(2*time.Hour), zero))  // after
+	assert.False(t, overlaps(m, zero, t0.Add(-time.Minute))) // before
+}
+
+func TestGetVersionsBetween(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second)
+	c := clockwork.NewFakeClockAt(t0)
+	ctx, _, b := setup(t, c)
+
+	// three versions in sstables, and one in the memtable.
+	for i := 0; i < 4; i++ {
+		_, err := b.Put(ctx, "k", []byte{byte('a' + i)})
+		require.NoError(t, err)
+		if i < 3 {
+			_, err = b.Flush(ctx, FlushOptions{})
+			require.NoError(t, err)
+		}
+		c.Advance(time.Hour)
+	}
+
+	recs, err := b.GetVersionsBetween(ctx, "k", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, recs, 4)
+	assert.Equal(t, []byte("d"), recs[0].Document)
+	assert.Equal(t, []byte("a"), recs[3].Document)
+
+	recs, err = b.GetVersionsBetween(ctx, "k", t0.Add(time.Hour), t0.Add(3*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, []byte("c"), recs[0].Document)
+	assert.Equal(t, []byte("b"), recs[1].Document)
+}
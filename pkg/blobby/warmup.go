@@ -0,0 +1,123 @@
+package blobby
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/sstable"
+	"golang.org/x/sync/errgroup"
+)
+
+// WarmupOptions configures Warmup.
+type WarmupOptions struct {
+	// Indexes is the number of the newest sstables whose indexes, including
+	// their filters, are loaded into the index cache. Zero loads none, and a
+	// negative number loads every live sstable's. Loading more than the size
+	// of the index cache (see blobstore.WithIndexCache) just evicts the first.
+	Indexes int
+}
+
+type WarmupStats struct {
+	// The number of live sstables whose metadata was read.
+	SSTables int
+
+	// The number of those whose filter is in the metadata (see
+	// WithInlineFilters), so needn't be fetched from the blobstore.
+	InlineFilters int
+
+	// The number of indexes which are now in the index cache.
+	Indexes int
+
+	// True if the manifest was loaded for degraded reads. See
+	// WithDegradedReads.
+	Manifest bool
+
+	// How long it took.
+	Duration time.Duration
+}
+
+// WithWarmup makes Open call Warmup with the given options before returning,
+// so the first reads after a deploy don't all miss the caches at once. Open
+// fails if the warmup does. The stats are available from Stats.Warmup.
+func WithWarmup(opts WarmupOptions) Option {
+	return func(b *Blobby) {
+		b.warmupOpts = &opts
+	}
+}
+
+// Warmup reads the metadata of every live sstable, newest first, including its
+// inline filter, so Mongo has it in memory; loads the indexes of the newest
+// sstables into the index cache; and, if degraded reads are enabled, fetches the
+// manifest. It's usually called by Open (see WithWarmup), but can be called
+// again at any time, e.g. after a failover of the Mongo cluster.
+func (b *Blobby) Warmup(ctx context.Context, opts WarmupOptions) (*WarmupStats, error) {
+	ctx = blobstore.WithOpClass(ctx, blobstore.ClassGet)
+	start := b.clock.Now()
+	stats := &WarmupStats{}
+
+	// newest first, so the indexes loaded are of the sstables which are most
+	// likely to contain recently written keys.
+	var newest []*sstable.Meta
+	err := b.md.EachMeta(ctx, ListOptions{Order: ByCreated, Desc: true}, func(m *sstable.Meta) error {
+		stats.SSTables++
+		if m.Filter != nil {
+			stats.InlineFilters++
+		}
+		if opts.Indexes < 0 || len(newest) < opts.Indexes {
+			newest = append(newest, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("metadata.EachMeta: %w", err)
+	}
+
+	stats.Indexes, err = b.warmIndexes(ctx, newest)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.degraded.enabled {
+		_, err = b.degradedManifest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("degradedManifest: %w", err)
+		}
+		stats.Manifest = true
+	}
+
+	stats.Duration = b.clock.Since(start)
+	return stats, nil
+}
+
+// warmIndexes loads the indexes of the given sstables into the index cache, and
+// returns how many there were. Unlike prefetch, it never fetches the sstables
+// themselves, even if there's a blob cache.
+func (b *Blobby) warmIndexes(ctx context.Context, metas []*sstable.Meta) (int, error) {
+	var n atomic.Int64
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(PrefetchConcurrency)
+
+	for _, m := range metas {
+		g.Go(func() error {
+			ix, err := b.bs.Index(ctx, m)
+			if err != nil {
+				return fmt.Errorf("blobstore.Index(%s): %w", m.Filename(), err)
+			}
+			if ix != nil {
+				n.Add(1)
+			}
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Load()), nil
+}
@@ -0,0 +1,47 @@
+package blobby
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmup(t *testing.T) {
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	ctx, env, _ := setup(t, c)
+
+	// three sstables, only the newest two of which have inline filters.
+	b1 := New(env.MongoURL(), env.S3Bucket, c)
+	require.NoError(t, b1.Open(ctx))
+	tb := &testBlobby{ctx: ctx, c: c, t: t, b: b1}
+	tb.put("a", []byte("a"))
+	_, err := b1.Flush(ctx, FlushOptions{})
+	require.NoError(t, err)
+
+	b2 := New(env.MongoURL(), env.S3Bucket, c, WithInlineFilters(1<<10))
+	require.NoError(t, b2.Open(ctx))
+	tb.b = b2
+	for _, k := range []string{"b", "c"} {
+		c.Advance(time.Second)
+		tb.put(k, []byte(k))
+		_, err := b2.Flush(ctx, FlushOptions{})
+		require.NoError(t, err)
+	}
+	_, err = b2.PublishManifest(ctx)
+	require.NoError(t, err)
+
+	// without the option, nothing is warmed up.
+	assert.Nil(t, b2.Stats().Warmup)
+
+	b3 := New(env.MongoURL(), env.S3Bucket, c, WithDegradedReads(0), WithWarmup(WarmupOptions{Indexes: 2}))
+	require.NoError(t, b3.Open(ctx))
+	assert.Equal(t, &WarmupStats{SSTables: 3, InlineFilters: 2, Indexes: 2, Manifest: true}, b3.Stats().Warmup)
+
+	stats, err := b3.Warmup(ctx, WarmupOptions{Indexes: -1})
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Indexes)
+	assert.True(t, stats.Manifest)
+}
@@ -0,0 +1,15 @@
+package blobby
+
+import (
+	"context"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+type Window = metadata.Window
+
+// Windows returns the summary of each window of creation time which the live
+// sstables are partitioned into, oldest first. See metadata.Window.
+func (b *Blobby) Windows(ctx context.Context) ([]*Window, error) {
+	return b.md.GetWindows(ctx)
+}
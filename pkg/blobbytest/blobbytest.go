@@ -0,0 +1,45 @@
+// Package blobbytest provides in-memory fakes of the memtable and the metadata
+// store, so that tests of the archive can run without Mongo. Together with the
+// fake S3 from testdeps.WithFakeS3, they make a complete archive which starts
+// instantly; see NewFakeArchive.
+package blobbytest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+)
+
+// NewFakeArchive returns an initialized archive backed by a fake memtable, a
+// fake metadata store, and a fake S3, with the given options. Options which
+// only apply to Mongo, like WithMongoClient and WithAudit, shouldn't be given.
+func NewFakeArchive(t testing.TB, clock clockwork.Clock, opts ...blobby.Option) *blobby.Blobby {
+	t.Helper()
+
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+
+	all := []blobby.Option{
+		blobby.WithMemtable(NewMemtable(clock)),
+		blobby.WithMetadata(NewMetadata()),
+	}
+	all = append(all, opts...)
+
+	// the URL is never used, since nothing is in Mongo.
+	b := blobby.New("", env.S3Bucket, clock, all...)
+
+	err := b.Init(ctx)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	err = b.Open(ctx)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	return b
+}
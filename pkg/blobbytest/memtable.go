@@ -0,0 +1,723 @@
+package blobbytest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/memtable"
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Memtable is an in-memory fake of memtable.Memtable. It behaves the same from
+// the outside, except that expired records are never deleted (they're still
+// skipped by reads and flushes), and nothing is shared with other processes.
+type Memtable struct {
+	clock clockwork.Clock
+
+	mu     sync.Mutex
+	seq    int
+	active string
+
+	// every memtable, active or flushing, oldest first.
+	tables []*fakeTable
+}
+
+var _ blobby.Memtable = (*Memtable)(nil)
+
+type fakeTable struct {
+	name     string
+	created  time.Time
+	flushing bool
+	partial  bool
+	claimed  time.Time
+	recs     []*types.Record
+}
+
+// NewMemtable returns an empty memtable, which must be initialized by Init
+// before use, like a real one.
+func NewMemtable(clock clockwork.Clock) *Memtable {
+	return &Memtable{clock: clock}
+}
+
+// stored returns a copy of the given record, as it would be after a round trip
+// through Mongo, which truncates the times to milliseconds in UTC.
+func stored(rec *types.Record) *types.Record {
+	out := &types.Record{}
+	roundTrip(rec, out)
+	return out
+}
+
+// roundTrip copies in to out via BSON, like storing it in Mongo and reading it
+// back. The values are always encodable, so errors are bugs.
+func roundTrip(in, out any) {
+	b, err := bson.Marshal(in)
+	if err != nil {
+		panic(fmt.Sprintf("bson.Marshal: %v", err))
+	}
+
+	err = bson.Unmarshal(b, out)
+	if err != nil {
+		panic(fmt.Sprintf("bson.Unmarshal: %v", err))
+	}
+}
+
+func (mt *Memtable) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (mt *Memtable) Init(ctx context.Context) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.active == "" {
+		mt.active = mt.createNext().name
+	}
+
+	return nil
+}
+
+func (mt *Memtable) Initialized(ctx context.Context) (bool, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	return mt.active != "", nil
+}
+
+func (mt *Memtable) Destroy(ctx context.Context) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.tables = nil
+	mt.active = ""
+	return nil
+}
+
+// createNext adds a new empty memtable. The caller must hold mu.
+func (mt *Memtable) createNext() *fakeTable {
+	mt.seq++
+	t := &fakeTable{
+		name:    fmt.Sprintf("mt_%d", mt.seq),
+		created: mt.clock.Now(),
+	}
+
+	mt.tables = append(mt.tables, t)
+	return t
+}
+
+// find returns the memtable with the given name, or nil. The caller must hold
+// mu.
+func (mt *Memtable) find(name string) *fakeTable {
+	for _, t := range mt.tables {
+		if t.name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// newestFirst returns every memtable, newest first. The caller must hold mu.
+func (mt *Memtable) newestFirst() []*fakeTable {
+	ts := slices.Clone(mt.tables)
+	slices.Reverse(ts)
+	return ts
+}
+
+// findIdempotent returns the name of the memtable containing a record with the
+// same key and idempotency key as the given one. The caller must hold mu.
+func (mt *Memtable) findIdempotent(rec *types.Record) string {
+	for _, t := range mt.newestFirst() {
+		for _, r := range t.recs {
+			if r.Key == rec.Key && r.IdempotencyKey == rec.IdempotencyKey {
+				return t.name
+			}
+		}
+	}
+
+	return ""
+}
+
+// expired returns true if the given record had expired at the given time.
+func expired(r *types.Record, now time.Time) bool {
+	return !r.Expires.IsZero() && !r.Expires.After(now)
+}
+
+func (t *fakeTable) at(key string, ts time.Time) *types.Record {
+	for _, r := range t.recs {
+		if r.Key == key && r.Timestamp.Equal(ts) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (mt *Memtable) PutRecord(ctx context.Context, rec *types.Record) (string, error) {
+	for {
+		mt.mu.Lock()
+		if mt.active == "" {
+			mt.mu.Unlock()
+			return "", fmt.Errorf("memtable not initialized")
+		}
+
+		if rec.IdempotencyKey != "" {
+			if name := mt.findIdempotent(rec); name != "" {
+				mt.mu.Unlock()
+				return name, nil
+			}
+		}
+
+		rec.Timestamp = mt.clock.Now()
+		s := stored(rec)
+		t := mt.find(mt.active)
+		if t.at(s.Key, s.Timestamp) == nil {
+			t.recs = append(t.recs, s)
+			mt.mu.Unlock()
+			return t.name, nil
+		}
+		mt.mu.Unlock()
+
+		// like the real one, wait for a new timestamp.
+		mt.clock.Sleep(time.Millisecond)
+	}
+}
+
+func (mt *Memtable) PutBatch(ctx context.Context, recs []*types.Record) (string, error) {
+	var untimed []*types.Record
+	var name string
+
+	mt.mu.Lock()
+	if mt.active == "" {
+		mt.mu.Unlock()
+		return "", fmt.Errorf("memtable not initialized")
+	}
+
+	t := mt.find(mt.active)
+	var conflict error
+	for _, rec := range recs {
+		if rec.Timestamp.IsZero() {
+			untimed = append(untimed, rec)
+			continue
+		}
+
+		name = t.name
+		s := stored(rec)
+		if existing := t.at(s.Key, s.Timestamp); existing != nil {
+			if conflict == nil && (existing.Codec != s.Codec || !bytes.Equal(existing.Document, s.Document)) {
+				conflict = &memtable.TimestampConflict{Key: s.Key, Timestamp: s.Timestamp}
+			}
+			continue
+		}
+
+		if s.IdempotencyKey != "" && slices.ContainsFunc(t.recs, func(r *types.Record) bool {
+			return r.Key == s.Key && r.IdempotencyKey == s.IdempotencyKey
+		}) {
+			continue
+		}
+
+		t.recs = append(t.recs, s)
+	}
+	mt.mu.Unlock()
+
+	if conflict != nil {
+		return name, conflict
+	}
+
+	for _, rec := range untimed {
+		var err error
+		name, err = mt.PutRecord(ctx, rec)
+		if err != nil {
+			return "", fmt.Errorf("PutRecord: %w", err)
+		}
+	}
+
+	return name, nil
+}
+
+func (mt *Memtable) Get(ctx context.Context, key string) (*types.Record, string, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var newest *types.Record
+	var name string
+	now := mt.clock.Now()
+	for _, t := range mt.newestFirst() {
+		for _, r := range t.recs {
+			if r.Key == key && !expired(r, now) && (newest == nil || r.Timestamp.After(newest.Timestamp)) {
+				newest, name = r, t.name
+			}
+		}
+	}
+
+	if newest == nil {
+		return nil, "", &memtable.NotFound{Key: key}
+	}
+
+	return stored(newest), name, nil
+}
+
+func (mt *Memtable) GetAll(ctx context.Context, key string, from, to time.Time) ([]*types.Record, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var out []*types.Record
+	now := mt.clock.Now()
+	for _, t := range mt.newestFirst() {
+		var batch []*types.Record
+		for _, r := range t.recs {
+			if r.Key != key || expired(r, now) || (!from.IsZero() && r.Timestamp.Before(from)) || (!to.IsZero() && !r.Timestamp.Before(to)) {
+				continue
+			}
+			batch = append(batch, stored(r))
+		}
+
+		slices.SortFunc(batch, func(a, b *types.Record) int {
+			return b.Timestamp.Compare(a.Timestamp)
+		})
+		out = append(out, batch...)
+	}
+
+	return out, nil
+}
+
+func (mt *Memtable) Since(ctx context.Context, from time.Time) ([]*types.Record, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var out []*types.Record
+	now := mt.clock.Now()
+	for _, t := range mt.tables {
+		var batch []*types.Record
+		for _, r := range t.recs {
+			if !r.Timestamp.Before(from) && !expired(r, now) {
+				batch = append(batch, stored(r))
+			}
+		}
+
+		slices.SortStableFunc(batch, func(a, b *types.Record) int {
+			return a.Timestamp.Compare(b.Timestamp)
+		})
+		out = append(out, batch...)
+	}
+
+	slices.SortStableFunc(out, func(a, b *types.Record) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return out, nil
+}
+
+func (mt *Memtable) Sample(ctx context.Context, n int) ([]*types.Record, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	total := 0
+	for _, t := range mt.tables {
+		total += len(t.recs)
+	}
+	if total == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	var out []*types.Record
+	for _, t := range mt.newestFirst() {
+		size := (n*len(t.recs) + total - 1) / total
+		for _, i := range rand.Perm(len(t.recs))[:min(size, len(t.recs))] {
+			out = append(out, stored(t.recs[i]))
+		}
+	}
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out, nil
+}
+
+func (mt *Memtable) Count(ctx context.Context) (int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	n := 0
+	for _, t := range mt.tables {
+		n += len(t.recs)
+	}
+
+	return n, nil
+}
+
+func (mt *Memtable) CountRange(ctx context.Context, start, end string) (int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	n := 0
+	for _, t := range mt.tables {
+		for _, r := range t.recs {
+			if inRange(r.Key, start, end) {
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// inRange returns true if key is in [start, end), or after start if end is
+// empty.
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+func (mt *Memtable) Names(ctx context.Context) ([]string, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var names []string
+	for _, t := range mt.newestFirst() {
+		names = append(names, t.name)
+	}
+
+	return names, nil
+}
+
+// RangeIter reads the whole range up front, rather than in batches like the
+// real one, so memtables dropped after it returns are still read in full.
+func (mt *Memtable) RangeIter(ctx context.Context, names []string, start, end string) (blobby.MemtableIter, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	type ordered struct {
+		rec   *types.Record
+		order int
+	}
+
+	var recs []ordered
+	it := &rangeIter{}
+	now := mt.clock.Now()
+	for i, name := range names {
+		t := mt.find(name)
+		if t == nil {
+			it.dropped = append(it.dropped, &memtable.Dropped{Name: name, Key: start})
+			continue
+		}
+
+		for _, r := range t.recs {
+			if inRange(r.Key, start, end) && !expired(r, now) {
+				recs = append(recs, ordered{stored(r), i})
+			}
+		}
+	}
+
+	slices.SortFunc(recs, func(a, b ordered) int {
+		if a.rec.Key != b.rec.Key {
+			if a.rec.Key < b.rec.Key {
+				return -1
+			}
+			return 1
+		}
+		if c := b.rec.Timestamp.Compare(a.rec.Timestamp); c != 0 {
+			return c
+		}
+		return a.order - b.order
+	})
+
+	for _, o := range recs {
+		it.recs = append(it.recs, o.rec)
+	}
+
+	return it, nil
+}
+
+type rangeIter struct {
+	recs    []*types.Record
+	dropped []*memtable.Dropped
+}
+
+func (it *rangeIter) Next(ctx context.Context) (*types.Record, error) {
+	if len(it.dropped) > 0 {
+		d := it.dropped[0]
+		it.dropped = it.dropped[1:]
+		return nil, d
+	}
+
+	if len(it.recs) == 0 {
+		return nil, nil
+	}
+
+	rec := it.recs[0]
+	it.recs = it.recs[1:]
+	return rec, nil
+}
+
+func (it *rangeIter) Close(ctx context.Context) {
+	it.recs = nil
+}
+
+func (mt *Memtable) Oldest(ctx context.Context) (time.Time, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var oldest time.Time
+	for _, t := range mt.tables {
+		o := t.oldest()
+		if !o.IsZero() && (oldest.IsZero() || o.Before(oldest)) {
+			oldest = o
+		}
+	}
+
+	return oldest, nil
+}
+
+func (t *fakeTable) oldest() time.Time {
+	var oldest time.Time
+	for _, r := range t.recs {
+		if oldest.IsZero() || r.Timestamp.Before(oldest) {
+			oldest = r.Timestamp
+		}
+	}
+
+	return oldest
+}
+
+// Stats reports the size of each memtable as the size of its records encoded as
+// BSON, which is roughly what Mongo reports.
+func (mt *Memtable) Stats(ctx context.Context) ([]*memtable.Stats, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	out := make([]*memtable.Stats, len(mt.tables))
+	for i, t := range mt.tables {
+		st := &memtable.Stats{
+			Name:    t.name,
+			Created: t.created,
+			Active:  t.name == mt.active,
+			Records: len(t.recs),
+			Oldest:  t.oldest(),
+		}
+
+		for _, r := range t.recs {
+			b, err := bson.Marshal(r)
+			if err != nil {
+				return nil, fmt.Errorf("bson.Marshal: %w", err)
+			}
+			st.Bytes += int64(len(b))
+		}
+
+		out[i] = st
+	}
+
+	return out, nil
+}
+
+func (mt *Memtable) Active(ctx context.Context) (blobby.MemtableHandle, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.active == "" {
+		return nil, fmt.Errorf("memtable not initialized")
+	}
+
+	return &Handle{mt: mt, name: mt.active}, nil
+}
+
+func (mt *Memtable) Rotate(ctx context.Context) (blobby.MemtableHandle, blobby.MemtableHandle, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	prev := mt.find(mt.active)
+	if prev == nil {
+		return nil, nil, fmt.Errorf("memtable not initialized")
+	}
+
+	next := mt.createNext()
+	mt.active = next.name
+	prev.flushing = true
+	prev.claimed = mt.clock.Now()
+
+	return &Handle{mt: mt, name: prev.name}, &Handle{mt: mt, name: next.name}, nil
+}
+
+func (mt *Memtable) FlushQueue(ctx context.Context) ([]blobby.MemtableHandle, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	var out []blobby.MemtableHandle
+	for _, t := range mt.tables {
+		if t.flushing {
+			out = append(out, &Handle{mt: mt, name: t.name})
+		}
+	}
+
+	return out, nil
+}
+
+func (mt *Memtable) Resume(ctx context.Context) (blobby.MemtableHandle, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	now := mt.clock.Now()
+	cutoff := now.Add(-memtable.ClaimTimeout)
+	for _, t := range mt.tables {
+		if t.flushing && (t.partial || t.claimed.Before(cutoff)) {
+			t.partial = false
+			t.claimed = now
+			return &Handle{mt: mt, name: t.name}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (mt *Memtable) Release(ctx context.Context, name string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if t := mt.find(name); t != nil && t.flushing {
+		t.claimed = time.Time{}
+	}
+
+	return nil
+}
+
+func (mt *Memtable) MarkPartial(ctx context.Context, name string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	t := mt.find(name)
+	if t == nil || !t.flushing {
+		return fmt.Errorf("memtable not flushing: %s", name)
+	}
+
+	t.partial = true
+	return nil
+}
+
+func (mt *Memtable) Drop(ctx context.Context, name string) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.tables = slices.DeleteFunc(mt.tables, func(t *fakeTable) bool {
+		return t.name == name
+	})
+
+	return nil
+}
+
+// Handle is a single memtable in a fake Memtable. Like a collection in Mongo,
+// it looks empty once it's been dropped.
+type Handle struct {
+	mt   *Memtable
+	name string
+}
+
+var _ blobby.MemtableHandle = (*Handle)(nil)
+
+func (h *Handle) Name() string {
+	return h.name
+}
+
+func (h *Handle) URL() string {
+	return "mem:///" + h.name
+}
+
+// records returns copies of the records in the memtable. The caller must hold
+// the lock of the memtable.
+func (h *Handle) records() []*types.Record {
+	t := h.mt.find(h.name)
+	if t == nil {
+		return nil
+	}
+
+	out := make([]*types.Record, len(t.recs))
+	for i, r := range t.recs {
+		out[i] = stored(r)
+	}
+
+	return out
+}
+
+func (h *Handle) Count(ctx context.Context) (int, error) {
+	h.mt.mu.Lock()
+	defer h.mt.mu.Unlock()
+
+	return len(h.records()), nil
+}
+
+func (h *Handle) Oldest(ctx context.Context) (time.Time, error) {
+	h.mt.mu.Lock()
+	defer h.mt.mu.Unlock()
+
+	t := h.mt.find(h.name)
+	if t == nil {
+		return time.Time{}, nil
+	}
+
+	return t.oldest(), nil
+}
+
+func (h *Handle) DeleteBelow(ctx context.Context, key string) (int, error) {
+	h.mt.mu.Lock()
+	defer h.mt.mu.Unlock()
+
+	t := h.mt.find(h.name)
+	if t == nil {
+		return 0, nil
+	}
+
+	n := len(t.recs)
+	t.recs = slices.DeleteFunc(t.recs, func(r *types.Record) bool {
+		return r.Key < key
+	})
+
+	return n - len(t.recs), nil
+}
+
+// FlushBatches sends the records which hadn't expired at now, sorted like the
+// real one, in batches of opts.BatchSize. They're all read up front.
+func (h *Handle) FlushBatches(ctx context.Context, ch chan *types.Record, now time.Time, opts memtable.StreamOptions) (*memtable.StreamStats, error) {
+	defer close(ch)
+
+	stats := &memtable.StreamStats{}
+	if opts.BatchSize <= 0 {
+		return stats, fmt.Errorf("invalid batch size: %d", opts.BatchSize)
+	}
+
+	h.mt.mu.Lock()
+	recs := slices.DeleteFunc(h.records(), func(r *types.Record) bool {
+		return expired(r, now)
+	})
+	h.mt.mu.Unlock()
+
+	slices.SortFunc(recs, func(a, b *types.Record) int {
+		if a.Key != b.Key {
+			if a.Key < b.Key {
+				return -1
+			}
+			return 1
+		}
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+
+	for batch := range slices.Chunk(recs, opts.BatchSize) {
+		for _, rec := range batch {
+			select {
+			case ch <- rec:
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			}
+		}
+
+		stats.Batches++
+		stats.Records += len(batch)
+	}
+
+	return stats, nil
+}
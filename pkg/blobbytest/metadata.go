@@ -0,0 +1,1130 @@
+package blobbytest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// Metadata is an in-memory fake of metadata.Store. Like the real one, every
+// sstable which goes in comes out as it would after a round trip through Mongo,
+// with its times truncated to milliseconds in UTC. It can't be watched (see
+// blobby.WatchMetadata), and the runtime config is only watched in-process.
+type Metadata struct {
+	mu          sync.Mutex
+	initialized bool
+
+	// every sstable, live or soft-deleted but not yet purged, in the order
+	// they were inserted.
+	sstables []*fakeSSTable
+	nextID   int
+
+	checkpoints map[string]*fakeCheckpoint
+	pending     map[string]*metadata.PendingCompaction
+	history     []*metadata.CompactionRecord
+	windows     map[time.Time]*metadata.Window
+	namespaces  map[string]*metadata.NamespaceConfig
+	usage       map[string]int64
+	access      map[string]metadata.Access
+	syncCursors map[string]time.Time
+	leases      map[string]fakeLease
+	features    []metadata.Feature
+	paused      []string
+	maintenance metadata.MaintenanceSchedule
+	config      metadata.RuntimeConfig
+	seq         int64
+	manifest    time.Time
+
+	// called with the runtime config when it changes.
+	configWatchers map[int]func(*metadata.RuntimeConfig)
+	nextWatcher    int
+}
+
+var _ blobby.Metadata = (*Metadata)(nil)
+
+type fakeSSTable struct {
+	id           int
+	meta         sstable.Meta
+	deleted      time.Time
+	claimedBy    string
+	claimedUntil time.Time
+}
+
+func (s *fakeSSTable) live() bool {
+	return s.deleted.IsZero()
+}
+
+type fakeCheckpoint struct {
+	cp      metadata.Checkpoint
+	members []*fakeSSTable
+}
+
+type fakeLease struct {
+	owner string
+	until time.Time
+}
+
+// NewMetadata returns an empty metadata store, which must be initialized by
+// Init before use, like a real one.
+func NewMetadata() *Metadata {
+	md := &Metadata{}
+	md.reset()
+	return md
+}
+
+// reset forgets everything. The caller must hold mu, unless it's new.
+func (md *Metadata) reset() {
+	md.initialized = false
+	md.sstables = nil
+	md.checkpoints = map[string]*fakeCheckpoint{}
+	md.pending = map[string]*metadata.PendingCompaction{}
+	md.history = nil
+	md.windows = map[time.Time]*metadata.Window{}
+	md.namespaces = map[string]*metadata.NamespaceConfig{}
+	md.usage = map[string]int64{}
+	md.access = map[string]metadata.Access{}
+	md.syncCursors = map[string]time.Time{}
+	md.leases = map[string]fakeLease{}
+	md.features = nil
+	md.paused = nil
+	md.maintenance = metadata.MaintenanceSchedule{}
+	md.config = metadata.RuntimeConfig{}
+	md.seq = 0
+	md.manifest = time.Time{}
+}
+
+// storedMeta returns a copy of the given meta, as it would be after a round trip
+// through Mongo.
+func storedMeta(m *sstable.Meta) *sstable.Meta {
+	out := &sstable.Meta{}
+	roundTrip(m, out)
+	return out
+}
+
+// metaKey identifies an sstable, like the filter which the real store uses.
+type metaKey struct {
+	created int64
+	minKey  string
+	maxKey  string
+}
+
+func keyOf(m *sstable.Meta) metaKey {
+	return metaKey{m.Created.UnixMilli(), m.MinKey, m.MaxKey}
+}
+
+// find returns the sstable matching the given meta, or nil. If live is true,
+// soft-deleted ones are ignored. The caller must hold mu.
+func (md *Metadata) find(m *sstable.Meta, live bool) *fakeSSTable {
+	k := keyOf(m)
+	for _, s := range md.sstables {
+		if keyOf(&s.meta) == k && (!live || s.live()) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// liveMetas returns copies of the live sstables matching the given func. The
+// caller must hold mu.
+func (md *Metadata) liveMetas(match func(*sstable.Meta) bool) []*sstable.Meta {
+	var out []*sstable.Meta
+	for _, s := range md.sstables {
+		if s.live() && match(&s.meta) {
+			out = append(out, storedMeta(&s.meta))
+		}
+	}
+
+	return out
+}
+
+// insert adds the given sstables to the live set, widening their windows. The
+// caller must hold mu.
+func (md *Metadata) insert(metas []*sstable.Meta) {
+	for _, m := range metas {
+		md.nextID++
+		md.sstables = append(md.sstables, &fakeSSTable{id: md.nextID, meta: *storedMeta(m)})
+	}
+
+	md.widenWindows(metas)
+}
+
+func windowOf(t time.Time) time.Time {
+	return t.UTC().Truncate(metadata.WindowWidth)
+}
+
+// widenWindows is like the real one. The caller must hold mu.
+func (md *Metadata) widenWindows(metas []*sstable.Meta) {
+	for _, m := range metas {
+		m = storedMeta(m)
+		start := windowOf(m.Created)
+		w, ok := md.windows[start]
+		if !ok {
+			md.windows[start] = &metadata.Window{Start: start, MinKey: m.MinKey, MaxKey: m.MaxKey, MaxTime: m.MaxTime, Count: 1}
+			continue
+		}
+
+		w.MinKey = min(w.MinKey, m.MinKey)
+		w.MaxKey = max(w.MaxKey, m.MaxKey)
+		if m.MaxTime.After(w.MaxTime) {
+			w.MaxTime = m.MaxTime
+		}
+		w.Count++
+	}
+}
+
+func (md *Metadata) Init(ctx context.Context) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.initialized = true
+	return nil
+}
+
+func (md *Metadata) Initialized(ctx context.Context) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return md.initialized, nil
+}
+
+// CheckSchema always succeeds, since the fake has no schema to migrate.
+func (md *Metadata) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+func (md *Metadata) Migrate(ctx context.Context) ([]metadata.Migration, error) {
+	return nil, nil
+}
+
+func (md *Metadata) CheckFeatures(ctx context.Context) error {
+	return nil
+}
+
+func (md *Metadata) HasFeature(ctx context.Context, f metadata.Feature) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return slices.Contains(md.features, f), nil
+}
+
+func (md *Metadata) EnableFeature(ctx context.Context, f metadata.Feature) error {
+	if f != metadata.FeatureBlocks {
+		return fmt.Errorf("%w: %s", metadata.ErrUnsupportedFeature, f)
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if !slices.Contains(md.features, f) {
+		md.features = append(md.features, f)
+	}
+
+	return nil
+}
+
+// Destroy forgets the sstables, checkpoints, and everything else which the real
+// one keeps in its own collections. The settings which it keeps in the meta
+// collection, which it shares with the memtable, are left alone.
+func (md *Metadata) Destroy(ctx context.Context) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.initialized = false
+	md.sstables = nil
+	md.checkpoints = map[string]*fakeCheckpoint{}
+	md.pending = map[string]*metadata.PendingCompaction{}
+	md.history = nil
+	md.windows = map[time.Time]*metadata.Window{}
+	md.namespaces = map[string]*metadata.NamespaceConfig{}
+	md.usage = map[string]int64{}
+	md.access = map[string]metadata.Access{}
+	md.leases = map[string]fakeLease{}
+	return nil
+}
+
+func (md *Metadata) DropDatabase(ctx context.Context) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.reset()
+	return nil
+}
+
+func (md *Metadata) Insert(ctx context.Context, meta *sstable.Meta) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.insert([]*sstable.Meta{meta})
+	return nil
+}
+
+func (md *Metadata) SetIndex(ctx context.Context, meta *sstable.Meta) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	s := md.find(meta, true)
+	if s == nil {
+		return fmt.Errorf("expected to update 1 record, matched 0")
+	}
+
+	m := storedMeta(meta)
+	s.meta.Index = m.Index
+	s.meta.Filter = m.Filter
+	return nil
+}
+
+func (md *Metadata) NextSeq(ctx context.Context, n int64) (int64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("invalid number of sequence numbers: %d", n)
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.seq += n
+	return md.seq - n + 1, nil
+}
+
+// newestFirst sorts metas like the real GetContaining.
+func newestFirst(metas []*sstable.Meta) {
+	slices.SortStableFunc(metas, func(a, b *sstable.Meta) int {
+		if c := b.MaxTime.Compare(a.MaxTime); c != 0 {
+			return c
+		}
+		if a.LargestSeq != b.LargestSeq {
+			if a.LargestSeq > b.LargestSeq {
+				return -1
+			}
+			return 1
+		}
+		return b.Created.Compare(a.Created)
+	})
+}
+
+func (md *Metadata) GetContaining(ctx context.Context, key string) ([]*sstable.Meta, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	metas := md.liveMetas(func(m *sstable.Meta) bool {
+		return m.MinKey <= key && m.MaxKey >= key
+	})
+
+	newestFirst(metas)
+	return metas, nil
+}
+
+func (md *Metadata) GetOverlapping(ctx context.Context, start, end string) ([]*sstable.Meta, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	metas := md.liveMetas(func(m *sstable.Meta) bool {
+		return m.MaxKey >= start && (end == "" || m.MinKey < end)
+	})
+
+	newestFirst(metas)
+	return metas, nil
+}
+
+func (md *Metadata) GetAllMetas(ctx context.Context) ([]*sstable.Meta, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	metas := md.liveMetas(func(*sstable.Meta) bool { return true })
+	slices.SortStableFunc(metas, func(a, b *sstable.Meta) int {
+		if c := strings.Compare(a.MinKey, b.MinKey); c != 0 {
+			return c
+		}
+		return b.MaxTime.Compare(a.MaxTime)
+	})
+
+	return metas, nil
+}
+
+// listed returns the live sstables matching the given options, in order. The
+// caller must hold mu.
+func (md *Metadata) listed(opts metadata.ListOptions) []*fakeSSTable {
+	var out []*fakeSSTable
+	for _, s := range md.sstables {
+		if !s.live() {
+			continue
+		}
+		if !opts.MinTime.IsZero() && s.meta.MaxTime.Before(opts.MinTime) {
+			continue
+		}
+		if !opts.MaxTime.IsZero() && s.meta.MinTime.After(opts.MaxTime) {
+			continue
+		}
+		out = append(out, s)
+	}
+
+	slices.SortFunc(out, func(a, b *fakeSSTable) int {
+		c := compareBy(opts.Order, a, b)
+		if opts.Desc {
+			c = -c
+		}
+		return c
+	})
+
+	return out
+}
+
+// compareBy compares two sstables by the given order, then by ID.
+func compareBy(o metadata.ListOrder, a, b *fakeSSTable) int {
+	var c int
+	switch o {
+	case metadata.ByCreated:
+		c = a.meta.Created.Compare(b.meta.Created)
+	case metadata.BySize:
+		c = a.meta.Size - b.meta.Size
+	default:
+		c = strings.Compare(a.meta.MinKey, b.meta.MinKey)
+	}
+
+	if c != 0 {
+		return c
+	}
+
+	return a.id - b.id
+}
+
+func listedMeta(s *fakeSSTable, opts metadata.ListOptions) *sstable.Meta {
+	m := storedMeta(&s.meta)
+	if opts.SkipFilters {
+		m.Filter = nil
+	}
+	return m
+}
+
+func (md *Metadata) EachMeta(ctx context.Context, opts metadata.ListOptions, fn func(*sstable.Meta) error) error {
+	md.mu.Lock()
+	ss := md.listed(opts)
+	metas := make([]*sstable.Meta, len(ss))
+	for i, s := range ss {
+		metas[i] = listedMeta(s, opts)
+	}
+	md.mu.Unlock()
+
+	for _, m := range metas {
+		err := fn(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListMetas returns tokens which hold the ID of the last sstable in the page,
+// which is found again by ID to resume after it, since soft-deleted sstables
+// aren't forgotten until they're purged.
+func (md *Metadata) ListMetas(ctx context.Context, opts metadata.ListOptions) ([]*sstable.Meta, string, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	ss := md.listed(opts)
+	if opts.After != "" {
+		b, err := base64.RawURLEncoding.DecodeString(opts.After)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid list token: %w", err)
+		}
+		id, err := strconv.Atoi(string(b))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid list token: %w", err)
+		}
+
+		i := slices.IndexFunc(md.sstables, func(s *fakeSSTable) bool { return s.id == id })
+		if i < 0 {
+			return nil, "", fmt.Errorf("invalid list token: sstable purged")
+		}
+
+		after := md.sstables[i]
+		ss = slices.DeleteFunc(ss, func(s *fakeSSTable) bool {
+			c := compareBy(opts.Order, s, after)
+			if opts.Desc {
+				c = -c
+			}
+			return c <= 0
+		})
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = metadata.DefaultListLimit
+	}
+
+	page := ss[:min(limit, len(ss))]
+	metas := make([]*sstable.Meta, len(page))
+	for i, s := range page {
+		metas[i] = listedMeta(s, opts)
+	}
+
+	if len(page) < limit {
+		return metas, "", nil
+	}
+
+	last := strconv.Itoa(page[len(page)-1].id)
+	return metas, base64.RawURLEncoding.EncodeToString([]byte(last)), nil
+}
+
+func (md *Metadata) CountLive(ctx context.Context) (int, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	n := 0
+	for _, s := range md.sstables {
+		if s.live() {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (md *Metadata) GetWindows(ctx context.Context) ([]*metadata.Window, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var out []*metadata.Window
+	for _, w := range md.windows {
+		c := *w
+		out = append(out, &c)
+	}
+
+	slices.SortFunc(out, func(a, b *metadata.Window) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	return out, nil
+}
+
+func (md *Metadata) RebuildWindows(ctx context.Context) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.windows = map[time.Time]*metadata.Window{}
+	md.widenWindows(md.liveMetas(func(*sstable.Meta) bool { return true }))
+	return nil
+}
+
+func (md *Metadata) IsLive(ctx context.Context, meta *sstable.Meta) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return md.find(meta, true) != nil, nil
+}
+
+func (md *Metadata) Claim(ctx context.Context, metas []*sstable.Meta, owner string, now, until time.Time) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var claimed []*fakeSSTable
+	for _, m := range metas {
+		s := md.find(m, true)
+		if s == nil || (s.claimedBy != "" && s.claimedBy != owner && !s.claimedUntil.Before(now)) {
+			for _, c := range claimed {
+				c.claimedBy, c.claimedUntil = "", time.Time{}
+			}
+			return fmt.Errorf("%w: %s", metadata.ErrClaimed, m.Filename())
+		}
+
+		s.claimedBy, s.claimedUntil = owner, until
+		claimed = append(claimed, s)
+	}
+
+	return nil
+}
+
+func (md *Metadata) Release(ctx context.Context, metas []*sstable.Meta, owner string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	for _, m := range metas {
+		s := md.find(m, false)
+		if s != nil && s.claimedBy == owner {
+			s.claimedBy, s.claimedUntil = "", time.Time{}
+		}
+	}
+
+	return nil
+}
+
+func (md *Metadata) PrepareCompaction(ctx context.Context, p *metadata.PendingCompaction) error {
+	if len(p.Outputs) == 0 {
+		return fmt.Errorf("compaction has no outputs")
+	}
+	p.ID = p.Outputs[0].Filename()
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.pending[p.ID]; ok {
+		return fmt.Errorf("pending compaction already exists: %s", p.ID)
+	}
+
+	c := &metadata.PendingCompaction{}
+	roundTrip(p, c)
+	md.pending[p.ID] = c
+	return nil
+}
+
+func (md *Metadata) CommitCompaction(ctx context.Context, p *metadata.PendingCompaction, at time.Time) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.pending[p.ID]; !ok {
+		return fmt.Errorf("%w: %s", metadata.ErrNotPending, p.ID)
+	}
+
+	inputs := make([]*fakeSSTable, len(p.Inputs))
+	for i, m := range p.Inputs {
+		inputs[i] = md.find(m, true)
+		if inputs[i] == nil {
+			return fmt.Errorf("%w: %s", metadata.ErrInputNotLive, m.Filename())
+		}
+	}
+
+	delete(md.pending, p.ID)
+	for _, s := range inputs {
+		s.deleted = at
+	}
+	md.insert(p.Outputs)
+
+	return nil
+}
+
+func (md *Metadata) AbortCompaction(ctx context.Context, p *metadata.PendingCompaction) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	delete(md.pending, p.ID)
+	return nil
+}
+
+func (md *Metadata) GetPendingCompactions(ctx context.Context, before time.Time) ([]*metadata.PendingCompaction, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var out []*metadata.PendingCompaction
+	for _, p := range md.pending {
+		if before.IsZero() || p.Created.Before(before) {
+			c := &metadata.PendingCompaction{}
+			roundTrip(p, c)
+			out = append(out, c)
+		}
+	}
+
+	slices.SortFunc(out, func(a, b *metadata.PendingCompaction) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	return out, nil
+}
+
+func (md *Metadata) GetDeleted(ctx context.Context, before time.Time) ([]*sstable.Meta, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var out []*sstable.Meta
+	for _, s := range md.sstables {
+		if !s.live() && (before.IsZero() || s.deleted.Before(before)) {
+			out = append(out, storedMeta(&s.meta))
+		}
+	}
+
+	return out, nil
+}
+
+func (md *Metadata) Purge(ctx context.Context, meta *sstable.Meta) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	k := keyOf(meta)
+	md.sstables = slices.DeleteFunc(md.sstables, func(s *fakeSSTable) bool {
+		return !s.live() && keyOf(&s.meta) == k
+	})
+
+	return nil
+}
+
+func (md *Metadata) InCheckpoint(ctx context.Context, meta *sstable.Meta) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	k := keyOf(meta)
+	for _, cp := range md.checkpoints {
+		for _, s := range cp.members {
+			if keyOf(&s.meta) == k {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (md *Metadata) CreateCheckpoint(ctx context.Context, name string, created time.Time) (*metadata.Checkpoint, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if _, ok := md.checkpoints[name]; ok {
+		return nil, fmt.Errorf("%w: %s", metadata.ErrCheckpointExists, name)
+	}
+
+	fc := &fakeCheckpoint{cp: metadata.Checkpoint{Name: name, Created: created}}
+	for _, s := range md.sstables {
+		if s.live() {
+			c := *s
+			fc.members = append(fc.members, &c)
+		}
+	}
+
+	slices.SortStableFunc(fc.members, func(a, b *fakeSSTable) int {
+		return compareBy(metadata.ByMinKey, a, b)
+	})
+
+	md.checkpoints[name] = fc
+	return md.checkpoint(fc), nil
+}
+
+// checkpoint returns a copy of the given checkpoint, with its metas. The caller
+// must hold mu.
+func (md *Metadata) checkpoint(fc *fakeCheckpoint) *metadata.Checkpoint {
+	cp := &metadata.Checkpoint{}
+	roundTrip(&fc.cp, cp)
+
+	for _, s := range fc.members {
+		cp.Metas = append(cp.Metas, storedMeta(&s.meta))
+	}
+
+	return cp
+}
+
+func (md *Metadata) GetCheckpoint(ctx context.Context, name string) (*metadata.Checkpoint, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	fc, ok := md.checkpoints[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", metadata.ErrCheckpointNotFound, name)
+	}
+
+	return md.checkpoint(fc), nil
+}
+
+func (md *Metadata) ListCheckpoints(ctx context.Context) ([]*metadata.Checkpoint, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var out []*metadata.Checkpoint
+	for _, fc := range md.checkpoints {
+		out = append(out, md.checkpoint(fc))
+	}
+
+	slices.SortFunc(out, func(a, b *metadata.Checkpoint) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	return out, nil
+}
+
+func (md *Metadata) Restore(ctx context.Context, cp *metadata.Checkpoint, at time.Time) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	fc, ok := md.checkpoints[cp.Name]
+	if !ok {
+		return nil
+	}
+
+	ids := map[int]bool{}
+	for _, m := range fc.members {
+		ids[m.id] = true
+	}
+
+	for _, s := range md.sstables {
+		if s.live() && !ids[s.id] {
+			s.deleted = at
+		}
+	}
+
+	var restored []*sstable.Meta
+	for _, m := range fc.members {
+		i := slices.IndexFunc(md.sstables, func(s *fakeSSTable) bool { return s.id == m.id })
+		switch {
+		case i < 0:
+			c := *m
+			c.deleted, c.claimedBy, c.claimedUntil = time.Time{}, "", time.Time{}
+			md.sstables = append(md.sstables, &c)
+		case !md.sstables[i].live():
+			md.sstables[i].deleted = time.Time{}
+		default:
+			continue
+		}
+		restored = append(restored, &m.meta)
+	}
+
+	md.widenWindows(restored)
+	return nil
+}
+
+func (md *Metadata) PutNamespace(ctx context.Context, cfg *metadata.NamespaceConfig) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	c := *cfg
+	md.namespaces[cfg.Prefix] = &c
+	return nil
+}
+
+func (md *Metadata) DeleteNamespace(ctx context.Context, prefix string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	delete(md.namespaces, prefix)
+	return nil
+}
+
+func (md *Metadata) GetNamespaces(ctx context.Context) (metadata.Namespaces, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var ns metadata.Namespaces
+	for _, cfg := range md.namespaces {
+		c := *cfg
+		ns = append(ns, &c)
+	}
+
+	slices.SortFunc(ns, func(a, b *metadata.NamespaceConfig) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+
+	return ns, nil
+}
+
+func (md *Metadata) GetRuntimeConfig(ctx context.Context) (*metadata.RuntimeConfig, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	cfg := &metadata.RuntimeConfig{}
+	roundTrip(&md.config, cfg)
+	return cfg, nil
+}
+
+func (md *Metadata) SetRuntimeConfig(ctx context.Context, cfg *metadata.RuntimeConfig) error {
+	md.mu.Lock()
+	roundTrip(cfg, &md.config)
+	watchers := make([]func(*metadata.RuntimeConfig), 0, len(md.configWatchers))
+	for _, fn := range md.configWatchers {
+		watchers = append(watchers, fn)
+	}
+	md.mu.Unlock()
+
+	for _, fn := range watchers {
+		c := &metadata.RuntimeConfig{}
+		roundTrip(cfg, c)
+		fn(c)
+	}
+
+	return nil
+}
+
+// WatchRuntimeConfig calls onChange with the runtime config, and again when
+// SetRuntimeConfig is called on this store, until the context is cancelled.
+func (md *Metadata) WatchRuntimeConfig(ctx context.Context, onChange func(*metadata.RuntimeConfig)) error {
+	cfg, err := md.GetRuntimeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	onChange(cfg)
+
+	md.mu.Lock()
+	md.nextWatcher++
+	id := md.nextWatcher
+	if md.configWatchers == nil {
+		md.configWatchers = map[int]func(*metadata.RuntimeConfig){}
+	}
+	md.configWatchers[id] = onChange
+	md.mu.Unlock()
+
+	<-ctx.Done()
+
+	md.mu.Lock()
+	delete(md.configWatchers, id)
+	md.mu.Unlock()
+
+	return ctx.Err()
+}
+
+func (md *Metadata) Paused(ctx context.Context) ([]string, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	out := slices.Clone(md.paused)
+	slices.Sort(out)
+	return out, nil
+}
+
+func (md *Metadata) SetPaused(ctx context.Context, task string, paused bool) error {
+	switch task {
+	case metadata.TaskFlush, metadata.TaskCompaction, metadata.TaskGC:
+	default:
+		return fmt.Errorf("%w: %s", metadata.ErrUnknownTask, task)
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	md.paused = slices.DeleteFunc(md.paused, func(t string) bool { return t == task })
+	if paused {
+		md.paused = append(md.paused, task)
+	}
+
+	return nil
+}
+
+func (md *Metadata) GetMaintenanceSchedule(ctx context.Context) (metadata.MaintenanceSchedule, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	out := metadata.MaintenanceSchedule{}
+	for task, ws := range md.maintenance {
+		out[task] = slices.Clone(ws)
+	}
+
+	return out, nil
+}
+
+// SetMaintenanceWindows validates the windows by parsing them again, since the
+// real validation isn't exported.
+func (md *Metadata) SetMaintenanceWindows(ctx context.Context, task string, windows []metadata.MaintenanceWindow) error {
+	if task != metadata.TaskCompaction && task != metadata.TaskGC {
+		return fmt.Errorf("%w: %s", metadata.ErrUnknownTask, task)
+	}
+
+	for _, w := range windows {
+		_, err := metadata.ParseMaintenanceWindow(w.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if len(windows) == 0 {
+		delete(md.maintenance, task)
+		return nil
+	}
+
+	md.maintenance[task] = slices.Clone(windows)
+	return nil
+}
+
+func (md *Metadata) RecordCompaction(ctx context.Context, r *metadata.CompactionRecord) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	c := &metadata.CompactionRecord{}
+	roundTrip(r, c)
+	md.history = append(md.history, c)
+	return nil
+}
+
+func (md *Metadata) GetCompactionHistory(ctx context.Context, f metadata.HistoryFilter) ([]*metadata.CompactionRecord, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	var out []*metadata.CompactionRecord
+	for _, r := range md.history {
+		if f.Filename != "" && !slices.Contains(r.Inputs, f.Filename) && !slices.Contains(r.Outputs, f.Filename) {
+			continue
+		}
+		if f.Output != "" && !slices.Contains(r.Outputs, f.Output) {
+			continue
+		}
+		if !f.Since.IsZero() && r.Started.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !r.Started.Before(f.Until) {
+			continue
+		}
+
+		c := &metadata.CompactionRecord{}
+		roundTrip(r, c)
+		out = append(out, c)
+	}
+
+	slices.SortStableFunc(out, func(a, b *metadata.CompactionRecord) int {
+		return b.Started.Compare(a.Started)
+	})
+
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+
+	return out, nil
+}
+
+func (md *Metadata) AddUsage(ctx context.Context, id string, n, max int64) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if max > 0 && md.usage[id]+n > max {
+		return false, nil
+	}
+
+	md.usage[id] += n
+	return true, nil
+}
+
+func (md *Metadata) GetUsage(ctx context.Context, id string) (int64, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return md.usage[id], nil
+}
+
+func (md *Metadata) RecordAccess(ctx context.Context, accesses map[string]metadata.Access) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	for fn, a := range accesses {
+		prev := md.access[fn]
+		if prev.LastRead.After(a.LastRead) {
+			a.LastRead = prev.LastRead
+		}
+		a.Reads += prev.Reads
+		md.access[fn] = a
+	}
+
+	return nil
+}
+
+func (md *Metadata) GetAccess(ctx context.Context) (map[string]metadata.Access, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	out := make(map[string]metadata.Access, len(md.access))
+	for fn, a := range md.access {
+		out[fn] = a
+	}
+
+	return out, nil
+}
+
+func (md *Metadata) DeleteAccess(ctx context.Context, filenames []string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	for _, fn := range filenames {
+		delete(md.access, fn)
+	}
+
+	return nil
+}
+
+func (md *Metadata) SyncCursor(ctx context.Context, name string) (time.Time, bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	t, ok := md.syncCursors[name]
+	return t, ok, nil
+}
+
+func (md *Metadata) SetSyncCursor(ctx context.Context, name string, t time.Time) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	t = storedTime(t)
+	if prev, ok := md.syncCursors[name]; !ok || t.After(prev) {
+		md.syncCursors[name] = t
+	}
+
+	return nil
+}
+
+func (md *Metadata) DeleteSyncCursor(ctx context.Context, name string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	delete(md.syncCursors, name)
+	return nil
+}
+
+// AcquireLease judges expiry by the local clock, which stands in for the clock
+// of the Mongo primary.
+func (md *Metadata) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	now := time.Now()
+	l, ok := md.leases[name]
+	if ok && l.owner != owner && !l.until.Before(now) {
+		return metadata.ErrLeaseHeld
+	}
+
+	md.leases[name] = fakeLease{owner: owner, until: now.Add(ttl)}
+	return nil
+}
+
+func (md *Metadata) ReleaseLease(ctx context.Context, name, owner string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if l, ok := md.leases[name]; ok && l.owner == owner {
+		delete(md.leases, name)
+	}
+
+	return nil
+}
+
+func (md *Metadata) LeaseHolder(ctx context.Context, name string) (string, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	l, ok := md.leases[name]
+	if !ok || l.until.Before(time.Now()) {
+		return "", nil
+	}
+
+	return l.owner, nil
+}
+
+func (md *Metadata) ManifestVersion(ctx context.Context) (time.Time, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	return md.manifest, nil
+}
+
+func (md *Metadata) SwapManifestVersion(ctx context.Context, prev, next time.Time) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if !md.manifest.Equal(storedTime(prev)) {
+		return metadata.ErrManifestConflict
+	}
+
+	md.manifest = storedTime(next)
+	return nil
+}
+
+// storedTime returns the given time as it would be after a round trip through
+// Mongo: truncated to milliseconds, in UTC. The zero time stays zero.
+func storedTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+
+	return time.UnixMilli(t.UnixMilli()).UTC()
+}
@@ -0,0 +1,354 @@
+package blobstore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DefaultBlobCacheSize is the number of bytes of blobs kept on disk by
+// WithBlobCache, if no size is given.
+const DefaultBlobCacheSize = 1 << 30
+
+// BlobCacheMode controls whether blobs served from the cache are checked
+// against the blobstore first.
+type BlobCacheMode int
+
+const (
+	// BlobCacheTrust serves cached blobs without any request at all. This is
+	// safe because sstables and indexes are never modified after they're
+	// written, only deleted.
+	BlobCacheTrust BlobCacheMode = iota
+
+	// BlobCacheValidate sends a conditional request with the ETag of the cached
+	// copy before serving it, which is much cheaper than fetching the blob again
+	// but not free. If the blob has changed, which should never happen, the new
+	// version is cached and served instead.
+	BlobCacheValidate
+)
+
+// BlobCacheStats are counters about the blob cache, since it was created.
+type BlobCacheStats struct {
+	// Reads which found the blob in the cache.
+	Hits int64
+
+	// Reads which had to fetch the whole blob.
+	Misses int64
+
+	// Hits which were confirmed by a conditional request first.
+	Validated int64
+
+	// Cached blobs which turned out to be different from the blobstore.
+	Stale int64
+
+	// Blobs removed from the cache to make room for others.
+	Evictions int64
+
+	// The number of bytes currently cached.
+	Bytes int64
+}
+
+// blobCache is an LRU cache of whole blobs on local disk, keyed by bucket and
+// key, which remembers the ETag of each. Ranged reads are served from the cached
+// copy too, so once any part of a blob has been read, the rest is free.
+type blobCache struct {
+	dir     string
+	initial int64
+	mode    BlobCacheMode
+
+	mu       sync.Mutex
+	maxBytes int64
+	ll       *list.List
+	items    map[string]*list.Element
+	stats    BlobCacheStats
+}
+
+type blobCacheEntry struct {
+	key  string
+	path string
+	etag string
+	size int64
+}
+
+func newBlobCache(dir string, maxBytes int64, mode BlobCacheMode) *blobCache {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBlobCacheSize
+	}
+
+	// the index of the cache is only in memory, so files left by a previous
+	// process can't be used. remove them, on a best-effort basis.
+	old, _ := filepath.Glob(filepath.Join(dir, "blob-*"))
+	for _, path := range old {
+		os.Remove(path)
+	}
+
+	return &blobCache{
+		dir:      dir,
+		initial:  maxBytes,
+		maxBytes: maxBytes,
+		mode:     mode,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// open returns the given range of the given blob (or all of it, if rng is
+// empty) from the cache, fetching the whole blob into the cache first if it's
+// not already there.
+func (c *blobCache) open(ctx context.Context, s3c S3API, bucket, key, rng string) (io.ReadCloser, error) {
+	ck := bucket + "/" + key
+
+	if e := c.get(ck); e != nil {
+		if c.mode == BlobCacheValidate {
+			output, err := s3c.GetObject(ctx, &s3.GetObjectInput{
+				Bucket:      &bucket,
+				Key:         &key,
+				IfNoneMatch: &e.etag,
+			})
+			if err == nil {
+				// the blob changed under us. drop the old copy and cache the new one.
+				c.remove(ck)
+				c.count(func(s *BlobCacheStats) { s.Stale++ })
+				return c.fill(ck, output, rng)
+			}
+			if !notModified(err) {
+				return nil, fmt.Errorf("GetObject: %w", err)
+			}
+
+			c.count(func(s *BlobCacheStats) { s.Validated++ })
+		}
+
+		// the file is gone if the entry was evicted since get, in which case
+		// this is a miss after all.
+		body, err := c.serve(e, rng)
+		if !errors.Is(err, os.ErrNotExist) {
+			return body, err
+		}
+	}
+
+	output, err := s3c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetObject: %w", err)
+	}
+
+	c.count(func(s *BlobCacheStats) { s.Misses++ })
+	return c.fill(ck, output, rng)
+}
+
+// fill writes the body of the given output to the cache, and serves the given
+// range of it.
+func (c *blobCache) fill(ck string, output *s3.GetObjectOutput, rng string) (io.ReadCloser, error) {
+	defer output.Body.Close()
+
+	f, err := os.CreateTemp(c.dir, "blob-*")
+	if err != nil {
+		return nil, fmt.Errorf("CreateTemp: %w", err)
+	}
+
+	n, err := io.Copy(f, output.Body)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("download: %w", err)
+	}
+
+	// every download gets its own file, so replacing or evicting an entry
+	// can't remove the file of another.
+	e := &blobCacheEntry{
+		key:  ck,
+		path: f.Name(),
+		size: n,
+	}
+	if output.ETag != nil {
+		e.etag = *output.ETag
+	}
+
+	// open before adding, so a concurrent eviction can't remove the file first.
+	// it stays readable after being removed.
+	body, err := c.serve(e, rng)
+	if err != nil {
+		os.Remove(e.path)
+		return nil, err
+	}
+
+	c.put(e)
+	return body, nil
+}
+
+// serve returns the given range of the cached blob.
+func (c *blobCache) serve(e *blobCacheEntry, rng string) (io.ReadCloser, error) {
+	start, end, ok := parseRange(rng, e.size)
+	if !ok {
+		return nil, fmt.Errorf("invalid range for cached blob of %d bytes: %q", e.size, rng)
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, fmt.Errorf("open cached blob: %w", err)
+	}
+
+	return &sectionBody{io.NewSectionReader(f, start, end-start), f}, nil
+}
+
+// sectionBody is a section of a file which closes the file.
+type sectionBody struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// get returns the entry for the given key, or nil if it's not cached.
+func (c *blobCache) get(ck string) *blobCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[ck]
+	if !ok {
+		return nil
+	}
+
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return el.Value.(*blobCacheEntry)
+}
+
+func (c *blobCache) put(e *blobCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[e.key]; ok {
+		c.unlink(el)
+	}
+
+	c.items[e.key] = c.ll.PushFront(e)
+	c.stats.Bytes += e.size
+	c.evict()
+}
+
+// resize changes the size of the cache, evicting the least recently used
+// blobs if it's shrinking. Zero restores the initial size.
+func (c *blobCache) resize(maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if maxBytes <= 0 {
+		maxBytes = c.initial
+	}
+
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
+// evict removes the least recently used blobs until the cache fits, but always
+// keeps the newest, even if it's bigger than the whole cache, so the caller of
+// put can read it back. The caller must hold mu.
+func (c *blobCache) evict() {
+	for c.stats.Bytes > c.maxBytes && c.ll.Len() > 1 {
+		c.unlink(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops the given key from the cache, if it's there, and deletes the
+// file.
+func (c *blobCache) remove(ck string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[ck]; ok {
+		c.unlink(el)
+	}
+}
+
+// unlink removes the given element and its file. The caller must hold mu.
+func (c *blobCache) unlink(el *list.Element) {
+	e := el.Value.(*blobCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.stats.Bytes -= e.size
+
+	// if a reader has the file open, it keeps working until it's closed.
+	os.Remove(e.path)
+}
+
+func (c *blobCache) count(f func(*BlobCacheStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.stats)
+}
+
+func (c *blobCache) snapshot() BlobCacheStats {
+	if c == nil {
+		return BlobCacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// notModified returns true if the given error is a 304 response to a
+// conditional request.
+func notModified(err error) bool {
+	var re *awshttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified
+}
+
+// parseRange returns the half-open byte range [start, end) of a blob of the
+// given size requested by the given Range header, as built by the blobstore.
+// An empty header is the whole blob.
+func parseRange(h string, size int64) (int64, int64, bool) {
+	if h == "" {
+		return 0, size, true
+	}
+
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+
+	first, last, _ := strings.Cut(spec, "-")
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false
+		}
+		end = min(n+1, size)
+	}
+
+	return start, end, true
+}
@@ -1,103 +1,598 @@
 package blobstore
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/sstable"
 	"github.com/adammck/blobby/pkg/types"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
 	"github.com/jonboulle/clockwork"
 )
 
 type Blobstore struct {
 	bucket string
-	s3     *s3.Client
+	s3     S3API
 	clock  clockwork.Clock
+	scheme sstable.KeyScheme
+	ring   *ring
+	faults *faultinject.Injector
+
+	// see WithFlushMemory.
+	flushMem int
+	tempDir  string
+
+	// the format of new sstables.
+	format sstable.Format
+
+	// see WithIndexCache.
+	indexes *indexCache
+
+	// see WithInlineFilters.
+	inlineFilters int
+
+	// the type of filter in the index of new sstables.
+	filter sstable.FilterType
+
+	// see WithBlobCache. nil if it wasn't given.
+	blobs *blobCache
+
+	// counts every request made by s3. see RequestStats.
+	requests requestCounter
+
+	// the clock of the sstables written by FlushPartitioned.
+	mono monoClock
+}
+
+type Option func(*Blobstore)
+
+// WithKeyScheme sets the scheme used to choose the prefix of new sstables. The
+// default is FlatKeys. Existing sstables are unaffected.
+func WithKeyScheme(scheme sstable.KeyScheme) Option {
+	return func(bs *Blobstore) {
+		bs.scheme = scheme
+	}
+}
+
+// WithBuckets spreads new sstables across the given buckets as well as the
+// primary one, by consistent hashing on their filename. The bucket which each
+// sstable is written to is recorded in its Meta, so buckets can be added later
+// without moving existing sstables. Buckets must not be removed while any
+// sstable refers to them.
+func WithBuckets(buckets ...string) Option {
+	return func(bs *Blobstore) {
+		bs.ring = newRing(append([]string{bs.bucket}, buckets...))
+	}
 }
 
-func New(bucket string, clock clockwork.Clock) *Blobstore {
-	return &Blobstore{
-		bucket: bucket,
-		clock:  clock,
+// WithFaults injects faults into reads, writes, and deletes of sstables. It's
+// only meant for tests.
+func WithFaults(fi *faultinject.Injector) Option {
+	return func(bs *Blobstore) {
+		bs.faults = fi
 	}
 }
 
+// WithFlushMemory limits the memory used to sort the records of a flush to
+// roughly the given number of bytes. Beyond that, they're sorted in chunks which
+// are spilled to temporary files in dir (or the default temporary directory, if
+// it's empty), then merged. The default is no limit.
+func WithFlushMemory(limit int, dir string) Option {
+	return func(bs *Blobstore) {
+		bs.flushMem = limit
+		bs.tempDir = dir
+	}
+}
+
+// WithFormat sets the format of new sstables. The default is
+// sstable.FormatRecords. Existing sstables are unaffected, since readers support
+// every format.
+func WithFormat(f sstable.Format) Option {
+	return func(bs *Blobstore) {
+		bs.format = f
+	}
+}
+
+// WithIndexCache sets the number of sstable indexes to keep in memory, so they
+// needn't be fetched for every read. The default is DefaultIndexCacheSize. Zero
+// disables the cache.
+func WithIndexCache(n int) Option {
+	return func(bs *Blobstore) {
+		bs.indexes = newIndexCache(n)
+	}
+}
+
+// WithFilter sets the type of filter in the index of new sstables, and of those
+// built by BuildIndex. The default is sstable.FilterBloom. Existing sstables
+// are unaffected, since readers support every type.
+func WithFilter(t sstable.FilterType) Option {
+	return func(bs *Blobstore) {
+		bs.filter = t
+	}
+}
+
+// WithInlineFilters copies the bloom filter of each new sstable into its Meta,
+// if it's no larger than the given number of bytes, so that it's stored in the
+// metadata and readers can rule out the sstable without fetching its index.
+// Larger filters are only in the index. The default is zero, i.e. never.
+func WithInlineFilters(maxBytes int) Option {
+	return func(bs *Blobstore) {
+		bs.inlineFilters = maxBytes
+	}
+}
+
+// WithBlobCache keeps whole sstables and indexes in the given directory, up to
+// maxBytes in total (or DefaultBlobCacheSize, if it's zero), so repeated reads
+// of the same blob don't fetch it again. The first read of each blob fetches all
+// of it, even if only a range was requested. The directory should not be used
+// for anything else. See BlobCacheMode.
+func WithBlobCache(dir string, maxBytes int64, mode BlobCacheMode) Option {
+	return func(bs *Blobstore) {
+		bs.blobs = newBlobCache(dir, maxBytes, mode)
+	}
+}
+
+func New(bucket string, clock clockwork.Clock, opts ...Option) *Blobstore {
+	bs := &Blobstore{
+		bucket:  bucket,
+		clock:   clock,
+		indexes: newIndexCache(DefaultIndexCacheSize),
+	}
+	bs.mono.Clock = clock
+
+	for _, opt := range opts {
+		opt(bs)
+	}
+
+	return bs
+}
+
 type GetStats struct {
 	// The URL of the blob that was fetched.
 	Source string
 
 	// The number of records which were scanned until the key was found.
 	RecordsScanned int
+
+	// True if the sstable's filter ruled out the key, so it wasn't fetched.
+	Filtered bool
 }
 
-func (bs *Blobstore) Find(ctx context.Context, fn string, key string) (*types.Record, *GetStats, error) {
-	reader, err := bs.Get(ctx, fn)
+// Find returns the first record with the given key in the given sstable, or nil
+// if there isn't one. Only the matching record is decoded, so skipping past the
+// others doesn't allocate. If the sstable has an index, it's used to skip the
+// sstable entirely if it doesn't contain the key, or to read only the part which
+// might.
+func (bs *Blobstore) Find(ctx context.Context, m *sstable.Meta, key string) (*types.Record, *GetStats, error) {
+	stats := &GetStats{
+		Source: m.Filename(),
+	}
+
+	reader, err := bs.openForKey(ctx, m, key, stats)
+	if err != nil || reader == nil {
+		return nil, stats, err
+	}
+	defer reader.Close()
+
+	stats.RecordsScanned, err = reader.Seek(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("getSST: %w", err)
+		return nil, stats, fmt.Errorf("Seek: %w", err)
+	}
+
+	recs, err := readKey(reader, key, 1)
+	if err != nil || len(recs) == 0 {
+		return nil, stats, err
 	}
 
-	var rec *types.Record
+	return recs[0], stats, nil
+}
+
+// FindAll returns every record with the given key in the given sstable, newest
+// first, or an empty slice if there are none.
+func (bs *Blobstore) FindAll(ctx context.Context, m *sstable.Meta, key string) ([]*types.Record, *GetStats, error) {
 	stats := &GetStats{
-		Source: fn,
+		Source: m.Filename(),
 	}
 
-	for {
-		rec, err = reader.Next()
-		if err != nil {
-			return nil, stats, fmt.Errorf("Next: %w", err)
+	reader, err := bs.openForKey(ctx, m, key, stats)
+	if err != nil || reader == nil {
+		return nil, stats, err
+	}
+	defer reader.Close()
+
+	stats.RecordsScanned, err = reader.Seek(key)
+	if err != nil {
+		return nil, stats, fmt.Errorf("Seek: %w", err)
+	}
+
+	recs, err := readKey(reader, key, 0)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	// the first was already counted by Seek.
+	stats.RecordsScanned += max(len(recs)-1, 0)
+	return recs, stats, nil
+}
+
+// openForKey returns a reader for the given sstable, positioned as close to the
+// given key as its index allows, or nil if its filter rules the key out. Without
+// an index, the whole sstable is read. If the filter is in the meta, it's
+// checked before the index is fetched.
+func (bs *Blobstore) openForKey(ctx context.Context, m *sstable.Meta, key string, stats *GetStats) (*sstable.Reader, error) {
+	if m.Filter != nil && !m.Filter.MayContain(key) {
+		stats.Filtered = true
+		return nil, nil
+	}
+
+	ix, err := bs.Index(ctx, m)
+	if err != nil {
+		return nil, fmt.Errorf("Index: %w", err)
+	}
+
+	var offset int64
+	if ix != nil {
+		if !ix.MayContain(key) {
+			stats.Filtered = true
+			return nil, nil
 		}
-		if rec == nil {
-			// end of file
-			return nil, stats, nil
+
+		offset = ix.Locate(key)
+	}
+
+	if offset == 0 {
+		reader, err := bs.OpenSSTable(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("OpenSSTable: %w", err)
 		}
+		return reader, nil
+	}
 
-		stats.RecordsScanned++
+	reader, err := bs.OpenSSTableAt(ctx, m, offset)
+	if err != nil {
+		return nil, fmt.Errorf("OpenSSTableAt: %w", err)
+	}
+
+	return reader, nil
+}
+
+// Index returns the index of the given sstable, or nil if it doesn't have one
+// (because it was written before indexes existed). Indexes are cached, so this
+// is usually cheap.
+func (bs *Blobstore) Index(ctx context.Context, m *sstable.Meta) (*sstable.Index, error) {
+	if m.Index == "" {
+		return nil, nil
+	}
+
+	bucket := bs.bucketFor(m)
+	ck := bucket + "/" + m.Index
+	if ix, ok := bs.indexes.get(ck); ok {
+		return ix, nil
+	}
+
+	b, err := bs.getRange(ctx, bucket, m.Index, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ix, err := sstable.ParseIndex(b)
+	if err != nil {
+		return nil, fmt.Errorf("ParseIndex(%s): %w", m.Index, err)
+	}
 
-		// TODO: index the file so we can grab a range
-		if rec.Key == key {
+	bs.indexes.put(ck, ix)
+	return ix, nil
+}
+
+type PrefetchStats struct {
+	// True if the sstable's filter ruled out the key, so it wasn't fetched.
+	Filtered bool
+
+	// True if the sstable is now in the blob cache.
+	Cached bool
+}
+
+// Prefetch loads the index of the given sstable into memory and, if there's a
+// blob cache (see WithBlobCache), the sstable itself onto disk, so that later
+// reads of it are fast. If key isn't empty and the filter rules it out, the
+// sstable is skipped.
+func (bs *Blobstore) Prefetch(ctx context.Context, m *sstable.Meta, key string) (*PrefetchStats, error) {
+	stats := &PrefetchStats{}
+
+	if key != "" && m.Filter != nil && !m.Filter.MayContain(key) {
+		stats.Filtered = true
+		return stats, nil
+	}
+
+	ix, err := bs.Index(ctx, m)
+	if err != nil {
+		return nil, fmt.Errorf("Index: %w", err)
+	}
+	if key != "" && ix != nil && !ix.MayContain(key) {
+		stats.Filtered = true
+		return stats, nil
+	}
+
+	// without a blob cache there's nowhere to keep the sstable.
+	if bs.blobs == nil {
+		return stats, nil
+	}
+
+	// reading the last byte is enough to fetch the whole thing.
+	body, err := bs.open(ctx, bs.bucketFor(m), m.Filename(), "bytes=-1")
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Cached = true
+	return stats, body.Close()
+}
+
+// readKey decodes the records with the given key from the reader, which must be
+// positioned at the first of them (or at a larger key, if there are none), until
+// there are no more or limit is reached. Zero is no limit.
+func readKey(reader *sstable.Reader, key string, limit int) ([]*types.Record, error) {
+	var recs []*types.Record
+
+	for limit == 0 || len(recs) < limit {
+		raw, err := reader.NextRaw()
+		if err != nil {
+			return nil, fmt.Errorf("NextRaw: %w", err)
+		}
+		if raw == nil {
 			break
 		}
+
+		if k, ok := types.RawKey(raw); !ok || string(k) != key {
+			break
+		}
+
+		rec := &types.Record{}
+		err = types.Unmarshal(raw, rec)
+		if err != nil {
+			return nil, fmt.Errorf("Unmarshal: %w", err)
+		}
+
+		recs = append(recs, rec)
 	}
 
-	return rec, stats, nil
+	return recs, nil
 }
 
+// Get returns a reader for the sstable with the given key in the primary bucket.
+// Use OpenSSTable to read an sstable which might be in another bucket. The
+// reader must be closed.
 func (bs *Blobstore) Get(ctx context.Context, key string) (*sstable.Reader, error) {
-	s3client, err := bs.getS3(ctx)
+	return bs.openSSTable(ctx, bs.bucket, key)
+}
+
+// OpenSSTable returns a reader which streams the records of the given sstable,
+// from whichever bucket it was written to. Records are downloaded as they're
+// read, so a caller which stops early doesn't fetch the whole blob. The reader
+// must be closed.
+func (bs *Blobstore) OpenSSTable(ctx context.Context, m *sstable.Meta) (*sstable.Reader, error) {
+	return bs.openSSTable(ctx, bs.bucketFor(m), m.Filename())
+}
+
+// OpenSSTableBuffered is like OpenSSTable, but reads from the blob in chunks
+// of the given size, rather than however the records happen to be sized. This
+// bounds the memory used by the reader, apart from records larger than size,
+// while avoiding lots of tiny reads.
+func (bs *Blobstore) OpenSSTableBuffered(ctx context.Context, m *sstable.Meta, size int) (*sstable.Reader, error) {
+	body, err := bs.open(ctx, bs.bucketFor(m), m.Filename(), "")
 	if err != nil {
 		return nil, err
 	}
 
-	output, err := s3client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &bs.bucket,
-		Key:    &key,
-	})
+	reader, err := sstable.NewReader(&bufferedBody{bufio.NewReaderSize(body, size), body})
 	if err != nil {
-		return nil, fmt.Errorf("GetObject: %w", err)
+		body.Close()
+		return nil, fmt.Errorf("NewReader: %w", err)
 	}
 
-	reader, err := sstable.NewReader(output.Body)
+	return reader, nil
+}
+
+// bufferedBody is a buffered reader which closes the body under it.
+type bufferedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// OpenSSTableAt is like OpenSSTable, but starts reading at the given byte
+// offset, which must be the start of a record (or block, depending on the
+// format of the sstable), rather than the start of the sstable. The reader must be closed.
+func (bs *Blobstore) OpenSSTableAt(ctx context.Context, m *sstable.Meta, offset int64) (*sstable.Reader, error) {
+	if offset == 0 {
+		return bs.OpenSSTable(ctx, m)
+	}
+
+	body, err := bs.open(ctx, bs.bucketFor(m), m.Filename(), fmt.Sprintf("bytes=%d-", offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return sstable.NewRecordReader(body, m.Format), nil
+}
+
+// OpenSSTableFrom is like OpenSSTable, but uses the index of the sstable (if it
+// has one) to skip ahead to the part which might contain the given key. The
+// reader might still return some records with smaller keys before that. The
+// reader must be closed.
+func (bs *Blobstore) OpenSSTableFrom(ctx context.Context, m *sstable.Meta, key string) (*sstable.Reader, error) {
+	ix, err := bs.Index(ctx, m)
 	if err != nil {
-		output.Body.Close()
+		return nil, fmt.Errorf("Index: %w", err)
+	}
+
+	var offset int64
+	if ix != nil {
+		offset = ix.Locate(key)
+	}
+
+	return bs.OpenSSTableAt(ctx, m, offset)
+}
+
+// ReadRange returns length bytes of the given sstable, starting at offset. If
+// offset is negative, it returns the last -offset bytes, and length is ignored.
+func (bs *Blobstore) ReadRange(ctx context.Context, m *sstable.Meta, offset, length int64) ([]byte, error) {
+	rng := fmt.Sprintf("bytes=%d", offset)
+	if offset >= 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	return bs.getRange(ctx, bs.bucketFor(m), m.Filename(), rng)
+}
+
+func (bs *Blobstore) openSSTable(ctx context.Context, bucket, key string) (*sstable.Reader, error) {
+	body, err := bs.open(ctx, bucket, key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := sstable.NewReader(body)
+	if err != nil {
+		body.Close()
 		return nil, fmt.Errorf("NewReader: %w", err)
 	}
 
 	return reader, nil
 }
 
+// open returns the body of the given blob, or the given range of it if rng isn't
+// empty. Every read of an sstable goes through here.
+func (bs *Blobstore) open(ctx context.Context, bucket, key, rng string) (io.ReadCloser, error) {
+	s3client, err := bs.getS3(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.ReadCloser
+	if bs.blobs != nil {
+		body, err = bs.blobs.open(ctx, s3client, bucket, key, rng)
+	} else {
+		body, err = getObject(ctx, s3client, bucket, key, rng)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checked, err := bs.faults.CheckReader(ctx, faultinject.BlobstoreGet, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return checked, nil
+}
+
+// getObject returns the body of the given blob, or the given range of it if rng
+// isn't empty, straight from S3.
+func getObject(ctx context.Context, s3client S3API, bucket, key, rng string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if rng != "" {
+		input.Range = &rng
+	}
+
+	output, err := s3client.GetObject(ctx, input)
+	if err != nil {
+		if rng != "" {
+			return nil, fmt.Errorf("GetObject(%s): %w", rng, err)
+		}
+		return nil, fmt.Errorf("GetObject: %w", err)
+	}
+
+	return output.Body, nil
+}
+
+// BlobCacheStats returns counters about the cache configured by WithBlobCache,
+// or zeros if there isn't one.
+func (bs *Blobstore) BlobCacheStats() BlobCacheStats {
+	return bs.blobs.snapshot()
+}
+
+// SetIndexCacheSize changes the number of indexes kept in memory, evicting some
+// if it's shrinking. Zero restores the size given to WithIndexCache.
+func (bs *Blobstore) SetIndexCacheSize(n int) {
+	bs.indexes.resize(n)
+}
+
+// SetBlobCacheSize changes the size of the cache configured by WithBlobCache,
+// evicting some blobs if it's shrinking, or does nothing if there isn't one.
+// Zero restores the size given to WithBlobCache.
+func (bs *Blobstore) SetBlobCacheSize(maxBytes int64) {
+	if bs.blobs == nil {
+		return
+	}
+
+	bs.blobs.resize(maxBytes)
+}
+
+// Delete deletes the blob with the given key from the primary bucket. Use
+// DeleteSSTable to delete an sstable which might be in another bucket.
 func (bs *Blobstore) Delete(ctx context.Context, key string) error {
+	return bs.delete(ctx, bs.bucket, key)
+}
+
+// DeleteSSTable deletes the given sstable, and its index if it has one, from
+// whichever bucket it was written to.
+func (bs *Blobstore) DeleteSSTable(ctx context.Context, m *sstable.Meta) error {
+	err := bs.delete(ctx, bs.bucketFor(m), m.Filename())
+	if err != nil {
+		return err
+	}
+
+	return bs.DeleteIndex(ctx, m)
+}
+
+// DeleteIndex deletes the index of the given sstable, if it has one, but not the
+// sstable itself.
+func (bs *Blobstore) DeleteIndex(ctx context.Context, m *sstable.Meta) error {
+	if m.Index == "" {
+		return nil
+	}
+
+	bucket := bs.bucketFor(m)
+	bs.indexes.remove(bucket + "/" + m.Index)
+
+	err := bs.delete(ctx, bucket, m.Index)
+	if err != nil {
+		return fmt.Errorf("delete index: %w", err)
+	}
+
+	return nil
+}
+
+func (bs *Blobstore) delete(ctx context.Context, bucket, key string) error {
+	err := bs.faults.Check(ctx, faultinject.BlobstoreDelete)
+	if err != nil {
+		return err
+	}
+
 	s3c, err := bs.getS3(ctx)
 	if err != nil {
 		return err
 	}
 
+	bs.blobs.remove(bucket + "/" + key)
+
 	_, err = s3c.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: &bs.bucket,
+		Bucket: &bucket,
 		Key:    &key,
 	})
 	if err != nil {
@@ -107,6 +602,253 @@ func (bs *Blobstore) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// BlobInfo describes a blob in the bucket, as returned by List.
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// List returns every blob in the bucket whose key starts with the given prefix,
+// which may be empty. This includes blobs which aren't sstables, or which
+// belong to other archives sharing the bucket.
+func (bs *Blobstore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := bs.ListPages(ctx, "", prefix, "", func(page []BlobInfo) error {
+		blobs = append(blobs, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+// ListPages calls fn with each page of the blobs in the given bucket (or the
+// primary bucket, if it's empty) whose keys start with the given prefix and
+// sort after startAfter, in key order, until it returns an error. Unlike List,
+// the blobs needn't all fit in memory, so it's suitable for huge buckets.
+func (bs *Blobstore) ListPages(ctx context.Context, bucket, prefix, startAfter string, fn func([]BlobInfo) error) error {
+	s3c, err := bs.getS3(ctx)
+	if err != nil {
+		return err
+	}
+
+	if bucket == "" {
+		bucket = bs.bucket
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+	if startAfter != "" {
+		input.StartAfter = &startAfter
+	}
+
+	p := s3.NewListObjectsV2Paginator(s3c, input)
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("ListObjectsV2: %w", err)
+		}
+
+		blobs := make([]BlobInfo, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			blobs = append(blobs, BlobInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+
+		err = fn(blobs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadMeta returns the Meta of the sstable with the given key. For sstables with
+// a footer, only the end of the blob is fetched. Older sstables are scanned in
+// full. Either way, Created and Prefix are taken from the key, since they're
+// what determine it.
+func (bs *Blobstore) ReadMeta(ctx context.Context, key string) (*sstable.Meta, error) {
+	prefix, created, err := sstable.ParseFilename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := bs.readFooter(ctx, bs.bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("readFooter: %w", err)
+	}
+
+	if m == nil {
+		r, err := bs.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("getSST: %w", err)
+		}
+		defer r.Close()
+
+		m, err = sstable.ScanMeta(r)
+		if err != nil {
+			return nil, fmt.Errorf("ScanMeta: %w", err)
+		}
+	}
+
+	m.Prefix = prefix
+	m.Created = created
+	return m, nil
+}
+
+// readFooter returns the Meta from the footer of the sstable with the given key,
+// or nil if it doesn't have one.
+func (bs *Blobstore) readFooter(ctx context.Context, bucket, key string) (*sstable.Meta, error) {
+	trailer, err := bs.getRange(ctx, bucket, key, fmt.Sprintf("bytes=-%d", sstable.TrailerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := sstable.ParseTrailer(trailer)
+	if !ok {
+		return nil, nil
+	}
+
+	b, err := bs.getRange(ctx, bucket, key, fmt.Sprintf("bytes=-%d", n+sstable.TrailerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return sstable.ParseFooter(b[:n])
+}
+
+func (bs *Blobstore) getRange(ctx context.Context, bucket, key, rng string) ([]byte, error) {
+	body, err := bs.open(ctx, bucket, key, rng)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// ErrBlobNotFound is returned by GetBlob when the blob doesn't exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// PutBlob writes an arbitrary blob (i.e. not an sstable) to the given key,
+// overwriting it if it already exists.
+func (bs *Blobstore) PutBlob(ctx context.Context, key string, body []byte) error {
+	return bs.PutBlobFrom(ctx, key, bytes.NewReader(body))
+}
+
+// PutBlobIn is like PutBlob, but writes to the given bucket, which needn't be
+// one of the archive's, e.g. to export objects for something else. If it's
+// empty, the archive's bucket is used.
+func (bs *Blobstore) PutBlobIn(ctx context.Context, bucket, key string, body []byte) error {
+	if bucket == "" {
+		bucket = bs.bucket
+	}
+
+	return bs.putBlob(ctx, bucket, key, bytes.NewReader(body))
+}
+
+// PutBlobFrom is like PutBlob, but reads the body from r, so it needn't be in
+// memory, e.g. if it was written to a temp file.
+func (bs *Blobstore) PutBlobFrom(ctx context.Context, key string, r io.ReadSeeker) error {
+	return bs.putBlob(ctx, bs.bucket, key, r)
+}
+
+func (bs *Blobstore) putBlob(ctx context.Context, bucket, key string, r io.ReadSeeker) error {
+	s3c, err := bs.getS3(ctx)
+	if err != nil {
+		return fmt.Errorf("getS3: %w", err)
+	}
+
+	_, err = s3c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject: %w", err)
+	}
+
+	return nil
+}
+
+// GetBlob reads an arbitrary blob written by PutBlob.
+func (bs *Blobstore) GetBlob(ctx context.Context, key string) ([]byte, error) {
+	r, err := bs.OpenBlob(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// OpenBlob is like GetBlob, but returns a reader, so the blob needn't be read
+// into memory all at once. The caller must close it.
+func (bs *Blobstore) OpenBlob(ctx context.Context, key string) (io.ReadCloser, error) {
+	return bs.openBlob(ctx, bs.bucket, key)
+}
+
+// GetBlobIn is like GetBlob, but reads from the given bucket, which needn't be
+// one of the archive's, e.g. to import objects written by something else. If
+// it's empty, the archive's bucket is used.
+func (bs *Blobstore) GetBlobIn(ctx context.Context, bucket, key string) ([]byte, error) {
+	if bucket == "" {
+		bucket = bs.bucket
+	}
+
+	r, err := bs.openBlob(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (bs *Blobstore) openBlob(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	s3c, err := bs.getS3(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getS3: %w", err)
+	}
+
+	output, err := s3c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var nsk *s3types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+		}
+		return nil, fmt.Errorf("GetObject: %w", err)
+	}
+
+	return output.Body, nil
+}
+
+// writerOpts returns the options for writing new sstables.
+func (bs *Blobstore) writerOpts() []sstable.WriterOption {
+	return []sstable.WriterOption{
+		sstable.WithFormat(bs.format),
+		sstable.WithFilter(bs.filter),
+	}
+}
+
+// SetFormat is like WithFormat, but can be called after New. It's not safe to
+// call concurrently with flushes.
+func (bs *Blobstore) SetFormat(f sstable.Format) {
+	bs.format = f
+}
+
 func (bs *Blobstore) Ping(ctx context.Context) error {
 	_, err := bs.getS3(ctx)
 	return err
@@ -118,17 +860,23 @@ func (bs *Blobstore) Init(ctx context.Context) error {
 
 var NoRecords = errors.New("NoRecords")
 
+// Flush writes the records from the given channel to a new sstable, uploads it,
+// and reads it back to verify it. If the sstable doesn't match the records, a
+// VerifyFailed error is returned.
+//
 // TODO: remove most of the return values; meta contains everything.
 func (bs *Blobstore) Flush(ctx context.Context, ch chan *types.Record) (dest string, count int, meta *sstable.Meta, err error) {
-	f, err := os.CreateTemp("", "sstable-*")
+	f, err := os.CreateTemp(bs.tempDir, "sstable-*")
 	if err != nil {
 		return "", 0, nil, fmt.Errorf("CreateTemp: %w", err)
 	}
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	w := sstable.NewWriter(bs.clock)
+	w := sstable.NewSpillWriter(bs.clock, bs.flushMem, bs.tempDir, bs.writerOpts()...)
+	defer w.Close()
 
+	t := ProgressFrom(ctx)
 	n := 0
 	for rec := range ch {
 		err = w.Add(rec)
@@ -136,6 +884,7 @@ func (bs *Blobstore) Flush(ctx context.Context, ch chan *types.Record) (dest str
 			return "", 0, nil, fmt.Errorf("Write: %w", err)
 		}
 		n++
+		t.Record()
 	}
 
 	// nothing to write
@@ -148,38 +897,309 @@ func (bs *Blobstore) Flush(ctx context.Context, ch chan *types.Record) (dest str
 		return "", 0, nil, fmt.Errorf("sstable.Write: %w", err)
 	}
 
-	_, err = f.Seek(0, 0)
+	key, err := bs.upload(ctx, f, meta, w.Index())
 	if err != nil {
-		return "", 0, nil, fmt.Errorf("Seek: %w", err)
+		return "", 0, nil, err
+	}
+
+	err = bs.verify(ctx, meta, n-w.Dropped())
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return key, n, meta, nil
+}
+
+// FlushSorted is like Flush, but the records must already be sorted (see
+// sstable.SortedWriter), so they're written to disk as they arrive rather than
+// buffered in memory. The channel is drained even if an error is returned.
+func (bs *Blobstore) FlushSorted(ctx context.Context, ch chan *types.Record) (dest string, count int, meta *sstable.Meta, err error) {
+	// don't leave the sender blocked if we bail out early.
+	defer func() {
+		for range ch {
+		}
+	}()
+
+	f, err := os.CreateTemp(bs.tempDir, "sstable-*")
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	w, err := sstable.NewSortedWriter(buf, bs.clock, bs.writerOpts()...)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("NewSortedWriter: %w", err)
+	}
+
+	t := ProgressFrom(ctx)
+	n := 0
+	for rec := range ch {
+		err = w.Add(rec)
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("Add: %w", err)
+		}
+		n++
+		t.Record()
+	}
+
+	if n == 0 {
+		return "", 0, nil, NoRecords
+	}
+
+	meta, err = w.Close()
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("sstable.Close: %w", err)
+	}
+
+	err = buf.Flush()
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("Flush: %w", err)
+	}
+
+	key, err := bs.upload(ctx, f, meta, w.Index())
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return key, n, meta, nil
+}
+
+// upload puts the sstable in the given file, described by the given meta, and
+// its index (if it's not nil) to the blobstore. It sets the Prefix, Bucket,
+// Checksum, and Index (and maybe Filter) of the meta, and returns the key.
+func (bs *Blobstore) upload(ctx context.Context, f *os.File, meta *sstable.Meta, ix *sstable.Index) (string, error) {
+	t := ProgressFrom(ctx)
+	t.Phase(PhaseUpload)
+
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return "", fmt.Errorf("Seek: %w", err)
+	}
+
+	meta.Checksum, err = checksum(f)
+	if err != nil {
+		return "", fmt.Errorf("checksum: %w", err)
 	}
 
 	s3c, err := bs.getS3(ctx)
 	if err != nil {
-		return "", 0, nil, fmt.Errorf("getS3: %w", err)
+		return "", fmt.Errorf("getS3: %w", err)
+	}
+
+	err = bs.faults.Check(ctx, faultinject.BlobstorePut)
+	if err != nil {
+		return "", err
+	}
+
+	// sstables are named after the time they were created, so two processes
+	// writing to the same bucket (e.g. an archive and its clone) might choose
+	// the same name. the puts are conditional, so neither overwrites the other,
+	// and the loser tries again a millisecond later.
+	for i := 0; ; i++ {
+		key, err := bs.put(ctx, s3c, f, meta, ix)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, errBlobExists) || i == maxNameAttempts-1 {
+			return "", err
+		}
+
+		meta.Created = meta.Created.Add(time.Millisecond)
+	}
+}
+
+// maxNameAttempts is the number of names which upload tries for an sstable,
+// before giving up.
+const maxNameAttempts = 10
+
+// errBlobExists is returned by put when there's already a blob with the name of
+// the sstable or its index.
+var errBlobExists = errors.New("blob already exists")
+
+// put uploads the given sstable and index under the name derived from the meta,
+// unless either already exists, in which case it returns errBlobExists. The
+// name recorded in the footer of the sstable might be different, if this isn't
+// the first attempt, but the key takes precedence (see ReadMeta).
+func (bs *Blobstore) put(ctx context.Context, s3c S3API, f *os.File, meta *sstable.Meta, ix *sstable.Index) (string, error) {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return "", fmt.Errorf("Seek: %w", err)
 	}
 
+	meta.Prefix = ""
+	meta.Prefix = bs.scheme.Prefix(meta)
 	key := meta.Filename()
+
+	// the primary bucket is left implicit, so that metadata doesn't change for
+	// archives which don't use multiple buckets.
+	bucket := bs.bucket
+	meta.Bucket = ""
+	if bs.ring != nil {
+		bucket = bs.ring.locate(key)
+		if bucket != bs.bucket {
+			meta.Bucket = bucket
+		}
+	}
+
+	// the index is written first, so that every sstable which exists has one.
+	// if the sstable then fails, the index is an orphan, like a failed sstable.
+	meta.Index = ""
+	if ix != nil {
+		meta.Index, err = bs.putIndex(ctx, bucket, meta, ix)
+		if err != nil {
+			return "", err
+		}
+
+		meta.Filter = bs.inlineFilter(ix)
+	}
+
+	var body io.ReadSeeker = f
+	if t := ProgressFrom(ctx); t != nil {
+		body = &uploadReader{f: f, t: t}
+	}
+
 	_, err = s3c.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &bs.bucket,
+		Bucket: &bucket,
 		Key:    &key,
-		Body:   f,
-		// never overwrite sstables. they're immutable. this is only a problem
-		// if we try to put two at the same time, since they're timestamped.
+		Body:   body,
+		// never overwrite sstables. they're immutable.
 		IfNoneMatch: aws.String("*"),
 	})
 	if err != nil {
-		return "", 0, nil, fmt.Errorf("PutObject: %w", err)
+		if isPreconditionFailed(err) {
+
+			// the index was written by us, so it's safe to remove.
+			if meta.Index != "" {
+				err = bs.delete(ctx, bucket, meta.Index)
+				if err != nil {
+					return "", fmt.Errorf("delete index: %w", err)
+				}
+			}
+
+			return "", fmt.Errorf("PutObject(%s): %w", key, errBlobExists)
+		}
+		return "", fmt.Errorf("PutObject: %w", err)
 	}
 
-	return key, n, meta, nil
+	return key, nil
+}
+
+// isPreconditionFailed returns true if the given error is from a conditional
+// request whose condition wasn't met.
+func isPreconditionFailed(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "PreconditionFailed"
+}
+
+// putIndex writes the given index of the given sstable to the given bucket, and
+// returns its key.
+func (bs *Blobstore) putIndex(ctx context.Context, bucket string, meta *sstable.Meta, ix *sstable.Index) (string, error) {
+	s3c, err := bs.getS3(ctx)
+	if err != nil {
+		return "", fmt.Errorf("getS3: %w", err)
+	}
+
+	b, err := ix.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("Index.Marshal: %w", err)
+	}
+
+	key := meta.IndexFilename()
+	_, err = s3c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(b),
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return "", fmt.Errorf("PutObject(%s): %w", key, errBlobExists)
+		}
+		return "", fmt.Errorf("PutObject(index): %w", err)
+	}
+
+	return key, nil
+}
+
+// BuildIndex reads the whole of the given sstable, which was written before
+// indexes existed, and writes an index for it alongside. It sets the Index (and
+// maybe Filter) of the meta, which should then be attached to the sstable's
+// metadata. The sstable itself is not modified.
+func (bs *Blobstore) BuildIndex(ctx context.Context, m *sstable.Meta) error {
+	bucket := bs.bucketFor(m)
+
+	body, err := bs.open(ctx, bucket, m.Filename(), "")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	ix, err := sstable.BuildIndex(bufio.NewReader(body), bs.filter)
+	if err != nil {
+		return fmt.Errorf("sstable.BuildIndex: %w", err)
+	}
+
+	m.Index, err = bs.putIndex(ctx, bucket, m, ix)
+	if err != nil {
+		return err
+	}
+
+	m.Filter = bs.inlineFilter(ix)
+	return nil
+}
+
+// inlineFilter returns the filter of the given index, if it's small enough to
+// store in the metadata, or nil.
+func (bs *Blobstore) inlineFilter(ix *sstable.Index) *sstable.EncodedFilter {
+	if ix.Filter == nil || ix.Filter.Size() > bs.inlineFilters {
+		return nil
+	}
+
+	return ix.Filter
+}
+
+// bucketFor returns the bucket which the given sstable was written to.
+func (bs *Blobstore) bucketFor(m *sstable.Meta) string {
+	if m.Bucket != "" {
+		return m.Bucket
+	}
+
+	return bs.bucket
+}
+
+// S3API is the subset of the S3 client used by the blobstore. It's implemented
+// by *s3.Client, and can be implemented by a wrapper, e.g. to add tracing.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// SetClient makes the blobstore use the given client, rather than creating its
+// own, so that the connection pool, credentials, and middleware can be shared
+// with others, or managed by the caller. Requests are still counted per
+// blobstore (see RequestStats), as long as the client applies the options
+// passed to each call, like *s3.Client does. Like the client which would be
+// created, it should use path-style addressing if S3 isn't AWS.
+func (bs *Blobstore) SetClient(client S3API) {
+	bs.s3 = &countedClient{client, bs.requests.register}
+}
+
+// NewClient returns an S3 client configured from the environment, like the one
+// each blobstore creates unless SetClient is called, to be shared by several.
+func NewClient(ctx context.Context) (*s3.Client, error) {
+	return connectToS3(ctx)
 }
 
-func (bs *Blobstore) getS3(ctx context.Context) (*s3.Client, error) {
+func (bs *Blobstore) getS3(ctx context.Context) (S3API, error) {
 	if bs.s3 != nil {
 		return bs.s3, nil
 	}
 
-	s, err := connectToS3(ctx)
+	s, err := connectToS3(ctx, bs.requests.register)
 	if err != nil {
 		return nil, err
 	}
@@ -188,7 +1208,7 @@ func (bs *Blobstore) getS3(ctx context.Context) (*s3.Client, error) {
 	return s, nil
 }
 
-func connectToS3(ctx context.Context) (*s3.Client, error) {
+func connectToS3(ctx context.Context, apiOpts ...func(*middleware.Stack) error) (*s3.Client, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, err
@@ -199,5 +1219,6 @@ func connectToS3(ctx context.Context) (*s3.Client, error) {
 		// the default of bucket-name.localhost, which doesn't work. seems fine
 		// to just do this in production too.
 		o.UsePathStyle = true
+		o.APIOptions = append(o.APIOptions, apiOpts...)
 	}), nil
 }
@@ -1,12 +1,20 @@
 package blobstore
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
+	"github.com/adammck/blobby/pkg/sstable"
 	"github.com/adammck/blobby/pkg/testdeps"
 	"github.com/adammck/blobby/pkg/types"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -58,26 +66,910 @@ func TestFlush(t *testing.T) {
 	assert.Equal(t, "test1", meta.MinKey)
 	assert.Equal(t, "test2", meta.MaxKey)
 
-	rec1, _, err := bs.Find(ctx, meta.Filename(), "test1")
+	rec1, _, err := bs.Find(ctx, meta, "test1")
 	require.NoError(t, err)
 	assert.NotNil(t, rec1)
 	assert.Equal(t, "test1", rec1.Key)
 	assert.Equal(t, []byte("doc1"), rec1.Document)
 
-	rec2, _, err := bs.Find(ctx, meta.Filename(), "test2")
+	rec2, _, err := bs.Find(ctx, meta, "test2")
 	require.NoError(t, err)
 	assert.NotNil(t, rec2)
 	assert.Equal(t, "test2", rec2.Key)
 	assert.Equal(t, []byte("doc2"), rec2.Document)
 
 	// unknown key
-	rec3, _, err := bs.Find(ctx, meta.Filename(), "test3")
+	rec3, _, err := bs.Find(ctx, meta, "test3")
 	require.NoError(t, err)
 	assert.Nil(t, rec3)
 }
 
 func TestGetNonExistentFile(t *testing.T) {
 	ctx, _, bs, _ := setup(t)
-	_, _, err := bs.Find(ctx, "nonexistent.sstable", "test1")
+	_, err := bs.Get(ctx, "nonexistent.sstable")
 	assert.Error(t, err)
 }
+
+func TestFlushWithKeyScheme(t *testing.T) {
+	ctx, env, _, clock := setup(t)
+	bs := New(env.S3Bucket, clock, WithKeyScheme(sstable.DateKeys))
+
+	ch := make(chan *types.Record)
+	go func() {
+		ch <- &types.Record{
+			Key:       "test1",
+			Timestamp: clock.Now(),
+			Document:  []byte("doc1"),
+		}
+		close(ch)
+	}()
+
+	dest, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now().UTC().Format("2006/01/02/"), meta.Prefix)
+	assert.Equal(t, meta.Filename(), dest)
+
+	rec, _, err := bs.Find(ctx, meta, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc1"), rec.Document)
+}
+
+func TestReadMeta(t *testing.T) {
+	ctx, env, _, clock := setup(t)
+	bs := New(env.S3Bucket, clock, WithKeyScheme(sstable.HashedKeys))
+
+	ch := make(chan *types.Record)
+	go func() {
+		ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+		ch <- &types.Record{Key: "b", Timestamp: clock.Now().Add(time.Second), Document: []byte("doc2")}
+		close(ch)
+	}()
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	m, err := bs.ReadMeta(ctx, meta.Filename())
+	require.NoError(t, err)
+	assert.Equal(t, meta.Filename(), m.Filename())
+	assert.Equal(t, "a", m.MinKey)
+	assert.Equal(t, "b", m.MaxKey)
+	assert.Equal(t, 2, m.Count)
+	assert.Equal(t, meta.Size, m.Size)
+	assert.True(t, meta.MaxTime.Equal(m.MaxTime))
+}
+
+func TestFlushWithBuckets(t *testing.T) {
+	ctx, env, _, clock := setup(t)
+	extra := []string{"extra-1", "extra-2"}
+	bs := New(env.S3Bucket, clock, WithBuckets(extra...))
+
+	s3c, err := NewClient(ctx)
+	require.NoError(t, err)
+	for _, b := range extra {
+		_, err = s3c.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(b)})
+		require.NoError(t, err)
+	}
+
+	// flush enough sstables that some of them land in each bucket.
+	seen := map[string]int{}
+	var metas []*sstable.Meta
+	for i := 0; i < 20; i++ {
+		clock.(*clockwork.FakeClock).Advance(time.Second)
+
+		ch := make(chan *types.Record, 1)
+		ch <- &types.Record{Key: "k", Timestamp: clock.Now(), Document: []byte(fmt.Sprintf("v%d", i))}
+		close(ch)
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		require.NoError(t, err)
+		seen[bs.bucketFor(meta)]++
+		metas = append(metas, meta)
+	}
+	assert.Len(t, seen, 3)
+
+	// every sstable can be read back via its meta, wherever it went.
+	for i, m := range metas {
+		rec, _, err := bs.Find(ctx, m, "k")
+		require.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("v%d", i)), rec.Document)
+	}
+
+	// the primary bucket is implicit, and the others aren't.
+	for _, m := range metas {
+		_, err := bs.Get(ctx, m.Filename())
+		if m.Bucket == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+
+	for _, m := range metas {
+		require.NoError(t, bs.DeleteSSTable(ctx, m))
+		_, _, err := bs.Find(ctx, m, "k")
+		assert.Error(t, err)
+	}
+}
+
+func TestFakeS3(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock, WithKeyScheme(sstable.HashedKeys))
+
+	ch := make(chan *types.Record, 2)
+	ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+	ch <- &types.Record{Key: "b", Timestamp: clock.Now().Add(time.Second), Document: []byte("doc2")}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	rec, _, err := bs.Find(ctx, meta, "b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc2"), rec.Document)
+
+	// ranged reads
+	m, err := bs.ReadMeta(ctx, meta.Filename())
+	require.NoError(t, err)
+	assert.Equal(t, 2, m.Count)
+	assert.Equal(t, meta.Size, m.Size)
+
+	blobs, err := bs.List(ctx, meta.Prefix)
+	require.NoError(t, err)
+	require.Len(t, blobs, 2)
+	assert.Equal(t, meta.Filename(), blobs[0].Key)
+	assert.Equal(t, meta.Index, blobs[1].Key)
+
+	_, err = bs.GetBlob(ctx, "nope")
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+
+	require.NoError(t, bs.DeleteSSTable(ctx, meta))
+	_, err = bs.OpenSSTable(ctx, meta)
+	assert.Error(t, err)
+}
+
+func TestFlushNameCollision(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	// two archives sharing a bucket, which flush at exactly the same time.
+	var metas []*sstable.Meta
+	for i := range 3 {
+		bs := New(env.S3Bucket, clock, WithKeyScheme(sstable.HashedKeys))
+
+		ch := make(chan *types.Record, 1)
+		ch <- &types.Record{Key: "k", Timestamp: clock.Now(), Document: []byte(fmt.Sprintf("doc%d", i))}
+		close(ch)
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		require.NoError(t, err)
+		metas = append(metas, meta)
+	}
+
+	// neither was overwritten; the later ones were given the next names.
+	for i, m := range metas {
+		assert.Equal(t, clock.Now().Add(time.Duration(i)*time.Millisecond).UnixMilli(), m.Created.UnixMilli())
+
+		bs := New(env.S3Bucket, clock)
+		rec, _, err := bs.Find(ctx, m, "k")
+		require.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("doc%d", i)), rec.Document)
+
+		got, err := bs.ReadMeta(ctx, m.Filename())
+		require.NoError(t, err)
+		assert.Equal(t, m.Created.UnixMilli(), got.Created.UnixMilli())
+	}
+}
+
+func TestOpenSSTableAt(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	recs := []*types.Record{
+		{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")},
+		{Key: "b", Timestamp: clock.Now(), Document: []byte("doc2")},
+		{Key: "c", Timestamp: clock.Now(), Document: []byte("doc3")},
+	}
+
+	ch := make(chan *types.Record, len(recs))
+	for _, rec := range recs {
+		ch <- rec
+	}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	magic, err := bs.ReadRange(ctx, meta, 0, 7)
+	require.NoError(t, err)
+	assert.Equal(t, "mudkips", string(magic))
+
+	// the second record starts after the magic bytes and the first record.
+	var buf bytes.Buffer
+	n, err := recs[0].Write(&buf)
+	require.NoError(t, err)
+
+	r, err := bs.OpenSSTableAt(ctx, meta, int64(len(magic)+n))
+	require.NoError(t, err)
+	defer r.Close()
+
+	var keys []string
+	for {
+		rec, err := r.Next()
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		keys = append(keys, rec.Key)
+	}
+
+	assert.Equal(t, []string{"b", "c"}, keys)
+	assert.Equal(t, 3, r.Footer().Count)
+}
+
+func TestFlushSorted(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	ch := make(chan *types.Record)
+	go func() {
+		defer close(ch)
+		for i := range 1000 {
+			ch <- &types.Record{Key: fmt.Sprintf("key-%04d", i), Timestamp: clock.Now(), Document: []byte("doc")}
+		}
+	}()
+
+	_, n, meta, err := bs.FlushSorted(ctx, ch)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, n)
+	assert.Equal(t, 1000, meta.Count)
+
+	// read it back in chunks much smaller than the blob.
+	r, err := bs.OpenSSTableBuffered(ctx, meta, 128)
+	require.NoError(t, err)
+	defer r.Close()
+
+	count := 0
+	for {
+		rec, err := r.Next()
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		assert.Equal(t, fmt.Sprintf("key-%04d", count), rec.Key)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	// unsorted input fails, but the sender isn't left blocked.
+	ch = make(chan *types.Record)
+	go func() {
+		defer close(ch)
+		for _, k := range []string{"b", "a", "c"} {
+			ch <- &types.Record{Key: k, Timestamp: clock.Now()}
+		}
+	}()
+
+	_, _, _, err = bs.FlushSorted(ctx, ch)
+	assert.ErrorIs(t, err, sstable.ErrUnsorted)
+}
+
+func TestFlushPartitioned(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	tenant := func(key string) string {
+		t, _, _ := strings.Cut(key, "/")
+		return t
+	}
+
+	ch := make(chan *types.Record)
+	go func() {
+		defer close(ch)
+		for _, k := range []string{"a/1", "a/2", "b/1", "c/1", "c/2", "c/3"} {
+			ch <- &types.Record{Key: k, Timestamp: clock.Now(), Document: []byte("doc")}
+		}
+	}()
+
+	metas, err := bs.FlushPartitioned(ctx, ch, tenant)
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+
+	// one sstable per tenant, with distinct filenames even though the clock
+	// didn't move.
+	for i, exp := range [][]string{{"a/1", "a/2"}, {"b/1"}, {"c/1", "c/3"}} {
+		assert.Equal(t, exp[0], metas[i].MinKey)
+		assert.Equal(t, exp[len(exp)-1], metas[i].MaxKey)
+	}
+	assert.Equal(t, []int{2, 1, 3}, []int{metas[0].Count, metas[1].Count, metas[2].Count})
+	assert.NotEqual(t, metas[0].Filename(), metas[1].Filename())
+	assert.NotEqual(t, metas[1].Filename(), metas[2].Filename())
+
+	rec, _, err := bs.Find(ctx, metas[2], "c/2")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "c/2", rec.Key)
+
+	// no records is the same as FlushSorted.
+	ch = make(chan *types.Record)
+	close(ch)
+	_, err = bs.FlushPartitioned(ctx, ch, tenant)
+	assert.ErrorIs(t, err, NoRecords)
+}
+
+func TestFlushVerify(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	fi := faultinject.New(clock)
+	bs := New(env.S3Bucket, clock, WithFaults(fi))
+
+	flush := func() (*sstable.Meta, error) {
+		ch := make(chan *types.Record)
+		go func() {
+			defer close(ch)
+			for _, k := range []string{"a", "b", "c"} {
+				ch <- &types.Record{Key: k, Timestamp: clock.Now(), Document: []byte(k)}
+			}
+		}()
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		clock.Advance(time.Second)
+		return meta, err
+	}
+
+	meta, err := flush()
+	require.NoError(t, err)
+	b, err := bs.GetBlob(ctx, meta.Filename())
+	require.NoError(t, err)
+	sum, err := checksum(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, sum, meta.Checksum)
+
+	// a bit flipped on the way back is caught.
+	fi.Add(faultinject.Fault{Op: faultinject.BlobstoreGet, Corrupt: true, Times: 1})
+	_, err = flush()
+	require.ErrorIs(t, err, ErrVerifyFailed)
+	var vf *VerifyFailed
+	require.ErrorAs(t, err, &vf)
+	assert.Equal(t, "checksum", vf.What)
+}
+
+func TestFlushProgress(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	var ps []Progress
+	ctx = WithProgress(ctx, clock, 2500, func(p Progress) {
+		ps = append(ps, p)
+	})
+
+	ch := make(chan *types.Record)
+	go func() {
+		defer close(ch)
+		for i := 0; i < 2500; i++ {
+			if i == 999 {
+				clock.Advance(time.Second)
+			}
+			ch <- &types.Record{Key: fmt.Sprintf("%04d", i), Timestamp: clock.Now(), Document: []byte("x")}
+		}
+	}()
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	var phases []Phase
+	for _, p := range ps {
+		phases = append(phases, p.Phase)
+	}
+	assert.Equal(t, []Phase{PhaseWrite, PhaseWrite, PhaseUpload, PhaseVerify}, phases)
+
+	// a second per thousand records, so another 500ms for the rest.
+	assert.Equal(t, 1000, ps[0].Records)
+	assert.Equal(t, 2500, ps[0].TotalRecords)
+	assert.Equal(t, 1500*time.Millisecond, ps[0].ETA)
+	assert.Equal(t, 2000, ps[1].Records)
+
+	b, err := bs.GetBlob(ctx, meta.Filename())
+	require.NoError(t, err)
+
+	last := ps[len(ps)-1]
+	assert.Equal(t, 2500, last.Records)
+	assert.Equal(t, int64(len(b)), last.BytesUploaded)
+	assert.Equal(t, time.Second, last.Elapsed)
+}
+
+// BenchmarkFind measures fetching and scanning an sstable from the fake S3, so
+// it's mostly the cost of the HTTP round trip and decoding, not the network.
+func BenchmarkFind(b *testing.B) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, b, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	ch := make(chan *types.Record, 1000)
+	for i := range 1000 {
+		ch <- &types.Record{Key: fmt.Sprintf("key-%04d", i), Timestamp: clock.Now(), Document: []byte("doc")}
+	}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := range b.N {
+		rec, _, err := bs.Find(ctx, meta, fmt.Sprintf("key-%04d", i%1000))
+		require.NoError(b, err)
+		require.NotNil(b, rec)
+	}
+}
+
+func TestFindWithIndex(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	ch := make(chan *types.Record, 1000)
+	for i := range 1000 {
+		ch <- &types.Record{
+			Key:       fmt.Sprintf("key-%04d", i),
+			Timestamp: clock.Now(),
+			Document:  []byte(fmt.Sprintf("doc-%04d", i)),
+		}
+	}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+	require.Equal(t, meta.IndexFilename(), meta.Index)
+
+	// the index lets the reader skip most of the sstable.
+	rec, stats, err := bs.Find(ctx, meta, "key-0900")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "doc-0900", string(rec.Document))
+	assert.Less(t, stats.RecordsScanned, 100)
+	assert.False(t, stats.Filtered)
+
+	// missing keys are (almost always) ruled out without fetching the sstable.
+	filtered := 0
+	for i := range 100 {
+		rec, stats, err := bs.Find(ctx, meta, fmt.Sprintf("nope-%d", i))
+		require.NoError(t, err)
+		require.Nil(t, rec)
+		if stats.Filtered {
+			filtered++
+		}
+	}
+	assert.Greater(t, filtered, 90)
+
+	// sstables without an index are read from the start.
+	legacy := *meta
+	legacy.Index = ""
+	rec, stats, err = bs.Find(ctx, &legacy, "key-0900")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, 901, stats.RecordsScanned)
+
+	err = bs.DeleteSSTable(ctx, meta)
+	require.NoError(t, err)
+	_, err = bs.GetBlob(ctx, meta.Index)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+}
+
+func TestBuildIndex(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock, WithFormat(sstable.FormatBlocks))
+
+	ch := make(chan *types.Record, 1000)
+	for i := range 1000 {
+		ch <- &types.Record{
+			Key:       fmt.Sprintf("key-%04d", i),
+			Timestamp: clock.Now(),
+			Document:  []byte(fmt.Sprintf("doc-%04d", i)),
+		}
+	}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+	want, err := bs.GetBlob(ctx, meta.Index)
+	require.NoError(t, err)
+
+	// forget the index, like an sstable written before they existed.
+	require.NoError(t, bs.DeleteIndex(ctx, meta))
+	meta.Index = ""
+
+	require.NoError(t, bs.BuildIndex(ctx, meta))
+	assert.Equal(t, meta.IndexFilename(), meta.Index)
+
+	got, err := bs.GetBlob(ctx, meta.Index)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	rec, _, err := bs.Find(ctx, meta, "key-0500")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "doc-0500", string(rec.Document))
+}
+
+func TestInlineFilters(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	flush := func(bs *Blobstore, n int) *sstable.Meta {
+		ch := make(chan *types.Record, n)
+		for i := range n {
+			ch <- &types.Record{
+				Key:       fmt.Sprintf("key-%04d", i),
+				Timestamp: clock.Now(),
+				Document:  []byte("doc"),
+			}
+		}
+		close(ch)
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		require.NoError(t, err)
+		clock.Advance(time.Second)
+		return meta
+	}
+
+	bs := New(env.S3Bucket, clock, WithInlineFilters(1024))
+
+	// small filters are copied into the meta.
+	meta := flush(bs, 100)
+	require.NotNil(t, meta.Filter)
+
+	// so missing keys are ruled out without fetching the index. (it's gone, so
+	// that would fail.)
+	require.NoError(t, bs.DeleteIndex(ctx, meta))
+	filtered := 0
+	for i := range 100 {
+		_, stats, err := bs.Find(ctx, meta, fmt.Sprintf("nope-%d", i))
+		if err == nil && stats.Filtered {
+			filtered++
+		}
+	}
+	assert.Greater(t, filtered, 90)
+
+	// large ones aren't.
+	meta = flush(bs, 2000)
+	assert.Nil(t, meta.Filter)
+	assert.NotEmpty(t, meta.Index)
+}
+
+func TestFilterTypes(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	for _, ft := range []sstable.FilterType{sstable.FilterBloom, sstable.FilterRibbon, sstable.FilterCuckoo} {
+		t.Run(string(ft), func(t *testing.T) {
+			bs := New(env.S3Bucket, clock, WithFilter(ft), WithInlineFilters(4096))
+
+			ch := make(chan *types.Record, 100)
+			for i := range 100 {
+				ch <- &types.Record{Key: fmt.Sprintf("key-%04d", i), Timestamp: clock.Now(), Document: []byte("doc")}
+			}
+			close(ch)
+			clock.Advance(time.Second)
+
+			_, _, meta, err := bs.Flush(ctx, ch)
+			require.NoError(t, err)
+			require.NotNil(t, meta.Filter)
+
+			rec, _, err := bs.Find(ctx, meta, "key-0042")
+			require.NoError(t, err)
+			require.NotNil(t, rec)
+
+			_, stats, err := bs.Find(ctx, meta, "nope")
+			require.NoError(t, err)
+			assert.True(t, stats.Filtered)
+		})
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	for _, mode := range []BlobCacheMode{BlobCacheTrust, BlobCacheValidate} {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			bs := New(env.S3Bucket, clock, WithBlobCache(t.TempDir(), 0, mode))
+
+			ch := make(chan *types.Record, 2)
+			ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+			ch <- &types.Record{Key: "b", Timestamp: clock.Now(), Document: []byte("doc2")}
+			close(ch)
+
+			_, _, meta, err := bs.Flush(ctx, ch)
+			require.NoError(t, err)
+
+			// the first read of each blob (the index and the sstable) misses.
+			rec, _, err := bs.Find(ctx, meta, "a")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("doc1"), rec.Document)
+			assert.Equal(t, int64(2), bs.BlobCacheStats().Misses)
+
+			// ranged reads are served from the cached copy.
+			m, err := bs.ReadMeta(ctx, meta.Filename())
+			require.NoError(t, err)
+			assert.Equal(t, 2, m.Count)
+
+			r, err := bs.OpenSSTable(ctx, meta)
+			require.NoError(t, err)
+			rec, err = r.Next()
+			require.NoError(t, err)
+			assert.Equal(t, "a", rec.Key)
+			require.NoError(t, r.Close())
+
+			s := bs.BlobCacheStats()
+			assert.Equal(t, int64(2), s.Misses)
+			assert.Equal(t, int64(3), s.Hits)
+			assert.Positive(t, s.Bytes)
+			if mode == BlobCacheValidate {
+				assert.Equal(t, int64(3), s.Validated)
+			}
+
+			// overwrite the sstable, which should never happen. only the
+			// validating cache notices.
+			var buf bytes.Buffer
+			w := sstable.NewWriter(clock)
+			require.NoError(t, w.Add(&types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("new")}))
+			_, err = w.Write(&buf)
+			require.NoError(t, err)
+			require.NoError(t, bs.PutBlob(ctx, meta.Filename(), buf.Bytes()))
+
+			r, err = bs.OpenSSTable(ctx, meta)
+			require.NoError(t, err)
+			rec, err = r.Next()
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			if mode == BlobCacheValidate {
+				assert.Equal(t, []byte("new"), rec.Document)
+				assert.Equal(t, int64(1), bs.BlobCacheStats().Stale)
+			} else {
+				assert.Equal(t, []byte("doc1"), rec.Document)
+			}
+
+			// deleting drops the cached copy.
+			require.NoError(t, bs.DeleteSSTable(ctx, meta))
+			_, err = bs.OpenSSTable(ctx, meta)
+			assert.Error(t, err)
+			assert.Zero(t, bs.BlobCacheStats().Bytes)
+		})
+	}
+}
+
+func TestSetCacheSizes(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock, WithBlobCache(t.TempDir(), 0, BlobCacheTrust))
+
+	for _, k := range []string{"a", "b"} {
+		ch := make(chan *types.Record, 1)
+		ch <- &types.Record{Key: k, Timestamp: clock.Now(), Document: []byte(k)}
+		close(ch)
+
+		_, _, meta, err := bs.Flush(ctx, ch)
+		require.NoError(t, err)
+		_, _, err = bs.Find(ctx, meta, k)
+		require.NoError(t, err)
+		clock.Advance(time.Second)
+	}
+
+	// an index and an sstable for each.
+	assert.Equal(t, 2, bs.indexes.ll.Len())
+	assert.Equal(t, 4, bs.blobs.ll.Len())
+
+	bs.SetIndexCacheSize(1)
+	bs.SetBlobCacheSize(1)
+	assert.Equal(t, 1, bs.indexes.ll.Len())
+	assert.Equal(t, 1, bs.blobs.ll.Len())
+	assert.Equal(t, int64(3), bs.BlobCacheStats().Evictions)
+
+	bs.SetIndexCacheSize(0)
+	bs.SetBlobCacheSize(0)
+	assert.Equal(t, DefaultIndexCacheSize, bs.indexes.size)
+	assert.Equal(t, int64(DefaultBlobCacheSize), bs.blobs.maxBytes)
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock, WithBlobCache(t.TempDir(), 0, BlobCacheTrust))
+
+	ch := make(chan *types.Record, 2)
+	ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+	ch <- &types.Record{Key: "c", Timestamp: clock.Now(), Document: []byte("doc2")}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(ctx, ch)
+	require.NoError(t, err)
+
+	// the filter rules out b, so only the index is fetched.
+	ps, err := bs.Prefetch(ctx, meta, "b")
+	require.NoError(t, err)
+	assert.Equal(t, &PrefetchStats{Filtered: true}, ps)
+	assert.Equal(t, int64(1), bs.BlobCacheStats().Misses)
+
+	ps, err = bs.Prefetch(ctx, meta, "c")
+	require.NoError(t, err)
+	assert.Equal(t, &PrefetchStats{Cached: true}, ps)
+	assert.Equal(t, int64(2), bs.BlobCacheStats().Misses)
+
+	// now reads don't miss.
+	rec, _, err := bs.Find(ctx, meta, "c")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc2"), rec.Document)
+	assert.Equal(t, int64(2), bs.BlobCacheStats().Misses)
+}
+
+func TestSample(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	for _, f := range []sstable.Format{sstable.FormatRecords, sstable.FormatBlocks} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			bs := New(env.S3Bucket, clock, WithFormat(f))
+			clock.Advance(time.Second)
+
+			ch := make(chan *types.Record, 1000)
+			for i := range 1000 {
+				ch <- &types.Record{
+					Key:       fmt.Sprintf("key-%04d", i),
+					Timestamp: clock.Now(),
+					Document:  []byte(fmt.Sprintf("doc-%04d", i)),
+				}
+			}
+			close(ch)
+
+			_, _, meta, err := bs.Flush(ctx, ch)
+			require.NoError(t, err)
+
+			ix, err := bs.Index(ctx, meta)
+			require.NoError(t, err)
+			require.Greater(t, len(ix.Entries), 1)
+
+			rnd := rand.New(rand.NewSource(1))
+			recs, err := bs.Sample(ctx, meta, 50, rnd)
+			require.NoError(t, err)
+			require.Len(t, recs, 50)
+
+			// distinct, in order, and intact.
+			for i, rec := range recs {
+				if i > 0 {
+					assert.Less(t, recs[i-1].Key, rec.Key)
+				}
+				assert.Equal(t, "doc-"+strings.TrimPrefix(rec.Key, "key-"), string(rec.Document))
+			}
+
+			// asking for more than there are returns all of them.
+			recs, err = bs.Sample(ctx, meta, 2000, rnd)
+			require.NoError(t, err)
+			assert.Len(t, recs, 1000)
+		})
+	}
+}
+
+func TestChoose(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, []int{0, 1, 2}, choose(rnd, 3, 5))
+
+	counts := make([]int, 10)
+	for range 1000 {
+		got := choose(rnd, 10, 3)
+		require.Len(t, got, 3)
+		require.True(t, got[0] < got[1] && got[1] < got[2])
+		for _, x := range got {
+			counts[x]++
+		}
+	}
+
+	// each should be chosen about 300 times.
+	for _, c := range counts {
+		assert.InDelta(t, 300, c, 60)
+	}
+}
+
+func TestRequestStats(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+	bs := New(env.S3Bucket, clock)
+
+	ch := make(chan *types.Record, 1)
+	ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+	close(ch)
+
+	_, _, meta, err := bs.Flush(WithOpClass(ctx, ClassFlush), ch)
+	require.NoError(t, err)
+
+	_, _, err = bs.Find(WithOpClass(ctx, ClassGet), meta, "a")
+	require.NoError(t, err)
+
+	err = bs.DeleteSSTable(ctx, meta)
+	require.NoError(t, err)
+
+	rs := bs.RequestStats()
+	require.Len(t, rs, 3)
+
+	// the sstable and its index.
+	flush := rs[ClassFlush]
+	assert.Equal(t, int64(2), flush.Requests["PutObject"])
+	assert.Greater(t, flush.BytesSent, int64(meta.Size))
+
+	// the index (which is cached from now on) and the sstable.
+	get := rs[ClassGet]
+	assert.Equal(t, map[string]int64{"GetObject": 2}, get.Requests)
+	assert.Greater(t, get.BytesReceived, int64(0))
+	assert.Equal(t, int64(0), get.BytesSent)
+
+	assert.Equal(t, map[string]int64{"DeleteObject": 2}, rs[ClassOther].Requests)
+}
+
+// tracingClient wraps an S3 client, like a host application might.
+type tracingClient struct {
+	S3API
+	calls int
+}
+
+func (c *tracingClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	c.calls++
+	return c.S3API.PutObject(ctx, params, optFns...)
+}
+
+func TestSetClient(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClock()
+
+	s3c, err := NewClient(ctx)
+	require.NoError(t, err)
+	shared := &tracingClient{S3API: s3c}
+
+	bs1 := New(env.S3Bucket, clock)
+	bs1.SetClient(shared)
+	bs2 := New(env.S3Bucket, clock)
+	bs2.SetClient(shared)
+
+	ch := make(chan *types.Record, 1)
+	ch <- &types.Record{Key: "a", Timestamp: clock.Now(), Document: []byte("doc1")}
+	close(ch)
+
+	_, _, meta, err := bs1.Flush(WithOpClass(ctx, ClassFlush), ch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, shared.calls)
+
+	// the other blobstore can read it, via the same client.
+	rec, _, err := bs2.Find(WithOpClass(ctx, ClassGet), meta, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc1"), rec.Document)
+
+	// but requests are counted by the blobstore which made them.
+	assert.Equal(t, int64(2), bs1.RequestStats()[ClassFlush].Requests["PutObject"])
+	assert.NotContains(t, bs1.RequestStats(), ClassGet)
+	assert.Equal(t, int64(2), bs2.RequestStats()[ClassGet].Requests["GetObject"])
+	assert.NotContains(t, bs2.RequestStats(), ClassFlush)
+}
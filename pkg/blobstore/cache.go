@@ -0,0 +1,113 @@
+package blobstore
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+// DefaultIndexCacheSize is the number of sstable indexes which are kept in
+// memory by default. They're usually a few KB each.
+const DefaultIndexCacheSize = 1024
+
+// indexCache is an LRU cache of sstable indexes, keyed by the key of their
+// blob. Indexes are immutable, so entries never need to be invalidated, only
+// evicted.
+type indexCache struct {
+	mu      sync.Mutex
+	size    int
+	initial int
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type indexCacheEntry struct {
+	key string
+	ix  *sstable.Index
+}
+
+func newIndexCache(size int) *indexCache {
+	return &indexCache{
+		size:    size,
+		initial: size,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+func (c *indexCache) get(key string) (*sstable.Index, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return e.Value.(*indexCacheEntry).ix, true
+}
+
+func (c *indexCache) put(key string, ix *sstable.Index) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&indexCacheEntry{key: key, ix: ix})
+	c.evict()
+}
+
+// resize changes the number of indexes which the cache holds, evicting the
+// least recently used if it's shrinking. Zero restores the initial size.
+func (c *indexCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size <= 0 {
+		size = c.initial
+	}
+
+	c.size = size
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits. The
+// caller must hold mu.
+func (c *indexCache) evict() {
+	for c.ll.Len() > max(c.size, 0) {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*indexCacheEntry).key)
+	}
+}
+
+func (c *indexCache) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
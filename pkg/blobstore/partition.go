@@ -0,0 +1,170 @@
+package blobstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+)
+
+// FlushPartitioned is like FlushSorted, but writes a separate sstable for each
+// run of records whose keys are in the same partition, per the given func. This
+// keeps (say) each tenant's records in their own sstables, rather than every
+// flush producing one sstable which overlaps all of them. Since the records are
+// sorted, each partition should be a contiguous range of keys; otherwise the
+// outputs will overlap each other, which is correct but pointless.
+//
+// Each output is verified like Flush does. The metas of the outputs which were
+// uploaded and verified are returned even if an error is, since they'll be
+// orphaned. The channel is drained either way.
+func (bs *Blobstore) FlushPartitioned(ctx context.Context, ch chan *types.Record, partition func(key string) string) ([]*sstable.Meta, error) {
+	defer func() {
+		for range ch {
+		}
+	}()
+
+	// the filenames are based on the creation time, so every output needs a
+	// different one, even if they're written within the same millisecond, by
+	// this call or a previous one.
+	clock := &bs.mono
+
+	t := ProgressFrom(ctx)
+	var metas []*sstable.Meta
+	var pw *partWriter
+	var part string
+
+	defer func() {
+		if pw != nil {
+			pw.close()
+		}
+	}()
+
+	for rec := range ch {
+		p := partition(rec.Key)
+		if pw != nil && p != part {
+			meta, err := pw.finish(ctx)
+			pw.close()
+			pw = nil
+			if err != nil {
+				return metas, err
+			}
+			metas = append(metas, meta)
+		}
+
+		if pw == nil {
+			t.Phase(PhaseWrite)
+			var err error
+			pw, err = bs.newPartWriter(clock)
+			if err != nil {
+				return metas, err
+			}
+			part = p
+		}
+
+		err := pw.w.Add(rec)
+		if err != nil {
+			return metas, fmt.Errorf("Add: %w", err)
+		}
+		pw.n++
+		t.Record()
+	}
+
+	if pw == nil {
+		return nil, NoRecords
+	}
+
+	meta, err := pw.finish(ctx)
+	if err != nil {
+		return metas, err
+	}
+
+	return append(metas, meta), nil
+}
+
+// partWriter writes one of the outputs of FlushPartitioned to a temp file.
+type partWriter struct {
+	bs  *Blobstore
+	f   *os.File
+	buf *bufio.Writer
+	w   *sstable.SortedWriter
+
+	// the number of records added.
+	n int
+}
+
+func (bs *Blobstore) newPartWriter(clock clockwork.Clock) (*partWriter, error) {
+	f, err := os.CreateTemp(bs.tempDir, "sstable-*")
+	if err != nil {
+		return nil, fmt.Errorf("CreateTemp: %w", err)
+	}
+
+	buf := bufio.NewWriter(f)
+	w, err := sstable.NewSortedWriter(buf, clock, bs.writerOpts()...)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("NewSortedWriter: %w", err)
+	}
+
+	return &partWriter{bs: bs, f: f, buf: buf, w: w}, nil
+}
+
+// finish writes the footer and index of the sstable, uploads it, and verifies
+// it like Flush does.
+func (pw *partWriter) finish(ctx context.Context) (*sstable.Meta, error) {
+	meta, err := pw.w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("sstable.Close: %w", err)
+	}
+
+	err = pw.buf.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("Flush: %w", err)
+	}
+
+	_, err = pw.bs.upload(ctx, pw.f, meta, pw.w.Index())
+	if err != nil {
+		return nil, err
+	}
+
+	err = pw.bs.verify(ctx, meta, pw.n-pw.w.Dropped())
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// close removes the temp file. It's safe to call after finish.
+func (pw *partWriter) close() {
+	pw.f.Close()
+	os.Remove(pw.f.Name())
+}
+
+// monoClock is a clock whose Now always returns a later millisecond than it
+// did the last time it was called.
+type monoClock struct {
+	clockwork.Clock
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (c *monoClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.Clock.Now()
+	if !c.last.IsZero() && t.UnixMilli() <= c.last.UnixMilli() {
+		t = time.UnixMilli(c.last.UnixMilli() + 1).In(t.Location())
+	}
+
+	c.last = t
+	return t
+}
@@ -0,0 +1,193 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// Phase is a stage of a flush or compaction.
+type Phase string
+
+const (
+	// PhaseWrite is when records are being read from the memtable (or the
+	// inputs of a compaction) and written to a temp file.
+	PhaseWrite Phase = "write"
+
+	// PhaseUpload is when an sstable is being uploaded to the blobstore.
+	PhaseUpload Phase = "upload"
+
+	// PhaseVerify is when an uploaded sstable is being read back to check it.
+	PhaseVerify Phase = "verify"
+
+	// PhaseCommit is when the metadata is being updated.
+	PhaseCommit Phase = "commit"
+
+	// PhaseDone is reported once, when the flush or compaction succeeds.
+	PhaseDone Phase = "done"
+)
+
+// How often progress is reported, other than when the phase changes.
+const (
+	progressRecords = 1000
+	progressBytes   = 1 << 20
+)
+
+// Progress is a snapshot of the progress of a flush or compaction.
+type Progress struct {
+	Phase Phase
+
+	// The number of records written so far, and the number expected in total,
+	// or zero if that isn't known. Compactions might write fewer than expected,
+	// since expired versions are dropped.
+	Records      int
+	TotalRecords int
+
+	// The number of bytes of sstables uploaded so far.
+	BytesUploaded int64
+
+	// How long since the flush or compaction started.
+	Elapsed time.Duration
+
+	// A rough estimate of how long it will take to write the rest of the
+	// records, extrapolated from how long the ones so far took, or zero if
+	// there's no way to know.
+	ETA time.Duration
+}
+
+// ProgressFunc is called with the progress of a flush or compaction, whenever
+// the phase changes and periodically in between. It's never called
+// concurrently, but can be called from any goroutine, so should return quickly.
+type ProgressFunc func(Progress)
+
+type trackerKey struct{}
+
+// Tracker accumulates the progress of a single flush or compaction, and
+// reports it to a ProgressFunc. A nil Tracker ignores everything, so callers
+// needn't check whether progress was requested.
+type Tracker struct {
+	fn    ProgressFunc
+	clock clockwork.Clock
+	start time.Time
+
+	mu sync.Mutex
+	p  Progress
+
+	// the number of records and bytes at the last report.
+	lastRecords int
+	lastBytes   int64
+}
+
+// WithProgress returns a context which reports the progress of the flush or
+// compaction it's passed to, expected to write the given number of records (or
+// zero if unknown), to fn.
+func WithProgress(ctx context.Context, clock clockwork.Clock, total int, fn ProgressFunc) context.Context {
+	t := &Tracker{
+		fn:    fn,
+		clock: clock,
+		start: clock.Now(),
+		p:     Progress{Phase: PhaseWrite, TotalRecords: total},
+	}
+
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// ProgressFrom returns the Tracker attached to the given context by
+// WithProgress, or nil if there isn't one.
+func ProgressFrom(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// Phase reports that the given phase has started.
+func (t *Tracker) Phase(ph Phase) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.p.Phase == ph {
+		return
+	}
+
+	t.p.Phase = ph
+	t.report()
+}
+
+// Record counts one record as written, and reports progress if enough have
+// been since the last report.
+func (t *Tracker) Record() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.p.Records++
+	if t.p.Records-t.lastRecords >= progressRecords {
+		t.report()
+	}
+}
+
+func (t *Tracker) uploaded(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.p.BytesUploaded += n
+	if t.p.BytesUploaded-t.lastBytes >= progressBytes {
+		t.report()
+	}
+}
+
+// report calls the ProgressFunc with the current progress. The mutex must be
+// held, which also stops it being called concurrently.
+func (t *Tracker) report() {
+	p := t.p
+	p.Elapsed = t.clock.Since(t.start)
+
+	if p.Phase == PhaseWrite && p.Records > 0 && p.TotalRecords > p.Records {
+		per := p.Elapsed / time.Duration(p.Records)
+		p.ETA = per * time.Duration(p.TotalRecords-p.Records)
+	}
+
+	t.lastRecords = p.Records
+	t.lastBytes = p.BytesUploaded
+	t.fn(p)
+}
+
+// uploadReader counts the bytes read from an sstable being uploaded. The SDK
+// might read the body more than once (e.g. to sign it) and seek back to the
+// start in between, so only bytes beyond the furthest offset read are counted.
+type uploadReader struct {
+	f   *os.File
+	t   *Tracker
+	off int64
+	max int64
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.off += int64(n)
+	if r.off > r.max {
+		r.t.uploaded(r.off - r.max)
+		r.max = r.off
+	}
+	return n, err
+}
+
+func (r *uploadReader) Seek(offset int64, whence int) (int64, error) {
+	off, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.off = off
+	}
+	return off, err
+}
+
+var _ io.ReadSeeker = &uploadReader{}
@@ -0,0 +1,153 @@
+package blobstore
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// OpClass is the kind of operation which an S3 request was made on behalf of,
+// so the requests can be attributed to it. See WithOpClass.
+type OpClass string
+
+const (
+	ClassGet        OpClass = "get"
+	ClassScan       OpClass = "scan"
+	ClassFlush      OpClass = "flush"
+	ClassCompaction OpClass = "compaction"
+	ClassGC         OpClass = "gc"
+
+	// ClassOther is the class of requests made with a context which has none.
+	ClassOther OpClass = "other"
+)
+
+type opClassKey struct{}
+
+// WithOpClass returns a context which attributes the S3 requests made with it
+// to the given class. The innermost class wins.
+func WithOpClass(ctx context.Context, c OpClass) context.Context {
+	return context.WithValue(ctx, opClassKey{}, c)
+}
+
+// OpClassFrom returns the class of the given context, or ClassOther.
+func OpClassFrom(ctx context.Context) OpClass {
+	if c, ok := ctx.Value(opClassKey{}).(OpClass); ok {
+		return c
+	}
+
+	return ClassOther
+}
+
+// RequestStats counts the S3 requests made for one OpClass, and the bytes which
+// they transferred, which is what S3 charges for.
+type RequestStats struct {
+	// The number of requests, by S3 operation, e.g. "GetObject". Retries are
+	// counted too, since they're charged for.
+	Requests map[string]int64
+
+	// The number of bytes in the bodies of requests to S3, and of responses.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// requestCounter counts every request made by the S3 client, by the class of
+// its context.
+type requestCounter struct {
+	mu      sync.Mutex
+	byClass map[OpClass]*RequestStats
+}
+
+// register adds the middleware which counts requests to the stack of an S3
+// client. It's in the deserialize step, which is after the retry middleware, so
+// it sees every attempt.
+func (c *requestCounter) register(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("CountRequests", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, md, err := next.HandleDeserialize(ctx, in)
+
+		var sent, received int64
+		if req, ok := in.Request.(*smithyhttp.Request); ok {
+			sent = max(req.ContentLength, 0)
+		}
+		if res, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			received = max(res.ContentLength, 0)
+		}
+
+		c.count(OpClassFrom(ctx), awsmiddleware.GetOperationName(ctx), sent, received)
+		return out, md, err
+	}), middleware.After)
+}
+
+func (c *requestCounter) count(class OpClass, op string, sent, received int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byClass == nil {
+		c.byClass = map[OpClass]*RequestStats{}
+	}
+
+	s, ok := c.byClass[class]
+	if !ok {
+		s = &RequestStats{Requests: map[string]int64{}}
+		c.byClass[class] = s
+	}
+
+	s.Requests[op]++
+	s.BytesSent += sent
+	s.BytesReceived += received
+}
+
+func (c *requestCounter) snapshot() map[OpClass]RequestStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[OpClass]RequestStats, len(c.byClass))
+	for class, s := range c.byClass {
+		cp := *s
+		cp.Requests = maps.Clone(s.Requests)
+		out[class] = cp
+	}
+
+	return out
+}
+
+// RequestStats returns the number of S3 requests made by this blobstore since it
+// was created, and the bytes they transferred, by OpClass.
+func (bs *Blobstore) RequestStats() map[OpClass]RequestStats {
+	return bs.requests.snapshot()
+}
+
+// countedClient wraps an S3 client which was given to SetClient, adding the
+// middleware which counts requests to every call, rather than to the client,
+// which might be shared.
+type countedClient struct {
+	S3API
+	register func(*middleware.Stack) error
+}
+
+func (c *countedClient) withCounter(optFns []func(*s3.Options)) []func(*s3.Options) {
+	return append(slices.Clip(optFns), func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, c.register)
+	})
+}
+
+func (c *countedClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return c.S3API.GetObject(ctx, params, c.withCounter(optFns)...)
+}
+
+func (c *countedClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return c.S3API.PutObject(ctx, params, c.withCounter(optFns)...)
+}
+
+func (c *countedClient) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return c.S3API.DeleteObject(ctx, params, c.withCounter(optFns)...)
+}
+
+func (c *countedClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return c.S3API.ListObjectsV2(ctx, params, c.withCounter(optFns)...)
+}
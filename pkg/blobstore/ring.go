@@ -0,0 +1,63 @@
+package blobstore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// ringReplicas is the number of points each bucket occupies on the ring. More
+// points spread sstables more evenly, at the cost of a bigger ring.
+const ringReplicas = 64
+
+// ring assigns sstables to buckets by consistent hashing on their filename, so
+// that adding a bucket only moves a small fraction of new sstables away from
+// the existing buckets. Where each sstable actually went is recorded in its
+// Meta, so changing the ring never affects existing sstables.
+type ring struct {
+	points  []uint64
+	buckets map[uint64]string
+}
+
+func newRing(buckets []string) *ring {
+	r := &ring{
+		buckets: map[uint64]string{},
+	}
+
+	for _, b := range buckets {
+		for i := 0; i < ringReplicas; i++ {
+			p := hash(fmt.Sprintf("%s#%d", b, i))
+			r.points = append(r.points, p)
+			r.buckets[p] = b
+		}
+	}
+
+	slices.Sort(r.points)
+	return r
+}
+
+// locate returns the bucket which the given filename belongs in.
+func (r *ring) locate(fn string) string {
+	h := hash(fn)
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.buckets[r.points[i]]
+}
+
+// hash returns a 64-bit hash of the given string. FNV alone doesn't spread
+// similar strings (like sequential filenames) evenly enough, so the result is
+// passed through the splitmix64 finalizer.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,41 @@
+package blobstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing([]string{"a", "b", "c"})
+
+	counts := map[string]int{}
+	placed := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		fn := fmt.Sprintf("%d.sstable", 1700000000000+i)
+		b := r.locate(fn)
+		counts[b]++
+		placed[fn] = b
+
+		// stable
+		assert.Equal(t, b, r.locate(fn))
+	}
+
+	// roughly even
+	for _, b := range []string{"a", "b", "c"} {
+		assert.Greater(t, counts[b], 500, b)
+	}
+
+	// adding a bucket only moves sstables to the new bucket.
+	r2 := newRing([]string{"a", "b", "c", "d"})
+	moved := 0
+	for fn, b := range placed {
+		b2 := r2.locate(fn)
+		if b2 != b {
+			assert.Equal(t, "d", b2)
+			moved++
+		}
+	}
+	assert.Less(t, moved, 1500)
+}
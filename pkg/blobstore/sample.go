@@ -0,0 +1,145 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+)
+
+// Sample returns n distinct records chosen uniformly at random from the given
+// sstable, or all of them if it has fewer than n, in the order they appear in
+// the sstable. If the index has per-entry counts, only the entries containing
+// the chosen records are read. Otherwise the whole sstable is.
+func (bs *Blobstore) Sample(ctx context.Context, m *sstable.Meta, n int, rnd *rand.Rand) ([]*types.Record, error) {
+	if n <= 0 || m.Count == 0 {
+		return nil, nil
+	}
+
+	pos := choose(rnd, m.Count, n)
+
+	ix, err := bs.Index(ctx, m)
+	if err != nil {
+		return nil, fmt.Errorf("Index: %w", err)
+	}
+
+	if ix == nil || !hasCounts(ix) {
+		r, err := bs.OpenSSTable(ctx, m)
+		if err != nil {
+			return nil, fmt.Errorf("OpenSSTable: %w", err)
+		}
+		defer r.Close()
+
+		return pick(r, pos, m.Count)
+	}
+
+	// walk the entries, reading each one which contains any of the positions.
+	var recs []*types.Record
+	first := 0
+	for _, e := range ix.Entries {
+		var in []int
+		for len(pos) > 0 && pos[0] < first+e.Count {
+			in = append(in, pos[0]-first)
+			pos = pos[1:]
+		}
+
+		if len(in) > 0 {
+			r, err := bs.OpenSSTableAt(ctx, m, e.Offset)
+			if err != nil {
+				return nil, fmt.Errorf("OpenSSTableAt: %w", err)
+			}
+
+			got, err := pick(r, in, e.Count)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			recs = append(recs, got...)
+		}
+
+		first += e.Count
+		if len(pos) == 0 {
+			break
+		}
+	}
+
+	return recs, nil
+}
+
+// hasCounts returns true if every entry of the index has a count, which isn't
+// the case for indexes written before they were added.
+func hasCounts(ix *sstable.Index) bool {
+	if len(ix.Entries) == 0 {
+		return false
+	}
+
+	for _, e := range ix.Entries {
+		if e.Count == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pick decodes the records at the given positions, which must be sorted, from
+// the reader, reading no more than limit records.
+func pick(r *sstable.Reader, pos []int, limit int) ([]*types.Record, error) {
+	var recs []*types.Record
+
+	for i := 0; i < limit && len(pos) > 0; i++ {
+		raw, err := r.NextRaw()
+		if err != nil {
+			return nil, fmt.Errorf("NextRaw: %w", err)
+		}
+		if raw == nil {
+			break
+		}
+
+		if i != pos[0] {
+			continue
+		}
+		pos = pos[1:]
+
+		rec := &types.Record{}
+		err = types.Unmarshal(raw, rec)
+		if err != nil {
+			return nil, fmt.Errorf("Unmarshal: %w", err)
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// choose returns min(k, n) distinct integers in [0, n), chosen uniformly at
+// random, in ascending order. This is Floyd's algorithm, so it's cheap even when
+// n is huge.
+func choose(rnd *rand.Rand, n, k int) []int {
+	if k >= n {
+		out := make([]int, n)
+		for i := range out {
+			out[i] = i
+		}
+		return out
+	}
+
+	seen := make(map[int]bool, k)
+	out := make([]int, 0, k)
+	for j := n - k; j < n; j++ {
+		t := rnd.Intn(j + 1)
+		if seen[t] {
+			t = j
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+
+	slices.Sort(out)
+	return out
+}
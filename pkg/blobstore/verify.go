@@ -0,0 +1,92 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/adammck/blobby/pkg/faultinject"
+	"github.com/adammck/blobby/pkg/sstable"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrVerifyFailed matches any VerifyFailed error, via errors.Is.
+var ErrVerifyFailed = &VerifyFailed{}
+
+// VerifyFailed is returned by Flush when the sstable which it uploaded doesn't
+// match what it was given: either the number of records in it isn't the number
+// which were sent (less any duplicates which were dropped), or the blob read
+// back from the blobstore has a different checksum than the one written. The
+// sstable is left orphaned, and should not be inserted into the metadata.
+type VerifyFailed struct {
+	Key string
+
+	// What didn't match: "count" or "checksum".
+	What string
+
+	Want int64
+	Got  int64
+}
+
+func (e *VerifyFailed) Error() string {
+	return fmt.Sprintf("verify %s: %s mismatch: want %d, got %d", e.Key, e.What, e.Want, e.Got)
+}
+
+func (e *VerifyFailed) Is(err error) bool {
+	_, ok := err.(*VerifyFailed)
+	return ok
+}
+
+// checksum returns the CRC-32C of everything read from r.
+func checksum(r io.Reader) (uint32, error) {
+	h := crc32.New(castagnoli)
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
+
+// verify checks that the given sstable, which was just uploaded, contains the
+// given number of records, and reads it back to check that its checksum matches
+// the meta. Since the footer is covered by the checksum, it's known to contain
+// the same count. The blob is read straight from S3, bypassing the blob cache,
+// so this costs a full download.
+func (bs *Blobstore) verify(ctx context.Context, m *sstable.Meta, count int) error {
+	key := m.Filename()
+	ProgressFrom(ctx).Phase(PhaseVerify)
+
+	if m.Count != count {
+		return &VerifyFailed{Key: key, What: "count", Want: int64(count), Got: int64(m.Count)}
+	}
+
+	s3c, err := bs.getS3(ctx)
+	if err != nil {
+		return fmt.Errorf("getS3: %w", err)
+	}
+
+	body, err := getObject(ctx, s3c, bs.bucketFor(m), key, "")
+	if err != nil {
+		return err
+	}
+
+	checked, err := bs.faults.CheckReader(ctx, faultinject.BlobstoreGet, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	defer checked.Close()
+
+	sum, err := checksum(checked)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", key, err)
+	}
+	if sum != m.Checksum {
+		return &VerifyFailed{Key: key, What: "checksum", Want: int64(m.Checksum), Got: int64(sum)}
+	}
+
+	return nil
+}
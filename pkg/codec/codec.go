@@ -0,0 +1,154 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec transforms values on their way into and out of the archive, e.g. to
+// compress or encrypt them. The ID is stored alongside each record, so must be
+// unique and must never change once data has been written with it.
+type Codec interface {
+	ID() string
+	Encode(value []byte) ([]byte, error)
+	Decode(value []byte) ([]byte, error)
+}
+
+type UnknownCodec struct {
+	ID string
+}
+
+func (e *UnknownCodec) Error() string {
+	return fmt.Sprintf("unknown codec: %s", e.ID)
+}
+
+func (e *UnknownCodec) Is(err error) bool {
+	_, ok := err.(*UnknownCodec)
+	return ok
+}
+
+// Registry maps codec IDs to codecs, so records can be decoded with the codec
+// which they were encoded with. The zero value contains only the builtins.
+type Registry struct {
+	codecs map[string]Codec
+}
+
+// Register adds the given codec to the registry, replacing any existing codec
+// with the same ID.
+func (r *Registry) Register(c Codec) {
+	if r.codecs == nil {
+		r.codecs = map[string]Codec{}
+	}
+	r.codecs[c.ID()] = c
+}
+
+// Lookup returns the codec with the given ID. Records with no codec ID were
+// written before codecs existed, so the empty ID is the identity codec.
+func (r *Registry) Lookup(id string) (Codec, error) {
+	if c, ok := r.codecs[id]; ok {
+		return c, nil
+	}
+
+	switch id {
+	case "", Identity.ID():
+		return Identity, nil
+	case Gzip.ID():
+		return Gzip, nil
+	case Zstd.ID():
+		return Zstd, nil
+	}
+
+	return nil, &UnknownCodec{ID: id}
+}
+
+// Decode decodes the given value with the codec with the given ID.
+func (r *Registry) Decode(id string, value []byte) ([]byte, error) {
+	c, err := r.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Decode(value)
+}
+
+var (
+	Identity Codec = identity{}
+	Gzip     Codec = gzipCodec{}
+	Zstd     Codec = &zstdCodec{}
+)
+
+type identity struct{}
+
+func (identity) ID() string                          { return "identity" }
+func (identity) Encode(value []byte) ([]byte, error) { return value, nil }
+func (identity) Decode(value []byte) ([]byte, error) { return value, nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() string {
+	return "gzip"
+}
+
+func (gzipCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(value []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// zstdCodec lazily creates a single encoder and decoder, which are safe for
+// concurrent use via EncodeAll and DecodeAll.
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (z *zstdCodec) init() error {
+	z.once.Do(func() {
+		z.enc, z.err = zstd.NewWriter(nil)
+		if z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCodec) ID() string {
+	return "zstd"
+}
+
+func (z *zstdCodec) Encode(value []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(value, nil), nil
+}
+
+func (z *zstdCodec) Decode(value []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(value, nil)
+}
@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rot13 struct{}
+
+func (rot13) ID() string { return "rot13" }
+func (rot13) Encode(v []byte) ([]byte, error) {
+	return bytes.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return 'a' + (r-'a'+13)%26
+		}
+		return r
+	}, v), nil
+}
+func (c rot13) Decode(v []byte) ([]byte, error) { return c.Encode(v) }
+
+func TestRoundTrip(t *testing.T) {
+	v := bytes.Repeat([]byte("hello, world. "), 100)
+
+	for _, c := range []Codec{Identity, Gzip, Zstd, rot13{}} {
+		t.Run(c.ID(), func(t *testing.T) {
+			enc, err := c.Encode(v)
+			require.NoError(t, err)
+
+			r := &Registry{}
+			r.Register(rot13{})
+			dec, err := r.Decode(c.ID(), enc)
+			require.NoError(t, err)
+			assert.Equal(t, v, dec)
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := &Registry{}
+
+	// records written before codecs existed have no ID.
+	c, err := r.Lookup("")
+	require.NoError(t, err)
+	assert.Equal(t, Identity, c)
+
+	_, err = r.Lookup("rot13")
+	assert.ErrorIs(t, err, &UnknownCodec{})
+}
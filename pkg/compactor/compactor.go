@@ -3,8 +3,10 @@ package compactor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"sort"
 	"time"
 
@@ -16,17 +18,75 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// ClaimTimeout is how long a compaction can hold its inputs before they can be
+// claimed by another. It should be much longer than the slowest compaction.
+const ClaimTimeout = 1 * time.Hour
+
+// DefaultMaxMemory is the MaxMemory of compactions which don't specify one.
+const DefaultMaxMemory = 64 * 1024 * 1024
+
+// minReadBuffer is the smallest chunk in which inputs are read, however many
+// there are.
+const minReadBuffer = 64 * 1024
+
+// Metadata is the part of the metadata store which the compactor uses. It's
+// usually a metadata.Store.
+type Metadata interface {
+	EachMeta(ctx context.Context, opts metadata.ListOptions, fn func(*sstable.Meta) error) error
+	GetNamespaces(ctx context.Context) (metadata.Namespaces, error)
+	IsLive(ctx context.Context, meta *sstable.Meta) (bool, error)
+	InCheckpoint(ctx context.Context, meta *sstable.Meta) (bool, error)
+
+	Claim(ctx context.Context, metas []*sstable.Meta, owner string, now, until time.Time) error
+	Release(ctx context.Context, metas []*sstable.Meta, owner string) error
+
+	PrepareCompaction(ctx context.Context, p *metadata.PendingCompaction) error
+	CommitCompaction(ctx context.Context, p *metadata.PendingCompaction, at time.Time) error
+	AbortCompaction(ctx context.Context, p *metadata.PendingCompaction) error
+	GetPendingCompactions(ctx context.Context, before time.Time) ([]*metadata.PendingCompaction, error)
+
+	GetDeleted(ctx context.Context, before time.Time) ([]*sstable.Meta, error)
+	Purge(ctx context.Context, meta *sstable.Meta) error
+}
+
+var _ Metadata = (*metadata.Store)(nil)
+
 type Compactor struct {
 	bs    *blobstore.Blobstore
-	md    *metadata.Store
+	md    Metadata
 	clock clockwork.Clock
+
+	// identifies the claims made by this compactor. see metadata.Claim.
+	owner string
+
+	// called when claims are made or given up, if set.
+	onLease LeaseFunc
+}
+
+// LeaseFunc is called when a compactor claims the inputs of a compaction (held
+// is true), and again when it gives them up, either because the compaction
+// failed and they were released, or because it succeeded and they're no longer
+// live (held is false).
+type LeaseFunc func(inputs []*sstable.Meta, owner string, held bool)
+
+// SetLeaseFunc sets the func called when this compactor claims or gives up the
+// inputs of a compaction. It must be called before any compactions are run.
+func (c *Compactor) SetLeaseFunc(fn LeaseFunc) {
+	c.onLease = fn
 }
 
-func New(bs *blobstore.Blobstore, md *metadata.Store, clock clockwork.Clock) *Compactor {
+func (c *Compactor) lease(inputs []*sstable.Meta, held bool) {
+	if c.onLease != nil {
+		c.onLease(inputs, c.owner, held)
+	}
+}
+
+func New(bs *blobstore.Blobstore, md Metadata, clock clockwork.Clock) *Compactor {
 	return &Compactor{
 		bs:    bs,
 		md:    md,
 		clock: clock,
+		owner: fmt.Sprintf("compactor-%016x", rand.Uint64()),
 	}
 }
 
@@ -54,6 +114,21 @@ const (
 	LargestFirst
 )
 
+func (o CompactionOrder) String() string {
+	switch o {
+	case OldestFirst:
+		return "oldest-first"
+	case NewestFirst:
+		return "newest-first"
+	case SmallestFirst:
+		return "smallest-first"
+	case LargestFirst:
+		return "largest-first"
+	default:
+		return fmt.Sprintf("CompactionOrder(%d)", int(o))
+	}
+}
+
 type CompactionOptions struct {
 	// Order specifies the order in which files should be considered for
 	// compaction. The default is OldestFirst.
@@ -87,6 +162,32 @@ type CompactionOptions struct {
 	// once. This is mostly to avoid shuffling too much metadata around.
 	MaxFiles int
 
+	// MaxMemory is roughly the most memory, in bytes, which a compaction will
+	// use to buffer its inputs. It's divided evenly between them. Inputs are
+	// merged as a stream and the output is written to disk, so this doesn't
+	// limit how large either can be. The default is DefaultMaxMemory.
+	MaxMemory int
+
+	// Verify re-reads the inputs and output of each compaction after the output
+	// is written, and checks that it contains exactly the versions which should
+	// have survived, before the inputs are removed from the live set. This
+	// roughly doubles the cost of compaction, so is meant for staging or
+	// after changes to the compactor, not for routine use in production. If
+	// the output is wrong, the compaction fails with a VerifyFailed error, and
+	// nothing is changed.
+	Verify bool
+
+	// Progress, if set, is called with the progress of each compaction as it
+	// runs. See blobstore.ProgressFunc.
+	Progress blobstore.ProgressFunc
+
+	// MaxDuration, if set, bounds how long Run spends compacting. Compactions
+	// which finished before it was exceeded are kept, but no more are started
+	// after, and one which is still merging is abandoned with ErrTimedOut,
+	// since its inputs can only be replaced all at once. One which is already
+	// committing is allowed to finish.
+	MaxDuration time.Duration
+
 	// only compact a subset of the keyspace?
 	//MinKey string
 	//MaxKey string
@@ -96,138 +197,518 @@ type CompactionStats struct {
 	Inputs  []*sstable.Meta
 	Outputs []*sstable.Meta
 
+	// The number of records which weren't copied to the outputs, because they
+	// were expired by the retention config of their namespace.
+	Dropped int
+
+	// Why the inputs were chosen. See Compaction.Reason.
+	Reason string
+
+	// When the compaction started and finished, including claiming the inputs
+	// and committing the outputs.
+	Started  time.Time
+	Finished time.Time
+
+	// TimedOut is true if the compaction was abandoned because it exceeded
+	// CompactionOptions.MaxDuration. Error is ErrTimedOut.
+	TimedOut bool
+
 	// Contains an error if the comnpaction failed.
 	Error error
 }
 
-func (c *Compactor) Run(ctx context.Context, opts CompactionOptions) ([]*CompactionStats, error) {
+// ErrTimedOut is the Error of a compaction which exceeded MaxDuration. Nothing
+// was changed, so it can be retried with a longer (or no) MaxDuration.
+var ErrTimedOut = errors.New("compaction exceeded MaxDuration")
 
-	// grab *all* metadata for now, and do the selection in-process.
-	// TODO: push down as much as we can to the mongo query.
-	metas, err := c.md.GetAllMetas(ctx)
+func (c *Compactor) Run(ctx context.Context, opts CompactionOptions) ([]*CompactionStats, error) {
+	// get the list of blobs eligibile for compactions right now.
+	compactions, err := c.plan(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("get metas: %w", err)
+		return nil, fmt.Errorf("plan: %w", err)
 	}
 
-	// get the list of blobs eligibile for compactions right now.
-	compactions := c.GetCompactions(metas, opts)
+	var deadline time.Time
+	if opts.MaxDuration > 0 {
+		deadline = c.clock.Now().Add(opts.MaxDuration)
+	}
 
 	stats := []*CompactionStats{}
 	for _, cc := range compactions {
+		if !deadline.IsZero() && !c.clock.Now().Before(deadline) {
+			break
+		}
+
+		cc.Deadline = deadline
+		start := c.clock.Now()
 		s := c.Compact(ctx, cc)
+		s.Reason = cc.Reason
+		s.Started = start
+		s.Finished = c.clock.Now()
 		stats = append(stats, s)
 	}
 
 	return stats, nil
 }
 
-func (c *Compactor) Compact(ctx context.Context, cc *Compaction) *CompactionStats {
-	stats := &CompactionStats{
+// Compact merges the inputs of the given compaction into a new sstable, and
+// replaces them with it in the live set. The inputs are claimed first, so if
+// another compaction (in any process) is already working on any of them, this
+// fails with metadata.ErrClaimed without changing anything.
+func (c *Compactor) Compact(ctx context.Context, cc *Compaction) (stats *CompactionStats) {
+	stats = &CompactionStats{
 		Inputs: cc.Inputs,
 	}
 
-	readers := make([]*sstable.Reader, len(cc.Inputs))
-	for i, m := range cc.Inputs {
-		r, err := c.bs.Get(ctx, m.Filename())
+	if cc.Progress != nil {
+		total := 0
+		for _, m := range cc.Inputs {
+			total += m.Count
+		}
+		ctx = blobstore.WithProgress(ctx, c.clock, total, cc.Progress)
+	}
+
+	now := c.clock.Now()
+	err := c.md.Claim(ctx, cc.Inputs, c.owner, now, now.Add(ClaimTimeout))
+	if err != nil {
+		stats.Error = fmt.Errorf("metadata.Claim: %w", err)
+		return stats
+	}
+
+	c.lease(cc.Inputs, true)
+	defer c.lease(cc.Inputs, false)
+
+	// on success, the inputs are no longer live, so there's nothing to release.
+	// on failure, let someone else try. if this fails, the claims will expire.
+	defer func() {
+		if stats.Error != nil {
+			c.md.Release(context.WithoutCancel(ctx), cc.Inputs, c.owner)
+		}
+	}()
+
+	// the merge is abandoned at the deadline, but the commit isn't, since
+	// it's quick, and the work is already done by then.
+	wctx := ctx
+	if !cc.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		t := c.clock.AfterFunc(cc.Deadline.Sub(c.clock.Now()), cancel)
+		defer t.Stop()
+	}
+
+	// failed returns the stats of a compaction which failed with the given
+	// error while merging, which might be because the deadline passed.
+	failed := func(err error) *CompactionStats {
+		s := &CompactionStats{Inputs: cc.Inputs, Error: err}
+		if wctx.Err() != nil && ctx.Err() == nil {
+			s.TimedOut = true
+			s.Error = fmt.Errorf("%w: %w", ErrTimedOut, err)
+		}
+		return s
+	}
+
+	readers := make([]*sstable.Reader, 0, len(cc.Inputs))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	maxMem := cc.MaxMemory
+	if maxMem <= 0 {
+		maxMem = DefaultMaxMemory
+	}
+	bufSize := max(maxMem/max(len(cc.Inputs), 1), minReadBuffer)
+
+	for _, m := range newestFirst(cc.Inputs) {
+		r, err := c.bs.OpenSSTableBuffered(wctx, m, bufSize)
 		if err != nil {
-			stats.Error = fmt.Errorf("getSST(%s): %w", m.Filename(), err)
+			stats = failed(fmt.Errorf("OpenSSTable(%s): %w", m.Filename(), err))
 			return stats
 		}
-		readers[i] = r
+		readers = append(readers, r)
 	}
 
-	// TODO: do filtering here, to expire data by timestamp and version count
+	ns, err := c.md.GetNamespaces(ctx)
+	if err != nil {
+		stats.Error = fmt.Errorf("metadata.GetNamespaces: %w", err)
+		return stats
+	}
 
-	// TODO: also do partitioning here, so large files can be split by key.
+	// TODO: do partitioning here, so large files can be split by key.
 
+	// the merge is streamed straight to disk, so only one record per input
+	// (plus the versions of the current key) is in memory at once.
 	ch := make(chan *types.Record)
-	g, ctx2 := errgroup.WithContext(ctx)
+	g, ctx2 := errgroup.WithContext(wctx)
+
+	// records are expired as of the start of the merge, so that verify can
+	// expire the same ones.
+	expireAt := c.clock.Now()
 
 	g.Go(func() error {
 		defer close(ch)
 
-		mr, err := sstable.NewMergeReader(readers)
-		if err != nil {
-			return fmt.Errorf("NewMergeReader: %w", err)
-		}
-
-		for {
-			rec, err := mr.Next()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return fmt.Errorf("NewMergeReader: %w", err)
+		dropped, err := merge(readers, ns, expireAt, func(rec *types.Record) error {
+			select {
+			case ch <- rec:
+				return nil
+			case <-ctx2.Done():
+				return ctx2.Err()
 			}
-			ch <- rec
-		}
-
-		return nil
+		})
+		stats.Dropped = dropped
+		return err
 	})
 
 	var meta *sstable.Meta
 
 	g.Go(func() error {
 		var err error
-		_, _, meta, err = c.bs.Flush(ctx2, ch)
+		_, _, meta, err = c.bs.FlushSorted(ctx2, ch)
 		if err != nil {
-			return fmt.Errorf("blobstore.Flush: %w", err)
+			return fmt.Errorf("blobstore.FlushSorted: %w", err)
 		}
 		return nil
 	})
 
-	err := g.Wait()
+	err = g.Wait()
 	if err != nil {
-		return &CompactionStats{
-			Error: fmt.Errorf("g.Wait: %w", err),
+		stats = failed(fmt.Errorf("g.Wait: %w", err))
+		return stats
+	}
+
+	if cc.Verify {
+		err = c.verify(wctx, cc.Inputs, meta, ns, expireAt, bufSize)
+		if err != nil {
+			stats = failed(fmt.Errorf("verify: %w", err))
+			return stats
 		}
 	}
 
+	setLineage(meta, cc.Inputs)
 	stats.Outputs = []*sstable.Meta{meta}
 
-	// TODO: Do the inserts and deletes transactionally!
+	// record the compaction before committing it, so if we crash part-way
+	// through, Recover can finish (or undo) it. the commit swaps the inputs for
+	// the outputs in the live set atomically. the input blobs are left alone
+	// until they're purged, so readers which already resolved them can still
+	// fetch them.
+	p := &metadata.PendingCompaction{
+		Owner:   c.owner,
+		Created: c.clock.Now(),
+		Inputs:  cc.Inputs,
+		Outputs: stats.Outputs,
+	}
+
+	blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseCommit)
 
-	err = c.md.Insert(ctx, meta)
+	err = c.md.PrepareCompaction(ctx, p)
 	if err != nil {
 		return &CompactionStats{
-			Error: fmt.Errorf("metadata.Insert: %w", err),
+			Inputs: cc.Inputs,
+			Error:  fmt.Errorf("metadata.PrepareCompaction: %w", err),
+		}
+	}
+
+	err = c.md.CommitCompaction(ctx, p, c.clock.Now())
+	if err != nil {
+
+		// the inputs changed under us, so the outputs are no good. anything
+		// else might be transient, so leave it for Recover.
+		if errors.Is(err, metadata.ErrInputNotLive) {
+			err = errors.Join(err, c.rollBack(ctx, p))
+		}
+
+		return &CompactionStats{
+			Inputs: cc.Inputs,
+			Error:  fmt.Errorf("metadata.CommitCompaction: %w", err),
+		}
+	}
+
+	blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseDone)
+	return stats
+}
+
+type RecoverStats struct {
+	// Compactions which were committed.
+	RolledForward []*metadata.PendingCompaction
+
+	// Compactions which were aborted, because some of their inputs were no
+	// longer live. Their outputs were deleted.
+	RolledBack []*metadata.PendingCompaction
+}
+
+// Recover finishes compactions which were prepared more than grace ago, but
+// never committed, because the compactor crashed or the commit failed. If every
+// input is still live, the compaction is committed, as if it had succeeded.
+// Otherwise it's aborted, and the blobs of its outputs are deleted. The grace
+// should be longer than the slowest commit, so running compactions aren't
+// interfered with; ClaimTimeout is plenty.
+func (c *Compactor) Recover(ctx context.Context, grace time.Duration) (*RecoverStats, error) {
+	stats := &RecoverStats{}
+
+	ps, err := c.md.GetPendingCompactions(ctx, c.clock.Now().Add(-grace))
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetPendingCompactions: %w", err)
+	}
+
+	for _, p := range ps {
+		err = c.md.CommitCompaction(ctx, p, c.clock.Now())
+		if err == nil {
+			stats.RolledForward = append(stats.RolledForward, p)
+			continue
+		}
+
+		// someone else got there first.
+		if errors.Is(err, metadata.ErrNotPending) {
+			continue
+		}
+
+		if !errors.Is(err, metadata.ErrInputNotLive) {
+			return stats, fmt.Errorf("metadata.CommitCompaction(%s): %w", p.ID, err)
 		}
+
+		err = c.rollBack(ctx, p)
+		if err != nil {
+			return stats, err
+		}
+		stats.RolledBack = append(stats.RolledBack, p)
 	}
 
-	// delete the input files from the metadata store, so they're no longer
-	// returned for queries, before removing the actual files.
+	return stats, nil
+}
 
-	for i, m := range cc.Inputs {
-		err = c.md.Delete(ctx, m)
+// rollBack aborts the given pending compaction, and deletes its outputs. The
+// record is removed first, so the outputs can never be committed after they're
+// deleted.
+func (c *Compactor) rollBack(ctx context.Context, p *metadata.PendingCompaction) error {
+	err := c.md.AbortCompaction(ctx, p)
+	if err != nil {
+		return fmt.Errorf("metadata.AbortCompaction(%s): %w", p.ID, err)
+	}
+
+	for _, m := range p.Outputs {
+		err = c.bs.DeleteSSTable(ctx, m)
 		if err != nil {
-			return &CompactionStats{
-				// TODO: include the metadata ID in this error.
-				Error: fmt.Errorf("metadata.Delete(%d): %w", i, err),
+			return fmt.Errorf("blobstore.DeleteSSTable(%s): %w", m.Filename(), err)
+		}
+	}
+
+	return nil
+}
+
+// merge reads the records from the given readers in order, and calls fn with
+// each one which isn't expired by the namespace config at the given time. It
+// returns the number which were.
+func merge(readers []*sstable.Reader, ns metadata.Namespaces, now time.Time, fn func(*types.Record) error) (int, error) {
+	mr, err := sstable.NewMergeReader(readers)
+	if err != nil {
+		return 0, fmt.Errorf("NewMergeReader: %w", err)
+	}
+
+	// the merge returns the versions of each key newest first, so n is the
+	// number of newer versions of the current key which were already seen.
+	var key string
+	n := 0
+	dropped := 0
+
+	for {
+		rec, err := mr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
+			return dropped, fmt.Errorf("NewMergeReader: %w", err)
+		}
+
+		if n == 0 || rec.Key != key {
+			key = rec.Key
+			n = 0
+		}
+
+		expired := ns.Expired(rec.Key, rec.Timestamp, n, now)
+		n++
+		if expired {
+			dropped++
+			continue
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return dropped, err
+		}
+	}
+
+	return dropped, nil
+}
+
+// newestFirst returns a copy of the given sstables, ordered by their sequence
+// numbers, newest first, so that when several contain versions of a key with the
+// same timestamp, the merge puts the newest write first, and that's the one which
+// the writer keeps. Sstables without sequence numbers come last.
+func newestFirst(metas []*sstable.Meta) []*sstable.Meta {
+	out := append([]*sstable.Meta(nil), metas...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].LargestSeq > out[j].LargestSeq
+	})
+
+	return out
+}
+
+// setLineage sets the level, generation, and sequence range of the output of a
+// compaction, from its inputs.
+func setLineage(out *sstable.Meta, inputs []*sstable.Meta) {
+	shallowest, deepest := -1, 0
+	for _, m := range inputs {
+		if shallowest == -1 || m.Level < shallowest {
+			shallowest = m.Level
+		}
+		deepest = max(deepest, m.Level)
+
+		out.Generation = max(out.Generation, m.Generation+1)
+
+		// inputs written before sequence numbers existed have none.
+		if m.SmallestSeq != 0 && (out.SmallestSeq == 0 || m.SmallestSeq < out.SmallestSeq) {
+			out.SmallestSeq = m.SmallestSeq
 		}
+		out.LargestSeq = max(out.LargestSeq, m.LargestSeq)
 	}
 
-	// delete the blobs.
+	out.Level = max(shallowest+1, deepest)
+}
 
-	for _, m := range cc.Inputs {
-		c.bs.Delete(ctx, m.Filename())
+type PurgeStats struct {
+	// The sstables whose metadata was purged.
+	Purged []*sstable.Meta
+
+	// The number of blobs which were deleted. This can be fewer than the number
+	// of sstables purged, since some are retained for checkpoints.
+	BlobsDeleted int
+}
+
+// Purge permanently removes sstables which were removed from the live set (by
+// compaction or restore) more than grace ago. Their blobs are deleted, unless
+// they're still referenced by a checkpoint or the live set.
+func (c *Compactor) Purge(ctx context.Context, grace time.Duration) (*PurgeStats, error) {
+	stats := &PurgeStats{}
+
+	metas, err := c.md.GetDeleted(ctx, c.clock.Now().Add(-grace))
+	if err != nil {
+		return stats, fmt.Errorf("metadata.GetDeleted: %w", err)
+	}
+
+	for _, m := range metas {
+		keep, err := c.isReferenced(ctx, m)
 		if err != nil {
-			return &CompactionStats{
-				Error: fmt.Errorf("blobstore.Delete(%s): %w", m.Filename(), err),
+			return stats, err
+		}
+
+		// delete the blob first, so we can try again if that fails.
+		if !keep {
+			err = c.bs.DeleteSSTable(ctx, m)
+			if err != nil {
+				return stats, fmt.Errorf("blobstore.Delete(%s): %w", m.Filename(), err)
 			}
+			stats.BlobsDeleted++
+		}
+
+		err = c.md.Purge(ctx, m)
+		if err != nil {
+			return stats, fmt.Errorf("metadata.Purge(%s): %w", m.Filename(), err)
 		}
+
+		stats.Purged = append(stats.Purged, m)
 	}
 
-	return stats
+	return stats, nil
+}
+
+// isReferenced returns true if the blob of the given sstable must be retained,
+// because it's still in the live set (after a restore) or in a checkpoint.
+func (c *Compactor) isReferenced(ctx context.Context, m *sstable.Meta) (bool, error) {
+	ok, err := c.md.IsLive(ctx, m)
+	if err != nil {
+		return false, fmt.Errorf("metadata.IsLive(%s): %w", m.Filename(), err)
+	}
+	if ok {
+		return true, nil
+	}
+
+	ok, err = c.md.InCheckpoint(ctx, m)
+	if err != nil {
+		return false, fmt.Errorf("metadata.InCheckpoint(%s): %w", m.Filename(), err)
+	}
+
+	return ok, nil
 }
 
 type Compaction struct {
 	Inputs []*sstable.Meta
+
+	// Reason describes why the inputs were chosen, for the compaction history.
+	Reason string
+
+	// MaxMemory, Verify, and Progress are copied from CompactionOptions.
+	MaxMemory int
+	Verify    bool
+	Progress  blobstore.ProgressFunc
+
+	// Deadline, if set, is when the compaction is abandoned if it's still
+	// merging. See CompactionOptions.MaxDuration.
+	Deadline time.Time
+}
+
+// Estimate returns the S3 requests which the compaction is expected to make,
+// and the bytes they'll transfer, including the requests to purge its inputs
+// afterwards. The output is assumed to be as large as the inputs, which it is
+// unless many records are superseded or expired, so it's an upper bound. The
+// requests are named like those counted by blobstore.RequestStats, so can be
+// priced the same way.
+func (cc *Compaction) Estimate() blobstore.RequestStats {
+	var size int64
+	gets := len(cc.Inputs)
+	deletes := 0
+
+	for _, m := range cc.Inputs {
+		size += int64(m.Size)
+		deletes++
+		if m.Index != "" {
+			deletes++
+		}
+	}
+
+	// each input is read once, in a single request, and the output and its
+	// index are uploaded.
+	read := size
+	if cc.Verify {
+		gets += len(cc.Inputs) + 1
+		read += size * 2
+	}
+
+	return blobstore.RequestStats{
+		Requests: map[string]int64{
+			"GetObject":    int64(gets),
+			"PutObject":    2,
+			"DeleteObject": int64(deletes),
+		},
+		BytesSent:     size,
+		BytesReceived: read,
+	}
+}
+
+// Plan returns the compactions which Run would run with the given options right
+// now, without running them, so their cost can be estimated (see Estimate).
+func (c *Compactor) Plan(ctx context.Context, opts CompactionOptions) ([]*Compaction, error) {
+	return c.plan(ctx, opts)
 }
 
+// GetCompactions returns the compactions which should be run on the given
+// sstables, which needn't be in any particular order. Run streams the sstables
+// from the metadata store instead, so prefer that for large archives.
 func (c *Compactor) GetCompactions(metas []*sstable.Meta, opts CompactionOptions) []*Compaction {
-	r := &Compaction{}
-	var tot int
 
 	// return early if there aren't enough files to possibly qualify.
 	if len(metas) < opts.MinFiles {
@@ -256,48 +737,140 @@ func (c *Compactor) GetCompactions(metas []*sstable.Meta, opts CompactionOptions
 		}
 	})
 
+	p := &planner{opts: opts}
 	for _, m := range smetas {
-		// skip if all records are before MinTime.
-		if !opts.MinTime.IsZero() {
-			if m.MaxTime.Before(opts.MinTime) {
-				continue
-			}
+		if !p.add(m) {
+			break
 		}
+	}
 
-		// skip if all records are after MaxTime.
-		if !opts.MaxTime.IsZero() {
-			if m.MinTime.After(opts.MaxTime) {
-				continue
-			}
+	return p.compactions()
+}
+
+// planner chooses the inputs of a compaction from a stream of sstables, which
+// must already be in opts.Order, so that the whole live set needn't be held in
+// memory at once.
+type planner struct {
+	opts   CompactionOptions
+	inputs []*sstable.Meta
+	tot    int
+}
+
+// add considers the given sstable, and returns false once no more can be added,
+// so the caller can stop early.
+func (p *planner) add(m *sstable.Meta) bool {
+	opts := p.opts
+
+	// skip if all records are before MinTime.
+	if !opts.MinTime.IsZero() {
+		if m.MaxTime.Before(opts.MinTime) {
+			return true
 		}
+	}
 
-		// skip if adding this file would exceed the total cumulative input size
-		// limit. (we don't know what the output file size would be, but it'll
-		// be pretty similar because we're not expiring anything yet.)
-		if opts.MaxInputSize != 0 {
-			if tot+m.Size > opts.MaxInputSize {
-				continue
-			}
+	// skip if all records are after MaxTime.
+	if !opts.MaxTime.IsZero() {
+		if m.MinTime.After(opts.MaxTime) {
+			return true
 		}
+	}
 
-		// skip if adding this file would add the input count limit.
-		if opts.MaxFiles > 0 && len(r.Inputs) >= opts.MaxFiles {
-			break
+	// skip if adding this file would exceed the total cumulative input size
+	// limit. (we don't know what the output file size would be, but it'll
+	// be pretty similar because we're not expiring anything yet.)
+	if opts.MaxInputSize != 0 {
+		if p.tot+m.Size > opts.MaxInputSize {
+			return true
 		}
+	}
 
-		r.Inputs = append(r.Inputs, m)
-		tot += m.Size
+	// stop if adding this file would exceed the input count limit.
+	if opts.MaxFiles > 0 && len(p.inputs) >= opts.MaxFiles {
+		return false
 	}
 
+	p.inputs = append(p.inputs, m)
+	p.tot += m.Size
+
+	return opts.MaxFiles <= 0 || len(p.inputs) < opts.MaxFiles
+}
+
+// compactions returns the compaction planned from the sstables added so far, if
+// it qualifies.
+func (p *planner) compactions() []*Compaction {
+
 	// abort if we don't have enough files left.
-	if len(r.Inputs) < opts.MinFiles {
+	if len(p.inputs) < p.opts.MinFiles {
 		return nil
 	}
 
 	// abort if the total input size is too small.
-	if tot < opts.MinInputSize {
+	if p.tot < p.opts.MinInputSize {
 		return nil
 	}
 
+	r := &Compaction{
+		Inputs:    p.inputs,
+		MaxMemory: p.opts.MaxMemory,
+		Verify:    p.opts.Verify,
+		Progress:  p.opts.Progress,
+	}
+	r.Reason = fmt.Sprintf("%s: %d files, %d bytes", p.opts.Order, len(r.Inputs), p.tot)
+
 	return []*Compaction{r}
 }
+
+// listOptions returns the options to stream the live set from the metadata
+// store in the given order, with as much of the selection as possible done by
+// the query.
+func listOptions(opts CompactionOptions) (metadata.ListOptions, error) {
+	lo := metadata.ListOptions{
+		MinTime: opts.MinTime,
+		MaxTime: opts.MaxTime,
+
+		// compactions read whole sstables, so never need the filters.
+		SkipFilters: true,
+	}
+
+	switch opts.Order {
+	case OldestFirst:
+		lo.Order = metadata.ByCreated
+	case NewestFirst:
+		lo.Order = metadata.ByCreated
+		lo.Desc = true
+	case SmallestFirst:
+		lo.Order = metadata.BySize
+	case LargestFirst:
+		lo.Order = metadata.BySize
+		lo.Desc = true
+	default:
+		return lo, fmt.Errorf("invalid sort order: %v", opts.Order)
+	}
+
+	return lo, nil
+}
+
+// errPlanned stops the stream of sstables once the planner is full.
+var errPlanned = errors.New("planned")
+
+// plan streams the live set from the metadata store into a planner, stopping
+// as soon as it's full, so at most the inputs are held in memory.
+func (c *Compactor) plan(ctx context.Context, opts CompactionOptions) ([]*Compaction, error) {
+	lo, err := listOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &planner{opts: opts}
+	err = c.md.EachMeta(ctx, lo, func(m *sstable.Meta) error {
+		if !p.add(m) {
+			return errPlanned
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPlanned) {
+		return nil, fmt.Errorf("metadata.EachMeta: %w", err)
+	}
+
+	return p.compactions(), nil
+}
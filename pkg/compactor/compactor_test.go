@@ -4,6 +4,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/metadata"
 	"github.com/adammck/blobby/pkg/sstable"
 	"github.com/stretchr/testify/require"
 )
@@ -227,3 +229,133 @@ func TestGetCompactionsTimeFilter(t *testing.T) {
 	require.Equal(t, now.Add(-2*time.Hour), compactions[0].Inputs[0].Created)
 	require.Equal(t, now.Add(-1*time.Hour), compactions[0].Inputs[1].Created)
 }
+
+func TestPlannerStopsWhenFull(t *testing.T) {
+	now := time.Now()
+	p := &planner{opts: CompactionOptions{MinFiles: 2, MaxFiles: 2}}
+
+	require.True(t, p.add(&sstable.Meta{Created: now, Size: 100}))
+	require.False(t, p.add(&sstable.Meta{Created: now, Size: 100}))
+
+	compactions := p.compactions()
+	require.Len(t, compactions, 1)
+	require.Len(t, compactions[0].Inputs, 2)
+}
+
+func TestEstimate(t *testing.T) {
+	now := time.Now()
+	c := &Compactor{}
+	metas := []*sstable.Meta{
+		{Created: now, Size: 100, Index: "a.idx"},
+		{Created: now.Add(time.Second), Size: 300},
+	}
+
+	ccs := c.GetCompactions(metas, CompactionOptions{MinFiles: 2})
+	require.Len(t, ccs, 1)
+	require.Equal(t, blobstore.RequestStats{
+		Requests:      map[string]int64{"GetObject": 2, "PutObject": 2, "DeleteObject": 3},
+		BytesSent:     400,
+		BytesReceived: 400,
+	}, ccs[0].Estimate())
+
+	// verifying reads the inputs again, and the output.
+	ccs = c.GetCompactions(metas, CompactionOptions{MinFiles: 2, Verify: true})
+	require.Len(t, ccs, 1)
+	e := ccs[0].Estimate()
+	require.Equal(t, int64(5), e.Requests["GetObject"])
+	require.Equal(t, int64(1200), e.BytesReceived)
+}
+
+func TestListOptions(t *testing.T) {
+	now := time.Now()
+	lo, err := listOptions(CompactionOptions{Order: LargestFirst, MinTime: now})
+	require.NoError(t, err)
+	require.Equal(t, metadata.BySize, lo.Order)
+	require.True(t, lo.Desc)
+	require.True(t, lo.SkipFilters)
+	require.Equal(t, now, lo.MinTime)
+
+	_, err = listOptions(CompactionOptions{Order: CompactionOrder(99)})
+	require.Error(t, err)
+}
+
+// benchMetas returns a million sstables, which is roughly the most that an
+// archive is expected to have.
+func benchMetas() []*sstable.Meta {
+	now := time.Now()
+	metas := make([]*sstable.Meta, 1_000_000)
+	for i := range metas {
+		metas[i] = &sstable.Meta{Created: now.Add(time.Duration(i) * time.Second), Size: 1000 + i%1000}
+	}
+	return metas
+}
+
+// BenchmarkGetCompactions plans a compaction by sorting the whole live set in
+// memory, as GetCompactions does.
+func BenchmarkGetCompactions(b *testing.B) {
+	c := &Compactor{}
+	metas := benchMetas()
+	opts := CompactionOptions{Order: SmallestFirst, MinFiles: 2, MaxFiles: 100}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		require.Len(b, c.GetCompactions(metas, opts), 1)
+	}
+}
+
+// BenchmarkPlanner plans the same compaction as BenchmarkGetCompactions from
+// a stream which is already in order, as Run does, so it stops after MaxFiles.
+func BenchmarkPlanner(b *testing.B) {
+	metas := benchMetas()
+	opts := CompactionOptions{Order: OldestFirst, MinFiles: 2, MaxFiles: 100}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := &planner{opts: opts}
+		for _, m := range metas {
+			if !p.add(m) {
+				break
+			}
+		}
+		require.Len(b, p.compactions(), 1)
+	}
+}
+
+func TestSetLineage(t *testing.T) {
+	// two flushes compact into level one.
+	out := &sstable.Meta{}
+	setLineage(out, []*sstable.Meta{
+		{SmallestSeq: 11, LargestSeq: 20},
+		{SmallestSeq: 1, LargestSeq: 10},
+	})
+	require.Equal(t, &sstable.Meta{Level: 1, Generation: 1, SmallestSeq: 1, LargestSeq: 20}, out)
+
+	// a flush compacted with level two stays in level two, and legacy inputs
+	// without sequence numbers are ignored.
+	out = &sstable.Meta{}
+	setLineage(out, []*sstable.Meta{
+		{SmallestSeq: 30, LargestSeq: 40},
+		{Level: 2, Generation: 3},
+		{Level: 2, Generation: 1, SmallestSeq: 5, LargestSeq: 9},
+	})
+	require.Equal(t, &sstable.Meta{Level: 2, Generation: 4, SmallestSeq: 5, LargestSeq: 40}, out)
+
+	// a level on its own is pushed down.
+	out = &sstable.Meta{}
+	setLineage(out, []*sstable.Meta{{Level: 1}, {Level: 1}})
+	require.Equal(t, 2, out.Level)
+}
+
+func TestNewestFirst(t *testing.T) {
+	a := &sstable.Meta{SmallestSeq: 1, LargestSeq: 10}
+	b := &sstable.Meta{SmallestSeq: 11, LargestSeq: 20}
+	legacy := &sstable.Meta{}
+
+	in := []*sstable.Meta{a, legacy, b}
+	require.Equal(t, []*sstable.Meta{b, a, legacy}, newestFirst(in))
+
+	// the input isn't reordered.
+	require.Equal(t, []*sstable.Meta{a, legacy, b}, in)
+}
@@ -0,0 +1,145 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrVerifyFailed matches any VerifyFailed error, via errors.Is.
+var ErrVerifyFailed = &VerifyFailed{}
+
+// VerifyFailed is the error of a compaction with Verify set, when its output
+// didn't contain exactly the versions of its inputs which should have survived.
+type VerifyFailed struct {
+	// The filename of the output sstable.
+	Output string
+
+	// The key at which the output first differed from the inputs.
+	Key string
+
+	// What was wrong with it, e.g. a version was missing.
+	Reason string
+}
+
+func (e *VerifyFailed) Error() string {
+	return fmt.Sprintf("compaction output %s wrong at key %q: %s", e.Output, e.Key, e.Reason)
+}
+
+func (e *VerifyFailed) Is(err error) bool {
+	_, ok := err.(*VerifyFailed)
+	return ok
+}
+
+// verify reads the inputs of a compaction again, along with its output, and
+// checks that the output contains every version from the inputs which wasn't
+// expired at the given time (less duplicates, which the writer removes), and
+// nothing else, in the same order.
+func (c *Compactor) verify(ctx context.Context, inputs []*sstable.Meta, out *sstable.Meta, ns metadata.Namespaces, now time.Time, bufSize int) error {
+	blobstore.ProgressFrom(ctx).Phase(blobstore.PhaseVerify)
+
+	readers := make([]*sstable.Reader, 0, len(inputs))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	for _, m := range newestFirst(inputs) {
+		r, err := c.bs.OpenSSTableBuffered(ctx, m, bufSize)
+		if err != nil {
+			return fmt.Errorf("OpenSSTable(%s): %w", m.Filename(), err)
+		}
+		readers = append(readers, r)
+	}
+
+	or, err := c.bs.OpenSSTableBuffered(ctx, out, bufSize)
+	if err != nil {
+		return fmt.Errorf("OpenSSTable(%s): %w", out.Filename(), err)
+	}
+	defer or.Close()
+
+	fail := func(key, reason string, args ...any) error {
+		return &VerifyFailed{Output: out.Filename(), Key: key, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	// the surviving versions of the current key, which are deduped before
+	// they're compared, like the writer does.
+	var group []*types.Record
+
+	check := func() error {
+		for _, want := range sstable.Dedupe(group) {
+			got, err := or.Next()
+			if err != nil {
+				return fmt.Errorf("read output: %w", err)
+			}
+			if got == nil {
+				return fail(want.Key, "missing version %s", want.Timestamp)
+			}
+
+			same, err := sameRecord(want, got)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return fail(want.Key, "want version %s, got %q at %s", want.Timestamp, got.Key, got.Timestamp)
+			}
+		}
+
+		group = group[:0]
+		return nil
+	}
+
+	_, err = merge(readers, ns, now, func(rec *types.Record) error {
+		if len(group) > 0 && group[0].Key != rec.Key {
+			err := check()
+			if err != nil {
+				return err
+			}
+		}
+
+		group = append(group, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = check()
+	if err != nil {
+		return err
+	}
+
+	// anything left over wasn't in the inputs, or should have been expired.
+	extra, err := or.Next()
+	if err != nil {
+		return fmt.Errorf("read output: %w", err)
+	}
+	if extra != nil {
+		return fail(extra.Key, "unexpected version %s", extra.Timestamp)
+	}
+
+	return nil
+}
+
+// sameRecord returns true if the given records are identical.
+func sameRecord(a, b *types.Record) (bool, error) {
+	ab, err := bson.Marshal(a)
+	if err != nil {
+		return false, fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	bb, err := bson.Marshal(b)
+	if err != nil {
+		return false, fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	return bytes.Equal(ab, bb), nil
+}
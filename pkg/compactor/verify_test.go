@@ -0,0 +1,83 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobstore"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithFakeS3())
+	clock := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	bs := blobstore.New(env.S3Bucket, clock)
+	c := New(bs, nil, clock)
+
+	t0 := clock.Now()
+	rec := func(key string, sec int) *types.Record {
+		return &types.Record{Key: key, Timestamp: t0.Add(time.Duration(sec) * time.Second), Document: []byte(key)}
+	}
+
+	write := func(sorted bool, recs ...*types.Record) *sstable.Meta {
+		ch := make(chan *types.Record)
+		go func() {
+			defer close(ch)
+			for _, r := range recs {
+				ch <- r
+			}
+		}()
+
+		var meta *sstable.Meta
+		var err error
+		if sorted {
+			_, _, meta, err = bs.FlushSorted(ctx, ch)
+		} else {
+			_, _, meta, err = bs.Flush(ctx, ch)
+		}
+		require.NoError(t, err)
+		clock.Advance(time.Second)
+		return meta
+	}
+
+	// b@1 is in both inputs, so it's only expected once.
+	inputs := []*sstable.Meta{
+		write(false, rec("a", 1), rec("b", 1), rec("c", 1)),
+		write(false, rec("b", 1), rec("b", 2), rec("d", 2)),
+	}
+
+	// only the newest version of keys starting with "b" survives.
+	ns := metadata.Namespaces{{Prefix: "b", MaxVersions: 1}}
+	now := clock.Now()
+
+	good := write(true, rec("a", 1), rec("b", 2), rec("c", 1), rec("d", 2))
+	require.NoError(t, c.verify(ctx, inputs, good, ns, now, minReadBuffer))
+
+	for name, tc := range map[string]struct {
+		out *sstable.Meta
+		key string
+	}{
+		"missing":   {write(true, rec("a", 1), rec("b", 2), rec("c", 1)), "d"},
+		"unexpired": {write(true, rec("a", 1), rec("b", 2), rec("b", 1), rec("c", 1), rec("d", 2)), "c"},
+		"wrong":     {write(true, rec("a", 1), rec("b", 2), rec("c", 2), rec("d", 2)), "c"},
+		"extra":     {write(true, rec("a", 1), rec("b", 2), rec("c", 1), rec("d", 2), rec("e", 1)), "e"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := c.verify(ctx, inputs, tc.out, ns, now, minReadBuffer)
+			require.ErrorIs(t, err, ErrVerifyFailed)
+
+			var vf *VerifyFailed
+			require.ErrorAs(t, err, &vf)
+			assert.Equal(t, tc.key, vf.Key)
+			assert.Equal(t, tc.out.Filename(), vf.Output)
+		})
+	}
+}
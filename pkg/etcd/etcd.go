@@ -0,0 +1,340 @@
+// Package etcd coordinates the processes sharing an archive via etcd rather than
+// Mongo (see blobby.WithCoordinator), for deployments which already run it. etcd
+// expires leases itself, and its consensus makes failover of the lease holder
+// quicker and more predictable than a Mongo election.
+//
+// It talks to the JSON gateway of the etcd v3 API over plain HTTP, so needs no
+// client library. For TLS, including client certificates, set Client.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/metadata"
+)
+
+// Coordinator implements blobby.Coordinator on etcd. Every key it writes is
+// under Prefix, so several archives can share a cluster.
+type Coordinator struct {
+	// The base URL of an etcd member, e.g. http://localhost:2379.
+	Endpoint string
+
+	// Prefixed to every key, e.g. "/blobby/<archive>/".
+	Prefix string
+
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// New returns a coordinator which keeps its keys under the given prefix in the
+// etcd cluster at endpoint.
+func New(endpoint, prefix string) *Coordinator {
+	return &Coordinator{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Prefix:   prefix,
+	}
+}
+
+func (c *Coordinator) leaseKey(name string) []byte {
+	return []byte(c.Prefix + "leases/" + name)
+}
+
+func (c *Coordinator) manifestKey() []byte {
+	return []byte(c.Prefix + "manifest_version")
+}
+
+// AcquireLease takes the named lease for owner for ttl, or extends it if owner
+// already holds it. The lease is an etcd lease with a key attached, so etcd
+// deletes the key when it expires. When extending, the lease is renewed for
+// the ttl it was first granted with, which is normally the same.
+func (c *Coordinator) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) error {
+	key := c.leaseKey(name)
+
+	kv, err := c.get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if kv != nil {
+		if string(kv.Value) != owner {
+			return fmt.Errorf("%w: %s", metadata.ErrLeaseHeld, name)
+		}
+
+		left, err := c.keepAlive(ctx, kv.Lease)
+		if err != nil {
+			return err
+		}
+		if left > 0 {
+			return nil
+		}
+
+		// it expired since we read it, so the key is gone. take it again.
+	}
+
+	id, err := c.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+
+	ok, err := c.txn(ctx, &txnRequest{
+		Compare: []compare{{Key: key, Target: "CREATE", Result: "EQUAL", CreateRevision: new(num)}},
+		Success: []requestOp{{RequestPut: &putRequest{Key: key, Value: []byte(owner), Lease: id}}},
+	})
+	if err != nil || !ok {
+		// if this fails too, the lease will expire.
+		_ = c.revoke(ctx, id)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", metadata.ErrLeaseHeld, name)
+	}
+
+	return nil
+}
+
+// ReleaseLease gives up the named lease, if owner holds it.
+func (c *Coordinator) ReleaseLease(ctx context.Context, name, owner string) error {
+	kv, err := c.get(ctx, c.leaseKey(name))
+	if err != nil {
+		return err
+	}
+
+	if kv == nil || string(kv.Value) != owner {
+		return nil
+	}
+
+	// revoking the lease deletes the key. if someone else took the lease since
+	// we read it, their key is attached to a different lease, so isn't.
+	return c.revoke(ctx, kv.Lease)
+}
+
+// LeaseHolder returns the owner of the named lease, or an empty string if no
+// one holds it.
+func (c *Coordinator) LeaseHolder(ctx context.Context, name string) (string, error) {
+	kv, err := c.get(ctx, c.leaseKey(name))
+	if err != nil || kv == nil {
+		return "", err
+	}
+
+	return string(kv.Value), nil
+}
+
+// ManifestVersion returns the Created time of the newest manifest which was
+// published, or the zero time if none was.
+func (c *Coordinator) ManifestVersion(ctx context.Context) (time.Time, error) {
+	kv, err := c.get(ctx, c.manifestKey())
+	if err != nil || kv == nil {
+		return time.Time{}, err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, string(kv.Value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid manifest version: %w", err)
+	}
+
+	return t, nil
+}
+
+// SwapManifestVersion sets the manifest version to next, if it's currently prev
+// (as returned by ManifestVersion). Otherwise it returns
+// metadata.ErrManifestConflict.
+func (c *Coordinator) SwapManifestVersion(ctx context.Context, prev, next time.Time) error {
+	key := c.manifestKey()
+
+	cmp := compare{Key: key, Target: "VALUE", Result: "EQUAL", Value: formatVersion(prev)}
+	if prev.IsZero() {
+		cmp = compare{Key: key, Target: "CREATE", Result: "EQUAL", CreateRevision: new(num)}
+	}
+
+	ok, err := c.txn(ctx, &txnRequest{
+		Compare: []compare{cmp},
+		Success: []requestOp{{RequestPut: &putRequest{Key: key, Value: formatVersion(next)}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return metadata.ErrManifestConflict
+	}
+
+	return nil
+}
+
+func formatVersion(t time.Time) []byte {
+	return []byte(t.UTC().Format(time.RFC3339Nano))
+}
+
+// num is an int64, which the gateway encodes as a string, like proto3 JSON.
+type num int64
+
+func (n num) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatInt(int64(n), 10))), nil
+}
+
+func (n *num) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number: %s", b)
+	}
+	*n = num(v)
+	return nil
+}
+
+type keyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision num    `json:"create_revision"`
+	ModRevision    num    `json:"mod_revision"`
+	Lease          num    `json:"lease"`
+}
+
+// compare is one condition of a txn. Only one of CreateRevision and Value may
+// be set, depending on Target.
+type compare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	CreateRevision *num   `json:"create_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease num    `json:"lease,omitempty"`
+}
+
+type requestOp struct {
+	RequestPut *putRequest `json:"request_put,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare"`
+	Success []requestOp `json:"success"`
+}
+
+// get returns the given key, or nil if it doesn't exist.
+func (c *Coordinator) get(ctx context.Context, key []byte) (*keyValue, error) {
+	var res struct {
+		KVs []*keyValue `json:"kvs"`
+	}
+
+	err := c.call(ctx, "/v3/kv/range", map[string]interface{}{"key": key}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.KVs) == 0 {
+		return nil, nil
+	}
+
+	return res.KVs[0], nil
+}
+
+// txn runs the given transaction, and returns whether its comparisons held.
+func (c *Coordinator) txn(ctx context.Context, req *txnRequest) (bool, error) {
+	var res struct {
+		Succeeded bool `json:"succeeded"`
+	}
+
+	err := c.call(ctx, "/v3/kv/txn", req, &res)
+	if err != nil {
+		return false, err
+	}
+
+	return res.Succeeded, nil
+}
+
+// grant creates a lease which expires after ttl (rounded up to a second), and
+// returns its ID.
+func (c *Coordinator) grant(ctx context.Context, ttl time.Duration) (num, error) {
+	var res struct {
+		ID    num    `json:"ID"`
+		Error string `json:"error"`
+	}
+
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	err := c.call(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": num(secs)}, &res)
+	if err != nil {
+		return 0, err
+	}
+	if res.Error != "" {
+		return 0, fmt.Errorf("grant: %s", res.Error)
+	}
+
+	return res.ID, nil
+}
+
+// keepAlive renews the given lease, and returns the seconds left on it, which
+// is zero if it already expired.
+func (c *Coordinator) keepAlive(ctx context.Context, id num) (int64, error) {
+	var res struct {
+		Result struct {
+			TTL num `json:"TTL"`
+		} `json:"result"`
+	}
+
+	err := c.call(ctx, "/v3/lease/keepalive", map[string]interface{}{"ID": id}, &res)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(res.Result.TTL), nil
+}
+
+func (c *Coordinator) revoke(ctx context.Context, id num) error {
+	return c.call(ctx, "/v3/lease/revoke", map[string]interface{}{"ID": id}, nil)
+}
+
+// call posts the given request to the gateway, and decodes the response into
+// res, unless it's nil. Only the first object is decoded, since some endpoints
+// (e.g. keepalive) stream several.
+func (c *Coordinator) call(ctx context.Context, path string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("NewRequest: %w", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	hres, err := client.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", path, err)
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(hres.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", path, hres.Status, strings.TrimSpace(string(b)))
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(hres.Body).Decode(res)
+	if err != nil {
+		return fmt.Errorf("POST %s: Decode: %w", path, err)
+	}
+
+	return nil
+}
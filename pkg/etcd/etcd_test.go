@@ -0,0 +1,236 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEtcd implements just enough of the JSON gateway for Coordinator. Leases
+// never expire by themselves; call expire instead.
+type fakeEtcd struct {
+	mu     sync.Mutex
+	rev    int64
+	kvs    map[string]*keyValue
+	leases map[num]int64
+	nextID num
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *Coordinator) {
+	f := &fakeEtcd{kvs: map[string]*keyValue{}, leases: map[num]int64{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", f.handle(f.rangeKV))
+	mux.HandleFunc("/v3/kv/txn", f.handle(f.txn))
+	mux.HandleFunc("/v3/lease/grant", f.handle(f.grant))
+	mux.HandleFunc("/v3/lease/keepalive", f.handle(f.keepAlive))
+	mux.HandleFunc("/v3/lease/revoke", f.handle(f.revoke))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return f, New(srv.URL+"/", "/blobby/test/")
+}
+
+func (f *fakeEtcd) handle(fn func(req map[string]json.RawMessage) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(fn(req))
+	}
+}
+
+func (f *fakeEtcd) rangeKV(req map[string]json.RawMessage) interface{} {
+	var key []byte
+	_ = json.Unmarshal(req["key"], &key)
+
+	res := map[string]interface{}{}
+	if kv, ok := f.kvs[string(key)]; ok {
+		res["kvs"] = []*keyValue{kv}
+	}
+	return res
+}
+
+func (f *fakeEtcd) txn(req map[string]json.RawMessage) interface{} {
+	var cmps []compare
+	var ops []requestOp
+	_ = json.Unmarshal(req["compare"], &cmps)
+	_ = json.Unmarshal(req["success"], &ops)
+
+	for _, c := range cmps {
+		kv := f.kvs[string(c.Key)]
+		switch c.Target {
+		case "CREATE":
+			var rev num
+			if kv != nil {
+				rev = kv.CreateRevision
+			}
+			if rev != *c.CreateRevision {
+				return map[string]interface{}{"succeeded": false}
+			}
+		case "VALUE":
+			if kv == nil || string(kv.Value) != string(c.Value) {
+				return map[string]interface{}{"succeeded": false}
+			}
+		}
+	}
+
+	for _, op := range ops {
+		p := op.RequestPut
+		f.rev++
+		kv := &keyValue{Key: p.Key, Value: p.Value, CreateRevision: num(f.rev), ModRevision: num(f.rev), Lease: p.Lease}
+		if prev, ok := f.kvs[string(p.Key)]; ok {
+			kv.CreateRevision = prev.CreateRevision
+		}
+		f.kvs[string(p.Key)] = kv
+	}
+
+	return map[string]interface{}{"succeeded": true}
+}
+
+func (f *fakeEtcd) grant(req map[string]json.RawMessage) interface{} {
+	var ttl num
+	_ = json.Unmarshal(req["TTL"], &ttl)
+
+	f.nextID++
+	f.leases[f.nextID] = int64(ttl)
+	return map[string]interface{}{"ID": f.nextID, "TTL": ttl}
+}
+
+func (f *fakeEtcd) keepAlive(req map[string]json.RawMessage) interface{} {
+	var id num
+	_ = json.Unmarshal(req["ID"], &id)
+
+	return map[string]interface{}{"result": map[string]interface{}{"ID": id, "TTL": num(f.leases[id])}}
+}
+
+func (f *fakeEtcd) revoke(req map[string]json.RawMessage) interface{} {
+	var id num
+	_ = json.Unmarshal(req["ID"], &id)
+	f.expireLocked(id)
+	return map[string]interface{}{}
+}
+
+// expire expires the lease attached to the given key, like etcd would after
+// its TTL, deleting the key.
+func (f *fakeEtcd) expire(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if kv, ok := f.kvs[key]; ok {
+		f.expireLocked(kv.Lease)
+	}
+}
+
+func (f *fakeEtcd) expireLocked(id num) {
+	delete(f.leases, id)
+	for k, kv := range f.kvs {
+		if kv.Lease == id {
+			delete(f.kvs, k)
+		}
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	f, c := newFakeEtcd(t)
+
+	holder, err := c.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+
+	require.NoError(t, c.AcquireLease(ctx, "flush", "a", 1500*time.Millisecond))
+	assert.Equal(t, int64(2), f.leases[f.kvs["/blobby/test/leases/flush"].Lease], "ttl is rounded up")
+
+	// the holder can extend it; no one else can take it.
+	require.NoError(t, c.AcquireLease(ctx, "flush", "a", time.Second))
+	err = c.AcquireLease(ctx, "flush", "b", time.Second)
+	assert.ErrorIs(t, err, metadata.ErrLeaseHeld)
+	assert.Len(t, f.leases, 1, "the lease granted for b was revoked")
+
+	holder, err = c.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "a", holder)
+
+	// leases are independent.
+	require.NoError(t, c.AcquireLease(ctx, "compact", "b", time.Second))
+
+	// releasing someone else's lease does nothing.
+	require.NoError(t, c.ReleaseLease(ctx, "flush", "b"))
+	holder, err = c.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "a", holder)
+
+	require.NoError(t, c.ReleaseLease(ctx, "flush", "a"))
+	require.NoError(t, c.AcquireLease(ctx, "flush", "b", time.Second))
+
+	// once it expires, anyone can take it.
+	f.expire("/blobby/test/leases/flush")
+	require.NoError(t, c.AcquireLease(ctx, "flush", "c", time.Second))
+	holder, err = c.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "c", holder)
+}
+
+func TestManifestVersion(t *testing.T) {
+	ctx := context.Background()
+	_, c := newFakeEtcd(t)
+
+	v, err := c.ManifestVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, v.IsZero())
+
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	t2 := t1.Add(time.Minute)
+
+	require.NoError(t, c.SwapManifestVersion(ctx, time.Time{}, t1))
+	assert.ErrorIs(t, c.SwapManifestVersion(ctx, time.Time{}, t2), metadata.ErrManifestConflict)
+
+	v, err = c.ManifestVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, t1.Equal(v))
+
+	require.NoError(t, c.SwapManifestVersion(ctx, v, t2))
+	assert.ErrorIs(t, c.SwapManifestVersion(ctx, v, t2), metadata.ErrManifestConflict)
+}
+
+func TestNum(t *testing.T) {
+	b, err := json.Marshal(num(7587862087443474693))
+	require.NoError(t, err)
+	assert.Equal(t, `"7587862087443474693"`, string(b))
+
+	var n num
+	require.NoError(t, json.Unmarshal([]byte(`"42"`), &n))
+	assert.Equal(t, num(42), n)
+	require.NoError(t, json.Unmarshal([]byte(`42`), &n))
+	assert.Equal(t, num(42), n)
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"etcdserver: permission denied","code":7}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, "/").LeaseHolder(context.Background(), "flush")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+}
+
+func TestCoordinator(t *testing.T) {
+	var _ blobby.Coordinator = New("http://localhost:2379", "/")
+}
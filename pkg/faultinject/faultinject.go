@@ -0,0 +1,202 @@
+// Package faultinject fails, delays, or corrupts specific backend operations,
+// deterministically, so tests can exercise crash recovery and retries without
+// real outages. The backends call Check (or CheckReader) before each operation
+// they support injecting faults into. A nil Injector injects nothing, so the
+// hooks cost nothing in production.
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// Op identifies an operation which faults can be injected into.
+type Op string
+
+const (
+	BlobstoreGet    Op = "blobstore.get"
+	BlobstorePut    Op = "blobstore.put"
+	BlobstoreDelete Op = "blobstore.delete"
+
+	MemtablePut    Op = "memtable.put"
+	MemtableRead   Op = "memtable.read"
+	MemtableRotate Op = "memtable.rotate"
+	MemtableSwap   Op = "memtable.swap"
+	MemtableDrop   Op = "memtable.drop"
+
+	MetadataInsert Op = "metadata.insert"
+	MetadataDelete Op = "metadata.delete"
+	MetadataPurge  Op = "metadata.purge"
+	MetadataCommit Op = "metadata.commit"
+)
+
+// ErrInjected is the default error returned by injected faults.
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes what to do to some calls of an operation.
+type Fault struct {
+	Op Op
+
+	// After is the number of calls to let through before the fault starts.
+	After int
+
+	// Times is the number of calls which the fault applies to, once it starts.
+	// Zero means every call.
+	Times int
+
+	// Delay is how long to wait, per the injector's clock, before continuing
+	// (or failing). The wait is abandoned if the context is cancelled.
+	Delay time.Duration
+
+	// Err is returned instead of performing the operation. If this is nil and
+	// Delay and Corrupt are both unset, ErrInjected is returned.
+	Err error
+
+	// Corrupt flips a bit in the data read by the operation, rather than
+	// failing it. Only supported by ops which read a blob.
+	Corrupt bool
+}
+
+type rule struct {
+	Fault
+	seen int
+}
+
+type Injector struct {
+	clock clockwork.Clock
+
+	mu    sync.Mutex
+	rules []*rule
+	calls map[Op]int
+}
+
+func New(clock clockwork.Clock) *Injector {
+	return &Injector{
+		clock: clock,
+		calls: map[Op]int{},
+	}
+}
+
+// Add adds a fault. When more than one fault matches a call, the first one
+// added is applied.
+func (i *Injector) Add(f Fault) {
+	if f.Err == nil && f.Delay == 0 && !f.Corrupt {
+		f.Err = ErrInjected
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = append(i.rules, &rule{Fault: f})
+}
+
+// Reset removes every fault, and zeroes the call counts.
+func (i *Injector) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = nil
+	i.calls = map[Op]int{}
+}
+
+// Calls returns the number of times that the given operation was attempted,
+// including those which were failed.
+func (i *Injector) Calls(op Op) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.calls[op]
+}
+
+// match counts a call of the given op, and returns the fault which applies to
+// it, or nil.
+func (i *Injector) match(op Op) *Fault {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.calls[op]++
+
+	var hit *Fault
+	for _, r := range i.rules {
+		if r.Op != op {
+			continue
+		}
+
+		n := r.seen
+		r.seen++
+
+		if hit != nil || n < r.After || (r.Times > 0 && n >= r.After+r.Times) {
+			continue
+		}
+
+		f := r.Fault
+		hit = &f
+	}
+
+	return hit
+}
+
+// Check is called before performing the given operation. It waits for the
+// delay of the matching fault, then returns its error, or nil if there isn't
+// one.
+func (i *Injector) Check(ctx context.Context, op Op) error {
+	_, err := i.check(ctx, op)
+	return err
+}
+
+func (i *Injector) check(ctx context.Context, op Op) (*Fault, error) {
+	if i == nil {
+		return nil, nil
+	}
+
+	f := i.match(op)
+	if f == nil {
+		return nil, nil
+	}
+
+	if f.Delay > 0 {
+		select {
+		case <-i.clock.After(f.Delay):
+		case <-ctx.Done():
+			return f, ctx.Err()
+		}
+	}
+
+	return f, f.Err
+}
+
+// CheckReader is like Check, for operations which read a blob. If the matching
+// fault corrupts, the given reader is wrapped so a bit is flipped in the data
+// read from it.
+func (i *Injector) CheckReader(ctx context.Context, op Op, r io.ReadCloser) (io.ReadCloser, error) {
+	f, err := i.check(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if f != nil && f.Corrupt {
+		return &corruptReader{ReadCloser: r}, nil
+	}
+
+	return r, nil
+}
+
+// corruptReader flips the lowest bit of the last byte of the first non-empty
+// read. (not the first byte, since corrupting length prefixes tends to produce
+// huge allocations rather than interesting failures.)
+type corruptReader struct {
+	io.ReadCloser
+	done bool
+}
+
+func (c *corruptReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.done && n > 0 {
+		p[n-1] ^= 1
+		c.done = true
+	}
+
+	return n, err
+}
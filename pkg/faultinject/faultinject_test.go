@@ -0,0 +1,77 @@
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilInjector(t *testing.T) {
+	var i *Injector
+	assert.NoError(t, i.Check(context.Background(), MemtablePut))
+}
+
+func TestAfterAndTimes(t *testing.T) {
+	ctx := context.Background()
+	i := New(clockwork.NewFakeClock())
+	errBoom := errors.New("boom")
+	i.Add(Fault{Op: MemtablePut, After: 1, Times: 2, Err: errBoom})
+	i.Add(Fault{Op: MemtablePut, After: 2})
+
+	assert.NoError(t, i.Check(ctx, MemtablePut))
+	assert.ErrorIs(t, i.Check(ctx, MemtablePut), errBoom)
+	assert.ErrorIs(t, i.Check(ctx, MemtablePut), errBoom) // first rule wins
+	assert.ErrorIs(t, i.Check(ctx, MemtablePut), ErrInjected)
+	assert.NoError(t, i.Check(ctx, MemtableDrop))
+	assert.Equal(t, 4, i.Calls(MemtablePut))
+
+	i.Reset()
+	assert.NoError(t, i.Check(ctx, MemtablePut))
+	assert.Equal(t, 1, i.Calls(MemtablePut))
+}
+
+func TestDelay(t *testing.T) {
+	ctx := context.Background()
+	c := clockwork.NewFakeClock()
+	i := New(c)
+	i.Add(Fault{Op: BlobstoreGet, Delay: time.Second})
+
+	done := make(chan error)
+	go func() {
+		done <- i.Check(ctx, BlobstoreGet)
+	}()
+
+	require.NoError(t, c.BlockUntilContext(ctx, 1))
+	c.Advance(time.Second)
+	assert.NoError(t, <-done)
+
+	// cancellation abandons the wait.
+	ctx2, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, i.Check(ctx2, BlobstoreGet), context.Canceled)
+}
+
+func TestCorrupt(t *testing.T) {
+	ctx := context.Background()
+	i := New(clockwork.NewFakeClock())
+	i.Add(Fault{Op: BlobstoreGet, Corrupt: true, Times: 1})
+
+	r, err := i.CheckReader(ctx, BlobstoreGet, io.NopCloser(strings.NewReader("abc")))
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "abb", string(b))
+
+	r, err = i.CheckReader(ctx, BlobstoreGet, io.NopCloser(strings.NewReader("abc")))
+	require.NoError(t, err)
+	b, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+}
@@ -0,0 +1,185 @@
+// Package ingest writes messages from a queue (e.g. Kafka) to an archive in
+// batches, acknowledging them only once they're durably written.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+)
+
+// Message is a single key/value message read from a Source.
+type Message struct {
+	Key   string
+	Value []byte
+
+	// Timestamp is used as the timestamp of the record in the archive, so
+	// replays of the same message are deduplicated. If it's zero, the current
+	// time is used instead, and replays are not deduplicated.
+	Timestamp time.Time
+
+	// Offset is opaque to the ingester, and passed back to Source.Commit. It
+	// can be used to track the position in the queue.
+	Offset any
+}
+
+// Source is a queue of messages. A Kafka consumer (or any other queue client)
+// can be adapted to this interface.
+type Source interface {
+
+	// Next blocks until the next message is available, or the context is done.
+	Next(ctx context.Context) (*Message, error)
+
+	// Commit acknowledges the given message, and every message before it. It's
+	// only called after they've been written to the archive.
+	Commit(ctx context.Context, m *Message) error
+}
+
+type Options struct {
+	// BatchSize is the maximum number of messages written at once. The default
+	// is 100.
+	BatchSize int
+
+	// BatchTimeout is the maximum time to wait for a batch to fill, after the
+	// first message in it arrives. The default is one second.
+	BatchTimeout time.Duration
+
+	// FlushRecords, if non-zero, flushes the memtable after a batch is written
+	// if it contains at least this many records.
+	FlushRecords int
+}
+
+type Ingester struct {
+	b    *blobby.Blobby
+	src  Source
+	opts Options
+}
+
+func New(b *blobby.Blobby, src Source, opts Options) *Ingester {
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 100
+	}
+	if opts.BatchTimeout == 0 {
+		opts.BatchTimeout = time.Second
+	}
+
+	return &Ingester{
+		b:    b,
+		src:  src,
+		opts: opts,
+	}
+}
+
+// Run reads, writes, and commits batches of messages until the context is done
+// (which returns nil) or an error occurs, including the source running out of
+// messages (e.g. ErrClosed). If a batch can't be written, it isn't committed, so the
+// messages will be redelivered by the source.
+func (in *Ingester) Run(ctx context.Context) error {
+	for {
+		batch, err := in.next(ctx)
+		if len(batch) > 0 {
+			werr := in.write(ctx, batch)
+			if werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// next reads the next batch of messages. It returns a partial batch along with
+// the error if reading fails part-way through.
+func (in *Ingester) next(ctx context.Context) ([]*Message, error) {
+	m, err := in.src.Next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Source.Next: %w", err)
+	}
+
+	batch := []*Message{m}
+	ctx2, cancel := context.WithTimeout(ctx, in.opts.BatchTimeout)
+	defer cancel()
+
+	for len(batch) < in.opts.BatchSize {
+		m, err := in.src.Next(ctx2)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				break
+			}
+			return batch, fmt.Errorf("Source.Next: %w", err)
+		}
+		batch = append(batch, m)
+	}
+
+	return batch, nil
+}
+
+func (in *Ingester) write(ctx context.Context, batch []*Message) error {
+	recs := make([]*blobby.Record, len(batch))
+	for i, m := range batch {
+		recs[i] = &blobby.Record{
+			Key:       m.Key,
+			Document:  m.Value,
+			Timestamp: m.Timestamp,
+		}
+	}
+
+	// use a fresh context, so that a batch which was read before the context
+	// was cancelled is still written and committed.
+	wctx := context.WithoutCancel(ctx)
+
+	_, err := in.b.PutBatch(wctx, recs)
+	if err != nil {
+		return fmt.Errorf("PutBatch: %w", err)
+	}
+
+	err = in.src.Commit(wctx, batch[len(batch)-1])
+	if err != nil {
+		return fmt.Errorf("Source.Commit: %w", err)
+	}
+
+	if in.opts.FlushRecords > 0 {
+		_, err = in.b.Flush(wctx, blobby.FlushOptions{MinRecords: in.opts.FlushRecords})
+		if err != nil && !errors.Is(err, blobby.ErrFlushInProgress) && !errors.Is(err, blobby.ErrPaused) {
+			return fmt.Errorf("Flush: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ChanSource adapts a channel of messages to a Source. Commit calls OnCommit,
+// if it's set.
+type ChanSource struct {
+	C        <-chan *Message
+	OnCommit func(m *Message) error
+}
+
+// ErrClosed is returned by ChanSource.Next when the channel is closed.
+var ErrClosed = errors.New("source closed")
+
+func (s *ChanSource) Next(ctx context.Context) (*Message, error) {
+	select {
+	case m, ok := <-s.C:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *ChanSource) Commit(ctx context.Context, m *Message) error {
+	if s.OnCommit == nil {
+		return nil
+	}
+	return s.OnCommit(m)
+}
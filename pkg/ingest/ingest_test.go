@@ -0,0 +1,58 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngest(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClock()
+	b := blobby.New(env.MongoURL(), env.S3Bucket, c)
+	require.NoError(t, b.Init(ctx))
+
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := make([]*Message, 5)
+	for i := range msgs {
+		msgs[i] = &Message{
+			Key:       "k",
+			Value:     []byte(fmt.Sprintf("v%d", i)),
+			Timestamp: t0.Add(time.Duration(i) * time.Second),
+			Offset:    i,
+		}
+	}
+
+	ch := make(chan *Message, 10)
+	var committed []any
+	src := &ChanSource{C: ch, OnCommit: func(m *Message) error {
+		committed = append(committed, m.Offset)
+		return nil
+	}}
+
+	// the third message is redelivered.
+	for _, m := range msgs {
+		ch <- m
+	}
+	ch <- msgs[2]
+	close(ch)
+
+	in := New(b, src, Options{BatchSize: 2, BatchTimeout: 100 * time.Millisecond})
+	err := in.Run(ctx)
+	require.ErrorIs(t, err, ErrClosed)
+	assert.Equal(t, []any{1, 3, 2}, committed)
+
+	recs, err := b.GetVersionsBetween(ctx, "k", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, recs, 5)
+	assert.Equal(t, t0.Add(4*time.Second), recs[0].Timestamp.UTC())
+	assert.Equal(t, []byte("v4"), recs[0].Document)
+}
@@ -2,17 +2,70 @@ package memtable
 
 import (
 	"fmt"
+	"time"
 )
 
 type NotFound struct {
-	key string
+	Key string
 }
 
 func (e *NotFound) Error() string {
-	return fmt.Sprintf("memtable: not found: %s", e.key)
+	return fmt.Sprintf("memtable: not found: %s", e.Key)
 }
 
 func (e *NotFound) Is(err error) bool {
 	_, ok := err.(*NotFound)
 	return ok
 }
+
+// RotateConflict is returned by Rotate when another caller rotated the same
+// active memtable concurrently. The winner is responsible for flushing it.
+type RotateConflict struct {
+	name string
+}
+
+func (e *RotateConflict) Error() string {
+	return fmt.Sprintf("memtable: concurrent rotation of: %s", e.name)
+}
+
+func (e *RotateConflict) Is(err error) bool {
+	_, ok := err.(*RotateConflict)
+	return ok
+}
+
+// ErrTimestampConflict matches any TimestampConflict error, via errors.Is.
+var ErrTimestampConflict = &TimestampConflict{}
+
+// TimestampConflict is returned by PutBatch when a record has the same key and
+// timestamp as one which is already in the memtable, but a different value, so
+// it can't be a replay, and one of them would be lost.
+type TimestampConflict struct {
+	Key       string
+	Timestamp time.Time
+}
+
+func (e *TimestampConflict) Error() string {
+	return fmt.Sprintf("memtable: conflicting records with key %q at %s", e.Key, e.Timestamp.Format(time.RFC3339Nano))
+}
+
+func (e *TimestampConflict) Is(err error) bool {
+	_, ok := err.(*TimestampConflict)
+	return ok
+}
+
+// Dropped is returned by RangeIter.Next when one of the memtables it was reading
+// was dropped, usually because it was flushed, before every record in the range
+// was read from it. Key is the last key which was, or the start of the range.
+type Dropped struct {
+	Name string
+	Key  string
+}
+
+func (e *Dropped) Error() string {
+	return fmt.Sprintf("memtable: dropped while reading: %s (at %q)", e.Name, e.Key)
+}
+
+func (e *Dropped) Is(err error) bool {
+	_, ok := err.(*Dropped)
+	return ok
+}
@@ -3,7 +3,10 @@ package memtable
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/types"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -13,6 +16,11 @@ import (
 type Handle struct {
 	db   *mongo.Database
 	coll *mongo.Collection
+
+	// the URL of the server, for URL, and the faults to inject into Stream.
+	// unset if the handle wasn't created by a Memtable.
+	mongoURL string
+	faults   *faultinject.Injector
 }
 
 func NewHandle(db *mongo.Database, name string) *Handle {
@@ -22,14 +30,226 @@ func NewHandle(db *mongo.Database, name string) *Handle {
 	}
 }
 
+// handle returns a handle to the given collection, which knows its URL.
+func (mt *Memtable) handle(db *mongo.Database, name string) *Handle {
+	h := NewHandle(db, name)
+	h.mongoURL = mt.mongoURL
+	h.faults = mt.faults
+	return h
+}
+
 // Name returns the name of the collection serving this handle. This may be
 // formatted arbitrarily, and should only be used for display.
 func (h *Handle) Name() string {
 	return h.coll.Name()
 }
 
-func (h *Handle) Flush(ctx context.Context, ch chan *types.Record) error {
-	cur, err := h.coll.Find(ctx, bson.M{})
+// URL returns the location of the collection serving this handle, like
+// mongodb://host:27017/db/collection, for display. Credentials and options from
+// the URL the Memtable was created with are omitted. If that isn't known, the
+// host is empty.
+func (h *Handle) URL() string {
+	u, err := url.Parse(h.mongoURL)
+	if err != nil || u.Scheme == "" {
+		u = &url.URL{Scheme: "mongodb"}
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Path = "/" + h.db.Name() + "/" + h.coll.Name()
+	u.RawPath = ""
+	return u.String()
+}
+
+// Flush sends every record in this memtable to the given channel, and closes it.
+// Records which expired at or before now (see types.Record.Expires) are skipped,
+// since Mongo only deletes them periodically.
+func (h *Handle) Flush(ctx context.Context, ch chan *types.Record, now time.Time) error {
+	return h.flush(ctx, ch, now, options.Find())
+}
+
+// FlushSorted is like Flush, but sends the records in the order they're written
+// to sstables: by key ascending, then by timestamp descending.
+func (h *Handle) FlushSorted(ctx context.Context, ch chan *types.Record, now time.Time) error {
+	return h.flush(ctx, ch, now, options.Find().SetSort(bson.D{
+		{Key: "key", Value: 1},
+		{Key: "ts", Value: -1},
+	}))
+}
+
+// Batch is a page of records read from a memtable by Stream. The receiver must
+// call Ack once it's done with the records. The next batch isn't read until it
+// does, so only one is ever held in memory.
+type Batch struct {
+	Records []*types.Record
+	ack     chan error
+}
+
+// Ack acknowledges the batch. If err isn't nil, the stream stops, and Stream
+// returns the error.
+func (b *Batch) Ack(err error) {
+	b.ack <- err
+}
+
+type StreamOptions struct {
+	// BatchSize is the maximum number of records in each batch.
+	BatchSize int
+
+	// Retries is the number of times that reading a batch is retried, if it
+	// fails, before the stream fails. Since each batch is a separate query,
+	// retrying one doesn't repeat the others.
+	Retries int
+}
+
+type StreamStats struct {
+	// The number of batches and records which were acknowledged.
+	Batches int
+	Records int
+
+	// The number of times that reading a batch failed, and was retried.
+	Retries int
+}
+
+// Stream sends every record in this memtable to the given channel, in the same
+// order as FlushSorted, in batches of at most opts.BatchSize records, each read
+// with its own query starting after the last record of the previous one, rather
+// than through a single cursor which must stay open (and consistent) for the
+// whole flush. Each batch must be acknowledged before the next is read. The
+// channel is closed when the stream stops, even if it fails.
+//
+// Since the records are sent in order, every key before the first one in a batch
+// has been sent in full, so a flush which stops part-way can pick up from there
+// (see DeleteBelow).
+func (h *Handle) Stream(ctx context.Context, ch chan *Batch, now time.Time, opts StreamOptions) (*StreamStats, error) {
+	defer close(ch)
+
+	stats := &StreamStats{}
+	if opts.BatchSize <= 0 {
+		return stats, fmt.Errorf("invalid batch size: %d", opts.BatchSize)
+	}
+
+	fopts := options.Find().SetLimit(int64(opts.BatchSize)).SetSort(bson.D{
+		{Key: "key", Value: 1},
+		{Key: "ts", Value: -1},
+	})
+
+	var last *types.Record
+	for {
+		filter := notExpired(now)
+		if last != nil {
+			filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+				bson.M{"key": bson.M{"$gt": last.Key}},
+				bson.M{"key": last.Key, "ts": bson.M{"$lt": last.Timestamp}},
+			}}}}
+		}
+
+		recs, err := h.readBatch(ctx, filter, fopts)
+		for n := 0; err != nil && n < opts.Retries && ctx.Err() == nil; n++ {
+			stats.Retries++
+			recs, err = h.readBatch(ctx, filter, fopts)
+		}
+		if err != nil {
+			return stats, err
+		}
+		if len(recs) == 0 {
+			return stats, nil
+		}
+
+		b := &Batch{Records: recs, ack: make(chan error, 1)}
+		select {
+		case ch <- b:
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		}
+
+		select {
+		case err = <-b.ack:
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		}
+		if err != nil {
+			return stats, fmt.Errorf("batch %d: %w", stats.Batches, err)
+		}
+
+		stats.Batches++
+		stats.Records += len(recs)
+
+		if len(recs) < opts.BatchSize {
+			return stats, nil
+		}
+		last = recs[len(recs)-1]
+	}
+}
+
+// FlushBatches is like FlushSorted, but reads the records in batches via Stream,
+// and sends them to the given channel one at a time, acknowledging each batch
+// once every record in it has been received.
+func (h *Handle) FlushBatches(ctx context.Context, ch chan *types.Record, now time.Time, opts StreamOptions) (*StreamStats, error) {
+	defer close(ch)
+
+	batches := make(chan *Batch)
+	var stats *StreamStats
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		stats, err = h.Stream(ctx, batches, now, opts)
+		errc <- err
+	}()
+
+	for b := range batches {
+		b.Ack(forward(ctx, b.Records, ch))
+	}
+
+	err := <-errc
+	return stats, err
+}
+
+// forward sends the given records to the given channel, or returns an error if
+// the context is cancelled first.
+func forward(ctx context.Context, recs []*types.Record, ch chan *types.Record) error {
+	for _, rec := range recs {
+		select {
+		case ch <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// readBatch returns the records matching the given filter.
+func (h *Handle) readBatch(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]*types.Record, error) {
+	err := h.faults.Check(ctx, faultinject.MemtableRead)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := h.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+
+	var recs []*types.Record
+	err = cur.All(ctx, &recs)
+	if err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return recs, nil
+}
+
+func (h *Handle) flush(ctx context.Context, ch chan *types.Record, now time.Time, opts *options.FindOptions) error {
+	// closed even if the flush fails, so the receiver never waits forever.
+	defer close(ch)
+
+	return h.send(ctx, ch, notExpired(now), opts)
+}
+
+// send sends every record matching the given filter to the given channel.
+func (h *Handle) send(ctx context.Context, ch chan *types.Record, filter bson.M, opts *options.FindOptions) error {
+	cur, err := h.coll.Find(ctx, filter, opts)
 	if err != nil {
 		return fmt.Errorf("Find: %w", err)
 	}
@@ -43,12 +263,14 @@ func (h *Handle) Flush(ctx context.Context, ch chan *types.Record) error {
 			return fmt.Errorf("Decode: %w", err)
 		}
 
-		ch <- &rec
+		// the receiver might stop early, and cancel the context.
+		select {
+		case ch <- &rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	// TODO: does this belong at the bottom?
-	close(ch)
-
 	err = cur.Err()
 	if err != nil {
 		return fmt.Errorf("cursor error: %w", err)
@@ -57,6 +279,15 @@ func (h *Handle) Flush(ctx context.Context, ch chan *types.Record) error {
 	return nil
 }
 
+// notExpired returns a filter matching the records which hadn't expired at the
+// given time.
+func notExpired(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"expires": bson.M{"$exists": false}},
+		bson.M{"expires": bson.M{"$gt": now}},
+	}}
+}
+
 func (h *Handle) Create(ctx context.Context) error {
 	err := h.db.CreateCollection(ctx, h.coll.Name())
 	if err != nil {
@@ -78,5 +309,89 @@ func (h *Handle) Create(ctx context.Context) error {
 		return fmt.Errorf("CreateIndex: %w", err)
 	}
 
+	// to reject retried writes which already succeeded. most records don't
+	// have an idempotency key, so they're excluded.
+	_, err = h.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "key", Value: 1},
+			{Key: "idem", Value: 1},
+		},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"idem": bson.M{"$exists": true},
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf("CreateIndex(idem): %w", err)
+	}
+
+	// to find the oldest record quickly, without scanning the whole thing.
+	_, err = h.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ts", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("CreateIndex(ts): %w", err)
+	}
+
+	// so records in namespaces with a TTL are deleted once they expire. those
+	// without the field never are.
+	_, err = h.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("CreateIndex(expires): %w", err)
+	}
+
 	return nil
 }
+
+// DeleteBelow deletes every record in this memtable whose key sorts before the
+// given key, and returns how many were deleted. It's used to trim a memtable
+// which was partially flushed, since FlushSorted sends them first.
+func (h *Handle) DeleteBelow(ctx context.Context, key string) (int, error) {
+	res, err := h.coll.DeleteMany(ctx, bson.M{"key": bson.M{"$lt": key}})
+	if err != nil {
+		return 0, fmt.Errorf("DeleteMany: %w", err)
+	}
+
+	return int(res.DeletedCount), nil
+}
+
+// Count returns the number of records in this memtable. Note that multiple
+// versions of the same key are counted separately, as they are in sstables.
+func (h *Handle) Count(ctx context.Context) (int, error) {
+	n, err := h.coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return int(n), nil
+}
+
+// SizeBytes returns the total size of the records in this memtable, as stored
+// by Mongo, not including its indexes.
+func (h *Handle) SizeBytes(ctx context.Context) (int64, error) {
+	_, size, err := collStats(ctx, h.db, h.coll.Name())
+	if err != nil {
+		return 0, fmt.Errorf("collStats: %w", err)
+	}
+
+	return size, nil
+}
+
+// Oldest returns the timestamp of the oldest record in this memtable, or the
+// zero time if it's empty.
+func (h *Handle) Oldest(ctx context.Context) (time.Time, error) {
+	res := h.coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"ts": 1}))
+
+	var rec types.Record
+	err := res.Decode(&rec)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("Decode: %w", err)
+	}
+
+	return rec.Timestamp, nil
+}
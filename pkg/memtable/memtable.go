@@ -1,11 +1,15 @@
 package memtable
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
 	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/types"
 	"github.com/jonboulle/clockwork"
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,7 +18,6 @@ import (
 )
 
 const (
-	defaultDB               = "blobby"
 	metaCollectionName      = "meta"
 	memtablesCollectionName = "memtables"
 	metaActiveMemtableDocID = "active_memtable"
@@ -26,62 +29,332 @@ const (
 	retryJitter = 100 * time.Microsecond // 0.1ms
 )
 
+// Every memtable collection is tracked by a document in the memtables
+// collection, with one of these statuses. Exactly one memtable is active (and
+// receiving writes) at a time, but any number of them can be flushing, since
+// rotating doesn't wait for the previous memtable to finish flushing.
+const (
+	statusActive   = "active"
+	statusFlushing = "flushing"
+)
+
 type memtableInfo struct {
 	ID      string    `bson:"_id"`
 	Created time.Time `bson:"created,omitempty"`
 	Status  string    `bson:"status,omitempty"`
+
+	// Partial is set on flushing memtables whose flush stopped part-way
+	// through, so the next flush can resume it. See MarkPartial.
+	Partial bool `bson:"partial,omitempty"`
+
+	// Claimed is when the flush of a flushing memtable started, so that it can
+	// be resumed by another flush if it doesn't finish within ClaimTimeout. See
+	// Resume. It's zero if the flush was released.
+	Claimed time.Time `bson:"claimed,omitempty"`
 }
 
+// ClaimTimeout is how long the flush of a memtable can take before it's assumed
+// to have crashed, and the memtable can be claimed by another flush. It should
+// be much longer than the slowest flush.
+const ClaimTimeout = 1 * time.Hour
+
 type Memtable struct {
 	mongoURL string
+	dbName   string
 	mongo    *mongo.Database
 	clock    clockwork.Clock
+	faults   *faultinject.Injector
 }
 
-func New(mongoURL string, clock clockwork.Clock) *Memtable {
+func New(mongoURL, dbName string, clock clockwork.Clock) *Memtable {
 	return &Memtable{
 		mongoURL: mongoURL,
+		dbName:   dbName,
 		clock:    clock,
 	}
 }
 
+// SetFaults injects faults into writes, batched reads, rotations, and drops.
+// It's only meant for tests.
+func (mt *Memtable) SetFaults(fi *faultinject.Injector) {
+	mt.faults = fi
+}
+
 func (mt *Memtable) Get(ctx context.Context, key string) (*types.Record, string, error) {
+	rec, name, _, err := mt.GetFlushing(ctx, key)
+	return rec, name, err
+}
+
+// GetFlushing is like Get, but also returns true if the record was found in a
+// memtable which has been rotated out. Those might have been (partly) flushed
+// already, or abandoned by a flush which failed, so newer versions of the key
+// could be in an sstable.
+func (mt *Memtable) GetFlushing(ctx context.Context, key string) (*types.Record, string, bool, error) {
 	db, err := mt.GetMongo(ctx)
 	if err != nil {
-		return nil, "", fmt.Errorf("GetMongo: %w", err)
+		return nil, "", false, fmt.Errorf("GetMongo: %w", err)
 	}
 
-	cur, err := db.Collection(memtablesCollectionName).Find(
-		ctx,
-		bson.M{},
-		options.Find().SetSort(bson.D{{Key: "created", Value: -1}}))
+	// newest first, so the active memtable wins ties with the flushing ones.
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
 	if err != nil {
-		return nil, "", fmt.Errorf("db.Collection: %w", err)
+		return nil, "", false, fmt.Errorf("listMemtables: %w", err)
 	}
-	defer cur.Close(ctx)
 
-	var memtables []memtableInfo
-	if err := cur.All(ctx, &memtables); err != nil {
-		return nil, "", fmt.Errorf("cur.All: %w", err)
-	}
-
-	// try to find the key in each collection, starting with newest.
+	// the key might be in any of them, and the newest version isn't always in
+	// the newest memtable, since PutBatch accepts explicit timestamps.
+	var newest *types.Record
+	var name string
+	var flushing bool
+	now := mt.clock.Now()
 	for _, memtable := range memtables {
-		rec, err := mt.innerGetOneCollection(ctx, db, memtable.ID, key)
+		rec, err := mt.innerGetOneCollection(ctx, db, memtable.ID, key, now)
 		if err != nil && err != mongo.ErrNoDocuments {
-			return nil, "", fmt.Errorf("innerGetOneCollection(%s): %w", memtable.ID, err)
+			return nil, "", false, fmt.Errorf("innerGetOneCollection(%s): %w", memtable.ID, err)
+		}
+		if rec != nil && (newest == nil || rec.Timestamp.After(newest.Timestamp)) {
+			newest, name, flushing = rec, memtable.ID, memtable.Status != statusActive
+		}
+	}
+
+	if newest == nil {
+		return nil, "", false, &NotFound{Key: key}
+	}
+
+	return newest, name, flushing, nil
+}
+
+// GetAll returns every record with the given key and a timestamp in [from, to)
+// from every memtable, newest first. A zero from or to is unbounded. Expired
+// records are skipped.
+func (mt *Memtable) GetAll(ctx context.Context, key string, from, to time.Time) ([]*types.Record, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
+	if err != nil {
+		return nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	filter := notExpired(mt.clock.Now())
+	filter["key"] = key
+	if ts := timeRange(from, to); ts != nil {
+		filter["ts"] = ts
+	}
+
+	var recs []*types.Record
+	for _, m := range memtables {
+		cur, err := db.Collection(m.ID).Find(ctx, filter, options.Find().SetSort(bson.M{"ts": -1}))
+		if err != nil {
+			return nil, fmt.Errorf("Find(%s): %w", m.ID, err)
+		}
+
+		var batch []*types.Record
+		err = cur.All(ctx, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("cursor.All(%s): %w", m.ID, err)
+		}
+
+		recs = append(recs, batch...)
+	}
+
+	return recs, nil
+}
+
+// Count returns the approximate number of records in every memtable, active or
+// flushing. Records in flushing memtables might also be in an sstable.
+func (mt *Memtable) Count(ctx context.Context) (int, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	_, counts, err := countMemtables(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+
+	return total, nil
+}
+
+// CountRange returns the number of records with a key in [start, end) in every
+// memtable, active or flushing. If end is empty, the range is unbounded.
+func (mt *Memtable) CountRange(ctx context.Context, start, end string) (int, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
+	if err != nil {
+		return 0, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	keys := bson.M{"$gte": start}
+	if end != "" {
+		keys["$lt"] = end
+	}
+
+	total := 0
+	for _, m := range memtables {
+		n, err := db.Collection(m.ID).CountDocuments(ctx, bson.M{"key": keys})
+		if err != nil {
+			return 0, fmt.Errorf("CountDocuments(%s): %w", m.ID, err)
+		}
+		total += int(n)
+	}
+
+	return total, nil
+}
+
+// Sample returns up to n records chosen at random from every memtable, each
+// memtable contributing in proportion to its size.
+func (mt *Memtable) Sample(ctx context.Context, n int) ([]*types.Record, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, counts, err := countMemtables(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	var recs []*types.Record
+	for i, m := range memtables {
+		size := (n*counts[i] + total - 1) / total
+		if size == 0 {
+			continue
+		}
+
+		cur, err := db.Collection(m.ID).Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$sample", Value: bson.M{"size": size}}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Aggregate(%s): %w", m.ID, err)
+		}
+
+		var batch []*types.Record
+		err = cur.All(ctx, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("cursor.All(%s): %w", m.ID, err)
+		}
+
+		recs = append(recs, batch...)
+	}
+
+	// rounding up might have taken a few too many.
+	if len(recs) > n {
+		recs = recs[:n]
+	}
+
+	return recs, nil
+}
+
+// countMemtables returns every memtable, and the approximate number of records
+// in each.
+func countMemtables(ctx context.Context, db *mongo.Database) ([]memtableInfo, []int, error) {
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	counts := make([]int, len(memtables))
+	for i, m := range memtables {
+		c, err := db.Collection(m.ID).EstimatedDocumentCount(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("EstimatedDocumentCount(%s): %w", m.ID, err)
+		}
+		counts[i] = int(c)
+	}
+
+	return memtables, counts, nil
+}
+
+// Since returns every record with a timestamp at or after the given time, from
+// every memtable, in timestamp order. Expired records are skipped.
+func (mt *Memtable) Since(ctx context.Context, from time.Time) ([]*types.Record, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, 1)
+	if err != nil {
+		return nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	filter := notExpired(mt.clock.Now())
+	if ts := timeRange(from, time.Time{}); ts != nil {
+		filter["ts"] = ts
+	}
+
+	var recs []*types.Record
+	for _, m := range memtables {
+		cur, err := db.Collection(m.ID).Find(ctx, filter, options.Find().SetSort(bson.M{"ts": 1}))
+		if err != nil {
+			return nil, fmt.Errorf("Find(%s): %w", m.ID, err)
 		}
-		if rec != nil {
-			return rec, memtable.ID, nil
+
+		var batch []*types.Record
+		err = cur.All(ctx, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("cursor.All(%s): %w", m.ID, err)
 		}
+
+		recs = append(recs, batch...)
+	}
+
+	// memtables are rotated in time order, but writers with skewed clocks can
+	// still put records out of order across them.
+	slices.SortStableFunc(recs, func(a, b *types.Record) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return recs, nil
+}
+
+// timeRange returns a filter matching times in [from, to), or nil if both are
+// zero.
+func timeRange(from, to time.Time) bson.M {
+	if from.IsZero() && to.IsZero() {
+		return nil
+	}
+
+	r := bson.M{}
+	if !from.IsZero() {
+		r["$gte"] = from
+	}
+	if !to.IsZero() {
+		r["$lt"] = to
 	}
 
-	// not found in any collection.
-	return nil, "", &NotFound{key}
+	return r
 }
 
-func (mt *Memtable) innerGetOneCollection(ctx context.Context, db *mongo.Database, coll, key string) (*types.Record, error) {
-	res := db.Collection(coll).FindOne(ctx, bson.M{"key": key}, options.FindOne().SetSort(bson.M{"ts": -1}))
+// innerGetOneCollection returns the newest record with the given key in the
+// given memtable, skipping those which had expired at the given time, since
+// Mongo doesn't delete them straight away.
+func (mt *Memtable) innerGetOneCollection(ctx context.Context, db *mongo.Database, coll, key string, now time.Time) (*types.Record, error) {
+	filter := notExpired(now)
+	filter["key"] = key
+
+	res := db.Collection(coll).FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"ts": -1}))
 
 	b, err := res.Raw()
 	if err != nil {
@@ -98,33 +371,257 @@ func (mt *Memtable) innerGetOneCollection(ctx context.Context, db *mongo.Databas
 }
 
 func (mt *Memtable) Put(ctx context.Context, key string, value []byte) (string, error) {
-	c, err := mt.activeCollection(ctx)
+	return mt.PutRecord(ctx, &types.Record{Key: key, Document: value})
+}
+
+// PutRecord is like Put, but writes the given record, so that the fields other
+// than the key and value (e.g. the codec) can be set. The timestamp is always
+// set to the current time, overwriting whatever was there.
+//
+// If the record has an idempotency key, and a record with the same key and
+// idempotency key is already in any memtable, nothing is written, and the name
+// of the memtable containing the existing record is returned.
+func (mt *Memtable) PutRecord(ctx context.Context, rec *types.Record) (string, error) {
+	err := mt.faults.Check(ctx, faultinject.MemtablePut)
 	if err != nil {
 		return "", err
 	}
 
+	if rec.IdempotencyKey != "" {
+		name, err := mt.findIdempotent(ctx, rec)
+		if err != nil || name != "" {
+			return name, err
+		}
+	}
+
+	rec.Timestamp = time.Time{}
+
 	for {
-		_, err = c.InsertOne(ctx, &types.Record{
-			Key:       key,
-			Timestamp: mt.clock.Now(),
-			Document:  value,
-		})
-		if err == nil {
-			break
+		c, err := mt.activeCollection(ctx)
+		if err != nil {
+			return "", err
 		}
 
-		// sleep and retry to get a new timestamp. it's almost certainly been
-		// long enough already, but this makes testing easier.
-		if mongo.IsDuplicateKeyError(err) {
-			jitter := time.Duration(rand.Int63n(retryJitter.Nanoseconds()))
-			mt.clock.Sleep(retrySleep + jitter)
-			continue
+		if rec.Timestamp.IsZero() {
+			rec.Timestamp = mt.clock.Now()
+		}
+
+		_, err = c.InsertOne(ctx, rec)
+		if err != nil {
+			// sleep and retry to get a new timestamp. it's almost certainly
+			// been long enough already, but this makes testing easier.
+			if mongo.IsDuplicateKeyError(err) {
+
+				// a concurrent retry of the same write might have beaten us.
+				if rec.IdempotencyKey != "" {
+					name, err := mt.findIdempotent(ctx, rec)
+					if err != nil || name != "" {
+						return name, err
+					}
+				}
+
+				jitter := time.Duration(rand.Int63n(retryJitter.Nanoseconds()))
+				mt.clock.Sleep(retrySleep + jitter)
+				rec.Timestamp = time.Time{}
+				continue
+			}
+
+			return "", err
 		}
 
+		ok, err := mt.stillActive(ctx, c)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return c.Name(), nil
+		}
+
+		// the memtable was rotated (maybe by another process) while we were
+		// writing to it, so the flush might have missed this record. write it
+		// again to the new active memtable, with the same timestamp, so if the
+		// flush did see it, the two copies are identical and will be deduped.
+		_, err = c.DeleteOne(ctx, bson.M{"key": rec.Key, "ts": rec.Timestamp})
+		if err != nil {
+			return "", fmt.Errorf("DeleteOne: %w", err)
+		}
+	}
+}
+
+// stillActive returns true if the given memtable is still the active one. When
+// this is true after a write, the write is guaranteed to be seen by the flush
+// of that memtable, since it can't start until after the memtable is marked as
+// flushing.
+func (mt *Memtable) stillActive(ctx context.Context, c *mongo.Collection) (bool, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	n, err := db.Collection(memtablesCollectionName).CountDocuments(ctx, bson.M{
+		"_id":    c.Name(),
+		"status": statusActive,
+	})
+	if err != nil {
+		return false, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return n > 0, nil
+}
+
+// PutBatch writes the given records to the active memtable, in one round trip.
+// Unlike PutRecord, records keep their timestamps, so a record which collides
+// with an existing one with the same key and timestamp (or idempotency key) is
+// assumed to be a replay of it, and skipped. If it has a different value, it's
+// not a replay, and a TimestampConflict error is returned, though the rest of
+// the batch is still written. Records with no timestamp are given the current
+// time, and written individually by PutRecord.
+//
+// The timestamps don't need to increase. A record older than the newest version
+// of its key is written as an older version, and doesn't change what Get
+// returns.
+func (mt *Memtable) PutBatch(ctx context.Context, recs []*types.Record) (string, error) {
+	err := mt.faults.Check(ctx, faultinject.MemtablePut)
+	if err != nil {
 		return "", err
 	}
 
-	return c.Name(), nil
+	var docs []any
+	var untimed []*types.Record
+	for _, rec := range recs {
+		if rec.Timestamp.IsZero() {
+			untimed = append(untimed, rec)
+			continue
+		}
+		docs = append(docs, rec)
+	}
+
+	var name string
+	if len(docs) > 0 {
+		name, err = mt.insertMany(ctx, docs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, rec := range untimed {
+		name, err = mt.PutRecord(ctx, rec)
+		if err != nil {
+			return "", fmt.Errorf("PutRecord: %w", err)
+		}
+	}
+
+	return name, nil
+}
+
+// insertMany writes the given records to the active memtable, skipping any
+// which are already there. Like PutRecord, if the memtable is rotated during
+// the write, the records are written again to the new one.
+func (mt *Memtable) insertMany(ctx context.Context, docs []any) (string, error) {
+	for {
+		c, err := mt.activeCollection(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = c.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		dups, ok := onlyDuplicates(err)
+		if err != nil && !ok {
+			return "", fmt.Errorf("InsertMany: %w", err)
+		}
+
+		ok, err = mt.stillActive(ctx, c)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+
+		for _, i := range dups {
+			err = checkReplay(ctx, c, docs[i].(*types.Record))
+			if err != nil {
+				return c.Name(), err
+			}
+		}
+
+		return c.Name(), nil
+	}
+}
+
+// onlyDuplicates returns the indexes of the documents which failed to insert,
+// and true, if the given error from InsertMany was caused by duplicate keys and
+// nothing else, or nil.
+func onlyDuplicates(err error) ([]int, bool) {
+	if err == nil {
+		return nil, true
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return nil, false
+	}
+
+	dups := make([]int, 0, len(bwe.WriteErrors))
+	for _, we := range bwe.WriteErrors {
+		if !mongo.IsDuplicateKeyError(we) {
+			return nil, false
+		}
+		dups = append(dups, we.Index)
+	}
+
+	return dups, true
+}
+
+// checkReplay is called with a record which collided with one already in the
+// given memtable, and returns a TimestampConflict error if they have the same
+// key and timestamp, but not the same value. Collisions on the idempotency key
+// are always replays.
+func checkReplay(ctx context.Context, c *mongo.Collection, rec *types.Record) error {
+	var existing types.Record
+	err := c.FindOne(ctx, bson.M{"key": rec.Key, "ts": rec.Timestamp}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("FindOne: %w", err)
+	}
+
+	if existing.Codec != rec.Codec || !bytes.Equal(existing.Document, rec.Document) {
+		return &TimestampConflict{Key: rec.Key, Timestamp: rec.Timestamp}
+	}
+
+	return nil
+}
+
+// findIdempotent returns the name of the memtable containing a record with the
+// same key and idempotency key as the given one, or the empty string if there's
+// no such memtable. Records which were already flushed aren't considered.
+func (mt *Memtable) findIdempotent(ctx context.Context, rec *types.Record) (string, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return "", fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
+	if err != nil {
+		return "", fmt.Errorf("listMemtables: %w", err)
+	}
+
+	for _, m := range memtables {
+		n, err := db.Collection(m.ID).CountDocuments(ctx, bson.M{
+			"key":  rec.Key,
+			"idem": rec.IdempotencyKey,
+		})
+		if err != nil {
+			return "", fmt.Errorf("CountDocuments(%s): %w", m.ID, err)
+		}
+		if n > 0 {
+			return m.ID, nil
+		}
+	}
+
+	return "", nil
 }
 
 func (mt *Memtable) Ping(ctx context.Context) error {
@@ -132,45 +629,104 @@ func (mt *Memtable) Ping(ctx context.Context) error {
 	return err
 }
 
+// Init creates the collections needed by the memtable, and the first memtable.
+// It's idempotent, so can be called again to finish an interrupted Init, or on
+// a memtable which is already initialized.
 func (mt *Memtable) Init(ctx context.Context) error {
 	db, err := mt.GetMongo(ctx)
 	if err != nil {
 		return fmt.Errorf("GetMongo: %w", err)
 	}
 
-	err = db.CreateCollection(ctx, metaCollectionName)
+	for _, name := range []string{metaCollectionName, memtablesCollectionName} {
+		err = createCollection(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("createCollection(%s): %w", name, err)
+		}
+	}
+
+	ok, err := mt.Initialized(ctx)
 	if err != nil {
-		return fmt.Errorf("CreateCollection(%s): %w", metaCollectionName, err)
+		return fmt.Errorf("Initialized: %w", err)
+	}
+	if ok {
+		return nil
 	}
 
-	err = db.CreateCollection(ctx, memtablesCollectionName)
+	// if a previous Init was interrupted after creating the first memtable but
+	// before pointing at it, reuse that one rather than leaking it.
+	var name string
+	active, err := listMemtables(ctx, db, bson.M{"status": statusActive}, -1)
 	if err != nil {
-		return fmt.Errorf("CreateCollection(%s): %w", memtablesCollectionName, err)
+		return fmt.Errorf("listMemtables: %w", err)
+	}
+	if len(active) > 0 {
+		name = active[0].ID
+	} else {
+		handle, err := mt.createNext(ctx, db)
+		if err != nil {
+			return fmt.Errorf("createNewMemtable: %w", err)
+		}
+		name = handle.Name()
 	}
 
-	handle, err := mt.createNext(ctx, db)
+	// upsert rather than insert, in case another process is racing to init.
+	// whichever one wins, the other memtable is harmless and empty.
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaActiveMemtableDocID},
+		bson.M{"$setOnInsert": bson.M{"value": name}},
+		options.Update().SetUpsert(true),
+	)
 	if err != nil {
-		return fmt.Errorf("createNewMemtable: %w", err)
+		return fmt.Errorf("UpdateOne: %w", err)
 	}
 
-	coll := db.Collection(metaCollectionName)
-	_, err = coll.InsertOne(ctx, bson.M{
-		"_id":   metaActiveMemtableDocID,
-		"value": handle.Name(),
-	})
+	return nil
+}
+
+// Initialized returns true if Init has completed, i.e. there's an active
+// memtable to write to.
+func (mt *Memtable) Initialized(ctx context.Context) (bool, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	n, err := db.Collection(metaCollectionName).CountDocuments(ctx, bson.M{"_id": metaActiveMemtableDocID})
+	if err != nil {
+		return false, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return n > 0, nil
+}
+
+// createCollection creates a collection, unless it already exists.
+func createCollection(ctx context.Context, db *mongo.Database, name string) error {
+	err := db.CreateCollection(ctx, name)
 	if err != nil {
-		return fmt.Errorf("InsertOne: %w", err)
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Name == "NamespaceExists" {
+			return nil
+		}
+		return err
 	}
 
 	return nil
 }
 
+// SetClient makes the memtable use the given client, rather than connecting its
+// own, so that it can share a connection pool with others.
+func (mt *Memtable) SetClient(client *mongo.Client) {
+	mt.mongo = client.Database(mt.dbName)
+}
+
 func (mt *Memtable) GetMongo(ctx context.Context) (*mongo.Database, error) {
 	if mt.mongo != nil {
 		return mt.mongo, nil
 	}
 
-	m, err := connectToMongo(ctx, mt.mongoURL)
+	m, err := connectToMongo(ctx, mt.mongoURL, mt.dbName)
 	if err != nil {
 		return nil, err
 	}
@@ -179,7 +735,7 @@ func (mt *Memtable) GetMongo(ctx context.Context) (*mongo.Database, error) {
 	return m, nil
 }
 
-func connectToMongo(ctx context.Context, url string) (*mongo.Database, error) {
+func connectToMongo(ctx context.Context, url, dbName string) (*mongo.Database, error) {
 	opt := options.Client().ApplyURI(url).SetTimeout(10 * time.Second)
 
 	client, err := mongo.Connect(ctx, opt)
@@ -191,7 +747,7 @@ func connectToMongo(ctx context.Context, url string) (*mongo.Database, error) {
 		return nil, err
 	}
 
-	return client.Database(defaultDB), nil
+	return client.Database(dbName), nil
 }
 
 func (mt *Memtable) activeCollection(ctx context.Context) (*mongo.Collection, error) {
@@ -208,6 +764,21 @@ func (mt *Memtable) activeCollection(ctx context.Context) (*mongo.Collection, er
 	return m.Collection(cn), nil
 }
 
+// Active returns a handle to the memtable which is currently receiving writes.
+func (mt *Memtable) Active(ctx context.Context) (*Handle, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	name, err := activeCollectionName(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("activeCollectionName: %w", err)
+	}
+
+	return mt.handle(db, name), nil
+}
+
 func activeCollectionName(ctx context.Context, db *mongo.Database) (string, error) {
 	res := db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaActiveMemtableDocID})
 
@@ -233,7 +804,7 @@ func activeCollectionName(ctx context.Context, db *mongo.Database) (string, erro
 func (mt *Memtable) createNext(ctx context.Context, db *mongo.Database) (*Handle, error) {
 	name := fmt.Sprintf("mt_%d", mt.clock.Now().UTC().UnixNano())
 
-	handle := NewHandle(db, name)
+	handle := mt.handle(db, name)
 	if err := handle.Create(ctx); err != nil {
 		return nil, fmt.Errorf("handle.Create: %w", err)
 	}
@@ -241,7 +812,7 @@ func (mt *Memtable) createNext(ctx context.Context, db *mongo.Database) (*Handle
 	_, err := db.Collection(memtablesCollectionName).InsertOne(ctx, memtableInfo{
 		ID:      name,
 		Created: mt.clock.Now(),
-		Status:  "active",
+		Status:  statusActive,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("error tracking memtable: %w", err)
@@ -250,7 +821,16 @@ func (mt *Memtable) createNext(ctx context.Context, db *mongo.Database) (*Handle
 	return handle, nil
 }
 
+// Rotate creates a new memtable and makes it active, and marks the previously
+// active memtable as flushing, in one transaction. It doesn't wait for any previous memtables to be
+// flushed, so writes are never blocked by a slow flush. hPrev should be flushed
+// and dropped by the caller.
 func (mt *Memtable) Rotate(ctx context.Context) (hPrev *Handle, hNext *Handle, err error) {
+	err = mt.faults.Check(ctx, faultinject.MemtableRotate)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	db, err := mt.GetMongo(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("GetMongo: %w", err)
@@ -266,29 +846,309 @@ func (mt *Memtable) Rotate(ctx context.Context) (hPrev *Handle, hNext *Handle, e
 		return nil, nil, fmt.Errorf("createNext: %w", err)
 	}
 
-	_, err = db.Collection(metaCollectionName).UpdateOne(
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return nil, nil, fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	// swap the pointer and mark the previous memtable as flushing atomically.
+	// otherwise a crash in between would leave it pointed at by nothing, but
+	// still active, so nothing would ever flush it.
+	swapped := false
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		swapped = false
+
+		// only swap the pointer if it still points at the memtable we read
+		// above. otherwise someone else rotated concurrently, and they own the
+		// flush.
+		res, err := db.Collection(metaCollectionName).UpdateOne(
+			sc,
+			bson.M{"_id": metaActiveMemtableDocID, "value": activeName},
+			bson.M{"$set": bson.M{"value": hNext.Name()}},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateOne: %w", err)
+		}
+		if res.MatchedCount == 0 {
+			return nil, nil
+		}
+
+		err = mt.faults.Check(sc, faultinject.MemtableSwap)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = db.Collection(memtablesCollectionName).UpdateOne(
+			sc,
+			bson.M{"_id": activeName},
+			bson.M{"$set": bson.M{"status": statusFlushing, "claimed": mt.clock.Now()}},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateOne: %w", err)
+		}
+
+		swapped = true
+		return nil, nil
+	})
+	if err != nil {
+		_ = mt.Drop(context.WithoutCancel(ctx), hNext.Name())
+		return nil, nil, fmt.Errorf("WithTransaction: %w", err)
+	}
+	if !swapped {
+		err = mt.Drop(ctx, hNext.Name())
+		if err != nil {
+			return nil, nil, fmt.Errorf("Drop(%s): %w", hNext.Name(), err)
+		}
+
+		return nil, nil, &RotateConflict{activeName}
+	}
+
+	hPrev = mt.handle(db, activeName)
+	return hPrev, hNext, nil
+}
+
+// FlushQueue returns handles to every memtable which has been rotated out but
+// not yet dropped, oldest first. The oldest should be flushed first, so newer
+// versions of a key never end up in an older sstable.
+func (mt *Memtable) FlushQueue(ctx context.Context) ([]*Handle, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{"status": statusFlushing}, 1)
+	if err != nil {
+		return nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	handles := make([]*Handle, len(memtables))
+	for i, info := range memtables {
+		handles[i] = mt.handle(db, info.ID)
+	}
+
+	return handles, nil
+}
+
+// MarkPartial records that the flush of the given memtable, which must be
+// flushing, stopped part-way through. The records which were flushed should be
+// deleted from it (see Handle.DeleteBelow), and the rest flushed later by
+// whoever claims it with Resume.
+func (mt *Memtable) MarkPartial(ctx context.Context, name string) error {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("GetMongo: %w", err)
+	}
+
+	res, err := db.Collection(memtablesCollectionName).UpdateOne(
 		ctx,
-		bson.M{"_id": metaActiveMemtableDocID},
-		bson.M{"$set": bson.M{"value": hNext.Name()}},
+		bson.M{"_id": name, "status": statusFlushing},
+		bson.M{"$set": bson.M{"partial": true}},
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("UpdateOne: %w", err)
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("memtable not flushing: %s", name)
+	}
+
+	return nil
+}
+
+// Resume claims the oldest flushing memtable whose flush didn't finish, and
+// returns a handle to it, or nil if there are none. That's those marked by
+// MarkPartial or Release, and those whose flush started more than ClaimTimeout
+// ago, since whoever started it probably crashed. They might have been written
+// to an sstable already, if the flush failed after that, in which case flushing
+// them again writes harmless duplicates. The claim is renewed, so concurrent
+// callers never claim the same one.
+func (mt *Memtable) Resume(ctx context.Context) (*Handle, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	now := mt.clock.Now()
+	cutoff := now.Add(-ClaimTimeout)
+
+	var info memtableInfo
+	err = db.Collection(memtablesCollectionName).FindOneAndUpdate(
+		ctx,
+		bson.M{"status": statusFlushing, "$or": bson.A{
+			bson.M{"partial": true},
+			bson.M{"claimed": bson.M{"$lt": cutoff}},
+
+			// rotated before claims existed.
+			bson.M{"claimed": bson.M{"$exists": false}, "created": bson.M{"$lt": cutoff}},
+		}},
+		bson.M{"$unset": bson.M{"partial": ""}, "$set": bson.M{"claimed": now}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "created", Value: 1}}),
+	).Decode(&info)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("FindOneAndUpdate: %w", err)
+	}
+
+	return mt.handle(db, info.ID), nil
+}
+
+// Release gives up the claim on the given flushing memtable, after its flush
+// failed, so the next call to Resume claims it rather than waiting for the claim
+// to time out.
+func (mt *Memtable) Release(ctx context.Context, name string) error {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("GetMongo: %w", err)
 	}
 
 	_, err = db.Collection(memtablesCollectionName).UpdateOne(
 		ctx,
-		bson.M{"_id": activeName},
-		bson.M{"$set": bson.M{"status": "flushing"}},
+		bson.M{"_id": name, "status": statusFlushing},
+		bson.M{"$set": bson.M{"claimed": time.Time{}}},
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("UpdateOne: %w", err)
+		return fmt.Errorf("UpdateOne: %w", err)
 	}
 
-	hPrev = NewHandle(db, activeName)
-	return hPrev, hNext, nil
+	return nil
+}
+
+// Oldest returns the timestamp of the oldest record in any memtable, active or
+// flushing, or the zero time if they're all empty. This is the oldest record
+// which exists only in the memtable, and hasn't yet made it to the blobstore.
+func (mt *Memtable) Oldest(ctx context.Context) (time.Time, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, 1)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	var oldest time.Time
+	for _, info := range memtables {
+		t, err := mt.handle(db, info.ID).Oldest(ctx)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Oldest(%s): %w", info.ID, err)
+		}
+
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+
+	return oldest, nil
+}
+
+// Stats describes a memtable.
+type Stats struct {
+	Name    string
+	Created time.Time
+
+	// Active is true if the memtable is receiving writes. Otherwise, it has been
+	// rotated out, and is waiting to be flushed.
+	Active bool
+
+	// The number of records, and their total size in Mongo (before compression
+	// by the storage engine), both from the collection stats.
+	Records int
+	Bytes   int64
+
+	// The timestamp of the oldest record, or zero if it's empty.
+	Oldest time.Time
+}
+
+// Stats returns the stats of every memtable, active or flushing, oldest first.
+func (mt *Memtable) Stats(ctx context.Context) ([]*Stats, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, 1)
+	if err != nil {
+		return nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	out := make([]*Stats, len(memtables))
+	for i, info := range memtables {
+		st := &Stats{Name: info.ID, Created: info.Created, Active: info.Status == statusActive}
+
+		st.Records, st.Bytes, err = collStats(ctx, db, info.ID)
+		if err != nil {
+			return nil, fmt.Errorf("collStats(%s): %w", info.ID, err)
+		}
+
+		st.Oldest, err = mt.handle(db, info.ID).Oldest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Oldest(%s): %w", info.ID, err)
+		}
+
+		out[i] = st
+	}
+
+	return out, nil
+}
+
+// collStats returns the number of documents in the given collection, and their
+// total uncompressed size in bytes.
+func collStats(ctx context.Context, db *mongo.Database, coll string) (int, int64, error) {
+	cur, err := db.Collection(coll).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$collStats", Value: bson.M{"storageStats": bson.M{}}}},
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Aggregate: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var docs []struct {
+		StorageStats struct {
+			Count int64 `bson:"count"`
+			Size  int64 `bson:"size"`
+		} `bson:"storageStats"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return 0, 0, fmt.Errorf("cur.All: %w", err)
+	}
+
+	// the collection doesn't exist (yet), so it's empty.
+	if len(docs) == 0 {
+		return 0, 0, nil
+	}
+
+	return int(docs[0].StorageStats.Count), docs[0].StorageStats.Size, nil
+}
+
+// listMemtables returns the info docs of the memtables matching the given
+// filter, sorted by creation time in the given direction (1 or -1).
+func listMemtables(ctx context.Context, db *mongo.Database, filter bson.M, dir int) ([]memtableInfo, error) {
+	cur, err := db.Collection(memtablesCollectionName).Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "created", Value: dir}}))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var memtables []memtableInfo
+	if err := cur.All(ctx, &memtables); err != nil {
+		return nil, fmt.Errorf("cur.All: %w", err)
+	}
+
+	return memtables, nil
 }
 
 func (mt *Memtable) Drop(ctx context.Context, name string) error {
+	err := mt.faults.Check(ctx, faultinject.MemtableDrop)
+	if err != nil {
+		return err
+	}
+
 	db, err := mt.GetMongo(ctx)
 	if err != nil {
 		return fmt.Errorf("GetMongo: %w", err)
@@ -306,3 +1166,33 @@ func (mt *Memtable) Drop(ctx context.Context, name string) error {
 
 	return nil
 }
+
+// Destroy drops every memtable, including any unflushed records, along with the
+// collections which track them.
+func (mt *Memtable) Destroy(ctx context.Context) error {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, 1)
+	if err != nil {
+		return fmt.Errorf("listMemtables: %w", err)
+	}
+
+	for _, info := range memtables {
+		err = mt.Drop(ctx, info.ID)
+		if err != nil {
+			return fmt.Errorf("Drop(%s): %w", info.ID, err)
+		}
+	}
+
+	for _, name := range []string{memtablesCollectionName, metaCollectionName} {
+		err = db.Collection(name).Drop(ctx)
+		if err != nil {
+			return fmt.Errorf("Drop(%s): %w", name, err)
+		}
+	}
+
+	return nil
+}
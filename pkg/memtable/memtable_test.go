@@ -2,12 +2,14 @@ package memtable
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/testdeps"
 	"github.com/adammck/blobby/pkg/types"
 	"github.com/jonboulle/clockwork"
@@ -20,7 +22,7 @@ func TestSwap(t *testing.T) {
 	ctx := context.Background()
 	env := testdeps.New(ctx, t, testdeps.WithMongo())
 	c := clockwork.NewFakeClock()
-	mt := New(env.MongoURL(), c)
+	mt := New(env.MongoURL(), "blobby", c)
 
 	err := mt.Init(ctx)
 	require.NoError(t, err)
@@ -84,11 +86,375 @@ func TestSwap(t *testing.T) {
 	require.Equal(t, mtn2, src2)
 }
 
+func TestInitIdempotent(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClock()
+	mt := New(env.MongoURL(), "blobby", c)
+
+	ok, err := mt.Initialized(ctx)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = mt.Init(ctx)
+	require.NoError(t, err)
+	mtn1, err := getCurrentMemtableName(ctx, t, mt)
+	require.NoError(t, err)
+
+	// calling again doesn't replace the active memtable.
+	c.Advance(1 * time.Second)
+	err = mt.Init(ctx)
+	require.NoError(t, err)
+	mtn2, err := getCurrentMemtableName(ctx, t, mt)
+	require.NoError(t, err)
+	require.Equal(t, mtn1, mtn2)
+
+	ok, err = mt.Initialized(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestRotateWithoutFlushing(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClock()
+	mt := New(env.MongoURL(), "blobby", c)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	// Nothing is flushing yet
+	q, err := mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	// Write a version of the same key to each of several memtables, rotating
+	// after each one without ever flushing or dropping the previous one.
+	var prev []string
+	for i := 1; i <= 3; i++ {
+		c.Advance(1 * time.Second)
+		_, err = mt.Put(ctx, "k", []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+
+		c.Advance(1 * time.Second)
+		hOld, _, err := mt.Rotate(ctx)
+		require.NoError(t, err)
+		prev = append(prev, hOld.Name())
+	}
+
+	// All of the rotated memtables are queued, oldest first
+	q, err = mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	names := make([]string, len(q))
+	for i, h := range q {
+		names[i] = h.Name()
+	}
+	require.Equal(t, prev, names)
+
+	// The newest version is returned, from the newest flushing memtable
+	rec, src, err := mt.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), rec.Document)
+	require.Equal(t, prev[2], src)
+
+	// Dropping a memtable removes it from the queue
+	err = mt.Drop(ctx, prev[0])
+	require.NoError(t, err)
+	q, err = mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	require.Len(t, q, 2)
+	require.Equal(t, prev[1], q[0].Name())
+}
+
+func TestRotateFailure(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	fi := faultinject.New(c)
+	mt := New(env.MongoURL(), "blobby", c)
+	mt.SetFaults(fi)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+	hActive, err := mt.Active(ctx)
+	require.NoError(t, err)
+
+	_, err = mt.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+
+	// fail between swapping the pointer and marking the previous memtable as
+	// flushing. neither happens, so it's still the active one.
+	fi.Add(faultinject.Fault{Op: faultinject.MemtableSwap, Times: 1})
+	_, _, err = mt.Rotate(ctx)
+	require.ErrorIs(t, err, faultinject.ErrInjected)
+
+	h, err := mt.Active(ctx)
+	require.NoError(t, err)
+	require.Equal(t, hActive.Name(), h.Name())
+
+	q, err := mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	// and the new memtable was cleaned up.
+	stats, err := mt.Stats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.True(t, stats[0].Active)
+
+	// the next rotation works.
+	c.Advance(1 * time.Second)
+	hPrev, _, err := mt.Rotate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, hActive.Name(), hPrev.Name())
+	q, err = mt.FlushQueue(ctx)
+	require.NoError(t, err)
+	require.Len(t, q, 1)
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	mt := New(env.MongoURL(), "blobby", c)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	// Nothing to resume yet
+	h, err := mt.Resume(ctx)
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	_, err = mt.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	hOld, _, err := mt.Rotate(ctx)
+	require.NoError(t, err)
+
+	// A memtable which was just rotated belongs to whoever is flushing it
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	// Until they release it, e.g. because the flush failed
+	err = mt.Release(ctx, hOld.Name())
+	require.NoError(t, err)
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	require.Equal(t, hOld.Name(), h.Name())
+
+	// Which claims it again
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	// Or the claim times out, because they crashed
+	c.Advance(ClaimTimeout + time.Second)
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	require.Equal(t, hOld.Name(), h.Name())
+
+	// Or they stopped part-way
+	err = mt.MarkPartial(ctx, hOld.Name())
+	require.NoError(t, err)
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	require.Equal(t, hOld.Name(), h.Name())
+
+	// The record is still readable, from a memtable which isn't active
+	rec, src, flushing, err := mt.GetFlushing(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), rec.Document)
+	require.Equal(t, hOld.Name(), src)
+	require.True(t, flushing)
+
+	// Dropped memtables can't be resumed
+	err = mt.Drop(ctx, hOld.Name())
+	require.NoError(t, err)
+	c.Advance(ClaimTimeout + time.Second)
+	h, err = mt.Resume(ctx)
+	require.NoError(t, err)
+	require.Nil(t, h)
+}
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	mt := New(env.MongoURL(), "blobby", c)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	h, err := mt.Active(ctx)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(h.URL(), "mongodb://"), h.URL())
+	require.True(t, strings.HasSuffix(h.URL(), "/blobby/"+h.Name()), h.URL())
+	require.NotContains(t, h.URL(), "?")
+
+	size, err := h.SizeBytes(ctx)
+	require.NoError(t, err)
+	require.Zero(t, size)
+
+	// several versions of some keys, so that they span batches, and one
+	// record which has expired.
+	for _, k := range []string{"a", "b", "b", "b", "c", "d", "d"} {
+		_, err = mt.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		c.Advance(1 * time.Second)
+	}
+	_, err = mt.PutRecord(ctx, &types.Record{Key: "e", Document: []byte("e"), Expires: c.Now()})
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+
+	n, err := h.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+
+	size, err = h.SizeBytes(ctx)
+	require.NoError(t, err)
+	require.Positive(t, size)
+
+	// every batch size sends the same records in the same order as FlushSorted.
+	ch := make(chan *types.Record)
+	go func() {
+		require.NoError(t, h.FlushSorted(ctx, ch, c.Now()))
+	}()
+	var want []*types.Record
+	for rec := range ch {
+		want = append(want, rec)
+	}
+	require.Len(t, want, 7)
+
+	for size, batches := range map[int]int{1: 7, 2: 4, 3: 3, 7: 1, 100: 1} {
+		ch := make(chan *types.Record)
+		statsc := make(chan *StreamStats, 1)
+		go func() {
+			stats, err := h.FlushBatches(ctx, ch, c.Now(), StreamOptions{BatchSize: size})
+			require.NoError(t, err)
+			statsc <- stats
+		}()
+		var got []*types.Record
+		for rec := range ch {
+			got = append(got, rec)
+		}
+		require.Equal(t, want, got, "size=%d", size)
+		require.Equal(t, &StreamStats{Batches: batches, Records: 7}, <-statsc, "size=%d", size)
+	}
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	fi := faultinject.New(c)
+	mt := New(env.MongoURL(), "blobby", c)
+	mt.SetFaults(fi)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = mt.Put(ctx, fmt.Sprintf("k%d", i), []byte("v"))
+		require.NoError(t, err)
+		c.Advance(1 * time.Second)
+	}
+
+	h, err := mt.Active(ctx)
+	require.NoError(t, err)
+
+	// the second batch fails to read once, and is retried.
+	fi.Add(faultinject.Fault{Op: faultinject.MemtableRead, After: 1, Times: 1})
+
+	ch := make(chan *Batch)
+	var keys []string
+	go func() {
+		for b := range ch {
+			for _, rec := range b.Records {
+				keys = append(keys, rec.Key)
+			}
+			b.Ack(nil)
+		}
+	}()
+	stats, err := h.Stream(ctx, ch, c.Now(), StreamOptions{BatchSize: 2, Retries: 1})
+	require.NoError(t, err)
+	require.Equal(t, &StreamStats{Batches: 3, Records: 5, Retries: 1}, stats)
+	require.Equal(t, []string{"k0", "k1", "k2", "k3", "k4"}, keys)
+
+	// without retries, the stream fails.
+	fi.Reset()
+	fi.Add(faultinject.Fault{Op: faultinject.MemtableRead, After: 1, Times: 1})
+	ch = make(chan *Batch)
+	go func() {
+		for b := range ch {
+			b.Ack(nil)
+		}
+	}()
+	stats, err = h.Stream(ctx, ch, c.Now(), StreamOptions{BatchSize: 2})
+	require.ErrorIs(t, err, faultinject.ErrInjected)
+	require.Equal(t, 1, stats.Batches)
+
+	// and so does a batch which isn't acknowledged, without reading the rest.
+	fi.Reset()
+	errNope := errors.New("nope")
+	ch = make(chan *Batch)
+	go func() {
+		for b := range ch {
+			b.Ack(errNope)
+		}
+	}()
+	stats, err = h.Stream(ctx, ch, c.Now(), StreamOptions{BatchSize: 2})
+	require.ErrorIs(t, err, errNope)
+	require.Equal(t, 0, stats.Batches)
+	require.Equal(t, 1, fi.Calls(faultinject.MemtableRead))
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	mt := New(env.MongoURL(), "blobby", c)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	t1 := c.Now()
+	_, err = mt.Put(ctx, "a", []byte("aaaa"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	_, err = mt.Put(ctx, "b", []byte("bbbb"))
+	require.NoError(t, err)
+
+	c.Advance(1 * time.Second)
+	hOld, hNew, err := mt.Rotate(ctx)
+	require.NoError(t, err)
+
+	stats, err := mt.Stats(ctx)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	require.Equal(t, hOld.Name(), stats[0].Name)
+	require.False(t, stats[0].Active)
+	require.Equal(t, 2, stats[0].Records)
+	require.Positive(t, stats[0].Bytes)
+	require.True(t, t1.Equal(stats[0].Oldest))
+
+	require.Equal(t, hNew.Name(), stats[1].Name)
+	require.True(t, stats[1].Active)
+	require.Equal(t, 0, stats[1].Records)
+	require.Zero(t, stats[1].Oldest)
+}
+
 func TestPut(t *testing.T) {
 	ctx := context.Background()
 	env := testdeps.New(ctx, t, testdeps.WithMongo())
 	c := clockwork.NewFakeClock()
-	mt := New(env.MongoURL(), c)
+	mt := New(env.MongoURL(), "blobby", c)
 
 	err := mt.Init(ctx)
 	require.NoError(t, err)
@@ -117,7 +483,7 @@ func TestPutConcurrent(t *testing.T) {
 	ctx := context.Background()
 	env := testdeps.New(ctx, t, testdeps.WithMongo())
 	c := clockwork.NewFakeClock()
-	mt := New(env.MongoURL(), c)
+	mt := New(env.MongoURL(), "blobby", c)
 
 	err := mt.Init(ctx)
 	require.NoError(t, err)
@@ -207,3 +573,140 @@ func getRecords(ctx context.Context, t *testing.T, mt *Memtable, coll string, ke
 
 	return recs
 }
+
+func TestPutIdempotent(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClock()
+	mt := New(env.MongoURL(), "blobby", c)
+	require.NoError(t, mt.Init(ctx))
+
+	dest1, err := mt.PutRecord(ctx, &types.Record{Key: "k", Document: []byte("v1"), IdempotencyKey: "req1"})
+	require.NoError(t, err)
+
+	// retry, after the memtable was rotated.
+	c.Advance(1 * time.Second)
+	_, _, err = mt.Rotate(ctx)
+	require.NoError(t, err)
+	dest2, err := mt.PutRecord(ctx, &types.Record{Key: "k", Document: []byte("v1"), IdempotencyKey: "req1"})
+	require.NoError(t, err)
+	require.Equal(t, dest1, dest2)
+
+	// same idempotency key, different key.
+	dest3, err := mt.PutRecord(ctx, &types.Record{Key: "k2", Document: []byte("v1"), IdempotencyKey: "req1"})
+	require.NoError(t, err)
+	require.NotEqual(t, dest1, dest3)
+
+	h, err := mt.Active(ctx)
+	require.NoError(t, err)
+	n, err := h.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestPutBatch(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClock()
+	mt := New(env.MongoURL(), "blobby", c)
+	require.NoError(t, mt.Init(ctx))
+
+	t0 := c.Now().Add(-time.Hour)
+	rec := func(key, value string, sec int) *types.Record {
+		return &types.Record{Key: key, Document: []byte(value), Timestamp: t0.Add(time.Duration(sec) * time.Second)}
+	}
+
+	_, err := mt.PutBatch(ctx, []*types.Record{rec("a", "v1", 1), rec("a", "v2", 2), rec("b", "v1", 1)})
+	require.NoError(t, err)
+
+	// replays are skipped, even if they're older than the newest version.
+	_, err = mt.PutBatch(ctx, []*types.Record{rec("a", "v1", 1), rec("c", "v1", 1)})
+	require.NoError(t, err)
+
+	got, _, err := mt.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), got.Document)
+
+	// a record with the same key and timestamp as an existing one, but not
+	// the same value, isn't a replay. the rest of the batch is still written.
+	_, err = mt.PutBatch(ctx, []*types.Record{rec("b", "other", 1), rec("d", "v1", 1)})
+	require.ErrorIs(t, err, ErrTimestampConflict)
+
+	var tc *TimestampConflict
+	require.True(t, errors.As(err, &tc))
+	require.Equal(t, "b", tc.Key)
+
+	got, _, err = mt.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), got.Document)
+
+	_, _, err = mt.Get(ctx, "d")
+	require.NoError(t, err)
+
+	// the same goes for two within one batch.
+	_, err = mt.PutBatch(ctx, []*types.Record{rec("e", "v1", 1), rec("e", "v2", 1)})
+	require.ErrorIs(t, err, ErrTimestampConflict)
+
+	// records without timestamps are given the current time, so they're newer.
+	_, err = mt.PutBatch(ctx, []*types.Record{{Key: "a", Document: []byte("v3")}})
+	require.NoError(t, err)
+
+	got, _, err = mt.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), got.Document)
+	require.WithinDuration(t, c.Now(), got.Timestamp, time.Millisecond)
+
+	h, err := mt.Active(ctx)
+	require.NoError(t, err)
+	n, err := h.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+}
+
+func TestExpired(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+	mt := New(env.MongoURL(), "blobby", c)
+
+	err := mt.Init(ctx)
+	require.NoError(t, err)
+
+	_, err = mt.Put(ctx, "k", []byte("v1"))
+	require.NoError(t, err)
+	c.Advance(1 * time.Second)
+	_, err = mt.PutRecord(ctx, &types.Record{Key: "k", Document: []byte("v2"), Expires: c.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	_, err = mt.PutRecord(ctx, &types.Record{Key: "e", Document: []byte("e"), Expires: c.Now().Add(time.Minute)})
+	require.NoError(t, err)
+
+	rec, _, err := mt.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), rec.Document)
+
+	// once they've expired, the records are skipped, even though Mongo hasn't
+	// deleted them yet. older versions which haven't expired are returned.
+	c.Advance(2 * time.Minute)
+	rec, _, err = mt.Get(ctx, "k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), rec.Document)
+	_, _, err = mt.Get(ctx, "e")
+	require.ErrorIs(t, err, &NotFound{})
+
+	names, err := mt.Names(ctx)
+	require.NoError(t, err)
+	it, err := mt.RangeIter(ctx, names, "", "")
+	require.NoError(t, err)
+	defer it.Close(ctx)
+
+	var got []string
+	for {
+		rec, err := it.Next(ctx)
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		got = append(got, rec.Key+"="+string(rec.Document))
+	}
+	require.Equal(t, []string{"k=v1"}, got)
+}
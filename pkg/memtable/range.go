@@ -0,0 +1,215 @@
+package memtable
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rangeBatchSize is the number of records which RangeIter fetches from each
+// memtable at once.
+const rangeBatchSize = 1000
+
+// Names returns the names of every memtable, active or flushing, newest first.
+func (mt *Memtable) Names(ctx context.Context) ([]string, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	memtables, err := listMemtables(ctx, db, bson.M{}, -1)
+	if err != nil {
+		return nil, fmt.Errorf("listMemtables: %w", err)
+	}
+
+	names := make([]string, len(memtables))
+	for i, m := range memtables {
+		names[i] = m.ID
+	}
+
+	return names, nil
+}
+
+// RangeIter reads the records in a range of keys from several memtables, in
+// batches, merged in order of key, then newest first.
+type RangeIter struct {
+	db *mongo.Database
+	h  cursorHeap
+
+	// memtables which were dropped before they were read to the end, to be
+	// returned by Next.
+	dropped []*Dropped
+}
+
+// RangeIter returns an iterator over the records with a key in [start, end)
+// from the given memtables, which should be newest first, like Names returns
+// them. If end is empty, the range is unbounded. The records are fetched as
+// they're read, rather than all at once, so memory use doesn't depend on the
+// size of the range. The iterator must be closed. Records which had expired when
+// it was created are skipped.
+//
+// A memtable can be flushed and dropped while it's being read, or before, since
+// the names can be stale. Next returns a Dropped error when that happens, and
+// then carries on reading the others.
+func (mt *Memtable) RangeIter(ctx context.Context, names []string, start, end string) (*RangeIter, error) {
+	db, err := mt.GetMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetMongo: %w", err)
+	}
+
+	keys := bson.M{"$gte": start}
+	if end != "" {
+		keys["$lt"] = end
+	}
+
+	filter := notExpired(mt.clock.Now())
+	filter["key"] = keys
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "key", Value: 1}, {Key: "ts", Value: -1}}).
+		SetBatchSize(rangeBatchSize)
+
+	it := &RangeIter{db: db}
+	for i, name := range names {
+		cur, err := db.Collection(name).Find(ctx, filter, opts)
+		if err != nil {
+			it.Close(ctx)
+			return nil, fmt.Errorf("Find(%s): %w", name, err)
+		}
+
+		err = it.advance(ctx, &rangeCursor{name: name, cur: cur, order: i}, start)
+		if err != nil {
+			it.Close(ctx)
+			return nil, err
+		}
+	}
+
+	// reading a collection which doesn't exist isn't an error, so memtables
+	// which were dropped before they were opened look empty.
+	exist, err := db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$in": names}})
+	if err != nil {
+		it.Close(ctx)
+		return nil, fmt.Errorf("ListCollectionNames: %w", err)
+	}
+
+	for _, name := range names {
+		if !slices.Contains(exist, name) {
+			it.dropped = append(it.dropped, &Dropped{Name: name, Key: start})
+		}
+	}
+
+	return it, nil
+}
+
+// Next returns the next record, or nil if there are no more. If one of the
+// memtables was dropped, a Dropped error is returned instead, once, and the
+// iterator can still be used.
+func (it *RangeIter) Next(ctx context.Context) (*types.Record, error) {
+	if len(it.dropped) > 0 {
+		d := it.dropped[0]
+		it.dropped = it.dropped[1:]
+		return nil, d
+	}
+
+	if it.h.Len() == 0 {
+		return nil, nil
+	}
+
+	c := heap.Pop(&it.h).(*rangeCursor)
+	rec := c.rec
+
+	err := it.advance(ctx, c, rec.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// advance reads the next record from the given cursor, and pushes it onto the
+// heap, unless there are no more. Key is the last key which was read from it.
+func (it *RangeIter) advance(ctx context.Context, c *rangeCursor, key string) error {
+	if c.cur.Next(ctx) {
+		c.rec = &types.Record{}
+		err := c.cur.Decode(c.rec)
+		if err != nil {
+			return fmt.Errorf("Decode(%s): %w", c.name, err)
+		}
+
+		heap.Push(&it.h, c)
+		return nil
+	}
+
+	err := c.cur.Err()
+	c.cur.Close(ctx)
+	if err == nil {
+		return nil
+	}
+
+	// dropping a collection kills the cursors which are reading it.
+	names, lerr := it.db.ListCollectionNames(ctx, bson.M{"name": c.name})
+	if lerr == nil && len(names) == 0 {
+		it.dropped = append(it.dropped, &Dropped{Name: c.name, Key: key})
+		return nil
+	}
+
+	return fmt.Errorf("cursor(%s): %w", c.name, err)
+}
+
+// Close closes the cursors which haven't been read to the end.
+func (it *RangeIter) Close(ctx context.Context) {
+	for _, c := range it.h {
+		c.cur.Close(ctx)
+	}
+	it.h = nil
+}
+
+type rangeCursor struct {
+	name string
+	cur  *mongo.Cursor
+	rec  *types.Record
+
+	// the index of the memtable, so that newer memtables win ties.
+	order int
+}
+
+// cursorHeap is a min-heap of cursors by the key of their next record, then
+// newest first.
+type cursorHeap []*rangeCursor
+
+func (h cursorHeap) Len() int {
+	return len(h)
+}
+
+func (h cursorHeap) Less(i, j int) bool {
+	a, b := h[i].rec, h[j].rec
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return h[i].order < h[j].order
+}
+
+func (h cursorHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *cursorHeap) Push(x any) {
+	*h = append(*h, x.(*rangeCursor))
+}
+
+func (h *cursorHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
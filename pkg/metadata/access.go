@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const accessCollectionName = "access"
+
+// Access is how recently, and roughly how often, an sstable has been read.
+type Access struct {
+	// LastRead is the last time which a read of the sstable was recorded.
+	LastRead time.Time `bson:"last_read"`
+
+	// Reads is the estimated number of reads, which is approximate because
+	// only a sample of them are recorded.
+	Reads float64 `bson:"reads"`
+}
+
+// RecordAccess merges the given accesses, keyed by the filename of the sstable,
+// into those already recorded: the last read times are the later of the two,
+// and the read counts are added together.
+func (s *Store) RecordAccess(ctx context.Context, accesses map[string]Access) error {
+	if len(accesses) == 0 {
+		return nil
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	models := make([]mongo.WriteModel, 0, len(accesses))
+	for fn, a := range accesses {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": fn}).
+			SetUpdate(bson.M{
+				"$max": bson.M{"last_read": a.LastRead},
+				"$inc": bson.M{"reads": a.Reads},
+			}).
+			SetUpsert(true))
+	}
+
+	_, err = db.Collection(accessCollectionName).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("BulkWrite: %w", err)
+	}
+
+	return nil
+}
+
+// GetAccess returns the recorded accesses of every sstable which has any, keyed
+// by filename. Sstables which have been purged might be included.
+func (s *Store) GetAccess(ctx context.Context) (map[string]Access, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	cur, err := db.Collection(accessCollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+
+	var docs []struct {
+		Filename string `bson:"_id"`
+		Access   `bson:",inline"`
+	}
+	err = cur.All(ctx, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	out := make(map[string]Access, len(docs))
+	for _, d := range docs {
+		out[d.Filename] = d.Access
+	}
+
+	return out, nil
+}
+
+// DeleteAccess forgets the accesses of the given sstables, e.g. once they've
+// been purged.
+func (s *Store) DeleteAccess(ctx context.Context, filenames []string) error {
+	if len(filenames) == 0 {
+		return nil
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(accessCollectionName).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": filenames}})
+	if err != nil {
+		return fmt.Errorf("DeleteMany: %w", err)
+	}
+
+	return nil
+}
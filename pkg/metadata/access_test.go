@@ -0,0 +1,35 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAccess(t *testing.T) {
+	ctx, store := setup(t)
+	t0 := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, store.RecordAccess(ctx, map[string]Access{
+		"a.sstable": {LastRead: t0.Add(time.Hour), Reads: 10},
+		"b.sstable": {LastRead: t0, Reads: 1},
+	}))
+
+	// merged with what's there.
+	require.NoError(t, store.RecordAccess(ctx, map[string]Access{
+		"a.sstable": {LastRead: t0, Reads: 5},
+	}))
+
+	got, err := store.GetAccess(ctx)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.True(t, t0.Add(time.Hour).Equal(got["a.sstable"].LastRead))
+	assert.Equal(t, 15.0, got["a.sstable"].Reads)
+
+	require.NoError(t, store.DeleteAccess(ctx, []string{"a.sstable"}))
+	got, err = store.GetAccess(ctx)
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+}
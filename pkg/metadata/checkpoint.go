@@ -0,0 +1,321 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	checkpointsCollectionName = "checkpoints"
+
+	// The sstables in each checkpoint are stored as separate documents, rather
+	// than an array in the checkpoint, which would be limited to 16MB.
+	checkpointMembersCollectionName = "checkpoint_members"
+)
+
+// ErrCheckpointNotFound is returned when reading a checkpoint which doesn't
+// exist.
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// ErrCheckpointExists is returned when creating a checkpoint with a name which
+// has already been used. Checkpoints are immutable.
+var ErrCheckpointExists = errors.New("checkpoint already exists")
+
+// Checkpoint is a named, immutable copy of the set of sstables which were live
+// at some point in time. The sstables it references are not deleted when they
+// are compacted, so the archive can be read or restored as of the checkpoint.
+type Checkpoint struct {
+	Name    string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+
+	// Metas is read from the members collection, ordered by MinKey.
+	Metas []*sstable.Meta `bson:"-"`
+}
+
+// checkpointMember is a document in the members collection: an sstable which
+// was live when a checkpoint was created. SSTable is the _id of its document in
+// the sstables collection, which Restore un-deletes (or reinserts, if it was
+// purged since) so an sstable is never in the live set twice.
+type checkpointMember struct {
+	Checkpoint   string             `bson:"checkpoint"`
+	SSTable      primitive.ObjectID `bson:"sstable"`
+	sstable.Meta `bson:",inline"`
+}
+
+// checkpointMemberIndexes support reading the members of a checkpoint, and
+// InCheckpoint.
+var checkpointMemberIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "checkpoint", Value: 1}, {Key: "sstable", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	},
+	{
+		Keys: bson.D{{Key: "created", Value: 1}, {Key: "min_key", Value: 1}, {Key: "max_key", Value: 1}},
+	},
+}
+
+func (s *Store) initCheckpoints(ctx context.Context, db *mongo.Database) error {
+	err := createCollection(ctx, db, checkpointsCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection: %w", err)
+	}
+
+	// the members collection and its indexes are created by the migrations,
+	// so existing archives get them too.
+
+	return nil
+}
+
+// CreateCheckpoint records the current set of sstables under the given name.
+func (s *Store) CreateCheckpoint(ctx context.Context, name string, created time.Time) (*Checkpoint, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return nil, fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	cp := &Checkpoint{
+		Name:    name,
+		Created: created,
+	}
+
+	// the live set is read in the same transaction as the members are written,
+	// so the checkpoint is a consistent snapshot of it.
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		_, err := db.Collection(checkpointsCollectionName).InsertOne(sc, cp)
+		if err != nil {
+			return nil, err
+		}
+
+		cur, err := db.Collection(collectionName).Find(sc, live(bson.M{}), options.Find().SetSort(bson.D{
+			{Key: "min_key", Value: 1},
+			{Key: "_id", Value: 1},
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("Find: %w", err)
+		}
+		defer cur.Close(sc)
+
+		var docs []*listedMeta
+		if err := cur.All(sc, &docs); err != nil {
+			return nil, fmt.Errorf("cursor.All: %w", err)
+		}
+
+		cp.Metas = make([]*sstable.Meta, len(docs))
+		members := make([]interface{}, len(docs))
+		for i, d := range docs {
+			cp.Metas[i] = &d.Meta
+			members[i] = &checkpointMember{Checkpoint: name, SSTable: d.ID, Meta: d.Meta}
+		}
+
+		if len(members) == 0 {
+			return nil, nil
+		}
+
+		_, err = db.Collection(checkpointMembersCollectionName).InsertMany(sc, members)
+		if err != nil {
+			return nil, fmt.Errorf("InsertMany: %w", err)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("%w: %s", ErrCheckpointExists, name)
+		}
+		return nil, fmt.Errorf("WithTransaction: %w", err)
+	}
+
+	return cp, nil
+}
+
+// GetCheckpoint returns the checkpoint with the given name.
+func (s *Store) GetCheckpoint(ctx context.Context, name string) (*Checkpoint, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var cp Checkpoint
+	err = db.Collection(checkpointsCollectionName).FindOne(ctx, bson.M{"_id": name}).Decode(&cp)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: %s", ErrCheckpointNotFound, name)
+		}
+		return nil, fmt.Errorf("FindOne: %w", err)
+	}
+
+	err = readMembers(ctx, db, []*Checkpoint{&cp})
+	if err != nil {
+		return nil, fmt.Errorf("readMembers: %w", err)
+	}
+
+	return &cp, nil
+}
+
+// readMembers sets the Metas of each of the given checkpoints.
+func readMembers(ctx context.Context, db *mongo.Database, cps []*Checkpoint) error {
+	if len(cps) == 0 {
+		return nil
+	}
+
+	byName := make(map[string]*Checkpoint, len(cps))
+	names := make([]string, len(cps))
+	for i, cp := range cps {
+		byName[cp.Name] = cp
+		names[i] = cp.Name
+	}
+
+	cur, err := db.Collection(checkpointMembersCollectionName).Find(ctx, bson.M{"checkpoint": bson.M{"$in": names}}, options.Find().SetSort(bson.D{
+		{Key: "min_key", Value: 1},
+	}))
+	if err != nil {
+		return fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var m checkpointMember
+		err = cur.Decode(&m)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		cp := byName[m.Checkpoint]
+		cp.Metas = append(cp.Metas, &m.Meta)
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("cursor: %w", err)
+	}
+
+	return nil
+}
+
+// InCheckpoint returns true if the given sstable is referenced by any
+// checkpoint, in which case its blob must not be deleted.
+func (s *Store) InCheckpoint(ctx context.Context, meta *sstable.Meta) (bool, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getMongo: %w", err)
+	}
+
+	n, err := db.Collection(checkpointMembersCollectionName).CountDocuments(ctx, bson.M{
+		"created": meta.Created,
+		"min_key": meta.MinKey,
+		"max_key": meta.MaxKey,
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return n > 0, nil
+}
+
+// Restore atomically replaces the set of live sstables with those in the given
+// checkpoint. The live sstables which aren't in the checkpoint are soft-deleted
+// at the given time, and those which are, but were deleted since, are returned
+// to the live set: un-deleted if their metadata is still there, or reinserted
+// if it was purged. Those which are in both are left alone.
+func (s *Store) Restore(ctx context.Context, cp *Checkpoint, at time.Time) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		coll := db.Collection(collectionName)
+
+		cur, err := db.Collection(checkpointMembersCollectionName).Find(sc, bson.M{"checkpoint": cp.Name})
+		if err != nil {
+			return nil, fmt.Errorf("Find: %w", err)
+		}
+		defer cur.Close(sc)
+
+		var members []*checkpointMember
+		if err := cur.All(sc, &members); err != nil {
+			return nil, fmt.Errorf("cursor.All: %w", err)
+		}
+
+		ids := make([]primitive.ObjectID, len(members))
+		for i, m := range members {
+			ids[i] = m.SSTable
+		}
+
+		_, err = coll.UpdateMany(sc, live(bson.M{"_id": bson.M{"$nin": ids}}), bson.M{"$set": bson.M{"deleted_at": at}})
+		if err != nil {
+			return nil, fmt.Errorf("UpdateMany: %w", err)
+		}
+
+		var restored []*sstable.Meta
+		for _, m := range members {
+			res, err := coll.UpdateOne(sc, bson.M{"_id": m.SSTable}, bson.M{
+				"$unset":       bson.M{"deleted_at": ""},
+				"$setOnInsert": windowedDocs([]*sstable.Meta{&m.Meta})[0],
+			}, options.Update().SetUpsert(true))
+			if err != nil {
+				return nil, fmt.Errorf("UpdateOne(%s): %w", m.Filename(), err)
+			}
+
+			if res.ModifiedCount > 0 || res.UpsertedCount > 0 {
+				restored = append(restored, &m.Meta)
+			}
+		}
+
+		err = widenWindows(sc, db, restored)
+		if err != nil {
+			return nil, fmt.Errorf("widenWindows: %w", err)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("WithTransaction: %w", err)
+	}
+
+	return nil
+}
+
+// ListCheckpoints returns every checkpoint, oldest first.
+func (s *Store) ListCheckpoints(ctx context.Context) ([]*Checkpoint, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	cur, err := db.Collection(checkpointsCollectionName).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var cps []*Checkpoint
+	if err := cur.All(ctx, &cps); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	err = readMembers(ctx, db, cps)
+	if err != nil {
+		return nil, fmt.Errorf("readMembers: %w", err)
+	}
+
+	return cps, nil
+}
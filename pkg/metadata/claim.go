@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrClaimed is returned by Claim when some of the sstables are already claimed
+// by someone else.
+var ErrClaimed = errors.New("sstable already claimed")
+
+// Claim marks the given live sstables as claimed by owner until the given time,
+// so that concurrent compactions (in this or any other process) don't pick the
+// same inputs. Either all of them are claimed, or (if any are already claimed
+// by someone else, or aren't live) none are, and ErrClaimed is returned. Claims
+// which have expired are ignored, so a crashed owner doesn't block anyone for
+// long.
+func (s *Store) Claim(ctx context.Context, metas []*sstable.Meta, owner string, now, until time.Time) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	coll := db.Collection(collectionName)
+	for i, m := range metas {
+		filter := live(bson.M{
+			"created": m.Created,
+			"min_key": m.MinKey,
+			"max_key": m.MaxKey,
+			"$or": bson.A{
+				bson.M{"claimed_by": bson.M{"$exists": false}},
+				bson.M{"claimed_by": owner},
+				bson.M{"claimed_until": bson.M{"$lt": now}},
+			},
+		})
+
+		res, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+			"claimed_by":    owner,
+			"claimed_until": until,
+		}})
+		if err == nil && res.MatchedCount == 1 {
+			continue
+		}
+
+		// undo the claims we already made. if this fails, they'll expire.
+		rerr := s.Release(ctx, metas[:i], owner)
+		if err != nil {
+			return fmt.Errorf("UpdateOne: %w", errors.Join(err, rerr))
+		}
+
+		return fmt.Errorf("%w: %s", ErrClaimed, m.Filename())
+	}
+
+	return nil
+}
+
+// Release removes the claims on the given sstables made by owner. Sstables which
+// are claimed by someone else are left alone.
+func (s *Store) Release(ctx context.Context, metas []*sstable.Meta, owner string) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	for _, m := range metas {
+		_, err = db.Collection(collectionName).UpdateOne(ctx, bson.M{
+			"created":    m.Created,
+			"min_key":    m.MinKey,
+			"max_key":    m.MaxKey,
+			"claimed_by": owner,
+		}, bson.M{"$unset": bson.M{"claimed_by": "", "claimed_until": ""}})
+		if err != nil {
+			return fmt.Errorf("UpdateOne: %w", err)
+		}
+	}
+
+	return nil
+}
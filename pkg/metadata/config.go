@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metaConfigID = "runtime_config"
+
+// RuntimeConfig is the settings which can be changed while the archive is in
+// use, without restarting the processes using it. Zero fields leave the setting
+// which each process was started with.
+type RuntimeConfig struct {
+	// Defaults for the corresponding fields of CompactionOptions, used when
+	// Compact is called without them.
+	CompactionMinFiles     int `bson:"compaction_min_files,omitempty"`
+	CompactionMaxFiles     int `bson:"compaction_max_files,omitempty"`
+	CompactionMinInputSize int `bson:"compaction_min_input_size,omitempty"`
+	CompactionMaxInputSize int `bson:"compaction_max_input_size,omitempty"`
+
+	// The number of sstable indexes kept in memory, and the size in bytes of
+	// the blob cache, if the process has one.
+	IndexCacheSize int   `bson:"index_cache_size,omitempty"`
+	BlobCacheBytes int64 `bson:"blob_cache_bytes,omitempty"`
+
+	// The most sstables which each Get will fetch.
+	MaxGetFetches int `bson:"max_get_fetches,omitempty"`
+
+	// Replace the rates of the quotas (see blobby.WithQuota) with the same
+	// prefixes. Quotas can't be added or removed.
+	QuotaRates []QuotaRate `bson:"quota_rates,omitempty"`
+}
+
+// QuotaRate is the rate limits of the quota with the given prefix. Unlike the
+// other fields of RuntimeConfig, zero rates mean unlimited.
+type QuotaRate struct {
+	Prefix        string  `bson:"prefix"`
+	PutsPerSecond float64 `bson:"puts_per_second,omitempty"`
+	GetsPerSecond float64 `bson:"gets_per_second,omitempty"`
+}
+
+// GetRuntimeConfig returns the runtime config, which is empty if it was never
+// set.
+func (s *Store) GetRuntimeConfig(ctx context.Context) (*RuntimeConfig, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value RuntimeConfig `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaConfigID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return &RuntimeConfig{}, nil
+		}
+		return nil, fmt.Errorf("FindOne: %w", err)
+	}
+
+	return &doc.Value, nil
+}
+
+// SetRuntimeConfig replaces the runtime config.
+func (s *Store) SetRuntimeConfig(ctx context.Context, cfg *RuntimeConfig) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaConfigID},
+		bson.M{"$set": bson.M{"value": cfg}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// WatchRuntimeConfig calls onChange with the runtime config, and then again
+// every time that any process changes it, until the context is cancelled or the
+// change stream fails.
+func (s *Store) WatchRuntimeConfig(ctx context.Context, onChange func(*RuntimeConfig)) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	// open the stream before reading the config, so changes in between aren't
+	// missed. see Watcher.Run.
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"documentKey._id": metaConfigID}}},
+	}
+
+	cs, err := db.Collection(metaCollectionName).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+	defer cs.Close(ctx)
+
+	cfg, err := s.GetRuntimeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	onChange(cfg)
+
+	for cs.Next(ctx) {
+		var ce struct {
+			After *struct {
+				Value RuntimeConfig `bson:"value"`
+			} `bson:"fullDocument"`
+		}
+
+		err = cs.Decode(&ce)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		// the document was deleted, or was deleted again before the lookup.
+		if ce.After == nil {
+			onChange(&RuntimeConfig{})
+			continue
+		}
+
+		onChange(&ce.After.Value)
+	}
+
+	return cs.Err()
+}
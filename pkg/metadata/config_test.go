@@ -0,0 +1,27 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeConfig(t *testing.T) {
+	ctx, store := setup(t)
+
+	cfg, err := store.GetRuntimeConfig(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &RuntimeConfig{}, cfg)
+
+	want := &RuntimeConfig{
+		CompactionMinFiles: 4,
+		BlobCacheBytes:     1 << 30,
+		QuotaRates:         []QuotaRate{{Prefix: "a/", PutsPerSecond: 10}},
+	}
+	require.NoError(t, store.SetRuntimeConfig(ctx, want))
+
+	cfg, err = store.GetRuntimeConfig(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, cfg)
+}
@@ -0,0 +1,120 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metaFeaturesID = "features"
+
+// Feature is the name of an optional format feature, like a compression codec
+// or a new index version, which changes how sstables are written. Once enabled
+// for an archive, every process reading or writing it must support it.
+type Feature string
+
+// ErrUnsupportedFeature is returned when an archive has enabled a feature which
+// this version of the package doesn't support. It's not safe to read or write
+// the archive until this process is upgraded.
+var ErrUnsupportedFeature = errors.New("unsupported feature")
+
+// supportedFeatures is the set of features which this version of the package
+// can read and write. Features are added here before they're enabled anywhere,
+// so a fleet can be upgraded in two steps: deploy, then enable.
+var supportedFeatures = map[Feature]bool{
+	FeatureBlocks: true,
+}
+
+// FeatureBlocks writes new sstables in sstable.FormatBlocks, which older
+// versions of this package can't read.
+const FeatureBlocks Feature = "blocks"
+
+// Features returns the set of features enabled for the archive, sorted by name.
+func (s *Store) Features(ctx context.Context) ([]Feature, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value []Feature `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaFeaturesID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("FindOne: %w", err)
+	}
+
+	sort.Slice(doc.Value, func(i, j int) bool {
+		return doc.Value[i] < doc.Value[j]
+	})
+
+	return doc.Value, nil
+}
+
+// CheckFeatures returns ErrUnsupportedFeature if the archive has enabled any
+// features which aren't supported by this version of the package.
+func (s *Store) CheckFeatures(ctx context.Context) error {
+	fs, err := s.Features(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fs {
+		if !supportedFeatures[f] {
+			return fmt.Errorf("%w: %s", ErrUnsupportedFeature, f)
+		}
+	}
+
+	return nil
+}
+
+// HasFeature returns true if the given feature is enabled for the archive.
+func (s *Store) HasFeature(ctx context.Context, f Feature) (bool, error) {
+	fs, err := s.Features(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ff := range fs {
+		if ff == f {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// EnableFeature enables the given feature for the archive. This can't be
+// undone, so should only be done once every process which might read or write
+// the archive has been upgraded to a version which supports it.
+func (s *Store) EnableFeature(ctx context.Context, f Feature) error {
+	if !supportedFeatures[f] {
+		return fmt.Errorf("%w: %s", ErrUnsupportedFeature, f)
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaFeaturesID},
+		bson.M{"$addToSet": bson.M{"value": f}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
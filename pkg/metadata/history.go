@@ -0,0 +1,145 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const historyCollectionName = "compaction_history"
+
+// CompactionRecord is the permanent record of a single compaction, which is
+// kept after its inputs are purged, so the lineage of any sstable can be traced
+// back to the flushes which produced its data.
+type CompactionRecord struct {
+	Started  time.Time `bson:"started"`
+	Finished time.Time `bson:"finished"`
+
+	// Operator is the caller which ran the compaction (see blobby.WithCaller),
+	// or empty if it was run automatically.
+	Operator string `bson:"operator,omitempty"`
+
+	// Reason describes why the inputs were chosen, e.g. the policy which
+	// selected them, or that the compaction was recovered.
+	Reason string `bson:"reason,omitempty"`
+
+	// The filenames of the sstables which were replaced, and replaced them.
+	Inputs  []string `bson:"inputs"`
+	Outputs []string `bson:"outputs,omitempty"`
+
+	InputBytes    int `bson:"input_bytes"`
+	OutputBytes   int `bson:"output_bytes"`
+	InputRecords  int `bson:"input_records"`
+	OutputRecords int `bson:"output_records"`
+
+	// The number of records which were expired by the retention config.
+	Dropped int `bson:"dropped"`
+
+	// The error returned by the compaction, if it failed.
+	Error string `bson:"error,omitempty"`
+}
+
+// Duration returns how long the compaction took.
+func (r *CompactionRecord) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+func (s *Store) initHistory(ctx context.Context, db *mongo.Database) error {
+	err := createCollection(ctx, db, historyCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection: %w", err)
+	}
+
+	_, err = db.Collection(historyCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "started", Value: -1}}},
+		{Keys: bson.D{{Key: "inputs", Value: 1}}},
+		{Keys: bson.D{{Key: "outputs", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("CreateIndexes: %w", err)
+	}
+
+	return nil
+}
+
+// RecordCompaction appends the given record to the compaction history.
+func (s *Store) RecordCompaction(ctx context.Context, r *CompactionRecord) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(historyCollectionName).InsertOne(ctx, r)
+	if err != nil {
+		return fmt.Errorf("InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// HistoryFilter selects records from the compaction history. Zero fields match
+// everything.
+type HistoryFilter struct {
+	// Filename matches compactions which read or wrote the given sstable.
+	Filename string
+
+	// Output matches compactions which wrote the given sstable. There should
+	// only ever be one.
+	Output string
+
+	Since time.Time
+	Until time.Time
+
+	// Limit specifies the maximum number of records to return. Zero means no
+	// limit.
+	Limit int
+}
+
+// GetCompactionHistory returns the records matching the given filter, newest
+// first.
+func (s *Store) GetCompactionHistory(ctx context.Context, f HistoryFilter) ([]*CompactionRecord, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	q := bson.M{}
+	if f.Filename != "" {
+		q["$or"] = bson.A{bson.M{"inputs": f.Filename}, bson.M{"outputs": f.Filename}}
+	}
+	if f.Output != "" {
+		q["outputs"] = f.Output
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := bson.M{}
+		if !f.Since.IsZero() {
+			t["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			t["$lt"] = f.Until
+		}
+		q["started"] = t
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "started", Value: -1}})
+	if f.Limit > 0 {
+		opts.SetLimit(int64(f.Limit))
+	}
+
+	cur, err := db.Collection(historyCollectionName).Find(ctx, q, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var rs []*CompactionRecord
+	if err := cur.All(ctx, &rs); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return rs, nil
+}
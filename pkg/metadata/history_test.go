@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionHistory(t *testing.T) {
+	ctx, store := setup(t)
+	t0 := time.Now().UTC().Truncate(time.Second)
+
+	r1 := &CompactionRecord{Started: t0, Finished: t0.Add(time.Second), Reason: "a", Inputs: []string{"1.sstable", "2.sstable"}, Outputs: []string{"3.sstable"}}
+	r2 := &CompactionRecord{Started: t0.Add(time.Minute), Finished: t0.Add(time.Minute), Operator: "adam", Inputs: []string{"3.sstable", "4.sstable"}, Outputs: []string{"5.sstable"}}
+	require.NoError(t, store.RecordCompaction(ctx, r1))
+	require.NoError(t, store.RecordCompaction(ctx, r2))
+
+	rs, err := store.GetCompactionHistory(ctx, HistoryFilter{})
+	require.NoError(t, err)
+	require.Len(t, rs, 2)
+	assert.Equal(t, r2.Inputs, rs[0].Inputs)
+	assert.Equal(t, "adam", rs[0].Operator)
+	assert.Equal(t, time.Second, rs[1].Duration())
+
+	// 3.sstable was written by one and read by the other.
+	rs, err = store.GetCompactionHistory(ctx, HistoryFilter{Filename: "3.sstable"})
+	require.NoError(t, err)
+	assert.Len(t, rs, 2)
+
+	rs, err = store.GetCompactionHistory(ctx, HistoryFilter{Output: "3.sstable"})
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	assert.Equal(t, "a", rs[0].Reason)
+
+	rs, err = store.GetCompactionHistory(ctx, HistoryFilter{Since: t0.Add(time.Second)})
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	assert.Equal(t, r2.Outputs, rs[0].Outputs)
+
+	rs, err = store.GetCompactionHistory(ctx, HistoryFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, rs, 1)
+}
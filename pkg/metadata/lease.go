@@ -0,0 +1,161 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	leasesCollectionName = "leases"
+
+	// in the meta collection.
+	metaManifestVersionID = "manifest_version"
+)
+
+// ErrLeaseHeld is returned by AcquireLease when the lease is held by someone
+// else.
+var ErrLeaseHeld = errors.New("lease held by another owner")
+
+// ErrManifestConflict is returned by SwapManifestVersion when the version isn't
+// the one which the caller expected, because someone else published a manifest
+// in the meantime.
+var ErrManifestConflict = errors.New("manifest version changed")
+
+// AcquireLease takes the named lease for owner for ttl, or extends it if owner
+// already holds it. If anyone else holds it, it returns ErrLeaseHeld. Expiry is
+// judged by the clock of the Mongo primary rather than the caller, so clock
+// skew between processes doesn't let two of them hold the same lease.
+func (s *Store) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(leasesCollectionName).UpdateOne(ctx, bson.M{
+		"_id": name,
+		"$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$until", "$$NOW"}}},
+		},
+	}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"owner": owner,
+			"until": bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}},
+		}}},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		// the filter didn't match, so the upsert tried to insert another lease
+		// with the same name.
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s", ErrLeaseHeld, name)
+		}
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseLease gives up the named lease, if owner holds it.
+func (s *Store) ReleaseLease(ctx context.Context, name, owner string) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(leasesCollectionName).DeleteOne(ctx, bson.M{"_id": name, "owner": owner})
+	if err != nil {
+		return fmt.Errorf("DeleteOne: %w", err)
+	}
+
+	return nil
+}
+
+// LeaseHolder returns the owner of the named lease, or an empty string if no
+// one holds it.
+func (s *Store) LeaseHolder(ctx context.Context, name string) (string, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return "", fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Owner string `bson:"owner"`
+	}
+
+	err = db.Collection(leasesCollectionName).FindOne(ctx, bson.M{
+		"_id":   name,
+		"$expr": bson.M{"$gte": bson.A{"$until", "$$NOW"}},
+	}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil
+		}
+		return "", fmt.Errorf("FindOne: %w", err)
+	}
+
+	return doc.Owner, nil
+}
+
+// ManifestVersion returns the Created time of the newest manifest which was
+// published, or the zero time if none was.
+func (s *Store) ManifestVersion(ctx context.Context) (time.Time, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value time.Time `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaManifestVersionID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("FindOne: %w", err)
+	}
+
+	return doc.Value, nil
+}
+
+// SwapManifestVersion sets the manifest version to next, if it's currently prev
+// (as returned by ManifestVersion). Otherwise it returns ErrManifestConflict.
+func (s *Store) SwapManifestVersion(ctx context.Context, prev, next time.Time) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	coll := db.Collection(metaCollectionName)
+
+	if prev.IsZero() {
+		_, err = coll.InsertOne(ctx, bson.M{"_id": metaManifestVersionID, "value": next})
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrManifestConflict
+			}
+			return fmt.Errorf("InsertOne: %w", err)
+		}
+		return nil
+	}
+
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": metaManifestVersionID, "value": prev},
+		bson.M{"$set": bson.M{"value": next}},
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrManifestConflict
+	}
+
+	return nil
+}
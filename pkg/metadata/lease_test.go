@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	ctx, store := setup(t)
+
+	holder, err := store.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+
+	require.NoError(t, store.AcquireLease(ctx, "flush", "a", time.Minute))
+	require.NoError(t, store.AcquireLease(ctx, "flush", "a", time.Minute))
+	assert.ErrorIs(t, store.AcquireLease(ctx, "flush", "b", time.Minute), ErrLeaseHeld)
+
+	holder, err = store.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "a", holder)
+
+	// releasing someone else's lease does nothing.
+	require.NoError(t, store.ReleaseLease(ctx, "flush", "b"))
+	assert.ErrorIs(t, store.AcquireLease(ctx, "flush", "b", time.Minute), ErrLeaseHeld)
+
+	require.NoError(t, store.ReleaseLease(ctx, "flush", "a"))
+	require.NoError(t, store.AcquireLease(ctx, "flush", "b", time.Millisecond))
+
+	// expiry is by the server's clock, so wait for it.
+	time.Sleep(10 * time.Millisecond)
+	holder, err = store.LeaseHolder(ctx, "flush")
+	require.NoError(t, err)
+	assert.Equal(t, "", holder)
+	require.NoError(t, store.AcquireLease(ctx, "flush", "c", time.Minute))
+}
+
+func TestManifestVersion(t *testing.T) {
+	ctx, store := setup(t)
+
+	v, err := store.ManifestVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, v.IsZero())
+
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+
+	require.NoError(t, store.SwapManifestVersion(ctx, time.Time{}, t1))
+	assert.ErrorIs(t, store.SwapManifestVersion(ctx, time.Time{}, t2), ErrManifestConflict)
+
+	v, err = store.ManifestVersion(ctx)
+	require.NoError(t, err)
+	assert.True(t, t1.Equal(v))
+
+	require.NoError(t, store.SwapManifestVersion(ctx, v, t2))
+	assert.ErrorIs(t, store.SwapManifestVersion(ctx, v, t2), ErrManifestConflict)
+}
@@ -0,0 +1,274 @@
+package metadata
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// listBatchSize is the number of sstables fetched from Mongo at once by
+// EachMeta, which bounds its memory use.
+const listBatchSize = 1000
+
+// ListOrder is the field which EachMeta and ListMetas order sstables by.
+type ListOrder int
+
+const (
+	ByMinKey ListOrder = iota
+	ByCreated
+	BySize
+)
+
+func (o ListOrder) field() string {
+	switch o {
+	case ByCreated:
+		return "created"
+	case BySize:
+		return "size"
+	default:
+		return "min_key"
+	}
+}
+
+// ListOptions selects and orders the live sstables for EachMeta and ListMetas.
+type ListOptions struct {
+	Order ListOrder
+	Desc  bool
+
+	// If set, only sstables which might contain records in [MinTime, MaxTime]
+	// are included.
+	MinTime time.Time
+	MaxTime time.Time
+
+	// SkipFilters omits the inline filters (see blobstore.WithInlineFilters),
+	// which are most of the size of each sstable's metadata, for callers which
+	// don't read any records.
+	SkipFilters bool
+
+	// After is the token returned by the previous call to ListMetas, to fetch
+	// the next page. It's ignored by EachMeta.
+	After string
+
+	// Limit is the maximum number of sstables returned by ListMetas. Zero means
+	// DefaultListLimit. It's ignored by EachMeta.
+	Limit int
+}
+
+// DefaultListLimit is the page size of ListMetas when ListOptions.Limit isn't
+// given.
+const DefaultListLimit = 1000
+
+// listedMeta is an sstable document, with the _id which breaks ties between
+// sstables with the same value of the ListOrder field, so pages never skip or
+// repeat sstables.
+type listedMeta struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	sstable.Meta `bson:",inline"`
+}
+
+// EachMeta calls fn with the metadata of each sstable in the live set matching
+// the given options, in order, fetching them from Mongo in batches rather than
+// all at once, so it's suitable for archives with millions of sstables. If fn
+// returns an error, it stops, and returns that error.
+//
+// The live set might change while it's running, in which case sstables which
+// were added or removed might or might not be included.
+func (s *Store) EachMeta(ctx context.Context, opts ListOptions, fn func(*sstable.Meta) error) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	filter, err := listFilter(opts, false)
+	if err != nil {
+		return err
+	}
+
+	cur, err := db.Collection(collectionName).Find(ctx, filter, listFindOptions(opts).SetBatchSize(listBatchSize))
+	if err != nil {
+		return fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		m := &sstable.Meta{}
+		err = cur.Decode(m)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		err = fn(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("cursor: %w", err)
+	}
+
+	return nil
+}
+
+// ListMetas returns one page of the sstables in the live set matching the given
+// options, in order, and a token to pass as opts.After to fetch the next page,
+// which is empty if this is the last one. The options must be the same for
+// every page.
+func (s *Store) ListMetas(ctx context.Context, opts ListOptions) ([]*sstable.Meta, string, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("getMongo: %w", err)
+	}
+
+	filter, err := listFilter(opts, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	cur, err := db.Collection(collectionName).Find(ctx, filter, listFindOptions(opts).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, "", fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var docs []*listedMeta
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, "", fmt.Errorf("cursor.All: %w", err)
+	}
+
+	metas := make([]*sstable.Meta, len(docs))
+	for i, d := range docs {
+		metas[i] = &d.Meta
+	}
+
+	if len(docs) < limit {
+		return metas, "", nil
+	}
+
+	next, err := encodeListToken(opts.Order, docs[len(docs)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return metas, next, nil
+}
+
+// listFilter returns the filter for the given options, including the position
+// after the previous page, if paged is true.
+func listFilter(opts ListOptions, paged bool) (bson.M, error) {
+	filter := live(bson.M{})
+
+	if !opts.MinTime.IsZero() {
+		filter["max_time"] = bson.M{"$gte": opts.MinTime}
+	}
+	if !opts.MaxTime.IsZero() {
+		filter["min_time"] = bson.M{"$lte": opts.MaxTime}
+	}
+
+	if !paged || opts.After == "" {
+		return filter, nil
+	}
+
+	after, err := decodeListToken(opts.After)
+	if err != nil {
+		return nil, err
+	}
+
+	op := "$gt"
+	if opts.Desc {
+		op = "$lt"
+	}
+
+	f := opts.Order.field()
+	filter["$or"] = bson.A{
+		bson.M{f: bson.M{op: after.Value}},
+		bson.M{f: after.Value, "_id": bson.M{op: after.ID}},
+	}
+
+	return filter, nil
+}
+
+func listFindOptions(opts ListOptions) *options.FindOptions {
+	dir := 1
+	if opts.Desc {
+		dir = -1
+	}
+
+	o := options.Find().SetSort(bson.D{
+		{Key: opts.Order.field(), Value: dir},
+		{Key: "_id", Value: dir},
+	})
+
+	if opts.SkipFilters {
+		o.SetProjection(bson.M{"filter": 0})
+	}
+
+	return o
+}
+
+// listToken is the position of the last sstable in a page of ListMetas.
+type listToken struct {
+	Value interface{}        `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+func encodeListToken(o ListOrder, m *listedMeta) (string, error) {
+	t := listToken{ID: m.ID}
+	switch o {
+	case ByCreated:
+		t.Value = m.Created
+	case BySize:
+		t.Value = m.Size
+	default:
+		t.Value = m.MinKey
+	}
+
+	b, err := bson.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeListToken(s string) (*listToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list token: %w", err)
+	}
+
+	t := &listToken{}
+	err = bson.Unmarshal(b, t)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list token: %w", err)
+	}
+
+	return t, nil
+}
+
+// CountLive returns the number of sstables in the live set, without fetching
+// them.
+func (s *Store) CountLive(ctx context.Context) (int, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getMongo: %w", err)
+	}
+
+	n, err := db.Collection(collectionName).CountDocuments(ctx, live(bson.M{}))
+	if err != nil {
+		return 0, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return int(n), nil
+}
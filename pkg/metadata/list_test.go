@@ -0,0 +1,147 @@
+package metadata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListMetas(t *testing.T) {
+	ctx, store := setup(t)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	// several sstables with the same size, so pages must break ties.
+	var want []string
+	for i := 0; i < 7; i++ {
+		m := &sstable.Meta{
+			MinKey:  fmt.Sprintf("k%02d", i),
+			MaxKey:  fmt.Sprintf("k%02d", i),
+			MinTime: now,
+			MaxTime: now,
+			Created: now.Add(time.Duration(i) * time.Second),
+			Size:    100 * (i % 2),
+		}
+		require.NoError(t, store.Insert(ctx, m))
+		want = append(want, m.Filename())
+	}
+
+	for _, order := range []ListOrder{ByMinKey, ByCreated, BySize} {
+		for _, desc := range []bool{false, true} {
+			opts := ListOptions{Order: order, Desc: desc, Limit: 3, SkipFilters: true}
+			var got []string
+			pages := 0
+
+			for {
+				metas, next, err := store.ListMetas(ctx, opts)
+				require.NoError(t, err)
+				for _, m := range metas {
+					got = append(got, m.Filename())
+				}
+				pages++
+				if next == "" {
+					break
+				}
+				opts.After = next
+			}
+
+			assert.ElementsMatch(t, want, got, "order=%d desc=%v", order, desc)
+			assert.Equal(t, 3, pages, "order=%d desc=%v", order, desc)
+
+			var each []string
+			err := store.EachMeta(ctx, ListOptions{Order: order, Desc: desc}, func(m *sstable.Meta) error {
+				each = append(each, m.Filename())
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, got, each, "order=%d desc=%v", order, desc)
+		}
+	}
+
+	// by created, the order is exact.
+	metas, _, err := store.ListMetas(ctx, ListOptions{Order: ByCreated, Desc: true, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+	assert.Equal(t, want[6], metas[0].Filename())
+	assert.Equal(t, want[5], metas[1].Filename())
+
+	n, err := store.CountLive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+
+	_, _, err = store.ListMetas(ctx, ListOptions{After: "garbage!"})
+	assert.Error(t, err)
+}
+
+func TestEachMetaTimeRange(t *testing.T) {
+	ctx, store := setup(t)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	old := &sstable.Meta{MinKey: "a", MaxKey: "b", MinTime: t0, MaxTime: t0.Add(time.Hour), Created: t0}
+	mid := &sstable.Meta{MinKey: "c", MaxKey: "d", MinTime: t0.Add(2 * time.Hour), MaxTime: t0.Add(3 * time.Hour), Created: t0.Add(time.Second)}
+	recent := &sstable.Meta{MinKey: "e", MaxKey: "f", MinTime: t0.Add(4 * time.Hour), MaxTime: t0.Add(5 * time.Hour), Created: t0.Add(2 * time.Second)}
+	for _, m := range []*sstable.Meta{old, mid, recent} {
+		require.NoError(t, store.Insert(ctx, m))
+	}
+
+	var got []string
+	err := store.EachMeta(ctx, ListOptions{MinTime: t0.Add(90 * time.Minute), MaxTime: t0.Add(150 * time.Minute)}, func(m *sstable.Meta) error {
+		got = append(got, m.MinKey)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, got)
+
+	// errors from the callback stop the stream.
+	calls := 0
+	err = store.EachMeta(ctx, ListOptions{}, func(*sstable.Meta) error {
+		calls++
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 1, calls)
+}
+
+// BenchmarkEachMeta streams a live set of a million sstables from Mongo, which
+// is roughly the most that an archive is expected to have.
+func BenchmarkEachMeta(b *testing.B) {
+	const n = 1_000_000
+	const batch = 10_000
+	ctx, store := setup(b)
+	now := time.Now()
+
+	db, err := store.getMongo(ctx)
+	require.NoError(b, err)
+
+	metas := make([]*sstable.Meta, 0, batch)
+	for i := 0; i < n; i++ {
+		metas = append(metas, &sstable.Meta{
+			MinKey:  fmt.Sprintf("k%08d", i),
+			MaxKey:  fmt.Sprintf("k%08d", i),
+			MinTime: now,
+			MaxTime: now,
+			Created: now.Add(time.Duration(i) * time.Millisecond),
+			Size:    i % 1000,
+		})
+		if len(metas) == batch {
+			_, err = db.Collection(collectionName).InsertMany(ctx, windowedDocs(metas))
+			require.NoError(b, err)
+			metas = metas[:0]
+		}
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		err = store.EachMeta(ctx, ListOptions{Order: BySize, SkipFilters: true}, func(*sstable.Meta) error {
+			count++
+			return nil
+		})
+		require.NoError(b, err)
+		require.Equal(b, n, count)
+	}
+}
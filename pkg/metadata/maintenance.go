@@ -0,0 +1,365 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metaMaintenanceID = "maintenance_windows"
+
+// The background tasks which can be paused, or (except for flushes) confined to
+// maintenance windows.
+const (
+	TaskFlush      = "flush"
+	TaskCompaction = "compaction"
+	TaskGC         = "gc"
+)
+
+// ErrUnknownTask is returned when pausing or scheduling a task which isn't one
+// of the above.
+var ErrUnknownTask = errors.New("unknown task")
+
+// MaintenanceWindow is a time of day, on some days of the week, during which
+// a background task is allowed to run.
+type MaintenanceWindow struct {
+	// Days are the days on which the window opens. Empty means every day.
+	Days []time.Weekday `bson:"days,omitempty"`
+
+	// Start and End are the times of day at which the window opens and
+	// closes, as offsets from midnight. If End isn't after Start, the window
+	// spans midnight, and closes the next day. If they're equal, it lasts all
+	// day.
+	Start time.Duration `bson:"start"`
+	End   time.Duration `bson:"end"`
+
+	// Location is the IANA name of the time zone which the window is in, e.g.
+	// "America/New_York". Empty means UTC.
+	Location string `bson:"location,omitempty"`
+}
+
+func (w MaintenanceWindow) location() *time.Location {
+	if w.Location == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(w.Location)
+	if err != nil {
+		// ParseMaintenanceWindow and SetMaintenanceWindows check this, so it
+		// only happens if the tzdata is missing here.
+		return time.UTC
+	}
+
+	return loc
+}
+
+func (w MaintenanceWindow) opensOn(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, wd := range w.Days {
+		if wd == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Contains returns true if the window is open at t.
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	t = t.In(w.location())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	switch {
+	case w.Start == w.End:
+		return w.opensOn(today)
+	case w.Start < w.End:
+		return w.opensOn(today) && tod >= w.Start && tod < w.End
+	default:
+		return (w.opensOn(today) && tod >= w.Start) || (w.opensOn(yesterday) && tod < w.End)
+	}
+}
+
+// NextOpen returns t if the window is open at t, or otherwise the next time
+// that it opens.
+func (w MaintenanceWindow) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	lt := t.In(w.location())
+	for d := 0; d <= 7; d++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()+d, 0, 0, 0, 0, lt.Location())
+		open := day.Add(w.Start)
+		if open.After(t) && w.opensOn(day.Weekday()) {
+			return open.In(t.Location())
+		}
+	}
+
+	// unreachable, since every window opens at least once a week.
+	return t
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// String returns the window in the format accepted by ParseMaintenanceWindow.
+func (w MaintenanceWindow) String() string {
+	var parts []string
+
+	if len(w.Days) > 0 {
+		days := make([]string, len(w.Days))
+		for i, d := range w.Days {
+			days[i] = weekdays[d]
+		}
+		parts = append(parts, strings.Join(days, ","))
+	}
+
+	hhmm := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	parts = append(parts, hhmm(w.Start)+"-"+hhmm(w.End))
+
+	if w.Location != "" {
+		parts = append(parts, w.Location)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ParseMaintenanceWindow parses a window like "mon-fri 01:00-05:00 Europe/London",
+// with the days (a comma-separated list of days or ranges of them) and the time
+// zone optional. "22:00-02:00" is every night from 10pm to 2am UTC.
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	w := MaintenanceWindow{}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return w, fmt.Errorf("empty maintenance window")
+	}
+
+	if !strings.Contains(fields[0], ":") {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, err
+		}
+		w.Days = days
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid maintenance window: %q", s)
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range: %q", fields[0])
+	}
+
+	var err error
+	w.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return w, err
+	}
+	w.End, err = parseTimeOfDay(end)
+	if err != nil {
+		return w, err
+	}
+
+	if len(fields) == 2 {
+		w.Location = fields[1]
+	}
+
+	return w, w.validate()
+}
+
+func (w MaintenanceWindow) validate() error {
+	day := 24 * time.Hour
+	if w.Start < 0 || w.Start >= day || w.End < 0 || w.End >= day {
+		return fmt.Errorf("invalid maintenance window: times must be within a day")
+	}
+
+	if w.Location != "" {
+		_, err := time.LoadLocation(w.Location)
+		if err != nil {
+			return fmt.Errorf("invalid location: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	if s == "*" {
+		return nil, nil
+	}
+
+	day := func(s string) (time.Weekday, error) {
+		for i, d := range weekdays {
+			if strings.EqualFold(s, d) {
+				return time.Weekday(i), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day: %q", s)
+	}
+
+	var out []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		d, err := day(first)
+		if err != nil {
+			return nil, err
+		}
+		if !isRange {
+			out = append(out, d)
+			continue
+		}
+
+		e, err := day(last)
+		if err != nil {
+			return nil, err
+		}
+
+		// ranges can wrap around the end of the week, e.g. fri-mon.
+		for {
+			out = append(out, d)
+			if d == e {
+				break
+			}
+			d = (d + 1) % 7
+		}
+	}
+
+	return out, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+
+	hh, err := strconv.Atoi(h)
+	if err != nil || hh < 0 || hh > 23 {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+
+	mm, err := strconv.Atoi(m)
+	if err != nil || mm < 0 || mm > 59 {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+
+	return time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute, nil
+}
+
+// MaintenanceSchedule is the maintenance windows of each task. A task without
+// any windows can run at any time.
+type MaintenanceSchedule map[string][]MaintenanceWindow
+
+// Allows returns true if the given task may run at t.
+func (ms MaintenanceSchedule) Allows(task string, t time.Time) bool {
+	ws := ms[task]
+	if len(ws) == 0 {
+		return true
+	}
+
+	for _, w := range ws {
+		if w.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextAllowed returns the first time at or after t when the given task may run.
+func (ms MaintenanceSchedule) NextAllowed(task string, t time.Time) time.Time {
+	ws := ms[task]
+	if len(ws) == 0 {
+		return t
+	}
+
+	var next time.Time
+	for _, w := range ws {
+		n := w.NextOpen(t)
+		if next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+
+	return next
+}
+
+// GetMaintenanceSchedule returns the maintenance windows of every task which
+// has any.
+func (s *Store) GetMaintenanceSchedule(ctx context.Context) (MaintenanceSchedule, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value MaintenanceSchedule `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaMaintenanceID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return MaintenanceSchedule{}, nil
+		}
+		return nil, fmt.Errorf("FindOne: %w", err)
+	}
+
+	if doc.Value == nil {
+		doc.Value = MaintenanceSchedule{}
+	}
+
+	return doc.Value, nil
+}
+
+// SetMaintenanceWindows replaces the maintenance windows of the given task. If
+// there are none, the task can run at any time.
+func (s *Store) SetMaintenanceWindows(ctx context.Context, task string, windows []MaintenanceWindow) error {
+	if task != TaskCompaction && task != TaskGC {
+		return fmt.Errorf("%w: %s", ErrUnknownTask, task)
+	}
+
+	for _, w := range windows {
+		err := w.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	update := bson.M{"$set": bson.M{"value." + task: windows}}
+	if len(windows) == 0 {
+		update = bson.M{"$unset": bson.M{"value." + task: ""}}
+	}
+
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaMaintenanceID},
+		update,
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
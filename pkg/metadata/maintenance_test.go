@@ -0,0 +1,104 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	w, err := ParseMaintenanceWindow("mon-wed,fri 01:30-05:00 America/New_York")
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceWindow{
+		Days:     []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Friday},
+		Start:    90 * time.Minute,
+		End:      5 * time.Hour,
+		Location: "America/New_York",
+	}, w)
+	assert.Equal(t, "mon,tue,wed,fri 01:30-05:00 America/New_York", w.String())
+
+	w, err = ParseMaintenanceWindow("fri-mon 22:00-02:00")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, w.Days)
+
+	w, err = ParseMaintenanceWindow("* 00:00-00:00")
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceWindow{}, w)
+
+	for _, s := range []string{"", "mon", "01:00", "25:00-01:00", "xyz 01:00-02:00", "01:00-02:00 Nowhere/Special", "01:00-02:00 UTC extra"} {
+		_, err := ParseMaintenanceWindow(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	// a wednesday.
+	wed := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	w, err := ParseMaintenanceWindow("wed 01:00-05:00")
+	require.NoError(t, err)
+	assert.False(t, w.Contains(wed))
+	assert.True(t, w.Contains(wed.Add(time.Hour)))
+	assert.True(t, w.Contains(wed.Add(5*time.Hour-time.Second)))
+	assert.False(t, w.Contains(wed.Add(5*time.Hour)))
+	assert.False(t, w.Contains(wed.Add(25*time.Hour)))
+	assert.Equal(t, wed.Add(time.Hour), w.NextOpen(wed))
+	assert.Equal(t, wed.Add(7*24*time.Hour+time.Hour), w.NextOpen(wed.Add(5*time.Hour)))
+
+	// spanning midnight, the window which opened on tuesday night is still
+	// open early on wednesday, but the one on wednesday night isn't.
+	w, err = ParseMaintenanceWindow("tue 22:00-02:00")
+	require.NoError(t, err)
+	assert.True(t, w.Contains(wed.Add(time.Hour)))
+	assert.False(t, w.Contains(wed.Add(23*time.Hour)))
+	assert.Equal(t, wed.Add(6*24*time.Hour+22*time.Hour), w.NextOpen(wed.Add(3*time.Hour)))
+
+	// in another time zone, 01:00 in new york is 06:00 utc.
+	w, err = ParseMaintenanceWindow("01:00-02:00 America/New_York")
+	require.NoError(t, err)
+	assert.False(t, w.Contains(wed.Add(time.Hour)))
+	assert.True(t, w.Contains(wed.Add(6*time.Hour)))
+	assert.Equal(t, wed.Add(6*time.Hour), w.NextOpen(wed))
+}
+
+func TestMaintenanceSchedule(t *testing.T) {
+	wed := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	night, err := ParseMaintenanceWindow("22:00-02:00")
+	require.NoError(t, err)
+	lunch, err := ParseMaintenanceWindow("12:00-13:00")
+	require.NoError(t, err)
+
+	ms := MaintenanceSchedule{TaskCompaction: {night, lunch}}
+	assert.True(t, ms.Allows(TaskGC, wed.Add(6*time.Hour)), "no windows means any time")
+	assert.True(t, ms.Allows(TaskCompaction, wed.Add(time.Hour)))
+	assert.False(t, ms.Allows(TaskCompaction, wed.Add(6*time.Hour)))
+	assert.Equal(t, wed.Add(12*time.Hour), ms.NextAllowed(TaskCompaction, wed.Add(6*time.Hour)))
+	assert.Equal(t, wed.Add(22*time.Hour), ms.NextAllowed(TaskCompaction, wed.Add(13*time.Hour)))
+}
+
+func TestSetMaintenanceWindows(t *testing.T) {
+	ctx, store := setup(t)
+
+	ms, err := store.GetMaintenanceSchedule(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ms)
+
+	w, err := ParseMaintenanceWindow("sat,sun 00:00-06:00 Europe/London")
+	require.NoError(t, err)
+	require.NoError(t, store.SetMaintenanceWindows(ctx, TaskCompaction, []MaintenanceWindow{w}))
+	require.NoError(t, store.SetMaintenanceWindows(ctx, TaskGC, []MaintenanceWindow{w}))
+
+	ms, err = store.GetMaintenanceSchedule(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceSchedule{TaskCompaction: {w}, TaskGC: {w}}, ms)
+
+	require.NoError(t, store.SetMaintenanceWindows(ctx, TaskGC, nil))
+	ms, err = store.GetMaintenanceSchedule(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceSchedule{TaskCompaction: {w}}, ms)
+
+	err = store.SetMaintenanceWindows(ctx, TaskGC, []MaintenanceWindow{{Start: 25 * time.Hour}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,231 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Manifest is a snapshot of the live set of an archive, which can be stored
+// outside of the metadata store (e.g. in the blobstore, alongside the sstables)
+// so that readers don't need access to Mongo.
+type Manifest struct {
+	Archive string          `bson:"archive"`
+	Created time.Time       `bson:"created"`
+	Metas   []*sstable.Meta `bson:"metas"`
+
+	// Count is the number of sstables in the manifest. It's set even when the
+	// Metas weren't kept in memory, e.g. by ReadManifest with a callback.
+	Count int `bson:"count"`
+}
+
+// ManifestKey returns the blob key of the manifest of the given archive.
+func ManifestKey(archive string) string {
+	return fmt.Sprintf("manifests/%s.json", archive)
+}
+
+// Encode returns the manifest as (relaxed) extended JSON, so it's readable by
+// humans and other tools.
+func (m *Manifest) Encode() ([]byte, error) {
+	m.Count = len(m.Metas)
+	return bson.MarshalExtJSON(m, false, false)
+}
+
+func DecodeManifest(b []byte) (*Manifest, error) {
+	return ReadManifest(bytes.NewReader(b), nil)
+}
+
+// GetContaining is like Store.GetContaining, but is served from the manifest.
+func (m *Manifest) GetContaining(key string) []*sstable.Meta {
+	return containing(slices.Values(m.Metas), key)
+}
+
+// ManifestWriter writes a manifest one sstable at a time, so the whole live set
+// never needs to be in memory. The output is the same as Manifest.Encode.
+type ManifestWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+// NewManifestWriter writes the header of a manifest to w, and returns a writer
+// for the sstables in it. Close must be called to finish it.
+func NewManifestWriter(w io.Writer, archive string, created time.Time) (*ManifestWriter, error) {
+	head, err := bson.MarshalExtJSON(bson.D{
+		{Key: "archive", Value: archive},
+		{Key: "created", Value: created},
+	}, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("MarshalExtJSON: %w", err)
+	}
+
+	mw := &ManifestWriter{w: bufio.NewWriter(w)}
+
+	// reopen the header document to append the metas.
+	mw.w.Write(head[:len(head)-1])
+	mw.w.WriteString(`,"metas":[`)
+
+	return mw, nil
+}
+
+// Add writes the given sstable to the manifest.
+func (mw *ManifestWriter) Add(m *sstable.Meta) error {
+	b, err := bson.MarshalExtJSON(m, false, false)
+	if err != nil {
+		return fmt.Errorf("MarshalExtJSON(%s): %w", m.Filename(), err)
+	}
+
+	if mw.n > 0 {
+		mw.w.WriteByte(',')
+	}
+
+	_, err = mw.w.Write(b)
+	if err != nil {
+		return err
+	}
+
+	mw.n++
+	return nil
+}
+
+// Count returns the number of sstables added so far.
+func (mw *ManifestWriter) Count() int {
+	return mw.n
+}
+
+// Close finishes the manifest, and flushes it to the underlying writer, which
+// isn't closed.
+func (mw *ManifestWriter) Close() error {
+	fmt.Fprintf(mw.w, `],"count":%d}`, mw.n)
+	return mw.w.Flush()
+}
+
+// ReadManifest reads a manifest written by Encode or ManifestWriter from r,
+// without reading the whole thing into memory first. If fn is nil, the sstables
+// are returned in Metas. Otherwise fn is called with each one instead, and Metas
+// is left empty, so memory use doesn't grow with the number of sstables. If fn
+// returns an error, reading stops, and that error is returned.
+func ReadManifest(r io.Reader, fn func(*sstable.Meta) error) (*Manifest, error) {
+	d := json.NewDecoder(r)
+	m := &Manifest{}
+
+	err := expectDelim(d, '{')
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Token: %w", err)
+		}
+
+		key, _ := tok.(string)
+		if key != "metas" {
+			err = readManifestField(d, key, m)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		tok, err = d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("Token: %w", err)
+		}
+		if tok == nil {
+			continue // an empty manifest encoded by Encode.
+		}
+		if tok != json.Delim('[') {
+			return nil, fmt.Errorf("expected metas to be an array, got: %v", tok)
+		}
+
+		for d.More() {
+			var raw json.RawMessage
+			err = d.Decode(&raw)
+			if err != nil {
+				return nil, fmt.Errorf("Decode(meta %d): %w", n, err)
+			}
+
+			meta := &sstable.Meta{}
+			err = bson.UnmarshalExtJSON(raw, false, meta)
+			if err != nil {
+				return nil, fmt.Errorf("UnmarshalExtJSON(meta %d): %w", n, err)
+			}
+			n++
+
+			if fn == nil {
+				m.Metas = append(m.Metas, meta)
+				continue
+			}
+
+			err = fn(meta)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = expectDelim(d, ']')
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = expectDelim(d, '}')
+	if err != nil {
+		return nil, err
+	}
+
+	m.Count = n
+	return m, nil
+}
+
+// readManifestField decodes the value of the given top-level field (other than
+// metas) into the manifest. Unknown fields are skipped.
+func readManifestField(d *json.Decoder, key string, m *Manifest) error {
+	var raw json.RawMessage
+	err := d.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("Decode(%s): %w", key, err)
+	}
+
+	// the values are extended JSON (e.g. the created time), so wrap them in a
+	// document to decode them the same way as Encode encoded them.
+	k, _ := json.Marshal(key)
+	doc := slices.Concat([]byte("{"), k, []byte(":"), raw, []byte("}"))
+
+	var head Manifest
+	err = bson.UnmarshalExtJSON(doc, false, &head)
+	if err != nil {
+		return fmt.Errorf("UnmarshalExtJSON(%s): %w", key, err)
+	}
+
+	switch key {
+	case "archive":
+		m.Archive = head.Archive
+	case "created":
+		m.Created = head.Created
+	}
+
+	return nil
+}
+
+func expectDelim(d *json.Decoder, want json.Delim) error {
+	tok, err := d.Token()
+	if err != nil {
+		return fmt.Errorf("Token: %w", err)
+	}
+
+	if tok != want {
+		return fmt.Errorf("expected %q in manifest, got: %v", want, tok)
+	}
+
+	return nil
+}
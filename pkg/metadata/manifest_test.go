@@ -0,0 +1,145 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &Manifest{
+		Archive: "test",
+		Created: now,
+		Metas: []*sstable.Meta{
+			{MinKey: "a", MaxKey: "c", MinTime: now, MaxTime: now, Count: 2, Size: 100, Created: now, Prefix: "ab12/"},
+		},
+	}
+
+	b, err := m.Encode()
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"min_key":"a"`)
+
+	m2, err := DecodeManifest(b)
+	require.NoError(t, err)
+	assert.Equal(t, m.Archive, m2.Archive)
+	require.Len(t, m2.Metas, 1)
+	assert.Equal(t, m.Metas[0].Filename(), m2.Metas[0].Filename())
+	assert.Equal(t, now, m2.Created.UTC())
+}
+
+func TestManifestWriter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &Manifest{
+		Archive: "test",
+		Created: now,
+		Metas: []*sstable.Meta{
+			{MinKey: "a", MaxKey: "c", MinTime: now, MaxTime: now, Count: 2, Size: 100, Created: now, Prefix: "ab12/"},
+			{MinKey: "d", MaxKey: "f", MinTime: now, MaxTime: now, Count: 3, Size: 200, Created: now.Add(time.Second)},
+		},
+	}
+
+	var buf bytes.Buffer
+	mw, err := NewManifestWriter(&buf, m.Archive, m.Created)
+	require.NoError(t, err)
+	for _, meta := range m.Metas {
+		require.NoError(t, mw.Add(meta))
+	}
+	require.NoError(t, mw.Close())
+	assert.Equal(t, 2, mw.Count())
+
+	// the same as encoding the whole manifest at once.
+	want, err := m.Encode()
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want), buf.String())
+
+	// and readable by other tools, which don't stream.
+	var m2 Manifest
+	require.NoError(t, bson.UnmarshalExtJSON(buf.Bytes(), false, &m2))
+	require.Len(t, m2.Metas, 2)
+	assert.Equal(t, 2, m2.Count)
+
+	// with a callback, the metas aren't kept.
+	var got []string
+	m3, err := ReadManifest(bytes.NewReader(buf.Bytes()), func(meta *sstable.Meta) error {
+		got = append(got, meta.Filename())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{m.Metas[0].Filename(), m.Metas[1].Filename()}, got)
+	assert.Empty(t, m3.Metas)
+	assert.Equal(t, 2, m3.Count)
+	assert.Equal(t, "test", m3.Archive)
+
+	// errors from the callback stop reading.
+	_, err = ReadManifest(bytes.NewReader(buf.Bytes()), func(*sstable.Meta) error {
+		return assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestManifestWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	mw, err := NewManifestWriter(&buf, "test", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	m, err := DecodeManifest(buf.Bytes())
+	require.NoError(t, err)
+	assert.Empty(t, m.Metas)
+	assert.Equal(t, 0, m.Count)
+}
+
+// BenchmarkManifest writes and then streams back a manifest of a million
+// sstables, which is roughly the most that an archive is expected to have.
+func BenchmarkManifest(b *testing.B) {
+	const n = 1_000_000
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	meta := &sstable.Meta{MinKey: "aaaaaaaa", MaxKey: "zzzzzzzz", MinTime: now, MaxTime: now, Count: 1000, Size: 65536, Created: now}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		mw, err := NewManifestWriter(&buf, "bench", now)
+		require.NoError(b, err)
+		for j := 0; j < n; j++ {
+			require.NoError(b, mw.Add(meta))
+		}
+		require.NoError(b, mw.Close())
+		b.SetBytes(int64(buf.Len()))
+
+		count := 0
+		m, err := ReadManifest(&buf, func(*sstable.Meta) error {
+			count++
+			return nil
+		})
+		require.NoError(b, err)
+		require.Equal(b, n, count)
+		require.Equal(b, n, m.Count)
+	}
+}
+
+func TestManifestGetContaining(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &Manifest{
+		Metas: []*sstable.Meta{
+			{MinKey: "a", MaxKey: "c", MaxTime: now, LargestSeq: 3, Created: now, Prefix: "1/"},
+			{MinKey: "a", MaxKey: "c", MaxTime: now, LargestSeq: 5, Created: now, Prefix: "2/"},
+			{MinKey: "a", MaxKey: "c", MaxTime: now.Add(-time.Second), LargestSeq: 9, Created: now, Prefix: "3/"},
+			{MinKey: "d", MaxKey: "f", MaxTime: now.Add(time.Second), LargestSeq: 9, Created: now, Prefix: "4/"},
+		},
+	}
+
+	// newest first; ties on MaxTime are broken by sequence number, like in
+	// compaction, not by which sstable happens to be created last.
+	var got []string
+	for _, meta := range m.GetContaining("b") {
+		got = append(got, meta.Prefix)
+	}
+	assert.Equal(t, []string{"2/", "1/", "3/"}, got)
+}
@@ -2,9 +2,12 @@ package metadata
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"time"
 
+	"github.com/adammck/blobby/pkg/faultinject"
 	"github.com/adammck/blobby/pkg/sstable"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,7 +15,6 @@ import (
 )
 
 const (
-	defaultDB         = "blobby"
 	collectionName    = "sstables"
 	connectionTimeout = 3 * time.Second
 )
@@ -20,14 +22,29 @@ const (
 type Store struct {
 	mongo    *mongo.Database
 	mongoURL string
+	dbName   string
+	faults   *faultinject.Injector
 }
 
-func New(mongoURL string) *Store {
+func New(mongoURL, dbName string) *Store {
 	return &Store{
 		mongoURL: mongoURL,
+		dbName:   dbName,
 	}
 }
 
+// SetFaults injects faults into inserts, deletes, and purges. It's only meant
+// for tests.
+func (s *Store) SetFaults(fi *faultinject.Injector) {
+	s.faults = fi
+}
+
+// SetClient makes the store use the given client, rather than connecting its
+// own, so that it can share a connection pool with others.
+func (s *Store) SetClient(client *mongo.Client) {
+	s.mongo = client.Database(s.dbName)
+}
+
 func (s *Store) getMongo(ctx context.Context) (*mongo.Database, error) {
 	if s.mongo != nil {
 		return s.mongo, nil
@@ -44,84 +61,328 @@ func (s *Store) getMongo(ctx context.Context) (*mongo.Database, error) {
 		return nil, err
 	}
 
-	s.mongo = client.Database(defaultDB)
+	s.mongo = client.Database(s.dbName)
 	return s.mongo, nil
 }
 
+// Init creates the collections and indexes needed by the metadata store. It's
+// idempotent, so can be called again to finish an interrupted Init.
 func (s *Store) Init(ctx context.Context) error {
 	db, err := s.getMongo(ctx)
 	if err != nil {
 		return fmt.Errorf("getMongo: %w", err)
 	}
 
-	err = db.CreateCollection(ctx, collectionName)
+	err = createCollection(ctx, db, collectionName)
 	if err != nil {
-		return fmt.Errorf("CreateCollection: %w", err)
+		return fmt.Errorf("createCollection: %w", err)
 	}
 
-	_, err = db.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "min_key", Value: 1},
-			{Key: "max_key", Value: 1},
-		},
-	})
+	// note that the indexes on the sstables collection are created by the
+	// migrations, so existing archives get them too.
+
+	err = s.initCheckpoints(ctx, db)
 	if err != nil {
-		return fmt.Errorf("CreateIndex: %w", err)
+		return fmt.Errorf("initCheckpoints: %w", err)
+	}
+
+	err = s.initHistory(ctx, db)
+	if err != nil {
+		return fmt.Errorf("initHistory: %w", err)
+	}
+
+	err = createCollection(ctx, db, windowsCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection(%s): %w", windowsCollectionName, err)
+	}
+
+	// bring new archives straight up to the latest schema. this is a no-op
+	// for existing archives which are already up to date.
+	_, err = s.Migrate(ctx)
+	if err != nil {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+
+	return nil
+}
+
+// Initialized returns true if the collections created by Init exist. It doesn't
+// check the indexes.
+func (s *Store) Initialized(ctx context.Context) (bool, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getMongo: %w", err)
+	}
+
+	want := []string{collectionName, checkpointsCollectionName}
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$in": want}})
+	if err != nil {
+		return false, fmt.Errorf("ListCollectionNames: %w", err)
+	}
+
+	return len(names) == len(want), nil
+}
+
+// createCollection creates a collection, unless it already exists.
+func createCollection(ctx context.Context, db *mongo.Database, name string) error {
+	err := db.CreateCollection(ctx, name)
+	if err != nil {
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Name == "NamespaceExists" {
+			return nil
+		}
+		return err
 	}
 
 	return nil
 }
 
 func (s *Store) Insert(ctx context.Context, meta *sstable.Meta) error {
+	err := s.faults.Check(ctx, faultinject.MetadataInsert)
+	if err != nil {
+		return err
+	}
+
 	db, err := s.getMongo(ctx)
 	if err != nil {
 		return fmt.Errorf("getMongo: %w", err)
 	}
 
-	_, err = db.Collection(collectionName).InsertOne(ctx, meta)
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		metas := []*sstable.Meta{meta}
+		err := widenWindows(sc, db, metas)
+		if err != nil {
+			return nil, fmt.Errorf("widenWindows: %w", err)
+		}
+
+		_, err = db.Collection(collectionName).InsertOne(sc, windowedDocs(metas)[0])
+		if err != nil {
+			return nil, fmt.Errorf("InsertOne: %w", err)
+		}
+
+		return nil, nil
+	})
 	if err != nil {
-		return fmt.Errorf("InsertOne: %w", err)
+		return fmt.Errorf("WithTransaction: %w", err)
 	}
 
 	return nil
 }
 
-func (s *Store) Delete(ctx context.Context, meta *sstable.Meta) error {
+// Delete removes the given sstable from the live set, so it's no longer
+// returned by GetContaining or GetAllMetas. This is a soft delete: the metadata
+// is retained, so readers which already resolved the sstable can still fetch
+// it, until it's purged by Purge some time after the given deletion time.
+func (s *Store) Delete(ctx context.Context, meta *sstable.Meta, at time.Time) error {
+	err := s.faults.Check(ctx, faultinject.MetadataDelete)
+	if err != nil {
+		return err
+	}
+
 	db, err := s.getMongo(ctx)
 	if err != nil {
 		return fmt.Errorf("getMongo: %w", err)
 	}
 
 	// TODO: add an ID to Meta and use that instead of this weird filter.
-	result, err := db.Collection(collectionName).DeleteOne(ctx, bson.M{
+	result, err := db.Collection(collectionName).UpdateOne(ctx, live(bson.M{
 		"created": meta.Created,
 		"min_key": meta.MinKey,
 		"max_key": meta.MaxKey,
-	})
+	}), bson.M{"$set": bson.M{"deleted_at": at}})
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	if result.ModifiedCount != 1 {
+		return fmt.Errorf("expected to delete 1 record, deleted %d", result.ModifiedCount)
+	}
+
+	return nil
+}
+
+// SetIndex updates the Index and Filter of the given sstable, which must be
+// live. It's for sstables which were written before indexes existed; the index
+// of new sstables is set before they're inserted.
+func (s *Store) SetIndex(ctx context.Context, meta *sstable.Meta) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	update := bson.M{"$set": bson.M{"index": meta.Index, "filter": meta.Filter}}
+	if meta.Filter == nil {
+		update = bson.M{"$set": bson.M{"index": meta.Index}, "$unset": bson.M{"filter": ""}}
+	}
+
+	result, err := db.Collection(collectionName).UpdateOne(ctx, live(bson.M{
+		"created": meta.Created,
+		"min_key": meta.MinKey,
+		"max_key": meta.MaxKey,
+	}), update)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	if result.MatchedCount != 1 {
+		return fmt.Errorf("expected to update 1 record, matched %d", result.MatchedCount)
+	}
+
+	return nil
+}
+
+// GetDeleted returns the metadata of every sstable which was soft-deleted
+// before the given time (or at any time, if it's zero), and hasn't been purged.
+func (s *Store) GetDeleted(ctx context.Context, before time.Time) ([]*sstable.Meta, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	cond := bson.M{"$exists": true}
+	if !before.IsZero() {
+		cond["$lt"] = before
+	}
+
+	cur, err := db.Collection(collectionName).Find(ctx, bson.M{"deleted_at": cond})
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var metas []*sstable.Meta
+	if err := cur.All(ctx, &metas); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return metas, nil
+}
+
+// Purge permanently removes the metadata of a soft-deleted sstable. The caller
+// is responsible for deleting the blob, if it's no longer referenced.
+func (s *Store) Purge(ctx context.Context, meta *sstable.Meta) error {
+	err := s.faults.Check(ctx, faultinject.MetadataPurge)
 	if err != nil {
-		return fmt.Errorf("DeleteOne: %w", err)
+		return err
 	}
 
-	if result.DeletedCount != 1 {
-		return fmt.Errorf("expected to delete 1 record, deleted %d", result.DeletedCount)
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(collectionName).DeleteMany(ctx, bson.M{
+		"created":    meta.Created,
+		"min_key":    meta.MinKey,
+		"max_key":    meta.MaxKey,
+		"deleted_at": bson.M{"$exists": true},
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteMany: %w", err)
 	}
 
 	return nil
 }
 
+// IsLive returns true if the given sstable is in the live set.
+func (s *Store) IsLive(ctx context.Context, meta *sstable.Meta) (bool, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getMongo: %w", err)
+	}
+
+	n, err := db.Collection(collectionName).CountDocuments(ctx, live(bson.M{
+		"created": meta.Created,
+		"min_key": meta.MinKey,
+		"max_key": meta.MaxKey,
+	}))
+	if err != nil {
+		return false, fmt.Errorf("CountDocuments: %w", err)
+	}
+
+	return n > 0, nil
+}
+
+// live adds a condition to the given filter to exclude soft-deleted sstables.
+func live(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// GetContaining returns the metadata of every sstable whose key range contains
+// the given key, ordered such that the sstable containing the newest record is
+// first: by MaxTime descending, then by LargestSeq and Created descending to
+// break ties (see newestFirst). The read path depends on this ordering, so
+// don't change it.
 func (s *Store) GetContaining(ctx context.Context, key string) ([]*sstable.Meta, error) {
 	db, err := s.getMongo(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getMongo: %w", err)
 	}
 
-	cursor, err := db.Collection(collectionName).Find(ctx, bson.M{
+	keys := bson.M{
 		"min_key": bson.M{"$lte": key},
 		"max_key": bson.M{"$gte": key},
-	}, options.Find().SetSort(bson.D{
-		{Key: "max_time", Value: -1},
-		{Key: "created", Value: -1}, // tie-breaker
-	}))
+	}
+
+	// the window summaries have the same key fields, so the same conditions
+	// find the windows which might contain the key.
+	filter := live(maps.Clone(keys))
+	ok, err := inWindows(ctx, db, filter, keys)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	cursor, err := db.Collection(collectionName).Find(ctx, filter, options.Find().SetSort(newestFirst))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var metas []*sstable.Meta
+	if err := cursor.All(ctx, &metas); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return metas, nil
+}
+
+// newestFirst is the order of the sstables returned by GetContaining: by MaxTime,
+// then by LargestSeq, so that when several contain versions of a key with the
+// same timestamp, the one flushed last is first, like in compaction.
+var newestFirst = bson.D{
+	{Key: "max_time", Value: -1},
+	{Key: "largest_seq", Value: -1},
+	{Key: "created", Value: -1},
+}
+
+// GetOverlapping returns the metadata of every sstable whose key range overlaps
+// the half-open range [start, end), in the same order as GetContaining. If end is
+// empty, the range is unbounded.
+func (s *Store) GetOverlapping(ctx context.Context, start, end string) ([]*sstable.Meta, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	keys := bson.M{"max_key": bson.M{"$gte": start}}
+	if end != "" {
+		keys["min_key"] = bson.M{"$lt": end}
+	}
+
+	filter := live(maps.Clone(keys))
+	ok, err := inWindows(ctx, db, filter, keys)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	cursor, err := db.Collection(collectionName).Find(ctx, filter, options.Find().SetSort(newestFirst))
 	if err != nil {
 		return nil, fmt.Errorf("Find: %w", err)
 	}
@@ -135,13 +396,14 @@ func (s *Store) GetContaining(ctx context.Context, key string) ([]*sstable.Meta,
 	return metas, nil
 }
 
+// GetAllMetas returns the metadata of every sstable in the live set.
 func (s *Store) GetAllMetas(ctx context.Context) ([]*sstable.Meta, error) {
 	db, err := s.getMongo(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getMongo: %w", err)
 	}
 
-	cur, err := db.Collection(collectionName).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{
+	cur, err := db.Collection(collectionName).Find(ctx, live(bson.M{}), options.Find().SetSort(bson.D{
 		{Key: "min_key", Value: 1},
 		{Key: "max_time", Value: -1},
 	}))
@@ -157,3 +419,38 @@ func (s *Store) GetAllMetas(ctx context.Context) ([]*sstable.Meta, error) {
 
 	return metas, nil
 }
+
+// Destroy drops all of the collections owned by the metadata store, including
+// checkpoints. It doesn't touch the blobs which they reference.
+func (s *Store) Destroy(ctx context.Context) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	for _, name := range []string{collectionName, checkpointsCollectionName, checkpointMembersCollectionName, namespacesCollectionName, usageCollectionName, pendingCollectionName, historyCollectionName, windowsCollectionName, leasesCollectionName, accessCollectionName} {
+		err = db.Collection(name).Drop(ctx)
+		if err != nil {
+			return fmt.Errorf("Drop(%s): %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// DropDatabase drops the whole database of the archive: everything dropped by
+// Destroy, and the collections which other packages keep alongside it, like the
+// memtables and the audit log. It doesn't touch any blobs.
+func (s *Store) DropDatabase(ctx context.Context) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	err = db.Drop(ctx)
+	if err != nil {
+		return fmt.Errorf("Drop: %w", err)
+	}
+
+	return nil
+}
@@ -9,26 +9,31 @@ import (
 	"github.com/adammck/blobby/pkg/testdeps"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestInit(t *testing.T) {
 	ctx := context.Background()
 	env := testdeps.New(ctx, t, testdeps.WithMongo())
 
-	store := New(env.MongoURL())
+	store := New(env.MongoURL(), "blobby")
 	err := store.Init(ctx)
 	require.NoError(t, err)
 
-	// second call fails on an existing db.
+	ok, err := store.Initialized(ctx)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// second call is a no-op.
 	err = store.Init(ctx)
-	assert.Error(t, err)
+	assert.NoError(t, err)
 }
 
-func setup(t *testing.T) (context.Context, *Store) {
+func setup(t testing.TB) (context.Context, *Store) {
 	ctx := context.Background()
 	env := testdeps.New(ctx, t, testdeps.WithMongo())
 
-	store := New(env.MongoURL())
+	store := New(env.MongoURL(), "blobby")
 	err := store.Init(ctx)
 	require.NoError(t, err)
 
@@ -172,3 +177,260 @@ func TestBoundaryCases(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, metas, 1)
 }
+
+func TestCheckpoint(t *testing.T) {
+	ctx, store := setup(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	m1 := &sstable.Meta{
+		MinKey:  "a",
+		MaxKey:  "c",
+		Created: now,
+	}
+	err := store.Insert(ctx, m1)
+	require.NoError(t, err)
+
+	cp, err := store.CreateCheckpoint(ctx, "before-migration", now)
+	require.NoError(t, err)
+	require.Len(t, cp.Metas, 1)
+
+	// names are unique.
+	_, err = store.CreateCheckpoint(ctx, "before-migration", now)
+	require.ErrorIs(t, err, ErrCheckpointExists)
+
+	// sstables created after the checkpoint aren't included.
+	m2 := &sstable.Meta{
+		MinKey:  "d",
+		MaxKey:  "f",
+		Created: now.Add(time.Second),
+	}
+	err = store.Insert(ctx, m2)
+	require.NoError(t, err)
+
+	cp, err = store.GetCheckpoint(ctx, "before-migration")
+	require.NoError(t, err)
+	require.Len(t, cp.Metas, 1)
+	assert.Equal(t, "a", cp.Metas[0].MinKey)
+
+	ok, err := store.InCheckpoint(ctx, m1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.InCheckpoint(ctx, m2)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = store.GetCheckpoint(ctx, "nope")
+	require.ErrorIs(t, err, ErrCheckpointNotFound)
+}
+
+func TestRestore(t *testing.T) {
+	ctx, store := setup(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	m1 := &sstable.Meta{MinKey: "a", MaxKey: "c", Created: now}
+	m2 := &sstable.Meta{MinKey: "d", MaxKey: "f", Created: now.Add(1 * time.Second)}
+	m3 := &sstable.Meta{MinKey: "g", MaxKey: "i", Created: now.Add(2 * time.Second)}
+	for _, m := range []*sstable.Meta{m1, m2, m3} {
+		require.NoError(t, store.Insert(ctx, m))
+	}
+
+	cp, err := store.CreateCheckpoint(ctx, "cp", now)
+	require.NoError(t, err)
+
+	// m1 stays live, m2 is deleted, and m3 is deleted and purged. m4 is new.
+	require.NoError(t, store.Delete(ctx, m2, now))
+	require.NoError(t, store.Delete(ctx, m3, now))
+	require.NoError(t, store.Purge(ctx, m3))
+	m4 := &sstable.Meta{MinKey: "j", MaxKey: "l", Created: now.Add(3 * time.Second)}
+	require.NoError(t, store.Insert(ctx, m4))
+
+	require.NoError(t, store.Restore(ctx, cp, now.Add(time.Minute)))
+
+	// every sstable in the checkpoint is live exactly once.
+	metas, err := store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	var keys []string
+	for _, m := range metas {
+		keys = append(keys, m.MinKey)
+	}
+	assert.Equal(t, []string{"a", "d", "g"}, keys)
+
+	deleted, err := store.GetDeleted(ctx, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, "j", deleted[0].MinKey)
+
+	// and restoring again changes nothing.
+	require.NoError(t, store.Restore(ctx, cp, now.Add(2*time.Minute)))
+	metas, err = store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metas, 3)
+}
+
+func TestMigrateCheckpointMembers(t *testing.T) {
+	ctx, store := setup(t)
+	db, err := store.getMongo(ctx)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	m1 := &sstable.Meta{MinKey: "a", MaxKey: "c", Created: now}
+	require.NoError(t, store.Insert(ctx, m1))
+
+	// a checkpoint in the old format, whose second sstable was purged.
+	m2 := &sstable.Meta{MinKey: "d", MaxKey: "f", Created: now.Add(time.Second)}
+	_, err = db.Collection(checkpointsCollectionName).InsertOne(ctx, bson.M{
+		"_id":     "old",
+		"created": now,
+		"metas":   []*sstable.Meta{m1, m2},
+	})
+	require.NoError(t, err)
+
+	// run it twice, as if the first was interrupted.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, migrateCheckpointMembers(ctx, db))
+	}
+
+	cp, err := store.GetCheckpoint(ctx, "old")
+	require.NoError(t, err)
+	require.Len(t, cp.Metas, 2)
+	assert.Equal(t, "a", cp.Metas[0].MinKey)
+	assert.Equal(t, "d", cp.Metas[1].MinKey)
+
+	ok, err := store.InCheckpoint(ctx, m2)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the purged sstable is reinserted by restore.
+	require.NoError(t, store.Restore(ctx, cp, now))
+	metas, err := store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metas, 2)
+}
+
+func TestFeatures(t *testing.T) {
+	ctx, store := setup(t)
+
+	fs, err := store.Features(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, fs)
+	require.NoError(t, store.CheckFeatures(ctx))
+
+	// can't enable features which we don't support.
+	err = store.EnableFeature(ctx, "teleportation")
+	require.ErrorIs(t, err, ErrUnsupportedFeature)
+
+	// pretend that this version supports it.
+	supportedFeatures["teleportation"] = true
+	err = store.EnableFeature(ctx, "teleportation")
+	require.NoError(t, err)
+
+	ok, err := store.HasFeature(ctx, "teleportation")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, store.CheckFeatures(ctx))
+
+	// now pretend that we're an older version which doesn't.
+	delete(supportedFeatures, "teleportation")
+	err = store.CheckFeatures(ctx)
+	require.ErrorIs(t, err, ErrUnsupportedFeature)
+}
+
+func TestIndexes(t *testing.T) {
+	ctx, store := setup(t)
+
+	db, err := store.getMongo(ctx)
+	require.NoError(t, err)
+
+	specs, err := db.Collection(collectionName).Indexes().ListSpecifications(ctx)
+	require.NoError(t, err)
+
+	var names []string
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+
+	assert.Contains(t, names, "min_key_1_max_key_1_max_time_-1_created_-1")
+	assert.NotContains(t, names, oldKeyRangeIndex)
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, store := setup(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	m1 := &sstable.Meta{MinKey: "a", MaxKey: "c", MaxTime: now, Created: now}
+	require.NoError(t, store.Insert(ctx, m1))
+
+	events := make(chan Event, 10)
+	w := store.NewWatcher(func(ev Event) {
+		events <- ev
+	})
+
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.Run(ctx2)
+	<-w.Ready()
+
+	// the initial state is loaded without events.
+	assert.Equal(t, 1, w.Len())
+
+	m2 := &sstable.Meta{MinKey: "b", MaxKey: "d", MaxTime: now.Add(time.Second), Created: now.Add(time.Second)}
+	require.NoError(t, store.Insert(ctx, m2))
+	ev := <-events
+	assert.Equal(t, SSTableAdded, ev.Type)
+	assert.Equal(t, m2.Filename(), ev.Meta.Filename())
+
+	metas := w.GetContaining("b")
+	require.Len(t, metas, 2)
+	assert.Equal(t, m2.Filename(), metas[0].Filename())
+
+	// other updates replace the sstable.
+	m2.Index = "idx"
+	require.NoError(t, store.SetIndex(ctx, m2))
+	ev = <-events
+	assert.Equal(t, SSTableAdded, ev.Type)
+	assert.Equal(t, "idx", ev.Meta.Index)
+	assert.Equal(t, 2, w.Len())
+	metas = w.GetContaining("b")
+	require.Len(t, metas, 2)
+	assert.Equal(t, "idx", metas[0].Index)
+
+	require.NoError(t, store.Delete(ctx, m1, now))
+	ev = <-events
+	assert.Equal(t, SSTableRemoved, ev.Type)
+	assert.Equal(t, m1.Filename(), ev.Meta.Filename())
+	assert.Equal(t, 1, w.Len())
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx, store := setup(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	m1 := &sstable.Meta{MinKey: "a", MaxKey: "c", Created: now}
+	require.NoError(t, store.Insert(ctx, m1))
+
+	// deleted sstables are no longer live.
+	require.NoError(t, store.Delete(ctx, m1, now))
+	metas, err := store.GetContaining(ctx, "b")
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+	metas, err = store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+
+	// can't delete it twice.
+	assert.Error(t, store.Delete(ctx, m1, now))
+
+	// but they're still around until purged.
+	metas, err = store.GetDeleted(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+	metas, err = store.GetDeleted(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+
+	require.NoError(t, store.Purge(ctx, metas[0]))
+	metas, err = store.GetDeleted(ctx, time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+}
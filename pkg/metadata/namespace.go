@@ -0,0 +1,131 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const namespacesCollectionName = "namespaces"
+
+// NamespaceConfig overrides the archive's settings for keys which start with
+// Prefix. Zero values mean the archive default.
+type NamespaceConfig struct {
+	Prefix string `bson:"_id"`
+
+	// Codec is the ID of the codec which new values are encoded with.
+	Codec string `bson:"codec,omitempty"`
+
+	// Retention is how long superseded versions of each key are kept. Once a
+	// version is older than this and a newer version exists, it's dropped the
+	// next time it's compacted. The newest version of each key is never dropped.
+	Retention time.Duration `bson:"retention,omitempty"`
+
+	// MaxVersions is the number of versions of each key which are kept by
+	// compaction. Older versions are dropped, like with Retention.
+	MaxVersions int `bson:"max_versions,omitempty"`
+
+	// TTL is how long new records stay in the memtable before they expire, for
+	// namespaces which are used as caches. Expired records are deleted by Mongo
+	// and skipped by flush, so they're never written to an sstable. Records
+	// which are flushed before they expire are kept, subject to Retention and
+	// MaxVersions like any other.
+	TTL time.Duration `bson:"ttl,omitempty"`
+}
+
+// Namespaces is a set of namespace configs, sorted by prefix.
+type Namespaces []*NamespaceConfig
+
+// For returns the config of the namespace which the given key belongs to, which
+// is the one with the longest matching prefix, or nil if there isn't one.
+func (ns Namespaces) For(key string) *NamespaceConfig {
+	var best *NamespaceConfig
+	for _, n := range ns {
+		if strings.HasPrefix(key, n.Prefix) && (best == nil || len(n.Prefix) > len(best.Prefix)) {
+			best = n
+		}
+	}
+
+	return best
+}
+
+// Expired returns true if a version of the given key which was written at ts,
+// and has n newer versions, should be dropped by compaction at the given time.
+func (ns Namespaces) Expired(key string, ts time.Time, n int, now time.Time) bool {
+	if n == 0 {
+		return false
+	}
+
+	cfg := ns.For(key)
+	if cfg == nil {
+		return false
+	}
+
+	if cfg.MaxVersions > 0 && n >= cfg.MaxVersions {
+		return true
+	}
+
+	if cfg.Retention > 0 && ts.Before(now.Add(-cfg.Retention)) {
+		return true
+	}
+
+	return false
+}
+
+// PutNamespace creates or replaces the config of the namespace with the given
+// prefix.
+func (s *Store) PutNamespace(ctx context.Context, cfg *NamespaceConfig) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(namespacesCollectionName).ReplaceOne(ctx, bson.M{"_id": cfg.Prefix}, cfg, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("ReplaceOne: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteNamespace removes the config of the namespace with the given prefix, so
+// its keys revert to the archive defaults. It's not an error if there isn't one.
+func (s *Store) DeleteNamespace(ctx context.Context, prefix string) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(namespacesCollectionName).DeleteOne(ctx, bson.M{"_id": prefix})
+	if err != nil {
+		return fmt.Errorf("DeleteOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetNamespaces returns every namespace config, sorted by prefix.
+func (s *Store) GetNamespaces(ctx context.Context) (Namespaces, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	cur, err := db.Collection(namespacesCollectionName).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var ns Namespaces
+	err = cur.All(ctx, &ns)
+	if err != nil {
+		return nil, fmt.Errorf("All: %w", err)
+	}
+
+	return ns, nil
+}
@@ -0,0 +1,75 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacesFor(t *testing.T) {
+	ns := Namespaces{
+		{Prefix: "logs/"},
+		{Prefix: "logs/debug/"},
+		{Prefix: "users/"},
+	}
+
+	assert.Equal(t, "logs/", ns.For("logs/x").Prefix)
+	assert.Equal(t, "logs/debug/", ns.For("logs/debug/x").Prefix)
+	assert.Equal(t, "users/", ns.For("users/").Prefix)
+	assert.Nil(t, ns.For("other"))
+	assert.Nil(t, Namespaces(nil).For("logs/x"))
+}
+
+func TestNamespacesExpired(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ns := Namespaces{
+		{Prefix: "a/", Retention: time.Hour},
+		{Prefix: "b/", MaxVersions: 2},
+	}
+
+	old := now.Add(-2 * time.Hour)
+	recent := now.Add(-time.Minute)
+
+	// the newest version is never expired.
+	assert.False(t, ns.Expired("a/k", old, 0, now))
+	assert.True(t, ns.Expired("a/k", old, 1, now))
+	assert.False(t, ns.Expired("a/k", recent, 1, now))
+
+	assert.False(t, ns.Expired("b/k", old, 1, now))
+	assert.True(t, ns.Expired("b/k", recent, 2, now))
+
+	// no config, no expiry.
+	assert.False(t, ns.Expired("c/k", old, 5, now))
+}
+
+func TestNamespaceStore(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	s := New(env.MongoURL(), "test")
+	require.NoError(t, s.Init(ctx))
+
+	ns, err := s.GetNamespaces(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ns)
+
+	require.NoError(t, s.PutNamespace(ctx, &NamespaceConfig{Prefix: "z/", Codec: "gzip"}))
+	require.NoError(t, s.PutNamespace(ctx, &NamespaceConfig{Prefix: "a/", Retention: time.Hour}))
+	require.NoError(t, s.PutNamespace(ctx, &NamespaceConfig{Prefix: "z/", MaxVersions: 3}))
+
+	ns, err = s.GetNamespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Namespaces{
+		{Prefix: "a/", Retention: time.Hour},
+		{Prefix: "z/", MaxVersions: 3},
+	}, ns)
+
+	require.NoError(t, s.DeleteNamespace(ctx, "a/"))
+	require.NoError(t, s.DeleteNamespace(ctx, "missing/"))
+	ns, err = s.GetNamespaces(ctx)
+	require.NoError(t, err)
+	assert.Len(t, ns, 1)
+}
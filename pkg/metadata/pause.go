@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metaPausedID = "paused"
+
+// Paused returns the tasks which are paused, sorted by name.
+func (s *Store) Paused(ctx context.Context) ([]string, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value []string `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaPausedID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("FindOne: %w", err)
+	}
+
+	sort.Strings(doc.Value)
+	return doc.Value, nil
+}
+
+// SetPaused pauses or resumes the given task. It's idempotent.
+func (s *Store) SetPaused(ctx context.Context, task string, paused bool) error {
+	switch task {
+	case TaskFlush, TaskCompaction, TaskGC:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownTask, task)
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	update := bson.M{"$addToSet": bson.M{"value": task}}
+	if !paused {
+		update = bson.M{"$pull": bson.M{"value": task}}
+	}
+
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaPausedID},
+		update,
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
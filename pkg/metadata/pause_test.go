@@ -0,0 +1,34 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPaused(t *testing.T) {
+	ctx, store := setup(t)
+
+	paused, err := store.Paused(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, paused)
+
+	require.NoError(t, store.SetPaused(ctx, TaskGC, true))
+	require.NoError(t, store.SetPaused(ctx, TaskFlush, true))
+	require.NoError(t, store.SetPaused(ctx, TaskFlush, true))
+
+	paused, err = store.Paused(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TaskFlush, TaskGC}, paused)
+
+	require.NoError(t, store.SetPaused(ctx, TaskGC, false))
+	require.NoError(t, store.SetPaused(ctx, TaskCompaction, false))
+
+	paused, err = store.Paused(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{TaskFlush}, paused)
+
+	err = store.SetPaused(ctx, "nope", true)
+	assert.ErrorIs(t, err, ErrUnknownTask)
+}
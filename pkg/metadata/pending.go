@@ -0,0 +1,168 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/faultinject"
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const pendingCollectionName = "pending_compactions"
+
+// ErrNotPending is returned by CommitCompaction when the compaction has no
+// pending record, because it was already committed or aborted.
+var ErrNotPending = errors.New("compaction not pending")
+
+// ErrInputNotLive is returned by CommitCompaction when one of the inputs of the
+// compaction is no longer live, so its outputs must not be either.
+var ErrInputNotLive = errors.New("compaction input not live")
+
+// PendingCompaction records a compaction whose outputs have been written, but
+// not yet committed. It's written by PrepareCompaction before the commit, and
+// removed by the commit itself, so if it's still around long after it was
+// created, the compactor crashed (or failed) in between, and the compaction can
+// be rolled forward (by committing it) or back (by aborting it).
+type PendingCompaction struct {
+	// ID is the filename of the first output, which is unique.
+	ID      string          `bson:"_id"`
+	Owner   string          `bson:"owner"`
+	Created time.Time       `bson:"created"`
+	Inputs  []*sstable.Meta `bson:"inputs"`
+	Outputs []*sstable.Meta `bson:"outputs"`
+}
+
+// PrepareCompaction records that the given compaction is about to be committed.
+// Its outputs must already be written, and it must have at least one.
+func (s *Store) PrepareCompaction(ctx context.Context, p *PendingCompaction) error {
+	if len(p.Outputs) == 0 {
+		return fmt.Errorf("compaction has no outputs")
+	}
+	p.ID = p.Outputs[0].Filename()
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(pendingCollectionName).InsertOne(ctx, p)
+	if err != nil {
+		return fmt.Errorf("InsertOne: %w", err)
+	}
+
+	return nil
+}
+
+// CommitCompaction atomically replaces the inputs of the given pending
+// compaction with its outputs in the live set, and removes the pending record.
+// The inputs are soft-deleted at the given time, like Delete. If the pending
+// record is gone, ErrNotPending is returned; if any input isn't live anymore,
+// ErrInputNotLive is. Either way, nothing is changed.
+func (s *Store) CommitCompaction(ctx context.Context, p *PendingCompaction, at time.Time) error {
+	err := s.faults.Check(ctx, faultinject.MetadataCommit)
+	if err != nil {
+		return err
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		res, err := db.Collection(pendingCollectionName).DeleteOne(sc, bson.M{"_id": p.ID})
+		if err != nil {
+			return nil, fmt.Errorf("DeleteOne: %w", err)
+		}
+		if res.DeletedCount != 1 {
+			return nil, fmt.Errorf("%w: %s", ErrNotPending, p.ID)
+		}
+
+		coll := db.Collection(collectionName)
+		for _, m := range p.Inputs {
+			res, err := coll.UpdateOne(sc, live(bson.M{
+				"created": m.Created,
+				"min_key": m.MinKey,
+				"max_key": m.MaxKey,
+			}), bson.M{"$set": bson.M{"deleted_at": at}})
+			if err != nil {
+				return nil, fmt.Errorf("UpdateOne: %w", err)
+			}
+			if res.ModifiedCount != 1 {
+				return nil, fmt.Errorf("%w: %s", ErrInputNotLive, m.Filename())
+			}
+		}
+
+		err = widenWindows(sc, db, p.Outputs)
+		if err != nil {
+			return nil, fmt.Errorf("widenWindows: %w", err)
+		}
+
+		_, err = coll.InsertMany(sc, windowedDocs(p.Outputs))
+		if err != nil {
+			return nil, fmt.Errorf("InsertMany: %w", err)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("WithTransaction: %w", err)
+	}
+
+	return nil
+}
+
+// AbortCompaction removes the pending record of the given compaction, without
+// changing the live set. It's not an error if there isn't one. The caller is
+// responsible for deleting the blobs of the outputs.
+func (s *Store) AbortCompaction(ctx context.Context, p *PendingCompaction) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(pendingCollectionName).DeleteOne(ctx, bson.M{"_id": p.ID})
+	if err != nil {
+		return fmt.Errorf("DeleteOne: %w", err)
+	}
+
+	return nil
+}
+
+// GetPendingCompactions returns every pending compaction which was prepared
+// before the given time (or at any time, if it's zero), oldest first.
+func (s *Store) GetPendingCompactions(ctx context.Context, before time.Time) ([]*PendingCompaction, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	filter := bson.M{}
+	if !before.IsZero() {
+		filter["created"] = bson.M{"$lt": before}
+	}
+
+	cur, err := db.Collection(pendingCollectionName).Find(ctx, filter, options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var ps []*PendingCompaction
+	if err := cur.All(ctx, &ps); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return ps, nil
+}
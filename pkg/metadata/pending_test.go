@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitCompaction(t *testing.T) {
+	ctx, store := setup(t)
+	t0 := time.Now().UTC().Truncate(time.Second)
+
+	meta := func(min, max string, sec int) *sstable.Meta {
+		return &sstable.Meta{MinKey: min, MaxKey: max, Created: t0.Add(time.Duration(sec) * time.Second)}
+	}
+
+	in1, in2 := meta("a", "m", 1), meta("n", "z", 2)
+	require.NoError(t, store.Insert(ctx, in1))
+	require.NoError(t, store.Insert(ctx, in2))
+
+	p := &PendingCompaction{Owner: "x", Created: t0, Inputs: []*sstable.Meta{in1, in2}, Outputs: []*sstable.Meta{meta("a", "z", 3)}}
+	require.NoError(t, store.PrepareCompaction(ctx, p))
+	assert.Equal(t, p.Outputs[0].Filename(), p.ID)
+
+	// nothing changes until it's committed.
+	ps, err := store.GetPendingCompactions(ctx, t0.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, ps, 1)
+	assert.Equal(t, p.ID, ps[0].ID)
+	metas, err := store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metas, 2)
+
+	require.NoError(t, store.CommitCompaction(ctx, p, t0))
+	metas, err = store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.Equal(t, "a", metas[0].MinKey)
+	assert.Equal(t, "z", metas[0].MaxKey)
+
+	ps, err = store.GetPendingCompactions(ctx, t0.Add(time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, ps)
+
+	// it can't be committed twice.
+	err = store.CommitCompaction(ctx, p, t0)
+	assert.ErrorIs(t, err, ErrNotPending)
+
+	// if an input isn't live, nothing changes, and it's still pending.
+	p2 := &PendingCompaction{Owner: "x", Created: t0, Inputs: []*sstable.Meta{metas[0], in1}, Outputs: []*sstable.Meta{meta("a", "z", 4)}}
+	require.NoError(t, store.PrepareCompaction(ctx, p2))
+	err = store.CommitCompaction(ctx, p2, t0)
+	assert.ErrorIs(t, err, ErrInputNotLive)
+
+	metas, err = store.GetAllMetas(ctx)
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.True(t, t0.Add(3*time.Second).Equal(metas[0].Created))
+
+	require.NoError(t, store.AbortCompaction(ctx, p2))
+	ps, err = store.GetPendingCompactions(ctx, t0.Add(time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, ps)
+}
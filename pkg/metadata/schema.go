@@ -0,0 +1,466 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// This collection is shared with the memtable, which keeps its own docs in
+	// there. Be careful not to collide with them.
+	metaCollectionName  = "meta"
+	metaSchemaVersionID = "schema_version"
+	unversionedSchema   = 0
+)
+
+// ErrSchemaTooNew is returned when the metadata was written by a newer version
+// of this package, which might have changed it in ways we don't understand.
+var ErrSchemaTooNew = errors.New("metadata schema is newer than supported")
+
+// ErrSchemaTooOld is returned when the metadata needs to be migrated before it
+// can be used by this version of this package.
+var ErrSchemaTooOld = errors.New("metadata schema needs migration")
+
+// Migration upgrades the metadata from the previous version to Version.
+// Migrations must be idempotent, since they might be interrupted after making
+// changes but before the version is updated.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations must be sorted by version, with no gaps. Never remove or modify
+// one which has been released; add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		// nothing to do. this just marks archives which were created before
+		// the schema was versioned.
+		Up: func(ctx context.Context, db *mongo.Database) error { return nil },
+	},
+	{
+		Version: 2,
+		Name:    "sstables-compound-index",
+		Up:      migrateCompoundIndex,
+	},
+	{
+		Version: 3,
+		Name:    "sstables-change-stream-pre-images",
+		Up:      migratePreImages,
+	},
+	{
+		Version: 4,
+		Name:    "sstables-levels",
+		Up:      migrateLevels,
+	},
+	{
+		Version: 5,
+		Name:    "sstables-time-windows",
+		Up:      migrateWindows,
+	},
+	{
+		Version: 6,
+		Name:    "sstables-list-indexes",
+		Up:      migrateListIndexes,
+	},
+	{
+		Version: 7,
+		Name:    "leases",
+		Up:      migrateLeases,
+	},
+	{
+		Version: 8,
+		Name:    "checkpoint-members",
+		Up:      migrateCheckpointMembers,
+	},
+}
+
+// SchemaVersion is the version of the metadata schema which this version of the
+// package reads and writes.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// GetSchemaVersion returns the version of the metadata schema currently stored,
+// or zero if it predates versioning.
+func (s *Store) GetSchemaVersion(ctx context.Context) (int, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value int `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaSchemaVersionID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return unversionedSchema, nil
+		}
+		return 0, fmt.Errorf("FindOne: %w", err)
+	}
+
+	return doc.Value, nil
+}
+
+func (s *Store) setSchemaVersion(ctx context.Context, db *mongo.Database, v int) error {
+	_, err := db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaSchemaVersionID},
+		bson.M{"$set": bson.M{"value": v}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// CheckSchema returns an error unless the stored metadata schema is exactly the
+// version supported by this package.
+func (s *Store) CheckSchema(ctx context.Context) error {
+	v, err := s.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if v > SchemaVersion {
+		return fmt.Errorf("%w: stored=%d, supported=%d", ErrSchemaTooNew, v, SchemaVersion)
+	}
+
+	if v < SchemaVersion {
+		return fmt.Errorf("%w: stored=%d, supported=%d", ErrSchemaTooOld, v, SchemaVersion)
+	}
+
+	return nil
+}
+
+// Migrate runs any migrations needed to bring the stored metadata schema up to
+// SchemaVersion, and returns those which were run. It refuses to touch metadata
+// which is newer than that.
+func (s *Store) Migrate(ctx context.Context) ([]Migration, error) {
+	return s.migrate(ctx, migrations)
+}
+
+func (s *Store) migrate(ctx context.Context, ms []Migration) ([]Migration, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	v, err := s.GetSchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := pendingMigrations(ms, v)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range pending {
+		err = m.Up(ctx, db)
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		err = s.setSchemaVersion(ctx, db, m.Version)
+		if err != nil {
+			return done, fmt.Errorf("setSchemaVersion(%d): %w", m.Version, err)
+		}
+
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// pendingMigrations returns the migrations which must be run, in order, to
+// upgrade from the given version to the latest one in ms.
+func pendingMigrations(ms []Migration, from int) ([]Migration, error) {
+	latest := ms[len(ms)-1].Version
+	if from > latest {
+		return nil, fmt.Errorf("%w: stored=%d, supported=%d", ErrSchemaTooNew, from, latest)
+	}
+
+	var pending []Migration
+	for i, m := range ms {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d (%s) is out of order", m.Version, m.Name)
+		}
+		if m.Version > from {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// oldKeyRangeIndex is the name of the index which was created by Init before the
+// schema was versioned. It's replaced by containingIndex.
+const oldKeyRangeIndex = "min_key_1_max_key_1"
+
+// containingIndex supports GetContaining: the key range for the filter, then
+// the fields it sorts by. It predates the largest_seq tie-breaker, so sstables
+// with the same max_time are sorted in memory, but there are few of those.
+var containingIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "min_key", Value: 1},
+		{Key: "max_key", Value: 1},
+		{Key: "max_time", Value: -1},
+		{Key: "created", Value: -1},
+	},
+}
+
+func migrateCompoundIndex(ctx context.Context, db *mongo.Database) error {
+	idx := db.Collection(collectionName).Indexes()
+
+	_, err := idx.CreateOne(ctx, containingIndex)
+	if err != nil {
+		return fmt.Errorf("CreateIndex: %w", err)
+	}
+
+	_, err = idx.DropOne(ctx, oldKeyRangeIndex)
+	if err != nil {
+		var ce mongo.CommandError
+		if errors.As(err, &ce) && ce.Name == "IndexNotFound" {
+			return nil
+		}
+		return fmt.Errorf("DropIndex: %w", err)
+	}
+
+	return nil
+}
+
+// migratePreImages enables pre-images on the sstables collection, so the
+// Watcher can tell which sstable was removed from delete events.
+func migratePreImages(ctx context.Context, db *mongo.Database) error {
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collectionName},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("collMod: %w", err)
+	}
+
+	return nil
+}
+
+// levelIndex supports finding the sstables in each level, e.g. for leveled
+// compaction.
+var levelIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "level", Value: 1},
+		{Key: "min_key", Value: 1},
+	},
+}
+
+// migrateLevels puts every existing sstable in level zero, generation zero, so
+// that they can be queried by level, and indexes them by level.
+func migrateLevels(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(collectionName)
+
+	for _, field := range []string{"level", "generation"} {
+		_, err := coll.UpdateMany(ctx,
+			bson.M{field: bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{field: 0}})
+		if err != nil {
+			return fmt.Errorf("UpdateMany(%s): %w", field, err)
+		}
+	}
+
+	_, err := coll.Indexes().CreateOne(ctx, levelIndex)
+	if err != nil {
+		return fmt.Errorf("CreateIndex: %w", err)
+	}
+
+	return nil
+}
+
+// windowIndex supports finding the sstables in the windows which might contain
+// a key. See Window.
+var windowIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "window", Value: 1},
+		{Key: "min_key", Value: 1},
+		{Key: "max_key", Value: 1},
+	},
+}
+
+// migrateWindows puts every existing sstable in the window of its creation
+// time, and builds the summaries of those windows.
+func migrateWindows(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(collectionName)
+
+	err := createCollection(ctx, db, windowsCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection(%s): %w", windowsCollectionName, err)
+	}
+
+	cur, err := coll.Find(ctx, bson.M{"window": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"created": 1}))
+	if err != nil {
+		return fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID      interface{} `bson:"_id"`
+			Created time.Time   `bson:"created"`
+		}
+		err = cur.Decode(&doc)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"window": windowOf(doc.Created)}})
+		if err != nil {
+			return fmt.Errorf("UpdateOne: %w", err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("cursor: %w", err)
+	}
+
+	_, err = coll.Indexes().CreateOne(ctx, windowIndex)
+	if err != nil {
+		return fmt.Errorf("CreateIndex: %w", err)
+	}
+
+	// if this was interrupted, some sstables already have a window, but their
+	// window might not have a summary yet. so rebuild every window in use.
+	vals, err := coll.Distinct(ctx, "window", bson.M{})
+	if err != nil {
+		return fmt.Errorf("Distinct: %w", err)
+	}
+
+	for _, v := range vals {
+		dt, ok := v.(primitive.DateTime)
+		if !ok {
+			continue
+		}
+
+		err = rebuildWindow(ctx, db, dt.Time())
+		if err != nil {
+			return fmt.Errorf("rebuildWindow(%s): %w", dt.Time(), err)
+		}
+	}
+
+	return nil
+}
+
+// listIndexes support the orders of EachMeta and ListMetas, so Mongo doesn't
+// need to sort the whole live set in memory, which it refuses to do beyond
+// 100MB.
+var listIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "min_key", Value: 1}, {Key: "_id", Value: 1}}},
+	{Keys: bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}},
+	{Keys: bson.D{{Key: "size", Value: 1}, {Key: "_id", Value: 1}}},
+}
+
+func migrateListIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(collectionName).Indexes().CreateMany(ctx, listIndexes)
+	if err != nil {
+		return fmt.Errorf("CreateMany: %w", err)
+	}
+
+	return nil
+}
+
+func migrateLeases(ctx context.Context, db *mongo.Database) error {
+	err := createCollection(ctx, db, leasesCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection(%s): %w", leasesCollectionName, err)
+	}
+
+	return nil
+}
+
+// migrateCheckpointMembers moves the sstables of each checkpoint out of the
+// metas array of the checkpoint document, and into the members collection,
+// referencing the sstable documents by their _id. Those which were purged since
+// the checkpoint was created are given a new _id, which Restore will insert
+// them with.
+func migrateCheckpointMembers(ctx context.Context, db *mongo.Database) error {
+	err := createCollection(ctx, db, checkpointMembersCollectionName)
+	if err != nil {
+		return fmt.Errorf("createCollection(%s): %w", checkpointMembersCollectionName, err)
+	}
+
+	members := db.Collection(checkpointMembersCollectionName)
+	_, err = members.Indexes().CreateMany(ctx, checkpointMemberIndexes)
+	if err != nil {
+		return fmt.Errorf("CreateMany: %w", err)
+	}
+
+	coll := db.Collection(checkpointsCollectionName)
+	cur, err := coll.Find(ctx, bson.M{"metas": bson.M{"$exists": true}})
+	if err != nil {
+		return fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc struct {
+			Name  string          `bson:"_id"`
+			Metas []*sstable.Meta `bson:"metas"`
+		}
+		err = cur.Decode(&doc)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		// if this was interrupted, some of the members might already exist.
+		_, err = members.DeleteMany(ctx, bson.M{"checkpoint": doc.Name})
+		if err != nil {
+			return fmt.Errorf("DeleteMany: %w", err)
+		}
+
+		var docs []interface{}
+		for _, m := range doc.Metas {
+			var found struct {
+				ID primitive.ObjectID `bson:"_id"`
+			}
+			err = db.Collection(collectionName).FindOne(ctx, bson.M{
+				"created": m.Created,
+				"min_key": m.MinKey,
+				"max_key": m.MaxKey,
+			}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&found)
+			if err == mongo.ErrNoDocuments {
+				found.ID = primitive.NewObjectID()
+			} else if err != nil {
+				return fmt.Errorf("FindOne: %w", err)
+			}
+
+			docs = append(docs, &checkpointMember{Checkpoint: doc.Name, SSTable: found.ID, Meta: *m})
+		}
+
+		if len(docs) > 0 {
+			_, err = members.InsertMany(ctx, docs)
+			if err != nil {
+				return fmt.Errorf("InsertMany: %w", err)
+			}
+		}
+
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": doc.Name}, bson.M{"$unset": bson.M{"metas": ""}})
+		if err != nil {
+			return fmt.Errorf("UpdateOne: %w", err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("cursor: %w", err)
+	}
+
+	return nil
+}
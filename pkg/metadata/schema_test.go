@@ -0,0 +1,85 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func noop(ctx context.Context, db *mongo.Database) error {
+	return nil
+}
+
+func TestPendingMigrations(t *testing.T) {
+	ms := []Migration{
+		{Version: 1, Name: "one", Up: noop},
+		{Version: 2, Name: "two", Up: noop},
+		{Version: 3, Name: "three", Up: noop},
+	}
+
+	pending, err := pendingMigrations(ms, 0)
+	require.NoError(t, err)
+	assert.Len(t, pending, 3)
+
+	pending, err = pendingMigrations(ms, 2)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "three", pending[0].Name)
+
+	pending, err = pendingMigrations(ms, 3)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	_, err = pendingMigrations(ms, 4)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+func TestPendingMigrationsOutOfOrder(t *testing.T) {
+	ms := []Migration{
+		{Version: 1, Name: "one", Up: noop},
+		{Version: 3, Name: "three", Up: noop},
+	}
+
+	_, err := pendingMigrations(ms, 0)
+	assert.Error(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx, store := setup(t)
+
+	// init brings new stores up to date.
+	v, err := store.GetSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaVersion, v)
+	require.NoError(t, store.CheckSchema(ctx))
+
+	// pretend that a newer version added a migration.
+	var ran int
+	ms := append(migrations, Migration{
+		Version: SchemaVersion + 1,
+		Name:    "add-something",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			ran++
+			return nil
+		},
+	})
+
+	done, err := store.migrate(ctx, ms)
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, 1, ran)
+
+	// it's only run once.
+	done, err = store.migrate(ctx, ms)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+	assert.Equal(t, 1, ran)
+
+	// and now this version refuses to use it.
+	assert.ErrorIs(t, store.CheckSchema(ctx), ErrSchemaTooNew)
+	_, err = store.Migrate(ctx)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
@@ -0,0 +1,41 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// metaSeqID is the ID of the doc in the meta collection which holds the last
+// sequence number which was allocated.
+const metaSeqID = "seq"
+
+// NextSeq allocates n consecutive sequence numbers, and returns the first. They
+// start at one, and are never reused, even if the caller doesn't use them.
+func (s *Store) NextSeq(ctx context.Context, n int64) (int64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("invalid number of sequence numbers: %d", n)
+	}
+
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOneAndUpdate(ctx,
+		bson.M{"_id": metaSeqID},
+		bson.M{"$inc": bson.M{"seq": n}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, fmt.Errorf("FindOneAndUpdate: %w", err)
+	}
+
+	return doc.Seq - n + 1, nil
+}
@@ -0,0 +1,22 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextSeq(t *testing.T) {
+	ctx, store := setup(t)
+
+	seq, err := store.NextSeq(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), seq)
+
+	seq, err = store.NextSeq(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(11), seq)
+
+	_, err = store.NextSeq(ctx, 0)
+	require.Error(t, err)
+}
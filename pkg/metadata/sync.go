@@ -0,0 +1,74 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const metaSyncPrefix = "sync:"
+
+// SyncCursor returns the time which the sync with the given name has copied
+// every record before, and false if it hasn't started.
+func (s *Store) SyncCursor(ctx context.Context, name string) (time.Time, bool, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Value time.Time `bson:"value"`
+	}
+
+	err = db.Collection(metaCollectionName).FindOne(ctx, bson.M{"_id": metaSyncPrefix + name}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, fmt.Errorf("FindOne: %w", err)
+	}
+
+	return doc.Value, true, nil
+}
+
+// SetSyncCursor advances the cursor of the sync with the given name to t. It's
+// never moved backwards, so concurrent syncs can't undo each other. The time is
+// truncated to milliseconds, which only makes the sync repeat some records.
+func (s *Store) SetSyncCursor(ctx context.Context, name string, t time.Time) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(metaCollectionName).UpdateOne(
+		ctx,
+		bson.M{"_id": metaSyncPrefix + name},
+		bson.M{"$max": bson.M{"value": t}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateOne: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteSyncCursor forgets the sync with the given name, so it starts over with
+// a full copy next time.
+func (s *Store) DeleteSyncCursor(ctx context.Context, name string) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	_, err = db.Collection(metaCollectionName).DeleteOne(ctx, bson.M{"_id": metaSyncPrefix + name})
+	if err != nil {
+		return fmt.Errorf("DeleteOne: %w", err)
+	}
+
+	return nil
+}
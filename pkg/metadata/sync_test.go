@@ -0,0 +1,33 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncCursor(t *testing.T) {
+	ctx, store := setup(t)
+	t0 := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	_, ok, err := store.SyncCursor(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.SetSyncCursor(ctx, "a", t0.Add(time.Minute)))
+
+	// never moves backwards.
+	require.NoError(t, store.SetSyncCursor(ctx, "a", t0))
+
+	c, ok, err := store.SyncCursor(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, t0.Add(time.Minute).Equal(c))
+
+	require.NoError(t, store.DeleteSyncCursor(ctx, "a"))
+	_, ok, err = store.SyncCursor(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
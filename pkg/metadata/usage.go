@@ -0,0 +1,75 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const usageCollectionName = "usage"
+
+// AddUsage adds n (which may be negative) to the usage counter with the given
+// ID, unless that would take it over max, in which case it returns false and
+// the counter is unchanged. A max of zero is unlimited. Counters which don't
+// exist yet start at zero.
+func (s *Store) AddUsage(ctx context.Context, id string, n, max int64) (bool, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("getMongo: %w", err)
+	}
+
+	coll := db.Collection(usageCollectionName)
+	filter := bson.M{"_id": id}
+	if max > 0 {
+		filter["bytes"] = bson.M{"$lte": max - n}
+	}
+
+	res, err := coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"bytes": n}})
+	if err != nil {
+		return false, fmt.Errorf("UpdateOne: %w", err)
+	}
+	if res.MatchedCount == 1 {
+		return true, nil
+	}
+
+	// either the counter doesn't exist yet, or it's full. try to create it,
+	// which fails if it already exists.
+	if max > 0 && n > max {
+		return false, nil
+	}
+
+	_, err = coll.InsertOne(ctx, bson.M{"_id": id, "bytes": n})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("InsertOne: %w", err)
+	}
+
+	return true, nil
+}
+
+// GetUsage returns the value of the usage counter with the given ID, or zero if
+// it doesn't exist.
+func (s *Store) GetUsage(ctx context.Context, id string) (int64, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getMongo: %w", err)
+	}
+
+	var doc struct {
+		Bytes int64 `bson:"bytes"`
+	}
+
+	err = db.Collection(usageCollectionName).FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("FindOne: %w", err)
+	}
+
+	return doc.Bytes, nil
+}
@@ -0,0 +1,46 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddUsage(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo())
+	s := New(env.MongoURL(), "test")
+	require.NoError(t, s.Init(ctx))
+
+	ok, err := s.AddUsage(ctx, "a", 11, 10)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.AddUsage(ctx, "a", 6, 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.AddUsage(ctx, "a", 5, 10)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.AddUsage(ctx, "a", 4, 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// refunds, and unlimited counters.
+	ok, err = s.AddUsage(ctx, "a", -3, 0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	n, err := s.GetUsage(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+
+	n, err = s.GetUsage(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
@@ -0,0 +1,329 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type EventType int
+
+const (
+	// SSTableAdded is emitted when an sstable is added to the live set, by a
+	// flush, compaction, or restore. It's also emitted when the metadata of a
+	// live sstable is changed (e.g. by SetIndex), in which case the Meta
+	// replaces the previous version.
+	SSTableAdded EventType = iota
+
+	// SSTableRemoved is emitted when an sstable is removed from the live set,
+	// by a compaction or restore.
+	SSTableRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case SSTableAdded:
+		return "added"
+	case SSTableRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+type Event struct {
+	Type EventType
+	Meta *sstable.Meta
+}
+
+// Watcher maintains an in-memory copy of the live set of sstables, which is
+// kept up to date by watching the metadata store for changes made by any
+// process. This is useful when several processes share an archive.
+type Watcher struct {
+	s       *Store
+	onEvent func(Event)
+
+	mu    sync.RWMutex
+	metas map[string]*sstable.Meta // by filename
+	index keyIndex
+	ready chan struct{}
+}
+
+// NewWatcher returns a watcher which calls onEvent (if not nil) for every
+// change to the live set, after updating its own copy. Call Run to start it.
+func (s *Store) NewWatcher(onEvent func(Event)) *Watcher {
+	return &Watcher{
+		s:       s,
+		onEvent: onEvent,
+		metas:   map[string]*sstable.Meta{},
+		ready:   make(chan struct{}),
+	}
+}
+
+// Run loads the live set, then watches for changes until the context is
+// cancelled or the change stream fails. It should only be called once.
+func (w *Watcher) Run(ctx context.Context) error {
+	db, err := w.s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	// open the stream before loading the live set, so we don't miss anything
+	// in between. changes which are already reflected in the initial load are
+	// idempotent when applied again.
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "delete"}}}}},
+	}
+
+	cs, err := db.Collection(collectionName).Watch(ctx, pipeline, opts)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+	defer cs.Close(ctx)
+
+	metas, err := w.s.GetAllMetas(ctx)
+	if err != nil {
+		return fmt.Errorf("GetAllMetas: %w", err)
+	}
+
+	w.mu.Lock()
+	for _, m := range metas {
+		w.put(m)
+	}
+	w.mu.Unlock()
+	close(w.ready)
+
+	for cs.Next(ctx) {
+		var ce struct {
+			OperationType string   `bson:"operationType"`
+			After         bson.Raw `bson:"fullDocument"`
+			Before        bson.Raw `bson:"fullDocumentBeforeChange"`
+		}
+
+		err = cs.Decode(&ce)
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		// sstables are removed from the live set by soft-deleting them, which
+		// is an update. the actual delete happens later, when they're purged,
+		// so can be ignored unless they were somehow deleted while live. other
+		// updates (to the index, or un-deleting by restore) leave the sstable
+		// live, so replace whatever we have.
+		var typ EventType
+		var doc bson.Raw
+		switch ce.OperationType {
+		case "insert":
+			typ, doc = SSTableAdded, ce.After
+		case "update":
+			if ce.After == nil {
+				continue
+			}
+			typ, doc = SSTableAdded, ce.After
+			if isSoftDeleted(ce.After) {
+				typ = SSTableRemoved
+			}
+		case "delete":
+			if ce.Before == nil {
+				return fmt.Errorf("delete event without pre-image; is the schema up to date?")
+			}
+			if isSoftDeleted(ce.Before) {
+				continue
+			}
+			typ, doc = SSTableRemoved, ce.Before
+		default:
+			continue
+		}
+
+		var m sstable.Meta
+		err = bson.Unmarshal(doc, &m)
+		if err != nil {
+			return fmt.Errorf("Unmarshal: %w", err)
+		}
+
+		ev := Event{Type: typ, Meta: &m}
+		w.apply(ev)
+		if w.onEvent != nil {
+			w.onEvent(ev)
+		}
+	}
+
+	return cs.Err()
+}
+
+func (w *Watcher) apply(ev Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch ev.Type {
+	case SSTableAdded:
+		w.put(ev.Meta)
+	case SSTableRemoved:
+		w.remove(ev.Meta.Filename())
+	}
+}
+
+// put adds the given sstable, or replaces it if it's already present. The lock
+// must be held.
+func (w *Watcher) put(m *sstable.Meta) {
+	fn := m.Filename()
+	w.remove(fn)
+	w.metas[fn] = m
+	w.index.insert(m)
+}
+
+// remove removes the sstable with the given filename, if it's present. The lock
+// must be held.
+func (w *Watcher) remove(fn string) {
+	m, ok := w.metas[fn]
+	if !ok {
+		return
+	}
+	delete(w.metas, fn)
+	w.index.delete(m)
+}
+
+// Ready returns a channel which is closed once the initial live set has been
+// loaded, after which the other methods return useful answers.
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// GetContaining is like Store.GetContaining, but is served from memory, so may
+// be slightly behind.
+func (w *Watcher) GetContaining(key string) []*sstable.Meta {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.index.containing(key)
+}
+
+// containing returns the sstables from the given set whose key range contains
+// the given key, in the same order as Store.GetContaining.
+func containing(set iter.Seq[*sstable.Meta], key string) []*sstable.Meta {
+	var metas []*sstable.Meta
+	for m := range set {
+		if m.MinKey <= key && key <= m.MaxKey {
+			metas = append(metas, m)
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return newer(metas[i], metas[j])
+	})
+
+	return metas
+}
+
+// Len returns the number of sstables in the live set.
+func (w *Watcher) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.metas)
+}
+
+// newer returns true if a sorts before b in the order of Store.GetContaining.
+func newer(a, b *sstable.Meta) bool {
+	if !a.MaxTime.Equal(b.MaxTime) {
+		return a.MaxTime.After(b.MaxTime)
+	}
+	if a.LargestSeq != b.LargestSeq {
+		return a.LargestSeq > b.LargestSeq
+	}
+	return a.Created.After(b.Created)
+}
+
+func isSoftDeleted(doc bson.Raw) bool {
+	_, err := doc.LookupErr("deleted_at")
+	return err == nil
+}
+
+// keyIndex is a set of sstables ordered by MinKey, so those whose range
+// contains a key can be found without looking at every one. It's updated in
+// place as sstables are added and removed, which is much less frequent than
+// reads.
+type keyIndex struct {
+	metas []*sstable.Meta // by MinKey, then Filename
+
+	// reach[i] is the greatest MaxKey of metas[:i+1], so the search for the
+	// sstables containing a key can stop as soon as it's less than that key.
+	reach []string
+}
+
+// find returns the position of the given sstable in the index, and whether
+// it's there.
+func (x *keyIndex) find(m *sstable.Meta) (int, bool) {
+	fn := m.Filename()
+	return slices.BinarySearchFunc(x.metas, m, func(a, b *sstable.Meta) int {
+		if c := strings.Compare(a.MinKey, b.MinKey); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Filename(), fn)
+	})
+}
+
+func (x *keyIndex) insert(m *sstable.Meta) {
+	i, _ := x.find(m)
+	x.metas = slices.Insert(x.metas, i, m)
+	x.reach = slices.Insert(x.reach, i, "")
+	x.extend(i)
+}
+
+func (x *keyIndex) delete(m *sstable.Meta) {
+	i, ok := x.find(m)
+	if !ok {
+		return
+	}
+	x.metas = slices.Delete(x.metas, i, i+1)
+	x.reach = slices.Delete(x.reach, i, i+1)
+	x.extend(i)
+}
+
+// extend recomputes reach from i onwards.
+func (x *keyIndex) extend(i int) {
+	for ; i < len(x.metas); i++ {
+		r := x.metas[i].MaxKey
+		if i > 0 && x.reach[i-1] > r {
+			r = x.reach[i-1]
+		}
+		x.reach[i] = r
+	}
+}
+
+// containing returns the sstables whose key range contains the given key, in
+// the same order as Store.GetContaining.
+func (x *keyIndex) containing(key string) []*sstable.Meta {
+
+	// the sstables after this start after the key.
+	n, _ := slices.BinarySearchFunc(x.metas, key, func(m *sstable.Meta, k string) int {
+		if m.MinKey <= k {
+			return -1
+		}
+		return 1
+	})
+
+	var metas []*sstable.Meta
+	for i := n - 1; i >= 0 && x.reach[i] >= key; i-- {
+		if x.metas[i].MaxKey >= key {
+			metas = append(metas, x.metas[i])
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return newer(metas[i], metas[j])
+	})
+
+	return metas
+}
@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyIndex(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := rand.New(rand.NewSource(1))
+	w := &Watcher{metas: map[string]*sstable.Meta{}}
+
+	key := func() string {
+		return fmt.Sprintf("%02d", r.Intn(50))
+	}
+
+	// random adds, replacements, and removals, checked against the linear
+	// search which the manifest uses.
+	for i := 0; i < 2000; i++ {
+		min, max := key(), key()
+		if max < min {
+			min, max = max, min
+		}
+		m := &sstable.Meta{
+			MinKey:     min,
+			MaxKey:     max,
+			MaxTime:    now.Add(time.Duration(r.Intn(10)) * time.Second),
+			LargestSeq: int64(r.Intn(10)),
+			Created:    now.Add(time.Duration(r.Intn(100)) * time.Millisecond),
+		}
+
+		if r.Intn(3) == 0 {
+			w.remove(m.Filename())
+		} else {
+			w.put(m)
+		}
+
+		k := key()
+		want := containing(func(yield func(*sstable.Meta) bool) {
+			for _, m := range w.metas {
+				if !yield(m) {
+					return
+				}
+			}
+		}, k)
+		got := w.index.containing(k)
+		assert.Equal(t, filenames(want), filenames(got), "key=%s", k)
+	}
+
+	assert.Equal(t, len(w.metas), len(w.index.metas))
+}
+
+func filenames(metas []*sstable.Meta) []string {
+	out := make([]string, len(metas))
+	for i, m := range metas {
+		out[i] = m.Filename()
+	}
+	return out
+}
@@ -0,0 +1,216 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const windowsCollectionName = "sstable_windows"
+
+// WindowWidth is the span of creation times which share a window. Every sstable
+// belongs to the window containing its Created time.
+const WindowWidth = 24 * time.Hour
+
+// Window summarizes the sstables created during one WindowWidth, so that
+// queries by key can skip whole windows which can't contain it, rather than
+// scanning the index of every sstable ever created. Archives with lots of
+// sstables tend to have keys which correlate with time (e.g. logs), so most
+// windows cover a narrow range.
+//
+// The summary is widened whenever an sstable is added to the window, but isn't
+// narrowed when one is removed, until RebuildWindows is called. So it's always
+// a superset of the live sstables in it.
+type Window struct {
+	Start time.Time `bson:"_id"`
+
+	// The union of the key ranges, and the newest record, of the sstables.
+	MinKey  string    `bson:"min_key"`
+	MaxKey  string    `bson:"max_key"`
+	MaxTime time.Time `bson:"max_time"`
+
+	// The number of sstables, which is only exact after RebuildWindows.
+	Count int `bson:"count"`
+}
+
+// windowOf returns the start of the window containing the given time.
+func windowOf(t time.Time) time.Time {
+	return t.UTC().Truncate(WindowWidth)
+}
+
+// windowedMeta is the document stored in the sstables collection: the Meta,
+// plus the window which it belongs to, which isn't part of the Meta since only
+// the metadata store cares about it.
+type windowedMeta struct {
+	sstable.Meta `bson:",inline"`
+	Window       time.Time `bson:"window"`
+}
+
+// windowedDocs returns the documents to insert into the sstables collection for
+// the given sstables.
+func windowedDocs(metas []*sstable.Meta) []interface{} {
+	docs := make([]interface{}, len(metas))
+	for i, m := range metas {
+		docs[i] = &windowedMeta{Meta: *m, Window: windowOf(m.Created)}
+	}
+	return docs
+}
+
+// widenWindows updates the summaries of the windows of the given sstables to
+// include them, creating them if necessary. It must be done in the same
+// transaction as inserting the sstables, or before, so no sstable is ever in a
+// window which doesn't cover it.
+func widenWindows(ctx context.Context, db *mongo.Database, metas []*sstable.Meta) error {
+	coll := db.Collection(windowsCollectionName)
+
+	for _, m := range metas {
+		_, err := coll.UpdateOne(ctx, bson.M{"_id": windowOf(m.Created)}, bson.M{
+			"$min": bson.M{"min_key": m.MinKey},
+			"$max": bson.M{"max_key": m.MaxKey, "max_time": m.MaxTime},
+			"$inc": bson.M{"count": 1},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("UpdateOne: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// inWindows adds a condition to the given sstables filter, to only match those
+// in the windows whose summaries match the given windows filter, which must
+// have the same conditions on min_key and max_key. It returns false if no
+// windows match, so there's no need to run the query at all.
+func inWindows(ctx context.Context, db *mongo.Database, sstables, windows bson.M) (bool, error) {
+	cur, err := db.Collection(windowsCollectionName).Find(ctx, windows, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return false, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var ws []Window
+	if err := cur.All(ctx, &ws); err != nil {
+		return false, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	if len(ws) == 0 {
+		return false, nil
+	}
+
+	starts := make([]time.Time, len(ws))
+	for i, w := range ws {
+		starts[i] = w.Start
+	}
+
+	sstables["window"] = bson.M{"$in": starts}
+	return true, nil
+}
+
+// GetWindows returns the summary of every window which might contain a live
+// sstable, oldest first.
+func (s *Store) GetWindows(ctx context.Context) ([]*Window, error) {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getMongo: %w", err)
+	}
+
+	cur, err := db.Collection(windowsCollectionName).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("Find: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var ws []*Window
+	if err := cur.All(ctx, &ws); err != nil {
+		return nil, fmt.Errorf("cursor.All: %w", err)
+	}
+
+	return ws, nil
+}
+
+// RebuildWindows narrows the summary of every window to cover only the live
+// sstables in it, and removes those which don't have any. It should be called
+// now and then (e.g. after purging), since compactions move sstables out of old
+// windows, but their summaries are never narrowed otherwise.
+func (s *Store) RebuildWindows(ctx context.Context) error {
+	db, err := s.getMongo(ctx)
+	if err != nil {
+		return fmt.Errorf("getMongo: %w", err)
+	}
+
+	ws, err := s.GetWindows(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range ws {
+		err = rebuildWindow(ctx, db, w.Start)
+		if err != nil {
+			return fmt.Errorf("rebuildWindow(%s): %w", w.Start, err)
+		}
+	}
+
+	return nil
+}
+
+// rebuildWindow replaces the summary of the given window with one computed
+// from the live sstables in it. It's done in a transaction, so if an sstable is
+// added to the window concurrently, one of them is retried, rather than the new
+// sstable being left out of the summary.
+func rebuildWindow(ctx context.Context, db *mongo.Database, start time.Time) error {
+	sess, err := db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("StartSession: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		cur, err := db.Collection(collectionName).Aggregate(sc, mongo.Pipeline{
+			{{Key: "$match", Value: live(bson.M{"window": start})}},
+			{{Key: "$group", Value: bson.M{
+				"_id":      nil,
+				"min_key":  bson.M{"$min": "$min_key"},
+				"max_key":  bson.M{"$max": "$max_key"},
+				"max_time": bson.M{"$max": "$max_time"},
+				"count":    bson.M{"$sum": 1},
+			}}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Aggregate: %w", err)
+		}
+
+		var res []*Window
+		err = cur.All(sc, &res)
+		if err != nil {
+			return nil, fmt.Errorf("cursor.All: %w", err)
+		}
+
+		coll := db.Collection(windowsCollectionName)
+		if len(res) == 0 {
+			_, err = coll.DeleteOne(sc, bson.M{"_id": start})
+			if err != nil {
+				return nil, fmt.Errorf("DeleteOne: %w", err)
+			}
+			return nil, nil
+		}
+
+		w := res[0]
+		w.Start = start
+		_, err = coll.ReplaceOne(sc, bson.M{"_id": start}, w, options.Replace().SetUpsert(true))
+		if err != nil {
+			return nil, fmt.Errorf("ReplaceOne: %w", err)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("WithTransaction: %w", err)
+	}
+
+	return nil
+}
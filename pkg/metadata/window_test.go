@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/sstable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWindowOf(t *testing.T) {
+	day := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, day, windowOf(day))
+	assert.Equal(t, day, windowOf(day.Add(23*time.Hour+59*time.Minute)))
+	assert.Equal(t, day.Add(WindowWidth), windowOf(day.Add(WindowWidth)))
+
+	// windows are in UTC, whatever the zone of the time.
+	est := time.FixedZone("EST", -5*60*60)
+	assert.Equal(t, day, windowOf(time.Date(2025, 1, 10, 18, 0, 0, 0, est)))
+}
+
+func TestWindows(t *testing.T) {
+	ctx, store := setup(t)
+	d0 := windowOf(time.Now()).Add(-2 * WindowWidth)
+	d1 := d0.Add(WindowWidth)
+
+	meta := func(min, max string, created time.Time) *sstable.Meta {
+		return &sstable.Meta{MinKey: min, MaxKey: max, MaxTime: created, Created: created}
+	}
+
+	// two days of sstables, with keys which correlate with time.
+	a := meta("2025-01-01/a", "2025-01-01/m", d0.Add(time.Hour))
+	b := meta("2025-01-01/n", "2025-01-01/z", d0.Add(2*time.Hour))
+	c := meta("2025-01-02/a", "2025-01-02/z", d1.Add(time.Hour))
+	for _, m := range []*sstable.Meta{a, b, c} {
+		require.NoError(t, store.Insert(ctx, m))
+	}
+
+	ws, err := store.GetWindows(ctx)
+	require.NoError(t, err)
+	require.Len(t, ws, 2)
+	assert.Equal(t, Window{Start: d0, MinKey: "2025-01-01/a", MaxKey: "2025-01-01/z", MaxTime: b.MaxTime, Count: 2}, *ws[0])
+	assert.Equal(t, Window{Start: d1, MinKey: "2025-01-02/a", MaxKey: "2025-01-02/z", MaxTime: c.MaxTime, Count: 1}, *ws[1])
+
+	// every sstable is in the window of its creation time.
+	db, err := store.getMongo(ctx)
+	require.NoError(t, err)
+	n, err := db.Collection(collectionName).CountDocuments(ctx, bson.M{"window": d0})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// queries still find everything.
+	metas, err := store.GetContaining(ctx, "2025-01-01/b")
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.Equal(t, a.Filename(), metas[0].Filename())
+
+	metas, err = store.GetOverlapping(ctx, "2025-01-01/x", "2025-01-02/b")
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+
+	metas, err = store.GetContaining(ctx, "2025-01-03/a")
+	require.NoError(t, err)
+	assert.Empty(t, metas)
+
+	// replace a and b with a compaction output, which lands in today's window.
+	out := meta("2025-01-01/a", "2025-01-01/z", time.Now().UTC().Truncate(time.Millisecond))
+	p := &PendingCompaction{Owner: "x", Created: out.Created, Inputs: []*sstable.Meta{a, b}, Outputs: []*sstable.Meta{out}}
+	require.NoError(t, store.PrepareCompaction(ctx, p))
+	require.NoError(t, store.CommitCompaction(ctx, p, out.Created))
+
+	metas, err = store.GetContaining(ctx, "2025-01-01/b")
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.Equal(t, out.Filename(), metas[0].Filename())
+
+	// the summary of the first window isn't narrowed until it's rebuilt. then
+	// it's removed, since it's empty.
+	ws, err = store.GetWindows(ctx)
+	require.NoError(t, err)
+	require.Len(t, ws, 3)
+
+	require.NoError(t, store.RebuildWindows(ctx))
+	ws, err = store.GetWindows(ctx)
+	require.NoError(t, err)
+	require.Len(t, ws, 2)
+	assert.Equal(t, d1, ws[0].Start)
+	assert.Equal(t, windowOf(out.Created), ws[1].Start)
+	assert.Equal(t, 1, ws[1].Count)
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	var got []byte
+	var sig string
+	status := http.StatusNoContent
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		got, _ = io.ReadAll(r.Body)
+		sig = r.Header.Get(SignatureHeader)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	body := []byte(`{"type":"flush"}`)
+
+	w := NewWebhook(srv.URL)
+	require.NoError(t, w.Publish(ctx, body))
+	assert.Equal(t, body, got)
+	assert.Empty(t, sig)
+
+	w.Secret = "hunter2"
+	require.NoError(t, w.Publish(ctx, body))
+	assert.Equal(t, Sign("hunter2", body), sig)
+	assert.True(t, strings.HasPrefix(sig, "sha256="))
+
+	status = http.StatusBadGateway
+	assert.ErrorContains(t, w.Publish(ctx, body), "502 Bad Gateway")
+}
+
+func TestSNS(t *testing.T) {
+	var form url.Values
+	var auth string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+
+		if form.Get("TopicArn") == "arn:aws:sns:us-east-1:123456789012:missing" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<ErrorResponse><Error><Code>NotFound</Code></Error></ErrorResponse>")
+		}
+	}))
+	defer srv.Close()
+
+	s := &SNS{
+		TopicARN:    "arn:aws:sns:us-east-1:123456789012:sstables",
+		Region:      "us-east-1",
+		Endpoint:    srv.URL,
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+
+	ctx := context.Background()
+	require.NoError(t, s.Publish(ctx, []byte(`{"type":"flush"}`)))
+	assert.Equal(t, "Publish", form.Get("Action"))
+	assert.Equal(t, s.TopicARN, form.Get("TopicArn"))
+	assert.Equal(t, `{"type":"flush"}`, form.Get("Message"))
+	assert.Contains(t, auth, "AWS4-HMAC-SHA256 Credential=AKID/")
+	assert.Contains(t, auth, "/us-east-1/sns/aws4_request")
+
+	s.TopicARN = "arn:aws:sns:us-east-1:123456789012:missing"
+	assert.ErrorContains(t, s.Publish(ctx, []byte(`{}`)), "NotFound")
+}
+
+func TestArnRegion(t *testing.T) {
+	r, err := arnRegion("arn:aws:sns:eu-west-2:123456789012:topic")
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-2", r)
+
+	for _, arn := range []string{"", "topic", "arn:aws:sqs:eu-west-2:123456789012:queue", "arn:aws:sns::123456789012:topic"} {
+		_, err := arnRegion(arn)
+		assert.Error(t, err, arn)
+	}
+}
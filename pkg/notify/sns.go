@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// SNS publishes notifications to an SNS topic, from which they can be fanned
+// out to SQS queues, Lambdas, etc. It speaks the SNS query API directly, signed
+// with the usual AWS credentials, to avoid depending on the whole SNS SDK.
+type SNS struct {
+	TopicARN string
+	Region   string
+
+	// The endpoint to send requests to. Defaults to the public SNS endpoint of
+	// the Region, but can be changed e.g. to use a local emulator.
+	Endpoint string
+
+	Credentials aws.CredentialsProvider
+
+	// The client used to send requests. http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// NewSNS returns an SNS publisher for the topic with the given ARN, using the
+// default AWS credentials (the same ones used to access S3). The region is
+// taken from the ARN.
+func NewSNS(ctx context.Context, topicARN string) (*SNS, error) {
+	region, err := arnRegion(topicARN)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("config.LoadDefaultConfig: %w", err)
+	}
+
+	return &SNS{
+		TopicARN:    topicARN,
+		Region:      region,
+		Endpoint:    fmt.Sprintf("https://sns.%s.amazonaws.com/", region),
+		Credentials: cfg.Credentials,
+	}, nil
+}
+
+// arnRegion returns the region from an SNS topic ARN, which looks like:
+// arn:aws:sns:us-east-1:123456789012:topic-name
+func arnRegion(arn string) (string, error) {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return "", fmt.Errorf("invalid SNS topic ARN: %q", arn)
+	}
+
+	return parts[3], nil
+}
+
+func (s *SNS) Publish(ctx context.Context, body []byte) error {
+	form := url.Values{}
+	form.Set("Action", "Publish")
+	form.Set("Version", "2010-03-31")
+	form.Set("TopicArn", s.TopicARN)
+	form.Set("Message", string(body))
+	payload := form.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, strings.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds, err := s.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("Credentials.Retrieve: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(payload))
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "sns", s.Region, time.Now())
+	if err != nil {
+		return fmt.Errorf("SignHTTP: %w", err)
+	}
+
+	c := s.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("sns.Publish(%s): %w", s.TopicARN, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("sns.Publish(%s): %s: %s", s.TopicARN, res.Status, excerpt(res.Body))
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Package notify contains publishers which send notifications of events from
+// an archive (see blobby.WithPublisher) to external systems, such as a data
+// catalog or an ETL pipeline which wants to know when new sstables land.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SignatureHeader is the header which contains the signature of the body of
+// each webhook request, if the Webhook has a Secret. It's the hex-encoded
+// HMAC-SHA256 of the body, keyed with the secret, prefixed with "sha256=".
+const SignatureHeader = "X-Blobby-Signature"
+
+// Webhook publishes notifications by POSTing them as JSON to a URL. Any
+// response other than a 2xx is an error.
+type Webhook struct {
+	URL string
+
+	// If set, each request is signed with this (see SignatureHeader), so the
+	// receiver can check that it came from us.
+	Secret string
+
+	// The client used to send requests. http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// NewWebhook returns a Webhook which posts to the given URL.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url}
+}
+
+func (w *Webhook) Publish(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	c := w.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", w.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s: %s", w.URL, res.Status, excerpt(res.Body))
+	}
+
+	return nil
+}
+
+// Sign returns the value of the SignatureHeader for the given body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// excerpt returns the start of the given response body, to include in errors.
+func excerpt(r io.Reader) string {
+	b, _ := io.ReadAll(io.LimitReader(r, 512))
+	return string(bytes.TrimSpace(b))
+}
@@ -0,0 +1,131 @@
+package rocksdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// This package reads and writes the block-based table format of RocksDB's SST
+// files, without depending on RocksDB, so that archives can be bulk-loaded into
+// RocksDB (e.g. with IngestExternalFile) and vice versa.
+//
+// A table is a sequence of blocks, each followed by a five byte trailer: the
+// compression type, then a masked CRC32C of the block and that byte. Data blocks
+// hold the entries, prefix-compressed like sstable.FormatBlocks, with restart
+// offsets at the end. The index block has an entry for each data block, whose
+// key is at least the last key in it, and whose value is its BlockHandle. The
+// metaindex block maps the names of the other meta blocks (only the properties
+// are needed) to their handles. The footer, at the very end, holds the handles
+// of the metaindex and index blocks.
+//
+// Keys in the table are "internal keys": the user key, then eight bytes holding
+// the sequence number and the type of the entry. See InternalKey.
+
+const (
+	// The magic numbers at the end of the footer.
+	magicLegacy uint64 = 0xdb4775248b80fb57
+	magic       uint64 = 0x88e241b785f4cff7
+
+	// The length of the footer, in the legacy format (format_version 0) and
+	// in the newer one (1 to 5).
+	footerLenLegacy = 2*maxHandleLen + 8
+	footerLen       = 1 + 2*maxHandleLen + 4 + 8
+
+	// FormatVersion is the format_version of the tables which Writer writes.
+	// Versions 2 and up are readable by every supported release of RocksDB.
+	FormatVersion = 2
+
+	// The most format_version which Reader can read. Version 6 moved the
+	// index handle out of the footer, and changed the checksums.
+	maxFormatVersion = 5
+
+	maxHandleLen = 2 * binary.MaxVarintLen64
+	trailerLen   = 5
+
+	checksumCRC32C = 1
+
+	// BytewiseComparator is the only comparator supported, which sorts keys
+	// like bytes.Compare. It's RocksDB's default.
+	BytewiseComparator = "leveldb.BytewiseComparator"
+)
+
+// ValueType is the kind of entry in a table.
+type ValueType byte
+
+const (
+	TypeDeletion       ValueType = 0x0
+	TypeValue          ValueType = 0x1
+	TypeMerge          ValueType = 0x2
+	TypeSingleDeletion ValueType = 0x7
+)
+
+// Compression types, from the block trailers.
+const (
+	noCompression     = 0x0
+	snappyCompression = 0x1
+	zlibCompression   = 0x2
+	zstdCompression   = 0x7
+)
+
+var ErrCorrupt = errors.New("corrupt rocksdb table")
+
+// InternalKey is a key in a table, with the sequence number of the write and
+// the type of the entry.
+type InternalKey struct {
+	UserKey []byte
+	Seq     uint64
+	Type    ValueType
+}
+
+func (ik InternalKey) encode() []byte {
+	b := make([]byte, len(ik.UserKey)+8)
+	copy(b, ik.UserKey)
+	binary.LittleEndian.PutUint64(b[len(ik.UserKey):], ik.Seq<<8|uint64(ik.Type))
+	return b
+}
+
+func parseInternalKey(b []byte) (InternalKey, error) {
+	if len(b) < 8 {
+		return InternalKey{}, fmt.Errorf("%w: internal key too short", ErrCorrupt)
+	}
+
+	n := len(b) - 8
+	tr := binary.LittleEndian.Uint64(b[n:])
+	return InternalKey{UserKey: b[:n], Seq: tr >> 8, Type: ValueType(tr & 0xff)}, nil
+}
+
+// blockHandle is the location of a block, not including its trailer.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) encode(b []byte) []byte {
+	b = binary.AppendUvarint(b, h.offset)
+	return binary.AppendUvarint(b, h.size)
+}
+
+func decodeHandle(b []byte) (blockHandle, int, error) {
+	off, n := binary.Uvarint(b)
+	if n <= 0 {
+		return blockHandle{}, 0, fmt.Errorf("%w: bad block handle", ErrCorrupt)
+	}
+
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return blockHandle{}, 0, fmt.Errorf("%w: bad block handle", ErrCorrupt)
+	}
+
+	return blockHandle{off, size}, n + m, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maskedCRC returns the checksum in a block trailer, of the given block and its
+// compression type.
+func maskedCRC(block []byte, typ byte) uint32 {
+	c := crc32.Update(crc32.Checksum(block, castagnoli), castagnoli, []byte{typ})
+	return (c>>15 | c<<17) + 0xa282ead8
+}
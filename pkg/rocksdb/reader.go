@@ -0,0 +1,387 @@
+package rocksdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Reader reads a RocksDB table written with the block-based table format, a
+// format_version up to 5, the bytewise comparator, and a binary search index,
+// which are the defaults in most releases. Blocks can be uncompressed, or
+// compressed with Snappy, zlib, or Zstandard. Filters and range deletions are
+// ignored, but see RangeDeletions.
+type Reader struct {
+	r       io.ReaderAt
+	size    int64
+	version uint32
+	crc     bool
+	index   blockHandle
+	props   map[string][]byte
+
+	// true if the index block doesn't store the lengths of its values, and
+	// only the first handle after each restart point is stored in full.
+	deltaIndex bool
+}
+
+// NewReader reads the footer and properties of the table in r, which is size
+// bytes long.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < footerLenLegacy {
+		return nil, fmt.Errorf("%w: too short", ErrCorrupt)
+	}
+
+	n := int64(footerLen)
+	if size < n {
+		n = footerLenLegacy
+	}
+
+	buf := make([]byte, n)
+	_, err := r.ReadAt(buf, size-n)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAt: %w", err)
+	}
+
+	rd := &Reader{r: r, size: size}
+	var handles []byte
+
+	switch binary.LittleEndian.Uint64(buf[n-8:]) {
+	case magicLegacy:
+		rd.crc = true
+		handles = buf[n-footerLenLegacy:]
+
+	case magic:
+		if n < footerLen {
+			return nil, fmt.Errorf("%w: too short", ErrCorrupt)
+		}
+		rd.version = binary.LittleEndian.Uint32(buf[footerLen-12:])
+		if rd.version > maxFormatVersion {
+			return nil, fmt.Errorf("unsupported format_version: %d", rd.version)
+		}
+		rd.crc = buf[0] == checksumCRC32C
+		handles = buf[1:]
+
+	default:
+		return nil, fmt.Errorf("%w: bad magic number; not a block-based table?", ErrCorrupt)
+	}
+
+	meta, m, err := decodeHandle(handles)
+	if err != nil {
+		return nil, err
+	}
+	rd.index, _, err = decodeHandle(handles[m:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = rd.readProperties(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return rd, nil
+}
+
+func (rd *Reader) readProperties(meta blockHandle) error {
+	b, err := rd.readBlock(meta)
+	if err != nil {
+		return fmt.Errorf("metaindex: %w", err)
+	}
+
+	rd.props = map[string][]byte{}
+	var props *blockHandle
+	err = iterBlock(b, func(k, v []byte) error {
+		if string(k) == propertiesBlock {
+			h, _, err := decodeHandle(v)
+			props = &h
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("metaindex: %w", err)
+	}
+
+	// tables don't strictly need properties, but every supported release
+	// writes them.
+	if props == nil {
+		return nil
+	}
+
+	b, err = rd.readBlock(*props)
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+
+	err = iterBlock(b, func(k, v []byte) error {
+		rd.props[string(k)] = bytes.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+
+	if c, ok := rd.props["rocksdb.comparator"]; ok && string(c) != BytewiseComparator {
+		return fmt.Errorf("unsupported comparator: %s", c)
+	}
+
+	if t, ok := rd.props["rocksdb.block.based.table.index.type"]; ok && len(t) == 4 {
+		// 0 is binary search, and 1 is a hash index, which has a binary search
+		// index too. the others are partitioned, or have different values.
+		if it := binary.LittleEndian.Uint32(t); it > 1 {
+			return fmt.Errorf("unsupported index type: %d", it)
+		}
+	}
+
+	if d, ok := rd.props["rocksdb.index.value.is.delta.encoded"]; ok {
+		v, _ := binary.Uvarint(d)
+		rd.deltaIndex = v != 0
+	}
+
+	return nil
+}
+
+// Properties returns the properties of the table, like "rocksdb.num.entries",
+// encoded as RocksDB does. Most numbers are uvarints.
+func (rd *Reader) Properties() map[string][]byte {
+	return rd.props
+}
+
+// RangeDeletions returns the number of range deletions in the table, which Each
+// doesn't return, so the entries it does return might have been deleted.
+func (rd *Reader) RangeDeletions() uint64 {
+	n, _ := binary.Uvarint(rd.props["rocksdb.num.range-deletions"])
+	return n
+}
+
+// Each calls fn with every entry in the table, in order, until it returns an
+// error. Entries with the same user key are ordered newest first. The slices
+// aren't reused.
+func (rd *Reader) Each(fn func(ik InternalKey, value []byte) error) error {
+	ix, err := rd.readBlock(rd.index)
+	if err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	handles, err := indexHandles(ix, rd.deltaIndex)
+	if err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	for _, h := range handles {
+		b, err := rd.readBlock(h)
+		if err != nil {
+			return fmt.Errorf("data block at %d: %w", h.offset, err)
+		}
+
+		err = iterBlock(b, func(k, v []byte) error {
+			ik, err := parseInternalKey(k)
+			if err != nil {
+				return err
+			}
+			return fn(ik, v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readBlock returns the contents of the given block, checked and decompressed.
+func (rd *Reader) readBlock(h blockHandle) ([]byte, error) {
+	// the handle is read from the table, so check it before allocating.
+	if h.offset > uint64(rd.size) || h.size > uint64(rd.size)-h.offset || uint64(rd.size)-h.offset-h.size < trailerLen {
+		return nil, fmt.Errorf("%w: block at %d of size %d is out of bounds", ErrCorrupt, h.offset, h.size)
+	}
+
+	buf := make([]byte, h.size+trailerLen)
+	_, err := rd.r.ReadAt(buf, int64(h.offset))
+	if err != nil {
+		return nil, fmt.Errorf("ReadAt: %w", err)
+	}
+
+	b, typ := buf[:h.size], buf[h.size]
+	if rd.crc && binary.LittleEndian.Uint32(buf[h.size+1:]) != maskedCRC(b, typ) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	if typ == noCompression {
+		return b, nil
+	}
+
+	// since format_version 2, blocks compressed with anything but snappy are
+	// prefixed with their decompressed size.
+	if typ != snappyCompression && rd.version >= 2 {
+		_, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad decompressed size", ErrCorrupt)
+		}
+		b = b[n:]
+	}
+
+	switch typ {
+	case snappyCompression:
+		return s2.Decode(nil, b)
+
+	case zlibCompression:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(b)))
+
+	case zstdCompression:
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return d.DecodeAll(b, nil)
+
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %d", typ)
+	}
+}
+
+// blockLayout returns the end of the entries in the given block, and the
+// offsets of its restart points.
+func blockLayout(b []byte) (int, []uint32, error) {
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("%w: block too short", ErrCorrupt)
+	}
+
+	end := len(b) - 4
+	packed := binary.LittleEndian.Uint32(b[end:])
+	num := int(packed & (1<<31 - 1))
+
+	// the top bit means there's a hash index before the footer, which is a
+	// byte per bucket, then the number of buckets as a uint16.
+	if packed&(1<<31) != 0 {
+		if end < 2 {
+			return 0, nil, fmt.Errorf("%w: block too short", ErrCorrupt)
+		}
+		end -= 2 + int(binary.LittleEndian.Uint16(b[end-2:]))
+	}
+
+	end -= 4 * num
+	if end < 0 {
+		return 0, nil, fmt.Errorf("%w: bad restarts", ErrCorrupt)
+	}
+
+	restarts := make([]uint32, num)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(b[end+4*i:])
+	}
+
+	return end, restarts, nil
+}
+
+// iterBlock calls fn with each entry of the given block.
+func iterBlock(b []byte, fn func(k, v []byte) error) error {
+	end, _, err := blockLayout(b)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	p := 0
+	for p < end {
+		var hdr [3]uint64
+		for i := range hdr {
+			v, n := binary.Uvarint(b[p:end])
+			if n <= 0 {
+				return fmt.Errorf("%w: bad entry", ErrCorrupt)
+			}
+			hdr[i] = v
+			p += n
+		}
+
+		shared, unshared, vlen := int(hdr[0]), int(hdr[1]), int(hdr[2])
+		if shared > len(key) || p+unshared+vlen > end {
+			return fmt.Errorf("%w: bad entry", ErrCorrupt)
+		}
+
+		key = append(key[:shared:shared], b[p:p+unshared]...)
+		p += unshared
+
+		err = fn(key, bytes.Clone(b[p:p+vlen]))
+		if err != nil {
+			return err
+		}
+		p += vlen
+	}
+
+	return nil
+}
+
+// indexHandles returns the handles of the data blocks in the given index block.
+// If delta is true, entries don't have a value length, and entries other than
+// restart points only store the difference between their size and the previous
+// one, since the offset follows from the previous handle.
+func indexHandles(b []byte, delta bool) ([]blockHandle, error) {
+	if !delta {
+		var hs []blockHandle
+		err := iterBlock(b, func(_, v []byte) error {
+			h, _, err := decodeHandle(v)
+			hs = append(hs, h)
+			return err
+		})
+		return hs, err
+	}
+
+	end, restarts, err := blockLayout(b)
+	if err != nil {
+		return nil, err
+	}
+
+	isRestart := map[int]bool{}
+	for _, r := range restarts {
+		isRestart[int(r)] = true
+	}
+
+	var hs []blockHandle
+	p := 0
+	for p < end {
+		restart := isRestart[p]
+
+		// the key isn't needed.
+		_, n := binary.Uvarint(b[p:end])
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad index entry", ErrCorrupt)
+		}
+		p += n
+
+		unshared, n := binary.Uvarint(b[p:end])
+		if n <= 0 || p+n+int(unshared) > end {
+			return nil, fmt.Errorf("%w: bad index entry", ErrCorrupt)
+		}
+		p += n + int(unshared)
+
+		if restart || len(hs) == 0 {
+			h, n, err := decodeHandle(b[p:end])
+			if err != nil {
+				return nil, err
+			}
+			hs = append(hs, h)
+			p += n
+			continue
+		}
+
+		d, n := binary.Varint(b[p:end])
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad index entry", ErrCorrupt)
+		}
+		p += n
+
+		prev := hs[len(hs)-1]
+		hs = append(hs, blockHandle{
+			offset: prev.offset + prev.size + trailerLen,
+			size:   uint64(int64(prev.size) + d),
+		})
+	}
+
+	return hs, nil
+}
@@ -0,0 +1,124 @@
+package rocksdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	// enough to need several data blocks.
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("key-%05d", i)
+		require.NoError(t, w.Add([]byte(k), []byte("value of "+k)))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	props := r.Properties()
+	entries, _ := binary.Uvarint(props["rocksdb.num.entries"])
+	assert.Equal(t, uint64(n), entries)
+	blocks, _ := binary.Uvarint(props["rocksdb.num.data.blocks"])
+	assert.Greater(t, blocks, uint64(1))
+	assert.Equal(t, BytewiseComparator, string(props["rocksdb.comparator"]))
+
+	i := 0
+	err = r.Each(func(ik InternalKey, value []byte) error {
+		k := fmt.Sprintf("key-%05d", i)
+		assert.Equal(t, k, string(ik.UserKey))
+		assert.Equal(t, TypeValue, ik.Type)
+		assert.Zero(t, ik.Seq)
+		assert.Equal(t, "value of "+k, string(value))
+		i++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, n, i)
+}
+
+func TestWriterOrder(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.Add([]byte("b"), nil))
+	assert.Error(t, w.Add([]byte("b"), nil))
+	assert.Error(t, w.Add([]byte("a"), nil))
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.Add([]byte("a"), []byte("xyz")))
+	require.NoError(t, w.Close())
+
+	// flip a byte of the value, in the first data block.
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte("xyz"))
+	require.Positive(t, i)
+	b[i] = 'X'
+
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	err = r.Each(func(InternalKey, []byte) error { return nil })
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = NewReader(bytes.NewReader(b[:len(b)-1]), int64(len(b)-1))
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestDeltaIndex(t *testing.T) {
+	// three data blocks, with a restart point at the first only. the others
+	// only store the change in size.
+	var b []byte
+	for i, v := range [][]byte{
+		blockHandle{0, 100}.encode(nil),
+		binary.AppendVarint(nil, 20),
+		binary.AppendVarint(nil, -50),
+	} {
+		b = binary.AppendUvarint(b, 0)
+		b = binary.AppendUvarint(b, 1)
+		b = append(b, byte('a'+i))
+		b = append(b, v...)
+	}
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+
+	hs, err := indexHandles(b, true)
+	require.NoError(t, err)
+	assert.Equal(t, []blockHandle{{0, 100}, {105, 120}, {230, 70}}, hs)
+}
+
+func TestReaderBounds(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.Add([]byte("a"), []byte("xyz")))
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Zero(t, r.RangeDeletions())
+
+	// handles which don't fit in the table are rejected before anything is
+	// allocated for them.
+	size := uint64(buf.Len())
+	for _, h := range []blockHandle{
+		{0, 1 << 62},
+		{size, 0},
+		{size - trailerLen, 1},
+		{1 << 63, 1 << 63},
+	} {
+		_, err := r.readBlock(h)
+		assert.ErrorIs(t, err, ErrCorrupt, "%+v", h)
+	}
+
+	r.props["rocksdb.num.range-deletions"] = binary.AppendUvarint(nil, 2)
+	assert.Equal(t, uint64(2), r.RangeDeletions())
+}
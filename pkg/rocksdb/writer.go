@@ -0,0 +1,252 @@
+package rocksdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// The size after which a data block is finished, and the number of entries
+	// between restart points in each. These are RocksDB's defaults.
+	blockSize       = 4096
+	restartInterval = 16
+
+	// The column family ID which means that the table can be ingested into any
+	// column family.
+	unknownColumnFamily = 1<<31 - 1
+)
+
+// blockBuilder builds a block of prefix-compressed entries.
+type blockBuilder struct {
+	interval int
+	buf      []byte
+	restarts []uint32
+	n        int
+	last     []byte
+}
+
+func newBlockBuilder(interval int) *blockBuilder {
+	return &blockBuilder{interval: interval}
+}
+
+func (bb *blockBuilder) add(key, value []byte) {
+	shared := 0
+	if bb.n%bb.interval == 0 {
+		bb.restarts = append(bb.restarts, uint32(len(bb.buf)))
+	} else {
+		for shared < len(key) && shared < len(bb.last) && key[shared] == bb.last[shared] {
+			shared++
+		}
+	}
+
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(shared))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(key)-shared))
+	bb.buf = binary.AppendUvarint(bb.buf, uint64(len(value)))
+	bb.buf = append(bb.buf, key[shared:]...)
+	bb.buf = append(bb.buf, value...)
+
+	bb.last = append(bb.last[:0], key...)
+	bb.n++
+}
+
+func (bb *blockBuilder) size() int {
+	return len(bb.buf) + 4*len(bb.restarts) + 4
+}
+
+// finish returns the block, and resets the builder.
+func (bb *blockBuilder) finish() []byte {
+	if len(bb.restarts) == 0 {
+		bb.restarts = append(bb.restarts, 0)
+	}
+
+	b := bb.buf
+	for _, r := range bb.restarts {
+		b = binary.LittleEndian.AppendUint32(b, r)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(bb.restarts)))
+
+	bb.buf, bb.restarts, bb.n = nil, nil, 0
+	bb.last = bb.last[:0]
+	return b
+}
+
+// Writer writes a RocksDB table, of the values of keys which must be added in
+// strictly increasing order. Every entry has sequence number zero, like those
+// written by RocksDB's SstFileWriter, so the table can be ingested with
+// IngestExternalFile. The blocks aren't compressed, and there's no filter.
+type Writer struct {
+	w      *bufio.Writer
+	offset uint64
+
+	data    *blockBuilder
+	index   *blockBuilder
+	lastKey []byte
+	started bool
+
+	// for the properties.
+	entries   uint64
+	blocks    uint64
+	keyBytes  uint64
+	valBytes  uint64
+	dataBytes uint64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:     bufio.NewWriter(w),
+		data:  newBlockBuilder(restartInterval),
+		index: newBlockBuilder(1),
+	}
+}
+
+// Add adds a value. Keys must be added in strictly increasing order.
+func (w *Writer) Add(key, value []byte) error {
+	if w.started && bytes.Compare(key, w.lastKey) <= 0 {
+		return fmt.Errorf("keys out of order: %q after %q", key, w.lastKey)
+	}
+
+	ik := InternalKey{UserKey: key, Type: TypeValue}.encode()
+	w.data.add(ik, value)
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.started = true
+
+	w.entries++
+	w.keyBytes += uint64(len(ik))
+	w.valBytes += uint64(len(value))
+
+	if w.data.size() >= blockSize {
+		return w.flushData()
+	}
+
+	return nil
+}
+
+// flushData writes the current data block, and indexes it by its last key,
+// which is at least every key in it, and less than every key after it.
+func (w *Writer) flushData() error {
+	if w.data.n == 0 {
+		return nil
+	}
+
+	last := InternalKey{UserKey: w.lastKey, Type: TypeValue}.encode()
+	h, err := w.writeBlock(w.data.finish())
+	if err != nil {
+		return err
+	}
+
+	w.index.add(last, h.encode(nil))
+	w.blocks++
+	w.dataBytes = w.offset
+	return nil
+}
+
+func (w *Writer) writeBlock(b []byte) (blockHandle, error) {
+	h := blockHandle{offset: w.offset, size: uint64(len(b))}
+
+	var tr [trailerLen]byte
+	tr[0] = noCompression
+	binary.LittleEndian.PutUint32(tr[1:], maskedCRC(b, noCompression))
+
+	_, err := w.w.Write(b)
+	if err != nil {
+		return h, err
+	}
+	_, err = w.w.Write(tr[:])
+	if err != nil {
+		return h, err
+	}
+
+	w.offset += uint64(len(b)) + trailerLen
+	return h, nil
+}
+
+// Close writes the rest of the table. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	err := w.flushData()
+	if err != nil {
+		return err
+	}
+
+	ixBlock := w.index.finish()
+	ixHandle, err := w.writeBlock(ixBlock)
+	if err != nil {
+		return err
+	}
+
+	props := w.properties(uint64(len(ixBlock)))
+	names := make([]string, 0, len(props))
+	for k := range props {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pb := newBlockBuilder(1)
+	for _, k := range names {
+		pb.add([]byte(k), props[k])
+	}
+	propsHandle, err := w.writeBlock(pb.finish())
+	if err != nil {
+		return err
+	}
+
+	mb := newBlockBuilder(1)
+	mb.add([]byte(propertiesBlock), propsHandle.encode(nil))
+	metaHandle, err := w.writeBlock(mb.finish())
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, footerLen)
+	footer[0] = checksumCRC32C
+	hs := ixHandle.encode(metaHandle.encode(nil))
+	copy(footer[1:], hs)
+	binary.LittleEndian.PutUint32(footer[footerLen-12:], FormatVersion)
+	binary.LittleEndian.PutUint64(footer[footerLen-8:], magic)
+
+	_, err = w.w.Write(footer)
+	if err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+const propertiesBlock = "rocksdb.properties"
+
+// properties returns the table properties. Numbers are uvarints, except for the
+// user-collected ones, which are fixed-width.
+func (w *Writer) properties(indexSize uint64) map[string][]byte {
+	num := func(n uint64) []byte {
+		return binary.AppendUvarint(nil, n)
+	}
+
+	return map[string][]byte{
+		"rocksdb.block.based.table.index.type":   binary.LittleEndian.AppendUint32(nil, 0),
+		"rocksdb.column.family.id":               num(unknownColumnFamily),
+		"rocksdb.comparator":                     []byte(BytewiseComparator),
+		"rocksdb.compression":                    []byte("NoCompression"),
+		"rocksdb.data.size":                      num(w.dataBytes),
+		"rocksdb.deleted.keys":                   num(0),
+		"rocksdb.external_sst_file.global_seqno": binary.LittleEndian.AppendUint64(nil, 0),
+		"rocksdb.external_sst_file.version":      binary.LittleEndian.AppendUint32(nil, 2),
+		"rocksdb.filter.size":                    num(0),
+		"rocksdb.fixed.key.length":               num(0),
+		"rocksdb.format.version":                 num(0),
+		"rocksdb.index.key.is.user.key":          num(0),
+		"rocksdb.index.size":                     num(indexSize),
+		"rocksdb.index.value.is.delta.encoded":   num(0),
+		"rocksdb.merge.operands":                 num(0),
+		"rocksdb.merge.operator":                 []byte("nullptr"),
+		"rocksdb.num.data.blocks":                num(w.blocks),
+		"rocksdb.num.entries":                    num(w.entries),
+		"rocksdb.num.range-deletions":            num(0),
+		"rocksdb.prefix.extractor.name":          []byte("nullptr"),
+		"rocksdb.property.collectors":            []byte("[]"),
+		"rocksdb.raw.key.size":                   num(w.keyBytes),
+		"rocksdb.raw.value.size":                 num(w.valBytes),
+	}
+}
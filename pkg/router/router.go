@@ -0,0 +1,193 @@
+// Package router partitions the keyspace across several archives, each with its
+// own memtable and metadata (and possibly bucket), to scale writes beyond what a
+// single archive can handle.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+)
+
+// Shard is an archive which owns the keys from Start (inclusive) up to the
+// Start of the next shard (exclusive).
+type Shard struct {
+	Start   string
+	Archive *blobby.Blobby
+}
+
+type Router struct {
+	mu     sync.RWMutex
+	shards []Shard // sorted by Start
+}
+
+var ErrInvalidShards = errors.New("invalid shards")
+
+// New returns a router over the given shards. Exactly one of them must start at
+// the empty string, so that every key is owned by a shard.
+func New(shards ...Shard) (*Router, error) {
+	s := slices.Clone(shards)
+	slices.SortFunc(s, func(a, b Shard) int {
+		if a.Start < b.Start {
+			return -1
+		}
+		if a.Start > b.Start {
+			return 1
+		}
+		return 0
+	})
+
+	if len(s) == 0 || s[0].Start != "" {
+		return nil, fmt.Errorf("%w: no shard starts at the empty key", ErrInvalidShards)
+	}
+
+	for i := 1; i < len(s); i++ {
+		if s[i].Start == s[i-1].Start {
+			return nil, fmt.Errorf("%w: duplicate start: %q", ErrInvalidShards, s[i].Start)
+		}
+	}
+
+	return &Router{shards: s}, nil
+}
+
+// Shards returns a copy of the current shards, sorted by Start.
+func (r *Router) Shards() []Shard {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.shards)
+}
+
+// For returns the archive which owns the given key.
+func (r *Router) For(key string) *blobby.Blobby {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.shards[r.index(key)].Archive
+}
+
+// index returns the index of the shard which owns the given key. The caller must
+// hold the lock.
+func (r *Router) index(key string) int {
+	i, found := slices.BinarySearchFunc(r.shards, key, func(s Shard, k string) int {
+		if s.Start < k {
+			return -1
+		}
+		if s.Start > k {
+			return 1
+		}
+		return 0
+	})
+	if found {
+		return i
+	}
+
+	// i is where the key would be inserted, so the owner is the one before.
+	return i - 1
+}
+
+func (r *Router) Put(ctx context.Context, key string, value []byte) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.shards[r.index(key)].Archive.Put(ctx, key, value)
+}
+
+func (r *Router) Get(ctx context.Context, key string) ([]byte, *blobby.GetStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.shards[r.index(key)].Archive.Get(ctx, key)
+}
+
+// splitBatchSize is the number of records copied at once by Split.
+const splitBatchSize = 1000
+
+// Split moves the keys from at (inclusive) to the end of the shard which owns
+// it into dst, which must be an initialized archive, and makes dst a new shard.
+// It returns the number of records which were copied.
+//
+// Every version of every key in the range is copied, with its timestamp. Most
+// of the copying happens while the source shard is still serving reads and
+// writes; then the router is locked while anything written in the meantime is
+// copied, and the new shard is added. The records are not removed from the
+// source shard.
+func (r *Router) Split(ctx context.Context, at string, dst *blobby.Blobby) (int, error) {
+	r.mu.RLock()
+	i := r.index(at)
+	src := r.shards[i]
+	end := ""
+	if i+1 < len(r.shards) {
+		end = r.shards[i+1].Start
+	}
+	if src.Start == at {
+		r.mu.RUnlock()
+		return 0, fmt.Errorf("%w: shard already starts at: %q", ErrInvalidShards, at)
+	}
+	r.mu.RUnlock()
+
+	inRange := func(key string) bool {
+		return key >= at && (end == "" || key < end)
+	}
+
+	n, last, err := copyRange(ctx, src.Archive, dst, time.Time{}, inRange)
+	if err != nil {
+		return n, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// copy anything which was written during the first pass. records written
+	// at exactly the last timestamp are copied again, but that's harmless,
+	// since PutBatch skips replays.
+	m, _, err := copyRange(ctx, src.Archive, dst, last, inRange)
+	if err != nil {
+		return n + m, err
+	}
+
+	r.shards = slices.Insert(r.shards, i+1, Shard{Start: at, Archive: dst})
+	return n + m, nil
+}
+
+// copyRange copies every record at or after since whose key passes the given
+// filter from src to dst, and returns the number copied and the timestamp of
+// the newest.
+func copyRange(ctx context.Context, src, dst *blobby.Blobby, since time.Time, filter func(string) bool) (int, time.Time, error) {
+	var batch []*blobby.Record
+	n := 0
+	last := since
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := dst.PutBatch(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("PutBatch: %w", err)
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := src.ChangesSince(ctx, since, func(rec *blobby.Record) error {
+		last = rec.Timestamp
+		if !filter(rec.Key) {
+			return nil
+		}
+
+		batch = append(batch, rec)
+		if len(batch) >= splitBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, last, fmt.Errorf("ChangesSince: %w", err)
+	}
+
+	err = flush()
+	return n, last, err
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	a, b := &blobby.Blobby{}, &blobby.Blobby{}
+
+	_, err := New()
+	assert.ErrorIs(t, err, ErrInvalidShards)
+
+	_, err = New(Shard{Start: "m", Archive: a})
+	assert.ErrorIs(t, err, ErrInvalidShards)
+
+	_, err = New(Shard{Start: "", Archive: a}, Shard{Start: "", Archive: b})
+	assert.ErrorIs(t, err, ErrInvalidShards)
+}
+
+func TestFor(t *testing.T) {
+	a, b, c := &blobby.Blobby{}, &blobby.Blobby{}, &blobby.Blobby{}
+
+	// out of order on purpose.
+	r, err := New(Shard{Start: "m", Archive: b}, Shard{Start: "", Archive: a}, Shard{Start: "t", Archive: c})
+	require.NoError(t, err)
+
+	for key, want := range map[string]*blobby.Blobby{
+		"":     a,
+		"a":    a,
+		"lzzz": a,
+		"m":    b,
+		"m0":   b,
+		"szzz": b,
+		"t":    c,
+		"zzz":  c,
+	} {
+		assert.Same(t, want, r.For(key), key)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	c := clockwork.NewFakeClockAt(time.Now().UTC().Truncate(time.Second))
+
+	a := blobby.New(env.MongoURL(), env.S3Bucket, c, blobby.WithName("shard-a"))
+	require.NoError(t, a.Init(ctx))
+	b := blobby.New(env.MongoURL(), env.S3Bucket, c, blobby.WithName("shard-b"))
+	require.NoError(t, b.Init(ctx))
+
+	r, err := New(Shard{Start: "", Archive: a})
+	require.NoError(t, err)
+
+	for _, k := range []string{"apple", "mango", "zucchini"} {
+		_, err := r.Put(ctx, k, []byte(k))
+		require.NoError(t, err)
+		c.Advance(time.Second)
+	}
+	_, err = a.Flush(ctx, blobby.FlushOptions{})
+	require.NoError(t, err)
+	_, err = r.Put(ctx, "melon", []byte("melon"))
+	require.NoError(t, err)
+
+	n, err := r.Split(ctx, "m", b)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Same(t, b, r.For("mango"))
+	assert.Same(t, a, r.For("apple"))
+
+	for _, k := range []string{"apple", "mango", "melon", "zucchini"} {
+		v, _, err := r.Get(ctx, k)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(k), v)
+	}
+}
@@ -0,0 +1,105 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+func benchRecords(n, size int) []*types.Record {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	recs := make([]*types.Record, n)
+	for i := range recs {
+		recs[i] = &types.Record{
+			Key:       fmt.Sprintf("key-%08d", i),
+			Timestamp: ts.Add(time.Duration(i) * time.Millisecond),
+			Document:  bytes.Repeat([]byte{'x'}, size),
+		}
+	}
+	return recs
+}
+
+func BenchmarkWrite(b *testing.B) {
+	recs := benchRecords(10000, 256)
+	c := clockwork.NewFakeClock()
+	b.ReportAllocs()
+
+	for range b.N {
+		w := NewWriter(c)
+		for _, r := range recs {
+			w.Add(r)
+		}
+
+		var buf bytes.Buffer
+		m, err := w.Write(&buf)
+		require.NoError(b, err)
+		b.SetBytes(int64(m.Size))
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	w := NewWriter(clockwork.NewFakeClock())
+	for _, r := range benchRecords(10000, 256) {
+		w.Add(r)
+	}
+
+	var buf bytes.Buffer
+	_, err := w.Write(&buf)
+	require.NoError(b, err)
+	sst := buf.Bytes()
+
+	b.SetBytes(int64(len(sst)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		r, err := NewReader(bytes.NewReader(sst))
+		require.NoError(b, err)
+		for {
+			rec, err := r.Next()
+			require.NoError(b, err)
+			if rec == nil {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkReadRaw is like BenchmarkRead, but without decoding the records, like
+// a scan for a single key. It shouldn't allocate per record.
+func BenchmarkReadRaw(b *testing.B) {
+	w := NewWriter(clockwork.NewFakeClock())
+	for _, r := range benchRecords(10000, 256) {
+		w.Add(r)
+	}
+
+	var buf bytes.Buffer
+	_, err := w.Write(&buf)
+	require.NoError(b, err)
+	sst := buf.Bytes()
+
+	b.SetBytes(int64(len(sst)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		r, err := NewReader(bytes.NewReader(sst))
+		require.NoError(b, err)
+		for {
+			raw, err := r.NextRaw()
+			require.NoError(b, err)
+			if raw == nil {
+				break
+			}
+			if k, _ := types.RawKey(raw); string(k) == "nope" {
+				b.Fatal("found nope")
+			}
+		}
+		r.Close()
+	}
+}
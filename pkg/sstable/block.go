@@ -0,0 +1,287 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Format is the layout of the records within an sstable. It's chosen when the
+// sstable is written, and recorded in its magic bytes, so every reader supports
+// every format.
+type Format int
+
+const (
+	// FormatRecords is a plain sequence of BSON records. It's the original
+	// format, and the default.
+	FormatRecords Format = iota
+
+	// FormatBlocks groups the records into blocks of roughly BlockSize bytes.
+	// Within each block, keys are prefix-compressed against the previous key,
+	// except at restart points (every RestartInterval records) where the whole
+	// key is stored. The offsets of the restart points are stored at the end
+	// of each block, so it can be binary searched.
+	//
+	// Each block is a uint32 length, then the entries, then the restart
+	// offsets as uint32s, then the number of them as a uint32. Each entry is
+	// the number of bytes shared with the previous key, the number which
+	// aren't, and the length of the value (all uvarints), then the unshared
+	// bytes of the key, then the value, which is the BSON record without its
+	// key. A zero length marks the end of the blocks, which is followed by the
+	// footer, as in FormatRecords.
+	FormatBlocks
+)
+
+const (
+	// BlockSize is the size after which a block is finished, so blocks are
+	// usually a bit larger than this. A record larger than this gets a block
+	// to itself.
+	BlockSize = 4096
+
+	// RestartInterval is the number of records between restart points.
+	RestartInterval = 16
+
+	// maxBlockSize is the largest block which will be read, so corrupt lengths
+	// can't cause huge allocations. It fits a single record of the maximum
+	// size, plus the key and overhead.
+	maxBlockSize = 2 * types.MaxDocumentSize
+)
+
+// blockBuilder accumulates the entries of a block.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	prevKey  string
+	n        int
+}
+
+// add appends the given encoded record to the block. It must be sorted after
+// any which were already added.
+func (b *blockBuilder) add(raw bson.Raw) error {
+	k, ok := types.RawKey(raw)
+	if !ok {
+		return fmt.Errorf("record has no key")
+	}
+	key := string(k)
+
+	shared := 0
+	if b.n%RestartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.prevKey) && key[shared] == b.prevKey[shared] {
+			shared++
+		}
+	}
+
+	value := stripKey(raw)
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.prevKey = key
+	b.n++
+	return nil
+}
+
+// size returns roughly how many bytes the finished block will be.
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.n == 0
+}
+
+// finish writes the block, including its length prefix, to the given writer,
+// and resets the builder. It returns the number of bytes written.
+func (b *blockBuilder) finish(out io.Writer) (int, error) {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(b.buf)))
+
+	n, err := out.Write(append(length[:], b.buf...))
+	if err != nil {
+		return n, err
+	}
+
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.prevKey = ""
+	b.n = 0
+	return n, nil
+}
+
+// stripKey returns the given encoded record without its key element. The rest
+// of the elements are unchanged, so the record can be reconstructed exactly by
+// withKey.
+func stripKey(raw bson.Raw) []byte {
+	elems, _ := raw.Elements()
+	out := make([]byte, 4, len(raw))
+	for _, e := range elems {
+		if e.Key() != "key" {
+			out = append(out, e...)
+		}
+	}
+
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+// withKey reconstructs an encoded record from its key and the value written by
+// stripKey, into buf (which is grown if necessary). The key is the first
+// element, as it is when records are marshalled.
+func withKey(buf []byte, key []byte, value []byte) ([]byte, error) {
+	if len(value) < 5 {
+		return nil, fmt.Errorf("invalid value length: %d", len(value))
+	}
+
+	buf = append(buf[:0], 0, 0, 0, 0, byte(bson.TypeString), 'k', 'e', 'y', 0)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)+1))
+	buf = append(buf, key...)
+	buf = append(buf, 0)
+	buf = append(buf, value[4:]...)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	return buf, nil
+}
+
+// block is a block which has been read, and is being iterated over.
+type block struct {
+	data []byte
+
+	// the end of the entries, and the start of the restart offsets.
+	end      int
+	restarts int
+
+	// the offset of the next entry, and the key of the previous one.
+	pos int
+	key []byte
+}
+
+// reset prepares to iterate over the given block data, without its length
+// prefix.
+func (b *block) reset(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("block too short: %d", len(data))
+	}
+
+	n := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	end := len(data) - 4 - 4*n
+	if n < 1 || end < 0 {
+		return fmt.Errorf("invalid restart count: %d", n)
+	}
+
+	b.data = data
+	b.end = end
+	b.restarts = n
+	b.pos = 0
+	b.key = b.key[:0]
+	return nil
+}
+
+func (b *block) done() bool {
+	return b.pos >= b.end
+}
+
+// restart returns the offset of the i'th restart point.
+func (b *block) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(b.data[b.end+4*i:]))
+}
+
+// peek decodes the entry at the current position without consuming it, and
+// returns its key (which is only valid until the next call) and value, and the
+// offset of the entry after it.
+func (b *block) peek() (key, value []byte, next int, err error) {
+	p := b.pos
+
+	shared, n := binary.Uvarint(b.data[p:b.end])
+	if n <= 0 {
+		return nil, nil, 0, fmt.Errorf("invalid entry at %d", p)
+	}
+	p += n
+
+	unshared, n := binary.Uvarint(b.data[p:b.end])
+	if n <= 0 {
+		return nil, nil, 0, fmt.Errorf("invalid entry at %d", p)
+	}
+	p += n
+
+	vlen, n := binary.Uvarint(b.data[p:b.end])
+	if n <= 0 {
+		return nil, nil, 0, fmt.Errorf("invalid entry at %d", p)
+	}
+	p += n
+
+	if shared > uint64(len(b.key)) || unshared > uint64(b.end-p) || vlen > uint64(b.end-p)-unshared {
+		return nil, nil, 0, fmt.Errorf("invalid entry lengths at %d", b.pos)
+	}
+
+	// the shared prefix is unchanged by this, so it's fine to decode the same
+	// entry again (after peeking) even though b.key was overwritten.
+	b.key = append(b.key[:shared], b.data[p:p+int(unshared)]...)
+	p += int(unshared)
+
+	return b.key, b.data[p : p+int(vlen)], p + int(vlen), nil
+}
+
+// seek moves to the first entry in the block with a key greater than or equal
+// to the given key, or to the end of the block if there isn't one. It must be
+// called before any entries have been read. It returns the number of entries
+// decoded along the way.
+func (b *block) seek(key string) (int, error) {
+	// binary search for the last restart point whose key is less than the one
+	// we're looking for. entries before it are all smaller, too.
+	lo, hi := 0, b.restarts-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		b.pos = b.restart(mid)
+		if b.pos >= b.end {
+			return 0, fmt.Errorf("invalid restart offset: %d", b.pos)
+		}
+
+		b.key = b.key[:0]
+		k, _, _, err := b.peek()
+		if err != nil {
+			return 0, err
+		}
+
+		if string(k) < key {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	b.pos = b.restart(lo)
+	b.key = b.key[:0]
+	if b.pos > b.end {
+		return 0, fmt.Errorf("invalid restart offset: %d", b.pos)
+	}
+
+	// then scan forwards from there.
+	n := 0
+	for !b.done() {
+		k, _, next, err := b.peek()
+		if err != nil {
+			return n, err
+		}
+		n++
+
+		if string(k) >= key {
+			return n, nil
+		}
+
+		b.pos = next
+	}
+
+	return n, nil
+}
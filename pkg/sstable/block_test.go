@@ -0,0 +1,149 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prefixedRecords returns records whose keys share long prefixes, like keys
+// namespaced by tenant, with a few versions of each.
+func prefixedRecords(n int) []*types.Record {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var recs []*types.Record
+	for i := range n {
+		key := fmt.Sprintf("tenant-%04d/2025-01-01/object-%06d", i%7, i)
+		for v := range 3 {
+			recs = append(recs, &types.Record{
+				Key:       key,
+				Timestamp: ts.Add(time.Duration(v) * time.Second),
+				Document:  []byte(fmt.Sprintf("doc-%d-%d", i, v)),
+				Tags:      map[string]string{"v": fmt.Sprint(v)},
+			})
+		}
+	}
+	return recs
+}
+
+func writeFormat(t *testing.T, f Format, recs []*types.Record) ([]byte, *Meta) {
+	w := NewWriter(clockwork.NewFakeClock(), WithFormat(f))
+	for _, rec := range recs {
+		require.NoError(t, w.Add(rec))
+	}
+
+	var buf bytes.Buffer
+	m, err := w.Write(&buf)
+	require.NoError(t, err)
+	return buf.Bytes(), m
+}
+
+func TestBlocksRoundTrip(t *testing.T) {
+	recs := prefixedRecords(1000)
+	flat, fm := writeFormat(t, FormatRecords, recs)
+	blocks, bm := writeFormat(t, FormatBlocks, recs)
+
+	assert.Equal(t, FormatBlocks, bm.Format)
+	assert.Equal(t, fm.Count, bm.Count)
+	assert.Equal(t, fm.MinKey, bm.MinKey)
+	assert.Equal(t, fm.MaxKey, bm.MaxKey)
+	assert.Less(t, len(blocks), len(flat), "prefix compression didn't help")
+	assert.Equal(t, bm.Size, len(blocks)-footerLen(t, blocks))
+
+	// the records read back are identical, byte for byte.
+	fr, err := NewReader(bytes.NewReader(flat))
+	require.NoError(t, err)
+	br, err := NewReader(bytes.NewReader(blocks))
+	require.NoError(t, err)
+	assert.Equal(t, FormatBlocks, br.Format())
+
+	for {
+		want, err := fr.NextRaw()
+		require.NoError(t, err)
+		got, err := br.NextRaw()
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		if want == nil {
+			break
+		}
+	}
+
+	require.NotNil(t, br.Footer())
+	assert.Equal(t, bm.Count, br.Footer().Count)
+}
+
+func TestBlocksLargeRecord(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	big := bytes.Repeat([]byte("x"), 3*BlockSize)
+	recs := []*types.Record{
+		{Key: "a", Timestamp: ts, Document: []byte("small")},
+		{Key: "b", Timestamp: ts, Document: big},
+		{Key: "c", Timestamp: ts, Document: []byte("small")},
+	}
+
+	b, _ := writeFormat(t, FormatBlocks, recs)
+	r, err := NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	for _, want := range recs {
+		got, err := r.Next()
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, want.Key, got.Key)
+		assert.Equal(t, want.Document, got.Document)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	recs := prefixedRecords(500)
+
+	for _, f := range []Format{FormatRecords, FormatBlocks} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			b, _ := writeFormat(t, f, recs)
+
+			for _, tc := range []struct {
+				seek string
+				want string
+			}{
+				{"", "tenant-0000/2025-01-01/object-000000"},
+				{"tenant-0003/2025-01-01/object-000248", "tenant-0003/2025-01-01/object-000248"},
+				{"tenant-0003/2025-01-01/object-000248~", "tenant-0003/2025-01-01/object-000255"},
+				{"tenant-0006/2025-01-01/object-000496", "tenant-0006/2025-01-01/object-000496"},
+				{"zzz", ""},
+			} {
+				r, err := NewReader(bytes.NewReader(b))
+				require.NoError(t, err)
+
+				n, err := r.Seek(tc.seek)
+				require.NoError(t, err)
+
+				rec, err := r.Next()
+				require.NoError(t, err)
+				if tc.want == "" {
+					assert.Nil(t, rec)
+					continue
+				}
+
+				require.NotNil(t, rec, tc.seek)
+				assert.Equal(t, tc.want, rec.Key)
+				assert.Equal(t, "2", rec.Tags["v"], "not the newest version")
+
+				if f == FormatBlocks {
+					assert.Less(t, n, len(recs)/4, "looked at too many records")
+				}
+			}
+		})
+	}
+}
+
+// footerLen returns the length of the footer and trailer of the given sstable.
+func footerLen(t *testing.T, b []byte) int {
+	n, ok := ParseTrailer(b[len(b)-TrailerSize:])
+	require.True(t, ok)
+	return n + TrailerSize
+}
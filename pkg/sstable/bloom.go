@@ -0,0 +1,65 @@
+package sstable
+
+import (
+	"math"
+)
+
+// BloomBitsPerKey is the size of bloom filters per distinct key. Ten bits gives
+// a false positive rate of about 1%.
+const BloomBitsPerKey = 10
+
+// Bloom is a bloom filter of the keys in an sstable. See FilterBloom.
+type Bloom struct {
+	Bits []byte
+	K    int
+}
+
+// NewBloom returns a bloom filter containing the keys with the given hashes (see
+// filterHash), with bitsPerKey bits per key.
+func NewBloom(hashes []uint64, bitsPerKey int) *Bloom {
+	n := max(len(hashes)*bitsPerKey, 64)
+
+	// the optimal number of hash functions is ln(2) * bits per key.
+	k := max(1, min(30, int(math.Round(float64(bitsPerKey)*math.Ln2))))
+
+	b := &Bloom{
+		Bits: make([]byte, (n+7)/8),
+		K:    k,
+	}
+
+	for _, h := range hashes {
+		b.add(h)
+	}
+
+	return b
+}
+
+// add sets the bits for the given hash, using double hashing to derive K probes
+// from one 64-bit hash.
+func (b *Bloom) add(h uint64) {
+	n := uint64(len(b.Bits) * 8)
+	h1, h2 := h, (h>>33)|(h<<31)
+	for i := 0; i < b.K; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		b.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain returns false if the key is definitely not in the filter.
+func (b *Bloom) MayContain(key string) bool {
+	if len(b.Bits) == 0 {
+		return true
+	}
+
+	h := filterHash(key)
+	n := uint64(len(b.Bits) * 8)
+	h1, h2 := h, (h>>33)|(h<<31)
+	for i := 0; i < b.K; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if b.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,5 +1,23 @@
 package sstable
 
+import "fmt"
+
 const (
 	magicBytes = "\x6D\x75\x64\x6B\x69\x70\x73" // mudkips
+
+	// the magic bytes of sstables in FormatBlocks. same length as magicBytes,
+	// so the reader can tell them apart.
+	magicBlocks = "\x6D\x75\x64\x62\x6C\x6B\x73" // mudblks
 )
+
+// magic returns the magic bytes which start an sstable in this format.
+func (f Format) magic() (string, error) {
+	switch f {
+	case FormatRecords:
+		return magicBytes, nil
+	case FormatBlocks:
+		return magicBlocks, nil
+	}
+
+	return "", fmt.Errorf("unknown format: %d", f)
+}
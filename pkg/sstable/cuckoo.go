@@ -0,0 +1,193 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	// cuckooBucketSize is the number of fingerprints per bucket.
+	cuckooBucketSize = 4
+
+	// cuckooLoad is the fraction of slots which are filled when the filter is
+	// built. Inserts into fuller filters are likely to fail.
+	cuckooLoad = 0.9
+
+	// cuckooMaxKicks is how many fingerprints are moved to make room for a new
+	// one before giving up.
+	cuckooMaxKicks = 500
+)
+
+// Cuckoo is a cuckoo filter with 16-bit fingerprints. Each key's fingerprint is
+// stored in one of two buckets, so it can be found and removed again, unlike
+// the other filters. See FilterCuckoo.
+//
+// See: https://www.cs.cmu.edu/~dga/papers/cuckoo-conext2014.pdf
+type Cuckoo struct {
+	// the number of buckets (a power of two) as a uint32, then the slots, as
+	// uint16s. empty slots are zero.
+	data []byte
+	mask uint64
+}
+
+// NewCuckoo returns a cuckoo filter containing the keys with the given hashes.
+func NewCuckoo(hashes []uint64) (*Cuckoo, error) {
+	n := int(float64(len(hashes))/(cuckooBucketSize*cuckooLoad)) + 1
+	nb := 1 << bits.Len(uint(n-1))
+
+	// if inserting fails, which is unlikely, try again with twice the room.
+	for range 4 {
+		c := newCuckoo(nb)
+		ok := true
+		for _, h := range hashes {
+			if !c.add(h) {
+				ok = false
+				break
+			}
+		}
+
+		if ok {
+			return c, nil
+		}
+
+		nb *= 2
+	}
+
+	return nil, fmt.Errorf("couldn't build cuckoo filter of %d keys", len(hashes))
+}
+
+func newCuckoo(buckets int) *Cuckoo {
+	data := make([]byte, 4+buckets*cuckooBucketSize*2)
+	binary.LittleEndian.PutUint32(data, uint32(buckets))
+	return &Cuckoo{
+		data: data,
+		mask: uint64(buckets - 1),
+	}
+}
+
+// locate returns the fingerprint and the first bucket of the key with the given
+// hash. The fingerprint is never zero, which marks empty slots.
+func (c *Cuckoo) locate(h uint64) (uint16, uint64) {
+	// the high bits of the key hash barely vary between similar keys.
+	h = mix64(h)
+
+	fp := uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+
+	return fp, h & c.mask
+}
+
+// alt returns the other bucket of the given fingerprint in the given bucket.
+// It's symmetric, so either bucket leads to the other.
+func (c *Cuckoo) alt(i uint64, fp uint16) uint64 {
+	return (i ^ mix64(uint64(fp))) & c.mask
+}
+
+func (c *Cuckoo) slot(i uint64, j int) uint16 {
+	return binary.LittleEndian.Uint16(c.data[4+(int(i)*cuckooBucketSize+j)*2:])
+}
+
+func (c *Cuckoo) setSlot(i uint64, j int, fp uint16) {
+	binary.LittleEndian.PutUint16(c.data[4+(int(i)*cuckooBucketSize+j)*2:], fp)
+}
+
+// put stores the fingerprint in an empty slot of the bucket, if there is one.
+func (c *Cuckoo) put(i uint64, fp uint16) bool {
+	for j := range cuckooBucketSize {
+		if c.slot(i, j) == 0 {
+			c.setSlot(i, j, fp)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Cuckoo) add(h uint64) bool {
+	fp, i1 := c.locate(h)
+	i2 := c.alt(i1, fp)
+	if c.put(i1, fp) || c.put(i2, fp) {
+		return true
+	}
+
+	// evict a fingerprint from a full bucket to its other bucket, and so on,
+	// until one fits. the victims are chosen pseudo-randomly, but
+	// deterministically, so the same keys always make the same filter.
+	i := i1
+	rnd := h
+	for range cuckooMaxKicks {
+		rnd = mix64(rnd)
+		j := int(rnd % cuckooBucketSize)
+		victim := c.slot(i, j)
+		c.setSlot(i, j, fp)
+
+		fp = victim
+		i = c.alt(i, fp)
+		if c.put(i, fp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add adds the given key to the filter. It returns false if the filter is too
+// full, in which case the filter no longer contains some other key.
+func (c *Cuckoo) Add(key string) bool {
+	return c.add(filterHash(key))
+}
+
+// Delete removes the given key, which must have been added, from the filter. It
+// returns false if the key wasn't found. Deleting a key which wasn't added can
+// remove another key with the same fingerprint.
+func (c *Cuckoo) Delete(key string) bool {
+	fp, i1 := c.locate(filterHash(key))
+	for _, i := range []uint64{i1, c.alt(i1, fp)} {
+		for j := range cuckooBucketSize {
+			if c.slot(i, j) == fp {
+				c.setSlot(i, j, 0)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *Cuckoo) MayContain(key string) bool {
+	fp, i1 := c.locate(filterHash(key))
+	i2 := c.alt(i1, fp)
+	for j := range cuckooBucketSize {
+		if c.slot(i1, j) == fp || c.slot(i2, j) == fp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MarshalBinary returns the encoded filter. It aliases the filter.
+func (c *Cuckoo) MarshalBinary() []byte {
+	return c.data
+}
+
+// UnmarshalCuckoo returns the filter encoded by MarshalBinary. It aliases b, so
+// Add and Delete modify b.
+func UnmarshalCuckoo(b []byte) (*Cuckoo, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("cuckoo filter too short: %d", len(b))
+	}
+
+	nb := int(binary.LittleEndian.Uint32(b))
+	if nb == 0 || nb&(nb-1) != 0 || len(b) != 4+nb*cuckooBucketSize*2 {
+		return nil, fmt.Errorf("invalid cuckoo filter: %d buckets in %d bytes", nb, len(b))
+	}
+
+	return &Cuckoo{
+		data: b,
+		mask: uint64(nb - 1),
+	}, nil
+}
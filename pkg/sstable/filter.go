@@ -0,0 +1,129 @@
+package sstable
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Filter is a probabilistic set of the keys in an sstable. It can say for sure
+// that a key isn't present, but not that it is.
+type Filter interface {
+	MayContain(key string) bool
+}
+
+// FilterType is the kind of filter which is built for each sstable.
+type FilterType string
+
+const (
+	// FilterBloom is a bloom filter with BloomBitsPerKey bits per key, and a
+	// false positive rate of about 1%. It's the default.
+	FilterBloom FilterType = "bloom"
+
+	// FilterRibbon is a ribbon filter, which has a lower false positive rate
+	// (about 0.4%) than the bloom filter while being about 10% smaller, but is
+	// slower to build.
+	FilterRibbon FilterType = "ribbon"
+
+	// FilterCuckoo is a cuckoo filter, which is larger than the others, but
+	// has a much lower false positive rate, and supports removing keys.
+	FilterCuckoo FilterType = "cuckoo"
+)
+
+// ParseFilterType returns the FilterType with the given name.
+func ParseFilterType(s string) (FilterType, error) {
+	switch t := FilterType(s); t {
+	case FilterBloom, FilterRibbon, FilterCuckoo:
+		return t, nil
+	}
+
+	return "", fmt.Errorf("unknown filter type: %q", s)
+}
+
+// EncodedFilter is a filter of any type, as it's stored in an Index or Meta.
+type EncodedFilter struct {
+	// Type is empty for bloom filters, which predate the others.
+	Type FilterType `bson:"type,omitempty"`
+
+	// Data is the bits of a bloom filter, or the encoding of any other type.
+	Data []byte `bson:"bits"`
+
+	// K is the number of hash functions of a bloom filter.
+	K int `bson:"k,omitempty"`
+}
+
+// BuildFilter returns a filter of the given type containing the keys with the
+// given hashes (see filterHash).
+func BuildFilter(t FilterType, hashes []uint64) (*EncodedFilter, error) {
+	switch t {
+	case "", FilterBloom:
+		b := NewBloom(hashes, BloomBitsPerKey)
+		return &EncodedFilter{Data: b.Bits, K: b.K}, nil
+
+	case FilterRibbon:
+		r, err := NewRibbon(hashes)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedFilter{Type: t, Data: r.MarshalBinary()}, nil
+
+	case FilterCuckoo:
+		c, err := NewCuckoo(hashes)
+		if err != nil {
+			return nil, err
+		}
+		return &EncodedFilter{Type: t, Data: c.MarshalBinary()}, nil
+	}
+
+	return nil, fmt.Errorf("unknown filter type: %q", t)
+}
+
+// Decode returns the filter. Decoding doesn't copy, so is cheap enough to do
+// for every lookup.
+func (f *EncodedFilter) Decode() (Filter, error) {
+	switch f.Type {
+	case "", FilterBloom:
+		return &Bloom{Bits: f.Data, K: f.K}, nil
+	case FilterRibbon:
+		return UnmarshalRibbon(f.Data)
+	case FilterCuckoo:
+		return UnmarshalCuckoo(f.Data)
+	}
+
+	return nil, fmt.Errorf("unknown filter type: %q", f.Type)
+}
+
+// MayContain returns false if the key is definitely not in the filter. If the
+// filter can't be decoded, e.g. because it's of a type which this version
+// doesn't know about, it might contain anything.
+func (f *EncodedFilter) MayContain(key string) bool {
+	d, err := f.Decode()
+	if err != nil {
+		return true
+	}
+
+	return d.MayContain(key)
+}
+
+// Size returns the size of the filter in bytes.
+func (f *EncodedFilter) Size() int {
+	return len(f.Data)
+}
+
+// filterHash returns the hash of the given key, from which every type of filter
+// derives its own hashes.
+func filterHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// mix64 is the finalizer of splitmix64, to derive independent-ish hashes from
+// one key hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
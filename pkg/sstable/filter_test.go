@@ -0,0 +1,99 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilters(t *testing.T) {
+	const n = 10000
+
+	var hashes []uint64
+	for i := range n {
+		hashes = append(hashes, filterHash(fmt.Sprintf("key-%d", i)))
+	}
+
+	tests := []struct {
+		typ FilterType
+
+		// the maximum false positive rate, and size in bits per key.
+		maxFP   float64
+		maxBits float64
+	}{
+		{FilterBloom, 0.015, 10.1},
+		{FilterRibbon, 0.006, 9},
+		{FilterCuckoo, 0.001, 36},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.typ), func(t *testing.T) {
+			ef, err := BuildFilter(tt.typ, hashes)
+			require.NoError(t, err)
+
+			// round-trip it, like the index does.
+			b, err := bson.Marshal(ef)
+			require.NoError(t, err)
+			ef = &EncodedFilter{}
+			require.NoError(t, bson.Unmarshal(b, ef))
+
+			f, err := ef.Decode()
+			require.NoError(t, err)
+
+			for i := range n {
+				require.True(t, f.MayContain(fmt.Sprintf("key-%d", i)), i)
+			}
+
+			fp := 0
+			for i := range n {
+				if f.MayContain(fmt.Sprintf("other-%d", i)) {
+					fp++
+				}
+			}
+
+			assert.LessOrEqual(t, float64(fp)/n, tt.maxFP)
+			assert.LessOrEqual(t, float64(ef.Size()*8)/n, tt.maxBits)
+		})
+	}
+}
+
+func TestFilterEmpty(t *testing.T) {
+	for _, typ := range []FilterType{FilterBloom, FilterRibbon, FilterCuckoo} {
+		ef, err := BuildFilter(typ, nil)
+		require.NoError(t, err, typ)
+		assert.False(t, ef.MayContain("a"), typ)
+	}
+}
+
+func TestLegacyBloom(t *testing.T) {
+	// bloom filters written before there were other types have no type.
+	b := NewBloom([]uint64{filterHash("a")}, BloomBitsPerKey)
+	raw, err := bson.Marshal(bson.M{"bits": b.Bits, "k": b.K})
+	require.NoError(t, err)
+
+	ef := &EncodedFilter{}
+	require.NoError(t, bson.Unmarshal(raw, ef))
+	assert.True(t, ef.MayContain("a"))
+	assert.False(t, ef.MayContain("b"))
+
+	// unknown types might contain anything.
+	ef.Type = "nope"
+	assert.True(t, ef.MayContain("b"))
+}
+
+func TestCuckooDelete(t *testing.T) {
+	c, err := NewCuckoo([]uint64{filterHash("a"), filterHash("b")})
+	require.NoError(t, err)
+	require.True(t, c.MayContain("a"))
+
+	require.True(t, c.Delete("a"))
+	assert.False(t, c.MayContain("a"))
+	assert.True(t, c.MayContain("b"))
+	assert.False(t, c.Delete("a"))
+
+	require.True(t, c.Add("a"))
+	assert.True(t, c.MayContain("a"))
+}
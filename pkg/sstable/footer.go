@@ -0,0 +1,124 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Since the footer was added, every sstable ends with a footer document (a BSON
+// document containing the Meta under footerField, which readers recognize as the
+// end of the records), followed by a fixed-size trailer: the length of the
+// footer document as a little-endian uint32, then footerMagic. This allows the
+// Meta to be read from the end of the file without scanning the records.
+const (
+	footerField = "footer"
+	footerMagic = "mudfoot1"
+	TrailerSize = 4 + len(footerMagic)
+)
+
+type footer struct {
+	Meta *Meta `bson:"footer"`
+}
+
+// writeFooter writes the footer and trailer for the given meta.
+func writeFooter(out io.Writer, m *Meta) error {
+	b, err := bson.Marshal(&footer{Meta: m})
+	if err != nil {
+		return fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	var trailer [TrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:4], uint32(len(b)))
+	copy(trailer[4:], footerMagic)
+
+	_, err = out.Write(append(b, trailer[:]...))
+	return err
+}
+
+// ParseTrailer returns the length of the footer document described by the given
+// trailer (the last TrailerSize bytes of an sstable), or false if the sstable
+// has no footer, because it was written before footers existed.
+func ParseTrailer(b []byte) (int, bool) {
+	if len(b) != TrailerSize || !bytes.Equal(b[4:], []byte(footerMagic)) {
+		return 0, false
+	}
+
+	return int(binary.LittleEndian.Uint32(b[:4])), true
+}
+
+// ParseFooter returns the Meta from the given footer document.
+func ParseFooter(b []byte) (*Meta, error) {
+	f := &footer{}
+	err := types.Unmarshal(b, f)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+	if f.Meta == nil {
+		return nil, fmt.Errorf("not a footer")
+	}
+
+	return f.Meta, nil
+}
+
+// isFooter returns true if the given document is a footer, not a record.
+func isFooter(raw bson.Raw) bool {
+	_, err := raw.LookupErr(footerField)
+	return err == nil
+}
+
+// ParseFilename is the inverse of Meta.Filename. It returns the prefix and
+// creation time (truncated to milliseconds) encoded in the given blob key.
+func ParseFilename(key string) (prefix string, created time.Time, err error) {
+	base := path.Base(key)
+	ms, ok := strings.CutSuffix(base, ".sstable")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("not an sstable: %s", key)
+	}
+
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("not an sstable: %s", key)
+	}
+
+	return strings.TrimSuffix(key, base), time.UnixMilli(n).UTC(), nil
+}
+
+// ScanMeta reads every record from the given reader, and returns the Meta of
+// the sstable. If the sstable has a footer, that's returned. Otherwise, it's
+// reconstructed from the records, except for Created and Prefix, which are
+// encoded in the filename (see ParseFilename).
+func ScanMeta(r *Reader) (*Meta, error) {
+	m := &Meta{Size: len(magicBytes)}
+
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Next: %w", err)
+		}
+		if rec == nil {
+			break
+		}
+
+		n, err := rec.Write(io.Discard)
+		if err != nil {
+			return nil, fmt.Errorf("record.Write: %w", err)
+		}
+
+		m.observe(rec, n, n)
+	}
+
+	if f := r.Footer(); f != nil {
+		return f, nil
+	}
+
+	return m, nil
+}
@@ -0,0 +1,136 @@
+package sstable
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+)
+
+// validSSTable returns a small, well-formed sstable to seed the fuzzers with.
+func validSSTable(t testing.TB, opts ...WriterOption) []byte {
+	c := clockwork.NewFakeClockAt(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := NewWriter(c, opts...)
+	w.Add(&types.Record{Key: "a", Timestamp: c.Now(), Document: []byte("one")})
+	w.Add(&types.Record{Key: "b", Timestamp: c.Now(), Document: []byte("two"), Tags: map[string]string{"x": "y"}})
+
+	var buf bytes.Buffer
+	_, err := w.Write(&buf)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// FuzzReader feeds arbitrary bytes to the reader, which must return an error
+// (or some records) rather than panicking or allocating absurd amounts.
+func FuzzReader(f *testing.F) {
+	b := validSSTable(f)
+	f.Add(b)
+	f.Add(b[:len(b)/2])
+	f.Add(b[:len(magicBytes)+4])
+	f.Add(append([]byte(magicBytes), 0xff, 0xff, 0xff, 0x7f))
+
+	b = validSSTable(f, WithFormat(FormatBlocks))
+	f.Add(b)
+	f.Add(b[:len(b)/2])
+	f.Add(append([]byte(magicBlocks), 0xff, 0xff, 0xff, 0x7f))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := NewReader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		for {
+			rec, err := r.Next()
+			if err != nil || rec == nil {
+				break
+			}
+		}
+
+		// seeking takes a different path through blocks.
+		r, _ = NewReader(bytes.NewReader(b))
+		if _, err := r.Seek("b"); err == nil {
+			r.Next()
+		}
+	})
+}
+
+// FuzzFooter feeds arbitrary bytes to the functions which parse the end of an
+// sstable, as ReadMeta does.
+func FuzzFooter(f *testing.F) {
+	b := validSSTable(f)
+	f.Add(b[len(b)-TrailerSize:], b)
+
+	f.Fuzz(func(t *testing.T, trailer, b []byte) {
+		n, ok := ParseTrailer(trailer)
+		if !ok || n > len(b) {
+			return
+		}
+		ParseFooter(b[:n])
+	})
+}
+
+// FuzzRoundTrip checks that whatever is written can be read back unchanged.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("a", []byte("one"), int64(0), "b", []byte("two"), int64(1), false)
+	f.Add("", []byte{}, int64(-1), "\x00", []byte{0}, int64(1<<40), false)
+	f.Add("abc", []byte("one"), int64(0), "abd", []byte("two"), int64(1), true)
+
+	f.Fuzz(func(t *testing.T, k1 string, d1 []byte, ms1 int64, k2 string, d2 []byte, ms2 int64, blocks bool) {
+		c := clockwork.NewFakeClock()
+		in := []*types.Record{
+			{Key: k1, Timestamp: time.UnixMilli(ms1).UTC(), Document: d1},
+			{Key: k2, Timestamp: time.UnixMilli(ms2).UTC(), Document: d2},
+		}
+
+		format := FormatRecords
+		if blocks {
+			format = FormatBlocks
+		}
+
+		w := NewWriter(c, WithFormat(format))
+		for _, rec := range in {
+			require.NoError(t, w.Add(rec))
+		}
+
+		var buf bytes.Buffer
+		m, err := w.Write(&buf)
+		if err != nil {
+			// keys containing NUL can't be encoded as BSON.
+			return
+		}
+
+		r, err := NewReader(&buf)
+		require.NoError(t, err)
+
+		var out []*types.Record
+		for {
+			rec, err := r.Next()
+			require.NoError(t, err)
+			if rec == nil {
+				break
+			}
+			out = append(out, rec)
+		}
+
+		// identical keys and timestamps are deduped.
+		if k1 == k2 && ms1 == ms2 {
+			in = in[:1]
+		}
+
+		require.Len(t, out, len(in))
+		require.Equal(t, m.Count, len(out))
+		for _, rec := range out {
+			found := false
+			for _, exp := range in {
+				if rec.Key == exp.Key && rec.Timestamp.Equal(exp.Timestamp) && bytes.Equal(rec.Document, exp.Document) {
+					found = true
+				}
+			}
+			require.True(t, found, "unexpected record: %+v", rec)
+		}
+	})
+}
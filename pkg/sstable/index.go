@@ -0,0 +1,189 @@
+package sstable
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Index is a summary of an sstable, which is small enough to fetch before it,
+// so that readers can skip sstables which don't contain a key, and read only
+// part of those which do. It's written alongside the sstable by the writer.
+type Index struct {
+	// Entries are the first key and offset of each block, or in FormatRecords,
+	// of each run of roughly BlockSize bytes of records. Sorted by offset, and
+	// so by key.
+	Entries []IndexEntry `bson:"entries"`
+
+	// Filter contains every key in the sstable.
+	Filter *EncodedFilter `bson:"filter,omitempty"`
+}
+
+type IndexEntry struct {
+	Key    string `bson:"key"`
+	Offset int64  `bson:"offset"`
+
+	// The number of records in the entry, and the total size of their
+	// documents. The size of the entry itself is the difference between its
+	// offset and the next one's (or the end of the records).
+	Count      int `bson:"count,omitempty"`
+	ValueBytes int `bson:"value_bytes,omitempty"`
+}
+
+// MayContain returns false if the sstable definitely doesn't contain the key.
+func (ix *Index) MayContain(key string) bool {
+	if ix.Filter == nil {
+		return true
+	}
+
+	return ix.Filter.MayContain(key)
+}
+
+// Locate returns the offset at which to start reading to find the first (i.e.
+// newest) record with the given key, or zero if the whole sstable must be read.
+// Versions of a key can span entries, so this is the last entry with a smaller
+// key, not the first with an equal one.
+func (ix *Index) Locate(key string) int64 {
+	i := sort.Search(len(ix.Entries), func(i int) bool {
+		return ix.Entries[i].Key >= key
+	})
+
+	if i == 0 {
+		return 0
+	}
+
+	return ix.Entries[i-1].Offset
+}
+
+// Marshal returns the encoded index.
+func (ix *Index) Marshal() ([]byte, error) {
+	return bson.Marshal(ix)
+}
+
+// ParseIndex returns the index encoded by Marshal.
+func ParseIndex(b []byte) (*Index, error) {
+	ix := &Index{}
+	err := types.Unmarshal(b, ix)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+
+	return ix, nil
+}
+
+// indexer builds an Index as an sstable is written.
+type indexer struct {
+	filter  FilterType
+	entries []IndexEntry
+	hashes  []uint64
+	last    int64
+}
+
+// observe records that a record with the given key and document size is about
+// to be written at the given offset (or in FormatBlocks, in the block starting at
+// it). If newEntry is true, the record begins a new entry (i.e. a new block).
+// Otherwise, one is only started if it's been a while.
+func (ix *indexer) observe(key string, valueSize int, offset int64, newEntry bool) {
+	if n := len(ix.entries); n == 0 || newEntry || (offset-ix.last) >= BlockSize {
+		ix.entries = append(ix.entries, IndexEntry{Key: key, Offset: offset})
+		ix.last = offset
+	}
+
+	e := &ix.entries[len(ix.entries)-1]
+	e.Count++
+	e.ValueBytes += valueSize
+}
+
+// addKey adds a distinct key to the filter.
+func (ix *indexer) addKey(key string) {
+	ix.hashes = append(ix.hashes, filterHash(key))
+}
+
+func (ix *indexer) build() (*Index, error) {
+	f, err := BuildFilter(ix.filter, ix.hashes)
+	if err != nil {
+		return nil, fmt.Errorf("BuildFilter: %w", err)
+	}
+
+	return &Index{
+		Entries: ix.entries,
+		Filter:  f,
+	}, nil
+}
+
+// BuildIndex reads a whole sstable from r, and returns the same index as the
+// writer would have with the given filter type, for sstables which were written
+// before indexes existed. The reader is read from the start, and isn't closed.
+func BuildIndex(r io.Reader, filter FilterType) (*Index, error) {
+	cr := &countingReader{r: r}
+	reader, err := NewReader(cr)
+	if err != nil {
+		return nil, fmt.Errorf("NewReader: %w", err)
+	}
+
+	// don't close the reader, since that would close r.
+	defer func() {
+		putBuf(reader.buf)
+		putBuf(reader.blockBuf)
+	}()
+
+	ix := &indexer{filter: filter}
+	var prev []byte
+	first := true
+	var blockStart int64
+
+	for {
+		// the offset of the record, or of the block which is about to be read.
+		newBlock := reader.format == FormatBlocks && reader.blk.done()
+		offset := cr.n
+		if newBlock {
+			blockStart = offset
+		}
+		if reader.format == FormatBlocks {
+			offset = blockStart
+		}
+
+		raw, err := reader.NextRaw()
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			break
+		}
+
+		k, ok := types.RawKey(raw)
+		if !ok {
+			return nil, fmt.Errorf("record has no key")
+		}
+
+		var vs int
+		if _, doc, ok := raw.Lookup("doc").BinaryOK(); ok {
+			vs = len(doc)
+		}
+
+		ix.observe(string(k), vs, offset, newBlock)
+
+		if first || string(k) != string(prev) {
+			ix.addKey(string(k))
+			prev = append(prev[:0], k...)
+			first = false
+		}
+	}
+
+	return ix.build()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
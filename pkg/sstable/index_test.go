@@ -0,0 +1,114 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	recs := prefixedRecords(500)
+
+	for _, f := range []Format{FormatRecords, FormatBlocks} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			w := NewWriter(clockwork.NewFakeClock(), WithFormat(f))
+			for _, rec := range recs {
+				require.NoError(t, w.Add(rec))
+			}
+
+			var buf bytes.Buffer
+			_, err := w.Write(&buf)
+			require.NoError(t, err)
+			data := buf.Bytes()
+
+			// round-trip it, like the blobstore does.
+			b, err := w.Index().Marshal()
+			require.NoError(t, err)
+			ix, err := ParseIndex(b)
+			require.NoError(t, err)
+
+			require.Greater(t, len(ix.Entries), 10)
+			assert.Less(t, len(b), len(data)/10, "index is too large")
+
+			// every key can be found by reading from where the index says.
+			for i := 0; i < 500; i += 7 {
+				key := recs[i*3].Key
+				require.True(t, ix.MayContain(key), key)
+
+				off := ix.Locate(key)
+				var r *Reader
+				if off == 0 {
+					r, err = NewReader(bytes.NewReader(data))
+					require.NoError(t, err)
+				} else {
+					r = NewRecordReader(bytes.NewReader(data[off:]), f)
+				}
+
+				_, err = r.Seek(key)
+				require.NoError(t, err)
+				rec, err := r.Next()
+				require.NoError(t, err)
+				require.NotNil(t, rec, key)
+				assert.Equal(t, key, rec.Key)
+				assert.Equal(t, fmt.Sprintf("doc-%d-2", i), string(rec.Document))
+			}
+
+			// most missing keys are filtered out.
+			fp := 0
+			for i := range 1000 {
+				if ix.MayContain(fmt.Sprintf("missing-%d", i)) {
+					fp++
+				}
+			}
+			assert.Less(t, fp, 50)
+		})
+	}
+}
+
+func TestIndexLocate(t *testing.T) {
+	ix := &Index{Entries: []IndexEntry{
+		{Key: "b", Offset: 7},
+		{Key: "d", Offset: 100},
+		{Key: "d", Offset: 200},
+		{Key: "f", Offset: 300},
+	}}
+
+	assert.Equal(t, int64(0), ix.Locate("a"))
+	assert.Equal(t, int64(0), ix.Locate("b"))
+	assert.Equal(t, int64(7), ix.Locate("c"))
+
+	// versions of d might start in the first entry's run.
+	assert.Equal(t, int64(7), ix.Locate("d"))
+	assert.Equal(t, int64(200), ix.Locate("e"))
+	assert.Equal(t, int64(300), ix.Locate("z"))
+
+	// no filter means anything might be present.
+	assert.True(t, ix.MayContain("zzz"))
+}
+
+func TestBuildIndex(t *testing.T) {
+	recs := prefixedRecords(500)
+
+	for _, f := range []Format{FormatRecords, FormatBlocks} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			w := NewWriter(clockwork.NewFakeClock(), WithFormat(f), WithFilter(FilterRibbon))
+			for _, rec := range recs {
+				require.NoError(t, w.Add(rec))
+			}
+
+			var buf bytes.Buffer
+			_, err := w.Write(&buf)
+			require.NoError(t, err)
+
+			// an index built from the sstable is the same as the one which
+			// was built while writing it.
+			ix, err := BuildIndex(bytes.NewReader(buf.Bytes()), FilterRibbon)
+			require.NoError(t, err)
+			assert.Equal(t, w.Index(), ix)
+		})
+	}
+}
@@ -14,6 +14,10 @@ type MergeReader struct {
 	h recHeap
 }
 
+// NewMergeReader returns a reader which merges the given readers, returning the
+// records of each key newest first. Records with the same key and timestamp are
+// returned in the order of their readers, so callers which care which of them
+// wins (e.g. the first one kept by Dedupe) should pass the newest first.
 func NewMergeReader(readers []*Reader) (*MergeReader, error) {
 	h := make(recHeap, 0, len(readers))
 	heap.Init(&h)
@@ -28,6 +32,7 @@ func NewMergeReader(readers []*Reader) (*MergeReader, error) {
 			heap.Push(&h, &readerState{
 				reader: r,
 				rec:    rec,
+				order:  i,
 			})
 		}
 	}
@@ -61,6 +66,9 @@ func (m *MergeReader) Next() (*types.Record, error) {
 type readerState struct {
 	reader *Reader
 	rec    *types.Record
+
+	// the index of the reader, to break ties.
+	order int
 }
 
 type recHeap []*readerState
@@ -71,8 +79,11 @@ func (h recHeap) Len() int {
 
 func (h recHeap) Less(i, j int) bool {
 
-	// when keys ar ethe same, sort by timestamp.
+	// when keys ar ethe same, sort by timestamp, then by reader.
 	if h[i].rec.Key == h[j].rec.Key {
+		if h[i].rec.Timestamp.Equal(h[j].rec.Timestamp) {
+			return h[i].order < h[j].order
+		}
 		return h[i].rec.Timestamp.After(h[j].rec.Timestamp)
 	}
 
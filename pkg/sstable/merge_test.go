@@ -113,17 +113,45 @@ func TestMergeReaderExactSameTimestamp(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "a", rec1.Key)
 	assert.Equal(t, now.Unix(), rec1.Timestamp.Unix())
+	assert.Equal(t, []byte("a1"), rec1.Document)
 
 	rec2, err := m.Next()
 	require.NoError(t, err)
 	assert.Equal(t, "a", rec2.Key)
 	assert.Equal(t, now.Unix(), rec2.Timestamp.Unix())
+	assert.Equal(t, []byte("a2"), rec2.Document)
 
 	rec, err := m.Next()
 	assert.Equal(t, io.EOF, err)
 	assert.Nil(t, rec)
 }
 
+func TestMergeReaderTiesByReaderOrder(t *testing.T) {
+	now := time.Now().UTC()
+
+	for _, first := range []string{"a1", "a2"} {
+		r1 := readerWithRecords(t, []*types.Record{
+			{Key: "a", Timestamp: now, Document: []byte("a1")},
+		})
+
+		r2 := readerWithRecords(t, []*types.Record{
+			{Key: "a", Timestamp: now, Document: []byte("a2")},
+		})
+
+		readers := []*Reader{r1, r2}
+		if first == "a2" {
+			readers = []*Reader{r2, r1}
+		}
+
+		m, err := NewMergeReader(readers)
+		require.NoError(t, err)
+
+		rec, err := m.Next()
+		require.NoError(t, err)
+		assert.Equal(t, []byte(first), rec.Document)
+	}
+}
+
 func readerWithRecords(t *testing.T, records []*types.Record) *Reader {
 	var buf bytes.Buffer
 	buf.WriteString(magicBytes)
@@ -3,6 +3,8 @@ package sstable
 import (
 	"fmt"
 	"time"
+
+	"github.com/adammck/blobby/pkg/types"
 )
 
 type Meta struct {
@@ -13,6 +15,21 @@ type Meta struct {
 	Count   int       `bson:"count"`
 	Size    int       `bson:"size"`
 
+	// Keys is the number of distinct keys, which is less than Count if some
+	// keys have several versions. Zero for sstables written before this existed.
+	Keys int `bson:"keys,omitempty"`
+
+	// The smallest, largest, and total size of the documents of the records,
+	// in bytes, as stored (i.e. after encoding by any codec). Zero for sstables
+	// written before these existed, so check ValueBytes before trusting them.
+	MinValueSize int `bson:"min_value_size,omitempty"`
+	MaxValueSize int `bson:"max_value_size,omitempty"`
+	ValueBytes   int `bson:"value_bytes,omitempty"`
+
+	// RawSize is the total size of the records, in bytes, when encoded as BSON,
+	// before any compression by the format. See CompressionRatio.
+	RawSize int `bson:"raw_size,omitempty"`
+
 	// Warning! Even though this is a time.Time, which has nanosecond precision
 	// and a zone, when serialized to BSON, it's truncated into a UTC datetime
 	// with only millisecond precision. Since the metadata store is currently
@@ -20,10 +37,120 @@ type Meta struct {
 	//
 	// See: https://bsonspec.org/spec.html
 	Created time.Time `bson:"created"`
+
+	// Prefix is prepended to the filename of this sstable, to spread sstables
+	// across the keyspace of the bucket. It's chosen by a KeyScheme when the
+	// sstable is written, and stored here so the filename can be resolved even
+	// after the scheme is changed. Empty for sstables written before this.
+	Prefix string `bson:"prefix,omitempty"`
+
+	// Bucket is the bucket which this sstable was written to, when it's not the
+	// archive's primary bucket. See blobstore.WithBuckets.
+	Bucket string `bson:"bucket,omitempty"`
+
+	// Format is how the records are laid out. Readers work this out from the
+	// sstable itself, but it's needed to read from the middle of one.
+	Format Format `bson:"format,omitempty"`
+
+	// Level is the level of this sstable in the tree. Flushes write level zero,
+	// and compactions write the level below their shallowest input, or the level
+	// of their deepest input if that's deeper. Sstables written before levels
+	// existed are all at level zero.
+	Level int `bson:"level"`
+
+	// Generation is the number of compactions which the records in this sstable
+	// have been through: zero for flushes, and one more than the greatest of
+	// the inputs for compactions.
+	Generation int `bson:"generation"`
+
+	// SmallestSeq and LargestSeq are the range of sequence numbers allocated to
+	// this sstable (by metadata.Store.NextSeq) when it was flushed, or the range
+	// spanned by the inputs of a compaction. Sequence numbers increase with
+	// every flush, so an sstable whose range is greater than another's contains
+	// newer writes. Zero for sstables written before these existed. Like Index,
+	// these are set after the footer is written, so aren't in it.
+	SmallestSeq int64 `bson:"smallest_seq,omitempty"`
+	LargestSeq  int64 `bson:"largest_seq,omitempty"`
+
+	// Index is the key of the companion blob containing the Index of this
+	// sstable, in the same bucket. Empty for sstables written before indexes
+	// existed, which must be read from the start.
+	Index string `bson:"index,omitempty"`
+
+	// Checksum is the CRC-32C (Castagnoli) of the whole sstable blob, set when
+	// it's uploaded, so like Index it isn't in the footer. Zero for sstables
+	// written before this existed.
+	Checksum uint32 `bson:"checksum,omitempty"`
+
+	// Filter is a copy of the filter from the index, if it was small enough to
+	// store in the metadata (see blobstore.WithInlineFilters), so that readers
+	// can rule out this sstable without fetching anything.
+	Filter *EncodedFilter `bson:"filter,omitempty"`
 }
 
 // Filename returns the filename of this sstable. It happens to be based on the
 // creation time, but it should be considered opaque.
 func (m *Meta) Filename() string {
-	return fmt.Sprintf("%d.sstable", m.Created.UnixMilli())
+	return fmt.Sprintf("%s%d.sstable", m.Prefix, m.Created.UnixMilli())
+}
+
+// IndexFilename returns the filename of the index of this sstable.
+func (m *Meta) IndexFilename() string {
+	return m.Filename() + ".index"
+}
+
+// AvgValueSize returns the mean size of the documents of the records, or zero if
+// it's unknown.
+func (m *Meta) AvgValueSize() float64 {
+	if m.Count == 0 {
+		return 0
+	}
+
+	return float64(m.ValueBytes) / float64(m.Count)
+}
+
+// CompressionRatio returns the size of the records when encoded as BSON divided
+// by their size in the sstable (excluding the footer), or zero if it's unknown.
+// It's about one for FormatRecords, and more for FormatBlocks.
+func (m *Meta) CompressionRatio() float64 {
+	if m.RawSize == 0 || m.Size == 0 {
+		return 0
+	}
+
+	return float64(m.RawSize) / float64(m.Size)
+}
+
+// observe updates the stats to include the given record, which was raw bytes
+// when encoded as BSON, and added n bytes to the sstable. (They differ when the
+// format compresses records.) Records must be observed in the order they're
+// written, i.e. sorted by key.
+func (m *Meta) observe(rec *types.Record, n, raw int) {
+	m.Count++
+	m.Size += n
+	m.RawSize += raw
+
+	vs := len(rec.Document)
+	if m.Count == 1 || vs < m.MinValueSize {
+		m.MinValueSize = vs
+	}
+	m.MaxValueSize = max(m.MaxValueSize, vs)
+	m.ValueBytes += vs
+
+	// records are sorted by key, so the first is the min and the last is the
+	// max. (the empty string is a valid key, so can't be a sentinel.)
+	if m.Count == 1 {
+		m.MinKey = rec.Key
+	}
+	if m.Count == 1 || rec.Key != m.MaxKey {
+		m.Keys++
+	}
+	m.MaxKey = rec.Key
+
+	if m.MinTime.IsZero() || rec.Timestamp.Before(m.MinTime) {
+		m.MinTime = rec.Timestamp
+	}
+
+	if m.MaxTime.IsZero() || rec.Timestamp.After(m.MaxTime) {
+		m.MaxTime = rec.Timestamp
+	}
 }
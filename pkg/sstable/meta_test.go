@@ -1,10 +1,14 @@
 package sstable
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMetaFilename(t *testing.T) {
@@ -15,3 +19,79 @@ func TestMetaFilename(t *testing.T) {
 	// truncated (not rounded) to milliseconds.
 	assert.Equal(t, "1234567891234.sstable", meta.Filename())
 }
+
+func TestMetaFilenameWithPrefix(t *testing.T) {
+	meta := &Meta{
+		Created: time.Unix(1234567890, 0),
+		Prefix:  "abcd/",
+	}
+
+	assert.Equal(t, "abcd/1234567890000.sstable", meta.Filename())
+}
+
+func TestKeySchemePrefix(t *testing.T) {
+	meta := &Meta{
+		Created: time.Date(2025, 1, 10, 2, 3, 4, 0, time.UTC),
+	}
+
+	assert.Equal(t, "", FlatKeys.Prefix(meta))
+	assert.Equal(t, "2025/01/10/", DateKeys.Prefix(meta))
+
+	// hashed prefixes are stable, and four hex chars.
+	p := HashedKeys.Prefix(meta)
+	assert.Regexp(t, "^[0-9a-f]{4}/$", p)
+	assert.Equal(t, p, HashedKeys.Prefix(meta))
+}
+
+func TestParseKeyScheme(t *testing.T) {
+	for _, s := range []KeyScheme{FlatKeys, HashedKeys, DateKeys} {
+		ss, err := ParseKeyScheme(s.String())
+		assert.NoError(t, err)
+		assert.Equal(t, s, ss)
+	}
+
+	_, err := ParseKeyScheme("nope")
+	assert.Error(t, err)
+}
+
+func TestMetaStats(t *testing.T) {
+	// prefixedRecords has documents of 7 to 9 bytes.
+	recs := prefixedRecords(1000)
+
+	for _, f := range []Format{FormatRecords, FormatBlocks} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			w := NewWriter(clockwork.NewFakeClock(), WithFormat(f))
+			want := 0
+			for _, rec := range recs {
+				require.NoError(t, w.Add(rec))
+				want += len(rec.Document)
+			}
+
+			var buf bytes.Buffer
+			m, err := w.Write(&buf)
+			require.NoError(t, err)
+
+			assert.Equal(t, 3000, m.Count)
+			assert.Equal(t, 1000, m.Keys)
+			assert.Equal(t, 7, m.MinValueSize)
+			assert.Equal(t, 9, m.MaxValueSize)
+			assert.Equal(t, want, m.ValueBytes)
+			assert.InDelta(t, float64(want)/float64(len(recs)), m.AvgValueSize(), 0.001)
+
+			if f == FormatRecords {
+				assert.Equal(t, m.Size-len(magicBytes), m.RawSize)
+			} else {
+				assert.Greater(t, m.CompressionRatio(), 1.5)
+			}
+
+			// the per-block stats add up.
+			count, vb := 0, 0
+			for _, e := range w.Index().Entries {
+				count += e.Count
+				vb += e.ValueBytes
+			}
+			assert.Equal(t, m.Count, count)
+			assert.Equal(t, m.ValueBytes, vb)
+		})
+	}
+}
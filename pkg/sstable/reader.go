@@ -1,15 +1,48 @@
 package sstable
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/adammck/blobby/pkg/types"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+// bufPool holds the buffers which readers read raw records into, so scanning
+// doesn't allocate for every record.
+// Buffers grown larger than maxPooledBuffer by huge records aren't pooled.
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+const maxPooledBuffer = 1024 * 1024
+
 type Reader struct {
-	// TODO: this should be ReadCloser. i think we're leaking connections.
-	r io.Reader
+	r      io.Reader
+	format Format
+
+	// reused by NextRaw. taken from bufPool on first use, and returned by
+	// Close.
+	buf *[]byte
+
+	// the current block, and the buffer which it's read into, if the format
+	// is FormatBlocks.
+	blk      block
+	blockBuf *[]byte
+
+	// a record which was read by Seek, to be returned by the next NextRaw.
+	pending bson.Raw
+
+	// set once the end of the records has been reached.
+	eof bool
+
+	// set once the footer has been read.
+	footer *Meta
 }
 
 func NewReader(r io.Reader) (*Reader, error) {
@@ -17,15 +50,296 @@ func NewReader(r io.Reader) (*Reader, error) {
 	if _, err := io.ReadFull(r, magic); err != nil {
 		return nil, fmt.Errorf("read magic bytes: %w", err)
 	}
-	if string(magic) != magicBytes {
+
+	var f Format
+	switch string(magic) {
+	case magicBytes:
+		f = FormatRecords
+	case magicBlocks:
+		f = FormatBlocks
+	default:
 		return nil, fmt.Errorf("wrong magic bytes")
 	}
 
 	return &Reader{
-		r: r,
+		r:      r,
+		format: f,
 	}, nil
 }
 
+// NewRecordReader returns a reader for a stream which starts partway through
+// an sstable in the given format, rather than at the beginning, e.g. the body of
+// a ranged read. It must start at the beginning of a record, or for FormatBlocks,
+// a block. There are no magic bytes to check.
+func NewRecordReader(r io.Reader, f Format) *Reader {
+	return &Reader{
+		r:      r,
+		format: f,
+	}
+}
+
+// Close closes the underlying reader, if it's an io.Closer. Readers of blobs
+// must be closed, or their connection leaks. Records returned by NextRaw must
+// not be used after this.
+func (r *Reader) Close() error {
+	putBuf(r.buf)
+	putBuf(r.blockBuf)
+	r.buf = nil
+	r.blockBuf = nil
+	r.blk = block{}
+	r.pending = nil
+
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	if b != nil && cap(*b) <= maxPooledBuffer {
+		bufPool.Put(b)
+	}
+}
+
+// Format returns the format of the sstable.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Next returns the next record, or nil at the end of the records.
 func (r *Reader) Next() (*types.Record, error) {
-	return types.Read(r.r)
+	raw, err := r.NextRaw()
+	if err != nil || raw == nil {
+		return nil, err
+	}
+
+	rec := &types.Record{}
+	err = types.Unmarshal(raw, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// NextRaw returns the next record without decoding it, or nil at the end of the
+// records. It's validated, so can be inspected with types.RawKey, and decoded
+// with types.Unmarshal. To avoid allocating, it's read into a buffer which is
+// reused by the next call, so it's only valid until then.
+func (r *Reader) NextRaw() (bson.Raw, error) {
+	if r.pending != nil {
+		raw := r.pending
+		r.pending = nil
+		return raw, nil
+	}
+
+	if r.eof {
+		return nil, nil
+	}
+
+	if r.buf == nil {
+		r.buf = getBuf()
+	}
+
+	if r.format == FormatBlocks {
+		return r.nextEntry()
+	}
+
+	raw, buf, err := types.ReadRawInto(r.r, *r.buf)
+	*r.buf = buf
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		r.eof = true
+		return nil, nil
+	}
+
+	err = types.Validate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if isFooter(raw) {
+		r.eof = true
+		r.footer, err = ParseFooter(raw)
+		if err != nil {
+			return nil, fmt.Errorf("ParseFooter: %w", err)
+		}
+		return nil, nil
+	}
+
+	return raw, nil
+}
+
+// nextEntry returns the next record from the current block, or the next one.
+func (r *Reader) nextEntry() (bson.Raw, error) {
+	for r.blk.done() {
+		ok, err := r.nextBlock()
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	key, value, next, err := r.blk.peek()
+	if err != nil {
+		return nil, err
+	}
+	r.blk.pos = next
+
+	return r.reconstruct(key, value)
+}
+
+// reconstruct returns the encoded record with the given key and value (from a
+// block entry) in r.buf.
+func (r *Reader) reconstruct(key, value []byte) (bson.Raw, error) {
+	raw, err := withKey(*r.buf, key, value)
+	if err != nil {
+		return nil, err
+	}
+	*r.buf = raw
+
+	err = types.Validate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// nextBlock reads the next block into r.blk. It returns false at the end of the
+// blocks, after reading the footer.
+func (r *Reader) nextBlock() (bool, error) {
+	if r.blockBuf == nil {
+		r.blockBuf = getBuf()
+	}
+
+	buf := (*r.blockBuf)[:0]
+	if cap(buf) < 4 {
+		buf = make([]byte, 0, 4)
+	}
+
+	_, err := io.ReadFull(r.r, buf[:4])
+	if err != nil {
+		if err == io.EOF {
+			// truncated before the end marker.
+			err = io.ErrUnexpectedEOF
+		}
+		return false, fmt.Errorf("read block length: %w", err)
+	}
+
+	n := int(binary.LittleEndian.Uint32(buf[:4]))
+	if n == 0 {
+		r.eof = true
+		return false, r.readFooter()
+	}
+	if n > maxBlockSize {
+		return false, fmt.Errorf("invalid block length: %d", n)
+	}
+
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	*r.blockBuf = buf
+
+	_, err = io.ReadFull(r.r, buf)
+	if err != nil {
+		return false, fmt.Errorf("read block: %w", err)
+	}
+
+	return true, r.blk.reset(buf)
+}
+
+// readFooter reads the footer which follows the blocks.
+func (r *Reader) readFooter() error {
+	raw, err := types.ReadRaw(r.r)
+	if err != nil || raw == nil {
+		return err
+	}
+
+	r.footer, err = ParseFooter(raw)
+	if err != nil {
+		return fmt.Errorf("ParseFooter: %w", err)
+	}
+
+	return nil
+}
+
+// Seek skips to the first record with a key greater than or equal to the given
+// key, so that it's the next one returned by NextRaw or Next. If there isn't one,
+// they return nil. It returns the number of records which were looked at. In
+// FormatBlocks, only a few records per block are, since the restart points are
+// binary searched. Otherwise, every record before the key is.
+func (r *Reader) Seek(key string) (int, error) {
+	n := 0
+
+	if r.format != FormatBlocks || r.pending != nil {
+		for {
+			raw, err := r.NextRaw()
+			if err != nil || raw == nil {
+				return n, err
+			}
+			n++
+
+			k, ok := types.RawKey(raw)
+			if !ok {
+				return n, fmt.Errorf("record has no key")
+			}
+
+			if string(k) >= key {
+				r.pending = raw
+				return n, nil
+			}
+		}
+	}
+
+	if r.eof {
+		return n, nil
+	}
+
+	for {
+		if r.blk.done() {
+			ok, err := r.nextBlock()
+			if err != nil || !ok {
+				return n, err
+			}
+
+			m, err := r.blk.seek(key)
+			n += m
+			if err != nil {
+				return n, err
+			}
+
+			if !r.blk.done() {
+				return n, nil
+			}
+			continue
+		}
+
+		// partway through a block, which can't be searched.
+		k, _, next, err := r.blk.peek()
+		if err != nil {
+			return n, err
+		}
+		n++
+
+		if string(k) >= key {
+			return n, nil
+		}
+
+		r.blk.pos = next
+	}
+}
+
+// Footer returns the Meta from the footer of the sstable, once Next has reached
+// the end of the records. It's nil before then, or if the sstable was written
+// before footers existed.
+func (r *Reader) Footer() *Meta {
+	return r.footer
 }
@@ -53,3 +53,103 @@ func TestReaderNextEOF(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, rec)
 }
+
+func TestReaderNextRaw(t *testing.T) {
+	w, _ := newWriter()
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	_ = w.Add(&types.Record{Key: "a", Timestamp: ts, Document: []byte("short")})
+	_ = w.Add(&types.Record{Key: "b", Timestamp: ts, Document: bytes.Repeat([]byte("x"), 8192)})
+	_ = w.Add(&types.Record{Key: "c", Timestamp: ts, Document: []byte("short")})
+
+	var buf bytes.Buffer
+	_, err := w.Write(&buf)
+	require.NoError(t, err)
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var keys []string
+	var first *types.Record
+	for {
+		raw, err := r.NextRaw()
+		require.NoError(t, err)
+		if raw == nil {
+			break
+		}
+
+		k, ok := types.RawKey(raw)
+		require.True(t, ok)
+		keys = append(keys, string(k))
+
+		// decoded records don't alias the reused buffer.
+		if first == nil {
+			first = &types.Record{}
+			require.NoError(t, types.Unmarshal(raw, first))
+		}
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, "a", first.Key)
+	assert.Equal(t, []byte("short"), first.Document)
+	assert.Equal(t, 3, r.Footer().Count)
+}
+
+func TestReaderFooter(t *testing.T) {
+	w, c := newWriter()
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: c.Now(), Document: []byte("doc1")})
+
+	var buf bytes.Buffer
+	meta, err := w.Write(&buf)
+	require.NoError(t, err)
+
+	// the trailer points at the footer.
+	b := buf.Bytes()
+	n, ok := ParseTrailer(b[len(b)-TrailerSize:])
+	require.True(t, ok)
+	fm, err := ParseFooter(b[len(b)-TrailerSize-n : len(b)-TrailerSize])
+	require.NoError(t, err)
+	assert.Equal(t, meta.Count, fm.Count)
+
+	// the reader stops at the footer.
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	sm, err := ScanMeta(r)
+	require.NoError(t, err)
+	assert.Equal(t, "key1", sm.MinKey)
+	assert.Equal(t, 1, sm.Count)
+	assert.NotNil(t, r.Footer())
+}
+
+func TestScanMetaWithoutFooter(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte(magicBytes))
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, k := range []string{"a", "b", "c"} {
+		_, err := (&types.Record{Key: k, Timestamp: ts, Document: []byte("doc")}).Write(&buf)
+		require.NoError(t, err)
+	}
+	size := buf.Len()
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	m, err := ScanMeta(r)
+	require.NoError(t, err)
+	assert.Nil(t, r.Footer())
+	assert.Equal(t, 3, m.Count)
+	assert.Equal(t, size, m.Size)
+	assert.Equal(t, "a", m.MinKey)
+	assert.Equal(t, "c", m.MaxKey)
+	assert.Equal(t, ts, m.MinTime)
+}
+
+func TestParseFilename(t *testing.T) {
+	m := &Meta{Created: time.UnixMilli(1700000000123).UTC(), Prefix: "2024/01/02/"}
+	prefix, created, err := ParseFilename(m.Filename())
+	require.NoError(t, err)
+	assert.Equal(t, m.Prefix, prefix)
+	assert.Equal(t, m.Created, created)
+
+	_, _, err = ParseFilename("manifests/blobby.json")
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// ribbonWidth is the number of slots which each key's equation spans.
+const ribbonWidth = 64
+
+// Ribbon is a (standard, homogeneous-width) ribbon filter. Each key maps to a
+// random linear equation over GF(2) on 64 consecutive slots of 8 bits, and the
+// slots are the solution to every key's equation. A key is present if its
+// equation holds, which for other keys is true 1/256 of the time. See FilterRibbon.
+//
+// See: https://arxiv.org/abs/2103.02515
+type Ribbon struct {
+	seed  uint32
+	slots []uint8
+}
+
+// NewRibbon returns a ribbon filter containing the keys with the given hashes.
+// Building can fail (rarely) for a given seed and size, in which case another
+// seed and a little more space are tried.
+func NewRibbon(hashes []uint64) (*Ribbon, error) {
+	m := len(hashes) + len(hashes)/10 + ribbonWidth
+
+	for seed := range uint32(8) {
+		r := &Ribbon{
+			seed:  seed,
+			slots: make([]uint8, m),
+		}
+
+		if r.solve(hashes) {
+			return r, nil
+		}
+
+		m += m / 20
+	}
+
+	return nil, fmt.Errorf("couldn't build ribbon filter of %d keys", len(hashes))
+}
+
+// hash returns the first slot, the coefficients, and the expected result of the
+// equation for the key with the given hash. The lowest coefficient is always
+// set, so the first slot is always part of the equation.
+func (r *Ribbon) hash(h uint64) (int, uint64, uint8) {
+	x := mix64(h ^ (uint64(r.seed) * 0x9e3779b97f4a7c15))
+	start := int(mix64(x^0x5851f42d4c957f2d) % uint64(len(r.slots)-ribbonWidth+1))
+	return start, x | 1, uint8(mix64(x + 1))
+}
+
+// solve fills the slots such that every key's equation holds, or returns false
+// if that's impossible. The equations are reduced to echelon form as they're
+// added (each one is stored at the slot of its lowest coefficient), then the
+// slots are solved from the end backwards.
+func (r *Ribbon) solve(hashes []uint64) bool {
+	m := len(r.slots)
+	coeffs := make([]uint64, m)
+	results := make([]uint8, m)
+
+	for _, h := range hashes {
+		s, c, res := r.hash(h)
+		for {
+			if coeffs[s] == 0 {
+				coeffs[s] = c
+				results[s] = res
+				break
+			}
+
+			c ^= coeffs[s]
+			res ^= results[s]
+			if c == 0 {
+				// the equation was redundant, which is fine, unless it was
+				// inconsistent with the others.
+				if res != 0 {
+					return false
+				}
+				break
+			}
+
+			tz := bits.TrailingZeros64(c)
+			s += tz
+			c >>= tz
+		}
+	}
+
+	for i := m - 1; i >= 0; i-- {
+		v := results[i]
+		for rest := coeffs[i] &^ 1; rest != 0; rest &= rest - 1 {
+			v ^= r.slots[i+bits.TrailingZeros64(rest)]
+		}
+		r.slots[i] = v
+	}
+
+	return true
+}
+
+func (r *Ribbon) MayContain(key string) bool {
+	s, c, res := r.hash(filterHash(key))
+
+	var v uint8
+	for ; c != 0; c &= c - 1 {
+		v ^= r.slots[s+bits.TrailingZeros64(c)]
+	}
+
+	return v == res
+}
+
+// MarshalBinary returns the seed followed by the slots.
+func (r *Ribbon) MarshalBinary() []byte {
+	b := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(r.slots)), r.seed)
+	return append(b, r.slots...)
+}
+
+// UnmarshalRibbon returns the filter encoded by MarshalBinary. It aliases b.
+func UnmarshalRibbon(b []byte) (*Ribbon, error) {
+	if len(b) < 4+ribbonWidth {
+		return nil, fmt.Errorf("ribbon filter too short: %d", len(b))
+	}
+
+	return &Ribbon{
+		seed:  binary.LittleEndian.Uint32(b),
+		slots: b[4:],
+	}, nil
+}
@@ -0,0 +1,66 @@
+package sstable
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// KeyScheme determines the prefix of the blob key (i.e. the directory) which
+// an sstable is written to. This matters at scale, because S3 partitions
+// buckets by key prefix, so writing everything to the same prefix creates hot
+// spots, and makes listing slow.
+type KeyScheme int
+
+const (
+	// FlatKeys writes every sstable to the root of the bucket. This is the
+	// default, and was the only option for a long time.
+	FlatKeys KeyScheme = iota
+
+	// HashedKeys writes each sstable under a short prefix derived from a hash of
+	// its filename, which spreads writes evenly across S3 partitions.
+	HashedKeys
+
+	// DateKeys writes each sstable under a YYYY/MM/DD prefix derived from its
+	// creation time, which makes it easy to list or expire them by date.
+	DateKeys
+)
+
+func (s KeyScheme) String() string {
+	switch s {
+	case FlatKeys:
+		return "flat"
+	case HashedKeys:
+		return "hashed"
+	case DateKeys:
+		return "date"
+	default:
+		return fmt.Sprintf("KeyScheme(%d)", int(s))
+	}
+}
+
+// ParseKeyScheme returns the KeyScheme with the given name, as returned by
+// String.
+func ParseKeyScheme(name string) (KeyScheme, error) {
+	for _, s := range []KeyScheme{FlatKeys, HashedKeys, DateKeys} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown key scheme: %s", name)
+}
+
+// Prefix returns the prefix which should be assigned to the given sstable. It
+// must be called before the prefix is set, since the hash depends on it.
+func (s KeyScheme) Prefix(m *Meta) string {
+	switch s {
+	case HashedKeys:
+		h := fnv.New32a()
+		h.Write([]byte(m.Filename()))
+		return fmt.Sprintf("%04x/", h.Sum32()&0xffff)
+	case DateKeys:
+		return m.Created.UTC().Format("2006/01/02/")
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,187 @@
+package sstable
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+)
+
+// recordOverhead is roughly the memory used by a record apart from its key,
+// document, and idempotency key.
+const recordOverhead = 128
+
+// SpillWriter is like Writer, but doesn't need every record to fit in memory.
+// Records are buffered until they exceed the memory limit, then sorted and
+// written ("spilled") to a temporary file. Write merges the spilled runs with
+// whatever is still buffered. If the limit is never reached, nothing touches
+// the disk.
+type SpillWriter struct {
+	clock clockwork.Clock
+	limit int
+	dir   string
+
+	opts  []WriterOption
+	buf   *Writer
+	size  int
+	runs  []*os.File
+	index *Index
+
+	// duplicates dropped from the runs which have been spilled so far.
+	dropped int
+}
+
+// NewSpillWriter returns a writer which buffers up to roughly limit bytes of
+// records before spilling them to a temporary file in dir. If limit is zero,
+// records are never spilled, like Writer. If dir is empty, the default temporary
+// directory is used. Close must be called to remove the temporary files.
+func NewSpillWriter(clock clockwork.Clock, limit int, dir string, opts ...WriterOption) *SpillWriter {
+	return &SpillWriter{
+		clock: clock,
+		limit: limit,
+		dir:   dir,
+		opts:  opts,
+		buf:   NewWriter(clock, opts...),
+	}
+}
+
+func (w *SpillWriter) Add(record *types.Record) error {
+	err := w.buf.Add(record)
+	if err != nil {
+		return err
+	}
+
+	w.size += len(record.Key) + len(record.Document) + len(record.IdempotencyKey) + recordOverhead
+	if w.limit > 0 && w.size >= w.limit {
+		return w.spill()
+	}
+
+	return nil
+}
+
+// Spills returns the number of times the buffer was spilled to disk.
+func (w *SpillWriter) Spills() int {
+	return len(w.runs)
+}
+
+// spill writes the buffered records to a new temporary file, as an sstable.
+func (w *SpillWriter) spill() error {
+	f, err := os.CreateTemp(w.dir, "sstable-spill-*")
+	if err != nil {
+		return fmt.Errorf("CreateTemp: %w", err)
+	}
+	w.runs = append(w.runs, f)
+
+	bw := bufio.NewWriter(f)
+	_, err = w.buf.Write(bw)
+	if err != nil {
+		return fmt.Errorf("Write: %w", err)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("Flush: %w", err)
+	}
+
+	w.dropped += w.buf.Dropped()
+	w.buf = NewWriter(w.clock, w.opts...)
+	w.size = 0
+	return nil
+}
+
+func (w *SpillWriter) Write(out io.Writer) (*Meta, error) {
+	if len(w.runs) == 0 {
+		meta, err := w.buf.Write(out)
+		if err != nil {
+			return nil, err
+		}
+
+		w.index = w.buf.Index()
+		w.dropped = w.buf.Dropped()
+		return meta, nil
+	}
+
+	// spill the rest too, so every run can be read the same way. this is a
+	// bit wasteful, but means the merge doesn't need an in-memory reader.
+	if len(w.buf.records) > 0 {
+		err := w.spill()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	readers := make([]*Reader, len(w.runs))
+	for i, f := range w.runs {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, fmt.Errorf("Seek: %w", err)
+		}
+
+		readers[i], err = NewReader(bufio.NewReader(f))
+		if err != nil {
+			return nil, fmt.Errorf("NewReader: %w", err)
+		}
+	}
+
+	mr, err := NewMergeReader(readers)
+	if err != nil {
+		return nil, fmt.Errorf("NewMergeReader: %w", err)
+	}
+
+	// each run is deduped, but copies can be in different runs, so the output
+	// is deduped again.
+	sw, err := NewSortedWriter(out, w.clock, w.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		rec, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("MergeReader.Next: %w", err)
+		}
+
+		err = sw.Add(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	meta, err := sw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	w.index = sw.Index()
+	w.dropped += sw.Dropped()
+	return meta, nil
+}
+
+// Index returns the index of the sstable, once Write has returned.
+func (w *SpillWriter) Index() *Index {
+	return w.index
+}
+
+// Dropped returns the number of duplicate records which weren't written, once
+// Write has returned. See SortedWriter.Dropped.
+func (w *SpillWriter) Dropped() int {
+	return w.dropped
+}
+
+// Close removes any temporary files.
+func (w *SpillWriter) Close() error {
+	var errs []error
+	for _, f := range w.runs {
+		errs = append(errs, f.Close(), os.Remove(f.Name()))
+	}
+
+	w.runs = nil
+	return errors.Join(errs...)
+}
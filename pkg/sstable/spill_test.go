@@ -0,0 +1,98 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/types"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillWriter(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+
+	w := NewWriter(c)
+	sw := NewSpillWriter(c, 4096, dir)
+	defer sw.Close()
+
+	// unique timestamps, so the order of versions is unambiguous.
+	ts := rng.Perm(1000)
+
+	for i := range 1000 {
+		rec := &types.Record{
+			Key:       fmt.Sprintf("key-%03d", rng.Intn(100)),
+			Timestamp: c.Now().Add(time.Duration(ts[i]) * time.Millisecond),
+			Document:  []byte(fmt.Sprintf("doc-%d", i)),
+		}
+
+		// some retried writes, which might land in different runs.
+		if i%10 == 0 {
+			rec.IdempotencyKey = "retry"
+		}
+
+		require.NoError(t, w.Add(rec))
+		require.NoError(t, sw.Add(rec))
+	}
+
+	assert.Greater(t, sw.Spills(), 1)
+
+	var want, got bytes.Buffer
+	wm, err := w.Write(&want)
+	require.NoError(t, err)
+	gm, err := sw.Write(&got)
+	require.NoError(t, err)
+
+	assert.Equal(t, wm.Count, gm.Count)
+	assert.Equal(t, wm.MinKey, gm.MinKey)
+	assert.Equal(t, wm.MaxKey, gm.MaxKey)
+	assert.Equal(t, readAll(t, &want), readAll(t, &got))
+
+	// every record is either written or dropped as a duplicate.
+	assert.Greater(t, w.Dropped(), 0)
+	assert.Equal(t, 1000, wm.Count+w.Dropped())
+	assert.Equal(t, w.Dropped(), sw.Dropped())
+
+	require.NoError(t, sw.Close())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "temp files not removed")
+}
+
+func TestSpillWriterNoLimit(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	sw := NewSpillWriter(c, 0, t.TempDir())
+	defer sw.Close()
+
+	for i := range 100 {
+		require.NoError(t, sw.Add(&types.Record{Key: fmt.Sprintf("key-%d", i), Timestamp: c.Now()}))
+	}
+
+	var buf bytes.Buffer
+	m, err := sw.Write(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 100, m.Count)
+	assert.Equal(t, 0, sw.Spills())
+}
+
+func readAll(t *testing.T, buf *bytes.Buffer) []*types.Record {
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+
+	var recs []*types.Record
+	for {
+		rec, err := r.Next()
+		require.NoError(t, err)
+		if rec == nil {
+			return recs
+		}
+		recs = append(recs, rec)
+	}
+}
@@ -1,6 +1,7 @@
 package sstable
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"slices"
@@ -9,17 +10,40 @@ import (
 
 	"github.com/adammck/blobby/pkg/types"
 	"github.com/jonboulle/clockwork"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type Writer struct {
 	records []*types.Record
 	mu      sync.Mutex
 	clock   clockwork.Clock
+	opts    []WriterOption
+	index   *Index
+	dropped int
 }
 
-func NewWriter(clock clockwork.Clock) *Writer {
+// WriterOption configures a Writer or SortedWriter.
+type WriterOption func(*SortedWriter)
+
+// WithFormat sets the format of the sstable. The default is FormatRecords.
+func WithFormat(f Format) WriterOption {
+	return func(w *SortedWriter) {
+		w.format = f
+	}
+}
+
+// WithFilter sets the type of filter in the index of the sstable. The default
+// is FilterBloom.
+func WithFilter(t FilterType) WriterOption {
+	return func(w *SortedWriter) {
+		w.ix.filter = t
+	}
+}
+
+func NewWriter(clock clockwork.Clock, opts ...WriterOption) *Writer {
 	return &Writer{
 		clock: clock,
+		opts:  opts,
 	}
 }
 
@@ -47,41 +71,272 @@ func (w *Writer) Write(out io.Writer) (*Meta, error) {
 		return b.Timestamp.Compare(a.Timestamp)
 	})
 
-	_, err := out.Write([]byte(magicBytes))
+	sw, err := NewSortedWriter(out, w.clock, w.opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	m := &Meta{
-		Created: w.clock.Now(),
-		Size:    len(magicBytes),
+	for _, record := range w.records {
+		err = sw.Add(record)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	for _, record := range w.records {
-		n, err := record.Write(out)
+	meta, err := sw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	w.index = sw.Index()
+	w.dropped = sw.Dropped()
+	return meta, nil
+}
+
+// Index returns the index of the sstable, once Write has returned.
+func (w *Writer) Index() *Index {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.index
+}
+
+// Dropped returns the number of duplicate records which weren't written, once
+// Write has returned. See SortedWriter.Dropped.
+func (w *Writer) Dropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// ErrUnsorted is returned by SortedWriter.Add when a record is out of order.
+var ErrUnsorted = errors.New("records not sorted")
+
+// SortedWriter writes records to an sstable as they're added, rather than
+// buffering them all in memory like Writer, so it can write sstables far larger
+// than memory. The records must be added in the order they're written: by key
+// ascending, then by timestamp descending. Only the versions of a single key
+// are buffered, so that retried writes can be removed.
+type SortedWriter struct {
+	out    io.Writer
+	clock  clockwork.Clock
+	format Format
+	meta   *Meta
+
+	// the versions of the current key, which haven't been written yet.
+	group []*types.Record
+
+	// the current block, if the format is FormatBlocks.
+	block blockBuilder
+
+	// builds the index as records are written. set by Close.
+	ix    indexer
+	index *Index
+
+	// the number of records removed by Dedupe.
+	dropped int
+}
+
+// NewSortedWriter writes the header of a new sstable to the given writer, and
+// returns a SortedWriter to add records to it.
+func NewSortedWriter(out io.Writer, clock clockwork.Clock, opts ...WriterOption) (*SortedWriter, error) {
+	w := &SortedWriter{
+		out:   out,
+		clock: clock,
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	magic, err := w.format.magic()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = out.Write([]byte(magic))
+	if err != nil {
+		return nil, err
+	}
+
+	w.meta = &Meta{
+		Size:   len(magic),
+		Format: w.format,
+	}
+
+	return w, nil
+}
+
+// Add writes the given record, or buffers it until every version of its key has
+// been added.
+func (w *SortedWriter) Add(record *types.Record) error {
+	if n := len(w.group); n > 0 {
+		prev := w.group[n-1]
+
+		if record.Key < prev.Key || (record.Key == prev.Key && record.Timestamp.After(prev.Timestamp)) {
+			return fmt.Errorf("%w: %s@%s after %s@%s", ErrUnsorted,
+				record.Key, record.Timestamp, prev.Key, prev.Timestamp)
+		}
+
+		if record.Key != prev.Key {
+			err := w.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	w.group = append(w.group, record)
+	return nil
+}
+
+// Close writes any buffered records and the footer, and returns the Meta of the
+// sstable. It doesn't close the underlying writer.
+func (w *SortedWriter) Close() (*Meta, error) {
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	if w.format == FormatBlocks {
+		err = w.finishBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		// a zero length marks the end of the blocks.
+		n, err := w.out.Write([]byte{0, 0, 0, 0})
 		if err != nil {
-			return nil, fmt.Errorf("record.Write: %w", err)
+			return nil, err
 		}
+		w.meta.Size += n
+	}
+
+	w.meta.Created = w.clock.Now()
+
+	w.index, err = w.ix.build()
+	if err != nil {
+		return nil, err
+	}
 
-		m.Count++
-		m.Size += n
+	err = writeFooter(w.out, w.meta)
+	if err != nil {
+		return nil, fmt.Errorf("writeFooter: %w", err)
+	}
+
+	return w.meta, nil
+}
+
+// Index returns the index of the sstable, once Close has returned.
+func (w *SortedWriter) Index() *Index {
+	return w.index
+}
+
+// Dropped returns the number of records which were added but not written,
+// because they were duplicates of another record (see Dedupe).
+func (w *SortedWriter) Dropped() int {
+	return w.dropped
+}
+
+// flush writes the buffered versions of the current key.
+func (w *SortedWriter) flush() error {
+	if len(w.group) > 0 {
+		w.ix.addKey(w.group[0].Key)
+	}
+
+	n := len(w.group)
+	kept := Dedupe(w.group)
+	w.dropped += n - len(kept)
 
-		if m.MinKey == "" || record.Key < m.MinKey {
-			m.MinKey = record.Key
+	for _, record := range kept {
+		if w.format == FormatBlocks {
+			err := w.addToBlock(record)
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
-		if m.MaxKey == "" || record.Key > m.MaxKey {
-			m.MaxKey = record.Key
+		w.ix.observe(record.Key, len(record.Document), int64(w.meta.Size), false)
+
+		n, err := record.Write(w.out)
+		if err != nil {
+			return fmt.Errorf("record.Write: %w", err)
 		}
 
-		if m.MinTime.IsZero() || record.Timestamp.Before(m.MinTime) {
-			m.MinTime = record.Timestamp
+		w.meta.observe(record, n, n)
+	}
+
+	w.group = w.group[:0]
+	return nil
+}
+
+// addToBlock adds the given record to the current block, and writes the block
+// if it's full. The size of the record is counted when the block is written.
+func (w *SortedWriter) addToBlock(record *types.Record) error {
+	raw, err := bson.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("bson.Marshal: %w", err)
+	}
+
+	// blocks can only be read from the start, so each one is indexed.
+	w.ix.observe(record.Key, len(record.Document), int64(w.meta.Size), w.block.empty())
+
+	err = w.block.add(raw)
+	if err != nil {
+		return err
+	}
+
+	w.meta.observe(record, 0, len(raw))
+
+	if w.block.size() >= BlockSize {
+		return w.finishBlock()
+	}
+
+	return nil
+}
+
+func (w *SortedWriter) finishBlock() error {
+	if w.block.empty() {
+		return nil
+	}
+
+	n, err := w.block.finish(w.out)
+	if err != nil {
+		return fmt.Errorf("block.finish: %w", err)
+	}
+
+	w.meta.Size += n
+	return nil
+}
+
+// Dedupe removes retried writes from the given sorted records, i.e. those with
+// the same key and idempotency key as an older record. The oldest is kept,
+// since that's when the write actually happened. Records with the same key and
+// timestamp are also removed, since they're copies of the same write, which can
+// end up in two memtables if one is rotated while the write is in flight. The
+// result reuses the backing array of the given slice.
+func Dedupe(records []*types.Record) []*types.Record {
+	type ik struct{ key, idem string }
+
+	// records are sorted newest first within each key, so the last one seen is
+	// the oldest.
+	oldest := map[ik]int{}
+	for i, r := range records {
+		if r.IdempotencyKey != "" {
+			oldest[ik{r.Key, r.IdempotencyKey}] = i
 		}
+	}
 
-		if m.MaxTime.IsZero() || record.Timestamp.After(m.MaxTime) {
-			m.MaxTime = record.Timestamp
+	out := records[:0]
+	for i, r := range records {
+		if r.IdempotencyKey != "" && oldest[ik{r.Key, r.IdempotencyKey}] != i {
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1].Key == r.Key && out[n-1].Timestamp.Equal(r.Timestamp) {
+			continue
 		}
+		out = append(out, r)
 	}
 
-	return m, nil
+	return out
 }
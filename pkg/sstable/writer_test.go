@@ -3,6 +3,8 @@ package sstable
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -156,3 +158,113 @@ func newWriter() (*Writer, clockwork.Clock) {
 	w := NewWriter(c)
 	return w, c
 }
+
+func TestWriteDedupesIdempotencyKeys(t *testing.T) {
+	w, c := newWriter()
+	ts := c.Now()
+
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: ts, Document: []byte("doc1"), IdempotencyKey: "a"})
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: ts.Add(1 * time.Second), Document: []byte("doc2")})
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: ts.Add(2 * time.Second), Document: []byte("doc1"), IdempotencyKey: "a"}) // retry
+	_ = w.Add(&types.Record{Key: "key2", Timestamp: ts, Document: []byte("doc3"), IdempotencyKey: "a"})                      // other key
+
+	var buf bytes.Buffer
+	meta, err := w.Write(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 3, meta.Count)
+	assert.Equal(t, ts.Add(1*time.Second), meta.MaxTime)
+}
+
+func TestWriteDedupesCopies(t *testing.T) {
+	w, c := newWriter()
+	ts := c.Now()
+
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: ts, Document: []byte("doc1")})
+	_ = w.Add(&types.Record{Key: "key1", Timestamp: ts, Document: []byte("doc1")}) // copy
+	_ = w.Add(&types.Record{Key: "key2", Timestamp: ts, Document: []byte("doc2")})
+
+	var buf bytes.Buffer
+	meta, err := w.Write(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, meta.Count)
+}
+
+func TestWriteEdgeCaseKeys(t *testing.T) {
+	w, c := newWriter()
+	long := strings.Repeat("z", 4096)
+
+	for _, k := range []string{"b", "", long, "é", "日本"} {
+		_ = w.Add(&types.Record{Key: k, Timestamp: c.Now(), Document: []byte("doc")})
+	}
+
+	var buf bytes.Buffer
+	meta, err := w.Write(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 5, meta.Count)
+	assert.Equal(t, "", meta.MinKey)
+	assert.Equal(t, "日本", meta.MaxKey) // byte order, like mongo
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	var keys []string
+	for {
+		rec, err := r.Next()
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		keys = append(keys, rec.Key)
+	}
+	assert.Equal(t, []string{"", "b", long, "é", "日本"}, keys)
+}
+
+func TestSortedWriter(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	ts := c.Now()
+
+	var buf bytes.Buffer
+	w, err := NewSortedWriter(&buf, c)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Add(&types.Record{Key: "a", Timestamp: ts.Add(time.Second), Document: []byte("a2")}))
+	require.NoError(t, w.Add(&types.Record{Key: "a", Timestamp: ts, Document: []byte("a1")}))
+	require.NoError(t, w.Add(&types.Record{Key: "a", Timestamp: ts, Document: []byte("a1")})) // copy
+	require.NoError(t, w.Add(&types.Record{Key: "b", Timestamp: ts, Document: []byte("b1")}))
+
+	meta, err := w.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 3, meta.Count)
+	assert.Equal(t, "a", meta.MinKey)
+	assert.Equal(t, "b", meta.MaxKey)
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+
+	var docs []string
+	for {
+		rec, err := r.Next()
+		require.NoError(t, err)
+		if rec == nil {
+			break
+		}
+		docs = append(docs, string(rec.Document))
+	}
+
+	assert.Equal(t, []string{"a2", "a1", "b1"}, docs)
+	assert.Equal(t, meta.Count, r.Footer().Count)
+}
+
+func TestSortedWriterUnsorted(t *testing.T) {
+	c := clockwork.NewFakeClock()
+	ts := c.Now()
+
+	w, err := NewSortedWriter(io.Discard, c)
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&types.Record{Key: "b", Timestamp: ts}))
+
+	err = w.Add(&types.Record{Key: "a", Timestamp: ts})
+	assert.ErrorIs(t, err, ErrUnsorted)
+
+	err = w.Add(&types.Record{Key: "b", Timestamp: ts.Add(time.Second)})
+	assert.ErrorIs(t, err, ErrUnsorted)
+}
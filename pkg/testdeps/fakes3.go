@@ -0,0 +1,275 @@
+package testdeps
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3 is an in-memory implementation of the small subset of the S3 API used
+// by the blobstore: path-style object put, get (with ranges and If-None-Match),
+// delete, listing, and bucket creation. It's nowhere near a complete S3, but
+// it's enough to run blobstore tests in milliseconds without a container.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+}
+
+type fakeObject struct {
+	body     []byte
+	modified time.Time
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	f := &fakeS3{buckets: map[string]map[string]*fakeObject{}}
+	for _, b := range buckets {
+		f.buckets[b] = map[string]*fakeObject{}
+	}
+	return f
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodPut:
+			if _, ok := f.buckets[bucket]; !ok {
+				f.buckets[bucket] = map[string]*fakeObject{}
+			}
+		case http.MethodHead:
+			if _, ok := f.buckets[bucket]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodGet:
+			f.list(w, r, bucket)
+		default:
+			s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+		}
+		return
+	}
+
+	objs, ok := f.buckets[bucket]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if _, exists := objs[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", key)
+			return
+		}
+
+		body, err := readBody(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+
+		objs[key] = &fakeObject{body: body, modified: time.Now().UTC()}
+		w.Header().Set("ETag", etag(body))
+
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objs[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag(obj.body) {
+			w.Header().Set("ETag", inm)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		body := obj.body
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, len(body))
+			if !ok {
+				s3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(body)))
+			body = body[start:end]
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(obj.body))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+
+	case http.MethodDelete:
+		delete(objs, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+type listResult struct {
+	XMLName     xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []listContent `xml:"Contents"`
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+// list responds to ListObjectsV2. Every matching object is returned in a single
+// page, since tests never have enough for pagination to matter.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	objs, ok := f.buckets[bucket]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+
+	for k, obj := range objs {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		res.Contents = append(res.Contents, listContent{
+			Key:          k,
+			LastModified: obj.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(obj.body),
+			Size:         len(obj.body),
+		})
+	}
+
+	sort.Slice(res.Contents, func(i, j int) bool {
+		return res.Contents[i].Key < res.Contents[j].Key
+	})
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+// readBody returns the body of a put, decoding the aws-chunked encoding which
+// the SDK uses when it sends trailing checksums.
+func readBody(r *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return b, nil
+	}
+
+	var out []byte
+	for {
+		line, rest, ok := strings.Cut(string(b), "\r\n")
+		if !ok {
+			return nil, fmt.Errorf("truncated chunk header")
+		}
+
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad chunk size: %q", line)
+		}
+		if n == 0 {
+			return out, nil
+		}
+		if int64(len(rest)) < n+2 {
+			return nil, fmt.Errorf("truncated chunk")
+		}
+
+		out = append(out, rest[:n]...)
+		b = []byte(rest[n+2:])
+	}
+}
+
+// parseRange returns the half-open byte range [start, end) requested by the
+// given Range header, which may be a suffix range like "bytes=-10".
+func parseRange(h string, size int) (int, int, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < start {
+			return 0, 0, false
+		}
+		end = min(n+1, size)
+	}
+
+	return start, end, true
+}
+
+func etag(b []byte) string {
+	var h uint32 = 2166136261
+	for _, c := range b {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return fmt.Sprintf("\"%08x\"", h)
+}
+
+func s3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, msg)
+}
+
+func (e *Env) startFakeS3() {
+	srv := httptest.NewServer(newFakeS3(e.S3Bucket))
+	e.t.Cleanup(srv.Close)
+	e.S3URI = srv.URL
+
+	// TODO: inject these via testEnv
+	e.t.Setenv("AWS_ACCESS_KEY_ID", e.S3Key)
+	e.t.Setenv("AWS_SECRET_ACCESS_KEY", e.S3Secret)
+	e.t.Setenv("AWS_ENDPOINT_URL_S3", e.S3URI)
+	e.t.Setenv("AWS_REGION", "auto")
+}
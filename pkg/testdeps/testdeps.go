@@ -1,3 +1,6 @@
+// Package testdeps starts the backends which tests run against: Mongo and Minio
+// in containers, or an in-memory fake of S3 (see WithFakeS3). The fakes of the
+// memtable and metadata store are in the blobbytest package.
 package testdeps
 
 import (
@@ -21,7 +24,7 @@ const (
 )
 
 type Env struct {
-	t   *testing.T
+	t   testing.TB
 	cfg *config
 
 	mongoURL string
@@ -36,8 +39,9 @@ type Env struct {
 type Option func(*config)
 
 type config struct {
-	useMongo bool
-	useMinio bool
+	useMongo  bool
+	useMinio  bool
+	useFakeS3 bool
 }
 
 func WithMongo() Option {
@@ -52,18 +56,28 @@ func WithMinio() Option {
 	}
 }
 
-func New(ctx context.Context, t *testing.T, opts ...Option) *Env {
-	t.Helper()
-
-	if os.Getenv("SKIP_INTEGRATION") == "1" {
-		t.Skip("Skipping integration test")
+// WithFakeS3 serves an in-memory fake of S3 from this process, rather than
+// running Minio in a container. It only supports what the blobstore needs, but
+// starts instantly, so doesn't need SKIP_INTEGRATION to be unset. Don't combine
+// with WithMinio.
+func WithFakeS3() Option {
+	return func(c *config) {
+		c.useFakeS3 = true
 	}
+}
+
+func New(ctx context.Context, t testing.TB, opts ...Option) *Env {
+	t.Helper()
 
 	cfg := &config{}
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
+	if (cfg.useMongo || cfg.useMinio) && os.Getenv("SKIP_INTEGRATION") == "1" {
+		t.Skip("Skipping integration test")
+	}
+
 	env := &Env{
 		cfg:      cfg,
 		S3Bucket: bucket,
@@ -80,6 +94,10 @@ func New(ctx context.Context, t *testing.T, opts ...Option) *Env {
 		env.startMinio(ctx)
 	}
 
+	if cfg.useFakeS3 {
+		env.startFakeS3()
+	}
+
 	t.Cleanup(func() {
 		for _, c := range env.containers {
 			c.Terminate(ctx)
@@ -2,17 +2,54 @@ package types
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
+// MaxDocumentSize is the largest BSON document which will be read. It's the
+// same as Mongo's limit, so every record which can be in a memtable fits, and
+// corrupt length prefixes can't cause huge allocations.
+const MaxDocumentSize = 16 * 1024 * 1024
+
 type Record struct {
 	Key       string    `bson:"key"`
 	Timestamp time.Time `bson:"ts"`
 	Document  []byte    `bson:"doc"`
+
+	// The ID of the codec which the Document was encoded with, or empty if it
+	// wasn't encoded. See the codec package.
+	Codec string `bson:"codec,omitempty"`
+
+	// Arbitrary user-defined attributes, e.g. content-type or origin. These are
+	// not encoded by the codec.
+	Tags map[string]string `bson:"tags,omitempty"`
+
+	// An optional token provided by the writer, so that retried writes of the
+	// same record can be recognized and dropped. Only unique per key.
+	IdempotencyKey string `bson:"idem,omitempty"`
+
+	// When the record expires from the memtable, if it's in a namespace with a
+	// TTL. Mongo deletes it soon after, and it's skipped if it's still there
+	// when the memtable is flushed. Records which are flushed before they expire
+	// are kept, like any other.
+	Expires time.Time `bson:"expires,omitempty"`
+}
+
+// MatchTags returns true if the record has all of the given tags, with the same
+// values. An empty filter matches every record.
+func (r *Record) MatchTags(filter map[string]string) bool {
+	for k, v := range filter {
+		if rv, ok := r.Tags[k]; !ok || rv != v {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (r *Record) Write(out io.Writer) (int, error) {
@@ -25,6 +62,32 @@ func (r *Record) Write(out io.Writer) (int, error) {
 }
 
 func Read(r io.Reader) (*Record, error) {
+	b, err := ReadRaw(r)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	rec := &Record{}
+	if err := Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Unmarshal is like bson.Unmarshal, but validates the document first, since the
+// driver can panic on malformed input.
+func Unmarshal(b bson.Raw, v any) error {
+	if err := Validate(b); err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(b, v)
+}
+
+// ReadRaw reads the next BSON document from the given reader, without decoding
+// it. It returns nil at EOF.
+func ReadRaw(r io.Reader) (bson.Raw, error) {
 	b, err := readOne(r)
 	if err != nil {
 		if err == io.EOF {
@@ -33,32 +96,136 @@ func Read(r io.Reader) (*Record, error) {
 		return nil, err
 	}
 
-	rec := &Record{}
-	if err := bson.Unmarshal(b, rec); err != nil {
-		return nil, err
+	return bson.Raw(b), nil
+}
+
+// ReadRawInto is like ReadRaw, but reads into buf if it's large enough, rather
+// than allocating. The document aliases buf, so is only valid until buf is
+// reused. The buffer is returned too, since it might have been grown.
+func ReadRawInto(r io.Reader, buf []byte) (bson.Raw, []byte, error) {
+	b, err := readInto(r, buf)
+	if err != nil {
+		if err == io.EOF {
+			return nil, buf, nil
+		}
+		return nil, buf, err
 	}
 
-	return rec, nil
+	return bson.Raw(b), b[:0], nil
+}
+
+// Validate returns an error if the given document is malformed. The driver can
+// panic on malformed input, so documents from untrusted sources should be
+// validated before anything else is done with them. Unmarshal does this.
+func Validate(b bson.Raw) error {
+	if len(b) < 5 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return fmt.Errorf("invalid BSON document length")
+	}
+
+	return validateDoc(bsoncore.Document(b), 0)
+}
+
+// maxDepth is how deeply documents can be nested, like in Mongo.
+const maxDepth = 100
+
+// validateDoc is like bsoncore.Document.Validate, which only checks the length
+// of embedded documents and arrays, but validates them too.
+func validateDoc(d bsoncore.Document, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("BSON document nested too deeply")
+	}
+
+	err := d.Validate()
+	if err != nil {
+		return err
+	}
+
+	elems, err := d.Elements()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range elems {
+		v := e.Value()
+		switch v.Type {
+		case bsontype.EmbeddedDocument, bsontype.Array:
+			err = validateDoc(v.Data, depth+1)
+
+		case bsontype.CodeWithScope:
+			_, scope, ok := v.CodeWithScopeOK()
+			if !ok {
+				return fmt.Errorf("invalid BSON code with scope")
+			}
+			err = validateDoc(scope, depth+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RawKey returns the key of the given encoded record, without decoding the rest
+// of it. It aliases the record, so doesn't allocate.
+func RawKey(b bson.Raw) ([]byte, bool) {
+	v, err := b.LookupErr("key")
+	if err != nil || v.Type != bson.TypeString {
+		return nil, false
+	}
+
+	// an int32 length (including the trailing NUL), the string, then a NUL.
+	if len(v.Value) < 5 {
+		return nil, false
+	}
+
+	return v.Value[4 : len(v.Value)-1], true
+}
+
+// RawTimestamp returns the timestamp of the given encoded record, without
+// decoding the rest of it.
+func RawTimestamp(b bson.Raw) (time.Time, bool) {
+	v, err := b.LookupErr("ts")
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return v.TimeOK()
 }
 
 func readOne(r io.Reader) ([]byte, error) {
+	return readInto(r, nil)
+}
+
+func readInto(r io.Reader, buf []byte) ([]byte, error) {
 	// see: https://bsonspec.org/spec.html
 
-	var sizeBytes [4]byte
-	if _, err := io.ReadFull(r, sizeBytes[:]); err != nil {
+	// the size is read into buf (rather than an array on the stack) since it
+	// would escape via the reader and be allocated for every record.
+	if cap(buf) < 4 {
+		buf = make([]byte, 0, 4)
+	}
+	sizeBytes := buf[:4]
+	if _, err := io.ReadFull(r, sizeBytes); err != nil {
 		if err == io.EOF {
 			return nil, io.EOF
 		}
 		return nil, err
 	}
 
-	size := int(binary.LittleEndian.Uint32(sizeBytes[:]))
-	if size < 5 {
-		return nil, errors.New("invalid BSON document length")
+	size := int(binary.LittleEndian.Uint32(sizeBytes))
+	if size < 5 || size > MaxDocumentSize {
+		return nil, fmt.Errorf("invalid BSON document length: %d", size)
+	}
+
+	var docBytes []byte
+	if cap(buf) >= size {
+		docBytes = buf[:size]
+	} else {
+		docBytes = make([]byte, size)
+		copy(docBytes[0:4], sizeBytes)
 	}
 
-	docBytes := make([]byte, size)
-	copy(docBytes[0:4], sizeBytes[:])
 	if _, err := io.ReadFull(r, docBytes[4:]); err != nil {
 		return nil, err
 	}
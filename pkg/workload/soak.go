@@ -0,0 +1,209 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+// SoakConfig describes a sustained workload, run by Soak.
+type SoakConfig struct {
+	Config
+
+	// QPS limits the rate of puts and gets. Zero is unlimited.
+	QPS int
+
+	// Duration is how long to run for. Zero runs until the context is done.
+	Duration time.Duration
+
+	// FlushInterval and CompactInterval are how often to flush and compact, in
+	// the background, concurrently with the puts and gets. Zero disables them.
+	// The FlushEvery and CompactEvery fields of Config are ignored.
+	FlushInterval   time.Duration
+	CompactInterval time.Duration
+
+	// OnReport, if set, is called every ReportInterval with what was measured
+	// during the interval.
+	ReportInterval time.Duration
+	OnReport       func(*Result)
+}
+
+// ErrMismatch is returned by Soak when a get doesn't return the value of the
+// latest put of the same key.
+var ErrMismatch = errors.New("read didn't match last write")
+
+// Soak runs the given workload against the given archive until the duration
+// elapses or the context is cancelled, checking that every get of a key which
+// was put during the run returns the latest value. It returns the cumulative
+// result, and the first error (which might be ErrMismatch), if any.
+func Soak(ctx context.Context, b *blobby.Blobby, cfg SoakConfig) (*Result, error) {
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	var mu sync.Mutex
+	total := &Result{}
+	cur := &Result{}
+
+	// merges a result into the current interval.
+	record := func(r *Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		cur.add(r)
+	}
+
+	start := time.Now()
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		gen := NewGenerator(cfg.Config)
+		v := &validator{last: map[string]uint64{}}
+
+		lim := rate.NewLimiter(rate.Inf, 1)
+		if cfg.QPS > 0 {
+			lim = rate.NewLimiter(rate.Limit(cfg.QPS), 1)
+		}
+
+		for {
+			if lim.Wait(ctx) != nil {
+				return nil
+			}
+
+			r := &Result{}
+			err := step(ctx, b, gen, r, v)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			record(r)
+		}
+	})
+
+	every(ctx, g, cfg.FlushInterval, func() error {
+		r := &Result{}
+		err := flush(ctx, b, r)
+		if errors.Is(err, blobby.ErrFlushInProgress) || errors.Is(err, blobby.ErrPaused) {
+			return nil
+		}
+		record(r)
+		return err
+	})
+
+	every(ctx, g, cfg.CompactInterval, func() error {
+		r := &Result{}
+		err := compact(ctx, b, r)
+		record(r)
+		return err
+	})
+
+	last := start
+	report := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		cur.Elapsed = now.Sub(last)
+		last = now
+
+		if cfg.OnReport != nil {
+			cfg.OnReport(cur)
+		}
+
+		total.add(cur)
+		cur = &Result{}
+	}
+
+	every(ctx, g, cfg.ReportInterval, func() error {
+		report()
+		return nil
+	})
+
+	err := g.Wait()
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		err = nil
+	}
+
+	report()
+	total.Elapsed = time.Since(start)
+	return total, err
+}
+
+// every calls fn every interval in the given group, until the context is done
+// or fn returns an error. It does nothing if interval is zero.
+func every(ctx context.Context, g *errgroup.Group, interval time.Duration, fn func() error) {
+	if interval <= 0 {
+		return
+	}
+
+	g.Go(func() error {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.C:
+				err := fn()
+				if err != nil && ctx.Err() == nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// add accumulates o into r. Elapsed isn't touched.
+func (r *Result) add(o *Result) {
+	r.Puts += o.Puts
+	r.Gets += o.Gets
+	r.Flushes += o.Flushes
+	r.PutLatency = append(r.PutLatency, o.PutLatency...)
+	r.GetLatency = append(r.GetLatency, o.GetLatency...)
+	r.BytesPut += o.BytesPut
+	r.BytesWritten += o.BytesWritten
+	r.BlobsFetched += o.BlobsFetched
+	r.RecordsScanned += o.RecordsScanned
+}
+
+// validator remembers a hash of the last value put for each key, to check that
+// gets return it. Keys which weren't put aren't checked, since the archive
+// might already contain them.
+type validator struct {
+	last map[string]uint64
+}
+
+func (v *validator) put(key string, value []byte) {
+	v.last[key] = hash(value)
+}
+
+func (v *validator) check(key string, value []byte, src string) error {
+	h, ok := v.last[key]
+	if !ok {
+		return nil
+	}
+
+	if hash(value) != h {
+		return fmt.Errorf("%w: key=%s, src=%s", ErrMismatch, key, src)
+	}
+
+	return nil
+}
+
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
@@ -0,0 +1,281 @@
+// Package workload generates synthetic workloads against an archive, and
+// measures how it performs: throughput, latency percentiles, and read and write
+// amplification. It's used by the benchmarks and the bench command.
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+)
+
+// Config describes a workload.
+type Config struct {
+	// ReadPercent is the percentage of operations which are gets. The rest are
+	// puts.
+	ReadPercent int
+
+	// Keys is the number of distinct keys.
+	Keys int
+
+	// Zipf chooses keys from a zipfian distribution, so a few keys are very hot
+	// and most are cold. Otherwise, keys are chosen uniformly.
+	Zipf bool
+
+	// ValueSize is the size in bytes of each value written. If MaxValueSize
+	// is greater, sizes are chosen uniformly between the two.
+	ValueSize    int
+	MaxValueSize int
+
+	// FlushEvery and CompactEvery are the number of operations between flushes
+	// and compactions. Zero disables them.
+	FlushEvery   int
+	CompactEvery int
+
+	// Seed seeds the random choices, so runs are repeatable.
+	Seed int64
+}
+
+// Presets are some typical workloads, by name.
+var Presets = map[string]Config{
+	"write-heavy": {ReadPercent: 10, Keys: 10000, ValueSize: 256, FlushEvery: 1000, CompactEvery: 10000},
+	"read-heavy":  {ReadPercent: 90, Keys: 10000, ValueSize: 256, FlushEvery: 1000, CompactEvery: 10000},
+	"zipfian":     {ReadPercent: 50, Keys: 10000, ValueSize: 256, FlushEvery: 1000, CompactEvery: 10000, Zipf: true},
+}
+
+// Result is what was measured by Run.
+type Result struct {
+	Puts    int
+	Gets    int
+	Flushes int
+	Elapsed time.Duration
+
+	PutLatency Latencies
+	GetLatency Latencies
+
+	// bytes given to Put, and written to the blobstore by flushes and
+	// compactions.
+	BytesPut     int64
+	BytesWritten int64
+
+	// accumulated from the stats of every get.
+	BlobsFetched   int
+	RecordsScanned int
+}
+
+// Throughput returns the number of puts and gets per second.
+func (r *Result) Throughput() float64 {
+	if r.Elapsed == 0 {
+		return 0
+	}
+
+	return float64(r.Puts+r.Gets) / r.Elapsed.Seconds()
+}
+
+// WriteAmp returns the number of bytes written to the blobstore per byte put.
+// Flushed bytes include the encoding overhead, so this is a bit above one even
+// with no compaction.
+func (r *Result) WriteAmp() float64 {
+	if r.BytesPut == 0 {
+		return 0
+	}
+
+	return float64(r.BytesWritten) / float64(r.BytesPut)
+}
+
+// ReadAmp returns the mean number of blobs fetched per get.
+func (r *Result) ReadAmp() float64 {
+	if r.Gets == 0 {
+		return 0
+	}
+
+	return float64(r.BlobsFetched) / float64(r.Gets)
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%d puts, %d gets, %d flushes in %s (%.0f ops/s)\n"+
+		"put latency: %s\n"+
+		"get latency: %s\n"+
+		"write amp: %.2f, read amp: %.2f blobs/get (%d records scanned)",
+		r.Puts, r.Gets, r.Flushes, r.Elapsed.Round(time.Millisecond), r.Throughput(),
+		r.PutLatency, r.GetLatency,
+		r.WriteAmp(), r.ReadAmp(), r.RecordsScanned)
+}
+
+// Latencies is a set of observed latencies.
+type Latencies []time.Duration
+
+// Percentile returns the latency which p percent of observations were at or
+// below, or zero if there are no observations.
+func (l Latencies) Percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+
+	s := slices.Clone(l)
+	slices.Sort(s)
+	i := int(float64(len(s)-1) * p / 100)
+	return s[i]
+}
+
+func (l Latencies) String() string {
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s",
+		l.Percentile(50), l.Percentile(90), l.Percentile(99), l.Percentile(100))
+}
+
+// Generator chooses keys and values per a Config.
+type Generator struct {
+	cfg  Config
+	rand *rand.Rand
+	zipf *rand.Zipf
+}
+
+func NewGenerator(cfg Config) *Generator {
+	r := rand.New(rand.NewSource(cfg.Seed))
+	g := &Generator{cfg: cfg, rand: r}
+
+	if cfg.Zipf && cfg.Keys > 1 {
+		g.zipf = rand.NewZipf(r, 1.1, 1, uint64(cfg.Keys-1))
+	}
+
+	return g
+}
+
+// Key returns a random key.
+func (g *Generator) Key() string {
+	var n uint64
+	if g.zipf != nil {
+		n = g.zipf.Uint64()
+	} else {
+		n = uint64(g.rand.Intn(max(g.cfg.Keys, 1)))
+	}
+
+	return fmt.Sprintf("key-%08d", n)
+}
+
+// Value returns a random value.
+func (g *Generator) Value() []byte {
+	n := g.cfg.ValueSize
+	if g.cfg.MaxValueSize > n {
+		n += g.rand.Intn(g.cfg.MaxValueSize - n + 1)
+	}
+
+	b := make([]byte, n)
+	g.rand.Read(b)
+	return b
+}
+
+// Read returns true if the next operation should be a get.
+func (g *Generator) Read() bool {
+	return g.rand.Intn(100) < g.cfg.ReadPercent
+}
+
+// Run performs n operations against the given archive, per the given config,
+// and returns what it measured. It stops at the first error.
+func Run(ctx context.Context, b *blobby.Blobby, cfg Config, n int) (*Result, error) {
+	g := NewGenerator(cfg)
+	res := &Result{}
+	start := time.Now()
+
+	for i := 1; i <= n; i++ {
+		err := step(ctx, b, g, res, nil)
+		if err != nil {
+			return res, err
+		}
+
+		if cfg.FlushEvery > 0 && i%cfg.FlushEvery == 0 {
+			err := flush(ctx, b, res)
+			if err != nil {
+				return res, err
+			}
+		}
+
+		if cfg.CompactEvery > 0 && i%cfg.CompactEvery == 0 {
+			err := compact(ctx, b, res)
+			if err != nil {
+				return res, err
+			}
+		}
+	}
+
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
+
+// step performs a single random get or put, and records it in res. If v isn't
+// nil, puts are remembered, and gets are checked against them.
+func step(ctx context.Context, b *blobby.Blobby, g *Generator, res *Result, v *validator) error {
+	key := g.Key()
+
+	if g.Read() {
+		t := time.Now()
+		value, stats, err := b.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("Get: %w", err)
+		}
+		res.GetLatency = append(res.GetLatency, time.Since(t))
+		res.Gets++
+		res.BlobsFetched += stats.BlobsFetched
+		res.RecordsScanned += stats.RecordsScanned
+
+		if v != nil {
+			return v.check(key, value, stats.Source)
+		}
+		return nil
+	}
+
+	value := g.Value()
+	t := time.Now()
+	_, err := b.Put(ctx, key, value)
+	if err != nil {
+		return fmt.Errorf("Put: %w", err)
+	}
+	res.PutLatency = append(res.PutLatency, time.Since(t))
+	res.Puts++
+	res.BytesPut += int64(len(value))
+
+	if v != nil {
+		v.put(key, value)
+	}
+	return nil
+}
+
+func flush(ctx context.Context, b *blobby.Blobby, res *Result) error {
+	stats, err := b.Flush(ctx, blobby.FlushOptions{})
+	if err != nil {
+		return fmt.Errorf("Flush: %w", err)
+	}
+
+	if !stats.Skipped {
+		res.Flushes++
+		res.BytesWritten += int64(stats.Meta.Size)
+	}
+
+	return nil
+}
+
+func compact(ctx context.Context, b *blobby.Blobby, res *Result) error {
+	stats, err := b.Compact(ctx, blobby.CompactionOptions{})
+	if errors.Is(err, blobby.ErrOutsideMaintenanceWindow) || errors.Is(err, blobby.ErrPaused) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Compact: %w", err)
+	}
+
+	for _, s := range stats {
+		if s.Error != nil {
+			return fmt.Errorf("Compact: %w", s.Error)
+		}
+		for _, m := range s.Outputs {
+			res.BytesWritten += int64(m.Size)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/adammck/blobby/pkg/blobby"
+	"github.com/adammck/blobby/pkg/blobbytest"
+	"github.com/adammck/blobby/pkg/testdeps"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	var l Latencies
+	assert.Equal(t, time.Duration(0), l.Percentile(50))
+
+	for i := 100; i >= 1; i-- {
+		l = append(l, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, l.Percentile(50))
+	assert.Equal(t, 99*time.Millisecond, l.Percentile(99))
+	assert.Equal(t, 100*time.Millisecond, l.Percentile(100))
+}
+
+func TestGenerator(t *testing.T) {
+	cfg := Config{Keys: 100, Zipf: true, Seed: 1}
+
+	// same seed, same keys.
+	g1, g2 := NewGenerator(cfg), NewGenerator(cfg)
+	counts := map[string]int{}
+	for range 1000 {
+		k := g1.Key()
+		assert.Equal(t, k, g2.Key())
+		counts[k]++
+	}
+
+	// zipfian keys are skewed, so the hottest key is chosen far more often
+	// than it would be uniformly.
+	var ns []int
+	for _, n := range counts {
+		ns = append(ns, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ns)))
+	assert.Greater(t, ns[0], 100)
+}
+
+// BenchmarkWorkloads runs each preset against real backends. Besides the usual
+// ns/op, it reports latency percentiles and amplification.
+func BenchmarkWorkloads(b *testing.B) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, b, testdeps.WithMongo(), testdeps.WithMinio())
+
+	benchmarkPresets(b, func(b *testing.B, run int) *blobby.Blobby {
+		a := blobby.New(env.MongoURL(), env.S3Bucket, clockwork.NewRealClock(),
+			blobby.WithName(fmt.Sprintf("bench-%d", run)))
+		require.NoError(b, a.Init(ctx))
+		return a
+	})
+}
+
+// BenchmarkWorkloadsFake is like BenchmarkWorkloads, but against the in-memory
+// fakes, so it measures the archive itself rather than the backends.
+func BenchmarkWorkloadsFake(b *testing.B) {
+	benchmarkPresets(b, func(b *testing.B, run int) *blobby.Blobby {
+		return blobbytest.NewFakeArchive(b, clockwork.NewRealClock())
+	})
+}
+
+func benchmarkPresets(b *testing.B, newArchive func(b *testing.B, run int) *blobby.Blobby) {
+	ctx := context.Background()
+
+	// each run gets a fresh archive, since the framework calls each benchmark
+	// several times with increasing N.
+	runs := 0
+
+	for name, cfg := range Presets {
+		b.Run(name, func(b *testing.B) {
+			runs++
+			a := newArchive(b, runs)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			res, err := Run(ctx, a, cfg, b.N)
+			b.StopTimer()
+			require.NoError(b, err)
+
+			b.ReportMetric(float64(res.PutLatency.Percentile(99).Microseconds()), "put-p99-µs")
+			b.ReportMetric(float64(res.GetLatency.Percentile(99).Microseconds()), "get-p99-µs")
+			b.ReportMetric(res.WriteAmp(), "write-amp")
+			b.ReportMetric(res.ReadAmp(), "blobs/get")
+		})
+	}
+}
+
+func TestValidator(t *testing.T) {
+	v := &validator{last: map[string]uint64{}}
+	assert.NoError(t, v.check("a", nil, ""))
+
+	v.put("a", []byte("one"))
+	assert.NoError(t, v.check("a", []byte("one"), ""))
+	assert.ErrorIs(t, v.check("a", []byte("two"), ""), ErrMismatch)
+	assert.ErrorIs(t, v.check("a", nil, ""), ErrMismatch)
+}
+
+func TestSoak(t *testing.T) {
+	ctx := context.Background()
+	env := testdeps.New(ctx, t, testdeps.WithMongo(), testdeps.WithMinio())
+	a := blobby.New(env.MongoURL(), env.S3Bucket, clockwork.NewRealClock())
+	require.NoError(t, a.Init(ctx))
+
+	reports := 0
+	res, err := Soak(ctx, a, SoakConfig{
+		Config:          Config{ReadPercent: 50, Keys: 100, ValueSize: 10, MaxValueSize: 100},
+		Duration:        3 * time.Second,
+		FlushInterval:   500 * time.Millisecond,
+		CompactInterval: time.Second,
+		ReportInterval:  time.Second,
+		OnReport:        func(*Result) { reports++ },
+	})
+	require.NoError(t, err)
+	assert.Greater(t, res.Puts, 0)
+	assert.Greater(t, res.Gets, 0)
+	assert.Greater(t, res.Flushes, 0)
+	assert.GreaterOrEqual(t, reports, 3)
+}